@@ -0,0 +1,65 @@
+package stacker
+
+import (
+	"net/url"
+	"strings"
+)
+
+// annotationKey is the key of one of stacker's annotations. They're
+// DefaultAnnotationPrefix + suffix; people that have their own conventions
+// can use a different prefix.
+func (opts *BuildArgs) annotationKey(annotation string) string {
+	if opts.AnnotationPrefix == "" {
+		return annotation
+	}
+	return opts.AnnotationPrefix + strings.TrimPrefix(annotation, DefaultAnnotationPrefix)
+}
+
+// stackerAnnotations returns the annotations stacker records about how a
+// layer of sf was built: the git version of the stackerfile's repo (or, if
+// it isn't in one, the stackerfile itself), where it came from, and the
+// layer's provenance, if it's known.
+func stackerAnnotations(opts *BuildArgs, sf *Stackerfile, gitVersion string, prov *Provenance) (map[string]string, error) {
+	annotations := map[string]string{}
+	if opts.NoStackerAnnotations {
+		return annotations, nil
+	}
+
+	key := opts.annotationKey
+
+	if gitVersion != "" {
+		verboseln(opts.Config, "setting git version annotation to", gitVersion)
+		annotations[key(GitVersionAnnotation)] = gitVersion
+	} else if opts.RedactSubstitutions {
+		// the stackerfile as written has the ${{FOO}}s rather than
+		// their (possibly secret) values
+		annotations[key(StackerContentsAnnotation)] = sf.beforeSubstitutions
+	} else {
+		annotations[key(StackerContentsAnnotation)] = sf.AfterSubstitutions
+	}
+
+	if sf.source != "" {
+		annotations[key(StackerSourceAnnotation)] = redactURL(sf.source)
+	}
+
+	if prov != nil {
+		value, err := provenanceAnnotation(prov)
+		if err != nil {
+			return nil, err
+		}
+		annotations[key(ProvenanceAnnotation)] = value
+	}
+
+	return annotations, nil
+}
+
+// redactURL removes any credentials from rawURL.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+
+	u.User = nil
+	return u.String()
+}
@@ -1,8 +1,8 @@
 package stacker
 
 import (
-	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -20,8 +20,15 @@ import (
 
 const (
 	MediaTypeImageBtrfsLayer  = "application/vnd.cisco.image.layer.btrfs"
-	GitVersionAnnotation      = "ws.tycho.stacker.git_version"
-	StackerContentsAnnotation = "ws.tycho.stacker.stacker_yaml"
+	DefaultAnnotationPrefix   = "ws.tycho.stacker"
+	GitVersionAnnotation      = DefaultAnnotationPrefix + ".git_version"
+	StackerContentsAnnotation = DefaultAnnotationPrefix + ".stacker_yaml"
+	StackerSourceAnnotation   = DefaultAnnotationPrefix + ".source"
+	ProvenanceAnnotation      = DefaultAnnotationPrefix + ".provenance"
+
+	// VerityRootHashAnnotation is set on squashfs layers that have a
+	// dm-verity hash tree appended to them, to the tree's root hash.
+	VerityRootHashAnnotation = DefaultAnnotationPrefix + ".squashfs_verity_root_hash"
 )
 
 // StackerConfig is a struct that contains global (or widely used) stacker
@@ -30,11 +37,169 @@ type StackerConfig struct {
 	StackerDir string `yaml:"stacker_dir"`
 	OCIDir     string `yaml:"oci_dir"`
 	RootFSDir  string `yaml:"rootfs_dir"`
+
+	// SharedBlobDir is a content addressed blob store shared by all the
+	// projects on the host. If it is set, the blobs in OCIDir and the
+	// import layout are hardlinked with the ones in it after each build,
+	// so identical layers are only stored once. It must be on the same
+	// filesystem as OCIDir and StackerDir.
+	SharedBlobDir string `yaml:"shared_blob_dir"`
+
+	// BaseImageCacheDir is the OCI layout that images imported from
+	// registries are cached in, keyed by their manifest digest. It
+	// defaults to the import layout under StackerDir, and can be shared
+	// by several projects so that each image is only downloaded once.
+	BaseImageCacheDir string `yaml:"base_image_cache_dir"`
+
+	// StorageType is the kind of storage the rootfses of layers are kept
+	// in: "btrfs" (the default), "zfs", "lvm" (thin logical volumes), or
+	// "dir" (plain directories, copied instead of snapshotted).
+	StorageType string `yaml:"storage_type"`
+
+	// ZFSDataset is the dataset (e.g. "tank/stacker") the rootfses are
+	// kept in datasets under, for zfs storage. They're mounted in
+	// RootFSDir.
+	ZFSDataset string `yaml:"zfs_dataset"`
+
+	// LVMVolumeGroup and LVMThinPool are the thin pool the rootfses are
+	// kept in thin volumes of, for lvm storage, each LVMVolumeSize (100GB
+	// by default) big. They're mounted in RootFSDir.
+	LVMVolumeGroup string `yaml:"lvm_volume_group"`
+	LVMThinPool    string `yaml:"lvm_thin_pool"`
+	LVMVolumeSize  string `yaml:"lvm_volume_size"`
+
+	// LayerType is the type of layers that are generated by default,
+	// "tar" (the default) or "squashfs".
+	LayerType string `yaml:"layer_type"`
+
+	// RegistryAuth is the credentials to use for docker registries.
+	// Credentials given to the build itself override these.
+	RegistryAuth RegistryAuth `yaml:"registry_auth"`
+
+	// RegistryMirrors maps docker registry hosts (e.g. "docker.io") to a
+	// mirror (e.g. "mirror.example.com:5000") that base images from that
+	// registry are pulled from instead.
+	RegistryMirrors map[string]string `yaml:"registry_mirrors"`
+
+	// RegistryTLS is how to connect to docker registries, by host (e.g.
+	// "registry.example.com:5000"), when pulling base images and saving
+	// layers.
+	RegistryTLS map[string]RegistryTLS `yaml:"registry_tls"`
+
+	// UIDMap and GIDMap are the ranges of host ids (from the user's
+	// /etc/subuid and /etc/subgid delegations) that are mapped into the
+	// user namespace unprivileged builds run in, as "nsid:hostid:range".
+	// Each one defaults to the user's first delegation of at least 65536
+	// ids; the user themselves is always root in the namespace.
+	UIDMap []string `yaml:"uid_map"`
+	GIDMap []string `yaml:"gid_map"`
+
+	// Runtime is what runs layers' commands: "lxc" (the default), or the
+	// OCI runtime binary to use instead, e.g. "runc", "crun" or
+	// "kata-runtime".
+	Runtime string `yaml:"runtime"`
+
+	// Capabilities are the capabilities layers' commands run with,
+	// instead of DefaultCapabilities; layers can add to them.
+	Capabilities []string `yaml:"capabilities"`
+
+	// SeccompProfile is the seccomp profile layers' commands run with
+	// (in the runtime's format), instead of stacker's default one, or
+	// "unconfined" for none.
+	SeccompProfile string `yaml:"seccomp_profile"`
+
+	// PassProxy is whether layers' commands get the host's http_proxy,
+	// https_proxy and no_proxy; it is true unless set to false.
+	PassProxy *bool `yaml:"pass_proxy"`
+
+	// CACerts are PEM files (or directories of them) with extra CA
+	// certificates layers' commands trust, e.g. for a corporate proxy.
+	// They're added to a copy of the rootfs' CA bundle that SSL_CERT_FILE
+	// points at while the commands run, and aren't in the layer.
+	CACerts []string `yaml:"ca_certs"`
+
+	// DNS is the DNS configuration of layers' commands.
+	DNS *DNSConfig `yaml:"dns"`
+
+	// Policies are rego files (or directories of them) that every built
+	// image is checked against before it's saved, see PolicyQuery.
+	Policies []string `yaml:"policies"`
+
+	// CacheSalt is part of every layer's cache key, so changing it
+	// invalidates everything that was cached with the old one, e.g. to
+	// rebuild all layers after a fix to a toolchain they were built with.
+	CacheSalt string `yaml:"cache_salt"`
+
+	// ScratchDir is where large temporary files (squashfs images being
+	// generated, and imports being downloaded) are written, in a directory
+	// of their working container's name. Squashfs images are generated in
+	// OCIDir if it isn't set, and imports downloaded straight into
+	// StackerDir.
+	ScratchDir string `yaml:"scratch_dir"`
+
+	// ScratchMinFree is how much space (e.g. "10GB") must be free where
+	// squashfs images are generated for a build to start, and before each
+	// one is generated.
+	ScratchMinFree string `yaml:"scratch_min_free"`
+
+	// LayerQuota is how much space (e.g. "20GB") each layer's build can
+	// write on top of its base, so that one that runs away can't fill up
+	// the filesystem the rootfses are on. Only btrfs storage supports it,
+	// and only as root.
+	LayerQuota string `yaml:"layer_quota"`
+
+	// SnapshotRetention is how many of the snapshots of built layers and
+	// unpacked bases are kept, applied at the end of each build; they're
+	// all kept if it isn't set.
+	SnapshotRetention *SnapshotRetention `yaml:"snapshot_retention"`
+
+	// ImportPins is the file the sha256s of http(s) imports are pinned in
+	// the first time they're downloaded, after which they have to match
+	// (trust on first use); they aren't checked if it isn't set.
+	ImportPins string `yaml:"import_pins"`
+
+	// ImportPinMode is what happens when an import doesn't match its pin:
+	// PinFail (the default) fails the build, and PinWarn warns.
+	ImportPinMode string `yaml:"import_pin_mode"`
+
+	// GC is when builds remove the blobs in OCIDir that no tag uses; at
+	// the end of each one if it isn't set.
+	GC *GCPolicy `yaml:"gc"`
+
+	// Tools are the paths of the external tools stacker runs (e.g.
+	// ToolMksquashfs), by name, for the ones that shouldn't be looked up
+	// in $PATH.
+	Tools map[string]string `yaml:"tools"`
+
+	// SecretSalt is what the values of secrets and build_env are hashed
+	// with in the build cache, instead of a random salt kept in
+	// StackerDir. Stackers that share a cache need to use the same one.
+	SecretSalt string `yaml:"secret_salt"`
+
+	// Secrets are the values of the secrets given to the build, by name.
+	Secrets map[string]string `yaml:"-"`
+
+	// WorkingContainerName is the name of the container layers are built
+	// in (WorkingContainerName by default). Stackers that share RootFSDir
+	// each need their own to run at the same time.
+	WorkingContainerName string `yaml:"-"`
+
+	// output is where stacker's output goes, see stdout().
+	output io.Writer
+}
+
+// WorkingContainer is the name of the container layers are built in.
+func (c StackerConfig) WorkingContainer() string {
+	if c.WorkingContainerName != "" {
+		return c.WorkingContainerName
+	}
+	return WorkingContainerName
 }
 
 type BuildConfig struct {
 	Prerequisites []string `yaml:"prerequisites"`
 	SaveUrl       string   `yaml:"save_url"`
+	Include       []string `yaml:"include"`
 }
 
 type Stackerfile struct {
@@ -42,6 +207,10 @@ type Stackerfile struct {
 	// substitutions (i.e., the content that is actually used by stacker).
 	AfterSubstitutions string
 
+	// beforeSubstitutions is the contents of the stacker file as it was
+	// written.
+	beforeSubstitutions string
+
 	// internal is the actual representation of the stackerfile as a map.
 	internal map[string]*Layer
 
@@ -56,6 +225,9 @@ type Stackerfile struct {
 
 	// directory relative to which the stackerfile content is referenced
 	referenceDirectory string
+
+	// the url the stackerfile came from, if it isn't a local file
+	source string
 }
 
 func (sf *Stackerfile) Get(name string) (*Layer, bool) {
@@ -82,6 +254,10 @@ type ImageSource struct {
 	Url      string `yaml:"url"`
 	Tag      string `yaml:"tag"`
 	Insecure bool   `yaml:"insecure"`
+
+	// Sha256 is the checksum of a tar base (as it's downloaded, i.e.
+	// compressed); it's required for http(s) urls.
+	Sha256 string `yaml:"sha256"`
 }
 
 func NewImageSource(containersImageString string) (*ImageSource, error) {
@@ -102,7 +278,11 @@ func NewImageSource(containersImageString string) (*ImageSource, error) {
 		ret.Type = DockerType
 		ret.Url = containersImageString
 	default:
-		return nil, errors.Errorf("unknown image source type: %s", containersImageString)
+		if _, ok := lookupScheme(url.Scheme); !ok {
+			return nil, errors.Errorf("unknown image source type: %s", containersImageString)
+		}
+		ret.Type = url.Scheme
+		ret.Url = containersImageString
 	}
 
 	return ret, nil
@@ -140,32 +320,59 @@ func (is *ImageSource) ParseTag() (string, error) {
 		// url path, let's use the host as the image tag
 		return strings.Split(url.Host, ":")[0], nil
 	case OCIType:
-		pieces := strings.SplitN(is.Url, ":", 2)
-		if len(pieces) != 2 {
-			return "", fmt.Errorf("bad OCI tag: %s", is.Type)
+		// layouts made by other tools may have one image without a
+		// tag, which is named after the layout
+		layout, tag := ociLayoutRef(is.Url)
+		if tag == "" {
+			return path.Base(layout), nil
 		}
 
-		return pieces[1], nil
+		return tag, nil
 	default:
 		return "", fmt.Errorf("unsupported type: %s", is.Type)
 	}
 }
 
 type Layer struct {
-	From               *ImageSource      `yaml:"from"`
-	Import             interface{}       `yaml:"import"`
-	Run                interface{}       `yaml:"run"`
-	Cmd                interface{}       `yaml:"cmd"`
-	Entrypoint         interface{}       `yaml:"entrypoint"`
-	FullCommand        interface{}       `yaml:"full_command"`
-	Environment        map[string]string `yaml:"environment"`
-	Volumes            []string          `yaml:"volumes"`
-	Labels             map[string]string `yaml:"labels"`
-	WorkingDir         string            `yaml:"working_dir"`
-	BuildOnly          bool              `yaml:"build_only"`
-	Binds              interface{}       `yaml:"binds"`
-	Apply              []string          `yaml:"apply"`
-	referenceDirectory string            // Location of the directory where the layer is defined
+	From               *ImageSource        `yaml:"from"`
+	Import             interface{}         `yaml:"import"`
+	Run                interface{}         `yaml:"run"`
+	Test               interface{}         `yaml:"test"`
+	Cmd                interface{}         `yaml:"cmd"`
+	Entrypoint         interface{}         `yaml:"entrypoint"`
+	FullCommand        interface{}         `yaml:"full_command"`
+	Environment        map[string]string   `yaml:"environment"`
+	BuildEnv           map[string]string   `yaml:"build_env"`
+	Secrets            []string            `yaml:"secrets"`
+	Volumes            []string            `yaml:"volumes"`
+	Labels             map[string]string   `yaml:"labels"`
+	Annotations        map[string]string   `yaml:"annotations"`
+	WorkingDir         string              `yaml:"working_dir"`
+	User               string              `yaml:"user"`
+	Ports              []string            `yaml:"ports"`
+	StopSignal         string              `yaml:"stop_signal"`
+	Healthcheck        *Healthcheck        `yaml:"healthcheck"`
+	BuildOnly          bool                `yaml:"build_only"`
+	Squash             bool                `yaml:"squash"`
+	Binds              interface{}         `yaml:"binds"`
+	Apply              []string            `yaml:"apply"`
+	Hooks              *Hooks              `yaml:"hooks"`
+	Extends            string              `yaml:"extends"`
+	Matrix             map[string][]string `yaml:"matrix"`
+	If                 string              `yaml:"if"`
+	Privileged         bool                `yaml:"privileged"`
+	Capabilities       []string            `yaml:"capabilities"`
+	SeccompProfile     string              `yaml:"seccomp_profile"`
+	Devices            []string            `yaml:"devices"`
+	Tmpfs              []string            `yaml:"tmpfs"`
+	Artifacts          []string            `yaml:"artifacts"`
+	MaxSize            string              `yaml:"max_size"`
+	MaxSizeWarnOnly    bool                `yaml:"max_size_warn_only"`
+	CopyFrom           interface{}         `yaml:"copy_from"`
+	OS                 string              `yaml:"os"`
+	Arch               string              `yaml:"arch"`
+	Variant            string              `yaml:"variant"`
+	referenceDirectory string              // Location of the directory where the layer is defined
 }
 
 func (l *Layer) ParseCmd() ([]string, error) {
@@ -245,6 +452,22 @@ func (l *Layer) ParseRun() ([]string, error) {
 	})
 }
 
+func (l *Layer) ParseTest() ([]string, error) {
+	return l.getStringOrStringSlice(l.Test, func(s string) ([]string, error) {
+		return []string{s}, nil
+	})
+}
+
+// ParseSeccompProfile returns the path of the layer's seccomp profile, or
+// "unconfined" or "" (for the default one).
+func (l *Layer) ParseSeccompProfile() (string, error) {
+	if l.SeccompProfile == "" || l.SeccompProfile == SeccompUnconfined {
+		return l.SeccompProfile, nil
+	}
+
+	return l.getAbsPath(l.SeccompProfile)
+}
+
 func (l *Layer) getAbsPath(path string) (string, error) {
 	parsedPath, err := url.Parse(path)
 	if err != nil {
@@ -325,7 +548,7 @@ func init() {
 	}
 }
 
-func substitute(content string, substitutions []string) (string, error) {
+func substitute(config StackerConfig, content string, substitutions []string) (string, error) {
 	for _, subst := range substitutions {
 		membs := strings.SplitN(subst, "=", 2)
 		if len(membs) != 2 {
@@ -335,7 +558,7 @@ func substitute(content string, substitutions []string) (string, error) {
 		from := fmt.Sprintf("$%s", membs[0])
 		to := membs[1]
 
-		fmt.Printf("substituting %s to %s\n", from, to)
+		verbosef(config, "substituting %s to %s\n", from, to)
 
 		content = strings.Replace(content, from, to, -1)
 
@@ -347,35 +570,50 @@ func substitute(content string, substitutions []string) (string, error) {
 		content = re.ReplaceAllString(content, to)
 	}
 
-	// now, anything that's left we can just use its value
+	// now, anything that's left has to have a default, or it's missing
 	re, err := regexp.Compile(`\$\{\{[^\}]*\}\}`)
-	for {
-		indexes := re.FindAllStringIndex(content, -1)
-		if len(indexes) == 0 {
-			break
-		}
-
-		idx := indexes[0]
+	if err != nil {
+		return "", err
+	}
 
+	missing := []string{}
+	content = re.ReplaceAllStringFunc(content, func(match string) string {
 		// get content without ${{}}
-		variable := content[idx[0]+3 : idx[1]-2]
+		variable := match[3 : len(match)-2]
+
+		// ${{matrix.FOO}} is filled in per layer, by expandMatrix, and
+		// ${{build.FOO}} when the layer is built
+		if strings.HasPrefix(variable, "matrix.") || strings.HasPrefix(variable, "build.") {
+			return match
+		}
 
 		membs := strings.SplitN(variable, ":", 2)
 		if len(membs) != 2 {
-			return "", fmt.Errorf("no value for substitution %s", variable)
+			missing = append(missing, variable)
+			return match
 		}
 
-		buf := bytes.NewBufferString(content[:idx[0]])
-		_, err = buf.WriteString(membs[1])
-		if err != nil {
-			return "", err
-		}
-		_, err = buf.WriteString(content[idx[1]:])
-		if err != nil {
-			return "", err
+		switch {
+		case strings.HasPrefix(membs[1], "?"):
+			// ${{FOO:?message}} is required, and message says why
+			msg := strings.TrimPrefix(membs[1], "?")
+			if msg == "" {
+				missing = append(missing, membs[0])
+			} else {
+				missing = append(missing, fmt.Sprintf("%s (%s)", membs[0], msg))
+			}
+			return match
+		case strings.HasPrefix(membs[1], "-"):
+			// ${{FOO:-default}}, like the shell
+			return strings.TrimPrefix(membs[1], "-")
+		default:
+			// ${{FOO:default}}
+			return membs[1]
 		}
+	})
 
-		content = buf.String()
+	if len(missing) > 0 {
+		return "", fmt.Errorf("no value for substitutions: %s", strings.Join(missing, ", "))
 	}
 
 	return content, nil
@@ -386,9 +624,21 @@ func substitute(content string, substitutions []string) (string, error) {
 // explicitly not a map, because the substitutions are performed one at a time
 // in the order that they are given.
 func NewStackerfile(stackerfile string, substitutions []string) (*Stackerfile, error) {
+	return NewStackerfileWithOpts(stackerfile, StackerfileOpts{Substitute: substitutions})
+}
+
+// NewStackerfileWithOpts creates a new stackerfile from the given path, with
+// the given options.
+func NewStackerfileWithOpts(stackerfile string, opts StackerfileOpts) (*Stackerfile, error) {
+	return newStackerfile(stackerfile, opts, nil)
+}
+
+// newStackerfile reads a stackerfile; including is the chain of stackerfiles
+// that included this one (if any).
+func newStackerfile(stackerfile string, opts StackerfileOpts, including []string) (*Stackerfile, error) {
 	var err error
 
-	sf := Stackerfile{}
+	sf := &Stackerfile{}
 	sf.path = stackerfile
 
 	// Use working directory as default folder relative to which files
@@ -404,7 +654,25 @@ func NewStackerfile(stackerfile string, substitutions []string) (*Stackerfile, e
 	}
 
 	var raw []byte
-	if url.Scheme == "" {
+	if gitURL, ok := parseGitStackerfileURL(stackerfile); ok {
+		if opts.GitCloneDir == "" {
+			return nil, fmt.Errorf("stackerfile: nowhere to clone %s to", gitURL.repo)
+		}
+
+		repoDir, err := gitURL.checkout(opts.config, opts.GitCloneDir)
+		if err != nil {
+			return nil, err
+		}
+
+		raw, err = ioutil.ReadFile(path.Join(repoDir, gitURL.path))
+		if err != nil {
+			return nil, err
+		}
+
+		// Things in the stackerfile are relative to the root of the repo
+		sf.referenceDirectory = repoDir
+		sf.source = stackerfile
+	} else if url.Scheme == "" {
 		raw, err = ioutil.ReadFile(stackerfile)
 		if err != nil {
 			return nil, err
@@ -434,22 +702,70 @@ func NewStackerfile(stackerfile string, substitutions []string) (*Stackerfile, e
 		if err != nil {
 			return nil, err
 		}
+		sf.source = stackerfile
 
 		// There's no need to update the reference directory of the stackerfile
 		// Continue to use the working directory
 	}
 
-	content, err := substitute(string(raw), substitutions)
+	if err := sf.load(raw, opts, including); err != nil {
+		return nil, err
+	}
+
+	return sf, nil
+}
+
+// NewStackerfileFromReader reads a stackerfile from r rather than from a file,
+// e.g. for stackerfiles that are generated. Relative paths in it are relative
+// to workingDir, which is also where its git version comes from.
+func NewStackerfileFromReader(r io.Reader, workingDir string, substitutions []string) (*Stackerfile, error) {
+	return NewStackerfileFromReaderWithOpts(r, workingDir, StackerfileOpts{Substitute: substitutions})
+}
+
+// NewStackerfileFromReaderWithOpts is NewStackerfileFromReader, with the given
+// options.
+func NewStackerfileFromReaderWithOpts(r io.Reader, workingDir string, opts StackerfileOpts) (*Stackerfile, error) {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	sf := &Stackerfile{}
+	sf.referenceDirectory, err = filepath.Abs(workingDir)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := sf.load(raw, opts, nil); err != nil {
+		return nil, err
+	}
+
+	return sf, nil
+}
+
+// load parses the stackerfile content raw into sf.
+func (sf *Stackerfile) load(raw []byte, opts StackerfileOpts, including []string) error {
+	sf.beforeSubstitutions = string(raw)
+
+	content, err := substitute(opts.config, string(raw), opts.Substitute)
+	if err != nil {
+		return err
+	}
+
+	// Substitutions go first, since ${{FOO}} isn't valid template syntax.
+	if opts.Template {
+		content, err = renderTemplate(sf.path, content, opts, sf.referenceDirectory)
+		if err != nil {
+			return err
+		}
+	}
+
 	sf.AfterSubstitutions = content
 
 	// Parse the first time to validate the format/content
 	ms := yaml.MapSlice{}
 	if err := yaml.Unmarshal([]byte(content), &ms); err != nil {
-		return nil, err
+		return err
 	}
 
 	// Determine the layers in the stacker.yaml, their order and the list of prerequisite files
@@ -462,16 +778,16 @@ func NewStackerfile(stackerfile string, substitutions []string) (*Stackerfile, e
 	for _, e := range ms {
 		keyName, ok := e.Key.(string)
 		if !ok {
-			return nil, fmt.Errorf("stackerfile: cannot cast %v to string", e.Key)
+			return fmt.Errorf("stackerfile: cannot cast %v to string", e.Key)
 		}
 
 		if "stacker_config" == keyName {
 			stackerConfigContent, err := yaml.Marshal(e.Value)
 			if err != nil {
-				return nil, err
+				return err
 			}
 			if err = yaml.Unmarshal(stackerConfigContent, &sf.buildConfig); err != nil {
-				return nil, fmt.Errorf("stackerfile: cannot interpret 'stacker_config' value %v", e.Value)
+				return fmt.Errorf("stackerfile: cannot interpret 'stacker_config' value %v", e.Value)
 			}
 		} else {
 			sf.fileOrder = append(sf.fileOrder, e.Key.(string))
@@ -492,7 +808,7 @@ func NewStackerfile(stackerfile string, substitutions []string) (*Stackerfile, e
 			}
 
 			if !found {
-				return nil, fmt.Errorf("stackerfile: unknown directive %s", directive.Key.(string))
+				return fmt.Errorf("stackerfile: unknown directive %s", directive.Key.(string))
 			}
 
 			if directive.Key.(string) == "from" {
@@ -506,7 +822,7 @@ func NewStackerfile(stackerfile string, substitutions []string) (*Stackerfile, e
 					}
 
 					if !found {
-						return nil, fmt.Errorf("stackerfile: unknown image source directive %s",
+						return fmt.Errorf("stackerfile: unknown image source directive %s",
 							sourceDirective.Key.(string))
 					}
 				}
@@ -517,12 +833,12 @@ func NewStackerfile(stackerfile string, substitutions []string) (*Stackerfile, e
 	// Marshall only the layers so we can unmarshal them in the right data structure later
 	layersContent, err := yaml.Marshal(lms)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Unmarshal to save the data in the right structure to enable further processing
 	if err := yaml.Unmarshal(layersContent, &sf.internal); err != nil {
-		return nil, err
+		return err
 	}
 
 	// Set the directory with the location where the layer was defined
@@ -530,7 +846,23 @@ func NewStackerfile(stackerfile string, substitutions []string) (*Stackerfile, e
 		layer.referenceDirectory = sf.referenceDirectory
 	}
 
-	return &sf, err
+	if err := sf.expandMatrix(); err != nil {
+		return err
+	}
+
+	if err := sf.resolveExtends(opts, including); err != nil {
+		return err
+	}
+
+	// included stackerfiles are only definitions to extend, so the
+	// conditions are for whoever extends them to decide
+	if len(including) == 0 {
+		if err := sf.pruneLayers(opts.config, opts.Substitute); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // DependencyOrder provides the list of layer names from a stackerfile
@@ -566,6 +898,17 @@ func (s *Stackerfile) DependencyOrder() ([]string, error) {
 			// Determine if the layer has stacker:// imports from another
 			// layer which has not been processed
 			allStackerImportsProcessed := true
+			copyFromLayers, err := layer.copyFromLayers()
+			if err != nil {
+				return nil, err
+			}
+
+			for _, from := range copyFromLayers {
+				if !processed[from] {
+					allStackerImportsProcessed = false
+				}
+			}
+
 			for _, imp := range imports {
 				url, err := url.Parse(imp)
 				if err != nil {
@@ -635,22 +978,32 @@ type StackerFiles map[string]*Stackerfile
 // NewStackerFiles reads multiple Stackerfiles from a list of paths and applies substitutions
 // It adds the Stackerfiles mentioned in the prerequisite paths to the results
 func NewStackerFiles(paths []string, substituteVars []string) (StackerFiles, error) {
+	return NewStackerFilesWithOpts(paths, StackerfileOpts{Substitute: substituteVars})
+}
+
+// NewStackerFilesWithOpts is NewStackerFiles, with the given options for
+// reading the stackerfiles.
+func NewStackerFilesWithOpts(paths []string, opts StackerfileOpts) (StackerFiles, error) {
 	sfm := make(map[string]*Stackerfile, len(paths))
 
 	// Iterate over list of paths to stackerfiles
 	for _, path := range paths {
-		fmt.Printf("initializing stacker recipe: %s\n", path)
+		infof(opts.config, "initializing stacker recipe: %s\n", path)
 
 		// Read this stackerfile
-		sf, err := NewStackerfile(path, substituteVars)
+		sf, err := NewStackerfileWithOpts(path, opts)
 		if err != nil {
 			return nil, err
 		}
 
 		// Add using absolute path to make sure the entries are unique
-		absPath, err := filepath.Abs(path)
-		if err != nil {
-			return nil, err
+		// (remote stackerfiles are already unique by their url)
+		absPath := path
+		if sf.source == "" {
+			absPath, err = filepath.Abs(path)
+			if err != nil {
+				return nil, err
+			}
 		}
 		if _, ok := sfm[absPath]; ok != true {
 			sfm[absPath] = sf
@@ -663,7 +1016,7 @@ func NewStackerFiles(paths []string, substituteVars []string) (StackerFiles, err
 		}
 
 		// Need to also add stackerfile dependencies of this stackerfile to the map of stackerfiles
-		depStackerFiles, err := NewStackerFiles(prerequisites, substituteVars)
+		depStackerFiles, err := NewStackerFilesWithOpts(prerequisites, opts)
 		if err != nil {
 			return nil, err
 		}
@@ -1,9 +1,13 @@
 package stacker
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+
+	"github.com/pkg/errors"
 )
 
 func parse(t *testing.T, content string) *Stackerfile {
@@ -81,7 +85,7 @@ third:
 
 func TestSubstitute(t *testing.T) {
 	s := "$ONE $TWO ${{TWO}} ${{TWO:}} ${{TWO:3}} ${{TWO2:22}} ${{THREE:3}}"
-	result, err := substitute(s, []string{"ONE=1", "TWO=2"})
+	result, err := substitute(StackerConfig{}, s, []string{"ONE=1", "TWO=2"})
 	if err != nil {
 		t.Fatalf("failed substitutition: %s", err)
 	}
@@ -93,7 +97,7 @@ func TestSubstitute(t *testing.T) {
 
 	// ${PRODUCT} is ok
 	s = "$PRODUCT ${PRODUCT//x} ${{PRODUCT}}"
-	result, err = substitute(s, []string{"PRODUCT=foo"})
+	result, err = substitute(StackerConfig{}, s, []string{"PRODUCT=foo"})
 	if err != nil {
 		t.Fatalf("failed substitution: %s", err)
 	}
@@ -102,4 +106,110 @@ func TestSubstitute(t *testing.T) {
 	if result != expected {
 		t.Fatalf("bad substitution result, expected %s got %s", expected, result)
 	}
+
+	s = "${{ONE:-1}} ${{TWO:?two is required}} ${{THREE:-3}}"
+	result, err = substitute(StackerConfig{}, s, []string{"TWO=2"})
+	if err != nil {
+		t.Fatalf("failed substitution: %s", err)
+	}
+
+	expected = "1 2 3"
+	if result != expected {
+		t.Fatalf("bad substitution result, expected %s got %s", expected, result)
+	}
+
+	s = "${{ONE:?one is required}} ${{TWO}} ${{THREE:?}} ${{FOUR:-4}}"
+	_, err = substitute(StackerConfig{}, s, []string{})
+	if err == nil {
+		t.Fatalf("substitution succeeded with missing required values")
+	}
+
+	for _, missing := range []string{"ONE (one is required)", "TWO", "THREE"} {
+		if !strings.Contains(err.Error(), missing) {
+			t.Errorf("missing substitution %s not reported: %v", missing, err)
+		}
+	}
+}
+
+func TestStackerfileFromReader(t *testing.T) {
+	content := `meshuggah:
+    from:
+        type: docker
+        url: docker://${{DISTRO}}:latest
+    import: config.json
+`
+	sf, err := NewStackerfileFromReader(strings.NewReader(content), "/src", []string{"DISTRO=centos"})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	l, ok := sf.Get("meshuggah")
+	if !ok {
+		t.Fatalf("missing meshuggah layer")
+	}
+
+	if l.From.Url != "docker://centos:latest" {
+		t.Fatalf("bad url: %s", l.From.Url)
+	}
+
+	imports, err := l.ParseImport()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(imports) != 1 || imports[0] != "/src/config.json" {
+		t.Fatalf("bad imports: %v", imports)
+	}
+}
+
+func TestScratchFrom(t *testing.T) {
+	content := `builder:
+    from:
+        type: docker
+        url: docker://golang:latest
+    build_only: true
+app:
+    from:
+        type: scratch
+    copy_from: {layer: builder, path: /out/app, dest: /app}
+    entrypoint: /app
+`
+	sf := parse(t, content)
+	l, ok := sf.Get("app")
+	if !ok {
+		t.Fatalf("missing app layer")
+	}
+
+	if l.From.Type != ScratchType {
+		t.Fatalf("bad type: %v", l.From)
+	}
+
+	do, err := sf.DependencyOrder()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(do) != 2 || do[0] != "builder" || do[1] != "app" {
+		t.Fatalf("bad do: %v", do)
+	}
+}
+
+func TestBuilderInterrupted(t *testing.T) {
+	b := NewBuilder(&BuildArgs{})
+	if err := b.interrupted("foo"); err != nil {
+		t.Fatalf("interrupted without being cancelled: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.SetContext(ctx)
+	cancel()
+
+	err := b.interrupted("foo")
+	if errors.Cause(err) != ErrInterrupted {
+		t.Fatalf("bad error for cancelled build %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "foo") {
+		t.Errorf("error doesn't say which layer was stopped: %v", err)
+	}
 }
@@ -51,7 +51,7 @@ func NewApply(sfm StackerFiles, opts BaseLayerOpts, storage Storage, considerTim
 		// Search for the base layer in all of the built stackerfiles
 		base, ok := sfm.LookupLayerDefinition(opts.Layer.From.Tag)
 		if !ok {
-			return nil, fmt.Errorf("missing base layer: %s?", opts.Layer.From.Tag)
+			return nil, newError(ErrMissingBaseLayer, nil, "missing base layer: %s?", opts.Layer.From.Tag)
 		}
 
 		if base.BuildOnly {
@@ -64,7 +64,7 @@ func NewApply(sfm StackerFiles, opts BaseLayerOpts, storage Storage, considerTim
 			// re-extract everything the build-only layer is based
 			// on. Anyway, let's warn people.
 			if len(opts.Layer.Apply) > 0 {
-				fmt.Println("WARNING: build-only base layers with apply statements may be wonky")
+				warnln(opts.Config, "WARNING: build-only base layers with apply statements may be wonky")
 			}
 		} else {
 			source = opts.OCI
@@ -102,7 +102,7 @@ func (a *Apply) DoApply() error {
 	defer a.storage.Delete("stacker-apply-base")
 
 	for _, image := range a.opts.Layer.Apply {
-		fmt.Println("merging in layers from", image)
+		infoln(a.opts.Config, "merging in layers from", image)
 		err = a.applyImage(image)
 		if err != nil {
 			return err
@@ -118,7 +118,7 @@ func (a *Apply) applyImage(layer string) error {
 		return err
 	}
 
-	err = importImage(is, a.opts.Config)
+	err = importImage(is, a.opts.Config, a.opts.Auth, a.opts.Platform)
 	if err != nil {
 		return err
 	}
@@ -144,13 +144,15 @@ func (a *Apply) applyImage(layer string) error {
 		return err
 	}
 
-	baseTag, err := a.opts.Layer.From.ParseTag()
-	if err != nil {
-		return err
-	}
-
+	// only imported bases (which have tags) aren't in the output layout
+	// yet; scratch and tar bases are
 	baseManifest, err := stackeroci.LookupManifest(a.opts.OCI, a.opts.Name)
 	if err != nil {
+		baseTag, tagErr := a.opts.Layer.From.ParseTag()
+		if tagErr != nil {
+			return err
+		}
+
 		baseManifest, err = stackeroci.LookupManifest(layerBases, baseTag)
 		if err != nil {
 			return err
@@ -179,7 +181,7 @@ func (a *Apply) applyImage(layer string) error {
 			continue
 		}
 
-		fmt.Println("applying layer", l.Digest)
+		verboseln(a.opts.Config, "applying layer", l.Digest)
 
 		// apply the layer. TODO: we could be smart about this if the
 		// layer is strictly additive or doesn't otherwise require
@@ -0,0 +1,250 @@
+package stacker
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ArtifactConfigMediaType is the media type of the config of the OCI
+// artifacts stacker pushes a layer's artifacts as; their one layer is a
+// gzipped tar of the artifacts.
+const ArtifactConfigMediaType = "application/vnd.stacker.artifacts.config.v1+json"
+
+// artifactsSuffix is added to a layer's name to get the name its artifacts
+// are saved as.
+const artifactsSuffix = "-artifacts"
+
+// ParseArtifacts returns the paths in the layer's rootfs that are exported as
+// artifacts, mapped to where they go in its artifacts directory. Like binds,
+// they are either "/out/binary -> bin/app" or just "/out/binary", which
+// goes to out/binary.
+func (l *Layer) ParseArtifacts() (map[string]string, error) {
+	artifacts := map[string]string{}
+	for _, artifact := range l.Artifacts {
+		parts := strings.Split(artifact, "->")
+		if len(parts) != 1 && len(parts) != 2 {
+			return nil, fmt.Errorf("invalid artifact %s", artifact)
+		}
+
+		source := strings.TrimSpace(parts[0])
+		if !path.IsAbs(source) {
+			return nil, fmt.Errorf("invalid artifact %s: it must be an absolute path in the rootfs", artifact)
+		}
+
+		dest := source
+		if len(parts) == 2 {
+			dest = strings.TrimSpace(parts[1])
+		}
+
+		dest = path.Clean("/" + dest)
+		if dest == "/" {
+			return nil, fmt.Errorf("invalid artifact %s: it needs somewhere to go", artifact)
+		}
+
+		artifacts[source] = strings.TrimPrefix(dest, "/")
+	}
+
+	return artifacts, nil
+}
+
+// artifactsDir is where the artifacts of layers are exported to.
+func (opts *BuildArgs) artifactsDir() string {
+	if opts.ArtifactsDir != "" {
+		return opts.ArtifactsDir
+	}
+	return "artifacts"
+}
+
+// layerArtifactsDir is where the artifacts of the layer name are exported
+// to, which has to be in the artifacts directory.
+func (opts *BuildArgs) layerArtifactsDir(name string) (string, error) {
+	base, err := filepath.Abs(opts.artifactsDir())
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(base, name)
+	if !strings.HasPrefix(dir, base+"/") {
+		return "", fmt.Errorf("can't export artifacts of %s, its name leaves the artifacts directory", name)
+	}
+
+	return dir, nil
+}
+
+// exportArtifacts copies the layer name's artifacts out of its rootfs into
+// the artifacts directory, and if asked to, saves them as an OCI artifact
+// next to the layer.
+func exportArtifacts(opts *BuildArgs, oci casext.Engine, sf *Stackerfile, name string, l *Layer) error {
+	artifacts, err := l.ParseArtifacts()
+	if err != nil || len(artifacts) == 0 {
+		return err
+	}
+
+	rootfs := path.Join(opts.Config.RootFSDir, name, "rootfs")
+	if _, err := os.Stat(rootfs); err != nil {
+		warnf(opts.Config, "can't export artifacts of %s, its rootfs isn't there any more\n", name)
+		return nil
+	}
+
+	outDir, err := opts.layerArtifactsDir(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(outDir); err != nil {
+		return err
+	}
+
+	for source, dest := range artifacts {
+		// the rootfs' symlinks mustn't lead outside of it
+		resolved, err := securejoin.SecureJoin(rootfs, source)
+		if err != nil {
+			return err
+		}
+
+		if _, err := os.Lstat(resolved); err != nil {
+			return errors.Wrapf(err, "couldn't find artifact %s of %s", source, name)
+		}
+
+		target := path.Join(outDir, dest)
+		if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		// unprivileged, only the user namespace can read everything
+		// in the rootfs; the copies belong to the user either way.
+		infof(opts.Config, "exporting %s from %s to %s\n", source, name, target)
+		cmd := []string{"cp", "-a", "--no-preserve=ownership", resolved, target}
+		if err := MaybeRunInUserns(cmd, fmt.Sprintf("couldn't export artifact %s of %s", source, name)); err != nil {
+			return err
+		}
+	}
+
+	if !opts.PushArtifacts || len(sf.buildConfig.SaveUrl) == 0 {
+		return nil
+	}
+
+	if err := putArtifacts(oci, name+artifactsSuffix, outDir); err != nil {
+		return err
+	}
+
+	return SaveLayer(opts, sf, name+artifactsSuffix)
+}
+
+// putArtifacts adds the files in dir to oci as the OCI artifact tag.
+func putArtifacts(oci casext.Engine, tag string, dir string) error {
+	ctx := context.Background()
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeArtifactsTar(dir, writer))
+	}()
+
+	layerDigest, layerSize, err := oci.PutBlob(ctx, reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+
+	configDigest, configSize, err := oci.PutBlobJSON(ctx, struct{}{})
+	if err != nil {
+		return err
+	}
+
+	manifest := ispec.Manifest{
+		Config: ispec.Descriptor{
+			MediaType: ArtifactConfigMediaType,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{{
+			MediaType: ispec.MediaTypeImageLayerGzip,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		}},
+	}
+	manifest.SchemaVersion = 2
+
+	manifestDigest, manifestSize, err := oci.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		return err
+	}
+
+	return oci.UpdateReference(ctx, tag, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	})
+}
+
+// writeArtifactsTar writes a gzipped tar of what's in dir to w.
+func writeArtifactsTar(dir string, w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(p)
+			if err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
@@ -0,0 +1,110 @@
+package stacker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+)
+
+func TestParseArtifacts(t *testing.T) {
+	l := &Layer{Artifacts: []string{"/out/app -> bin/app", "/src/test-results", "/etc/passwd -> ../../passwd"}}
+	artifacts, err := l.ParseArtifacts()
+	if err != nil {
+		t.Fatalf("couldn't parse artifacts: %v", err)
+	}
+
+	expected := map[string]string{
+		"/out/app":          "bin/app",
+		"/src/test-results": "src/test-results",
+		"/etc/passwd":       "passwd",
+	}
+	if len(artifacts) != len(expected) {
+		t.Fatalf("bad artifacts: %v", artifacts)
+	}
+	for source, dest := range expected {
+		if artifacts[source] != dest {
+			t.Errorf("bad dest for %s: %s", source, artifacts[source])
+		}
+	}
+
+	for _, bad := range []string{"out/app", "/out/app -> /", "/a -> b -> c"} {
+		l := &Layer{Artifacts: []string{bad}}
+		if _, err := l.ParseArtifacts(); err == nil {
+			t.Errorf("parsed bad artifact %s", bad)
+		}
+	}
+}
+
+func TestLayerArtifactsDir(t *testing.T) {
+	opts := &BuildArgs{ArtifactsDir: "/build/artifacts"}
+
+	dir, err := opts.layerArtifactsDir("team/app")
+	if err != nil || dir != "/build/artifacts/team/app" {
+		t.Errorf("bad artifacts dir: %s %v", dir, err)
+	}
+
+	for _, bad := range []string{"..", "../build", "app/../..", "."} {
+		if dir, err := opts.layerArtifactsDir(bad); err == nil {
+			t.Errorf("artifacts of %s went to %s", bad, dir)
+		}
+	}
+}
+
+func TestWriteArtifactsTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_artifacts_test")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(path.Join(dir, "bin"), 0755); err != nil {
+		t.Fatalf("couldn't make dir: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "bin/app"), []byte("app"), 0755); err != nil {
+		t.Fatalf("couldn't write file: %v", err)
+	}
+	if err := os.Symlink("app", path.Join(dir, "bin/link")); err != nil {
+		t.Fatalf("couldn't make symlink: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writeArtifactsTar(dir, buf); err != nil {
+		t.Fatalf("couldn't write tar: %v", err)
+	}
+
+	gz, err := gzip.NewReader(buf)
+	if err != nil {
+		t.Fatalf("bad gzip: %v", err)
+	}
+
+	names := []string{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+
+		if hdr.Name == "bin/app" {
+			content, err := ioutil.ReadAll(tr)
+			if err != nil || string(content) != "app" {
+				t.Errorf("bad content of bin/app: %s %v", string(content), err)
+			}
+		}
+
+		if hdr.Name == "bin/link" && hdr.Linkname != "app" {
+			t.Errorf("bad link target: %s", hdr.Linkname)
+		}
+	}
+
+	sort.Strings(names)
+	if len(names) != 3 || names[0] != "bin/" || names[1] != "bin/app" || names[2] != "bin/link" {
+		t.Fatalf("bad tar entries: %v", names)
+	}
+}
@@ -0,0 +1,180 @@
+package stacker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/containers/image/types"
+	"github.com/pkg/errors"
+)
+
+// RegistryCredentials are the username and password to use for a docker
+// registry.
+type RegistryCredentials struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// Helper is the docker credential helper (docker-credential-<helper>,
+	// e.g. "ecr-login", "gcr" or "acr-env") to get the credentials from
+	// instead. Cloud registries' helpers hand out tokens that expire, so
+	// it's run again for each copy, and when a registry stops taking the
+	// ones it gave partway through one.
+	Helper string `yaml:"helper"`
+
+	// Token is a token to authenticate with instead of a password, which
+	// is read from TokenFile if it isn't set. It's the secret of the
+	// robot account Robot ("<org>+<name>" on Quay, "robot$<name>" on
+	// Harbor) if that's set, and otherwise an OAuth access token, which
+	// is exchanged for registry tokens as Quay's are, as the user
+	// "$oauthtoken".
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+	Robot     string `yaml:"robot"`
+}
+
+// oauthTokenUser is the username registries' token endpoints take OAuth
+// access tokens as the password of.
+const oauthTokenUser = "$oauthtoken"
+
+// tokenCredentials returns the username and password that the token creds
+// are sent to host's token endpoint as.
+func (creds RegistryCredentials) tokenCredentials(host string) (*types.DockerAuthConfig, error) {
+	token := creds.Token
+	if token == "" {
+		content, err := ioutil.ReadFile(creds.TokenFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read token for %s", host)
+		}
+		token = strings.TrimSpace(string(content))
+	}
+
+	if token == "" {
+		return nil, fmt.Errorf("empty token for %s", host)
+	}
+
+	if creds.Robot != "" {
+		return &types.DockerAuthConfig{Username: creds.Robot, Password: token}, nil
+	}
+
+	return &types.DockerAuthConfig{Username: oauthTokenUser, Password: token}, nil
+}
+
+// helperCredentials is what docker credential helpers print for get.
+type helperCredentials struct {
+	Username string `json:"Username"`
+	Secret   string `json:"Secret"`
+}
+
+// runHelper gets the credentials for host from the docker credential helper
+// helper.
+func runHelper(config StackerConfig, helper string, host string) (*types.DockerAuthConfig, error) {
+	cmd := exec.Command(config.ToolPath(credentialHelperTool(helper)), "get")
+	cmd.Stdin = strings.NewReader(host)
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Errorf("credential helper %s failed for %s: %v: %s", helper, host, err, strings.TrimSpace(stderr.String()))
+	}
+
+	creds := helperCredentials{}
+	if err := json.Unmarshal(output, &creds); err != nil {
+		return nil, errors.Wrapf(err, "bad output from credential helper %s", helper)
+	}
+
+	return &types.DockerAuthConfig{Username: creds.Username, Password: creds.Secret}, nil
+}
+
+// RegistryAuth maps registry hosts (e.g. "docker.io" or "localhost:5000") to
+// the credentials to use for them. Registries that aren't present are
+// accessed anonymously.
+type RegistryAuth map[string]RegistryCredentials
+
+// registryHost returns the registry host of a docker:// url, using the same
+// rules as docker does for deciding whether the first path component is a
+// registry or part of the repository name.
+func registryHost(imageURL string) (string, bool) {
+	// url.Parse() doesn't like docker://centos:latest, since "latest"
+	// isn't a port.
+	if !strings.HasPrefix(imageURL, "docker://") {
+		return "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(imageURL, "docker://"), "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0], true
+	}
+
+	return "docker.io", true
+}
+
+// forURL returns the containers/image credentials for imageURL, or nil if
+// there aren't any.
+func (ra RegistryAuth) forURL(config StackerConfig, imageURL string) (*types.DockerAuthConfig, error) {
+	host, ok := registryHost(imageURL)
+	if !ok {
+		return nil, nil
+	}
+
+	creds, ok := ra[host]
+	if !ok {
+		return nil, nil
+	}
+
+	if creds.Helper != "" {
+		return runHelper(config, creds.Helper, host)
+	}
+
+	if creds.Token != "" || creds.TokenFile != "" {
+		return creds.tokenCredentials(host)
+	}
+
+	if creds.Robot != "" {
+		return nil, fmt.Errorf("robot account %s for %s has no token", creds.Robot, host)
+	}
+
+	return &types.DockerAuthConfig{Username: creds.Username, Password: creds.Password}, nil
+}
+
+// hasHelper returns true if the credentials for imageURL come from a
+// credential helper.
+func (ra RegistryAuth) hasHelper(imageURL string) bool {
+	host, ok := registryHost(imageURL)
+	return ok && ra[host].Helper != ""
+}
+
+// imageCopy is lib.ImageCopy with opts' SrcAuth and DestAuth from ra. If the
+// registry stops taking credentials that came from a credential helper
+// (because they expired during a long copy), they're renewed and the copy is
+// retried once, which only copies the blobs that hadn't been copied yet.
+func imageCopy(config StackerConfig, opts lib.ImageCopyOpts, ra RegistryAuth) error {
+	for retried := false; ; retried = true {
+		var err error
+		opts.SrcAuth, err = ra.forURL(config, opts.Src)
+		if err != nil {
+			return err
+		}
+
+		opts.DestAuth, err = ra.forURL(config, opts.Dest)
+		if err != nil {
+			return err
+		}
+
+		err = lib.ImageCopy(opts)
+		if err == nil || retried || !isUnauthorized(err) {
+			return err
+		}
+
+		if !ra.hasHelper(opts.Src) && !ra.hasHelper(opts.Dest) {
+			return err
+		}
+
+		warnf(config, "registry stopped taking the credentials for %s -> %s, renewing them: %v\n", opts.Src, opts.Dest, err)
+	}
+}
@@ -0,0 +1,135 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/containers/image/types"
+)
+
+func TestRegistryHost(t *testing.T) {
+	cases := map[string]string{
+		"docker://centos:latest":                 "docker.io",
+		"docker://library/centos:latest":         "docker.io",
+		"docker://localhost/foo:latest":          "localhost",
+		"docker://localhost:5000/foo:latest":     "localhost:5000",
+		"docker://registry.example.com/a/b:v1.0": "registry.example.com",
+	}
+
+	for url, expected := range cases {
+		host, ok := registryHost(url)
+		if !ok {
+			t.Errorf("no registry host for %s", url)
+			continue
+		}
+
+		if host != expected {
+			t.Errorf("bad registry host for %s: %s (expected %s)", url, host, expected)
+		}
+	}
+
+	if _, ok := registryHost("oci:/tmp/oci:foo"); ok {
+		t.Errorf("got registry host for an oci url")
+	}
+}
+
+func TestRegistryAuthForURL(t *testing.T) {
+	auth := RegistryAuth{"localhost:5000": {Username: "user", Password: "pass"}}
+
+	creds, err := auth.forURL(StackerConfig{}, "docker://localhost:5000/foo:latest")
+	if err != nil || creds == nil || creds.Username != "user" || creds.Password != "pass" {
+		t.Errorf("bad credentials for localhost:5000: %v %v", creds, err)
+	}
+
+	if creds, err := auth.forURL(StackerConfig{}, "docker://centos:latest"); err != nil || creds != nil {
+		t.Errorf("got credentials for docker.io: %v %v", creds, err)
+	}
+}
+
+func TestRegistryAuthHelper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-auth-test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a helper that hands out a new token each time it's run, like cloud
+	// registries' do
+	helper := `#!/bin/sh
+read host
+echo x >> "$(dirname "$0")/runs"
+echo "{\"ServerURL\": \"$host\", \"Username\": \"AWS\", \"Secret\": \"token-$host-$(wc -l < "$(dirname "$0")/runs" | tr -d ' ')\"}"
+`
+	if err := ioutil.WriteFile(path.Join(dir, "docker-credential-test"), []byte(helper), 0755); err != nil {
+		t.Fatalf("couldn't write helper: %v", err)
+	}
+
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+":"+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	auth := RegistryAuth{"1234.dkr.ecr.us-east-1.amazonaws.com": {Helper: "test"}}
+	url := "docker://1234.dkr.ecr.us-east-1.amazonaws.com/foo:latest"
+
+	if !auth.hasHelper(url) || auth.hasHelper("docker://centos:latest") {
+		t.Errorf("bad hasHelper")
+	}
+
+	for _, expected := range []string{"token-1234.dkr.ecr.us-east-1.amazonaws.com-1", "token-1234.dkr.ecr.us-east-1.amazonaws.com-2"} {
+		creds, err := auth.forURL(StackerConfig{}, url)
+		if err != nil {
+			t.Fatalf("forURL failed: %v", err)
+		}
+
+		if creds.Username != "AWS" || creds.Password != expected {
+			t.Errorf("bad credentials from helper: %v (expected %s)", creds, expected)
+		}
+	}
+
+	auth = RegistryAuth{"localhost:5000": {Helper: "missing"}}
+	if _, err := auth.forURL(StackerConfig{}, "docker://localhost:5000/foo:latest"); err == nil {
+		t.Errorf("missing helper didn't fail")
+	}
+}
+
+func TestRegistryAuthToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-auth-test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenFile := path.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("couldn't write token: %v", err)
+	}
+
+	auth := RegistryAuth{
+		"quay.io":             {Token: "oauth"},
+		"quay.example.com":    {Robot: "org+ci", Token: "robot"},
+		"harbor.example.com":  {Robot: "robot$ci", TokenFile: tokenFile},
+		"norobot.example.com": {Robot: "robot$ci"},
+	}
+
+	for url, expected := range map[string]types.DockerAuthConfig{
+		"docker://quay.io/foo/bar:latest":            {Username: "$oauthtoken", Password: "oauth"},
+		"docker://quay.example.com/foo/bar:latest":   {Username: "org+ci", Password: "robot"},
+		"docker://harbor.example.com/foo/bar:latest": {Username: "robot$ci", Password: "from-file"},
+	} {
+		creds, err := auth.forURL(StackerConfig{}, url)
+		if err != nil {
+			t.Errorf("no credentials for %s: %v", url, err)
+			continue
+		}
+
+		if *creds != expected {
+			t.Errorf("bad credentials for %s: %v (expected %v)", url, *creds, expected)
+		}
+	}
+
+	if _, err := auth.forURL(StackerConfig{}, "docker://norobot.example.com/foo:latest"); err == nil {
+		t.Errorf("robot account without a token was accepted")
+	}
+}
@@ -6,9 +6,9 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/anuvu/stacker/lib"
@@ -32,13 +32,27 @@ type BaseLayerOpts struct {
 	OCI       casext.Engine
 	LayerType string
 	Debug     bool
+	Auth      RegistryAuth
+
+	// Storage, if set, is used to keep the unpacked base images around,
+	// so that they only need to be unpacked once.
+	Storage Storage
+
+	// Xattrs are the xattr namespaces kept in the unpacked base image and
+	// its layers; if it's empty, all xattrs are kept.
+	Xattrs []string
+
+	// Platform is the platform the layer is for; the base image for it is
+	// picked from multi-platform images. Parts that aren't set are the
+	// host's.
+	Platform ispec.Platform
 }
 
 func GetBaseLayer(o BaseLayerOpts, sfm StackerFiles) error {
 	// delete the tag if it exists
 	o.OCI.DeleteReference(context.Background(), o.Name)
 
-	switch o.Layer.From.Type {
+	switch o.Layer.From.baseType() {
 	case BuiltType:
 		return getBuilt(o, sfm)
 	case TarType:
@@ -54,7 +68,24 @@ func GetBaseLayer(o BaseLayerOpts, sfm StackerFiles) error {
 	}
 }
 
-func importImage(is *ImageSource, config StackerConfig) error {
+// baseImageCacheDir is the OCI layout that imported images are cached in by
+// the digest of their manifest, so that an image is only downloaded once no
+// matter how many stackerfiles (or, if it is shared, projects) use it.
+func baseImageCacheDir(config StackerConfig) string {
+	if config.BaseImageCacheDir != "" {
+		return config.BaseImageCacheDir
+	}
+
+	return path.Join(config.StackerDir, "layer-bases", "oci")
+}
+
+// digestTag is the tag an image with the manifest digest d has in the base
+// image cache.
+func digestTag(d digest.Digest) string {
+	return strings.Replace(d.String(), ":", "_", 1)
+}
+
+func importImage(is *ImageSource, config StackerConfig, auth RegistryAuth, platform ispec.Platform) error {
 	toImport, err := is.ContainersImageURL()
 	if err != nil {
 		return err
@@ -82,20 +113,124 @@ func importImage(is *ImageSource, config StackerConfig) error {
 		defer oci.Close()
 	}()
 
-	fmt.Printf("loading %s\n", toImport)
-	err = lib.ImageCopy(lib.ImageCopyOpts{
+	if is.Type == OCIType {
+		return importOCILayout(config, is.Url, cacheDir, tag, platform)
+	}
+
+	tls := lib.TLSOpts{Insecure: is.Insecure}
+	if is.Type == DockerType {
+		mirrored := config.mirrorURL(toImport)
+		if mirrored != toImport {
+			infof(config, "using mirror %s for %s\n", mirrored, toImport)
+			toImport = mirrored
+		}
+
+		tls, err = config.registryTLS(toImport)
+		if err != nil {
+			return err
+		}
+		tls.Insecure = tls.Insecure || is.Insecure
+
+		creds, err := auth.forURL(config, toImport)
+		if err != nil {
+			return err
+		}
+
+		manifestDigest, err := lib.ManifestDigest(toImport, tls, creds)
+		if err == nil {
+			return importByDigest(toImport, manifestDigest, tag, config, tls, auth, platform)
+		}
+
+		// we can still try to copy it the old fashioned way; if the
+		// registry really is unreachable, that will fail too.
+		warnf(config, "couldn't get manifest digest of %s, not using base image cache: %v\n", toImport, err)
+	}
+
+	infof(config, "loading %s\n", toImport)
+	err = imageCopy(config, lib.ImageCopyOpts{
 		Src:      toImport,
 		Dest:     fmt.Sprintf("oci:%s:%s", cacheDir, tag),
-		SkipTLS:  is.Insecure,
-		Progress: os.Stdout,
-	})
+		SrcTLS:   tls,
+		Progress: progressOutput(config),
+		SrcOS:    platform.OS,
+		SrcArch:  platform.Architecture,
+	}, auth)
 	if err != nil {
+		if isUnauthorized(err) {
+			return newError(ErrPullUnauthorized, err, "couldn't load %s", toImport)
+		}
 		return err
 	}
 
 	return err
 }
 
+// importByDigest imports toImport, whose manifest has the digest
+// manifestDigest, as tag in the import layout, only downloading it if it
+// isn't already in the base image cache. If it's a multi-platform image, the
+// image for platform is imported.
+func importByDigest(toImport string, manifestDigest digest.Digest, tag string, config StackerConfig, tls lib.TLSOpts, auth RegistryAuth, platform ispec.Platform) error {
+	sharedDir := baseImageCacheDir(config)
+	if err := os.MkdirAll(sharedDir, 0755); err != nil {
+		return err
+	}
+
+	// the cache may be shared with other stackers, so make sure only one
+	// of us writes to it at a time.
+	lock, err := os.OpenFile(path.Join(sharedDir, ".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return errors.Wrapf(err, "couldn't lock base image cache %s", sharedDir)
+	}
+
+	// the digest may be that of a list of images for several
+	// platforms, which has a different image for each of them
+	sharedTag := digestTag(manifestDigest)
+	if !isHost(platform) {
+		p := orHost(platform)
+		sharedTag = fmt.Sprintf("%s_%s_%s", sharedTag, p.OS, p.Architecture)
+	}
+
+	cached := false
+	sharedOCI, err := umoci.OpenLayout(sharedDir)
+	if err == nil {
+		descs, err := sharedOCI.ResolveReference(context.Background(), sharedTag)
+		cached = err == nil && len(descs) > 0
+		sharedOCI.Close()
+	}
+
+	sharedImage := fmt.Sprintf("oci:%s:%s", sharedDir, sharedTag)
+	if cached {
+		verbosef(config, "found %s in base image cache as %s\n", toImport, manifestDigest)
+	} else {
+		infof(config, "loading %s\n", toImport)
+		err = imageCopy(config, lib.ImageCopyOpts{
+			Src:      toImport,
+			Dest:     sharedImage,
+			SrcTLS:   tls,
+			Progress: progressOutput(config),
+			SrcOS:    platform.OS,
+			SrcArch:  platform.Architecture,
+		}, auth)
+		if err != nil {
+			if isUnauthorized(err) {
+				return newError(ErrPullUnauthorized, err, "couldn't load %s", toImport)
+			}
+			return err
+		}
+	}
+
+	cacheDir := path.Join(config.StackerDir, "layer-bases", "oci")
+	return lib.ImageCopy(lib.ImageCopyOpts{
+		Src:  sharedImage,
+		Dest: fmt.Sprintf("oci:%s:%s", cacheDir, tag),
+	})
+}
+
 func extractOutput(o BaseLayerOpts) error {
 	tag, err := o.Layer.From.ParseTag()
 	if err != nil {
@@ -103,7 +238,6 @@ func extractOutput(o BaseLayerOpts) error {
 	}
 
 	target := path.Join(o.Config.RootFSDir, o.Target)
-	fmt.Println("unpacking to", target)
 
 	cacheDir := path.Join(o.Config.StackerDir, "layer-bases", "oci")
 	cacheTag, err := o.Layer.From.ParseTag()
@@ -122,53 +256,58 @@ func extractOutput(o BaseLayerOpts) error {
 		return err
 	}
 
-	if manifest.Layers[0].MediaType == stackeroci.MediaTypeLayerSquashfs {
+	if len(manifest.Layers) > 0 && manifest.Layers[0].MediaType == stackeroci.MediaTypeLayerSquashfs {
 		sourceLayerType = "squashfs"
 	}
 
-	if sourceLayerType == "squashfs" {
-		for _, layer := range manifest.Layers {
-			rootfs := path.Join(target, "rootfs")
-			squashfsFile := path.Join(cacheDir, "blobs", "sha256", layer.Digest.Encoded())
-			err = MaybeRunInUserns([]string{"unsquashfs", "-f", "-d", rootfs, squashfsFile}, "couldn't unsquashfs layer")
-			if err != nil {
-				return err
-			}
-		}
+	dps, err := cacheOCI.ResolveReference(context.Background(), tag)
+	if err != nil {
+		return err
+	}
 
-		dps, err := cacheOCI.ResolveReference(context.Background(), tag)
-		if err != nil {
+	// the unpacked base is kept around as a snapshot, so it only needs to
+	// be unpacked once.
+	unpacked := baseSnapshotName(dps[0].Descriptor().Digest)
+	if o.Storage != nil && o.Storage.Exists(unpacked) {
+		verbosef(o.Config, "using unpacked %s\n", tag)
+		if err := o.Storage.Delete(o.Target); err != nil {
 			return err
 		}
 
-		mtreeName := strings.Replace(dps[0].Descriptor().Digest.String(), ":", "_", 1)
-		err = umoci.GenerateBundleManifest(mtreeName, target, fseval.DefaultFsEval)
-		if err != nil {
+		if err := o.Storage.Restore(unpacked, o.Target); err != nil {
 			return err
 		}
-
-		err = umoci.WriteBundleMeta(target, umoci.Meta{
-			Version: umoci.MetaVersion,
-			From: casext.DescriptorPath{
-				Walk: []ispec.Descriptor{dps[0].Descriptor()},
-			},
-		})
 	} else {
-		// This is a bit of a hack; since we want to unpack from the
-		// layer-bases import folder instead of the actual oci dir, we hack
-		// this to make config.OCIDir be our input folder. That's a lie, but it
-		// seems better to do a little lie here than to try and abstract it out
-		// and make everyone else deal with it.
-		modifiedConfig := o.Config
-		modifiedConfig.OCIDir = cacheDir
-		err = RunUmociSubcommand(modifiedConfig, o.Debug, []string{
-			"--bundle-path", target,
-			"--tag", tag,
-			"unpack",
-		})
+		verboseln(o.Config, "unpacking to", target)
+		err = unpackBase(o, cacheDir, tag, sourceLayerType, manifest, dps[0].Descriptor())
 		if err != nil {
 			return err
 		}
+
+		if o.Storage != nil {
+			if err := o.Storage.Snapshot(o.Target, unpacked); err != nil {
+				return err
+			}
+
+			if err := recordSnapshot(o.Config, unpacked, tag); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the snapshot has all of the image's xattrs, so that it can be used
+	// whatever xattrs are kept, and they're stripped from the copy
+	xattrs, err := parseXattrNamespaces(o.Xattrs)
+	if err != nil {
+		return err
+	}
+
+	if xattrs != nil {
+		if IdmapSet != nil {
+			warnf(o.Config, "warning: can't remove xattrs from %s when running unprivileged, keeping all of them\n", tag)
+		} else if err := stripXattrs(path.Join(target, "rootfs"), xattrs); err != nil {
+			return err
+		}
 	}
 
 	// Delete the tag for the base layer; we're only interested in our
@@ -191,14 +330,17 @@ func extractOutput(o BaseLayerOpts) error {
 
 	var blob io.ReadCloser
 
-	bundlePath := path.Join(o.Config.RootFSDir, WorkingContainerName)
+	bundlePath := path.Join(o.Config.RootFSDir, o.Config.WorkingContainer())
 	// otherwise, render the right layer type
 	if o.LayerType == "squashfs" {
 		// sourced a non-squashfs image and wants a squashfs layer,
 		// let's generate one.
-		o.OCI.GC(context.Background())
+		readOnly := o.Cache != nil && o.Cache.opts.readOnly
+		if grace, err := o.Config.gcPolicy().gracePeriod(); err == nil && !readOnly {
+			gcLayout(o.OCI, o.Config.OCIDir, grace, cachedImages(o.Cache))
+		}
 
-		tmpSquashfs, err := mkSquashfs(o.Config, nil)
+		tmpSquashfs, err := mkSquashfs(o.Config, nil, xattrs.squashfsXattrs())
 		if err != nil {
 			return err
 		}
@@ -216,6 +358,7 @@ func extractOutput(o BaseLayerOpts) error {
 		if err != nil {
 			return err
 		}
+		blob = filterTarXattrs(blob, xattrs)
 	}
 
 	layerDigest, layerSize, err := o.OCI.PutBlob(context.Background(), blob)
@@ -294,10 +437,59 @@ func extractOutput(o BaseLayerOpts) error {
 	return err
 }
 
+// baseSnapshotName is the name of the snapshot of the unpacked image whose
+// manifest has the digest d.
+func baseSnapshotName(d digest.Digest) string {
+	return fmt.Sprintf("base-%s", d.Encoded())
+}
+
+// unpackBase unpacks the image tag from the import layout cacheDir into
+// o.Target.
+func unpackBase(o BaseLayerOpts, cacheDir string, tag string, sourceLayerType string, manifest ispec.Manifest, manifestDesc ispec.Descriptor) error {
+	target := path.Join(o.Config.RootFSDir, o.Target)
+
+	if sourceLayerType == "squashfs" {
+		for _, layer := range manifest.Layers {
+			rootfs := path.Join(target, "rootfs")
+			squashfsFile := path.Join(cacheDir, "blobs", "sha256", layer.Digest.Encoded())
+			err := MaybeRunInUserns([]string{o.Config.ToolPath(ToolUnsquashfs), "-f", "-d", rootfs, squashfsFile}, "couldn't unsquashfs layer")
+			if err != nil {
+				return err
+			}
+		}
+
+		mtreeName := strings.Replace(manifestDesc.Digest.String(), ":", "_", 1)
+		err := umoci.GenerateBundleManifest(mtreeName, target, fseval.DefaultFsEval)
+		if err != nil {
+			return err
+		}
+
+		return umoci.WriteBundleMeta(target, umoci.Meta{
+			Version: umoci.MetaVersion,
+			From: casext.DescriptorPath{
+				Walk: []ispec.Descriptor{manifestDesc},
+			},
+		})
+	}
+
+	// This is a bit of a hack; since we want to unpack from the
+	// layer-bases import folder instead of the actual oci dir, we hack
+	// this to make config.OCIDir be our input folder. That's a lie, but it
+	// seems better to do a little lie here than to try and abstract it out
+	// and make everyone else deal with it.
+	modifiedConfig := o.Config
+	modifiedConfig.OCIDir = cacheDir
+	return RunUmociSubcommand(modifiedConfig, o.Debug, []string{
+		"--bundle-path", target,
+		"--tag", tag,
+		"unpack",
+	})
+}
+
 func umociInit(o BaseLayerOpts) error {
 	return RunUmociSubcommand(o.Config, o.Debug, []string{
 		"--tag", o.Name,
-		"--bundle-path", path.Join(o.Config.RootFSDir, WorkingContainerName),
+		"--bundle-path", path.Join(o.Config.RootFSDir, o.Config.WorkingContainer()),
 		"init",
 	})
 }
@@ -308,24 +500,13 @@ func getTar(o BaseLayerOpts) error {
 		return err
 	}
 
-	tar, err := acquireUrl(o.Config, o.Layer.From.Url, cacheDir)
+	err := umociInit(o)
 	if err != nil {
 		return err
 	}
 
-	err = umociInit(o)
-	if err != nil {
-		return err
-	}
-
-	// TODO: make this respect ID maps
 	layerPath := path.Join(o.Config.RootFSDir, o.Target, "rootfs")
-	output, err := exec.Command("tar", "xf", tar, "-C", layerPath).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("error: %s: %s", err, string(output))
-	}
-
-	return nil
+	return extractTarBase(o.Config, o.Layer.From, cacheDir, layerPath)
 }
 
 func getScratch(o BaseLayerOpts) error {
@@ -333,7 +514,7 @@ func getScratch(o BaseLayerOpts) error {
 }
 
 func getContainersImageType(o BaseLayerOpts) error {
-	err := importImage(o.Layer.From, o.Config)
+	err := importImage(o.Layer.From, o.Config, o.Auth, o.Platform)
 	if err != nil {
 		return err
 	}
@@ -354,7 +535,7 @@ func getBuilt(o BaseLayerOpts, sfm StackerFiles) error {
 		var ok bool
 		base, ok = sfm.LookupLayerDefinition(base.From.Tag)
 		if !ok {
-			return fmt.Errorf("missing base layer: %s?", base.From.Tag)
+			return newError(ErrMissingBaseLayer, nil, "missing base layer: %s?", base.From.Tag)
 		}
 
 		if base.From.Type != BuiltType {
@@ -425,12 +606,20 @@ func RunUmociSubcommand(config StackerConfig, debug bool, args []string) error {
 		"--oci-dir", config.OCIDir,
 		"--roots-dir", config.RootFSDir,
 		"--stacker-dir", config.StackerDir,
+		"--working-container", config.WorkingContainer(),
 	}
 
 	if debug {
 		cmd = append(cmd, "--debug")
 	}
 
+	switch outputLevel {
+	case QuietOutput:
+		cmd = append(cmd, "--quiet")
+	case VerboseOutput:
+		cmd = append(cmd, "--verbose")
+	}
+
 	cmd = append(cmd, "umoci")
 	cmd = append(cmd, args...)
 	return MaybeRunInUserns(cmd, "image unpack failed")
@@ -0,0 +1,143 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// shareBlobs hardlinks the blobs of the OCI layout at layout with the ones in
+// the shared blob store sharedDir: blobs the store already has replace the
+// layout's copy, and the rest are added to the store. Since blobs are content
+// addressed and never modified in place, every layout on the host that has a
+// blob then uses the same copy of it on disk.
+func shareBlobs(sharedDir string, layout string) error {
+	blobsDir := path.Join(layout, "blobs")
+	algorithms, err := ioutil.ReadDir(blobsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, alg := range algorithms {
+		if !alg.IsDir() {
+			continue
+		}
+
+		sharedAlgDir := path.Join(sharedDir, alg.Name())
+		if err := os.MkdirAll(sharedAlgDir, 0755); err != nil {
+			return err
+		}
+
+		blobs, err := ioutil.ReadDir(path.Join(blobsDir, alg.Name()))
+		if err != nil {
+			return err
+		}
+
+		for _, blob := range blobs {
+			if !blob.Mode().IsRegular() {
+				continue
+			}
+
+			local := path.Join(blobsDir, alg.Name(), blob.Name())
+			shared := path.Join(sharedAlgDir, blob.Name())
+			if err := shareBlob(shared, local, blob); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func shareBlob(shared string, local string, localInfo os.FileInfo) error {
+	sharedInfo, err := os.Stat(shared)
+	if os.IsNotExist(err) {
+		err = os.Link(local, shared)
+		if err != nil && !os.IsExist(err) {
+			return errors.Wrapf(err, "couldn't add %s to the shared blob store (it must be on the same filesystem as the OCI layouts)", local)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if os.SameFile(sharedInfo, localInfo) {
+		return nil
+	}
+
+	// link the shared copy next to ours and rename it over ours, so that
+	// the layout is never missing the blob
+	tmp := local + ".shared"
+	os.Remove(tmp)
+	if err := os.Link(shared, tmp); err != nil {
+		return errors.Wrapf(err, "couldn't link %s from the shared blob store", shared)
+	}
+
+	if err := os.Rename(tmp, local); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// ShareBlobs deduplicates the blobs in config's output and import layouts
+// against config.SharedBlobDir. It does nothing if there is no shared blob
+// store configured.
+func ShareBlobs(config StackerConfig) error {
+	if config.SharedBlobDir == "" {
+		return nil
+	}
+
+	for _, layout := range []string{config.OCIDir, path.Join(config.StackerDir, "layer-bases", "oci")} {
+		if err := shareBlobs(config.SharedBlobDir, layout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// gcSharedBlobs removes the blobs in the shared blob store that no layout
+// links to anymore, and that haven't changed (or been unlinked) in the last
+// grace.
+func gcSharedBlobs(sharedDir string, grace time.Duration) error {
+	algorithms, err := ioutil.ReadDir(sharedDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, alg := range algorithms {
+		if !alg.IsDir() {
+			continue
+		}
+
+		blobs, err := ioutil.ReadDir(path.Join(sharedDir, alg.Name()))
+		if err != nil {
+			return err
+		}
+
+		for _, blob := range blobs {
+			p := path.Join(sharedDir, alg.Name(), blob.Name())
+			if !blob.Mode().IsRegular() || blob.Sys().(*syscall.Stat_t).Nlink > 1 || changedWithin(p, grace) {
+				continue
+			}
+
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func writeBlob(t *testing.T, layout string, digest string) string {
+	dir := path.Join(layout, "blobs", "sha256")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	p := path.Join(dir, digest)
+	if err := ioutil.WriteFile(p, []byte(digest), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	return p
+}
+
+func TestShareBlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_blobstore_test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	shared := path.Join(dir, "shared")
+	one := writeBlob(t, path.Join(dir, "one"), "aaaa")
+	two := writeBlob(t, path.Join(dir, "two"), "aaaa")
+	writeBlob(t, path.Join(dir, "two"), "bbbb")
+
+	for _, layout := range []string{"one", "two"} {
+		if err := shareBlobs(shared, path.Join(dir, layout)); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	oneInfo, err := os.Stat(one)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	twoInfo, err := os.Stat(two)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if !os.SameFile(oneInfo, twoInfo) {
+		t.Fatalf("blob not shared between layouts")
+	}
+
+	// only the shared store has bbbb once two's copy is gone
+	if err := os.RemoveAll(path.Join(dir, "two")); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := gcSharedBlobs(shared, 0); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if _, err := os.Stat(path.Join(shared, "sha256", "aaaa")); err != nil {
+		t.Fatalf("used blob was removed: %s", err)
+	}
+
+	if _, err := os.Stat(path.Join(shared, "sha256", "bbbb")); !os.IsNotExist(err) {
+		t.Fatalf("unused blob was kept: %v", err)
+	}
+}
@@ -22,7 +22,6 @@ import (
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/vbatts/go-mtree"
-	"golang.org/x/sys/unix"
 )
 
 type BuildArgs struct {
@@ -36,6 +35,226 @@ type BuildArgs struct {
 	Debug                   bool
 	OrderOnly               bool
 	RemoteSaveTags          []string
+	Hooks                   Hooks
+	Webhooks                []string
+	WebhookFormat           string
+	MetricsTextfile         bool
+	RegistryAuth            RegistryAuth
+	Template                bool
+	TemplateEnv             []string
+	SubstituteFiles         []string
+	SubstituteEnvPrefix     string
+	NoStackerAnnotations    bool
+	RedactSubstitutions     bool
+	AnnotationPrefix        string
+	Squash                  bool
+	MaxLayerSize            int64
+	Xattrs                  []string
+	VerifyLayers            bool
+	ArtifactsDir            string
+	PushArtifacts           bool
+	Platform                string
+	Secrets                 []string
+	CacheSalt               string
+	Policies                []string
+	Scanner                 string
+	ScanFailOn              string
+	LayerSizeReport         int
+	NoAutoClean             bool
+	NoSpaceCheck            bool
+	ChunkSquashfs           bool
+	BundleDir               string
+
+	// WaitForOCIDir waits for other builds in the OCIDir to be done,
+	// instead of failing with ErrBuildInProgress.
+	WaitForOCIDir bool
+
+	// Untrusted refuses stackerfiles whose layers use the host rather
+	// than staying in their containers (hooks, binds, devices, privileged,
+	// host files outside the stackerfile's directory), for stackerfiles
+	// that aren't trusted with what stacker can do as root.
+	Untrusted bool
+
+	// ReadOnlyCache uses the layers in the build cache, but doesn't add
+	// the ones it builds to it, and leaves everything else in the stacker
+	// dir, OCIDir and shared blob store other than the layers' tags as it
+	// is. The snapshots of layers it replaces are put back when the build
+	// is done.
+	ReadOnlyCache bool
+
+	// CacheNamespace is the namespace in the build cache (e.g. a branch's
+	// name) that the build uses and adds to, so that builds in other
+	// namespaces don't replace its entries, or it theirs.
+	CacheNamespace string
+
+	// CacheReadFrom are the namespaces, in order, that layers the cache
+	// namespace doesn't have are used from, e.g. the main branch's, for a
+	// feature branch's first build to start warm.
+	CacheReadFrom []string
+
+	// noSave builds without saving layers to the stackerfiles' save_urls.
+	noSave bool
+
+	// eventHandlers are called with the build's events, see
+	// Builder.OnEvent.
+	eventHandlers []EventHandler
+}
+
+// registryAuth returns the registry credentials in the config, overridden by
+// the ones given to the build.
+func (opts *BuildArgs) registryAuth() RegistryAuth {
+	auth := RegistryAuth{}
+	for host, creds := range opts.Config.RegistryAuth {
+		auth[host] = creds
+	}
+
+	for host, creds := range opts.RegistryAuth {
+		auth[host] = creds
+	}
+
+	return auth
+}
+
+func (opts *BuildArgs) cacheOpts() cacheOpts {
+	return cacheOpts{
+		readOnly:  opts.ReadOnlyCache,
+		namespace: opts.CacheNamespace,
+		readFrom:  opts.CacheReadFrom,
+	}
+}
+
+// keepNamespacedSnapshot snapshots the layer name that was just built for its
+// entry in the build's cache namespace, if it has one, since the snapshot
+// named after the layer is replaced by builds of it in other namespaces.
+func keepNamespacedSnapshot(opts *BuildArgs, s Storage, name string) error {
+	if opts.CacheNamespace == "" || opts.ReadOnlyCache {
+		return nil
+	}
+
+	snapshot := namespacedSnapshot(opts.CacheNamespace, name)
+	s.Delete(snapshot)
+	if err := s.Snapshot(name, snapshot); err != nil {
+		return err
+	}
+
+	return recordSnapshot(opts.Config, snapshot, name)
+}
+
+// readOnlyStash is the name of the snapshot a read only build puts the
+// snapshot of the layer name aside as while it has its own build of it. Cache
+// namespaces can't have a : in them, so it's no namespace's snapshot.
+func readOnlyStash(name string) string {
+	return namespacedSnapshot(":read-only", name)
+}
+
+// replaceSnapshot replaces the snapshot of the layer name with one of source.
+// Cache entries use the snapshot that's there, so read only builds put it
+// aside first and restoreSnapshots puts it back when they're done.
+func (b *Builder) replaceSnapshot(s Storage, source string, name string) error {
+	if b.opts.ReadOnlyCache {
+		if _, ok := b.readOnlySnapshots[name]; !ok {
+			// one left by a read only build that crashed is the
+			// real one
+			stashed := s.Exists(readOnlyStash(name))
+			if !stashed && s.Exists(name) {
+				if err := s.Snapshot(name, readOnlyStash(name)); err != nil {
+					return err
+				}
+				stashed = true
+			}
+			b.readOnlySnapshots[name] = stashed
+		}
+
+		s.Delete(name)
+		return s.Snapshot(source, name)
+	}
+
+	s.Delete(name)
+	if err := s.Snapshot(source, name); err != nil {
+		return err
+	}
+
+	return recordSnapshot(b.opts.Config, name, name)
+}
+
+// restoreSnapshots puts back the snapshots a read only build replaced, and
+// deletes the ones it made of layers that didn't have any.
+func (b *Builder) restoreSnapshots() {
+	if len(b.readOnlySnapshots) == 0 {
+		return
+	}
+
+	lock, err := LockOCIDir(b.opts.Config)
+	if err != nil {
+		warnf(b.opts.Config, "couldn't restore the snapshots the build replaced: %v\n", err)
+		return
+	}
+	defer lock.Unlock()
+
+	s, err := NewStorage(b.opts.Config)
+	if err != nil {
+		warnf(b.opts.Config, "couldn't restore the snapshots the build replaced: %v\n", err)
+		return
+	}
+	if !b.opts.LeaveUnladen {
+		defer s.Detach()
+	}
+
+	for name, stashed := range b.readOnlySnapshots {
+		if err := restoreSnapshot(s, name, stashed); err != nil {
+			warnf(b.opts.Config, "couldn't restore the snapshot of %s: %v\n", name, err)
+			continue
+		}
+		delete(b.readOnlySnapshots, name)
+	}
+}
+
+// restoreSnapshot puts back the snapshot of the layer name that a read only
+// build put aside, if it did (stashed), or else deletes the build's own.
+func restoreSnapshot(s Storage, name string, stashed bool) error {
+	if !stashed {
+		return s.Delete(name)
+	}
+
+	// another stacker's clean up may have put it back already
+	if !s.Exists(readOnlyStash(name)) {
+		return nil
+	}
+
+	s.Delete(name)
+	if err := s.Snapshot(readOnlyStash(name), name); err != nil {
+		return err
+	}
+
+	return s.Delete(readOnlyStash(name))
+}
+
+// stackerfileOpts returns the options for reading stackerfiles. Substitutions
+// are applied in order and the first one for a name wins, so ones given
+// explicitly override ones from the environment, which override ones from
+// files.
+func (opts *BuildArgs) stackerfileOpts() (StackerfileOpts, error) {
+	substitute := append([]string{}, opts.Substitute...)
+
+	if opts.SubstituteEnvPrefix != "" {
+		substitute = append(substitute, SubstitutionsFromEnv(opts.SubstituteEnvPrefix)...)
+	}
+
+	for _, f := range opts.SubstituteFiles {
+		fromFile, err := SubstitutionsFromFile(f)
+		if err != nil {
+			return StackerfileOpts{}, err
+		}
+		substitute = append(substitute, fromFile...)
+	}
+
+	return StackerfileOpts{
+		Substitute:  substitute,
+		Template:    opts.Template,
+		TemplateEnv: opts.TemplateEnv,
+		GitCloneDir: path.Join(opts.Config.StackerDir, "git"),
+		config:      opts.Config,
+	}, nil
 }
 
 func updateBundleMtree(rootPath string, newPath ispec.Descriptor) error {
@@ -57,100 +276,157 @@ func updateBundleMtree(rootPath string, newPath ispec.Descriptor) error {
 	return nil
 }
 
-func mkSquashfs(config StackerConfig, eps *squashfs.ExcludePaths) (io.ReadCloser, error) {
-	// generate the squashfs in OCIDir, and then open it, read it from
-	// there, and delete it.
-	if err := os.MkdirAll(config.OCIDir, 0755); err != nil {
+// squashfsStageDir is where in the working container's bundle the files of
+// an incremental squashfs layer are staged.
+const squashfsStageDir = "squashfs-stage"
+
+func mkSquashfs(config StackerConfig, eps *squashfs.ExcludePaths, xattrs bool) (io.ReadCloser, error) {
+	// generate the squashfs in the scratch directory, and then open it,
+	// read it from there, and delete it.
+	if err := checkScratchSpace(config); err != nil {
 		return nil, err
 	}
 
-	rootfsPath := path.Join(config.RootFSDir, WorkingContainerName, "rootfs")
-	return squashfs.MakeSquashfs(config.OCIDir, rootfsPath, eps)
+	rootfsPath := path.Join(config.RootFSDir, config.WorkingContainer(), "rootfs")
+	return squashfs.MakeSquashfs(config.ToolPath(ToolMksquashfs), config.squashfsScratchDir(), rootfsPath, eps, xattrs)
 }
 
-func generateSquashfsLayer(oci casext.Engine, name string, author string, opts *BuildArgs) error {
-	meta, err := umoci.ReadBundleMeta(path.Join(opts.Config.RootFSDir, WorkingContainerName))
-	if err != nil {
-		return err
+// repackTarLayer adds the changes to the working container's rootfs as a new
+// tar layer of name. As root, this is done in-process (and how long finding
+// the changes took is added to report); otherwise, the rootfs belongs to the
+// ids mapped into the container, so only a stacker running in its user
+// namespace can read all of it.
+func repackTarLayer(oci casext.Engine, name string, history *ispec.History, squash bool, opts *BuildArgs, report *LayerReport) error {
+	bundlePath := path.Join(opts.Config.RootFSDir, opts.Config.WorkingContainer())
+	if IdmapSet == nil && os.Geteuid() == 0 {
+		return Repack(oci, RepackOpts{
+			Tag:          name,
+			BundlePath:   bundlePath,
+			History:      history,
+			Squash:       squash,
+			MaxLayerSize: opts.MaxLayerSize,
+			Xattrs:       opts.Xattrs,
+			Progress: func(layer int, layers int) {
+				if layers > 1 {
+					verbosef(opts.Config, "generating layer %d of %d for %s\n", layer, layers, name)
+				}
+			},
+			Timing: report.timedDuration,
+			config: opts.Config,
+		})
 	}
 
-	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
-	mtreePath := path.Join(opts.Config.RootFSDir, WorkingContainerName, mtreeName+".mtree")
-
-	mfh, err := os.Open(mtreePath)
-	if err != nil {
-		return err
+	args := []string{
+		"--tag", name,
+		"--bundle-path", bundlePath,
+		"repack",
+		"--history-author", history.Author,
+		"--history-created-by", history.CreatedBy,
+	}
+	if squash {
+		args = append(args, "--squash")
+	}
+	if opts.MaxLayerSize != 0 {
+		args = append(args, "--max-layer-size", fmt.Sprintf("%d", opts.MaxLayerSize))
+	}
+	for _, ns := range opts.Xattrs {
+		args = append(args, "--xattrs", ns)
 	}
 
-	spec, err := mtree.ParseSpec(mfh)
+	return RunUmociSubcommand(opts.Config, opts.Debug, args)
+}
+
+func generateSquashfsLayer(oci casext.Engine, name string, history *ispec.History, squash bool, opts *BuildArgs) error {
+	meta, err := umoci.ReadBundleMeta(path.Join(opts.Config.RootFSDir, opts.Config.WorkingContainer()))
 	if err != nil {
 		return err
 	}
 
+	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
+	mtreePath := path.Join(opts.Config.RootFSDir, opts.Config.WorkingContainer(), mtreeName+".mtree")
+
 	fsEval := fseval.DefaultFsEval
-	rootfsPath := path.Join(opts.Config.RootFSDir, WorkingContainerName, "rootfs")
-	newDH, err := mtree.Walk(rootfsPath, nil, umoci.MtreeKeywords, fsEval)
-	if err != nil {
-		return errors.Wrapf(err, "couldn't mtree walk %s", rootfsPath)
-	}
+	rootfsPath := path.Join(opts.Config.RootFSDir, opts.Config.WorkingContainer(), "rootfs")
 
-	diffs, err := mtree.CompareSame(spec, newDH, umoci.MtreeKeywords)
-	if err != nil {
-		return err
-	}
+	var tmpSquashfs io.ReadCloser
+	if squash {
+		// the squashfs of the whole rootfs, on top of nothing, squashes
+		// the image
+		cleared, err := stackeroci.ClearLayers(oci, meta.From.Descriptor())
+		if err != nil {
+			return err
+		}
 
-	// This is a pretty massive hack, because there's no library for
-	// generating squashfs images. However, mksquashfs does take a list of
-	// files to exclude from the image. So we go through and accumulate a
-	// list of these files.
-	//
-	// For missing files, since we're going to use overlayfs with
-	// squashfs, we use overlayfs' mechanism for whiteouts, which is a
-	// character device with device numbers 0/0. But since there's no
-	// library for generating squashfs images, we have to write these to
-	// the actual filesystem, and then remember what they are so we can
-	// delete them later.
-	missing := []string{}
-	defer func() {
-		for _, f := range missing {
-			os.Remove(f)
+		if err := oci.UpdateReference(context.Background(), name, cleared); err != nil {
+			return err
 		}
-	}()
 
-	paths := squashfs.NewExcludePaths()
-	for _, diff := range diffs {
-		switch diff.Type() {
-		case mtree.Modified, mtree.Extra:
-			p := path.Join(rootfsPath, diff.Path())
-			missing = append(missing, p)
-			paths.AddInclude(p, diff.New().IsDir())
-		case mtree.Missing:
-			p := path.Join(rootfsPath, diff.Path())
-			missing = append(missing, p)
-			paths.AddInclude(p, diff.Old().IsDir())
-			if err := unix.Mknod(p, unix.S_IFCHR, int(unix.Mkdev(0, 0))); err != nil {
-				if !os.IsNotExist(err) && err != unix.ENOTDIR {
-					return errors.Wrapf(err, "couldn't mknod whiteout for %s", diff.Path())
-				}
+		tmpSquashfs, err = mkSquashfs(opts.Config, nil, opts.xattrFilter().squashfsXattrs())
+		if err != nil {
+			return err
+		}
+	} else {
+		mfh, err := os.Open(mtreePath)
+		if err != nil {
+			return err
+		}
+
+		spec, err := mtree.ParseSpec(mfh)
+		if err != nil {
+			return err
+		}
+
+		newDH, err := walkRootfs(rootfsPath, umoci.MtreeKeywords, fsEval, path.Join(opts.Config.StackerDir, "mtree.cache"))
+		if err != nil {
+			return errors.Wrapf(err, "couldn't mtree walk %s", rootfsPath)
+		}
+
+		diffs, err := mtree.CompareSame(spec, newDH, umoci.MtreeKeywords)
+		if err != nil {
+			return err
+		}
+
+		// There's no library for generating squashfs images, so the
+		// files that changed are staged in a tree of their own (as
+		// hardlinks) that mksquashfs makes the layer out of. A
+		// directory that changed only brings itself, not the files in
+		// it that didn't.
+		//
+		// For missing files, since we're going to use overlayfs with
+		// squashfs, we use overlayfs' mechanism for whiteouts, which is a
+		// character device with device numbers 0/0.
+		files := squashfs.NewFileList(rootfsPath)
+		for _, diff := range diffs {
+			switch diff.Type() {
+			case mtree.Modified, mtree.Extra:
+				files.Add(diff.Path())
+			case mtree.Missing:
+				files.AddWhiteout(diff.Path())
 			}
-		case mtree.Same:
-			paths.AddExclude(path.Join(rootfsPath, diff.Path()))
 		}
-	}
 
-	tmpSquashfs, err := mkSquashfs(opts.Config, paths)
-	if err != nil {
-		return err
+		if err := checkScratchSpace(opts.Config); err != nil {
+			return err
+		}
+
+		// the stage has to be on the rootfs' filesystem to hardlink
+		stage := path.Join(opts.Config.RootFSDir, opts.Config.WorkingContainer(), squashfsStageDir)
+		os.RemoveAll(stage)
+		tmpSquashfs, err = squashfs.MakeSquashfsFiles(opts.Config.ToolPath(ToolMksquashfs), opts.Config.squashfsScratchDir(),
+			stage, files, opts.xattrFilter().squashfsXattrs())
+		if err != nil {
+			return err
+		}
 	}
 	defer tmpSquashfs.Close()
 
-	desc, err := stackeroci.AddBlobNoCompression(oci, name, tmpSquashfs)
+	desc, err := stackeroci.AddBlobNoCompression(oci, name, tmpSquashfs, history)
 	if err != nil {
 		return err
 	}
 
 	newName := strings.Replace(desc.Digest.String(), ":", "_", 1) + ".mtree"
-	err = umoci.GenerateBundleManifest(newName, path.Join(opts.Config.RootFSDir, WorkingContainerName), fsEval)
+	err = umoci.GenerateBundleManifest(newName, path.Join(opts.Config.RootFSDir, opts.Config.WorkingContainer()), fsEval)
 	if err != nil {
 		return err
 	}
@@ -159,7 +435,7 @@ func generateSquashfsLayer(oci casext.Engine, name string, author string, opts *
 	meta.From = casext.DescriptorPath{
 		Walk: []ispec.Descriptor{desc},
 	}
-	err = umoci.WriteBundleMeta(path.Join(opts.Config.RootFSDir, WorkingContainerName), meta)
+	err = umoci.WriteBundleMeta(path.Join(opts.Config.RootFSDir, opts.Config.WorkingContainer()), meta)
 	if err != nil {
 		return err
 	}
@@ -194,7 +470,7 @@ func SaveLayer(opts *BuildArgs, sf *Stackerfile, name string) error {
 	}
 
 	if len(tags) == 0 {
-		fmt.Printf("can't save layer %s since list of tags is empty\n", name)
+		warnf(opts.Config, "can't save layer %s since list of tags is empty\n", name)
 	}
 
 	// Store the layers to new detination
@@ -206,19 +482,44 @@ func SaveLayer(opts *BuildArgs, sf *Stackerfile, name string) error {
 		case OCIType:
 			destUrl = fmt.Sprintf("%s:%s_%s", sf.buildConfig.SaveUrl, name, tag)
 		default:
-			return fmt.Errorf("can't save layers to destination type: %s", is.Type)
+			scheme, ok := lookupScheme(is.Type)
+			if !ok {
+				return fmt.Errorf("can't save layers to destination type: %s", is.Type)
+			}
+
+			destUrl = fmt.Sprintf("%s/%s:%s", strings.TrimRight(sf.buildConfig.SaveUrl, "/"), name, tag)
+			infof(opts.Config, "saving %s\n", destUrl)
+			start := time.Now()
+			if err := scheme.Push(opts.Config, opts.Config.OCIDir, name, destUrl); err != nil {
+				return err
+			}
+			metricsPush(start)
+			opts.emit(Event{Type: EventLayerPushed, Stackerfile: sf.path, Layer: name, URL: redactURL(destUrl)})
+			continue
 		}
 
-		fmt.Printf("saving %s\n", destUrl)
-		err = lib.ImageCopy(lib.ImageCopyOpts{
+		tls, err := opts.Config.registryTLS(destUrl)
+		if err != nil {
+			return err
+		}
+
+		infof(opts.Config, "saving %s\n", destUrl)
+		start := time.Now()
+		err = imageCopy(opts.Config, lib.ImageCopyOpts{
 			Src:      fmt.Sprintf("oci:%s:%s", opts.Config.OCIDir, name),
 			Dest:     destUrl,
-			Progress: os.Stdout,
+			Progress: opts.eventOutput(Event{Type: EventPushProgress, Stackerfile: sf.path, Layer: name, URL: redactURL(destUrl)}, progressOutput(opts.Config)),
 			SkipTLS:  true,
-		})
+			DestTLS:  tls,
+		}, opts.registryAuth())
 		if err != nil {
+			if isUnauthorized(err) {
+				return newError(ErrPushUnauthorized, err, "couldn't save %s", destUrl)
+			}
 			return err
 		}
+		metricsPush(start)
+		opts.emit(Event{Type: EventLayerPushed, Stackerfile: sf.path, Layer: name, URL: redactURL(destUrl)})
 	}
 	return nil
 }
@@ -227,28 +528,230 @@ func SaveLayer(opts *BuildArgs, sf *Stackerfile, name string) error {
 type Builder struct {
 	builtStackerfiles StackerFiles // Keep track of all the Stackerfiles which were built
 	opts              *BuildArgs   // Build options
+	report            *BuildReport // Summary of what was built
+	ctx               context.Context
+
+	// recovered is set once what crashed builds left behind has been
+	// cleaned up, which only needs doing before the first stackerfile.
+	recovered bool
+
+	// readOnlySnapshots are the layers whose snapshots a read only build
+	// replaced, and whether they had one it put aside, see
+	// replaceSnapshot.
+	readOnlySnapshots map[string]bool
+
+	// runner runs the builds instead of this builder, if it's set.
+	runner Runner
+}
+
+// Runner runs builds somewhere other than in this stacker, e.g. KubeRunner.
+type Runner interface {
+	// Run builds the stackerfiles at paths with opts, sending the build's
+	// events to opts' event handlers.
+	Run(opts *BuildArgs, paths []string) error
+}
+
+// SetRunner makes the builder's Build and BuildMultiple run their builds with
+// r, so that the builder's event handlers see builds that happen elsewhere
+// the same way as ones that happen here.
+func (b *Builder) SetRunner(r Runner) {
+	b.runner = r
 }
 
 // NewBuilder initializes a new Builder struct
 func NewBuilder(opts *BuildArgs) *Builder {
 	return &Builder{
 		builtStackerfiles: make(map[string]*Stackerfile, 1),
+		readOnlySnapshots: map[string]bool{},
 		opts:              opts,
+		report:            &BuildReport{Stackerfiles: []*StackerfileReport{}},
+		ctx:               context.Background(),
 	}
 }
 
+// SetContext makes the builder stop before the next layer, or the next phase
+// of the layer it's building, once ctx is cancelled.
+func (b *Builder) SetContext(ctx context.Context) {
+	b.ctx = ctx
+}
+
+// interrupted returns ErrInterrupted if the builder's context has been
+// cancelled while building name.
+func (b *Builder) interrupted(name string) error {
+	if err := b.ctx.Err(); err != nil {
+		return newError(ErrInterrupted, err, "stopped building %s", name)
+	}
+	return nil
+}
+
+// Report returns the report of everything this builder has built so far.
+func (b *Builder) Report() *BuildReport {
+	return b.report
+}
+
+// noShellError is the error for when the layer name has commands to run, but
+// no shell to run them with.
+func noShellError(name string, l *Layer) error {
+	if l.From.Type == ScratchType {
+		return newError(ErrNoShell, nil, "rootfs for %s does not have a /bin/sh: it's based on scratch, so run the commands in a build_only layer and copy_from the results", name)
+	}
+	return newError(ErrNoShell, nil, "rootfs for %s does not have a /bin/sh", name)
+}
+
+// runLayerTests runs the layer's test commands in a fresh container created
+// from the snapshot of the layer that was just built, so that the tests see
+// exactly what will be shipped, rather than the build container.
+func runLayerTests(opts *BuildArgs, s Storage, name string, l *Layer, log *layerLog) error {
+	tests, err := l.ParseTest()
+	if err != nil {
+		return err
+	}
+
+	s.Delete(opts.Config.WorkingContainer())
+	if err := s.Restore(name, opts.Config.WorkingContainer()); err != nil {
+		return err
+	}
+	defer s.Delete(opts.Config.WorkingContainer())
+
+	_, err = os.Stat(path.Join(opts.Config.RootFSDir, opts.Config.WorkingContainer(), "rootfs/bin/sh"))
+	if err != nil {
+		return noShellError(name, l)
+	}
+
+	importsDir := path.Join(opts.Config.StackerDir, "imports", name)
+	script := fmt.Sprintf("#!/bin/sh -xe\n%s", strings.Join(tests, "\n"))
+	if err := ioutil.WriteFile(path.Join(importsDir, ".stacker-test.sh"), []byte(script), 0755); err != nil {
+		return err
+	}
+
+	infoln(opts.Config, "running tests for", name)
+	if err := runWithOutput(opts.Config, name, "/stacker/.stacker-test.sh", l, opts.OnRunFailure, nil, log.output()); err != nil {
+		return newError(ErrTestsFailed, err, "tests for %s failed (see %s)", name, log.path)
+	}
+
+	return nil
+}
+
 // Build builds a single stackerfile
 func (b *Builder) Build(file string) error {
+	if b.runner != nil {
+		return b.runner.Run(b.opts, []string{file})
+	}
+
+	defer b.restoreSnapshots()
+	return b.buildFile(file)
+}
+
+func (b *Builder) buildFile(file string) error {
+	return b.buildWithReport(file, func(sfOpts StackerfileOpts) (*Stackerfile, error) {
+		return NewStackerfileWithOpts(file, sfOpts)
+	})
+}
+
+// BuildReader builds the stackerfile read from r, see
+// NewStackerfileFromReader. name is what the stackerfile is called in the
+// build output and report.
+func (b *Builder) BuildReader(name string, r io.Reader, workingDir string) error {
+	defer b.restoreSnapshots()
+	return b.buildWithReport(name, func(sfOpts StackerfileOpts) (*Stackerfile, error) {
+		return NewStackerfileFromReaderWithOpts(r, workingDir, sfOpts)
+	})
+}
+
+func (b *Builder) buildWithReport(name string, read func(StackerfileOpts) (*Stackerfile, error)) error {
 	opts := b.opts
 
 	if opts.NoCache {
-		os.RemoveAll(opts.Config.StackerDir)
+		if opts.ReadOnlyCache {
+			return fmt.Errorf("can't build without the cache and with a read only one")
+		}
+		cleanStackerDir(opts.Config)
+	}
+
+	start := time.Now()
+	sfReport := b.report.newStackerfile(name)
+	err := b.build(name, read, sfReport)
+	if err == nil && !opts.ReadOnlyCache {
+		err = ShareBlobs(opts.Config)
+	}
+	sfReport.finish(start, err)
+
+	if err := b.report.persist(opts.Config); err != nil {
+		warnf(opts.Config, "couldn't write build report: %v\n", err)
+	}
+
+	notifyWebhooks(opts.Config, opts.Webhooks, opts.WebhookFormat, sfReport)
+
+	if opts.MetricsTextfile {
+		if err := writeMetricsTextfile(opts.Config); err != nil {
+			warnf(opts.Config, "couldn't write metrics: %v\n", err)
+		}
+	}
+
+	return err
+}
+
+func (b *Builder) build(file string, read func(StackerfileOpts) (*Stackerfile, error), sfReport *StackerfileReport) error {
+	opts := b.opts
+
+	if err := opts.checkXattrs(); err != nil {
+		return err
+	}
+
+	secrets, err := opts.secrets()
+	if err != nil {
+		return err
+	}
+	opts.Config.Secrets = secrets
+
+	if err := opts.checkScanner(); err != nil {
+		return err
+	}
+
+	if opts.CacheSalt != "" {
+		opts.Config.CacheSalt = opts.CacheSalt
+	}
+
+	sfOpts, err := opts.stackerfileOpts()
+	if err != nil {
+		return err
+	}
+
+	sf, err := read(sfOpts)
+	if err != nil {
+		return err
+	}
+
+	if opts.Untrusted {
+		if err := checkUntrusted(sf); err != nil {
+			return err
+		}
+	}
+
+	if err := opts.checkTools(sf); err != nil {
+		return err
+	}
+
+	if err := checkScratchSpace(opts.Config); err != nil {
+		return err
+	}
+
+	wcLock, err := LockWorkingContainer(opts.Config)
+	if err != nil {
+		return err
+	}
+	defer wcLock.Unlock()
+
+	lockOCIDir := LockOCIDir
+	if opts.WaitForOCIDir {
+		lockOCIDir = WaitForOCIDir
 	}
 
-	sf, err := NewStackerfile(file, opts.Substitute)
+	ociLock, err := lockOCIDir(opts.Config)
 	if err != nil {
 		return err
 	}
+	defer ociLock.Unlock()
 
 	s, err := NewStorage(opts.Config)
 	if err != nil {
@@ -258,11 +761,32 @@ func (b *Builder) Build(file string) error {
 		defer s.Detach()
 	}
 
+	if !opts.NoAutoClean && !b.recovered {
+		if err := recoverStaleState(opts.Config, s); err != nil {
+			return errors.Wrapf(err, "couldn't clean up after a previous build (--no-auto-clean skips this)")
+		}
+		b.recovered = true
+	}
+
+	// an interrupted build's working container is half built, so it's
+	// torn down (before the storage is detached) rather than left around
+	defer func() {
+		if b.ctx.Err() != nil {
+			s.Delete(opts.Config.WorkingContainer())
+		}
+	}()
+
 	order, err := sf.DependencyOrder()
 	if err != nil {
 		return err
 	}
 
+	importLocks, err := lockImports(opts.Config, order)
+	if err != nil {
+		return err
+	}
+	defer unlockAll(importLocks)
+
 	var oci casext.Engine
 	if _, statErr := os.Stat(opts.Config.OCIDir); statErr != nil {
 		oci, err = umoci.CreateLayout(opts.Config.OCIDir)
@@ -276,7 +800,7 @@ func (b *Builder) Build(file string) error {
 
 	// Add this stackerfile to the list of stackerfiles which were built
 	b.builtStackerfiles[file] = sf
-	buildCache, err := OpenCache(opts.Config, oci, b.builtStackerfiles)
+	buildCache, err := openCache(opts.Config, oci, b.builtStackerfiles, opts.cacheOpts())
 	if err != nil {
 		return err
 	}
@@ -286,6 +810,7 @@ func (b *Builder) Build(file string) error {
 	// we'll fall back to putting the whole stacker file contents in the
 	// metadata.
 	gitVersion, _ := GitVersion(sf.referenceDirectory)
+	gitCommit, _ := gitHash(sf.referenceDirectory, false)
 
 	username := os.Getenv("SUDO_USER")
 
@@ -305,20 +830,55 @@ func (b *Builder) Build(file string) error {
 
 	author := fmt.Sprintf("%s@%s", username, host)
 
-	s.Delete(WorkingContainerName)
+	// the log of the layer being built is closed at the end of each
+	// iteration, or here if the build fails part way through one
+	var openLog *layerLog
+	defer func() {
+		if openLog != nil {
+			openLog.Close()
+		}
+	}()
+
+	s.Delete(opts.Config.WorkingContainer())
 	for _, name := range order {
+		// layers are built all or nothing, so if we've been cancelled
+		// we stop between layers, or between the phases of one, and
+		// don't save anything half built
+		if err := b.interrupted(name); err != nil {
+			return err
+		}
+
 		l, ok := sf.Get(name)
 		if !ok {
 			return fmt.Errorf("%s not present in stackerfile?", name)
 		}
 
-		fmt.Printf("building image %s...\n", name)
+		// this is part of the layer's definition (rather than something
+		// we just check when generating the layer) so that squashed and
+		// unsquashed layers are cached separately
+		if opts.Squash {
+			l.Squash = true
+		}
+
+		// the same goes for the default platform
+		if opts.Platform != "" {
+			platform, err := ParsePlatform(opts.Platform)
+			if err != nil {
+				return err
+			}
+			l.setDefaultPlatform(platform)
+		}
+
+		infof(opts.Config, "building image %s...\n", name)
+		layerReport := sfReport.newLayer(name)
+		opts.emit(Event{Type: EventLayerStarted, Stackerfile: file, Layer: name})
 
 		// We need to run the imports first since we now compare
 		// against imports for caching layers. Since we don't do
 		// network copies if the files are present and we use rsync to
 		// copy things across, hopefully this isn't too expensive.
-		fmt.Println("importing files...")
+		infoln(opts.Config, "importing files...")
+		importStart := opts.startPhase(file, name, ImportPhase)
 		imports, err := l.ParseImport()
 		if err != nil {
 			return err
@@ -327,13 +887,40 @@ func (b *Builder) Build(file string) error {
 		if err := Import(opts.Config, name, imports); err != nil {
 			return err
 		}
+		for _, imp := range imports {
+			opts.emit(Event{Type: EventImportFetched, Stackerfile: file, Layer: name, URL: redactURL(imp)})
+		}
+		layerReport.timed(ImportPhase, importStart)
 
-		cacheEntry, ok := buildCache.Lookup(name)
+		if err := b.interrupted(name); err != nil {
+			return err
+		}
+
+		cacheEntry, cacheErr := buildCache.Get(name)
+		ok = cacheErr == nil
+		metricsCacheLookup(ok)
+		if !opts.ReadOnlyCache {
+			if err := recordCacheLookup(opts.Config, name, cacheErr); err != nil {
+				warnf(opts.Config, "couldn't record cache lookup of %s: %v\n", name, err)
+			}
+		}
+		if !ok && opts.Debug {
+			warnf(opts.Config, "not using cache: %v\n", cacheErr)
+		}
 		if ok {
+			opts.emit(Event{Type: EventCacheHit, Stackerfile: file, Layer: name, Digest: cacheEntry.Blob.Digest.String()})
+
+			// the snapshot named after the layer may be of a build
+			// of it in another cache namespace
+			if cacheEntry.Snapshot != "" && s.Exists(cacheEntry.Snapshot) {
+				if err := b.replaceSnapshot(s, cacheEntry.Snapshot, name); err != nil {
+					return err
+				}
+			}
+
 			if l.BuildOnly {
 				if cacheEntry.Name != name {
-					err = s.Snapshot(cacheEntry.Name, name)
-					if err != nil {
+					if err := b.replaceSnapshot(s, cacheEntry.Name, name); err != nil {
 						return err
 					}
 				}
@@ -343,57 +930,148 @@ func (b *Builder) Build(file string) error {
 					return err
 				}
 			}
-			fmt.Printf("found cached layer %s\n", name)
+			infof(opts.Config, "found cached layer %s\n", name)
+			layerReport.Cached = true
+			layerReport.Digest = cacheEntry.Blob.Digest.String()
+			if l.Test != nil {
+				layerReport.Tests = TestsCached
+			}
+			layerReport.Provenance = recordedProvenance(oci, name, opts.annotationKey(ProvenanceAnnotation))
+
+			// the policies may have changed since it was built
+			if !l.BuildOnly {
+				if err := checkPolicies(opts, name); err != nil {
+					return err
+				}
+			}
 
 			// Save image if requested by user
-			if len(sf.buildConfig.SaveUrl) != 0 {
+			if len(sf.buildConfig.SaveUrl) != 0 && !opts.noSave {
 				err := SaveLayer(opts, sf, name)
 				if err != nil {
 					return err
 				}
 			}
 
+			if err := exportArtifacts(opts, oci, sf, name, l); err != nil {
+				return err
+			}
+
+			if !l.BuildOnly {
+				if err := chunkBuiltLayer(opts, oci, sf, name); err != nil {
+					return err
+				}
+
+				if err := exportBundle(opts, name); err != nil {
+					return err
+				}
+			}
+
 			continue
 		}
 
+		if !opts.NoSpaceCheck {
+			needs, err := opts.estimateSpace(s, name, l)
+			if err != nil {
+				return err
+			}
+
+			if err := checkSpace(name, needs); err != nil {
+				return err
+			}
+		}
+
+		layerLog, err := openLayerLog(opts.Config, name)
+		if err != nil {
+			return err
+		}
+		openLog = layerLog
+		layerReport.Log = layerLog.path
+
 		baseOpts := BaseLayerOpts{
 			Config:    opts.Config,
 			Name:      name,
-			Target:    WorkingContainerName,
+			Target:    opts.Config.WorkingContainer(),
 			Layer:     l,
 			Cache:     buildCache,
 			OCI:       oci,
 			LayerType: opts.LayerType,
 			Debug:     opts.Debug,
+			Auth:      opts.registryAuth(),
+			Storage:   s,
+			Xattrs:    opts.Xattrs,
+			Platform:  l.platform(),
 		}
 
-		s.Delete(WorkingContainerName)
+		baseStart := opts.startPhase(file, name, BasePhase)
+		s.Delete(opts.Config.WorkingContainer())
 		if l.From.Type == BuiltType {
-			if err := s.Restore(l.From.Tag, WorkingContainerName); err != nil {
+			if err := s.Restore(l.From.Tag, opts.Config.WorkingContainer()); err != nil {
 				return err
 			}
 		} else {
-			if err := s.Create(WorkingContainerName); err != nil {
+			if err := s.Create(opts.Config.WorkingContainer()); err != nil {
 				return err
 			}
 		}
 
+		basesLock, err := lockOrWait(opts.Config, "layer-bases", "the base image import layout")
+		if err != nil {
+			return err
+		}
+
 		err = GetBaseLayer(baseOpts, b.builtStackerfiles)
+		basesLock.Unlock()
 		if err != nil {
 			return err
 		}
 
+		if err := limitWorkingContainer(opts.Config, s); err != nil {
+			return err
+		}
+		layerReport.timed(BasePhase, baseStart)
+
+		if err := b.interrupted(name); err != nil {
+			return err
+		}
+
+		provenance, err := layerProvenance(opts.Config, oci, name, l)
+		if err != nil {
+			return err
+		}
+		layerReport.Provenance = provenance
+
 		apply, err := NewApply(b.builtStackerfiles, baseOpts, s, opts.ApplyConsiderTimestamps)
 		if err != nil {
 			return err
 		}
 
+		applyStart := opts.startPhase(file, name, ApplyPhase)
 		err = apply.DoApply()
 		if err != nil {
+			return quotaError(opts.Config, s, name, err)
+		}
+
+		if err := CopyFromLayers(opts.Config, l); err != nil {
+			return quotaError(opts.Config, s, name, err)
+		}
+		layerReport.timed(ApplyPhase, applyStart)
+
+		if err := b.interrupted(name); err != nil {
 			return err
 		}
 
-		fmt.Println("running commands...")
+		he := hookEnv{
+			config:      opts.Config,
+			stackerfile: file,
+			name:        name,
+			rootfs:      path.Join(opts.Config.RootFSDir, opts.Config.WorkingContainer(), "rootfs"),
+		}
+		if err := runHooks(PreRunHook, &opts.Hooks, l, he); err != nil {
+			return err
+		}
+
+		infoln(opts.Config, "running commands...")
 
 		run, err := l.ParseRun()
 		if err != nil {
@@ -401,9 +1079,9 @@ func (b *Builder) Build(file string) error {
 		}
 
 		if len(run) != 0 {
-			_, err := os.Stat(path.Join(opts.Config.RootFSDir, WorkingContainerName, "rootfs/bin/sh"))
+			_, err := os.Stat(path.Join(opts.Config.RootFSDir, opts.Config.WorkingContainer(), "rootfs/bin/sh"))
 			if err != nil {
-				return fmt.Errorf("rootfs for %s does not have a /bin/sh", name)
+				return noShellError(name, l)
 			}
 
 			importsDir := path.Join(opts.Config.StackerDir, "imports", name)
@@ -413,10 +1091,22 @@ func (b *Builder) Build(file string) error {
 				return err
 			}
 
-			fmt.Println("running commands for", name)
-			if err := Run(opts.Config, name, "/stacker/.stacker-run.sh", l, opts.OnRunFailure, nil); err != nil {
-				return err
+			infoln(opts.Config, "running commands for", name)
+			runStart := opts.startPhase(file, name, RunPhase)
+			output := opts.eventOutput(Event{Type: EventRunOutput, Stackerfile: file, Layer: name}, layerLog.output())
+			if err := runWithOutput(opts.Config, name, "/stacker/.stacker-run.sh", l, opts.OnRunFailure, nil, output); err != nil {
+				// the commands were killed because we were
+				if ierr := b.interrupted(name); ierr != nil {
+					return ierr
+				}
+				err = newError(ErrRunFailed, err, "run commands for %s failed (see %s)", name, layerLog.path)
+				return quotaError(opts.Config, s, name, err)
 			}
+			layerReport.timed(RunPhase, runStart)
+		}
+
+		if err := b.interrupted(name); err != nil {
+			return err
 		}
 
 		// This is a build only layer, meaning we don't need to include
@@ -424,42 +1114,113 @@ func (b *Builder) Build(file string) error {
 		// imported into future images. Let's just snapshot it and add
 		// a bogus entry to our cache.
 		if l.BuildOnly {
-			s.Delete(name)
-			if err := s.Snapshot(WorkingContainerName, name); err != nil {
+			if err := b.replaceSnapshot(s, opts.Config.WorkingContainer(), name); err != nil {
+				return err
+			}
+
+			if err := keepNamespacedSnapshot(opts, s, name); err != nil {
 				return err
 			}
 
-			fmt.Println("build only layer, skipping OCI diff generation")
+			infoln(opts.Config, "build only layer, skipping OCI diff generation")
+
+			he.rootfs = path.Join(opts.Config.RootFSDir, name, "rootfs")
+			if err := runHooks(PostBuildHook, &opts.Hooks, l, he); err != nil {
+				return err
+			}
+
+			if l.Test != nil {
+				testStart := opts.startPhase(file, name, TestPhase)
+				err = runLayerTests(opts, s, name, l, layerLog)
+				if err != nil {
+					layerReport.Tests = TestsFailed
+					return err
+				}
+				layerReport.Tests = TestsPassed
+				layerReport.timed(TestPhase, testStart)
+			}
 
 			// A small hack: for build only layers, we keep track
 			// of the name, so we can make sure it exists when
 			// there is a cache hit. We should probably make this
 			// into some sort of proper Either type.
-			if err := buildCache.Put(name, ispec.Descriptor{}); err != nil {
+			if err := buildCache.PutWithRecord(name, ispec.Descriptor{}, newBuildRecord(sf, provenance)); err != nil {
+				return err
+			}
+			opts.emit(Event{Type: EventLayerCommitted, Stackerfile: file, Layer: name})
+
+			if err := exportArtifacts(opts, oci, sf, name, l); err != nil {
+				return err
+			}
+
+			openLog = nil
+			if err := layerLog.Close(); err != nil {
 				return err
 			}
 			continue
 		}
 
-		fmt.Println("generating layer for", name)
+		// the base's manifest, for ${{build.base_digest}}; this has to
+		// be read before the new layer is generated, which replaces it
+		bundleMeta, err := umoci.ReadBundleMeta(path.Join(opts.Config.RootFSDir, opts.Config.WorkingContainer()))
+		if err != nil {
+			return err
+		}
+
+		// what changed, to show what made the layer too big if it is;
+		// this has to be found before the layer is generated, too
+		var changes []PathSize
+		if l.MaxSize != "" || opts.LayerSizeReport > 0 {
+			changes, err = rootfsChanges(opts.Config)
+			if err != nil {
+				warnf(opts.Config, "couldn't find what changed in %s: %v\n", name, err)
+			} else if opts.LayerSizeReport > 0 {
+				reportLayerSize(opts.Config, name, changes, opts.LayerSizeReport, layerReport)
+			}
+		}
+
+		infoln(opts.Config, "generating layer for", name)
+		generationStart := opts.startPhase(file, name, GeneratePhase)
+		createdBy, err := layerCreatedBy(name, l)
+		if err != nil {
+			return err
+		}
+
+		layerHistory := &ispec.History{
+			Author:    author,
+			Created:   &generationStart,
+			CreatedBy: createdBy,
+		}
+
 		switch opts.LayerType {
 		case "tar":
-			err = RunUmociSubcommand(opts.Config, opts.Debug, []string{
-				"--tag", name,
-				"--bundle-path", path.Join(opts.Config.RootFSDir, WorkingContainerName),
-				"repack",
-			})
+			err = repackTarLayer(oci, name, layerHistory, l.Squash, opts, layerReport)
 			if err != nil {
 				return err
 			}
 		case "squashfs":
-			err = generateSquashfsLayer(oci, name, author, opts)
+			err = generateSquashfsLayer(oci, name, layerHistory, l.Squash, opts)
 			if err != nil {
 				return err
 			}
 		default:
 			return fmt.Errorf("unknown layer type: %s", opts.LayerType)
 		}
+
+		layerReport.timed(GeneratePhase, generationStart)
+
+		if opts.VerifyLayers {
+			verifyStart := opts.startPhase(file, name, VerifyPhase)
+			if err := verifyLayer(oci, name, opts); err != nil {
+				return err
+			}
+			layerReport.timed(VerifyPhase, verifyStart)
+		}
+
+		if err := checkLayerSize(opts.Config, oci, name, l, bundleMeta.From.Descriptor(), changes); err != nil {
+			return err
+		}
+
 		descPaths, err := oci.ResolveReference(context.Background(), name)
 		if err != nil {
 			return err
@@ -531,7 +1292,21 @@ func (b *Builder) Build(file string) error {
 			imageConfig.Labels = map[string]string{}
 		}
 
-		for k, v := range l.Labels {
+		metadata := buildMetadata{
+			"name":            name,
+			"git_commit":      gitCommit,
+			"git_version":     gitVersion,
+			"time":            generationStart.UTC().Format(time.RFC3339),
+			"stacker_version": Version,
+			"base_digest":     bundleMeta.From.Root().Digest.String(),
+		}
+
+		labels, err := metadata.expandMap(l.Labels)
+		if err != nil {
+			return errors.Wrapf(err, "bad label for %s", name)
+		}
+
+		for k, v := range labels {
 			imageConfig.Labels[k] = v
 		}
 
@@ -539,14 +1314,36 @@ func (b *Builder) Build(file string) error {
 			imageConfig.WorkingDir = l.WorkingDir
 		}
 
+		if err := applyRuntimeConfig(&imageConfig, l); err != nil {
+			return err
+		}
+
 		meta, err := mutator.Meta(context.Background())
 		if err != nil {
 			return err
 		}
 
 		meta.Created = time.Now()
-		meta.Architecture = runtime.GOARCH
+
+		// images built on foreign architectures' bases are for
+		// those architectures, not the host's, unless the layer
+		// says what it's for
+		arch, err := rootfsArch(path.Join(opts.Config.RootFSDir, opts.Config.WorkingContainer(), "rootfs"))
+		if err != nil {
+			return err
+		}
+		if l.Arch != "" {
+			meta.Architecture = l.Arch
+		} else if arch != "" {
+			meta.Architecture = arch
+		} else if meta.Architecture == "" {
+			meta.Architecture = runtime.GOARCH
+		}
+
 		meta.OS = runtime.GOOS
+		if l.OS != "" {
+			meta.OS = l.OS
+		}
 		meta.Author = author
 
 		annotations, err := mutator.Annotations(context.Background())
@@ -554,11 +1351,22 @@ func (b *Builder) Build(file string) error {
 			return err
 		}
 
-		if gitVersion != "" {
-			fmt.Println("setting git version annotation to", gitVersion)
-			annotations[GitVersionAnnotation] = gitVersion
-		} else {
-			annotations[StackerContentsAnnotation] = sf.AfterSubstitutions
+		sAnnotations, err := stackerAnnotations(opts, sf, gitVersion, provenance)
+		if err != nil {
+			return err
+		}
+
+		for k, v := range sAnnotations {
+			annotations[k] = v
+		}
+
+		layerAnnotations, err := metadata.expandMap(l.Annotations)
+		if err != nil {
+			return errors.Wrapf(err, "bad annotation for %s", name)
+		}
+
+		for k, v := range layerAnnotations {
+			annotations[k] = v
 		}
 
 		history := ispec.History{
@@ -578,14 +1386,19 @@ func (b *Builder) Build(file string) error {
 			return err
 		}
 
-		err = oci.UpdateReference(context.Background(), name, newPath.Root())
+		// the platform is in the index too, for tools that pick
+		// images by it
+		desc := newPath.Root()
+		desc.Platform = &ispec.Platform{OS: meta.OS, Architecture: meta.Architecture, Variant: l.Variant}
+		err = oci.UpdateReference(context.Background(), name, desc)
 		if err != nil {
 			return err
 		}
+		metricsLayerBuilt(generationStart)
 
 		// Now, we need to set the umoci data on the fs to tell it that
 		// it has a layer that corresponds to this fs.
-		bundlePath := path.Join(opts.Config.RootFSDir, WorkingContainerName)
+		bundlePath := path.Join(opts.Config.RootFSDir, opts.Config.WorkingContainer())
 		err = updateBundleMtree(bundlePath, newPath.Descriptor())
 		if err != nil {
 			return err
@@ -597,35 +1410,102 @@ func (b *Builder) Build(file string) error {
 			return err
 		}
 
-		// Delete the old snapshot if it existed; we just did a new build.
-		s.Delete(name)
-		if err := s.Snapshot(WorkingContainerName, name); err != nil {
+		// Replace the old snapshot if it existed; we just did a new build.
+		if err := b.replaceSnapshot(s, opts.Config.WorkingContainer(), name); err != nil {
 			return err
 		}
 
-		fmt.Printf("filesystem %s built successfully\n", name)
+		if err := keepNamespacedSnapshot(opts, s, name); err != nil {
+			return err
+		}
+
+		infof(opts.Config, "filesystem %s built successfully\n", name)
+
+		he.rootfs = path.Join(opts.Config.RootFSDir, name, "rootfs")
+		he.digest = newPath.Root().Digest.String()
+		if err := runHooks(PostBuildHook, &opts.Hooks, l, he); err != nil {
+			return err
+		}
+
+		if l.Test != nil {
+			testStart := opts.startPhase(file, name, TestPhase)
+			err = runLayerTests(opts, s, name, l, layerLog)
+			if err != nil {
+				layerReport.Tests = TestsFailed
+				return err
+			}
+			layerReport.Tests = TestsPassed
+			layerReport.timed(TestPhase, testStart)
+		}
+
+		// scan before the layer is cached, so that a build that fails
+		// because of what it finds isn't a cache hit next time
+		if opts.Scanner != "" {
+			scanStart := opts.startPhase(file, name, ScanPhase)
+			vulns, err := scanLayer(opts, name, he.rootfs)
+			layerReport.Vulnerabilities = vulns
+			layerReport.timed(ScanPhase, scanStart)
+			if err != nil {
+				return err
+			}
+		}
 
 		descPaths, err = oci.ResolveReference(context.Background(), name)
 		if err != nil {
 			return err
 		}
 
-		if err := buildCache.Put(name, descPaths[0].Descriptor()); err != nil {
+		if err := buildCache.PutWithRecord(name, descPaths[0].Descriptor(), newBuildRecord(sf, provenance)); err != nil {
+			return err
+		}
+		layerReport.Digest = descPaths[0].Descriptor().Digest.String()
+		opts.emit(Event{Type: EventLayerCommitted, Stackerfile: file, Layer: name, Digest: layerReport.Digest})
+
+		if err := checkPolicies(opts, name); err != nil {
 			return err
 		}
 
 		// Save image if requested by user
-		if len(sf.buildConfig.SaveUrl) != 0 {
+		if len(sf.buildConfig.SaveUrl) != 0 && !opts.noSave {
+			pushStart := opts.startPhase(file, name, PushPhase)
 			err := SaveLayer(opts, sf, name)
 			if err != nil {
 				return err
 			}
+			layerReport.timed(PushPhase, pushStart)
+		}
+
+		if err := exportArtifacts(opts, oci, sf, name, l); err != nil {
+			return err
+		}
+
+		if err := chunkBuiltLayer(opts, oci, sf, name); err != nil {
+			return err
+		}
+
+		if err := exportBundle(opts, name); err != nil {
+			return err
+		}
+
+		verbosef(opts.Config, "%s took %s\n", name, layerReport.phaseSummary())
+
+		openLog = nil
+		if err := layerLog.Close(); err != nil {
+			return err
 		}
 	}
 
-	err = oci.GC(context.Background())
+	if opts.ReadOnlyCache {
+		return nil
+	}
+
+	if err := enforceRetention(opts.Config, s, buildCache); err != nil {
+		warnf(opts.Config, "couldn't apply the snapshot retention policy: %v\n", err)
+	}
+
+	err = gcAfterBuild(opts.Config, oci, buildCache)
 	if err != nil {
-		fmt.Printf("final OCI GC failed: %v\n", err)
+		warnf(opts.Config, "final OCI GC failed: %v\n", err)
 	}
 
 	return err
@@ -633,10 +1513,20 @@ func (b *Builder) Build(file string) error {
 
 // BuildMultiple builds a list of stackerfiles
 func (b *Builder) BuildMultiple(paths []string) error {
+	if b.runner != nil {
+		return b.runner.Run(b.opts, paths)
+	}
+
 	opts := b.opts
+	defer b.restoreSnapshots()
 
 	// Read all the stacker recipes
-	stackerFiles, err := NewStackerFiles(paths, opts.Substitute)
+	sfOpts, err := opts.stackerfileOpts()
+	if err != nil {
+		return err
+	}
+
+	stackerFiles, err := NewStackerFilesWithOpts(paths, sfOpts)
 	if err != nil {
 		return err
 	}
@@ -650,13 +1540,13 @@ func (b *Builder) BuildMultiple(paths []string) error {
 	sortedPaths := dag.Sort()
 
 	// Show the serial build order
-	fmt.Printf("stacker build order:\n")
+	verbosef(opts.Config, "stacker build order:\n")
 	for i, p := range sortedPaths {
 		prerequisites, err := dag.GetStackerFile(p).Prerequisites()
 		if err != nil {
 			return err
 		}
-		fmt.Printf("%d build %s: requires: %v\n", i, p, prerequisites)
+		verbosef(opts.Config, "%d build %s: requires: %v\n", i, p, prerequisites)
 	}
 
 	if opts.OrderOnly {
@@ -666,9 +1556,9 @@ func (b *Builder) BuildMultiple(paths []string) error {
 
 	// Build all Stackerfiles
 	for i, p := range sortedPaths {
-		fmt.Printf("building: %d %s\n", i, p)
+		infof(opts.Config, "building: %d %s\n", i, p)
 
-		err = b.Build(p)
+		err = b.buildFile(p)
 		if err != nil {
 			return err
 		}
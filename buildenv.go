@@ -0,0 +1,56 @@
+package stacker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// buildEnv is the layer's build_env as KEY=value pairs, in a stable order.
+func (l *Layer) buildEnv() []string {
+	env := []string{}
+	for k, v := range l.BuildEnv {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(env)
+	return env
+}
+
+// mergeEnv returns env with the variables in extra added, replacing the ones
+// with the same names.
+func mergeEnv(env []string, extra []string) []string {
+	merged := []string{}
+	for _, e := range env {
+		name := strings.SplitN(e, "=", 2)[0]
+		replaced := false
+		for _, x := range extra {
+			if strings.SplitN(x, "=", 2)[0] == name {
+				replaced = true
+				break
+			}
+		}
+
+		if !replaced {
+			merged = append(merged, e)
+		}
+	}
+
+	return append(merged, extra...)
+}
+
+// setEnv adds env to the environment commands run with; lxc sets the
+// lxc.environment entries in order, so later ones win.
+func (c *container) setEnv(env []string) error {
+	for _, e := range env {
+		if err := c.setConfig("lxc.environment", e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *ociContainer) setEnv(env []string) error {
+	c.spec.Process.Env = mergeEnv(c.spec.Process.Env, env)
+	return nil
+}
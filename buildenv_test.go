@@ -0,0 +1,21 @@
+package stacker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildEnv(t *testing.T) {
+	l := &Layer{BuildEnv: map[string]string{"MAKEFLAGS": "-j8", "GOFLAGS": "-mod=vendor"}}
+	env := l.buildEnv()
+	if !reflect.DeepEqual(env, []string{"GOFLAGS=-mod=vendor", "MAKEFLAGS=-j8"}) {
+		t.Fatalf("bad build env: %v", env)
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	env := mergeEnv([]string{"PATH=/bin", "http_proxy=http://proxy:3128"}, []string{"http_proxy=", "FOO=a=b"})
+	if !reflect.DeepEqual(env, []string{"PATH=/bin", "http_proxy=", "FOO=a=b"}) {
+		t.Fatalf("bad merged env: %v", env)
+	}
+}
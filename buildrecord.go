@@ -0,0 +1,97 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// BuildRecord is how a layer was built, which its build cache entry keeps
+// for audits: what it was built from, by which stacker, and when.
+type BuildRecord struct {
+	// Stackerfile is the path (or url) of the stackerfile the layer is
+	// in, and StackerfileDigest the digest of its content, after
+	// substitutions.
+	Stackerfile       string `json:"stackerfile"`
+	StackerfileDigest string `json:"stackerfile_digest"`
+
+	// Base and Imports are what went into the layer.
+	Base    BaseProvenance     `json:"base"`
+	Imports []ImportProvenance `json:"imports,omitempty"`
+
+	// StackerVersion is the version of stacker that built it.
+	StackerVersion string `json:"stacker_version"`
+
+	// Built is when it was built.
+	Built time.Time `json:"built"`
+}
+
+// newBuildRecord returns the record of a layer of sf that's just been built
+// with prov.
+func newBuildRecord(sf *Stackerfile, prov *Provenance) *BuildRecord {
+	source := sf.source
+	if source == "" {
+		source = sf.path
+	}
+
+	record := &BuildRecord{
+		Stackerfile:       redactURL(source),
+		StackerfileDigest: digest.FromString(sf.AfterSubstitutions).String(),
+		StackerVersion:    Version,
+		Built:             time.Now().UTC(),
+	}
+
+	if prov != nil {
+		record.Base = prov.Base
+		record.Imports = prov.Imports
+	}
+
+	return record
+}
+
+// LastBuild is how a layer was last built on this machine.
+type LastBuild struct {
+	Name string `json:"name"`
+
+	// Digest is the digest of the manifest of the image it built, or
+	// empty for build_only layers.
+	Digest string `json:"digest,omitempty"`
+
+	// Record is how it was built, or nil if it was cached by a stacker
+	// that didn't keep records.
+	Record *BuildRecord `json:"record,omitempty"`
+}
+
+// GetLastBuild returns how the layer tag was last built with config's
+// stacker dir, according to its build cache.
+func GetLastBuild(config StackerConfig, tag string) (*LastBuild, error) {
+	content, err := ioutil.ReadFile(path.Join(config.StackerDir, "build.cache"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("nothing has been built in %s", config.StackerDir)
+		}
+		return nil, err
+	}
+
+	cache := &BuildCache{}
+	if err := json.Unmarshal(content, cache); err != nil {
+		return nil, err
+	}
+
+	ent, ok := cache.Cache[tag]
+	if !ok || cache.Version != currentCacheVersion {
+		return nil, fmt.Errorf("%s isn't in the build cache", tag)
+	}
+
+	last := &LastBuild{Name: ent.Name, Record: ent.Record}
+	if ent.Blob.Digest != "" {
+		last.Digest = ent.Blob.Digest.String()
+	}
+
+	return last, nil
+}
@@ -0,0 +1,92 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mitchellh/hashstructure"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestLastBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_build_record_test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := StackerConfig{
+		StackerDir: dir,
+		RootFSDir:  dir,
+	}
+
+	sf := &Stackerfile{
+		internal: map[string]*Layer{
+			"foo": &Layer{
+				From:      &ImageSource{Type: "docker", Url: "docker://centos:latest"},
+				Run:       []string{"zomg"},
+				BuildOnly: true,
+			},
+		},
+		path:               "/src/stacker.yaml",
+		AfterSubstitutions: "foo: {}",
+	}
+
+	cache, err := OpenCache(config, casext.Engine{}, StackerFiles{"dummy": sf})
+	if err != nil {
+		t.Fatalf("couldn't open cache %v", err)
+	}
+
+	if err := os.MkdirAll(path.Join(dir, "foo"), 0755); err != nil {
+		t.Fatalf("couldn't fake successful build %v", err)
+	}
+
+	prov := &Provenance{Base: BaseProvenance{Type: "docker", URL: "docker://centos:latest", Digest: "sha256:1234"}}
+	record := newBuildRecord(sf, prov)
+	if err := cache.PutWithRecord("foo", ispec.Descriptor{}, record); err != nil {
+		t.Fatalf("couldn't put to cache %v", err)
+	}
+
+	last, err := GetLastBuild(config, "foo")
+	if err != nil {
+		t.Fatalf("couldn't get last build: %v", err)
+	}
+
+	if last.Name != "foo" || last.Record == nil {
+		t.Fatalf("bad last build %+v", last)
+	}
+
+	if last.Record.Stackerfile != "/src/stacker.yaml" || last.Record.Base.Digest != "sha256:1234" || !last.Record.Built.Equal(record.Built) {
+		t.Errorf("bad record %+v", last.Record)
+	}
+
+	if last.Record.StackerfileDigest != "sha256:bf5abf2a9f9fcbcb7e4cd5b94a1bcb10f8bf2ae67393a7cf82d1d82a18b525a7" {
+		t.Errorf("bad stackerfile digest %s", last.Record.StackerfileDigest)
+	}
+
+	if _, err := GetLastBuild(config, "bar"); err == nil {
+		t.Errorf("got a last build of something that wasn't built")
+	}
+}
+
+func TestBuildRecordNotHashed(t *testing.T) {
+	ent := CacheEntry{Name: "foo"}
+	h1, err := hashstructure.Hash(ent, nil)
+	if err != nil {
+		t.Fatalf("couldn't hash: %v", err)
+	}
+
+	ent.Record = &BuildRecord{StackerVersion: "1.0"}
+	h2, err := hashstructure.Hash(ent, nil)
+	if err != nil {
+		t.Fatalf("couldn't hash: %v", err)
+	}
+
+	// layers built on this one would be rebuilt otherwise
+	if h1 != h2 {
+		t.Errorf("the build record changes the cache entry's hash")
+	}
+}
@@ -11,15 +11,18 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/mitchellh/hashstructure"
 	"github.com/openSUSE/umoci/oci/casext"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 	"github.com/vbatts/go-mtree"
+	"golang.org/x/sys/unix"
 )
 
-const currentCacheVersion = 4
+const currentCacheVersion = 6
 
 type ImportType int
 
@@ -52,7 +55,8 @@ type CacheEntry struct {
 	// case to make sure it still exists, and for printing error messages.
 	Name string
 
-	// The layer to cache
+	// The layer to cache, with its build_env values replaced by their
+	// salted hashes.
 	Layer *Layer
 
 	// If the layer is of type "built", this is a hash of the base layer's
@@ -60,23 +64,118 @@ type CacheEntry struct {
 	// mismatch with the current base layer's CacheEntry, the layer should
 	// be rebuilt.
 	Base string
+
+	// CopiedFrom is the same kind of hash of the CacheEntry of each layer
+	// this layer copies from.
+	CopiedFrom map[string]string
+
+	// Secrets are the salted hashes of the values of the secrets the
+	// layer used; the values themselves are never stored.
+	Secrets map[string]string
+
+	// CacheSalt is the StackerConfig's CacheSalt when the layer was
+	// cached.
+	CacheSalt string
+
+	// Record is how the layer was built, for audits; it doesn't decide
+	// whether the entry can be used, so it isn't part of the hash the
+	// layers built on this one keep of it.
+	Record *BuildRecord `json:",omitempty" hash:"ignore"`
+
+	// Snapshot is the snapshot of the layer's rootfs that goes with this
+	// entry, if it isn't the one named after the layer, which is of
+	// whichever build of it was last, in any cache namespace.
+	Snapshot string `json:",omitempty" hash:"ignore"`
+}
+
+// namespacedKey is the key of the entry of the layer name in the cache
+// namespace ns, which keeps it apart from the ones in other namespaces.
+func namespacedKey(ns string, name string) string {
+	if ns == "" {
+		return name
+	}
+	return ns + ":" + name
+}
+
+// namespacedSnapshot is the name of the snapshot the entry of the layer name
+// in the cache namespace ns keeps.
+func namespacedSnapshot(ns string, name string) string {
+	return name + "@" + strings.Replace(ns, "/", "_", -1)
+}
+
+// entrySnapshot is the snapshot of the layer's rootfs that ent goes with.
+func entrySnapshot(ent CacheEntry) string {
+	if ent.Snapshot != "" {
+		return ent.Snapshot
+	}
+	return ent.Name
+}
+
+// cacheOpts are how a build uses the build cache.
+type cacheOpts struct {
+	// readOnly doesn't write out the entries that are added.
+	readOnly bool
+
+	// namespace is the cache namespace that entries are looked up and
+	// added in, e.g. a branch's name, so that builds in other namespaces
+	// don't replace them.
+	namespace string
+
+	// readFrom are the namespaces, in order, that layers the namespace
+	// doesn't have (usable) entries for are looked up in, e.g. the main
+	// branch's for a feature branch.
+	readFrom []string
+}
+
+func (o cacheOpts) check() error {
+	for _, ns := range append([]string{o.namespace}, o.readFrom...) {
+		if strings.Contains(ns, ":") {
+			return fmt.Errorf("cache namespace %s can't have a : in it", ns)
+		}
+	}
+	return nil
 }
 
 type BuildCache struct {
 	path       string
 	importsDir string
 	sfm        StackerFiles
+	config     StackerConfig
 	Cache      map[string]CacheEntry `json:"cache"`
 	Version    int                   `json:"version"`
+
+	// changed are the entries this BuildCache has added (or removed, if
+	// they're nil), which are all that's written over the entries other
+	// stackers have persisted since it was opened.
+	changed map[string]*CacheEntry
+
+	// salt is what secrets are hashed with, read when it's first needed.
+	salt []byte
+
+	opts cacheOpts
 }
 
 func OpenCache(config StackerConfig, oci casext.Engine, sfm StackerFiles) (*BuildCache, error) {
+	return openCache(config, oci, sfm, cacheOpts{})
+}
+
+// openCache opens the build cache like OpenCache, with opts. If it's read
+// only, the layers Put in it are only in this BuildCache, for the layers
+// built on them.
+func openCache(config StackerConfig, oci casext.Engine, sfm StackerFiles, opts cacheOpts) (*BuildCache, error) {
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+
 	p := path.Join(config.StackerDir, "build.cache")
 	f, err := os.Open(p)
 	cache := &BuildCache{
 		path:       p,
 		importsDir: path.Join(config.StackerDir, "imports"),
 		sfm:        sfm,
+		config:     config,
+		changed:    map[string]*CacheEntry{},
+		opts:       opts,
 	}
 
 	if err != nil {
@@ -98,8 +197,10 @@ func OpenCache(config StackerConfig, oci casext.Engine, sfm StackerFiles) (*Buil
 	}
 
 	if cache.Version != currentCacheVersion {
-		fmt.Println("old cache version found, clearing cache and rebuilding from scratch...")
-		os.Remove(p)
+		infoln(config, "old cache version found, clearing cache and rebuilding from scratch...")
+		if !opts.readOnly {
+			os.Remove(p)
+		}
 		cache.Cache = map[string]CacheEntry{}
 		cache.Version = currentCacheVersion
 		return cache, nil
@@ -112,14 +213,15 @@ func OpenCache(config StackerConfig, oci casext.Engine, sfm StackerFiles) (*Buil
 			// fact that it's in the rootfs dir (and hope that
 			// nobody has touched it). So, let's stat its dir and
 			// keep going.
-			_, err = os.Stat(path.Join(config.RootFSDir, ent.Name))
+			_, err = os.Stat(path.Join(config.RootFSDir, entrySnapshot(ent)))
 		} else {
 			_, err = oci.FromDescriptor(context.Background(), ent.Blob)
 		}
 
 		if err != nil {
-			fmt.Printf("couldn't find %s, pruning it from the cache\n", ent.Name)
+			infof(config, "couldn't find %s, pruning it from the cache\n", ent.Name)
 			delete(cache.Cache, hash)
+			cache.changed[hash] = nil
 			pruned = true
 		}
 	}
@@ -159,98 +261,155 @@ func hashFile(path string) (string, error) {
 }
 
 func (c *BuildCache) Lookup(name string) (*CacheEntry, bool) {
+	ent, err := c.Get(name)
+	return ent, err == nil
+}
+
+// Get returns the cache entry for the layer name, from the cache namespace
+// or else the first of the ones it reads from that has a usable one, or an
+// error whose cause is ErrCacheMiss saying why the layer can't be used from
+// the cache.
+func (c *BuildCache) Get(name string) (*CacheEntry, error) {
 	l, ok := c.sfm.LookupLayerDefinition(name)
 	if !ok {
-		return nil, false
+		return nil, newError(ErrCacheMiss, nil, "%s not present in stackerfile", name)
 	}
 
-	result, ok := c.Cache[name]
-	if !ok {
-		return nil, false
+	var miss error
+	for _, ns := range append([]string{c.opts.namespace}, c.opts.readFrom...) {
+		result, ok := c.Cache[namespacedKey(ns, name)]
+		if !ok {
+			continue
+		}
+
+		ent, err := c.check(name, l, result)
+		if err == nil {
+			return ent, nil
+		}
+
+		if miss == nil {
+			miss = err
+		}
+	}
+
+	if miss == nil {
+		miss = newError(ErrCacheMiss, nil, "%s not in cache", name)
+	}
+
+	return nil, miss
+}
+
+// check returns result if it's a usable cache entry for the layer name, l,
+// or else why it isn't.
+func (c *BuildCache) check(name string, l *Layer, result CacheEntry) (*CacheEntry, error) {
+	if result.CacheSalt != c.config.CacheSalt {
+		return nil, newError(ErrCacheMiss, nil, "cache salt changed since %s was cached", name)
+	}
+
+	key, secrets, err := c.layerKey(l)
+	if err != nil {
+		return nil, newError(ErrCacheMiss, err, "couldn't hash secrets of %s", name)
 	}
 
 	h1, err := hashstructure.Hash(result.Layer, nil)
 	if err != nil {
-		return nil, false
+		return nil, newError(ErrCacheMiss, err, "couldn't hash cached definition of %s", name)
 	}
 
-	h2, err := hashstructure.Hash(l, nil)
+	h2, err := hashstructure.Hash(key, nil)
 	if err != nil {
-		return nil, false
+		return nil, newError(ErrCacheMiss, err, "couldn't hash definition of %s", name)
 	}
 
 	if h1 != h2 {
-		return nil, false
+		return nil, newError(ErrCacheMiss, nil, "definition of %s changed", name)
+	}
+
+	for secret, h := range secrets {
+		if result.Secrets[secret] != h {
+			return nil, newError(ErrCacheMiss, nil, "secret %s of %s changed", secret, name)
+		}
 	}
 
 	baseHash, err := c.getBaseHash(name)
 	if err != nil {
-		return nil, false
+		return nil, newError(ErrCacheMiss, err, "couldn't hash base of %s", name)
 	}
 
 	if baseHash != result.Base {
-		return nil, false
+		return nil, newError(ErrCacheMiss, nil, "base of %s changed", name)
+	}
+
+	copiedFrom, err := c.getCopiedFromHashes(l)
+	if err != nil {
+		return nil, newError(ErrCacheMiss, err, "couldn't hash layers %s copies from", name)
+	}
+
+	for from, h := range copiedFrom {
+		if result.CopiedFrom[from] != h {
+			return nil, newError(ErrCacheMiss, nil, "%s, which %s copies from, changed", from, name)
+		}
 	}
 
 	imports, err := l.ParseImport()
 	if err != nil {
-		return nil, false
+		return nil, newError(ErrCacheMiss, err, "couldn't parse imports of %s", name)
 	}
 
 	for _, imp := range imports {
 		fname := path.Base(imp)
 		cachedImport, ok := result.Imports[fname]
 		if !ok {
-			return nil, false
+			return nil, newError(ErrCacheMiss, nil, "import %s of %s is new", imp, name)
 		}
 
 		diskPath := path.Join(c.importsDir, name, fname)
 		st, err := os.Stat(diskPath)
 		if err != nil {
-			return nil, false
+			return nil, newError(ErrCacheMiss, err, "couldn't stat import %s of %s", imp, name)
 		}
 
 		if cachedImport.Type.IsDir() != st.IsDir() {
-			return nil, false
+			return nil, newError(ErrCacheMiss, nil, "import %s of %s changed type", imp, name)
 		}
 
 		if st.IsDir() {
 			rawCachedImport, err := base64.StdEncoding.DecodeString(cachedImport.Hash)
 			if err != nil {
-				return nil, false
+				return nil, newError(ErrCacheMiss, err, "bad cached hash for import %s of %s", imp, name)
 			}
 
 			cachedDH, err := mtree.ParseSpec(bytes.NewBuffer(rawCachedImport))
 			if err != nil {
-				return nil, false
+				return nil, newError(ErrCacheMiss, err, "bad cached hash for import %s of %s", imp, name)
 			}
 
 			dh, err := walkImport(diskPath)
 			if err != nil {
-				return nil, false
+				return nil, newError(ErrCacheMiss, err, "couldn't walk import %s of %s", imp, name)
 			}
 
 			diff, err := mtree.Compare(cachedDH, dh, mtreeKeywords)
 			if err != nil {
-				return nil, false
+				return nil, newError(ErrCacheMiss, err, "couldn't compare import %s of %s", imp, name)
 			}
 
 			if len(diff) > 0 {
-				return nil, false
+				return nil, newError(ErrCacheMiss, nil, "import %s of %s changed", imp, name)
 			}
 		} else {
 			h, err := hashFile(diskPath)
 			if err != nil {
-				return nil, false
+				return nil, newError(ErrCacheMiss, err, "couldn't hash import %s of %s", imp, name)
 			}
 
 			if h != cachedImport.Hash {
-				return nil, false
+				return nil, newError(ErrCacheMiss, nil, "import %s of %s changed", imp, name)
 			}
 		}
 	}
 
-	return &result, true
+	return &result, nil
 }
 
 func getEncodedMtree(path string) (string, error) {
@@ -291,7 +450,60 @@ func (c *BuildCache) getBaseHash(name string) (string, error) {
 	return fmt.Sprintf("%d", baseHash), nil
 }
 
+func (c *BuildCache) getCopiedFromHashes(l *Layer) (map[string]string, error) {
+	layers, err := l.copyFromLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := map[string]string{}
+	for _, from := range layers {
+		ent, ok := c.Lookup(from)
+		if !ok {
+			return nil, fmt.Errorf("couldn't find a cache of %s", from)
+		}
+
+		h, err := hashstructure.Hash(ent, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		hashes[from] = fmt.Sprintf("%d", h)
+	}
+
+	return hashes, nil
+}
+
+// layerKey returns the layer as it's cached, and the hashes of the secrets it
+// uses.
+func (c *BuildCache) layerKey(l *Layer) (*Layer, map[string]string, error) {
+	if len(l.BuildEnv) == 0 && len(l.Secrets) == 0 {
+		return l, map[string]string{}, nil
+	}
+
+	if c.salt == nil {
+		salt, err := secretSalt(c.config)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.salt = salt
+	}
+
+	secrets, err := secretHashes(c.config, c.salt, l)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return l.cacheKey(c.salt), secrets, nil
+}
+
 func (c *BuildCache) Put(name string, blob ispec.Descriptor) error {
+	return c.PutWithRecord(name, blob, nil)
+}
+
+// PutWithRecord caches the layer name as blob, like Put, along with the
+// record of how it was built.
+func (c *BuildCache) PutWithRecord(name string, blob ispec.Descriptor, record *BuildRecord) error {
 	l, ok := c.sfm.LookupLayerDefinition(name)
 	if !ok {
 		return fmt.Errorf("%s missing from stackerfile?", name)
@@ -302,12 +514,30 @@ func (c *BuildCache) Put(name string, blob ispec.Descriptor) error {
 		return err
 	}
 
+	copiedFrom, err := c.getCopiedFromHashes(l)
+	if err != nil {
+		return err
+	}
+
+	key, secrets, err := c.layerKey(l)
+	if err != nil {
+		return err
+	}
+
 	ent := CacheEntry{
-		Blob:    blob,
-		Imports: map[string]ImportHash{},
-		Name:    name,
-		Layer:   l,
-		Base:    baseHash,
+		Blob:       blob,
+		Imports:    map[string]ImportHash{},
+		Name:       name,
+		Layer:      key,
+		Base:       baseHash,
+		CopiedFrom: copiedFrom,
+		Secrets:    secrets,
+		CacheSalt:  c.config.CacheSalt,
+		Record:     record,
+	}
+
+	if c.opts.namespace != "" {
+		ent.Snapshot = namespacedSnapshot(c.opts.namespace, name)
 	}
 
 	imports, err := l.ParseImport()
@@ -341,15 +571,82 @@ func (c *BuildCache) Put(name string, blob ispec.Descriptor) error {
 		ent.Imports[fname] = ih
 	}
 
-	c.Cache[name] = ent
+	entKey := namespacedKey(c.opts.namespace, name)
+	c.Cache[entKey] = ent
+	c.changed[entKey] = &ent
 	return c.persist()
 }
 
+// readBuildCache reads the build cache in config's stacker dir as it is,
+// without checking its entries. Its Cache is empty if there isn't one yet (or
+// it's from another version of stacker).
+func readBuildCache(config StackerConfig) (*BuildCache, error) {
+	cache := &BuildCache{}
+	content, err := ioutil.ReadFile(path.Join(config.StackerDir, "build.cache"))
+	if err == nil {
+		if err := json.Unmarshal(content, cache); err != nil {
+			return nil, errors.Wrapf(err, "couldn't read build cache")
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if cache.Version != currentCacheVersion {
+		cache.Cache = map[string]CacheEntry{}
+	}
+
+	return cache, nil
+}
+
+// persist writes the cache out. Other stackers using the same StackerDir may
+// have written theirs since this one was read, so only the entries this one
+// changed are written over what's on disk.
 func (c *BuildCache) persist() error {
-	content, err := json.Marshal(c)
+	if c.opts.readOnly {
+		return nil
+	}
+
+	lock, err := lockFile(c.config, "cache", unix.LOCK_EX, true)
 	if err != nil {
+		return errors.Wrapf(err, "couldn't lock build cache")
+	}
+	defer lock.Unlock()
+
+	onDisk := &BuildCache{}
+	content, err := ioutil.ReadFile(c.path)
+	if err == nil {
+		if err := json.Unmarshal(content, onDisk); err != nil || onDisk.Version != currentCacheVersion {
+			onDisk.Cache = nil
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	merged := map[string]CacheEntry{}
+	for name, ent := range onDisk.Cache {
+		merged[name] = ent
+	}
+
+	for name, ent := range c.changed {
+		if ent == nil {
+			delete(merged, name)
+		} else {
+			merged[name] = *ent
+		}
+	}
+
+	c.Cache = merged
+	content, err = json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	// readers don't take the lock, so they must never see a partially
+	// written cache
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(c.path, content, 0600)
+	return os.Rename(tmp, c.path)
 }
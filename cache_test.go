@@ -8,6 +8,7 @@ import (
 
 	"github.com/openSUSE/umoci/oci/casext"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 )
 
 func TestLayerHashing(t *testing.T) {
@@ -67,4 +68,304 @@ func TestLayerHashing(t *testing.T) {
 	if ok {
 		t.Errorf("found cached entry when I shouldn't have?")
 	}
+
+	_, err = cache.Get("foo")
+	if errors.Cause(err) != ErrCacheMiss {
+		t.Errorf("expected a cache miss, got %v", err)
+	}
+}
+
+func TestCacheConcurrentPuts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-cache-test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := StackerConfig{
+		StackerDir: dir,
+		RootFSDir:  dir,
+	}
+
+	sf := &Stackerfile{
+		internal: map[string]*Layer{
+			"foo": &Layer{From: &ImageSource{Type: "scratch"}, BuildOnly: true},
+			"bar": &Layer{From: &ImageSource{Type: "scratch"}, BuildOnly: true},
+		},
+	}
+
+	// two stackers open the cache before either of them has built anything
+	cache1, err := OpenCache(config, casext.Engine{}, StackerFiles{"dummy": sf})
+	if err != nil {
+		t.Fatalf("couldn't open cache %v", err)
+	}
+
+	cache2, err := OpenCache(config, casext.Engine{}, StackerFiles{"dummy": sf})
+	if err != nil {
+		t.Fatalf("couldn't open cache %v", err)
+	}
+
+	for _, name := range []string{"foo", "bar"} {
+		if err := os.MkdirAll(path.Join(dir, name), 0755); err != nil {
+			t.Fatalf("couldn't fake successful build %v", err)
+		}
+	}
+
+	if err := cache1.Put("foo", ispec.Descriptor{}); err != nil {
+		t.Fatalf("couldn't put to cache %v", err)
+	}
+
+	if err := cache2.Put("bar", ispec.Descriptor{}); err != nil {
+		t.Fatalf("couldn't put to cache %v", err)
+	}
+
+	// the second put mustn't have lost the first
+	cache, err := OpenCache(config, casext.Engine{}, StackerFiles{"dummy": sf})
+	if err != nil {
+		t.Fatalf("couldn't re-load cache %v", err)
+	}
+
+	for _, name := range []string{"foo", "bar"} {
+		if _, ok := cache.Lookup(name); !ok {
+			t.Errorf("%s missing from the cache", name)
+		}
+	}
+}
+
+func TestCacheSalt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-cache-test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := StackerConfig{
+		StackerDir: dir,
+		RootFSDir:  dir,
+		CacheSalt:  "1",
+	}
+
+	sf := &Stackerfile{
+		internal: map[string]*Layer{
+			"foo": &Layer{From: &ImageSource{Type: "scratch"}, BuildOnly: true},
+		},
+	}
+
+	cache, err := OpenCache(config, casext.Engine{}, StackerFiles{"dummy": sf})
+	if err != nil {
+		t.Fatalf("couldn't open cache %v", err)
+	}
+
+	if err := os.MkdirAll(path.Join(dir, "foo"), 0755); err != nil {
+		t.Fatalf("couldn't fake successful build %v", err)
+	}
+
+	if err := cache.Put("foo", ispec.Descriptor{}); err != nil {
+		t.Fatalf("couldn't put to cache %v", err)
+	}
+
+	cache, err = OpenCache(config, casext.Engine{}, StackerFiles{"dummy": sf})
+	if err != nil {
+		t.Fatalf("couldn't re-load cache %v", err)
+	}
+
+	if _, err := cache.Get("foo"); err != nil {
+		t.Fatalf("layer should have been cached: %v", err)
+	}
+
+	config.CacheSalt = "2"
+	cache, err = OpenCache(config, casext.Engine{}, StackerFiles{"dummy": sf})
+	if err != nil {
+		t.Fatalf("couldn't re-load cache %v", err)
+	}
+
+	if _, err := cache.Get("foo"); errors.Cause(err) != ErrCacheMiss {
+		t.Errorf("expected a cache miss, got %v", err)
+	}
+}
+
+func TestReadOnlyCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_cache_test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := StackerConfig{
+		StackerDir: dir,
+		RootFSDir:  dir,
+	}
+
+	sf := &Stackerfile{
+		internal: map[string]*Layer{
+			"foo": &Layer{
+				From:      &ImageSource{Type: "docker", Url: "docker://centos:latest"},
+				Run:       []string{"zomg"},
+				BuildOnly: true,
+			},
+		},
+	}
+
+	cache, err := openCache(config, casext.Engine{}, StackerFiles{"dummy": sf}, cacheOpts{readOnly: true})
+	if err != nil {
+		t.Fatalf("couldn't open cache %v", err)
+	}
+
+	if err := os.MkdirAll(path.Join(dir, "foo"), 0755); err != nil {
+		t.Fatalf("couldn't fake successful build %v", err)
+	}
+
+	if err := cache.Put("foo", ispec.Descriptor{}); err != nil {
+		t.Fatalf("couldn't put to cache %v", err)
+	}
+
+	// the layers built on foo in the same build can use it...
+	if _, ok := cache.Lookup("foo"); !ok {
+		t.Errorf("entry put in a read only cache isn't in it")
+	}
+
+	// ...but it's never written out
+	if _, err := os.Stat(path.Join(dir, "build.cache")); !os.IsNotExist(err) {
+		t.Errorf("read only cache was written: %v", err)
+	}
+}
+
+func TestReadOnlySnapshots(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("copying keeps the files' ids, which needs root")
+	}
+
+	dir, err := ioutil.TempDir("", "stacker_cache_test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := StackerConfig{
+		StackerDir:  path.Join(dir, ".stacker"),
+		OCIDir:      path.Join(dir, "oci"),
+		RootFSDir:   path.Join(dir, "roots"),
+		StorageType: "dir",
+	}
+
+	s, err := newDirStorage(config, &Lock{})
+	if err != nil {
+		t.Fatalf("couldn't make storage %v", err)
+	}
+
+	// foo's snapshot is the one its cache entry goes with, and the working
+	// container is a read only build of it
+	for name, content := range map[string]string{"foo": "cached", "working": "built"} {
+		if err := s.Create(name); err != nil {
+			t.Fatalf("couldn't create %s %v", name, err)
+		}
+		if err := ioutil.WriteFile(path.Join(config.RootFSDir, name, "content"), []byte(content), 0644); err != nil {
+			t.Fatalf("couldn't write %s %v", name, err)
+		}
+	}
+
+	b := NewBuilder(&BuildArgs{Config: config, ReadOnlyCache: true})
+	for _, name := range []string{"foo", "bar"} {
+		if err := b.replaceSnapshot(s, "working", name); err != nil {
+			t.Fatalf("couldn't replace snapshot of %s %v", name, err)
+		}
+	}
+
+	// the build's later layers are built on its own build of foo...
+	content, err := ioutil.ReadFile(path.Join(config.RootFSDir, "foo", "content"))
+	if err != nil || string(content) != "built" {
+		t.Errorf("bad content of foo during the build %s: %v", string(content), err)
+	}
+
+	// ...and once it's done, the cache entry's snapshot is back, and the
+	// snapshot of the layer that didn't have one is gone
+	b.restoreSnapshots()
+
+	content, err = ioutil.ReadFile(path.Join(config.RootFSDir, "foo", "content"))
+	if err != nil || string(content) != "cached" {
+		t.Errorf("bad content of foo after the build %s: %v", string(content), err)
+	}
+
+	if s.Exists(readOnlyStash("foo")) || s.Exists("bar") {
+		t.Errorf("read only build's snapshots were left behind")
+	}
+}
+
+func TestCacheNamespaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_cache_test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := StackerConfig{
+		StackerDir: dir,
+		RootFSDir:  dir,
+	}
+
+	sf := &Stackerfile{
+		internal: map[string]*Layer{
+			"foo": &Layer{
+				From:      &ImageSource{Type: "docker", Url: "docker://centos:latest"},
+				Run:       []string{"zomg"},
+				BuildOnly: true,
+			},
+		},
+	}
+	sfm := StackerFiles{"dummy": sf}
+
+	for _, ns := range []string{"main", "feature"} {
+		if err := os.MkdirAll(path.Join(dir, namespacedSnapshot(ns, "foo")), 0755); err != nil {
+			t.Fatalf("couldn't fake successful build %v", err)
+		}
+	}
+
+	cache, err := openCache(config, casext.Engine{}, sfm, cacheOpts{namespace: "main"})
+	if err != nil {
+		t.Fatalf("couldn't open cache %v", err)
+	}
+
+	if err := cache.Put("foo", ispec.Descriptor{}); err != nil {
+		t.Fatalf("couldn't put to cache %v", err)
+	}
+
+	// a feature branch doesn't see main's entries, unless it reads from
+	// main
+	cache, err = openCache(config, casext.Engine{}, sfm, cacheOpts{namespace: "feature"})
+	if err != nil {
+		t.Fatalf("couldn't open cache %v", err)
+	}
+
+	if _, ok := cache.Lookup("foo"); ok {
+		t.Errorf("found another namespace's entry")
+	}
+
+	cache, err = openCache(config, casext.Engine{}, sfm, cacheOpts{namespace: "feature", readFrom: []string{"main"}})
+	if err != nil {
+		t.Fatalf("couldn't open cache %v", err)
+	}
+
+	ent, ok := cache.Lookup("foo")
+	if !ok || ent.Snapshot != namespacedSnapshot("main", "foo") {
+		t.Fatalf("didn't read main's entry: %v", ent)
+	}
+
+	// and its own builds don't replace them
+	if err := cache.Put("foo", ispec.Descriptor{}); err != nil {
+		t.Fatalf("couldn't put to cache %v", err)
+	}
+
+	cache, err = openCache(config, casext.Engine{}, sfm, cacheOpts{namespace: "main"})
+	if err != nil {
+		t.Fatalf("couldn't open cache %v", err)
+	}
+
+	ent, ok = cache.Lookup("foo")
+	if !ok || ent.Snapshot != namespacedSnapshot("main", "foo") {
+		t.Errorf("main's entry was replaced: %v", ent)
+	}
+
+	if _, err := openCache(config, casext.Engine{}, sfm, cacheOpts{namespace: "a:b"}); err == nil {
+		t.Errorf("opened a namespace with a : in it")
+	}
 }
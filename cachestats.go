@@ -0,0 +1,252 @@
+package stacker
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// maxCacheLookups is how many of the most recent cache lookups are kept for
+// CacheStats.
+const maxCacheLookups = 1000
+
+// CacheLookup is a build's lookup of a layer in the build cache.
+type CacheLookup struct {
+	Layer string    `json:"layer"`
+	Time  time.Time `json:"time"`
+	Hit   bool      `json:"hit"`
+
+	// Reason is why it missed.
+	Reason string `json:"reason,omitempty"`
+}
+
+func cacheLookupsPath(config StackerConfig) string {
+	return path.Join(config.StackerDir, "cache-lookups.json")
+}
+
+func readCacheLookups(config StackerConfig) ([]CacheLookup, error) {
+	lookups := []CacheLookup{}
+
+	content, err := ioutil.ReadFile(cacheLookupsPath(config))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return lookups, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, &lookups); err != nil {
+		return nil, err
+	}
+
+	return lookups, nil
+}
+
+// recordCacheLookup remembers that the build cache had the layer name, or
+// why it didn't (cacheErr), for CacheStats.
+func recordCacheLookup(config StackerConfig, name string, cacheErr error) error {
+	lock, err := lockFile(config, "cache-lookups", unix.LOCK_EX, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	lookups, err := readCacheLookups(config)
+	if err != nil {
+		return err
+	}
+
+	lookup := CacheLookup{Layer: name, Time: time.Now().UTC(), Hit: cacheErr == nil}
+	if cacheErr != nil {
+		lookup.Reason = cacheErr.Error()
+	}
+
+	lookups = append(lookups, lookup)
+	if len(lookups) > maxCacheLookups {
+		lookups = lookups[len(lookups)-maxCacheLookups:]
+	}
+
+	content, err := json.Marshal(lookups)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(cacheLookupsPath(config), content, 0644)
+}
+
+// CachedLayer is a layer in the build cache.
+type CachedLayer struct {
+	Name string `json:"name"`
+
+	// Namespace is the cache namespace it's in, if any.
+	Namespace string `json:"namespace,omitempty"`
+
+	// Built is when it was built, or zero if it was cached by a stacker
+	// that didn't keep build records.
+	Built time.Time `json:"built,omitempty"`
+
+	// Size is the size of its image's blobs (manifest, config and
+	// layers), or zero for build_only layers, which are only snapshots.
+	Size int64 `json:"size"`
+
+	BuildOnly bool `json:"build_only,omitempty"`
+}
+
+// LayerCacheStats are the recent cache lookups of a layer.
+type LayerCacheStats struct {
+	Hits    int           `json:"hits"`
+	Misses  int           `json:"misses"`
+	Lookups []CacheLookup `json:"lookups"`
+}
+
+// BuildCacheStats are what's in the build cache, and how well it has been
+// doing.
+type BuildCacheStats struct {
+	Entries int `json:"entries"`
+
+	// Size is the size of the blobs the entries' images use, counting
+	// the ones they share once.
+	Size int64 `json:"size"`
+
+	// Hits and Misses are of the most recent cache lookups builds made.
+	Hits   int `json:"hits"`
+	Misses int `json:"misses"`
+
+	// Oldest and Newest are the entries that were built longest ago and
+	// most recently, of the ones with build records.
+	Oldest *CachedLayer `json:"oldest,omitempty"`
+	Newest *CachedLayer `json:"newest,omitempty"`
+
+	// Layers are the entries, by name and then namespace.
+	Layers []CachedLayer `json:"layers"`
+
+	// History is the recent lookups, by layer name.
+	History map[string]*LayerCacheStats `json:"history"`
+}
+
+// CacheStats returns what's in the build cache in config's stacker dir, and
+// its hits and misses in the builds that used it recently.
+func CacheStats(config StackerConfig) (*BuildCacheStats, error) {
+	stats := &BuildCacheStats{Layers: []CachedLayer{}, History: map[string]*LayerCacheStats{}}
+
+	cache, err := readBuildCache(config)
+	if err != nil {
+		return nil, err
+	}
+
+	blobSizes := map[digest.Digest]int64{}
+	if len(cache.Cache) > 0 {
+		oci, err := umoci.OpenLayout(config.OCIDir)
+		if err != nil {
+			return nil, err
+		}
+		defer oci.Close()
+
+		for key, ent := range cache.Cache {
+			layer := CachedLayer{
+				Name:      ent.Name,
+				Namespace: strings.TrimSuffix(key, ":"+ent.Name),
+				BuildOnly: ent.Layer != nil && ent.Layer.BuildOnly,
+			}
+			if layer.Namespace == key {
+				layer.Namespace = ""
+			}
+
+			if ent.Record != nil {
+				layer.Built = ent.Record.Built
+			}
+
+			if !layer.BuildOnly {
+				layer.Size, err = imageBlobSizes(oci, ent.Blob, blobSizes)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			stats.Layers = append(stats.Layers, layer)
+		}
+	}
+
+	sort.Slice(stats.Layers, func(i, j int) bool {
+		a, b := stats.Layers[i], stats.Layers[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Namespace < b.Namespace
+	})
+	stats.Entries = len(stats.Layers)
+	for _, size := range blobSizes {
+		stats.Size += size
+	}
+
+	for i, l := range stats.Layers {
+		if l.Built.IsZero() {
+			continue
+		}
+		if stats.Oldest == nil || l.Built.Before(stats.Oldest.Built) {
+			stats.Oldest = &stats.Layers[i]
+		}
+		if stats.Newest == nil || l.Built.After(stats.Newest.Built) {
+			stats.Newest = &stats.Layers[i]
+		}
+	}
+
+	lookups, err := readCacheLookups(config)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, lookup := range lookups {
+		history, ok := stats.History[lookup.Layer]
+		if !ok {
+			history = &LayerCacheStats{}
+			stats.History[lookup.Layer] = history
+		}
+
+		history.Lookups = append(history.Lookups, lookup)
+		if lookup.Hit {
+			history.Hits++
+			stats.Hits++
+		} else {
+			history.Misses++
+			stats.Misses++
+		}
+	}
+
+	return stats, nil
+}
+
+// imageBlobSizes returns the size of the blobs of the image manifest desc in
+// oci, and adds them to sizes. Blobs that aren't there anymore don't count.
+func imageBlobSizes(oci casext.Engine, desc ispec.Descriptor, sizes map[digest.Digest]int64) (int64, error) {
+	blob, err := oci.FromDescriptor(context.Background(), desc)
+	if err != nil {
+		return 0, nil
+	}
+	defer blob.Close()
+
+	manifest, ok := blob.Data.(ispec.Manifest)
+	if !ok {
+		return 0, errors.Errorf("%s isn't an image manifest", desc.Digest)
+	}
+
+	size := int64(0)
+	for _, d := range append([]ispec.Descriptor{desc, manifest.Config}, manifest.Layers...) {
+		sizes[d.Digest] = d.Size
+		size += d.Size
+	}
+
+	return size, nil
+}
@@ -0,0 +1,97 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestCacheStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_cache_stats_test")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := StackerConfig{
+		StackerDir: path.Join(dir, ".stacker"),
+		OCIDir:     path.Join(dir, "oci"),
+	}
+
+	if err := os.MkdirAll(config.StackerDir, 0755); err != nil {
+		t.Fatalf("couldn't make stacker dir: %v", err)
+	}
+
+	oci, err := umoci.CreateLayout(config.OCIDir)
+	if err != nil {
+		t.Fatalf("couldn't create layout: %v", err)
+	}
+	desc := putImage(t, oci, ispec.MediaTypeImageLayer, "layer")
+	oci.Close()
+
+	built := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	cache := &BuildCache{
+		Version: currentCacheVersion,
+		Cache: map[string]CacheEntry{
+			"app": {
+				Name:   "app",
+				Blob:   desc,
+				Layer:  &Layer{},
+				Record: &BuildRecord{Built: built.Add(time.Hour)},
+			},
+			"builder": {
+				Name:   "builder",
+				Layer:  &Layer{BuildOnly: true},
+				Record: &BuildRecord{Built: built},
+			},
+		},
+	}
+
+	content, err := json.Marshal(cache)
+	if err != nil {
+		t.Fatalf("couldn't marshal cache: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(config.StackerDir, "build.cache"), content, 0644); err != nil {
+		t.Fatalf("couldn't write cache: %v", err)
+	}
+
+	for _, err := range []error{nil, fmt.Errorf("definition of app changed"), nil} {
+		if err := recordCacheLookup(config, "app", err); err != nil {
+			t.Fatalf("couldn't record lookup: %v", err)
+		}
+	}
+
+	stats, err := CacheStats(config)
+	if err != nil {
+		t.Fatalf("CacheStats failed: %v", err)
+	}
+
+	if stats.Entries != 2 {
+		t.Errorf("%d entries instead of 2", stats.Entries)
+	}
+
+	if stats.Size <= desc.Size {
+		t.Errorf("size %d doesn't count the image's config and layer", stats.Size)
+	}
+
+	if stats.Oldest == nil || stats.Oldest.Name != "builder" || stats.Newest.Name != "app" {
+		t.Errorf("bad oldest and newest entries: %v %v", stats.Oldest, stats.Newest)
+	}
+
+	if stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("%d hits and %d misses instead of 2 and 1", stats.Hits, stats.Misses)
+	}
+
+	app := stats.History["app"]
+	if app == nil || len(app.Lookups) != 3 || app.Lookups[1].Reason != "definition of app changed" {
+		t.Errorf("bad history for app: %v", app)
+	}
+}
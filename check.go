@@ -0,0 +1,381 @@
+package stacker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vbatts/go-mtree"
+)
+
+const (
+	ProblemBlob      = "blob"
+	ProblemReference = "reference"
+	ProblemCache     = "cache"
+	ProblemBundle    = "bundle"
+)
+
+// Problem is something wrong with stacker's local state that Check found.
+type Problem struct {
+	// Kind is what's broken: ProblemBlob, ProblemReference, ProblemCache
+	// or ProblemBundle.
+	Kind string `json:"kind"`
+
+	// Path is where the broken thing is, e.g. the blob's file or the
+	// layout and tag of the reference.
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+
+	// Fixed is whether it was repaired or pruned.
+	Fixed bool `json:"fixed"`
+}
+
+// CheckReport is everything Check found.
+type CheckReport struct {
+	Problems []Problem `json:"problems"`
+
+	// config is the config of the state being checked, for the output.
+	config StackerConfig
+}
+
+// Unfixed returns the problems that weren't fixed.
+func (r *CheckReport) Unfixed() []Problem {
+	unfixed := []Problem{}
+	for _, p := range r.Problems {
+		if !p.Fixed {
+			unfixed = append(unfixed, p)
+		}
+	}
+	return unfixed
+}
+
+func (r *CheckReport) add(kind string, where string, fixed bool, format string, args ...interface{}) {
+	p := Problem{Kind: kind, Path: where, Reason: fmt.Sprintf(format, args...), Fixed: fixed}
+	r.Problems = append(r.Problems, p)
+
+	if fixed {
+		infof(r.config, "%s %s: %s, fixed\n", kind, where, p.Reason)
+	} else {
+		warnf(r.config, "%s %s: %s\n", kind, where, p.Reason)
+	}
+}
+
+// checkBlobs checks that every blob in the layout has the digest it's stored
+// as, removing the ones that don't if fix is set. It returns the blobs that
+// are (still) in the layout and intact.
+func checkBlobs(oci casext.Engine, layout string, fix bool, report *CheckReport) (map[digest.Digest]bool, error) {
+	blobs, err := oci.ListBlobs(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	intact := map[digest.Digest]bool{}
+	for _, d := range blobs {
+		where := path.Join(layout, "blobs", d.Algorithm().String(), d.Hex())
+
+		err := verifyBlob(oci, d)
+		if err == nil {
+			intact[d] = true
+			continue
+		}
+
+		fixed := false
+		if fix {
+			if err := oci.DeleteBlob(context.Background(), d); err != nil {
+				return nil, err
+			}
+			fixed = true
+		}
+		report.add(ProblemBlob, where, fixed, "%v", err)
+	}
+
+	return intact, nil
+}
+
+func verifyBlob(oci casext.Engine, d digest.Digest) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+
+	r, err := oci.GetBlob(context.Background(), d)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	verifier := d.Verifier()
+	if _, err := io.Copy(verifier, r); err != nil {
+		return err
+	}
+
+	if !verifier.Verified() {
+		return fmt.Errorf("content doesn't match its digest")
+	}
+
+	return nil
+}
+
+// checkReferences checks that everything every tag in the layout refers to
+// is one of its intact blobs, deleting the tags that don't if fix is set.
+func checkReferences(oci casext.Engine, layout string, intact map[digest.Digest]bool, fix bool, report *CheckReport) error {
+	tags, err := oci.ListReferences(context.Background())
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		reason := brokenReference(oci, tag, intact)
+		if reason == "" {
+			continue
+		}
+
+		fixed := false
+		if fix {
+			if err := oci.DeleteReference(context.Background(), tag); err != nil {
+				return err
+			}
+			fixed = true
+		}
+		report.add(ProblemReference, fmt.Sprintf("%s:%s", layout, tag), fixed, "%s", reason)
+	}
+
+	return nil
+}
+
+// brokenReference returns why the tag is broken, or "" if it isn't.
+func brokenReference(oci casext.Engine, tag string, intact map[digest.Digest]bool) string {
+	descs, err := oci.ResolveReference(context.Background(), tag)
+	if err != nil {
+		return err.Error()
+	}
+
+	if len(descs) != 1 {
+		return fmt.Sprintf("resolves to %d manifests", len(descs))
+	}
+
+	return missingBlobs(oci, descs[0].Descriptor(), intact)
+}
+
+// missingBlobs returns which of the blobs the manifest desc refers to (or
+// desc itself) isn't intact, or "" if they all are.
+func missingBlobs(oci casext.Engine, desc ispec.Descriptor, intact map[digest.Digest]bool) string {
+	if !intact[desc.Digest] {
+		return fmt.Sprintf("blob %s is missing or corrupt", desc.Digest)
+	}
+
+	reachable, err := oci.Reachable(context.Background(), desc)
+	if err != nil {
+		return err.Error()
+	}
+
+	for _, r := range reachable {
+		if !intact[r] {
+			return fmt.Sprintf("blob %s is missing or corrupt", r)
+		}
+	}
+
+	return ""
+}
+
+// checkCache checks that the cache can be read and that the images its
+// entries refer to (or the rootfses, for build_only layers) are all there,
+// pruning the entries that aren't if fix is set.
+func checkCache(config StackerConfig, oci casext.Engine, intact map[digest.Digest]bool, fix bool, report *CheckReport) error {
+	p := path.Join(config.StackerDir, "build.cache")
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	cache := &BuildCache{path: p, config: config, changed: map[string]*CacheEntry{}}
+	if err := json.Unmarshal(content, cache); err != nil {
+		fixed := false
+		if fix {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+			fixed = true
+		}
+		report.add(ProblemCache, p, fixed, "couldn't read it: %v", err)
+		return nil
+	}
+
+	// an old cache is thrown away by the next build anyway
+	if cache.Version != currentCacheVersion {
+		return nil
+	}
+
+	for hash, ent := range cache.Cache {
+		reason := ""
+		if ent.Layer == nil {
+			reason = "it has no layer"
+		} else if ent.Layer.BuildOnly {
+			if _, err := os.Stat(path.Join(config.RootFSDir, ent.Name)); err != nil {
+				reason = fmt.Sprintf("its rootfs is missing: %v", err)
+			}
+		} else {
+			reason = missingBlobs(oci, ent.Blob, intact)
+		}
+
+		if reason == "" {
+			continue
+		}
+
+		if fix {
+			cache.changed[hash] = nil
+		}
+		report.add(ProblemCache, fmt.Sprintf("%s:%s", p, ent.Name), fix, "%s", reason)
+	}
+
+	if len(cache.changed) > 0 {
+		return cache.persist()
+	}
+
+	return nil
+}
+
+// checkBundles checks that the umoci metadata of every unpacked rootfs can
+// be read and has the mtree manifest of its base, which generating a layer
+// from it needs, deleting the ones that don't if fix is set. Rootfses that
+// are being built in right now are left alone.
+func checkBundles(config StackerConfig, s Storage, fix bool, report *CheckReport) error {
+	entries, err := ioutil.ReadDir(config.RootFSDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, ent := range entries {
+		if !ent.IsDir() || isLocked(config, workingLockName(ent.Name())) {
+			continue
+		}
+
+		bundlePath := path.Join(config.RootFSDir, ent.Name())
+		if _, err := os.Stat(path.Join(bundlePath, "umoci.json")); err != nil {
+			continue
+		}
+
+		reason := brokenBundle(bundlePath)
+		if reason == "" {
+			continue
+		}
+
+		fixed := false
+		if fix {
+			if err := s.Delete(ent.Name()); err != nil {
+				return err
+			}
+			fixed = true
+		}
+		report.add(ProblemBundle, bundlePath, fixed, "%s", reason)
+	}
+
+	return nil
+}
+
+// brokenBundle returns why the bundle is broken, or "" if it isn't.
+func brokenBundle(bundlePath string) string {
+	meta, err := umoci.ReadBundleMeta(bundlePath)
+	if err != nil {
+		return fmt.Sprintf("couldn't read its metadata: %v", err)
+	}
+
+	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
+	mfh, err := os.Open(path.Join(bundlePath, mtreeName+".mtree"))
+	if err != nil {
+		return fmt.Sprintf("couldn't open its mtree manifest: %v", err)
+	}
+	defer mfh.Close()
+
+	if _, err := mtree.ParseSpec(mfh); err != nil {
+		return fmt.Sprintf("couldn't parse its mtree manifest: %v", err)
+	}
+
+	return ""
+}
+
+// Check validates stacker's local state: that the blobs in the output and
+// import layouts match their digests, that their tags and the cache's
+// entries refer to blobs (or rootfses) that are there, and that the umoci
+// metadata of the unpacked rootfses is consistent. With fix, whatever is
+// broken is removed, so that the next build rebuilds it instead of failing
+// halfway through.
+func Check(config StackerConfig, fix bool) (*CheckReport, error) {
+	ociLock, err := LockOCIDir(config)
+	if err != nil {
+		return nil, err
+	}
+	defer ociLock.Unlock()
+
+	basesLock, err := lockOrWait(config, "layer-bases", "the base image import layout")
+	if err != nil {
+		return nil, err
+	}
+	defer basesLock.Unlock()
+
+	s, err := NewStorage(config)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Detach()
+
+	report := &CheckReport{Problems: []Problem{}, config: config}
+
+	var outputIntact map[digest.Digest]bool
+	var output casext.Engine
+	for _, layout := range []string{config.OCIDir, path.Join(config.StackerDir, "layer-bases", "oci")} {
+		if _, err := os.Stat(layout); err != nil {
+			continue
+		}
+
+		oci, err := umoci.OpenLayout(layout)
+		if err != nil {
+			report.add(ProblemReference, layout, false, "couldn't open layout: %v", err)
+			continue
+		}
+		defer oci.Close()
+
+		intact, err := checkBlobs(oci, layout, fix, report)
+		if err != nil {
+			return nil, err
+		}
+
+		err = checkReferences(oci, layout, intact, fix, report)
+		if err != nil {
+			return nil, err
+		}
+
+		if layout == config.OCIDir {
+			output = oci
+			outputIntact = intact
+		}
+	}
+
+	if outputIntact != nil {
+		err = checkCache(config, output, outputIntact, fix, report)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = checkBundles(config, s, fix, report)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
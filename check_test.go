@@ -0,0 +1,79 @@
+package stacker
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/openSUSE/umoci"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestCheckBlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-check-test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	layout := path.Join(dir, "oci")
+	oci, err := umoci.CreateLayout(layout)
+	if err != nil {
+		t.Fatalf("couldn't create layout %v", err)
+	}
+	defer oci.Close()
+
+	good, _, err := oci.PutBlob(context.Background(), bytes.NewReader([]byte("good")))
+	if err != nil {
+		t.Fatalf("couldn't put blob %v", err)
+	}
+
+	bad, _, err := oci.PutBlob(context.Background(), bytes.NewReader([]byte("bad")))
+	if err != nil {
+		t.Fatalf("couldn't put blob %v", err)
+	}
+
+	badPath := path.Join(layout, "blobs", "sha256", bad.Hex())
+	if err := ioutil.WriteFile(badPath, []byte("corrupted"), 0644); err != nil {
+		t.Fatalf("couldn't corrupt blob %v", err)
+	}
+
+	report := &CheckReport{}
+	intact, err := checkBlobs(oci, layout, false, report)
+	if err != nil {
+		t.Fatalf("couldn't check blobs %v", err)
+	}
+
+	if !intact[good] || intact[bad] || len(intact) != 1 {
+		t.Errorf("bad intact blobs %v", intact)
+	}
+
+	if len(report.Unfixed()) != 1 || report.Problems[0].Path != badPath {
+		t.Fatalf("bad problems %v", report.Problems)
+	}
+
+	if _, err := os.Stat(badPath); err != nil {
+		t.Errorf("corrupt blob removed without fix: %v", err)
+	}
+
+	report = &CheckReport{}
+	if _, err := checkBlobs(oci, layout, true, report); err != nil {
+		t.Fatalf("couldn't fix blobs %v", err)
+	}
+
+	if len(report.Problems) != 1 || len(report.Unfixed()) != 0 {
+		t.Errorf("bad problems %v", report.Problems)
+	}
+
+	if _, err := os.Stat(badPath); !os.IsNotExist(err) {
+		t.Errorf("corrupt blob not removed: %v", err)
+	}
+
+	if missing := missingBlobs(oci, ispec.Descriptor{Digest: bad}, map[digest.Digest]bool{good: true}); missing == "" {
+		t.Errorf("missing blob not found")
+	}
+}
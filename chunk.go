@@ -0,0 +1,378 @@
+package stacker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/dustin/go-humanize"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ChunkedConfigMediaType is the media type of the config of the
+	// chunked images ChunkImage makes, which is a ChunkedConfig.
+	ChunkedConfigMediaType = "application/vnd.stacker.chunked.config.v1+json"
+
+	// ChunkMediaType is the media type of the chunks of squashfs layers
+	// in a chunked image.
+	ChunkMediaType = "application/vnd.stacker.chunk.v1"
+)
+
+// chunkedSuffix is added to a layer's name to get the name its chunked image
+// is saved as.
+const chunkedSuffix = "-chunked"
+
+// ChunkedConfig is what a chunked image needs to make the image it was made
+// from out of its chunks.
+type ChunkedConfig struct {
+	// Image is the descriptor of the manifest of the image, and Manifest
+	// and Config are that manifest and its config.
+	Image    ispec.Descriptor `json:"image"`
+	Manifest []byte           `json:"manifest"`
+	Config   []byte           `json:"config"`
+
+	// Layers are the image's layers, each made of chunks.
+	Layers []ChunkedLayer `json:"layers"`
+}
+
+// ChunkedLayer is a layer of an image, as the chunks it's made of.
+type ChunkedLayer struct {
+	Digest digest.Digest `json:"digest"`
+
+	// Chunks are the digests of the blobs the layer is made of, in order.
+	// A layer that isn't chunked is its own one chunk.
+	Chunks []digest.Digest `json:"chunks"`
+}
+
+// The sizes of the chunks layers are split into: they're cut where the
+// content says to, which is every chunkAvgBits bits' worth of bytes on
+// average, but never shorter than chunkMin or longer than chunkMax.
+const (
+	chunkMin     = 16 << 10
+	chunkMax     = 256 << 10
+	chunkAvgBits = 16
+)
+
+// chunkGear is the table of the gear hash that finds where to cut chunks.
+// Changing it changes where every chunk is cut, so none of the chunks of
+// images chunked before would be shared with ones chunked after.
+var chunkGear = func() [256]uint64 {
+	gear := [256]uint64{}
+	for i := range gear {
+		sum := sha256.Sum256([]byte{byte(i)})
+		gear[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+	return gear
+}()
+
+// splitChunks splits what's read from r into content-defined chunks, and
+// calls chunk with each of them: unchanged runs of data in two versions of a
+// blob are mostly cut into the same chunks, even when what's before them
+// grew or shrank.
+func splitChunks(r io.Reader, chunk func([]byte) error) error {
+	in := bufio.NewReaderSize(r, chunkMax)
+	buf := make([]byte, 0, chunkMax)
+
+	// the gear hash's top bits depend on the last 64 bytes
+	const mask = uint64(1<<chunkAvgBits-1) << (64 - chunkAvgBits)
+
+	var h uint64
+	for {
+		b, err := in.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		buf = append(buf, b)
+		h = h<<1 + chunkGear[b]
+
+		if (len(buf) >= chunkMin && h&mask == 0) || len(buf) >= chunkMax {
+			if err := chunk(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+			h = 0
+		}
+	}
+
+	if len(buf) > 0 {
+		return chunk(buf)
+	}
+
+	return nil
+}
+
+// chunkLayer puts the chunks of the layer l into oci, and returns their
+// digests, and descriptors of the ones that are new to chunks.
+func chunkLayer(oci casext.Engine, layout string, l ispec.Descriptor, have map[digest.Digest]bool) ([]digest.Digest, []ispec.Descriptor, error) {
+	f, err := os.Open(blobPath(layout, l.Digest))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	digests := []digest.Digest{}
+	descs := []ispec.Descriptor{}
+	err = splitChunks(f, func(chunk []byte) error {
+		d, size, err := oci.PutBlob(context.Background(), bytes.NewReader(chunk))
+		if err != nil {
+			return err
+		}
+
+		digests = append(digests, d)
+		if !have[d] {
+			have[d] = true
+			descs = append(descs, ispec.Descriptor{MediaType: ChunkMediaType, Digest: d, Size: size})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "couldn't chunk layer %s", l.Digest)
+	}
+
+	return digests, descs, nil
+}
+
+// chunkImage makes the image tag in oci into the chunked image chunkedTag.
+func chunkImage(config StackerConfig, oci casext.Engine, layout string, tag string, chunkedTag string) error {
+	desc, err := resolveManifest(oci, tag)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return err
+	}
+
+	chunked := ChunkedConfig{Image: desc, Layers: []ChunkedLayer{}}
+	chunked.Manifest, err = readBlob(oci, desc.Digest)
+	if err != nil {
+		return err
+	}
+	chunked.Config, err = readBlob(oci, manifest.Config.Digest)
+	if err != nil {
+		return err
+	}
+
+	have := map[digest.Digest]bool{}
+	layers := []ispec.Descriptor{}
+	var chunksSize, layersSize int64
+	for _, l := range manifest.Layers {
+		layersSize += l.Size
+
+		if l.MediaType != stackeroci.MediaTypeLayerSquashfs {
+			chunked.Layers = append(chunked.Layers, ChunkedLayer{Digest: l.Digest, Chunks: []digest.Digest{l.Digest}})
+			if !have[l.Digest] {
+				have[l.Digest] = true
+				layers = append(layers, l)
+				chunksSize += l.Size
+			}
+			continue
+		}
+
+		digests, descs, err := chunkLayer(oci, layout, l, have)
+		if err != nil {
+			return err
+		}
+
+		chunked.Layers = append(chunked.Layers, ChunkedLayer{Digest: l.Digest, Chunks: digests})
+		layers = append(layers, descs...)
+		for _, d := range descs {
+			chunksSize += d.Size
+		}
+	}
+
+	configDigest, configSize, err := oci.PutBlobJSON(context.Background(), chunked)
+	if err != nil {
+		return err
+	}
+
+	chunkedManifest := ispec.Manifest{
+		Config: ispec.Descriptor{
+			MediaType: ChunkedConfigMediaType,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layers,
+	}
+	chunkedManifest.SchemaVersion = 2
+
+	manifestDigest, manifestSize, err := oci.PutBlobJSON(context.Background(), chunkedManifest)
+	if err != nil {
+		return err
+	}
+
+	err = oci.UpdateReference(context.Background(), chunkedTag, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	})
+	if err != nil {
+		return err
+	}
+
+	verbosef(config, "chunked %s into %d blobs, %s of its %s of layers\n", tag, len(layers),
+		humanize.Bytes(uint64(chunksSize)), humanize.Bytes(uint64(layersSize)))
+	return nil
+}
+
+// ChunkImage makes the image tag in the output, with squashfs layers, into
+// the image chunkedTag, whose blobs are content-defined chunks of its
+// layers, and which UnchunkImage makes into the image again. Unchanged data in
+// the layers of two versions of an image is mostly in the same chunks, so
+// a registry (or OCI layout) that has the chunked images only stores the
+// chunks the versions share once, and pushing or pulling a new version only
+// moves the chunks that changed.
+func ChunkImage(config StackerConfig, tag string, chunkedTag string) error {
+	lock, err := LockOCIDir(config)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	oci, err := umoci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	return chunkImage(config, oci, config.OCIDir, tag, chunkedTag)
+}
+
+// unchunkLayer puts the layer l, made of chunks, into oci, if it isn't
+// there already.
+func unchunkLayer(oci casext.Engine, layout string, l ChunkedLayer) error {
+	if _, err := os.Stat(blobPath(layout, l.Digest)); err == nil {
+		return nil
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		for _, c := range l.Chunks {
+			chunk, err := oci.GetBlob(context.Background(), c)
+			if err != nil {
+				writer.CloseWithError(errors.Wrapf(err, "missing chunk %s", c))
+				return
+			}
+
+			_, err = io.Copy(writer, chunk)
+			chunk.Close()
+			if err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+		writer.Close()
+	}()
+
+	d, _, err := oci.PutBlob(context.Background(), reader)
+	reader.Close()
+	if err != nil {
+		return errors.Wrapf(err, "couldn't put layer %s together", l.Digest)
+	}
+
+	if d != l.Digest {
+		return fmt.Errorf("chunks of layer %s make %s", l.Digest, d)
+	}
+
+	return nil
+}
+
+// UnchunkImage makes the image the chunked image chunkedTag in the output was
+// made from (by ChunkImage) out of its chunks again, and tags it tag.
+func UnchunkImage(config StackerConfig, chunkedTag string, tag string) error {
+	lock, err := LockOCIDir(config)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	oci, err := umoci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	manifest, err := stackeroci.LookupManifest(oci, chunkedTag)
+	if err != nil {
+		return err
+	}
+
+	if manifest.Config.MediaType != ChunkedConfigMediaType {
+		return fmt.Errorf("%s isn't chunked, its config is %s", chunkedTag, manifest.Config.MediaType)
+	}
+
+	content, err := readBlob(oci, manifest.Config.Digest)
+	if err != nil {
+		return err
+	}
+
+	chunked := ChunkedConfig{}
+	if err := json.Unmarshal(content, &chunked); err != nil {
+		return errors.Wrapf(err, "bad chunked config")
+	}
+
+	for _, l := range chunked.Layers {
+		if err := unchunkLayer(oci, config.OCIDir, l); err != nil {
+			return err
+		}
+	}
+
+	image := ispec.Manifest{}
+	if err := json.Unmarshal(chunked.Manifest, &image); err != nil {
+		return errors.Wrapf(err, "bad manifest in chunked image")
+	}
+
+	for _, blob := range []struct {
+		content []byte
+		want    digest.Digest
+	}{
+		{chunked.Config, image.Config.Digest},
+		{chunked.Manifest, chunked.Image.Digest},
+	} {
+		d, _, err := oci.PutBlob(context.Background(), bytes.NewReader(blob.content))
+		if err != nil {
+			return err
+		}
+
+		if d != blob.want {
+			return fmt.Errorf("chunked image has %s instead of %s", d, blob.want)
+		}
+	}
+
+	return oci.UpdateReference(context.Background(), tag, chunked.Image)
+}
+
+// chunkBuiltLayer makes the layer name that was just built into a chunked
+// image too if the build was asked to, and saves it to the save_urls.
+func chunkBuiltLayer(opts *BuildArgs, oci casext.Engine, sf *Stackerfile, name string) error {
+	if !opts.ChunkSquashfs || opts.LayerType != "squashfs" {
+		return nil
+	}
+
+	if err := chunkImage(opts.Config, oci, opts.Config.OCIDir, name, name+chunkedSuffix); err != nil {
+		return err
+	}
+
+	if len(sf.buildConfig.SaveUrl) == 0 || opts.noSave {
+		return nil
+	}
+
+	return SaveLayer(opts, sf, name+chunkedSuffix)
+}
@@ -0,0 +1,58 @@
+package stacker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"testing"
+)
+
+func chunks(t *testing.T, data []byte) [][]byte {
+	result := [][]byte{}
+	err := splitChunks(bytes.NewReader(data), func(chunk []byte) error {
+		result = append(result, append([]byte{}, chunk...))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("couldn't split chunks: %v", err)
+	}
+	return result
+}
+
+func TestSplitChunks(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	data := make([]byte, 4<<20)
+	r.Read(data)
+
+	split := chunks(t, data)
+	if !bytes.Equal(bytes.Join(split, nil), data) {
+		t.Fatalf("chunks don't add up to the data")
+	}
+
+	for i, c := range split {
+		if len(c) > chunkMax || (len(c) < chunkMin && i != len(split)-1) {
+			t.Errorf("chunk %d is %d bytes", i, len(c))
+		}
+	}
+
+	// inserting something at the start only changes the first chunk
+	shifted := chunks(t, append([]byte("something new"), data...))
+	have := map[[sha256.Size]byte]bool{}
+	for _, c := range split {
+		have[sha256.Sum256(c)] = true
+	}
+
+	shared := 0
+	for _, c := range shifted {
+		if have[sha256.Sum256(c)] {
+			shared++
+		}
+	}
+	if shared < len(split)-2 {
+		t.Errorf("only %d of %d chunks are shared after an insert", shared, len(split))
+	}
+
+	if len(chunks(t, []byte{})) != 0 {
+		t.Errorf("got chunks of nothing")
+	}
+}
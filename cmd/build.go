@@ -2,8 +2,13 @@ package main
 
 import (
 	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/anuvu/stacker"
+	"github.com/dustin/go-humanize"
 	"github.com/urfave/cli"
 )
 
@@ -18,17 +23,45 @@ var buildCmd = cli.Command{
 		},
 		cli.StringFlag{
 			Name:  "stacker-file, f",
-			Usage: "the input stackerfile",
+			Usage: "the input stackerfile, or - for stdin",
 			Value: "stacker.yaml",
 		},
 		cli.BoolFlag{
 			Name:  "no-cache",
 			Usage: "don't use the previous build cache",
 		},
+		cli.BoolFlag{
+			Name:  "read-only-cache",
+			Usage: "use the build cache, but don't add the layers that are built to it (or garbage collect anything)",
+		},
+		cli.StringFlag{
+			Name:  "cache-namespace",
+			Usage: "the namespace in the build cache to use and add to, e.g. the branch's name, which builds in other namespaces don't replace",
+		},
+		cli.StringSliceFlag{
+			Name:  "cache-from-namespace",
+			Usage: "a namespace in the build cache to use layers from when the cache namespace doesn't have them, e.g. main",
+		},
 		cli.StringSliceFlag{
 			Name:  "substitute",
 			Usage: "variable substitution in stackerfiles, FOO=bar format",
 		},
+		cli.StringSliceFlag{
+			Name:  "substitute-file",
+			Usage: "yaml file of substitutions (NAME: value), overridden by --substitute",
+		},
+		cli.StringFlag{
+			Name:  "substitute-env-prefix",
+			Usage: "use environment variables with this prefix as substitutions (e.g. STACKER_SUB_FOO=bar is FOO=bar)",
+		},
+		cli.BoolFlag{
+			Name:  "template",
+			Usage: "render stackerfiles as go templates (after substitutions)",
+		},
+		cli.StringSliceFlag{
+			Name:  "template-env",
+			Usage: "environment variable to make available to templates as .Env.<name>",
+		},
 		cli.StringFlag{
 			Name:  "on-run-failure",
 			Usage: "command to run inside container if run fails (useful for inspection)",
@@ -50,10 +83,192 @@ var buildCmd = cli.Command{
 			Name:  "order-only",
 			Usage: "show the build order without running the actual build",
 		},
+		cli.StringFlag{
+			Name:  "progress",
+			Usage: "how to show the build's progress: tty (a live view of each layer), plain (everything that happens), or auto (tty on a terminal)",
+			Value: "auto",
+		},
+		cli.BoolFlag{
+			Name:  "watch",
+			Usage: "rebuild whenever the stackerfile or its local imports change",
+		},
+		cli.DurationFlag{
+			Name:  "watch-interval",
+			Usage: "how often to check for changes in --watch mode",
+			Value: time.Second,
+		},
+		cli.DurationFlag{
+			Name:  "watch-debounce",
+			Usage: "how long to wait for changes to settle before rebuilding in --watch mode",
+			Value: 2 * time.Second,
+		},
+		cli.StringFlag{
+			Name:  "remote",
+			Usage: "ssh destination (e.g. me@buildbox) to run the build on, pulling the images it builds back",
+		},
+		cli.StringFlag{
+			Name:  "remote-dir",
+			Usage: "directory on the --remote host to build in (default: stacker-remote/<the current directory's name>)",
+		},
+		cli.StringFlag{
+			Name:  "remote-stacker",
+			Usage: "command that runs stacker on the --remote host, e.g. \"sudo stacker\"",
+			Value: "stacker",
+		},
+		cli.BoolFlag{
+			Name:  "remote-no-pull",
+			Usage: "leave the images built on the --remote host there instead of pulling them back",
+		},
+		cli.StringSliceFlag{
+			Name:  "farm-worker",
+			Usage: "ssh destination of a host to build on; stackerfiles are spread across them, with the --remote-* settings",
+		},
+		cli.StringFlag{
+			Name:  "kube-image",
+			Usage: "run the build as a kubernetes job, with stacker from this image",
+		},
+		cli.StringFlag{
+			Name:  "kube-context",
+			Usage: "kubectl context to run --kube-image builds in",
+		},
+		cli.StringFlag{
+			Name:  "kube-namespace",
+			Usage: "namespace to run --kube-image builds in",
+		},
+		cli.StringFlag{
+			Name:  "kube-cache-claim",
+			Usage: "persistent volume claim that --kube-image builds keep their build cache on",
+		},
+		cli.StringFlag{
+			Name:  "kube-registry-secret",
+			Usage: "kubernetes.io/dockerconfigjson secret with the registry credentials for --kube-image builds",
+		},
+		cli.StringFlag{
+			Name:  "event-stream",
+			Usage: "write the build's events to this file (e.g. /dev/stdout) as lines of json",
+		},
 		cli.StringSliceFlag{
 			Name:  "remote-save-tag",
 			Usage: "tag to be used with --remote-save",
 		},
+		cli.StringSliceFlag{
+			Name:  "webhook",
+			Usage: "url to POST a json summary of the build to when it finishes",
+		},
+		cli.StringFlag{
+			Name:  "webhook-format",
+			Usage: "the payload format for --webhook (supported values: json, slack)",
+			Value: "json",
+		},
+		cli.BoolFlag{
+			Name:  "metrics-textfile",
+			Usage: "add prometheus metrics to the totals in <stacker-dir>/metrics/stacker.prom after each stackerfile",
+		},
+		cli.StringFlag{
+			Name:  "metrics-listen",
+			Usage: "serve prometheus metrics on this address (e.g. :9090) during the build",
+		},
+		cli.StringFlag{
+			Name:  "cpu-profile",
+			Usage: "write a pprof CPU profile of stacker to this file",
+		},
+		cli.StringFlag{
+			Name:  "heap-profile",
+			Usage: "write a pprof heap profile of stacker to this file at the end of the build",
+		},
+		cli.StringSliceFlag{
+			Name:  "pre-run-hook",
+			Usage: "command to run on the host before each layer's run section",
+		},
+		cli.StringSliceFlag{
+			Name:  "post-build-hook",
+			Usage: "command to run on the host after each layer is built",
+		},
+		cli.BoolFlag{
+			Name:  "squash",
+			Usage: "squash each layer's image into a single layer, as if every layer had squash: true",
+		},
+		cli.StringFlag{
+			Name:  "max-layer-size",
+			Usage: "split tar layers bigger than this (e.g. 2GiB) into several layers",
+		},
+		cli.BoolFlag{
+			Name:  "verify-layers",
+			Usage: "unpack each generated layer and check that it matches the rootfs it was generated from",
+		},
+		cli.StringFlag{
+			Name:  "artifacts-dir",
+			Usage: "directory layers' artifacts are exported to (default: artifacts)",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "the os/arch[/variant] layers are for, unless they say otherwise (default: the host's)",
+		},
+		cli.BoolFlag{
+			Name:  "no-auto-clean",
+			Usage: "don't clean up the mounts, working containers and temp files crashed builds left behind",
+		},
+		cli.BoolFlag{
+			Name:  "wait",
+			Usage: "wait for other builds in the same OCI dir to be done instead of failing",
+		},
+		cli.BoolFlag{
+			Name:  "no-space-check",
+			Usage: "don't check that there's enough free space for each layer before building it",
+		},
+		cli.BoolFlag{
+			Name:  "chunk-squashfs",
+			Usage: "also make squashfs layers into images of content-defined chunks of them, as <layer>-chunked, which are saved to the save_url too",
+		},
+		cli.StringFlag{
+			Name:  "bundle-dir",
+			Usage: "also unpack each image that is built into an OCI runtime bundle (rootfs and config.json) in <bundle-dir>/<layer>",
+		},
+		cli.IntFlag{
+			Name:  "layer-size-report",
+			Usage: "show this many of the biggest files each layer adds or changes, and the directories they're in",
+		},
+		cli.StringFlag{
+			Name:  "scan",
+			Usage: "scan built layers for vulnerabilities with this scanner (trivy or grype)",
+		},
+		cli.StringFlag{
+			Name:  "scan-fail-on",
+			Usage: "fail the build if the scan finds vulnerabilities of this severity (low, medium, high, critical) or worse",
+		},
+		cli.StringSliceFlag{
+			Name:  "policy",
+			Usage: "rego policy file (or directory) that images are checked against before they're saved",
+		},
+		cli.StringFlag{
+			Name:  "cache-salt",
+			Usage: "value that's part of every layer's cache key; changing it rebuilds everything",
+		},
+		cli.StringSliceFlag{
+			Name:  "secret",
+			Usage: "secret for layers to use, as NAME (from the environment) or NAME=FILE",
+		},
+		cli.BoolFlag{
+			Name:  "push-artifacts",
+			Usage: "also save layers' artifacts as OCI artifacts to the save_url, as <layer>-artifacts",
+		},
+		cli.StringSliceFlag{
+			Name:  "xattrs",
+			Usage: "xattr namespace to keep in layers and unpacked base images, e.g. security, user or system.posix_acl (default: all, none for none)",
+		},
+		cli.BoolFlag{
+			Name:  "no-stacker-annotations",
+			Usage: "don't record the git version or the stackerfile in image annotations",
+		},
+		cli.BoolFlag{
+			Name:  "redact-substitutions",
+			Usage: "record the stackerfile in image annotations without substitutions applied",
+		},
+		cli.StringFlag{
+			Name:  "annotation-prefix",
+			Usage: "prefix for the keys of stacker's image annotations",
+			Value: stacker.DefaultAnnotationPrefix,
+		},
 	},
 	Before: beforeBuild,
 }
@@ -70,6 +285,12 @@ func beforeBuild(ctx *cli.Context) error {
 		}
 	}
 
+	if !ctx.IsSet("layer-type") && config.LayerType != "" {
+		if err := ctx.Set("layer-type", config.LayerType); err != nil {
+			return err
+		}
+	}
+
 	switch ctx.String("layer-type") {
 	case "tar":
 		break
@@ -80,6 +301,19 @@ func beforeBuild(ctx *cli.Context) error {
 		return fmt.Errorf("unknown layer type: %s", ctx.String("layer-type"))
 	}
 
+	switch ctx.String("progress") {
+	case "auto", "tty", "plain":
+	default:
+		return fmt.Errorf("unknown progress type: %s", ctx.String("progress"))
+	}
+
+	switch ctx.String("webhook-format") {
+	case stacker.WebhookFormatJSON, stacker.WebhookFormatSlack:
+		break
+	default:
+		return fmt.Errorf("unknown webhook format: %s", ctx.String("webhook-format"))
+	}
+
 	return nil
 }
 
@@ -88,6 +322,9 @@ func doBuild(ctx *cli.Context) error {
 		Config:                  config,
 		LeaveUnladen:            ctx.Bool("leave-unladen"),
 		NoCache:                 ctx.Bool("no-cache"),
+		ReadOnlyCache:           ctx.Bool("read-only-cache"),
+		CacheNamespace:          ctx.String("cache-namespace"),
+		CacheReadFrom:           ctx.StringSlice("cache-from-namespace"),
 		Substitute:              ctx.StringSlice("substitute"),
 		OnRunFailure:            ctx.String("on-run-failure"),
 		ApplyConsiderTimestamps: ctx.Bool("apply-consider-timestamps"),
@@ -95,8 +332,247 @@ func doBuild(ctx *cli.Context) error {
 		RemoteSaveTags:          ctx.StringSlice("remote-save-tag"),
 		OrderOnly:               ctx.Bool("order-only"),
 		Debug:                   debug,
+		Webhooks:                ctx.StringSlice("webhook"),
+		WebhookFormat:           ctx.String("webhook-format"),
+		MetricsTextfile:         ctx.Bool("metrics-textfile"),
+		SubstituteFiles:         ctx.StringSlice("substitute-file"),
+		SubstituteEnvPrefix:     ctx.String("substitute-env-prefix"),
+		Template:                ctx.Bool("template"),
+		TemplateEnv:             ctx.StringSlice("template-env"),
+		NoStackerAnnotations:    ctx.Bool("no-stacker-annotations"),
+		RedactSubstitutions:     ctx.Bool("redact-substitutions"),
+		AnnotationPrefix:        ctx.String("annotation-prefix"),
+		Squash:                  ctx.Bool("squash"),
+		Xattrs:                  ctx.StringSlice("xattrs"),
+		VerifyLayers:            ctx.Bool("verify-layers"),
+		ArtifactsDir:            ctx.String("artifacts-dir"),
+		PushArtifacts:           ctx.Bool("push-artifacts"),
+		Platform:                ctx.String("platform"),
+		Secrets:                 ctx.StringSlice("secret"),
+		CacheSalt:               ctx.String("cache-salt"),
+		Policies:                ctx.StringSlice("policy"),
+		Scanner:                 ctx.String("scan"),
+		LayerSizeReport:         ctx.Int("layer-size-report"),
+		NoAutoClean:             ctx.Bool("no-auto-clean"),
+		WaitForOCIDir:           ctx.Bool("wait"),
+		NoSpaceCheck:            ctx.Bool("no-space-check"),
+		ChunkSquashfs:           ctx.Bool("chunk-squashfs"),
+		BundleDir:               ctx.String("bundle-dir"),
+		ScanFailOn:              ctx.String("scan-fail-on"),
+		Hooks: stacker.Hooks{
+			PreRun:    ctx.StringSlice("pre-run-hook"),
+			PostBuild: ctx.StringSlice("post-build-hook"),
+		},
+	}
+
+	if size := ctx.String("max-layer-size"); size != "" {
+		maxLayerSize, err := humanize.ParseBytes(size)
+		if err != nil {
+			return fmt.Errorf("bad max layer size %s: %v", size, err)
+		}
+		args.MaxLayerSize = int64(maxLayerSize)
+	}
+
+	if addr := ctx.String("metrics-listen"); addr != "" {
+		go func() {
+			err := http.ListenAndServe(addr, stacker.MetricsHandler())
+			if err != nil {
+				fmt.Printf("metrics listener failed: %v\n", err)
+			}
+		}()
+	}
+
+	stopProfiling, err := startProfiling(ctx.String("cpu-profile"), ctx.String("heap-profile"))
+	if err != nil {
+		return err
+	}
+	defer stopProfiling()
+
+	if ctx.String("stacker-file") == "-" {
+		if ctx.Bool("watch") {
+			return fmt.Errorf("can't watch a stackerfile read from stdin")
+		}
+
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+
+		interrupt, stop := interruptible()
+		defer stop()
+
+		builder := stacker.NewBuilder(&args)
+		builder.SetContext(interrupt)
+
+		finish, err := showProgress(ctx, builder)
+		if err != nil {
+			return err
+		}
+
+		err = builder.BuildReader("-", os.Stdin, wd)
+		finish(err)
+		return err
+	}
+
+	if remote := ctx.String("remote"); remote != "" {
+		if ctx.Bool("watch") {
+			return fmt.Errorf("can't watch a remote build")
+		}
+
+		if err := checkLocalFileFlags(ctx, "remote"); err != nil {
+			return err
+		}
+
+		return stacker.RemoteBuild(&args, []string{ctx.String("stacker-file")}, stacker.RemoteBuildOpts{
+			Host:    remote,
+			Dir:     ctx.String("remote-dir"),
+			Stacker: ctx.String("remote-stacker"),
+			Args:    remoteBuildArgs(ctx),
+			NoPull:  ctx.Bool("remote-no-pull"),
+		})
+	}
+
+	if ctx.String("kube-image") != "" || len(ctx.StringSlice("farm-worker")) > 0 {
+		if ctx.Bool("watch") {
+			return fmt.Errorf("can't watch a kubernetes or farm build")
+		}
+
+		if err := checkLocalFileFlags(ctx, "kubernetes or farm"); err != nil {
+			return err
+		}
+	}
+
+	interrupt, stop := interruptible()
+	defer stop()
+
+	if ctx.Bool("watch") {
+		return stacker.Watch(interrupt, &args, []string{ctx.String("stacker-file")}, ctx.Duration("watch-interval"), ctx.Duration("watch-debounce"))
 	}
 
 	builder := stacker.NewBuilder(&args)
-	return builder.BuildMultiple([]string{ctx.String("stacker-file")})
+	builder.SetContext(interrupt)
+
+	if hosts := ctx.StringSlice("farm-worker"); len(hosts) > 0 {
+		farm := &stacker.FarmRunner{}
+		for _, host := range hosts {
+			farm.Workers = append(farm.Workers, stacker.RemoteBuildOpts{
+				Host:    host,
+				Dir:     ctx.String("remote-dir"),
+				Stacker: ctx.String("remote-stacker"),
+				Args:    remoteBuildArgs(ctx),
+				NoPull:  ctx.Bool("remote-no-pull"),
+			})
+		}
+		builder.SetRunner(farm)
+	}
+
+	if image := ctx.String("kube-image"); image != "" {
+		builder.SetRunner(&stacker.KubeRunner{
+			Image:          image,
+			Context:        ctx.String("kube-context"),
+			Namespace:      ctx.String("kube-namespace"),
+			CacheClaim:     ctx.String("kube-cache-claim"),
+			RegistrySecret: ctx.String("kube-registry-secret"),
+			Args:           remoteBuildArgs(ctx),
+		})
+	}
+
+	if stream := ctx.String("event-stream"); stream != "" {
+		f, err := os.Create(stream)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		builder.StreamEvents(f)
+	}
+
+	finish, err := showProgress(ctx, builder)
+	if err != nil {
+		return err
+	}
+
+	err = builder.BuildMultiple([]string{ctx.String("stacker-file")})
+	finish(err)
+	return err
+}
+
+// remoteBuildFlags are the build flags that are about running it elsewhere,
+// rather than for the build there.
+var remoteBuildFlags = map[string]bool{
+	"remote":               true,
+	"remote-dir":           true,
+	"remote-stacker":       true,
+	"remote-no-pull":       true,
+	"farm-worker":          true,
+	"kube-image":           true,
+	"kube-context":         true,
+	"kube-namespace":       true,
+	"kube-cache-claim":     true,
+	"kube-registry-secret": true,
+	"event-stream":         true,
+	"cpu-profile":          true,
+	"heap-profile":         true,
+	"metrics-listen":       true,
+}
+
+// localFileFlags are the build flags that name files or directories on the
+// local host: they aren't shipped to builds that run elsewhere, nor are their
+// outputs brought back, so they can't be given to them.
+var localFileFlags = []string{
+	"substitute-file",
+	"secret",
+	"policy",
+	"artifacts-dir",
+	"bundle-dir",
+}
+
+// checkLocalFileFlags fails if any of localFileFlags were given to a build
+// that runs elsewhere, which where describes.
+func checkLocalFileFlags(ctx *cli.Context, where string) error {
+	for _, name := range localFileFlags {
+		if ctx.IsSet(name) {
+			return fmt.Errorf("--%s can't be used with %s builds, since it's about files on this host", name, where)
+		}
+	}
+	return nil
+}
+
+// remoteBuildArgs returns the flags the build was given, to give them to the
+// build on the remote host.
+func remoteBuildArgs(ctx *cli.Context) []string {
+	args := []string{}
+	for _, f := range ctx.Command.Flags {
+		name := strings.TrimSpace(strings.Split(f.GetName(), ",")[0])
+		if remoteBuildFlags[name] || !ctx.IsSet(name) {
+			continue
+		}
+
+		switch f.(type) {
+		case cli.BoolFlag:
+			args = append(args, "--"+name)
+		case cli.StringSliceFlag:
+			for _, v := range ctx.StringSlice(name) {
+				args = append(args, "--"+name, v)
+			}
+		default:
+			args = append(args, "--"+name, ctx.String(name))
+		}
+	}
+	return args
+}
+
+// showProgress shows the build's progress as --progress says to, returning
+// the function to call with the error the build returned once it's done.
+func showProgress(ctx *cli.Context, builder *stacker.Builder) (func(error), error) {
+	progress := ctx.String("progress")
+	if progress == "plain" {
+		return func(error) {}, nil
+	}
+
+	// a shell for a failed layer needs the terminal to itself
+	if progress == "auto" && (!stacker.TTYProgressAvailable() || ctx.String("on-run-failure") != "") {
+		return func(error) {}, nil
+	}
+
+	return builder.ShowTTYProgress(os.Stdout)
 }
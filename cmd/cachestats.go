@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/anuvu/stacker"
+	"github.com/dustin/go-humanize"
+	"github.com/urfave/cli"
+)
+
+var cacheStatsCmd = cli.Command{
+	Name:   "cache-stats",
+	Usage:  "shows what's in the build cache, and its recent hits and misses",
+	Action: doCacheStats,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "render the statistics (including each layer's recent lookups) as json",
+		},
+	},
+}
+
+func doCacheStats(ctx *cli.Context) error {
+	stats, err := stacker.CacheStats(config)
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("json") {
+		pretty, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(pretty))
+		return nil
+	}
+
+	fmt.Printf("%d entries, %s\n", stats.Entries, humanize.Bytes(uint64(stats.Size)))
+	if stats.Oldest != nil {
+		fmt.Printf("oldest: %s (built %s)\n", stats.Oldest.Name, humanize.Time(stats.Oldest.Built))
+		fmt.Printf("newest: %s (built %s)\n", stats.Newest.Name, humanize.Time(stats.Newest.Built))
+	}
+	fmt.Printf("recent lookups: %d hits, %d misses\n", stats.Hits, stats.Misses)
+
+	names := []string{}
+	for name := range stats.History {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		h := stats.History[name]
+		fmt.Printf("\t%s: %d hits, %d misses\n", name, h.Hits, h.Misses)
+	}
+
+	return nil
+}
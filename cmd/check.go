@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/anuvu/stacker"
+	"github.com/urfave/cli"
+)
+
+var checkCmd = cli.Command{
+	Name:   "check",
+	Usage:  "validate the OCI layouts, build cache and unpacked rootfses in the stacker dirs",
+	Action: doCheck,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "fix",
+			Usage: "remove whatever is broken, so that it is rebuilt",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "render the problems found as json",
+		},
+	},
+}
+
+func doCheck(ctx *cli.Context) error {
+	report, err := stacker.Check(config, ctx.Bool("fix"))
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("json") {
+		pretty, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(pretty))
+	}
+
+	if unfixed := report.Unfixed(); len(unfixed) > 0 {
+		return fmt.Errorf("found %d problems, run with --fix to remove what's broken", len(unfixed))
+	}
+
+	return nil
+}
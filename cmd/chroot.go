@@ -34,13 +34,19 @@ you must specify a tag.`,
 }
 
 func doChroot(ctx *cli.Context) error {
+	wcLock, err := stacker.LockWorkingContainer(config)
+	if err != nil {
+		return err
+	}
+	defer wcLock.Unlock()
+
 	s, err := stacker.NewStorage(config)
 	if err != nil {
 		return err
 	}
 	defer s.Detach()
 
-	tag := stacker.WorkingContainerName
+	tag := config.WorkingContainer()
 
 	if len(ctx.Args()) > 0 {
 		tag = ctx.Args()[0]
@@ -56,7 +62,7 @@ func doChroot(ctx *cli.Context) error {
 	// the filesystem that just broke. So, let's try to support this. Since
 	// we can't figure out easily which filesystem _working came from, we
 	// fake an empty layer.
-	if tag == stacker.WorkingContainerName {
+	if tag == config.WorkingContainer() {
 		return stacker.Run(config, tag, cmd, &stacker.Layer{}, "", os.Stdin)
 	}
 
@@ -72,12 +78,12 @@ func doChroot(ctx *cli.Context) error {
 		return fmt.Errorf("no layer %s in stackerfile", tag)
 	}
 
-	defer s.Delete(stacker.WorkingContainerName)
-	err = s.Restore(tag, stacker.WorkingContainerName)
+	defer s.Delete(config.WorkingContainer())
+	err = s.Restore(tag, config.WorkingContainer())
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("WARNING: this chroot is temporary, any changes will be destroyed when it exits.")
+	stacker.Warnf(config, "WARNING: this chroot is temporary, any changes will be destroyed when it exits.\n")
 	return stacker.Run(config, tag, cmd, layer, "", os.Stdin)
 }
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anuvu/stacker"
+	"github.com/urfave/cli"
+)
+
+var chunkCmd = cli.Command{
+	Name:      "chunk",
+	Usage:     "make an image with squashfs layers into one of content-defined chunks of them",
+	ArgsUsage: "<tag> <chunked tag>",
+	Action:    doChunk,
+}
+
+var unchunkCmd = cli.Command{
+	Name:      "unchunk",
+	Usage:     "make a chunked image into the image it was made from",
+	ArgsUsage: "<chunked tag> <tag>",
+	Action:    doUnchunk,
+}
+
+func doChunk(ctx *cli.Context) error {
+	if ctx.NArg() != 2 {
+		return fmt.Errorf("expected the tag of the image and the tag of the chunked image")
+	}
+
+	return stacker.ChunkImage(config, ctx.Args().Get(0), ctx.Args().Get(1))
+}
+
+func doUnchunk(ctx *cli.Context) error {
+	if ctx.NArg() != 2 {
+		return fmt.Errorf("expected the tag of the chunked image and the tag of the image")
+	}
+
+	return stacker.UnchunkImage(config, ctx.Args().Get(0), ctx.Args().Get(1))
+}
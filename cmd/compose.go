@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/anuvu/stacker"
+	"github.com/urfave/cli"
+)
+
+var composeCmd = cli.Command{
+	Name:   "compose",
+	Usage:  "builds a set of layers and runs them together, e.g. for integration tests",
+	Action: doCompose,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "compose-file, f",
+			Usage: "the compose file",
+			Value: "stacker-compose.yaml",
+		},
+		cli.StringSliceFlag{
+			Name:  "substitute",
+			Usage: "variable substitution in stackerfiles, FOO=bar format",
+		},
+		cli.StringSliceFlag{
+			Name:  "substitute-file",
+			Usage: "yaml file of substitutions (NAME: value), overridden by --substitute",
+		},
+		cli.StringFlag{
+			Name:  "layer-type",
+			Usage: "set the output layer type (supported values: tar, squashfs)",
+			Value: "tar",
+		},
+		cli.StringSliceFlag{
+			Name:  "secret",
+			Usage: "secret for layers to use, as NAME (from the environment) or NAME=FILE",
+		},
+		cli.BoolFlag{
+			Name:  "no-cache",
+			Usage: "don't use the previous build cache",
+		},
+	},
+}
+
+func doCompose(ctx *cli.Context) error {
+	if !ctx.IsSet("layer-type") && config.LayerType != "" {
+		if err := ctx.Set("layer-type", config.LayerType); err != nil {
+			return err
+		}
+	}
+
+	args := stacker.BuildArgs{
+		Config:          config,
+		NoCache:         ctx.Bool("no-cache"),
+		Substitute:      ctx.StringSlice("substitute"),
+		SubstituteFiles: ctx.StringSlice("substitute-file"),
+		LayerType:       ctx.String("layer-type"),
+		Secrets:         ctx.StringSlice("secret"),
+		Debug:           debug,
+	}
+
+	interrupt, stop := interruptible()
+	defer stop()
+
+	return stacker.Compose(interrupt, &args, ctx.String("compose-file"))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anuvu/stacker"
+	"github.com/urfave/cli"
+)
+
+var deltaCmd = cli.Command{
+	Name:  "delta",
+	Usage: "make and apply binary deltas between versions of an image",
+	Subcommands: []cli.Command{
+		cli.Command{
+			Name:      "make",
+			Usage:     "make an OCI artifact with what's needed to make one image out of another",
+			ArgsUsage: "<from> <to> <delta tag>",
+			Action:    doDeltaMake,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "push",
+					Usage: "where to push the delta to, e.g. docker://registry.example.com/image:delta",
+				},
+			},
+		},
+		cli.Command{
+			Name:      "apply",
+			Usage:     "make the image a delta is to out of the one it's from",
+			ArgsUsage: "<delta tag> <tag>",
+			Action:    doDeltaApply,
+		},
+	},
+}
+
+func doDeltaMake(ctx *cli.Context) error {
+	if ctx.NArg() != 3 {
+		return fmt.Errorf("expected the tags to make a delta from and to, and the tag of the delta")
+	}
+
+	deltaTag := ctx.Args().Get(2)
+	err := stacker.MakeDelta(config, ctx.Args().Get(0), ctx.Args().Get(1), deltaTag)
+	if err != nil {
+		return err
+	}
+
+	if ctx.String("push") == "" {
+		return nil
+	}
+
+	return stacker.PushDelta(config, deltaTag, ctx.String("push"))
+}
+
+func doDeltaApply(ctx *cli.Context) error {
+	if ctx.NArg() != 2 {
+		return fmt.Errorf("expected the tag of the delta and the tag to give the image it makes")
+	}
+
+	return stacker.ApplyDelta(config, ctx.Args().Get(0), ctx.Args().Get(1))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/anuvu/stacker"
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var diffCmd = cli.Command{
+	Name:   "diff",
+	Usage:  "show the filesystem and config differences between two built tags",
+	Action: doDiff,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "render the diff as json",
+		},
+	},
+	ArgsUsage: `<tag1> <tag2>
+
+<tag1> and <tag2> are tags that were built (or unladen) on this machine.`,
+}
+
+func doDiff(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return errors.Errorf("wrong number of args for diff")
+	}
+
+	s, err := stacker.NewStorage(config)
+	if err != nil {
+		return err
+	}
+	defer s.Detach()
+
+	diff, err := stacker.Diff(config, ctx.Args()[0], ctx.Args()[1])
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("json") {
+		pretty, err := json.MarshalIndent(diff, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(pretty))
+		return nil
+	}
+
+	fmt.Printf("%s -> %s\n", diff.From, diff.To)
+	for _, f := range diff.Files {
+		switch f.Type {
+		case stacker.FileAdded:
+			fmt.Printf("\t+ %s (%s)\n", f.Path, humanize.Bytes(uint64(f.NewSize)))
+		case stacker.FileRemoved:
+			fmt.Printf("\t- %s (%s)\n", f.Path, humanize.Bytes(uint64(f.OldSize)))
+		case stacker.FileModified:
+			fmt.Printf("\tM %s (%s -> %s)\n", f.Path, humanize.Bytes(uint64(f.OldSize)), humanize.Bytes(uint64(f.NewSize)))
+		}
+	}
+
+	renderConfigDiff("Env", diff.Env)
+	renderConfigDiff("Labels", diff.Labels)
+	return nil
+}
+
+func renderConfigDiff(name string, cd stacker.ConfigDiff) {
+	if cd.Empty() {
+		return
+	}
+
+	fmt.Printf("%s:\n", name)
+	for k, v := range cd.Added {
+		fmt.Printf("\t+ %s=%s\n", k, v)
+	}
+	for k, v := range cd.Removed {
+		fmt.Printf("\t- %s=%s\n", k, v)
+	}
+	for k, v := range cd.Modified {
+		fmt.Printf("\tM %s: %s\n", k, v)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+
+	"github.com/anuvu/stacker"
+	"github.com/urfave/cli"
+)
+
+var dockerfileCmd = cli.Command{
+	Name:   "dockerfile",
+	Usage:  "converts a stackerfile into a Dockerfile that docker buildx can build",
+	Action: doDockerfile,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "stacker-file, f",
+			Usage: "the input stackerfile",
+			Value: "stacker.yaml",
+		},
+		cli.StringSliceFlag{
+			Name:  "substitute",
+			Usage: "variable substitution in stackerfiles, FOO=bar format",
+		},
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "file to write the Dockerfile to (default: stdout)",
+		},
+	},
+}
+
+func doDockerfile(ctx *cli.Context) error {
+	sf, err := stacker.NewStackerfile(ctx.String("stacker-file"), ctx.StringSlice("substitute"))
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if o := ctx.String("output"); o != "" {
+		out, err = os.Create(o)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	return stacker.WriteDockerfile(sf, out)
+}
@@ -10,32 +10,46 @@ import (
 
 var grabCmd = cli.Command{
 	Name:   "grab",
-	Usage:  "grabs a file from the layer's filesystem",
+	Usage:  "grabs files from the layers' filesystems",
 	Action: doGrab,
-	ArgsUsage: `<tag>:<path>
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "dest, d",
+			Usage: "the directory to put the files in",
+			Value: ".",
+		},
+	},
+	ArgsUsage: `<tag>:<path> [<tag>:<path>...]
 
-<tag> is the tag in a built stacker image to extract the file from.
+<tag> is the tag of a built (or pulled) image to extract the file from.
 
 <path> is the path to extract (relative to /) in the image's rootfs.`,
 }
 
 func doGrab(ctx *cli.Context) error {
-	s, err := stacker.NewStorage(config)
-	if err != nil {
-		return err
+	if len(ctx.Args()) == 0 {
+		return errors.Errorf("please specify what to grab")
 	}
-	defer s.Detach()
 
-	parts := strings.SplitN(ctx.Args().First(), ":", 2)
-	if len(parts) < 2 {
-		return errors.Errorf("invalid grab argument: %s", ctx.Args().First())
+	tags := []string{}
+	paths := map[string][]string{}
+	for _, arg := range ctx.Args() {
+		parts := strings.SplitN(arg, ":", 2)
+		if len(parts) < 2 {
+			return errors.Errorf("invalid grab argument: %s", arg)
+		}
+
+		if _, ok := paths[parts[0]]; !ok {
+			tags = append(tags, parts[0])
+		}
+		paths[parts[0]] = append(paths[parts[0]], parts[1])
 	}
 
-	err = s.Restore(parts[0], stacker.WorkingContainerName)
-	if err != nil {
-		return err
+	for _, tag := range tags {
+		if err := stacker.GrabFiles(config, tag, paths[tag], ctx.String("dest")); err != nil {
+			return err
+		}
 	}
-	defer s.Delete(stacker.WorkingContainerName)
 
-	return stacker.Grab(config, parts[0], parts[1])
+	return nil
 }
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 
+	"github.com/anuvu/stacker"
 	stackeroci "github.com/anuvu/stacker/oci"
 	"github.com/dustin/go-humanize"
 	"github.com/openSUSE/umoci"
@@ -17,7 +18,16 @@ var inspectCmd = cli.Command{
 	Name:   "inspect",
 	Usage:  "print the json representation of an OCI image",
 	Action: doInspect,
-	Flags:  []cli.Flag{},
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "render the inspection (including history and stackerfile) as json",
+		},
+		cli.BoolFlag{
+			Name:  "last-build",
+			Usage: "print how the tag was last built on this machine (its stackerfile, base, imports, stacker version and when) as json",
+		},
+	},
 	ArgsUsage: `[tag]
 
 <tag> is the tag in the stackerfile to inspect. If none is supplied, inspect
@@ -25,15 +35,33 @@ prints the information on all tags.`,
 }
 
 func doInspect(ctx *cli.Context) error {
+	arg := ctx.Args().Get(0)
+	if ctx.Bool("last-build") {
+		if arg == "" {
+			return fmt.Errorf("--last-build needs a tag")
+		}
+		return renderLastBuild(arg)
+	}
+
+	if ctx.Bool("json") && arg != "" {
+		return renderJSON(arg)
+	}
+
 	oci, err := umoci.OpenLayout(config.OCIDir)
 	if err != nil {
 		return err
 	}
 	defer oci.Close()
 
-	arg := ctx.Args().Get(0)
+	render := func(name string) error {
+		return renderManifest(oci, name)
+	}
+	if ctx.Bool("json") {
+		render = renderJSON
+	}
+
 	if arg != "" {
-		return renderManifest(oci, arg)
+		return render(arg)
 	}
 
 	tags, err := oci.ListReferences(context.Background())
@@ -42,7 +70,7 @@ func doInspect(ctx *cli.Context) error {
 	}
 
 	for _, t := range tags {
-		err = renderManifest(oci, t)
+		err = render(t)
 		if err != nil {
 			return err
 		}
@@ -51,6 +79,34 @@ func doInspect(ctx *cli.Context) error {
 	return nil
 }
 
+func renderLastBuild(name string) error {
+	last, err := stacker.GetLastBuild(config, name)
+	if err != nil {
+		return err
+	}
+
+	pretty, err := json.MarshalIndent(last, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(pretty))
+	return nil
+}
+
+func renderJSON(name string) error {
+	result, err := stacker.Inspect(config, name)
+	if err != nil {
+		return err
+	}
+
+	pretty, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(pretty))
+	return nil
+}
+
 func renderManifest(oci casext.Engine, name string) error {
 	man, err := stackeroci.LookupManifest(oci, name)
 	if err != nil {
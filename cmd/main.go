@@ -2,16 +2,12 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
-	"os/user"
-	"path"
 	"path/filepath"
 
 	"github.com/anuvu/stacker"
 	"github.com/apex/log"
 	"github.com/urfave/cli"
-	"gopkg.in/yaml.v2"
 )
 
 var (
@@ -21,21 +17,11 @@ var (
 )
 
 func main() {
-	user, err := user.Current()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "couldn't get current user: %s", err)
-		os.Exit(1)
-	}
-
-	configDir := os.Getenv("XDG_CONFIG_HOME")
-	if configDir == "" {
-		configDir = path.Join(user.HomeDir, ".config")
-	}
-
 	app := cli.NewApp()
 	app.Name = "stacker"
 	app.Usage = "stacker builds OCI images"
 	app.Version = version
+	stacker.Version = version
 	app.Commands = []cli.Command{
 		buildCmd,
 		chrootCmd,
@@ -46,56 +32,120 @@ func main() {
 		umociCmd,
 		unprivSetupCmd,
 		gcCmd,
+		diffCmd,
+		runCmd,
+		shellCmd,
+		serveCmd,
+		verifyCmd,
+		checkCmd,
+		snapshotCmd,
+		mountCmd,
+		umountCmd,
+		deltaCmd,
+		chunkCmd,
+		unchunkCmd,
+		dockerfileCmd,
+		composeCmd,
+		retagCmd,
+		promoteCmd,
+		cacheStatsCmd,
 	}
 
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:  "stacker-dir",
-			Usage: "set the directory for stacker's cache",
-			Value: ".stacker",
+			Usage: "set the directory for stacker's cache (default: .stacker, or $XDG_CACHE_HOME/stacker when unprivileged)",
 		},
 		cli.StringFlag{
 			Name:  "oci-dir",
-			Usage: "set the directory for OCI output",
-			Value: "oci",
+			Usage: "set the directory for OCI output (default: oci, or $XDG_DATA_HOME/stacker/oci when unprivileged)",
 		},
 		cli.StringFlag{
 			Name:  "roots-dir",
-			Usage: "set the directory for the rootfs output",
-			Value: "roots",
+			Usage: "set the directory for the rootfs output (default: roots, or $XDG_DATA_HOME/stacker/roots when unprivileged)",
+		},
+		cli.StringFlag{
+			Name:  "scratch-dir",
+			Usage: "set the directory for large temporary files, e.g. squashfs images being generated (default: the OCI output directory)",
+		},
+		cli.StringFlag{
+			Name:  "working-container",
+			Usage: "set the name of the container layers are built in",
+			Value: stacker.WorkingContainerName,
 		},
 		cli.BoolFlag{
 			Name:  "debug",
 			Usage: "enable stacker debug mode",
 		},
+		cli.BoolFlag{
+			Name:  "quiet, q",
+			Usage: "only print warnings and errors (layers' output still goes to their logs)",
+		},
+		cli.BoolFlag{
+			Name:  "verbose",
+			Usage: "print the details of what stacker is doing",
+		},
+		cli.BoolFlag{
+			Name:  "no-color",
+			Usage: "disable colored and animated output (the default when stdout isn't a terminal)",
+		},
 		cli.StringFlag{
 			Name:  "config",
-			Usage: "stacker config file with defaults",
-			Value: path.Join(configDir, "conf.yaml"),
+			Usage: "stacker config file with defaults (default: /etc/stacker/config.yaml and ~/.config/stacker/config.yaml)",
 		},
 	}
 
 	app.Before = func(ctx *cli.Context) error {
 		var err error
 
-		content, err := ioutil.ReadFile(ctx.String("config"))
-		if err == nil {
-			err = yaml.Unmarshal(content, &config)
+		paths := []string{ctx.String("config")}
+		if !ctx.IsSet("config") {
+			paths, err = stacker.DefaultConfigPaths()
 			if err != nil {
 				return err
 			}
 		}
 
-		if config.StackerDir == "" || ctx.IsSet("stacker-dir") {
+		config, err = stacker.ReadConfig(paths)
+		if err != nil {
+			return err
+		}
+
+		defaults, err := stacker.DefaultDirs()
+		if err != nil {
+			return err
+		}
+
+		if ctx.IsSet("stacker-dir") {
 			config.StackerDir = ctx.String("stacker-dir")
+		} else if config.StackerDir == "" {
+			config.StackerDir = defaults.StackerDir
 		}
-		if config.OCIDir == "" || ctx.IsSet("oci-dir") {
+		if ctx.IsSet("oci-dir") {
 			config.OCIDir = ctx.String("oci-dir")
+		} else if config.OCIDir == "" {
+			config.OCIDir = defaults.OCIDir
 		}
-		if config.RootFSDir == "" || ctx.IsSet("roots-dir") {
+		if ctx.IsSet("roots-dir") {
 			config.RootFSDir = ctx.String("roots-dir")
+		} else if config.RootFSDir == "" {
+			config.RootFSDir = defaults.RootFSDir
+		}
+
+		if ctx.IsSet("scratch-dir") {
+			config.ScratchDir = ctx.String("scratch-dir")
 		}
 
+		// the shell doesn't expand ~ in --foo=~/bar
+		for _, p := range []*string{&config.StackerDir, &config.OCIDir, &config.RootFSDir, &config.ScratchDir} {
+			*p, err = stacker.ExpandHome(*p)
+			if err != nil {
+				return err
+			}
+		}
+
+		config.WorkingContainerName = ctx.String("working-container")
+
 		config.StackerDir, err = filepath.Abs(config.StackerDir)
 		if err != nil {
 			return err
@@ -110,6 +160,46 @@ func main() {
 			return err
 		}
 
+		if config.SharedBlobDir != "" {
+			config.SharedBlobDir, err = filepath.Abs(config.SharedBlobDir)
+			if err != nil {
+				return err
+			}
+		}
+
+		if config.BaseImageCacheDir != "" {
+			config.BaseImageCacheDir, err = filepath.Abs(config.BaseImageCacheDir)
+			if err != nil {
+				return err
+			}
+		}
+
+		if config.ScratchDir != "" {
+			config.ScratchDir, err = filepath.Abs(config.ScratchDir)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := stacker.SetupIdmap(config); err != nil {
+			return err
+		}
+
+		if ctx.Bool("quiet") && ctx.Bool("verbose") {
+			return fmt.Errorf("--quiet and --verbose can't be used together")
+		}
+
+		if ctx.Bool("quiet") {
+			stacker.SetOutputLevel(stacker.QuietOutput)
+		} else if ctx.Bool("verbose") {
+			stacker.SetOutputLevel(stacker.VerboseOutput)
+			log.SetLevel(log.InfoLevel)
+		}
+
+		if ctx.Bool("no-color") {
+			stacker.DisableColor()
+		}
+
 		debug = ctx.Bool("debug")
 		return nil
 	}
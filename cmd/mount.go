@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anuvu/stacker"
+	"github.com/urfave/cli"
+)
+
+var mountCmd = cli.Command{
+	Name:      "mount",
+	Usage:     "mount an image with squashfs layers read-only, the way a device would",
+	ArgsUsage: "<tag> <mountpoint>",
+	Action:    doMount,
+}
+
+var umountCmd = cli.Command{
+	Name:      "umount",
+	Usage:     "unmount an image that was mounted with stacker mount",
+	ArgsUsage: "<mountpoint>",
+	Action:    doUmount,
+}
+
+func doMount(ctx *cli.Context) error {
+	if ctx.NArg() != 2 {
+		return fmt.Errorf("expected a tag and a mountpoint")
+	}
+
+	return stacker.Mount(config, ctx.Args().Get(0), ctx.Args().Get(1))
+}
+
+func doUmount(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return fmt.Errorf("expected a mountpoint")
+	}
+
+	return stacker.Unmount(config, ctx.Args().Get(0))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// startProfiling starts writing a pprof CPU profile of this process to
+// cpuProfile, if it's set. The returned function stops it, and writes a heap
+// profile to heapProfile, if that's set.
+func startProfiling(cpuProfile string, heapProfile string) (func(), error) {
+	var cpu *os.File
+	if cpuProfile != "" {
+		var err error
+		cpu, err = os.Create(cpuProfile)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := pprof.StartCPUProfile(cpu); err != nil {
+			cpu.Close()
+			return nil, err
+		}
+	}
+
+	return func() {
+		if cpu != nil {
+			pprof.StopCPUProfile()
+			cpu.Close()
+		}
+
+		if heapProfile == "" {
+			return
+		}
+
+		f, err := os.Create(heapProfile)
+		if err != nil {
+			fmt.Printf("couldn't write heap profile: %v\n", err)
+			return
+		}
+		defer f.Close()
+
+		// get up to date statistics
+		runtime.GC()
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			fmt.Printf("couldn't write heap profile: %v\n", err)
+		}
+	}, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anuvu/stacker"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var retagCmd = cli.Command{
+	Name:   "retag",
+	Usage:  "tags an image in the output again, keeping its digest",
+	Action: doRetag,
+	ArgsUsage: `<src> <dst>
+
+<src> is the tag of a built (or pulled) image, and <dst> is the tag to give it.`,
+}
+
+func doRetag(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return errors.Errorf("wrong number of args for retag")
+	}
+
+	return stacker.Retag(config, ctx.Args()[0], ctx.Args()[1])
+}
+
+var promoteCmd = cli.Command{
+	Name:   "promote",
+	Usage:  "copies a tested image to another tag or registry without rebuilding it",
+	Action: doPromote,
+	ArgsUsage: `<tag> <dest>
+
+<tag> is the tag of an image in the output, or an image url, e.g.
+docker://registry.example.com/staging/app:1.2.
+
+<dest> is the image url to copy it to, e.g.
+docker://registry.example.com/production/app:1.2.`,
+}
+
+func doPromote(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return errors.Errorf("wrong number of args for promote")
+	}
+
+	args := stacker.BuildArgs{
+		Config: config,
+		Debug:  debug,
+	}
+
+	d, err := stacker.Promote(&args, ctx.Args()[0], ctx.Args()[1])
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(d)
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+
+	"github.com/anuvu/stacker"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var runFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "bind",
+		Usage: "bind mount into the container, in /host/path[->/container/path] format",
+	},
+}
+
+var runCmd = cli.Command{
+	Name:   "run",
+	Usage:  "run a command in a throwaway container created from a built image",
+	Action: doRun,
+	Flags:  runFlags,
+	ArgsUsage: `<tag> [cmd...]
+
+<tag> is the built tag to run.
+
+<cmd> is the command to run, or /bin/sh if none is specified.`,
+}
+
+var shellCmd = cli.Command{
+	Name:      "shell",
+	Usage:     "run an interactive shell in a throwaway container created from a built image",
+	Action:    doShell,
+	Flags:     runFlags,
+	ArgsUsage: `<tag>`,
+}
+
+func doRun(ctx *cli.Context) error {
+	if len(ctx.Args()) < 1 {
+		return errors.Errorf("please specify a tag to run")
+	}
+
+	cmd := "/bin/sh"
+	if len(ctx.Args()) > 1 {
+		cmd = stacker.ShellJoin(ctx.Args()[1:])
+	}
+
+	return runBuilt(ctx, ctx.Args()[0], cmd)
+}
+
+func doShell(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return errors.Errorf("please specify exactly one tag for shell")
+	}
+
+	return runBuilt(ctx, ctx.Args()[0], "/bin/sh")
+}
+
+func runBuilt(ctx *cli.Context, tag string, cmd string) error {
+	wcLock, err := stacker.LockWorkingContainer(config)
+	if err != nil {
+		return err
+	}
+	defer wcLock.Unlock()
+
+	s, err := stacker.NewStorage(config)
+	if err != nil {
+		return err
+	}
+	defer s.Detach()
+
+	if !s.Exists(tag) {
+		return errors.Errorf("no snapshot for %s, was it built on this machine?", tag)
+	}
+
+	s.Delete(config.WorkingContainer())
+	err = s.Restore(tag, config.WorkingContainer())
+	if err != nil {
+		return err
+	}
+	defer s.Delete(config.WorkingContainer())
+
+	layer := &stacker.Layer{Binds: ctx.StringSlice("bind")}
+
+	stacker.Warnf(config, "WARNING: this container is temporary, any changes will be destroyed when it exits.\n")
+	return stacker.Run(config, tag, cmd, layer, "", os.Stdin)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+
+	"github.com/anuvu/stacker/server"
+	"github.com/urfave/cli"
+	"google.golang.org/grpc"
+)
+
+var serveCmd = cli.Command{
+	Name:   "serve",
+	Usage:  "run a daemon that accepts build requests over grpc",
+	Action: doServe,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "socket",
+			Usage: "the unix socket to listen on (default: <stacker-dir>/stacker.sock)",
+		},
+		cli.StringFlag{
+			Name:  "socket-group",
+			Usage: "group allowed to connect to the socket",
+		},
+	},
+}
+
+func doServe(ctx *cli.Context) error {
+	socket := ctx.String("socket")
+	if socket == "" {
+		socket = path.Join(config.StackerDir, "stacker.sock")
+	}
+
+	if err := os.MkdirAll(path.Dir(socket), 0755); err != nil {
+		return err
+	}
+
+	// clean up the socket from a previous daemon that didn't exit cleanly
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	if err := os.Chmod(socket, 0660); err != nil {
+		return err
+	}
+
+	if name := ctx.String("socket-group"); name != "" {
+		group, err := user.LookupGroup(name)
+		if err != nil {
+			return err
+		}
+
+		gid, err := strconv.Atoi(group.Gid)
+		if err != nil {
+			return err
+		}
+
+		if err := os.Chown(socket, -1, gid); err != nil {
+			return err
+		}
+	}
+
+	s := grpc.NewServer()
+	server.RegisterStackerServer(s, server.NewServer(config, debug))
+
+	fmt.Printf("listening on %s\n", socket)
+	return s.Serve(l)
+}
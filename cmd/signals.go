@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// interruptible returns a context that is cancelled when stacker gets SIGINT
+// or SIGTERM, so that a build can stop and clean up after itself (tear down
+// its container, detach the storage, remove its temp files) instead of dying
+// with all of that left behind. A second signal exits right away.
+func interruptible() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	done := make(chan bool)
+	go func() {
+		select {
+		case sg := <-signals:
+			fmt.Fprintf(os.Stderr, "got %s, cleaning up (again to exit now)\n", sg)
+			cancel()
+		case <-done:
+			return
+		}
+
+		select {
+		case <-signals:
+			os.Exit(130)
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel()
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/anuvu/stacker"
+	"github.com/urfave/cli"
+)
+
+var snapshotCmd = cli.Command{
+	Name:  "snapshot",
+	Usage: "move the snapshots of built layers and unpacked bases between hosts",
+	Subcommands: []cli.Command{
+		cli.Command{
+			Name:      "export",
+			Usage:     "write a snapshot as a stream",
+			ArgsUsage: "<name>",
+			Action:    doSnapshotExport,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "parent",
+					Usage: "only write what changed since this snapshot, which the other host needs to have imported already",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "the file to write the stream to (default: stdout)",
+				},
+			},
+		},
+		cli.Command{
+			Name:      "import",
+			Usage:     "make a snapshot out of a stream that was exported",
+			ArgsUsage: "<name>",
+			Action:    doSnapshotImport,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "input, i",
+					Usage: "the file to read the stream from (default: stdin)",
+				},
+			},
+		},
+	},
+}
+
+func snapshotName(ctx *cli.Context) (string, error) {
+	if ctx.NArg() != 1 {
+		return "", fmt.Errorf("expected the name of one snapshot")
+	}
+	return ctx.Args().Get(0), nil
+}
+
+func doSnapshotExport(ctx *cli.Context) error {
+	name, err := snapshotName(ctx)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if ctx.String("output") != "" {
+		f, err := os.Create(ctx.String("output"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	return stacker.ExportSnapshot(config, name, ctx.String("parent"), out)
+}
+
+func doSnapshotImport(ctx *cli.Context) error {
+	name, err := snapshotName(ctx)
+	if err != nil {
+		return err
+	}
+
+	var in io.Reader = os.Stdin
+	if ctx.String("input") != "" {
+		f, err := os.Open(ctx.String("input"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	return stacker.ImportSnapshot(config, name, in)
+}
@@ -49,6 +49,23 @@ var umociCmd = cli.Command{
 				cli.Uint64Flag{
 					Name: "max-layer-size",
 				},
+				cli.StringFlag{
+					Name:  "history-author",
+					Usage: "the author of the layer's history entry (default: the image's author)",
+				},
+				cli.StringFlag{
+					Name:  "history-created-by",
+					Usage: "the created_by of the layer's history entry",
+					Value: "stacker umoci repack",
+				},
+				cli.BoolFlag{
+					Name:  "squash",
+					Usage: "replace all of the image's layers with one of the whole rootfs",
+				},
+				cli.StringSliceFlag{
+					Name:  "xattrs",
+					Usage: "xattr namespace to keep in the new layers (default: all)",
+				},
 			},
 		},
 	},
@@ -180,7 +197,7 @@ func prepareUmociMetadata(storage stacker.Storage, bundlePath string, dp casext.
 		return err
 	}
 
-	err = storage.Snapshot(stacker.WorkingContainerName, highestHash)
+	err = storage.Snapshot(config.WorkingContainer(), highestHash)
 	if err != nil {
 		return err
 	}
@@ -232,16 +249,17 @@ func doUnpack(ctx *cli.Context) error {
 	if highestHash != "" {
 		// Delete the previously created working snapshot; we're about
 		// to create a new one.
-		err = storage.Delete(stacker.WorkingContainerName)
+		err = storage.Delete(config.WorkingContainer())
 		if err != nil {
 			return err
 		}
 
 		// TODO: this is a little wonky: we're assuming that
-		// bundle-path ends in _working. It always does because
-		// this is an internal API, but we should refactor this
-		// a bit.
-		err = storage.Restore(highestHash, stacker.WorkingContainerName)
+		// bundle-path is the working container (which our
+		// parent passed with --working-container). It always
+		// is because this is an internal API, but we should
+		// refactor this a bit.
+		err = storage.Restore(highestHash, config.WorkingContainer())
 		if err != nil {
 			return err
 		}
@@ -267,7 +285,7 @@ func doUnpack(ctx *cli.Context) error {
 			return err
 		}
 
-		return storage.Snapshot(stacker.WorkingContainerName, hash)
+		return storage.Snapshot(config.WorkingContainer(), hash)
 	}
 
 	opts := layer.MapOptions{KeepDirlinks: true}
@@ -285,30 +303,41 @@ func doRepack(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	defer oci.Close()
 
 	bundlePath := ctx.GlobalString("bundle-path")
-	meta, err := umoci.ReadBundleMeta(bundlePath)
-	if err != nil {
-		return err
-	}
+	author := ctx.String("history-author")
+	if author == "" {
+		meta, err := umoci.ReadBundleMeta(bundlePath)
+		if err != nil {
+			return err
+		}
 
-	mutator, err := mutate.New(oci, meta.From)
-	if err != nil {
-		return err
-	}
+		mutator, err := mutate.New(oci, meta.From)
+		if err != nil {
+			return err
+		}
 
-	imageMeta, err := mutator.Meta(context.Background())
-	if err != nil {
-		return err
-	}
+		imageMeta, err := mutator.Meta(context.Background())
+		if err != nil {
+			return err
+		}
 
-	now := time.Now()
-	history := &ispec.History{
-		Author:     imageMeta.Author,
-		Created:    &now,
-		CreatedBy:  "stacker umoci repack",
-		EmptyLayer: false,
+		author = imageMeta.Author
 	}
 
-	return umoci.Repack(oci, ctx.GlobalString("tag"), bundlePath, meta, history, nil, true, mutator)
+	now := time.Now()
+	return stacker.Repack(oci, stacker.RepackOpts{
+		Tag:        ctx.GlobalString("tag"),
+		BundlePath: bundlePath,
+		History: &ispec.History{
+			Author:     author,
+			Created:    &now,
+			CreatedBy:  ctx.String("history-created-by"),
+			EmptyLayer: false,
+		},
+		Squash:       ctx.Bool("squash"),
+		MaxLayerSize: int64(ctx.Uint64("max-layer-size")),
+		Xattrs:       ctx.StringSlice("xattrs"),
+	})
 }
@@ -16,14 +16,49 @@ var unladeCmd = cli.Command{
 	Usage:   "unpacks an OCI image to a directory",
 	Aliases: []string{"unpack"},
 	Action:  doUnlade,
-	Flags:   []cli.Flag{},
+	ArgsUsage: `[<tag> [<dest>]]
+
+<tag> is a built or pulled image to check out into the directory <dest>, or
+into a snapshot named <tag> if there's no <dest>. Without a <tag>, every
+image in the output is unpacked into a snapshot named after its tag.`,
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "uid-map",
+			Usage: "nsid:hostid:range entries to shift the uids of the image's files by (only as root)",
+		},
+		cli.StringSliceFlag{
+			Name:  "gid-map",
+			Usage: "nsid:hostid:range entries to shift the gids of the image's files by (only as root)",
+		},
+	},
 }
 
 func doUnlade(ctx *cli.Context) error {
+	if ctx.NArg() > 0 {
+		opts := stacker.UnpackOpts{
+			UIDMap: ctx.StringSlice("uid-map"),
+			GIDMap: ctx.StringSlice("gid-map"),
+		}
+
+		tag, dest := ctx.Args().Get(0), ctx.Args().Get(1)
+		if dest == "" {
+			opts.Snapshot = true
+			dest = tag
+		}
+
+		return stacker.Unpack(config, tag, dest, opts)
+	}
+
 	if _, err := os.Stat(config.OCIDir); err != nil {
 		return err
 	}
 
+	wcLock, err := stacker.LockWorkingContainer(config)
+	if err != nil {
+		return err
+	}
+	defer wcLock.Unlock()
+
 	s, err := stacker.NewStorage(config)
 	if err != nil {
 		return err
@@ -42,22 +77,22 @@ func doUnlade(ctx *cli.Context) error {
 
 	fmt.Printf("Unpacking all layers from %s into %s\n", config.OCIDir, config.RootFSDir)
 	for idx, tag := range tags {
-		s.Delete(stacker.WorkingContainerName)
-		err = s.Create(stacker.WorkingContainerName)
+		s.Delete(config.WorkingContainer())
+		err = s.Create(config.WorkingContainer())
 		if err != nil {
 			return err
 		}
 		fmt.Printf("%d/%d: unpacking %s", idx+1, len(tags), tag)
 		err = stacker.RunUmociSubcommand(config, debug, []string{
 			"--tag", tag,
-			"--bundle-path", path.Join(config.RootFSDir, stacker.WorkingContainerName),
+			"--bundle-path", path.Join(config.RootFSDir, config.WorkingContainer()),
 			"unpack",
 		})
 		if err != nil {
 			return err
 		}
 		fmt.Printf(" - done.\n")
-		err = s.Snapshot(stacker.WorkingContainerName, tag)
+		err = s.Snapshot(config.WorkingContainer(), tag)
 		if err != nil {
 			return err
 		}
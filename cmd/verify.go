@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/anuvu/stacker"
+	"github.com/urfave/cli"
+)
+
+var verifyCmd = cli.Command{
+	Name:   "verify",
+	Usage:  "rebuilds a stackerfile from scratch and checks that its images are the same as the ones that were built",
+	Action: doVerify,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "stacker-file, f",
+			Usage: "the input stackerfile",
+			Value: "stacker.yaml",
+		},
+		cli.StringSliceFlag{
+			Name:  "substitute",
+			Usage: "variable substitution in stackerfiles, FOO=bar format",
+		},
+		cli.StringSliceFlag{
+			Name:  "substitute-file",
+			Usage: "yaml file of substitutions (NAME: value), overridden by --substitute",
+		},
+		cli.StringFlag{
+			Name:  "layer-type",
+			Usage: "set the output layer type (supported values: tar, squashfs)",
+			Value: "tar",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "the os/arch[/variant] layers are for, unless they say otherwise (default: the host's)",
+		},
+		cli.StringSliceFlag{
+			Name:  "secret",
+			Usage: "secret for layers to use, as NAME (from the environment) or NAME=FILE",
+		},
+		cli.StringFlag{
+			Name:  "against",
+			Usage: "the save_url the images were saved to (default: the ones in the oci dir)",
+		},
+		cli.StringFlag{
+			Name:  "tag",
+			Usage: "the tag the images were saved to --against as",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "render the comparison as json",
+		},
+	},
+}
+
+func doVerify(ctx *cli.Context) error {
+	if !ctx.IsSet("layer-type") && config.LayerType != "" {
+		if err := ctx.Set("layer-type", config.LayerType); err != nil {
+			return err
+		}
+	}
+
+	args := stacker.BuildArgs{
+		Config:          config,
+		Substitute:      ctx.StringSlice("substitute"),
+		SubstituteFiles: ctx.StringSlice("substitute-file"),
+		LayerType:       ctx.String("layer-type"),
+		Platform:        ctx.String("platform"),
+		Secrets:         ctx.StringSlice("secret"),
+		Debug:           debug,
+	}
+
+	report, err := stacker.Reproduce(args, ctx.String("stacker-file"), ctx.String("against"), ctx.String("tag"))
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("json") {
+		pretty, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(pretty))
+	} else {
+		for _, l := range report.Layers {
+			switch {
+			case l.Missing:
+				fmt.Printf("%s: not in the original build\n", l.Name)
+			case l.Reproducible():
+				fmt.Printf("%s: reproducible\n", l.Name)
+			case !l.LayersMatch:
+				fmt.Printf("%s: layers differ\n", l.Name)
+				for i, d := range l.Layers {
+					expected := "(none)"
+					if i < len(l.ExpectedLayers) {
+						expected = l.ExpectedLayers[i].String()
+					}
+					if expected != d.String() {
+						fmt.Printf("\t%d: %s, expected %s\n", i, d, expected)
+					}
+				}
+			default:
+				fmt.Printf("%s: config differs (%s, expected %s)\n", l.Name, l.Config, l.ExpectedConfig)
+			}
+		}
+	}
+
+	if diverged := report.Diverged(); len(diverged) > 0 {
+		return fmt.Errorf("%d layers weren't reproduced: %s", len(diverged), strings.Join(diverged, ", "))
+	}
+
+	return nil
+}
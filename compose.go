@@ -0,0 +1,585 @@
+package stacker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openSUSE/umoci"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v2"
+)
+
+// composeReadyTimeout is how long a service has to start listening on its
+// ready_port, unless it says otherwise.
+const composeReadyTimeout = time.Minute
+
+// ComposeFile is a set of layers of stackerfiles to build and run together,
+// e.g. for integration tests; see Compose.
+type ComposeFile struct {
+	// StackerFiles are the stackerfiles the services' layers are in,
+	// relative to the compose file; stacker.yaml next to it if there are
+	// none.
+	StackerFiles []string `yaml:"stacker_files"`
+
+	Services map[string]*ComposeService `yaml:"services"`
+
+	// Test is run once all the services are ready; without one, the
+	// services run until one of them exits or stacker is interrupted.
+	Test *ComposeService `yaml:"test"`
+
+	// dir is the directory the compose file is in.
+	dir string
+}
+
+// ComposeService is something Compose runs, in a throwaway container made
+// from a layer.
+type ComposeService struct {
+	Layer string `yaml:"layer"`
+
+	// Command is run with /bin/sh -c; the layer's entrypoint and cmd are
+	// run if there isn't one.
+	Command string `yaml:"command"`
+
+	Environment map[string]string `yaml:"environment"`
+
+	// Binds are bind mounts, in /host/path[->/container/path] format,
+	// with relative host paths relative to the compose file.
+	Binds []string `yaml:"binds"`
+
+	// DependsOn are the services that are started (and ready) before
+	// this one.
+	DependsOn []string `yaml:"depends_on"`
+
+	// ReadyPort is the port the service listens on once it's ready; the
+	// services that depend on it aren't started until it does.
+	ReadyPort    int    `yaml:"ready_port"`
+	ReadyTimeout string `yaml:"ready_timeout"`
+}
+
+var composeServiceName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// ReadComposeFile reads and checks the compose file at file.
+func ReadComposeFile(file string) (*ComposeFile, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	cf := &ComposeFile{}
+	if err := yaml.Unmarshal(content, cf); err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse %s", file)
+	}
+
+	cf.dir, err = filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cf.StackerFiles) == 0 {
+		cf.StackerFiles = []string{"stacker.yaml"}
+	}
+	for i, f := range cf.StackerFiles {
+		if !filepath.IsAbs(f) {
+			cf.StackerFiles[i] = filepath.Join(cf.dir, f)
+		}
+	}
+
+	if len(cf.Services) == 0 && cf.Test == nil {
+		return nil, fmt.Errorf("%s has no services", file)
+	}
+
+	for name, svc := range cf.Services {
+		if cf.Test != nil && name == "test" {
+			return nil, fmt.Errorf("a service can't be called test when there is a test")
+		}
+		if !composeServiceName.MatchString(name) {
+			return nil, fmt.Errorf("bad service name %q", name)
+		}
+		if err := svc.check(name, cf); err != nil {
+			return nil, err
+		}
+	}
+
+	if cf.Test != nil {
+		if err := cf.Test.check("test", cf); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := cf.order(); err != nil {
+		return nil, err
+	}
+
+	return cf, nil
+}
+
+func (svc *ComposeService) check(name string, cf *ComposeFile) error {
+	if svc == nil || svc.Layer == "" {
+		return fmt.Errorf("%s: no layer", name)
+	}
+
+	for _, dep := range svc.DependsOn {
+		if _, ok := cf.Services[dep]; !ok {
+			return fmt.Errorf("%s: depends on %s, which isn't a service", name, dep)
+		}
+	}
+
+	if _, err := svc.binds(cf.dir); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	if svc.ReadyTimeout != "" {
+		if _, err := time.ParseDuration(svc.ReadyTimeout); err != nil {
+			return fmt.Errorf("%s: bad ready_timeout: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+func (svc *ComposeService) readyTimeout() time.Duration {
+	timeout, err := time.ParseDuration(svc.ReadyTimeout)
+	if err != nil {
+		return composeReadyTimeout
+	}
+	return timeout
+}
+
+// order returns the names of the services in the order they're started:
+// each after the ones it depends on, and otherwise by name.
+func (cf *ComposeFile) order() ([]string, error) {
+	names := []string{}
+	for name := range cf.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	order := []string{}
+	state := map[string]int{}
+
+	var visit func(name string, chain []string) error
+	visit = func(name string, chain []string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("services depend on each other: %s", strings.Join(append(chain, name), " -> "))
+		case 2:
+			return nil
+		}
+
+		state[name] = 1
+		deps := append([]string{}, cf.Services[name].DependsOn...)
+		sort.Strings(deps)
+		for _, dep := range deps {
+			if err := visit(dep, append(chain, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+
+		order = append(order, name)
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+// binds returns the service's binds, with host paths made absolute.
+func (svc *ComposeService) binds(dir string) ([]interface{}, error) {
+	binds := []interface{}{}
+	for _, b := range svc.Binds {
+		parts := strings.SplitN(b, "->", 2)
+		source := strings.TrimSpace(parts[0])
+		target := source
+		if len(parts) == 2 {
+			target = strings.TrimSpace(parts[1])
+		} else if !filepath.IsAbs(source) {
+			return nil, fmt.Errorf("bind %s needs a path in the container", b)
+		}
+
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(dir, source)
+		}
+
+		binds = append(binds, fmt.Sprintf("%s->%s", source, target))
+	}
+	return binds, nil
+}
+
+// command returns the shell command the service runs, in a container made
+// from an image whose config is image.
+func (svc *ComposeService) command(name string, image ispec.Image) (string, error) {
+	if svc.Command != "" {
+		return svc.Command, nil
+	}
+
+	args := append(append([]string{}, image.Config.Entrypoint...), image.Config.Cmd...)
+	if len(args) == 0 {
+		return "", fmt.Errorf("%s: %s has no entrypoint or cmd, so the service needs a command", name, svc.Layer)
+	}
+
+	quoted := []string{}
+	for _, a := range args {
+		quoted = append(quoted, shellQuote(a))
+	}
+
+	command := strings.Join(quoted, " ")
+	if image.Config.WorkingDir != "" {
+		command = fmt.Sprintf("cd %s && exec %s", shellQuote(image.Config.WorkingDir), command)
+	}
+	return command, nil
+}
+
+// composeHosts is the /etc/hosts of the containers Compose runs, which share
+// the host's network, so that each service can reach the others by name.
+func composeHosts(names []string) string {
+	return fmt.Sprintf("127.0.0.1\tlocalhost %s\n::1\tlocalhost ip6-localhost ip6-loopback\n", strings.Join(names, " "))
+}
+
+// prefixWriter prefixes each line written to w with prefix, so that the
+// output of several containers can be told apart.
+type prefixWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	prefix  string
+	partial bool
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	buf := bytes.Buffer{}
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+
+		if !p.partial {
+			buf.WriteString(p.prefix)
+		}
+		buf.Write(line)
+		p.partial = line[len(line)-1] != '\n'
+	}
+
+	if _, err := p.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// composeContainer is a running service.
+type composeContainer struct {
+	name   string
+	config StackerConfig
+	lock   *Lock
+
+	done chan struct{}
+	err  error
+}
+
+// composeRun is the services of a compose file that Compose is running.
+type composeRun struct {
+	config  StackerConfig
+	cf      *ComposeFile
+	storage Storage
+	images  map[string]ispec.Image
+	hosts   string
+	width   int
+
+	running []*composeContainer
+	exited  chan *composeContainer
+}
+
+// start starts the service name in its own container.
+func (r *composeRun) start(name string, svc *ComposeService) (*composeContainer, error) {
+	command, err := svc.command(name, r.images[svc.Layer])
+	if err != nil {
+		return nil, err
+	}
+
+	binds, err := svc.binds(r.cf.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// the containers are working containers like the one builds use, so
+	// a stacker that crashed with them running cleans them up next time
+	container := fmt.Sprintf("%s-compose-%s", r.config.WorkingContainer(), name)
+	lock, err := lockFile(r.config, workingLockName(container), unix.LOCK_EX, false)
+	if err == unix.EWOULDBLOCK {
+		return nil, newError(ErrBuildInProgress, nil, "%s is already running in another stacker", name)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "couldn't lock container for %s", name)
+	}
+
+	r.storage.Delete(container)
+	if err := r.storage.Restore(svc.Layer, container); err != nil {
+		lock.Unlock()
+		return nil, errors.Wrapf(err, "couldn't make container for %s", name)
+	}
+
+	c := &composeContainer{name: name, config: r.config, lock: lock, done: make(chan struct{})}
+	c.config.WorkingContainerName = container
+	r.running = append(r.running, c)
+
+	env := envMap(r.images[svc.Layer].Config.Env)
+	for k, v := range svc.Environment {
+		env[k] = v
+	}
+
+	l := &Layer{
+		BuildEnv: env,
+		Binds:    append(binds, fmt.Sprintf("%s->/etc/hosts", r.hosts)),
+	}
+
+	out := &prefixWriter{w: r.config.stdout(), prefix: fmt.Sprintf("%-*s | ", r.width, name)}
+	infof(r.config, "starting %s (%s)\n", name, svc.Layer)
+	go func() {
+		c.err = runWithOutput(c.config, container, command, l, "", nil, out)
+		close(c.done)
+		r.exited <- c
+	}()
+
+	return c, nil
+}
+
+// waitReady waits for the service c to listen on its ready port.
+func (r *composeRun) waitReady(ctx context.Context, c *composeContainer, svc *ComposeService) error {
+	if svc.ReadyPort == 0 {
+		return nil
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%d", svc.ReadyPort)
+	deadline := time.After(svc.readyTimeout())
+	tick := time.NewTicker(250 * time.Millisecond)
+	defer tick.Stop()
+
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			verbosef(r.config, "%s is ready\n", c.name)
+			return nil
+		}
+
+		select {
+		case <-c.done:
+			return fmt.Errorf("%s exited before it was ready: %v", c.name, c.err)
+		case <-ctx.Done():
+			return newError(ErrInterrupted, ctx.Err(), "interrupted waiting for %s", c.name)
+		case <-deadline:
+			return fmt.Errorf("%s wasn't listening on port %d after %s", c.name, svc.ReadyPort, svc.readyTimeout())
+		case <-tick.C:
+		}
+	}
+}
+
+// stop kills the services that are still running and throws away their
+// containers, last started first.
+func (r *composeRun) stop() {
+	for i := len(r.running) - 1; i >= 0; i-- {
+		c := r.running[i]
+
+		select {
+		case <-c.done:
+		default:
+			infof(r.config, "stopping %s\n", c.name)
+			if err := killContainer(c.config); err != nil {
+				warnf(r.config, "couldn't stop %s: %v\n", c.name, err)
+			}
+			<-c.done
+		}
+
+		if err := r.storage.Delete(c.config.WorkingContainer()); err != nil {
+			warnf(r.config, "couldn't remove the container of %s: %v\n", c.name, err)
+		}
+		c.lock.Unlock()
+	}
+	r.running = nil
+}
+
+// killContainer kills what's running in the working container of config.
+func killContainer(config StackerConfig) error {
+	c, err := newRunner(config, config.WorkingContainer())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return c.kill()
+}
+
+// composeImages returns the configs of the images of the layers, or empty
+// ones for the layers that are build_only.
+func composeImages(config StackerConfig, layers []string) (map[string]ispec.Image, error) {
+	lock, err := LockOCIDir(config)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	oci, err := umoci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return nil, err
+	}
+	defer oci.Close()
+
+	images := map[string]ispec.Image{}
+	for _, l := range layers {
+		image, err := lookupImageConfig(oci, l)
+		if err != nil {
+			verbosef(config, "%s has no image, so its entrypoint and cmd aren't known: %v\n", l, err)
+		}
+		images[l] = image
+	}
+
+	return images, nil
+}
+
+// Compose builds the stackerfiles of the compose file file (and their
+// prerequisites), and runs its services together, each in a throwaway
+// container made from its layer, in the order they depend on each other.
+// The containers share the host's network, as the ones that run the
+// layers' commands do, and each has an /etc/hosts that points the names of
+// the services at it. Once they're all ready, the compose file's test is
+// run, and the services are stopped and thrown away when it's done, or,
+// without a test, when one of them exits or ctx is done. Its error is the
+// test's, or the service's that exited.
+func Compose(ctx context.Context, opts *BuildArgs, file string) error {
+	cf, err := ReadComposeFile(file)
+	if err != nil {
+		return err
+	}
+
+	order, err := cf.order()
+	if err != nil {
+		return err
+	}
+
+	b := NewBuilder(opts)
+	b.SetContext(ctx)
+	if err := b.BuildMultiple(cf.StackerFiles); err != nil {
+		return err
+	}
+
+	services := map[string]*ComposeService{}
+	for name, svc := range cf.Services {
+		services[name] = svc
+	}
+
+	all := order
+	if cf.Test != nil {
+		services["test"] = cf.Test
+		all = append(all, "test")
+	}
+
+	layers := []string{}
+	width := 0
+	for _, name := range all {
+		layers = append(layers, services[name].Layer)
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+
+	images, err := composeImages(opts.Config, layers)
+	if err != nil {
+		return err
+	}
+
+	s, err := NewStorage(opts.Config)
+	if err != nil {
+		return err
+	}
+	defer s.Detach()
+
+	for _, l := range layers {
+		if !s.Exists(l) {
+			return fmt.Errorf("%s isn't in %s", l, strings.Join(cf.StackerFiles, ", "))
+		}
+	}
+
+	hostsDir := path.Join(opts.Config.StackerDir, "compose", opts.Config.WorkingContainer())
+	if err := os.MkdirAll(hostsDir, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(hostsDir)
+
+	hosts := path.Join(hostsDir, "hosts")
+	if err := ioutil.WriteFile(hosts, []byte(composeHosts(all)), 0644); err != nil {
+		return err
+	}
+
+	r := &composeRun{
+		config:  opts.Config,
+		cf:      cf,
+		storage: s,
+		images:  images,
+		hosts:   hosts,
+		width:   width,
+		exited:  make(chan *composeContainer, len(all)),
+	}
+	defer r.stop()
+
+	for _, name := range order {
+		c, err := r.start(name, services[name])
+		if err != nil {
+			return err
+		}
+
+		if err := r.waitReady(ctx, c, services[name]); err != nil {
+			return err
+		}
+	}
+
+	if cf.Test != nil {
+		c, err := r.start("test", cf.Test)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-c.done:
+			if c.err != nil {
+				return errors.Wrapf(c.err, "test failed")
+			}
+			infof(opts.Config, "test passed\n")
+			return nil
+		case <-ctx.Done():
+			return newError(ErrInterrupted, ctx.Err(), "interrupted running the test")
+		}
+	}
+
+	infof(opts.Config, "all services are running\n")
+	select {
+	case c := <-r.exited:
+		if c.err != nil {
+			return errors.Wrapf(c.err, "%s exited", c.name)
+		}
+		infof(opts.Config, "%s exited\n", c.name)
+		return nil
+	case <-ctx.Done():
+		return nil
+	}
+}
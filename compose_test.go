@@ -0,0 +1,138 @@
+package stacker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func writeComposeFile(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "stacker_compose_test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	file := path.Join(dir, "stacker-compose.yaml")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("%s", err)
+	}
+
+	return file, func() { os.RemoveAll(dir) }
+}
+
+func TestReadComposeFile(t *testing.T) {
+	file, cleanup := writeComposeFile(t, `services:
+    web:
+        layer: web
+        depends_on: [db, cache]
+        binds:
+            - config->/etc/web
+    db:
+        layer: postgres
+        ready_port: 5432
+    cache:
+        layer: redis
+test:
+    layer: tests
+    command: ./run-tests
+`)
+	defer cleanup()
+
+	cf, err := ReadComposeFile(file)
+	if err != nil {
+		t.Fatalf("couldn't read compose file: %v", err)
+	}
+
+	dir := path.Dir(file)
+	if !reflect.DeepEqual(cf.StackerFiles, []string{path.Join(dir, "stacker.yaml")}) {
+		t.Errorf("bad stackerfiles %v", cf.StackerFiles)
+	}
+
+	order, err := cf.order()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !reflect.DeepEqual(order, []string{"cache", "db", "web"}) {
+		t.Errorf("bad order %v", order)
+	}
+
+	binds, err := cf.Services["web"].binds(cf.dir)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !reflect.DeepEqual(binds, []interface{}{path.Join(dir, "config") + "->/etc/web"}) {
+		t.Errorf("bad binds %v", binds)
+	}
+
+	if cf.Services["db"].readyTimeout() != composeReadyTimeout {
+		t.Errorf("bad ready timeout %s", cf.Services["db"].readyTimeout())
+	}
+}
+
+func TestReadComposeFileErrors(t *testing.T) {
+	for _, content := range []string{
+		"services:\n    a:\n        layer: a\n        depends_on: [b]\n    b:\n        layer: b\n        depends_on: [a]\n",
+		"services:\n    a:\n        layer: a\n        depends_on: [nope]\n",
+		"services:\n    a:\n        command: true\n",
+		"services:\n    a:\n        layer: a\n        binds: [relative]\n",
+		"services:\n    test:\n        layer: a\ntest:\n    layer: b\n",
+		"services: {}\n",
+	} {
+		file, cleanup := writeComposeFile(t, content)
+		_, err := ReadComposeFile(file)
+		cleanup()
+		if err == nil {
+			t.Errorf("bad compose file was read:\n%s", content)
+		}
+	}
+}
+
+func TestComposeServiceCommand(t *testing.T) {
+	svc := &ComposeService{Layer: "web"}
+
+	image := ispec.Image{}
+	if _, err := svc.command("web", image); err == nil {
+		t.Errorf("got a command for an image with none")
+	}
+
+	image.Config.Entrypoint = []string{"/usr/bin/web"}
+	image.Config.Cmd = []string{"--listen", ":80 443"}
+	image.Config.WorkingDir = "/srv"
+	command, err := svc.command("web", image)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if command != "cd /srv && exec /usr/bin/web --listen ':80 443'" {
+		t.Errorf("bad command %s", command)
+	}
+
+	svc.Command = "web --debug"
+	command, err = svc.command("web", image)
+	if err != nil || command != "web --debug" {
+		t.Errorf("bad command %s (%v)", command, err)
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := &prefixWriter{w: out, prefix: "db | "}
+
+	w.Write([]byte("starting\nlisten"))
+	w.Write([]byte("ing on 5432\n"))
+
+	expected := "db | starting\ndb | listening on 5432\n"
+	if out.String() != expected {
+		t.Errorf("bad output %q", out.String())
+	}
+
+	if !strings.Contains(composeHosts([]string{"db", "web"}), "localhost db web\n") {
+		t.Errorf("bad hosts %s", composeHosts([]string{"db", "web"}))
+	}
+}
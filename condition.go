@@ -0,0 +1,263 @@
+package stacker
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"unicode"
+)
+
+// A layer's if: condition is a small boolean expression, e.g.
+//
+//     DEBUG == 1 && arch != "arm64"
+//
+// Names are the substitutions and the host's os and arch, and are "" if they
+// aren't set; literals are numbers or quoted strings. ==, !=, &&, ||, ! and
+// parentheses work as they do in go, and a value on its own is true unless it
+// is "", "0" or "false".
+
+type conditionParser struct {
+	tokens []string
+	pos    int
+	vars   map[string]string
+}
+
+func tokenizeCondition(expr string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.HasPrefix(expr[i:], "==") || strings.HasPrefix(expr[i:], "!=") ||
+			strings.HasPrefix(expr[i:], "&&") || strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		case c == '!' || c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(expr[i+1:], expr[i])
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string in %q", expr)
+			}
+			tokens = append(tokens, expr[i:i+end+2])
+			i += end + 2
+		default:
+			start := i
+			for i < len(expr) && !strings.ContainsRune(" \t\n=!&|()\"'", rune(expr[i])) {
+				i++
+			}
+			if start == i {
+				return nil, fmt.Errorf("unexpected %q in %q", expr[i], expr)
+			}
+			tokens = append(tokens, expr[start:i])
+		}
+	}
+
+	return tokens, nil
+}
+
+func (p *conditionParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *conditionParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func truthy(value string) bool {
+	return value != "" && value != "0" && value != "false"
+}
+
+func (p *conditionParser) or() (bool, error) {
+	result, err := p.and()
+	if err != nil {
+		return false, err
+	}
+
+	for p.peek() == "||" {
+		p.next()
+		rhs, err := p.and()
+		if err != nil {
+			return false, err
+		}
+		result = result || rhs
+	}
+
+	return result, nil
+}
+
+func (p *conditionParser) and() (bool, error) {
+	result, err := p.unary()
+	if err != nil {
+		return false, err
+	}
+
+	for p.peek() == "&&" {
+		p.next()
+		rhs, err := p.unary()
+		if err != nil {
+			return false, err
+		}
+		result = result && rhs
+	}
+
+	return result, nil
+}
+
+func (p *conditionParser) unary() (bool, error) {
+	switch p.peek() {
+	case "!":
+		p.next()
+		result, err := p.unary()
+		return !result, err
+	case "(":
+		p.next()
+		result, err := p.or()
+		if err != nil {
+			return false, err
+		}
+		if p.next() != ")" {
+			return false, fmt.Errorf("missing )")
+		}
+		return result, nil
+	}
+
+	lhs, err := p.operand()
+	if err != nil {
+		return false, err
+	}
+
+	switch p.peek() {
+	case "==", "!=":
+		op := p.next()
+		rhs, err := p.operand()
+		if err != nil {
+			return false, err
+		}
+		return (lhs == rhs) == (op == "=="), nil
+	default:
+		return truthy(lhs), nil
+	}
+}
+
+func (p *conditionParser) operand() (string, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return "", fmt.Errorf("unexpected end of expression")
+	case strings.HasPrefix(t, "\"") || strings.HasPrefix(t, "'"):
+		return t[1 : len(t)-1], nil
+	case unicode.IsDigit(rune(t[0])) || t[0] == '-':
+		return t, nil
+	case strings.ContainsAny(t, "=!&|()"):
+		return "", fmt.Errorf("unexpected %s", t)
+	default:
+		return p.vars[t], nil
+	}
+}
+
+// evalCondition evaluates the if: condition expr with the given
+// substitutions.
+func evalCondition(expr string, substitutions []string) (bool, error) {
+	vars := map[string]string{
+		"os":   runtime.GOOS,
+		"arch": runtime.GOARCH,
+	}
+
+	for _, subst := range substitutions {
+		membs := strings.SplitN(subst, "=", 2)
+		if len(membs) != 2 {
+			return false, fmt.Errorf("invalid substition %s", subst)
+		}
+		vars[membs[0]] = membs[1]
+	}
+
+	tokens, err := tokenizeCondition(expr)
+	if err != nil {
+		return false, err
+	}
+
+	p := &conditionParser{tokens: tokens, vars: vars}
+	result, err := p.or()
+	if err != nil {
+		return false, fmt.Errorf("bad condition %q: %v", expr, err)
+	}
+
+	if p.pos != len(p.tokens) {
+		return false, fmt.Errorf("bad condition %q: unexpected %s", expr, p.peek())
+	}
+
+	return result, nil
+}
+
+// pruneLayers removes the layers whose if: condition is false from sf. It is
+// an error for a layer that is built to need one that isn't.
+func (sf *Stackerfile) pruneLayers(config StackerConfig, substitutions []string) error {
+	skipped := map[string]bool{}
+	fileOrder := []string{}
+	for _, name := range sf.fileOrder {
+		layer := sf.internal[name]
+		if layer.If == "" {
+			fileOrder = append(fileOrder, name)
+			continue
+		}
+
+		include, err := evalCondition(layer.If, substitutions)
+		if err != nil {
+			return fmt.Errorf("stackerfile: %s: %v", name, err)
+		}
+
+		if !include {
+			infof(config, "skipping %s, since %s is false\n", name, layer.If)
+			skipped[name] = true
+			delete(sf.internal, name)
+			continue
+		}
+
+		fileOrder = append(fileOrder, name)
+	}
+	sf.fileOrder = fileOrder
+
+	for _, name := range sf.fileOrder {
+		layer := sf.internal[name]
+		if layer.From != nil && layer.From.Type == BuiltType && skipped[layer.From.Tag] {
+			return fmt.Errorf("stackerfile: %s is built on %s, which is skipped", name, layer.From.Tag)
+		}
+
+		copyFromLayers, err := layer.copyFromLayers()
+		if err != nil {
+			return err
+		}
+
+		for _, from := range copyFromLayers {
+			if skipped[from] {
+				return fmt.Errorf("stackerfile: %s copies from %s, which is skipped", name, from)
+			}
+		}
+
+		imports, err := layer.ParseImport()
+		if err != nil {
+			return err
+		}
+
+		for _, imp := range imports {
+			if !strings.HasPrefix(imp, "stacker://") {
+				continue
+			}
+
+			from := strings.SplitN(strings.TrimPrefix(imp, "stacker://"), "/", 2)[0]
+			if skipped[from] {
+				return fmt.Errorf("stackerfile: %s imports %s from %s, which is skipped", name, imp, from)
+			}
+		}
+	}
+
+	return nil
+}
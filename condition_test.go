@@ -0,0 +1,72 @@
+package stacker
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestEvalCondition(t *testing.T) {
+	subs := []string{"DEBUG=1", "FLAVOR=slim", "EMPTY="}
+	cases := map[string]bool{
+		"DEBUG":                            true,
+		"DEBUG == 1":                       true,
+		"DEBUG != 1":                       false,
+		"!DEBUG":                           false,
+		"UNSET":                            false,
+		"EMPTY":                            false,
+		`FLAVOR == "slim" && DEBUG == 1`:   true,
+		`FLAVOR == 'full' || DEBUG == 0`:   false,
+		`!(FLAVOR == "full") && DEBUG`:     true,
+		`arch == "` + runtime.GOARCH + `"`: true,
+		`os != "` + runtime.GOOS + `"`:     false,
+	}
+
+	for expr, expected := range cases {
+		result, err := evalCondition(expr, subs)
+		if err != nil {
+			t.Errorf("%s: %s", expr, err)
+			continue
+		}
+
+		if result != expected {
+			t.Errorf("%s: got %v, expected %v", expr, result, expected)
+		}
+	}
+
+	for _, expr := range []string{"DEBUG =", "(DEBUG", "DEBUG == 1 1", `FLAVOR == "slim`} {
+		if _, err := evalCondition(expr, subs); err == nil {
+			t.Errorf("bad condition %s accepted", expr)
+		}
+	}
+}
+
+func TestIf(t *testing.T) {
+	content := `base:
+    from:
+        type: docker
+        url: docker://centos:latest
+debug:
+    from:
+        type: built
+        tag: base
+    if: DEBUG == 1
+app:
+    from:
+        type: built
+        tag: base
+`
+	sf := parse(t, content)
+
+	do, err := sf.DependencyOrder()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(do) != 2 || do[0] != "base" || do[1] != "app" {
+		t.Fatalf("bad dependency order: %v", do)
+	}
+
+	if _, ok := sf.Get("debug"); ok {
+		t.Fatalf("debug layer wasn't skipped")
+	}
+}
@@ -0,0 +1,258 @@
+package stacker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigEnvPrefix is the prefix of the environment variables that override
+// settings in stacker's config files: each string setting can be set with
+// ConfigEnvPrefix followed by its name in upper case, e.g.
+// STACKER_OCI_DIR for oci_dir.
+const ConfigEnvPrefix = "STACKER_"
+
+// SystemConfigPath is the config file with the defaults for everyone on the
+// host.
+const SystemConfigPath = "/etc/stacker/config.yaml"
+
+// UserConfigPaths are the current user's config files, in the order they're
+// read: conf.yaml is where stacker used to read it from.
+func UserConfigPaths() ([]string, error) {
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		configDir = path.Join(home, ".config")
+	}
+
+	return []string{
+		path.Join(configDir, "conf.yaml"),
+		path.Join(configDir, "stacker", "config.yaml"),
+	}, nil
+}
+
+// DefaultConfigPaths are the config files stacker reads when it isn't told
+// which one to use, in the order they're read.
+func DefaultConfigPaths() ([]string, error) {
+	userPaths, err := UserConfigPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]string{SystemConfigPath}, userPaths...), nil
+}
+
+// ReadConfig reads the config files paths in order, with the settings in
+// each one overriding the ones before it (files that don't exist are
+// skipped), and then applies the overrides from the environment. A leading ~
+// in its directories is expanded to the user's home directory.
+func ReadConfig(paths []string) (StackerConfig, error) {
+	config := StackerConfig{}
+	for _, p := range paths {
+		content, err := ioutil.ReadFile(p)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return StackerConfig{}, err
+		}
+
+		if err := yaml.Unmarshal(content, &config); err != nil {
+			return StackerConfig{}, errors.Wrapf(err, "couldn't read config %s", p)
+		}
+	}
+
+	if err := applyConfigEnv(&config, os.LookupEnv); err != nil {
+		return StackerConfig{}, err
+	}
+
+	if err := config.expandPaths(); err != nil {
+		return StackerConfig{}, err
+	}
+
+	return config, nil
+}
+
+// configEnvVar is the name of the environment variable that overrides the
+// config setting whose yaml name is name.
+func configEnvVar(name string) string {
+	return ConfigEnvPrefix + strings.ToUpper(name)
+}
+
+// applyConfigEnv sets the string (and optional boolean) settings of config
+// that have an environment variable set (as looked up by lookup).
+func applyConfigEnv(config *StackerConfig, lookup func(string) (string, bool)) error {
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		value, ok := lookup(configEnvVar(name))
+		if !ok {
+			continue
+		}
+
+		switch {
+		case t.Field(i).Type.Kind() == reflect.String:
+			v.Field(i).SetString(value)
+		case t.Field(i).Type == reflect.TypeOf((*bool)(nil)):
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return errors.Wrapf(err, "bad %s", configEnvVar(name))
+			}
+			v.Field(i).Set(reflect.ValueOf(&b))
+		default:
+			return errors.Errorf("%s can't be set from the environment", configEnvVar(name))
+		}
+	}
+
+	return nil
+}
+
+// mirrorURL is imageURL, but pulled from the mirror configured for its
+// registry, if there is one.
+func (c StackerConfig) mirrorURL(imageURL string) string {
+	host, ok := registryHost(imageURL)
+	if !ok {
+		return imageURL
+	}
+
+	mirror, ok := c.RegistryMirrors[host]
+	if !ok {
+		return imageURL
+	}
+
+	image := strings.TrimPrefix(strings.TrimPrefix(imageURL, "docker://"), host+"/")
+	if host == "docker.io" && !strings.Contains(image, "/") {
+		// the docker hub's official images are really in library/,
+		// which mirrors don't know to fill in
+		image = "library/" + image
+	}
+
+	return fmt.Sprintf("docker://%s/%s", mirror, image)
+}
+
+// ExpandHome expands a leading ~ in p to the current user's home directory.
+func ExpandHome(p string) (string, error) {
+	if p != "~" && !strings.HasPrefix(p, "~/") {
+		return p, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(home, strings.TrimPrefix(p, "~")), nil
+}
+
+// expandPaths expands ~ in config's directories.
+func (c *StackerConfig) expandPaths() error {
+	paths := []*string{&c.StackerDir, &c.OCIDir, &c.RootFSDir, &c.SharedBlobDir, &c.BaseImageCacheDir, &c.ScratchDir, &c.SeccompProfile, &c.ImportPins}
+	for i := range c.CACerts {
+		paths = append(paths, &c.CACerts[i])
+	}
+
+	for _, p := range paths {
+		expanded, err := ExpandHome(*p)
+		if err != nil {
+			return err
+		}
+		*p = expanded
+	}
+
+	for host, t := range c.RegistryTLS {
+		for _, p := range []*string{&t.CACert, &t.ClientCert, &t.ClientKey} {
+			expanded, err := ExpandHome(*p)
+			if err != nil {
+				return err
+			}
+			*p = expanded
+		}
+		c.RegistryTLS[host] = t
+	}
+
+	for host, creds := range c.RegistryAuth {
+		expanded, err := ExpandHome(creds.TokenFile)
+		if err != nil {
+			return err
+		}
+		creds.TokenFile = expanded
+		c.RegistryAuth[host] = creds
+	}
+
+	for name, p := range c.Tools {
+		expanded, err := ExpandHome(p)
+		if err != nil {
+			return err
+		}
+		c.Tools[name] = expanded
+	}
+
+	return nil
+}
+
+// xdgDir is the XDG base directory in the environment variable env, or
+// fallback under the user's home directory if it isn't set.
+func xdgDir(env string, fallback string) (string, error) {
+	if dir := os.Getenv(env); dir != "" {
+		return dir, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(home, fallback), nil
+}
+
+// DefaultDirs returns the StackerDir, OCIDir and RootFSDir stacker uses when
+// none are configured. As root, or when the current directory already has a
+// .stacker (e.g. from stacker unpriv-setup), these are .stacker, oci and roots
+// in the current directory. Unprivileged users otherwise get them in their
+// XDG cache and data directories, since they can't always write to the
+// current one.
+func DefaultDirs() (StackerConfig, error) {
+	local := StackerConfig{
+		StackerDir: ".stacker",
+		OCIDir:     "oci",
+		RootFSDir:  "roots",
+	}
+
+	if os.Geteuid() == 0 {
+		return local, nil
+	}
+
+	if _, err := os.Stat(local.StackerDir); err == nil {
+		return local, nil
+	}
+
+	cacheHome, err := xdgDir("XDG_CACHE_HOME", ".cache")
+	if err != nil {
+		return StackerConfig{}, err
+	}
+
+	dataHome, err := xdgDir("XDG_DATA_HOME", ".local/share")
+	if err != nil {
+		return StackerConfig{}, err
+	}
+
+	return StackerConfig{
+		StackerDir: path.Join(cacheHome, "stacker"),
+		OCIDir:     path.Join(dataHome, "stacker", "oci"),
+		RootFSDir:  path.Join(dataHome, "stacker", "roots"),
+	}, nil
+}
@@ -0,0 +1,171 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-config-test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	system := path.Join(dir, "system.yaml")
+	err = ioutil.WriteFile(system, []byte(`
+stacker_dir: /system/stacker
+oci_dir: /system/oci
+registry_auth:
+  a.example.com:
+    username: a
+`), 0644)
+	if err != nil {
+		t.Fatalf("couldn't write config: %v", err)
+	}
+
+	user := path.Join(dir, "user.yaml")
+	err = ioutil.WriteFile(user, []byte(`
+oci_dir: /user/oci
+layer_type: squashfs
+registry_auth:
+  b.example.com:
+    username: b
+`), 0644)
+	if err != nil {
+		t.Fatalf("couldn't write config: %v", err)
+	}
+
+	os.Setenv("STACKER_LAYER_TYPE", "tar")
+	defer os.Unsetenv("STACKER_LAYER_TYPE")
+
+	config, err := ReadConfig([]string{system, path.Join(dir, "missing.yaml"), user})
+	if err != nil {
+		t.Fatalf("couldn't read config: %v", err)
+	}
+
+	if config.StackerDir != "/system/stacker" {
+		t.Errorf("bad stacker dir %s", config.StackerDir)
+	}
+
+	if config.OCIDir != "/user/oci" {
+		t.Errorf("user config didn't override oci dir: %s", config.OCIDir)
+	}
+
+	if config.LayerType != "tar" {
+		t.Errorf("environment didn't override layer type: %s", config.LayerType)
+	}
+
+	if config.RegistryAuth["a.example.com"].Username != "a" || config.RegistryAuth["b.example.com"].Username != "b" {
+		t.Errorf("registry auth wasn't merged: %v", config.RegistryAuth)
+	}
+}
+
+func TestApplyConfigEnvNonString(t *testing.T) {
+	config := StackerConfig{}
+	lookup := func(name string) (string, bool) {
+		return "foo", name == "STACKER_REGISTRY_MIRRORS"
+	}
+
+	if err := applyConfigEnv(&config, lookup); err == nil {
+		t.Fatalf("set a map from the environment")
+	}
+}
+
+func TestMirrorURL(t *testing.T) {
+	config := StackerConfig{
+		RegistryMirrors: map[string]string{
+			"docker.io":        "mirror:5000",
+			"quay.example.com": "quay-mirror.example.com",
+		},
+	}
+
+	for url, expected := range map[string]string{
+		"docker://centos:latest":              "docker://mirror:5000/library/centos:latest",
+		"docker://docker.io/centos:latest":    "docker://mirror:5000/library/centos:latest",
+		"docker://anuvu/stacker:latest":       "docker://mirror:5000/anuvu/stacker:latest",
+		"docker://quay.example.com/foo/bar:1": "docker://quay-mirror.example.com/foo/bar:1",
+		"docker://localhost:5000/foo:latest":  "docker://localhost:5000/foo:latest",
+		"oci:/foo/bar:latest":                 "oci:/foo/bar:latest",
+	} {
+		if actual := config.mirrorURL(url); actual != expected {
+			t.Errorf("mirror of %s is %s, expected %s", url, actual, expected)
+		}
+	}
+}
+
+func TestExpandHome(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Fatalf("couldn't get home dir: %v", err)
+	}
+
+	for p, expected := range map[string]string{
+		"~":        home,
+		"~/foo":    path.Join(home, "foo"),
+		"/foo/~":   "/foo/~",
+		"~foo/bar": "~foo/bar",
+		"relative": "relative",
+	} {
+		actual, err := ExpandHome(p)
+		if err != nil {
+			t.Fatalf("couldn't expand %s: %v", p, err)
+		}
+
+		if actual != expected {
+			t.Errorf("%s expanded to %s, expected %s", p, actual, expected)
+		}
+	}
+}
+
+func TestDefaultDirs(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root always gets the local directories")
+	}
+
+	dir, err := ioutil.TempDir("", "stacker-config-test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("couldn't get cwd: %v", err)
+	}
+	defer os.Chdir(cwd)
+
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("couldn't chdir: %v", err)
+	}
+
+	os.Setenv("XDG_CACHE_HOME", "/xdg/cache")
+	defer os.Unsetenv("XDG_CACHE_HOME")
+	os.Setenv("XDG_DATA_HOME", "/xdg/data")
+	defer os.Unsetenv("XDG_DATA_HOME")
+
+	defaults, err := DefaultDirs()
+	if err != nil {
+		t.Fatalf("couldn't get default dirs: %v", err)
+	}
+
+	if defaults.StackerDir != "/xdg/cache/stacker" || defaults.OCIDir != "/xdg/data/stacker/oci" || defaults.RootFSDir != "/xdg/data/stacker/roots" {
+		t.Errorf("bad unprivileged defaults: %+v", defaults)
+	}
+
+	// a project that was set up with unpriv-setup keeps using its own
+	if err := os.Mkdir(".stacker", 0755); err != nil {
+		t.Fatalf("couldn't create .stacker: %v", err)
+	}
+
+	defaults, err = DefaultDirs()
+	if err != nil {
+		t.Fatalf("couldn't get default dirs: %v", err)
+	}
+
+	if defaults.StackerDir != ".stacker" || defaults.OCIDir != "oci" || defaults.RootFSDir != "roots" {
+		t.Errorf("bad defaults with .stacker: %+v", defaults)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
-	"os/user"
 	"path"
 	"strings"
 	"syscall"
@@ -30,45 +29,11 @@ var (
 )
 
 func init() {
-	if os.Geteuid() != 0 {
-		currentUser, err := user.Current()
-		if err != nil {
-			return
-		}
-
-		// An error here means that this user has no subuid
-		// delegations. The only thing we can do is panic, and if we're
-		// re-execing inside a user namespace we don't want to do that.
-		// So let's just ignore the error and let future code handle it.
-		IdmapSet, _ = idmap.DefaultIdmapSet("", currentUser.Username)
-
-		if IdmapSet != nil {
-			/* Let's make our current user the root user in the ns, so that when
-			 * stacker emits files, it does them as the right user.
-			 */
-			hostMap := []idmap.IdmapEntry{
-				idmap.IdmapEntry{
-					Isuid:    true,
-					Hostid:   int64(os.Getuid()),
-					Nsid:     0,
-					Maprange: 1,
-				},
-				idmap.IdmapEntry{
-					Isgid:    true,
-					Hostid:   int64(os.Getgid()),
-					Nsid:     0,
-					Maprange: 1,
-				},
-			}
-
-			for _, hm := range hostMap {
-				err := IdmapSet.AddSafe(hm)
-				if err != nil {
-					return
-				}
-			}
-		}
-	}
+	// An error here means that this user has no subuid delegations. The
+	// only thing we can do is panic, and if we're re-execing inside a user
+	// namespace we don't want to do that. So let's just ignore the error
+	// and let future code handle it.
+	IdmapSet, _ = NewIdmapSet(StackerConfig{})
 }
 
 // our representation of a container
@@ -146,24 +111,9 @@ func newContainer(sc StackerConfig, name string) (*container, error) {
 		return nil, err
 	}
 
-	for _, k := range []string{"http_proxy", "https_proxy", "no_proxy", "TERM"} {
-		v := os.Getenv(k)
-		if v != "" {
-			err = c.setConfig("lxc.environment", fmt.Sprintf("%s=%s", k, v))
-			if err != nil {
-				return nil, err
-			}
-		}
-
-		// The proxy vars are special, because some things e.g. curl
-		// and python like lower case, while golang likes upper case.
-		k = strings.ToUpper(k)
-		v = os.Getenv(k)
-		if v != "" {
-			err = c.setConfig("lxc.environment", fmt.Sprintf("%s=%s", k, v))
-			if err != nil {
-				return nil, err
-			}
+	for _, env := range hostEnv(sc) {
+		if err := c.setConfig("lxc.environment", env); err != nil {
+			return nil, err
 		}
 	}
 
@@ -238,7 +188,7 @@ func (c *container) containerError(theErr error, msg string) error {
 	return errors.Wrapf(theErr, msg)
 }
 
-func (c *container) execute(args string, stdin io.Reader) error {
+func (c *container) execute(args string, stdin io.Reader, stdout io.Writer) error {
 	if err := c.setConfig("lxc.execute.cmd", args); err != nil {
 		return err
 	}
@@ -270,8 +220,8 @@ func (c *container) execute(args string, stdin io.Reader) error {
 	)
 
 	cmd.Stdin = stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = stdout
+	cmd.Stderr = c.sc.stderr()
 
 	// If this is non-interactive, we're going to setsid() later, so we
 	// need to make sure we capture the output somehow.
@@ -284,9 +234,9 @@ func (c *container) execute(args string, stdin io.Reader) error {
 
 		go func() {
 			defer reader.Close()
-			_, err := io.Copy(os.Stdout, reader)
+			_, err := io.Copy(stdout, reader)
 			if err != nil {
-				fmt.Println("err from stdout copy:", err)
+				warnln(c.sc, "err from stdout copy:", err)
 			}
 		}()
 
@@ -320,7 +270,7 @@ func (c *container) execute(args string, stdin io.Reader) error {
 
 				err = syscall.Kill(c.c.InitPid(), sg.(syscall.Signal))
 				if err != nil {
-					fmt.Println("failed to send signal", sg, err)
+					warnln(c.sc, "failed to send signal", sg, err)
 				}
 			}
 		}
@@ -332,6 +282,17 @@ func (c *container) execute(args string, stdin io.Reader) error {
 	return c.containerError(cmdErr, "execute failed")
 }
 
+// kill kills what's running in the container, which may be being run by
+// another container for the same lxc container.
+func (c *container) kill() error {
+	pid := c.c.InitPid()
+	if pid <= 0 {
+		return nil
+	}
+
+	return syscall.Kill(pid, syscall.SIGKILL)
+}
+
 func (c *container) Close() {
 	c.c.Release()
 }
@@ -0,0 +1,148 @@
+package stacker
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// CopyFrom is a file or directory copied into a layer's rootfs from the rootfs
+// of a layer that has already been built.
+type CopyFrom struct {
+	Layer string `yaml:"layer"`
+	Path  string `yaml:"path"`
+	Dest  string `yaml:"dest"`
+}
+
+// ParseCopyFrom returns what the layer copies from other layers. copy_from is
+// either one of them:
+//
+//	copy_from: {layer: builder, path: /out/binary, dest: /usr/bin/app}
+//
+// or a list of them. dest defaults to path.
+func (l *Layer) ParseCopyFrom() ([]CopyFrom, error) {
+	if l.CopyFrom == nil {
+		return nil, nil
+	}
+
+	// this is how it is after layers are merged
+	if copies, ok := l.CopyFrom.([]CopyFrom); ok {
+		return copies, nil
+	}
+
+	// the yaml decoder gives us maps, so let it do the work of turning
+	// them into CopyFroms
+	content, err := yaml.Marshal(l.CopyFrom)
+	if err != nil {
+		return nil, err
+	}
+
+	copies := []CopyFrom{}
+	if _, ok := l.CopyFrom.([]interface{}); ok {
+		err = yaml.UnmarshalStrict(content, &copies)
+	} else {
+		c := CopyFrom{}
+		err = yaml.UnmarshalStrict(content, &c)
+		copies = append(copies, c)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid copy_from")
+	}
+
+	for i, c := range copies {
+		if c.Layer == "" {
+			return nil, fmt.Errorf("invalid copy_from of %s: no layer", c.Path)
+		}
+
+		if !path.IsAbs(c.Path) {
+			return nil, fmt.Errorf("invalid copy_from of %s from %s: the path must be absolute", c.Path, c.Layer)
+		}
+
+		if c.Dest == "" {
+			copies[i].Dest = c.Path
+		} else if !path.IsAbs(c.Dest) {
+			return nil, fmt.Errorf("invalid copy_from of %s from %s: the dest must be absolute", c.Path, c.Layer)
+		}
+	}
+
+	return copies, nil
+}
+
+// copyFromLayers returns the names of the layers l copies from.
+func (l *Layer) copyFromLayers() ([]string, error) {
+	copies, err := l.ParseCopyFrom()
+	if err != nil {
+		return nil, err
+	}
+
+	layers := []string{}
+	for _, c := range copies {
+		layers = appendUnique(layers, c.Layer)
+	}
+
+	return layers, nil
+}
+
+// CopyFromLayers copies what l copies from other layers into the rootfs of
+// the working container. Like cp, a dest that ends in / or is an existing
+// directory gets the copy put in it.
+func CopyFromLayers(config StackerConfig, l *Layer) error {
+	copies, err := l.ParseCopyFrom()
+	if err != nil {
+		return err
+	}
+
+	rootfs := path.Join(config.RootFSDir, config.WorkingContainer(), "rootfs")
+	for _, c := range copies {
+		fromRootfs := path.Join(config.RootFSDir, c.Layer, "rootfs")
+		if _, err := os.Stat(fromRootfs); err != nil {
+			return errors.Wrapf(err, "can't copy from %s, it hasn't been built", c.Layer)
+		}
+
+		// neither rootfs' symlinks may lead outside of it
+		source, err := securejoin.SecureJoin(fromRootfs, c.Path)
+		if err != nil {
+			return err
+		}
+
+		if _, err := os.Lstat(source); err != nil {
+			return errors.Wrapf(err, "couldn't find %s in %s", c.Path, c.Layer)
+		}
+
+		dest, err := securejoin.SecureJoin(rootfs, c.Dest)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(c.Dest, "/") {
+			dest += "/"
+		}
+
+		infof(config, "copying %s from %s to %s\n", c.Path, c.Layer, c.Dest)
+
+		// the copies keep their owners, so do them in the user
+		// namespace when unprivileged
+		msg := fmt.Sprintf("couldn't copy %s from %s", c.Path, c.Layer)
+		if err := MaybeRunInUserns([]string{"mkdir", "-p", destDir(dest)}, msg); err != nil {
+			return err
+		}
+
+		if err := MaybeRunInUserns([]string{"cp", "-a", source, dest}, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// destDir is the directory that has to exist to cp something to dest.
+func destDir(dest string) string {
+	if strings.HasSuffix(dest, "/") {
+		return dest
+	}
+	return path.Dir(dest)
+}
@@ -0,0 +1,85 @@
+package stacker
+
+import (
+	"testing"
+)
+
+func TestParseCopyFrom(t *testing.T) {
+	content := `builder:
+    from:
+        type: docker
+        url: docker://centos:latest
+    build_only: true
+app:
+    from:
+        type: docker
+        url: docker://centos:latest
+    copy_from: {layer: builder, path: /out/binary, dest: /usr/bin/app}
+both:
+    from:
+        type: docker
+        url: docker://centos:latest
+    copy_from:
+        - layer: builder
+          path: /out/binary
+        - layer: app
+          path: /etc/app/
+          dest: /etc/
+`
+	sf := parse(t, content)
+
+	app, _ := sf.Get("app")
+	copies, err := app.ParseCopyFrom()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(copies) != 1 || copies[0] != (CopyFrom{Layer: "builder", Path: "/out/binary", Dest: "/usr/bin/app"}) {
+		t.Fatalf("bad copies: %v", copies)
+	}
+
+	both, _ := sf.Get("both")
+	copies, err = both.ParseCopyFrom()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(copies) != 2 || copies[0].Dest != "/out/binary" || copies[1].Layer != "app" || copies[1].Dest != "/etc/" {
+		t.Fatalf("bad copies: %v", copies)
+	}
+
+	for _, bad := range []interface{}{
+		map[interface{}]interface{}{"path": "/out/binary"},
+		map[interface{}]interface{}{"layer": "builder", "path": "out/binary"},
+		map[interface{}]interface{}{"layer": "builder", "path": "/out/binary", "dest": "usr/bin/app"},
+		map[interface{}]interface{}{"layer": "builder", "path": "/out/binary", "mode": "0755"},
+	} {
+		l := &Layer{CopyFrom: bad}
+		if _, err := l.ParseCopyFrom(); err == nil {
+			t.Errorf("parsed bad copy_from %v", bad)
+		}
+	}
+}
+
+func TestCopyFromDependencyOrder(t *testing.T) {
+	content := `app:
+    from:
+        type: docker
+        url: docker://centos:latest
+    copy_from: {layer: builder, path: /out/binary}
+builder:
+    from:
+        type: docker
+        url: docker://centos:latest
+    build_only: true
+`
+	sf := parse(t, content)
+	do, err := sf.DependencyOrder()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(do) != 2 || do[0] != "builder" || do[1] != "app" {
+		t.Fatalf("bad do: %v", do)
+	}
+}
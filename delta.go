@@ -0,0 +1,708 @@
+package stacker
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/anuvu/stacker/lib"
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/dustin/go-humanize"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DeltaConfigMediaType is the media type of the config of the OCI
+	// artifacts MakeDelta makes, which is a DeltaConfig.
+	DeltaConfigMediaType = "application/vnd.stacker.delta.config.v1+json"
+
+	// DeltaLayerMediaType is the media type of the layers of a delta
+	// artifact that are a gzipped binary delta of a layer of the image the
+	// delta is to against a layer of the image it's from.
+	DeltaLayerMediaType = "application/vnd.stacker.delta.v1+gzip"
+
+	// DeltaTargetAnnotation is set on the layers of a delta artifact to
+	// the digest of the layer they make.
+	DeltaTargetAnnotation = DefaultAnnotationPrefix + ".delta_target"
+
+	// DeltaBaseAnnotation is set on the binary delta layers of a delta
+	// artifact to the digest of the layer they're a delta against.
+	DeltaBaseAnnotation = DefaultAnnotationPrefix + ".delta_base"
+)
+
+// DeltaConfig is what a delta artifact needs to make the image it's to, other
+// than its layers.
+type DeltaConfig struct {
+	// From is the digest of the manifest of the image the delta is from,
+	// which has to be there to apply it.
+	From digest.Digest `json:"from"`
+
+	// To is the descriptor of the manifest of the image the delta makes,
+	// and Manifest and Config are that manifest and its config.
+	To       ispec.Descriptor `json:"to"`
+	Manifest []byte           `json:"manifest"`
+	Config   []byte           `json:"config"`
+}
+
+const (
+	// deltaBlockSize is the size of the blocks of the old blob that the
+	// new one is looked for in.
+	deltaBlockSize = 4096
+
+	// deltaMaxLiteral is the most new data that goes in one op.
+	deltaMaxLiteral = 1 << 20
+
+	deltaMagic = "stacker-delta-v1\n"
+
+	deltaOpCopy    = 'c'
+	deltaOpLiteral = 'l'
+	deltaOpEnd     = 'e'
+)
+
+// rollingSum is rsync's rolling checksum of a block, which can be moved along
+// one byte at a time.
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingSum(block []byte) rollingSum {
+	s := rollingSum{n: uint32(len(block))}
+	for i, c := range block {
+		s.a += uint32(c)
+		s.b += uint32(len(block)-i) * uint32(c)
+	}
+	return s
+}
+
+// roll moves the block the sum is of along by one byte: out is no longer in
+// it, and in is.
+func (s *rollingSum) roll(out byte, in byte) {
+	s.a = s.a - uint32(out) + uint32(in)
+	s.b = s.b - s.n*uint32(out) + s.a
+}
+
+func (s rollingSum) sum() uint32 {
+	return (s.a & 0xffff) | (s.b << 16)
+}
+
+type deltaBlock struct {
+	offset int64
+	strong [sha256.Size]byte
+}
+
+// deltaWriter writes the ops of a delta.
+type deltaWriter struct {
+	w       *bufio.Writer
+	literal []byte
+
+	// the copy being built up, while consecutive blocks match
+	copyOffset int64
+	copyLen    int64
+}
+
+func (dw *deltaWriter) uvarint(v uint64) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	_, err := dw.w.Write(buf[:binary.PutUvarint(buf, v)])
+	return err
+}
+
+func (dw *deltaWriter) flushLiteral() error {
+	if len(dw.literal) == 0 {
+		return nil
+	}
+
+	if err := dw.w.WriteByte(deltaOpLiteral); err != nil {
+		return err
+	}
+	if err := dw.uvarint(uint64(len(dw.literal))); err != nil {
+		return err
+	}
+	if _, err := dw.w.Write(dw.literal); err != nil {
+		return err
+	}
+
+	dw.literal = dw.literal[:0]
+	return nil
+}
+
+func (dw *deltaWriter) flushCopy() error {
+	if dw.copyLen == 0 {
+		return nil
+	}
+
+	if err := dw.w.WriteByte(deltaOpCopy); err != nil {
+		return err
+	}
+	if err := dw.uvarint(uint64(dw.copyOffset)); err != nil {
+		return err
+	}
+	if err := dw.uvarint(uint64(dw.copyLen)); err != nil {
+		return err
+	}
+
+	dw.copyLen = 0
+	return nil
+}
+
+func (dw *deltaWriter) addLiteral(b ...byte) error {
+	if err := dw.flushCopy(); err != nil {
+		return err
+	}
+
+	dw.literal = append(dw.literal, b...)
+	if len(dw.literal) >= deltaMaxLiteral {
+		return dw.flushLiteral()
+	}
+	return nil
+}
+
+func (dw *deltaWriter) addCopy(offset int64, length int64) error {
+	if err := dw.flushLiteral(); err != nil {
+		return err
+	}
+
+	if dw.copyLen > 0 && dw.copyOffset+dw.copyLen == offset {
+		dw.copyLen += length
+		return nil
+	}
+
+	if err := dw.flushCopy(); err != nil {
+		return err
+	}
+
+	dw.copyOffset = offset
+	dw.copyLen = length
+	return nil
+}
+
+// indexDeltaBlocks returns the blocks of old by their rolling checksum.
+func indexDeltaBlocks(old io.Reader) (map[uint32][]deltaBlock, error) {
+	blocks := map[uint32][]deltaBlock{}
+	block := make([]byte, deltaBlockSize)
+	for offset := int64(0); ; offset += deltaBlockSize {
+		n, err := io.ReadFull(old, block)
+		if n == deltaBlockSize {
+			sum := newRollingSum(block).sum()
+			blocks[sum] = append(blocks[sum], deltaBlock{offset: offset, strong: sha256.Sum256(block)})
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// writeDelta writes a delta of new against old to w, which applyDelta makes
+// new out of again given old: the data of new that's in a block of old is a
+// copy of it, and the rest is in the delta itself.
+func writeDelta(old io.Reader, new io.Reader, w io.Writer) error {
+	blocks, err := indexDeltaBlocks(old)
+	if err != nil {
+		return err
+	}
+
+	dw := &deltaWriter{w: bufio.NewWriter(w)}
+	if _, err := dw.w.WriteString(deltaMagic); err != nil {
+		return err
+	}
+
+	in := bufio.NewReaderSize(new, 1<<20)
+
+	// fill reads the next block of new into window, and says whether it
+	// got a whole one.
+	window := []byte{}
+	fill := func() (bool, error) {
+		window = make([]byte, deltaBlockSize)
+		n, err := io.ReadFull(in, window)
+		window = window[:n]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	match := func(sum rollingSum) (int64, bool) {
+		candidates, ok := blocks[sum.sum()]
+		if !ok {
+			return 0, false
+		}
+
+		strong := sha256.Sum256(window)
+		for _, c := range candidates {
+			if c.strong == strong {
+				return c.offset, true
+			}
+		}
+		return 0, false
+	}
+
+	full, err := fill()
+	for err == nil && full {
+		sum := newRollingSum(window)
+		for {
+			if offset, ok := match(sum); ok {
+				err = dw.addCopy(offset, deltaBlockSize)
+				if err == nil {
+					full, err = fill()
+				}
+				break
+			}
+
+			var c byte
+			c, err = in.ReadByte()
+			if err == io.EOF {
+				full, err = false, nil
+				break
+			}
+			if err != nil {
+				break
+			}
+
+			if err = dw.addLiteral(window[0]); err != nil {
+				break
+			}
+			sum.roll(window[0], c)
+			window = append(window[1:], c)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// what's left is too short to be a block
+	if err := dw.addLiteral(window...); err != nil {
+		return err
+	}
+	if err := dw.flushLiteral(); err != nil {
+		return err
+	}
+	if err := dw.flushCopy(); err != nil {
+		return err
+	}
+	if err := dw.w.WriteByte(deltaOpEnd); err != nil {
+		return err
+	}
+
+	return dw.w.Flush()
+}
+
+// applyDelta writes what the delta d that writeDelta made against old makes
+// to w.
+func applyDelta(old io.ReaderAt, d io.Reader, w io.Writer) error {
+	r := bufio.NewReader(d)
+
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != deltaMagic {
+		return fmt.Errorf("not a stacker delta")
+	}
+
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return errors.Wrapf(err, "truncated delta")
+		}
+
+		switch op {
+		case deltaOpEnd:
+			return nil
+		case deltaOpCopy:
+			offset, err := binary.ReadUvarint(r)
+			if err != nil {
+				return errors.Wrapf(err, "bad delta copy")
+			}
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return errors.Wrapf(err, "bad delta copy")
+			}
+
+			n, err := io.Copy(w, io.NewSectionReader(old, int64(offset), int64(length)))
+			if err != nil {
+				return err
+			}
+			if n != int64(length) {
+				return fmt.Errorf("delta copies past the end of what it's against")
+			}
+		case deltaOpLiteral:
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return errors.Wrapf(err, "bad delta literal")
+			}
+
+			n, err := io.CopyN(w, r, int64(length))
+			if err != nil {
+				return errors.Wrapf(err, "truncated delta literal, got %d of %d bytes", n, length)
+			}
+		default:
+			return fmt.Errorf("bad delta op %q", op)
+		}
+	}
+}
+
+func blobPath(layout string, d digest.Digest) string {
+	return path.Join(layout, "blobs", d.Algorithm().String(), d.Encoded())
+}
+
+// deltaBase returns the layer of from to make a delta of the layer i of to
+// against: the one in the same place, if they have the same media type, or
+// else the last one that does.
+func deltaBase(from []ispec.Descriptor, to []ispec.Descriptor, i int) (ispec.Descriptor, bool) {
+	if i < len(from) && from[i].MediaType == to[i].MediaType {
+		return from[i], true
+	}
+
+	for j := len(from) - 1; j >= 0; j-- {
+		if from[j].MediaType == to[i].MediaType {
+			return from[j], true
+		}
+	}
+
+	return ispec.Descriptor{}, false
+}
+
+// putDeltaLayer puts a gzipped delta of the blob target against base into
+// oci, and returns its descriptor.
+func putDeltaLayer(oci casext.Engine, layout string, base ispec.Descriptor, target ispec.Descriptor) (ispec.Descriptor, error) {
+	old, err := os.Open(blobPath(layout, base.Digest))
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	defer old.Close()
+
+	new, err := os.Open(blobPath(layout, target.Digest))
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	defer new.Close()
+
+	reader, writer := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(writer)
+		err := writeDelta(old, new, gz)
+		if err == nil {
+			err = gz.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	d, size, err := oci.PutBlob(context.Background(), reader)
+	reader.Close()
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "couldn't make delta of %s", target.Digest)
+	}
+
+	return ispec.Descriptor{
+		MediaType: DeltaLayerMediaType,
+		Digest:    d,
+		Size:      size,
+		Annotations: map[string]string{
+			DeltaTargetAnnotation: target.Digest.String(),
+			DeltaBaseAnnotation:   base.Digest.String(),
+		},
+	}, nil
+}
+
+// resolveManifest returns the descriptor of the manifest tag refers to.
+func resolveManifest(oci casext.Engine, tag string) (ispec.Descriptor, error) {
+	descs, err := oci.ResolveReference(context.Background(), tag)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	if len(descs) != 1 {
+		return ispec.Descriptor{}, fmt.Errorf("%s resolves to %d manifests", tag, len(descs))
+	}
+
+	return descs[0].Descriptor(), nil
+}
+
+func readBlob(oci casext.Engine, d digest.Digest) ([]byte, error) {
+	r, err := oci.GetBlob(context.Background(), d)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// MakeDelta makes an OCI artifact tagged deltaTag in the output that has just
+// what's needed to make the image to out of the image from, e.g. to update
+// a device that has from without it pulling the whole of to: the layers of
+// to that from doesn't have, each as a binary delta against a layer of from
+// when that's smaller. ApplyDelta makes to out of it. It works best with
+// squashfs layers, since a small change to a gzipped tar layer changes
+// most of its compressed stream.
+func MakeDelta(config StackerConfig, from string, to string, deltaTag string) error {
+	lock, err := LockOCIDir(config)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	oci, err := umoci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	fromDesc, err := resolveManifest(oci, from)
+	if err != nil {
+		return err
+	}
+
+	fromManifest, err := stackeroci.LookupManifest(oci, from)
+	if err != nil {
+		return err
+	}
+
+	toDesc, err := resolveManifest(oci, to)
+	if err != nil {
+		return err
+	}
+
+	toManifest, err := stackeroci.LookupManifest(oci, to)
+	if err != nil {
+		return err
+	}
+
+	deltaConfig := DeltaConfig{From: fromDesc.Digest, To: toDesc}
+	deltaConfig.Manifest, err = readBlob(oci, toDesc.Digest)
+	if err != nil {
+		return err
+	}
+	deltaConfig.Config, err = readBlob(oci, toManifest.Config.Digest)
+	if err != nil {
+		return err
+	}
+
+	have := map[digest.Digest]bool{}
+	for _, l := range fromManifest.Layers {
+		have[l.Digest] = true
+	}
+
+	layers := []ispec.Descriptor{}
+	var deltaSize, fullSize int64
+	for i, l := range toManifest.Layers {
+		if have[l.Digest] {
+			continue
+		}
+
+		layer := l
+		if base, ok := deltaBase(fromManifest.Layers, toManifest.Layers, i); ok {
+			delta, err := putDeltaLayer(oci, config.OCIDir, base, l)
+			if err != nil {
+				return err
+			}
+
+			if delta.Size < l.Size {
+				layer = delta
+			}
+		}
+
+		if layer.MediaType != DeltaLayerMediaType {
+			layer.Annotations = map[string]string{DeltaTargetAnnotation: l.Digest.String()}
+		}
+
+		layers = append(layers, layer)
+		deltaSize += layer.Size
+		fullSize += l.Size
+	}
+
+	configDigest, configSize, err := oci.PutBlobJSON(context.Background(), deltaConfig)
+	if err != nil {
+		return err
+	}
+
+	manifest := ispec.Manifest{
+		Config: ispec.Descriptor{
+			MediaType: DeltaConfigMediaType,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layers,
+	}
+	manifest.SchemaVersion = 2
+
+	manifestDigest, manifestSize, err := oci.PutBlobJSON(context.Background(), manifest)
+	if err != nil {
+		return err
+	}
+
+	err = oci.UpdateReference(context.Background(), deltaTag, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	})
+	if err != nil {
+		return err
+	}
+
+	infof(config, "delta %s from %s to %s is %s, the layers it makes are %s\n", deltaTag, from, to,
+		humanize.Bytes(uint64(deltaSize)), humanize.Bytes(uint64(fullSize)))
+	return nil
+}
+
+// applyDeltaLayer puts the layer the delta layer l makes into oci.
+func applyDeltaLayer(oci casext.Engine, layout string, l ispec.Descriptor) error {
+	target, err := digest.Parse(l.Annotations[DeltaTargetAnnotation])
+	if err != nil {
+		return errors.Wrapf(err, "bad delta layer %s", l.Digest)
+	}
+
+	if l.MediaType != DeltaLayerMediaType {
+		if l.Digest != target {
+			return fmt.Errorf("bad delta layer %s, it's for %s", l.Digest, target)
+		}
+		// it's the layer itself, which has been pulled with the delta
+		return nil
+	}
+
+	base, err := digest.Parse(l.Annotations[DeltaBaseAnnotation])
+	if err != nil {
+		return errors.Wrapf(err, "bad delta layer %s", l.Digest)
+	}
+
+	old, err := os.Open(blobPath(layout, base))
+	if err != nil {
+		return errors.Wrapf(err, "the delta needs layer %s", base)
+	}
+	defer old.Close()
+
+	d, err := oci.GetBlob(context.Background(), l.Digest)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	gz, err := gzip.NewReader(d)
+	if err != nil {
+		return errors.Wrapf(err, "bad delta layer %s", l.Digest)
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(applyDelta(old, gz, writer))
+	}()
+
+	made, _, err := oci.PutBlob(context.Background(), reader)
+	reader.Close()
+	if err != nil {
+		return errors.Wrapf(err, "couldn't apply delta layer %s", l.Digest)
+	}
+
+	if made != target {
+		return fmt.Errorf("delta layer %s made %s instead of %s", l.Digest, made, target)
+	}
+
+	return nil
+}
+
+// ApplyDelta makes the image the delta artifact deltaTag in the output (that
+// MakeDelta made) is to, out of the image it's from, which has to be in the
+// output too, and tags it tag.
+func ApplyDelta(config StackerConfig, deltaTag string, tag string) error {
+	lock, err := LockOCIDir(config)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	oci, err := umoci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	manifest, err := stackeroci.LookupManifest(oci, deltaTag)
+	if err != nil {
+		return err
+	}
+
+	if manifest.Config.MediaType != DeltaConfigMediaType {
+		return fmt.Errorf("%s isn't a delta, its config is %s", deltaTag, manifest.Config.MediaType)
+	}
+
+	content, err := readBlob(oci, manifest.Config.Digest)
+	if err != nil {
+		return err
+	}
+
+	deltaConfig := DeltaConfig{}
+	if err := json.Unmarshal(content, &deltaConfig); err != nil {
+		return errors.Wrapf(err, "bad delta config")
+	}
+
+	if _, err := os.Stat(blobPath(config.OCIDir, deltaConfig.From)); err != nil {
+		return errors.Wrapf(err, "the delta is from %s, which isn't here", deltaConfig.From)
+	}
+
+	for _, l := range manifest.Layers {
+		if err := applyDeltaLayer(oci, config.OCIDir, l); err != nil {
+			return err
+		}
+	}
+
+	toManifest := ispec.Manifest{}
+	if err := json.Unmarshal(deltaConfig.Manifest, &toManifest); err != nil {
+		return errors.Wrapf(err, "bad manifest in delta")
+	}
+
+	for _, blob := range []struct {
+		content []byte
+		want    digest.Digest
+	}{
+		{deltaConfig.Config, toManifest.Config.Digest},
+		{deltaConfig.Manifest, deltaConfig.To.Digest},
+	} {
+		d, _, err := oci.PutBlob(context.Background(), bytes.NewReader(blob.content))
+		if err != nil {
+			return err
+		}
+
+		if d != blob.want {
+			return fmt.Errorf("delta has %s instead of %s", d, blob.want)
+		}
+	}
+
+	for _, l := range toManifest.Layers {
+		if _, err := os.Stat(blobPath(config.OCIDir, l.Digest)); err != nil {
+			return errors.Wrapf(err, "the delta didn't make layer %s", l.Digest)
+		}
+	}
+
+	return oci.UpdateReference(context.Background(), tag, deltaConfig.To)
+}
+
+// PushDelta pushes the delta artifact deltaTag in the output to url, e.g.
+// docker://registry.example.com/image:delta.
+func PushDelta(config StackerConfig, deltaTag string, url string) error {
+	tls, err := config.registryTLS(url)
+	if err != nil {
+		return err
+	}
+
+	return imageCopy(config, lib.ImageCopyOpts{
+		Src:      fmt.Sprintf("oci:%s:%s", config.OCIDir, deltaTag),
+		Dest:     url,
+		Progress: progressOutput(config),
+		SkipTLS:  true,
+		DestTLS:  tls,
+	}, config.RegistryAuth)
+}
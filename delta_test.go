@@ -0,0 +1,83 @@
+package stacker
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func deltaRoundTrip(t *testing.T, old []byte, new []byte) []byte {
+	delta := bytes.Buffer{}
+	if err := writeDelta(bytes.NewReader(old), bytes.NewReader(new), &delta); err != nil {
+		t.Fatalf("couldn't make delta: %v", err)
+	}
+
+	made := bytes.Buffer{}
+	if err := applyDelta(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), &made); err != nil {
+		t.Fatalf("couldn't apply delta: %v", err)
+	}
+
+	if !bytes.Equal(made.Bytes(), new) {
+		t.Fatalf("delta made %d bytes that aren't the %d it should have", made.Len(), len(new))
+	}
+
+	return delta.Bytes()
+}
+
+func TestDelta(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	old := make([]byte, 64*deltaBlockSize+123)
+	r.Read(old)
+
+	// something inserted and something changed
+	new := append([]byte{}, old[:10*deltaBlockSize+7]...)
+	new = append(new, []byte("inserted")...)
+	new = append(new, old[10*deltaBlockSize+7:]...)
+	new[40*deltaBlockSize] ^= 0xff
+
+	delta := deltaRoundTrip(t, old, new)
+	if len(delta) > 4*deltaBlockSize {
+		t.Errorf("delta of a small change is %d bytes", len(delta))
+	}
+
+	deltaRoundTrip(t, old, old)
+	deltaRoundTrip(t, old, []byte{})
+	deltaRoundTrip(t, []byte{}, old)
+	deltaRoundTrip(t, old, []byte("short"))
+}
+
+func TestApplyBadDelta(t *testing.T) {
+	made := bytes.Buffer{}
+	if err := applyDelta(bytes.NewReader(nil), bytes.NewReader([]byte("nope")), &made); err == nil {
+		t.Fatalf("applied something that isn't a delta")
+	}
+
+	truncated := []byte(deltaMagic + string([]byte{deltaOpLiteral, 10, 'a'}))
+	if err := applyDelta(bytes.NewReader(nil), bytes.NewReader(truncated), &made); err == nil {
+		t.Fatalf("applied a truncated delta")
+	}
+
+	past := []byte(deltaMagic + string([]byte{deltaOpCopy, 0, 10, deltaOpEnd}))
+	if err := applyDelta(bytes.NewReader([]byte("abc")), bytes.NewReader(past), &made); err == nil {
+		t.Fatalf("applied a delta that copies past the end")
+	}
+}
+
+func TestDeltaBase(t *testing.T) {
+	from := []ispec.Descriptor{{MediaType: "a", Size: 1}, {MediaType: "b", Size: 2}}
+	to := []ispec.Descriptor{{MediaType: "a"}, {MediaType: "a"}, {MediaType: "c"}}
+
+	if base, ok := deltaBase(from, to, 0); !ok || base.Size != 1 {
+		t.Errorf("bad base for the first layer: %v", base)
+	}
+
+	if base, ok := deltaBase(from, to, 1); !ok || base.Size != 1 {
+		t.Errorf("bad base for the second layer: %v", base)
+	}
+
+	if _, ok := deltaBase(from, to, 2); ok {
+		t.Errorf("got a base for a layer of a different type")
+	}
+}
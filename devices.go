@@ -0,0 +1,105 @@
+package stacker
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// hostDevice is a device node on the host that's passed through to layers'
+// commands.
+type hostDevice struct {
+	path string
+
+	// kind is "c" for character devices, or "b" for block devices
+	kind  string
+	major int64
+	minor int64
+}
+
+// lookupDevice finds the host's device node p.
+func lookupDevice(p string) (hostDevice, error) {
+	if path.Clean(p) != p || !strings.HasPrefix(p, "/dev/") {
+		return hostDevice{}, errors.Errorf("device %s isn't in /dev", p)
+	}
+
+	var st unix.Stat_t
+	if err := unix.Stat(p, &st); err != nil {
+		return hostDevice{}, errors.Wrapf(err, "couldn't find device %s", p)
+	}
+
+	d := hostDevice{
+		path:  p,
+		major: int64(unix.Major(uint64(st.Rdev))),
+		minor: int64(unix.Minor(uint64(st.Rdev))),
+	}
+
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFCHR:
+		d.kind = "c"
+	case unix.S_IFBLK:
+		d.kind = "b"
+	default:
+		return hostDevice{}, errors.Errorf("%s isn't a device", p)
+	}
+
+	return d, nil
+}
+
+// ParseDevices returns the host's device nodes that the layer's commands can
+// use.
+func (l *Layer) ParseDevices() ([]hostDevice, error) {
+	devices := []hostDevice{}
+	for _, p := range l.Devices {
+		d, err := lookupDevice(p)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+
+	return devices, nil
+}
+
+// addDevice bind mounts d into the container. Its /dev is a tmpfs, so the
+// device never ends up in the rootfs (or the layer).
+func (c *container) addDevice(d hostDevice) error {
+	if IdmapSet == nil {
+		rule := fmt.Sprintf("%s %d:%d rwm", d.kind, d.major, d.minor)
+		if err := c.setConfig("lxc.cgroup.devices.allow", rule); err != nil {
+			return err
+		}
+	}
+
+	return c.bindMount(d.path, d.path, "")
+}
+
+func (c *ociContainer) addDevice(d hostDevice) error {
+	// unprivileged runtimes can't make device nodes, so bind mount
+	// everything
+	if err := c.bindMount(d.path, d.path, ""); err != nil {
+		return err
+	}
+
+	// and they can't change the devices cgroup either
+	if IdmapSet != nil {
+		return nil
+	}
+
+	if c.spec.Linux.Resources == nil {
+		c.spec.Linux.Resources = &rspec.LinuxResources{}
+	}
+
+	c.spec.Linux.Resources.Devices = append(c.spec.Linux.Resources.Devices, rspec.LinuxDeviceCgroup{
+		Allow:  true,
+		Type:   d.kind,
+		Major:  &d.major,
+		Minor:  &d.minor,
+		Access: "rwm",
+	})
+	return nil
+}
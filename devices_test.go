@@ -0,0 +1,22 @@
+package stacker
+
+import (
+	"testing"
+)
+
+func TestLookupDevice(t *testing.T) {
+	d, err := lookupDevice("/dev/null")
+	if err != nil {
+		t.Fatalf("couldn't find /dev/null: %v", err)
+	}
+
+	if d.kind != "c" || d.major != 1 || d.minor != 3 {
+		t.Errorf("bad device: %v", d)
+	}
+
+	for _, bad := range []string{"/etc/passwd", "/dev/../etc/passwd", "/dev/stacker-no-such-device", "/dev"} {
+		if _, err := lookupDevice(bad); err == nil {
+			t.Errorf("passed through %s", bad)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package stacker
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+)
+
+const (
+	FileAdded    = "added"
+	FileRemoved  = "removed"
+	FileModified = "modified"
+)
+
+// Like mtreeKeywords, we explicitly don't use mtime, since it changes on
+// every rebuild and is not interesting when auditing two images.
+var diffKeywords = []mtree.Keyword{"type", "link", "uid", "gid", "xattr", "mode", "size", "sha256digest"}
+
+// FileDiff is a single filesystem difference between two images.
+type FileDiff struct {
+	Path    string `json:"path"`
+	Type    string `json:"type"`
+	OldSize int64  `json:"old_size"`
+	NewSize int64  `json:"new_size"`
+}
+
+// ConfigDiff is the difference in a set of KEY=VALUE style image config
+// entries (env or labels) between two images.
+type ConfigDiff struct {
+	Added    map[string]string `json:"added,omitempty"`
+	Removed  map[string]string `json:"removed,omitempty"`
+	Modified map[string]string `json:"modified,omitempty"`
+}
+
+func (cd ConfigDiff) Empty() bool {
+	return len(cd.Added) == 0 && len(cd.Removed) == 0 && len(cd.Modified) == 0
+}
+
+// ImageDiff is the result of comparing two built tags.
+type ImageDiff struct {
+	From   string     `json:"from"`
+	To     string     `json:"to"`
+	Files  []FileDiff `json:"files"`
+	Env    ConfigDiff `json:"env"`
+	Labels ConfigDiff `json:"labels"`
+}
+
+// Diff compares the images tagA and tagB. The filesystem comparison is done
+// against the snapshots in config.RootFSDir, so both tags must have been
+// built (or unladen) on this machine and the storage must be attached; the
+// config comparison is done against config.OCIDir.
+func Diff(config StackerConfig, tagA string, tagB string) (*ImageDiff, error) {
+	result := &ImageDiff{From: tagA, To: tagB, Files: []FileDiff{}}
+
+	dhs := []*mtree.DirectoryHierarchy{}
+	for _, tag := range []string{tagA, tagB} {
+		rootfs := path.Join(config.RootFSDir, tag, "rootfs")
+		dh, err := mtree.Walk(rootfs, nil, diffKeywords, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't walk %s, was it built on this machine?", tag)
+		}
+		dhs = append(dhs, dh)
+	}
+
+	deltas, err := mtree.Compare(dhs[0], dhs[1], diffKeywords)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range deltas {
+		fd := FileDiff{Path: d.Path()}
+		switch d.Type() {
+		case mtree.Extra:
+			fd.Type = FileAdded
+		case mtree.Missing:
+			fd.Type = FileRemoved
+		case mtree.Modified:
+			fd.Type = FileModified
+		default:
+			return nil, errors.Errorf("failed to diff %s", d.Path())
+		}
+
+		if d.Old() != nil {
+			fd.OldSize = entrySize(d.Old())
+		}
+		if d.New() != nil {
+			fd.NewSize = entrySize(d.New())
+		}
+
+		result.Files = append(result.Files, fd)
+	}
+
+	sort.Slice(result.Files, func(i, j int) bool {
+		return result.Files[i].Path < result.Files[j].Path
+	})
+
+	oci, err := umoci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return nil, err
+	}
+	defer oci.Close()
+
+	configA, err := lookupImageConfig(oci, tagA)
+	if err != nil {
+		return nil, err
+	}
+
+	configB, err := lookupImageConfig(oci, tagB)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Env = diffConfigMaps(envMap(configA.Config.Env), envMap(configB.Config.Env))
+	result.Labels = diffConfigMaps(configA.Config.Labels, configB.Config.Labels)
+
+	return result, nil
+}
+
+func lookupImageConfig(oci casext.Engine, tag string) (ispec.Image, error) {
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return ispec.Image{}, err
+	}
+
+	return stackeroci.LookupConfig(oci, manifest.Config)
+}
+
+func entrySize(e *mtree.Entry) int64 {
+	kvs := mtree.HasKeyword(e.AllKeys(), "size")
+	if len(kvs) == 0 {
+		return 0
+	}
+
+	size, err := strconv.ParseInt(kvs[0].Value(), 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return size
+}
+
+func envMap(env []string) map[string]string {
+	ret := map[string]string{}
+	for _, e := range env {
+		membs := strings.SplitN(e, "=", 2)
+		if len(membs) != 2 {
+			ret[membs[0]] = ""
+			continue
+		}
+		ret[membs[0]] = membs[1]
+	}
+	return ret
+}
+
+func diffConfigMaps(a map[string]string, b map[string]string) ConfigDiff {
+	cd := ConfigDiff{
+		Added:    map[string]string{},
+		Removed:  map[string]string{},
+		Modified: map[string]string{},
+	}
+
+	for k, v := range a {
+		newV, ok := b[k]
+		if !ok {
+			cd.Removed[k] = v
+		} else if newV != v {
+			cd.Modified[k] = fmt.Sprintf("%s -> %s", v, newV)
+		}
+	}
+
+	for k, v := range b {
+		if _, ok := a[k]; !ok {
+			cd.Added[k] = v
+		}
+	}
+
+	return cd
+}
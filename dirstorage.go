@@ -0,0 +1,84 @@
+package stacker
+
+import (
+	"os"
+	"path"
+)
+
+// dirStorage keeps each container as a plain directory in RootFSDir, and
+// snapshots and restores them by copying (with reflinks, where the
+// filesystem has them). It's much slower than btrfs or zfs, and takes a lot
+// more space, but works anywhere, e.g. in a container that can't mount
+// anything.
+type dirStorage struct {
+	c    StackerConfig
+	lock *Lock
+}
+
+func newDirStorage(c StackerConfig, lock *Lock) (Storage, error) {
+	if err := os.MkdirAll(c.RootFSDir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &dirStorage{c: c, lock: lock}, nil
+}
+
+func (d *dirStorage) Name() string {
+	return "dir"
+}
+
+func (d *dirStorage) Create(source string) error {
+	return os.MkdirAll(path.Join(d.c.RootFSDir, source), 0755)
+}
+
+// copy copies source to target, keeping the ids of the files in it; as an
+// unprivileged user, they're the ids mapped into the user namespace, so it
+// has to be done in there.
+func (d *dirStorage) copy(source string, target string) error {
+	if err := d.Delete(target); err != nil {
+		return err
+	}
+
+	return MaybeRunInUserns([]string{
+		"cp", "-a", "--reflink=auto",
+		path.Join(d.c.RootFSDir, source),
+		path.Join(d.c.RootFSDir, target),
+	}, "couldn't copy "+source+" to "+target)
+}
+
+// Snapshot copies source to target. The copy isn't read only, but nothing
+// writes to snapshots.
+func (d *dirStorage) Snapshot(source string, target string) error {
+	return d.copy(source, target)
+}
+
+func (d *dirStorage) Restore(source string, target string) error {
+	return d.copy(source, target)
+}
+
+func (d *dirStorage) Delete(source string) error {
+	p := path.Join(d.c.RootFSDir, source)
+	if _, err := os.Lstat(p); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	// as an unprivileged user, the directories in it belong to ids mapped
+	// into the user namespace, and so can only be emptied from in there
+	if err := os.RemoveAll(p); err == nil {
+		return nil
+	}
+
+	return MaybeRunInUserns([]string{"rm", "-rf", p}, "couldn't delete "+source)
+}
+
+func (d *dirStorage) Detach() error {
+	return d.lock.Unlock()
+}
+
+func (d *dirStorage) Exists(thing string) bool {
+	_, err := os.Stat(path.Join(d.c.RootFSDir, thing))
+	return err == nil
+}
@@ -0,0 +1,63 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDirStorage(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("copying keeps the files' ids, which needs root")
+	}
+
+	dir, err := ioutil.TempDir("", "stacker-dirstorage-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newDirStorage(StackerConfig{RootFSDir: dir}, &Lock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Create("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "a", "foo"), []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Snapshot("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// changes to the source don't change the snapshot
+	if err := ioutil.WriteFile(path.Join(dir, "a", "foo"), []byte("bar"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Restore("b", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(path.Join(dir, "a", "foo"))
+	if err != nil || string(content) != "foo" {
+		t.Fatalf("bad restored content %s: %v", string(content), err)
+	}
+
+	if err := s.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Exists("b") || !s.Exists("a") {
+		t.Fatalf("wrong things deleted")
+	}
+
+	if err := s.Delete("b"); err != nil {
+		t.Fatalf("deleting something that isn't there failed: %v", err)
+	}
+}
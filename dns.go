@@ -0,0 +1,136 @@
+package stacker
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DNSSourceHost uses the host's /etc/resolv.conf as it is.
+	DNSSourceHost = "host"
+
+	// DNSSourceResolved uses the upstream nameservers systemd-resolved
+	// knows about, instead of its stub resolver.
+	DNSSourceResolved = "systemd-resolved"
+
+	hostResolvConf     = "/etc/resolv.conf"
+	resolvedResolvConf = "/run/systemd/resolve/resolv.conf"
+	resolvedStub       = "127.0.0.53"
+)
+
+// DNSConfig is the DNS configuration of the containers layers' commands
+// run in.
+type DNSConfig struct {
+	// Nameservers, Search and Options are written to the containers'
+	// resolv.conf instead of the host's, if Nameservers is set.
+	Nameservers []string `yaml:"nameservers"`
+	Search      []string `yaml:"search"`
+	Options     []string `yaml:"options"`
+
+	// Source is where the resolv.conf comes from otherwise:
+	// DNSSourceHost or DNSSourceResolved. By default it's the host's,
+	// unless that only has systemd-resolved's stub resolver.
+	Source string `yaml:"source"`
+}
+
+// nameservers returns the nameservers in the resolv.conf p.
+func nameservers(p string) ([]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	servers := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+
+	return servers, scanner.Err()
+}
+
+// onlyResolvedStub returns whether the resolv.conf p only has
+// systemd-resolved's stub resolver, which may not be reachable from
+// containers.
+func onlyResolvedStub(p string) bool {
+	servers, err := nameservers(p)
+	if err != nil || len(servers) == 0 {
+		return false
+	}
+
+	for _, s := range servers {
+		if s != resolvedStub {
+			return false
+		}
+	}
+
+	return true
+}
+
+// resolvConf returns the resolv.conf to bind mount into sc's working
+// container.
+func resolvConf(sc StackerConfig) (string, error) {
+	dns := sc.DNS
+	if dns == nil {
+		dns = &DNSConfig{}
+	}
+
+	if len(dns.Nameservers) > 0 {
+		content := ""
+		for _, s := range dns.Nameservers {
+			if net.ParseIP(s) == nil {
+				return "", errors.Errorf("invalid nameserver %s", s)
+			}
+			content += fmt.Sprintf("nameserver %s\n", s)
+		}
+
+		if len(dns.Search) > 0 {
+			content += fmt.Sprintf("search %s\n", strings.Join(dns.Search, " "))
+		}
+
+		if len(dns.Options) > 0 {
+			content += fmt.Sprintf("options %s\n", strings.Join(dns.Options, " "))
+		}
+
+		p := path.Join(sc.StackerDir, fmt.Sprintf("resolv.conf.%s", sc.WorkingContainer()))
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			return "", err
+		}
+
+		return p, nil
+	}
+
+	if len(dns.Search) > 0 || len(dns.Options) > 0 {
+		return "", errors.Errorf("dns search domains and options need nameservers")
+	}
+
+	switch dns.Source {
+	case DNSSourceHost:
+		return hostResolvConf, nil
+	case DNSSourceResolved:
+		if _, err := os.Stat(resolvedResolvConf); err != nil {
+			return "", errors.Wrapf(err, "couldn't find systemd-resolved's resolv.conf")
+		}
+		return resolvedResolvConf, nil
+	case "":
+		if onlyResolvedStub(hostResolvConf) {
+			if _, err := os.Stat(resolvedResolvConf); err == nil {
+				return resolvedResolvConf, nil
+			}
+		}
+		return hostResolvConf, nil
+	default:
+		return "", errors.Errorf("unknown dns source %s", dns.Source)
+	}
+}
@@ -0,0 +1,75 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestResolvConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_dns_test")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sc := StackerConfig{
+		StackerDir: dir,
+		DNS: &DNSConfig{
+			Nameservers: []string{"10.0.0.2", "10.0.0.3"},
+			Search:      []string{"corp.example.com"},
+		},
+	}
+
+	p, err := resolvConf(sc)
+	if err != nil {
+		t.Fatalf("couldn't make resolv.conf: %v", err)
+	}
+
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatalf("couldn't read resolv.conf: %v", err)
+	}
+
+	expected := "nameserver 10.0.0.2\nnameserver 10.0.0.3\nsearch corp.example.com\n"
+	if string(content) != expected {
+		t.Errorf("bad resolv.conf: %s", content)
+	}
+
+	for _, dns := range []*DNSConfig{{Nameservers: []string{"dns.example.com"}}, {Search: []string{"example.com"}}, {Source: "magic"}} {
+		if _, err := resolvConf(StackerConfig{StackerDir: dir, DNS: dns}); err == nil {
+			t.Errorf("accepted bad dns config %v", dns)
+		}
+	}
+
+	if p, err := resolvConf(StackerConfig{DNS: &DNSConfig{Source: DNSSourceHost}}); err != nil || p != hostResolvConf {
+		t.Errorf("didn't get the host's resolv.conf: %s %v", p, err)
+	}
+}
+
+func TestOnlyResolvedStub(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_dns_test")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	stub := path.Join(dir, "stub")
+	if err := ioutil.WriteFile(stub, []byte("nameserver 127.0.0.53\noptions edns0\n"), 0644); err != nil {
+		t.Fatalf("couldn't write resolv.conf: %v", err)
+	}
+
+	if !onlyResolvedStub(stub) {
+		t.Errorf("didn't find the stub resolver")
+	}
+
+	upstream := path.Join(dir, "upstream")
+	if err := ioutil.WriteFile(upstream, []byte("nameserver 127.0.0.53\nnameserver 1.1.1.1\n"), 0644); err != nil {
+		t.Fatalf("couldn't write resolv.conf: %v", err)
+	}
+
+	if onlyResolvedStub(upstream) {
+		t.Errorf("resolv.conf with upstream nameservers was only the stub")
+	}
+}
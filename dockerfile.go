@@ -0,0 +1,372 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// dockerfileSyntax is the Dockerfile frontend WriteDockerfile's Dockerfiles
+// need, for RUN heredocs and mounts.
+const dockerfileSyntax = "docker/dockerfile:1.4"
+
+// dockerfileLabsSyntax is the frontend needed for RUN --security=insecure,
+// i.e. for privileged layers.
+const dockerfileLabsSyntax = "docker/dockerfile:1-labs"
+
+var badStageChars = regexp.MustCompile(`[^a-z0-9_.-]`)
+
+// dockerfileStage is the name of the stage the layer name is in the
+// Dockerfile, which has to be lower case.
+func dockerfileStage(name string) string {
+	return badStageChars.ReplaceAllString(strings.ToLower(name), "-")
+}
+
+// dockerfileString quotes s for a Dockerfile, whose double quoted strings
+// are close enough to json's.
+func dockerfileString(s string) string {
+	content, _ := json.Marshal(s)
+	return string(content)
+}
+
+func dockerfileList(l []string) string {
+	content, _ := json.Marshal(l)
+	return string(content)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// dockerfileWriter writes the stages of a stackerfile's layers.
+type dockerfileWriter struct {
+	sf     *Stackerfile
+	w      io.Writer
+	stages map[string]string
+	err    error
+	config StackerConfig
+}
+
+func (dw *dockerfileWriter) printf(format string, args ...interface{}) {
+	if dw.err == nil {
+		_, dw.err = fmt.Fprintf(dw.w, format, args...)
+	}
+}
+
+// unsupported notes that the layer name uses what, which Dockerfiles can't
+// do, and is left out.
+func (dw *dockerfileWriter) unsupported(name string, what string) {
+	warnf(dw.config, "%s: %s can't be done in a Dockerfile, leaving it out\n", name, what)
+	dw.printf("# stacker: %s is left out\n", what)
+}
+
+// stage returns the stage the layer or image tag is in the Dockerfile.
+func (dw *dockerfileWriter) stage(tag string) string {
+	if s, ok := dw.stages[tag]; ok {
+		return s
+	}
+	return tag
+}
+
+// from returns what the layer is FROM.
+func (dw *dockerfileWriter) from(name string, l *Layer) (string, error) {
+	switch l.From.Type {
+	case DockerType:
+		return strings.TrimPrefix(l.From.Url, "docker://"), nil
+	case BuiltType:
+		if _, ok := dw.stages[l.From.Tag]; !ok {
+			warnf(dw.config, "%s: %s isn't in this stackerfile, so it has to be an image docker can pull\n", name, l.From.Tag)
+		}
+		return dw.stage(l.From.Tag), nil
+	case ScratchType:
+		return "scratch", nil
+	default:
+		return "", fmt.Errorf("%s: %s bases can't be used in a Dockerfile", name, l.From.Type)
+	}
+}
+
+// importSource returns the instruction that puts the import imp at dest in
+// the imports stage of a layer.
+func (dw *dockerfileWriter) importSource(imp string, dest string) (string, error) {
+	parsed, err := url.Parse(imp)
+	if err != nil {
+		return "", err
+	}
+
+	switch parsed.Scheme {
+	case "":
+		rel, err := filepath.Rel(dw.sf.referenceDirectory, imp)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return "", fmt.Errorf("import %s isn't under %s, the Dockerfile's context", imp, dw.sf.referenceDirectory)
+		}
+		return fmt.Sprintf("COPY %s %s", dockerfileString(rel), dockerfileString(dest)), nil
+	case "http", "https":
+		return fmt.Sprintf("ADD %s %s", dockerfileString(imp), dockerfileString(dest)), nil
+	case "stacker":
+		return fmt.Sprintf("COPY --from=%s %s %s", dw.stage(parsed.Host), dockerfileString(path.Join("/", parsed.Path)), dockerfileString(dest)), nil
+	default:
+		return "", fmt.Errorf("%s imports can't be done in a Dockerfile", parsed.Scheme)
+	}
+}
+
+func (dw *dockerfileWriter) layer(name string, l *Layer) error {
+	stage := dw.stage(name)
+
+	imports, err := l.ParseImport()
+	if err != nil {
+		return err
+	}
+
+	run, err := l.ParseRun()
+	if err != nil {
+		return err
+	}
+
+	// imports are in /stacker while the layer's commands run, like in
+	// stacker, but aren't in the image
+	importsStage := "stacker-imports-" + stage
+	if len(imports) > 0 && len(run) > 0 {
+		dw.printf("FROM scratch AS %s\n", importsStage)
+		for _, imp := range imports {
+			instruction, err := dw.importSource(imp, "/"+path.Base(imp))
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			dw.printf("%s\n", instruction)
+		}
+		dw.printf("\n")
+	}
+
+	from, err := dw.from(name, l)
+	if err != nil {
+		return err
+	}
+
+	platform := ""
+	if l.OS != "" || l.Arch != "" {
+		p := orHost(l.platform())
+		platform = fmt.Sprintf("--platform=%s/%s", p.OS, p.Architecture)
+		if p.Variant != "" {
+			platform += "/" + p.Variant
+		}
+		platform += " "
+	}
+
+	if l.BuildOnly {
+		dw.printf("# %s is build_only\n", name)
+	}
+	dw.printf("FROM %s%s AS %s\n", platform, from, stage)
+
+	for _, k := range sortedKeys(l.Environment) {
+		dw.printf("ENV %s=%s\n", k, dockerfileString(l.Environment[k]))
+	}
+
+	// build args are in the environment of RUN, but not the image
+	for _, k := range sortedKeys(l.BuildEnv) {
+		dw.printf("ARG %s=%s\n", k, dockerfileString(l.BuildEnv[k]))
+	}
+
+	copies, err := l.ParseCopyFrom()
+	if err != nil {
+		return err
+	}
+	for _, c := range copies {
+		dest := c.Dest
+		if dest == "" {
+			dest = c.Path
+		}
+		dw.printf("COPY --from=%s %s %s\n", dw.stage(c.Layer), dockerfileString(c.Path), dockerfileString(dest))
+	}
+
+	if len(run) > 0 {
+		mounts := ""
+		if len(imports) > 0 {
+			mounts += fmt.Sprintf(" --mount=type=bind,from=%s,target=/stacker,rw", importsStage)
+		}
+		for _, s := range l.Secrets {
+			mounts += fmt.Sprintf(" --mount=type=secret,id=%s", s)
+		}
+		if l.Privileged {
+			mounts += " --security=insecure"
+		}
+
+		dw.printf("RUN%s <<'STACKER_EOF'\n#!/bin/sh -xe\n%s\nSTACKER_EOF\n", mounts, strings.Join(run, "\n"))
+	}
+
+	binds, err := l.ParseBinds()
+	if err != nil {
+		return err
+	}
+
+	tests, err := l.ParseTest()
+	if err != nil {
+		return err
+	}
+
+	for _, u := range []struct {
+		used bool
+		what string
+	}{
+		{len(binds) > 0, "binds"},
+		{len(tests) > 0, "test"},
+		{len(l.Apply) > 0, "apply"},
+		{l.Squash, "squash"},
+		{len(l.Annotations) > 0, "annotations"},
+		{len(l.Capabilities) > 0, "capabilities"},
+		{l.SeccompProfile != "", "seccomp_profile"},
+		{len(l.Devices) > 0, "devices"},
+		{len(l.Tmpfs) > 0, "tmpfs"},
+		{len(l.Artifacts) > 0, "artifacts"},
+		{l.MaxSize != "", "max_size"},
+		{l.Hooks != nil, "hooks"},
+	} {
+		if u.used {
+			dw.unsupported(name, u.what)
+		}
+	}
+
+	for _, k := range sortedKeys(l.Labels) {
+		dw.printf("LABEL %s=%s\n", dockerfileString(k), dockerfileString(l.Labels[k]))
+	}
+
+	ports, err := l.ParsePorts()
+	if err != nil {
+		return err
+	}
+	if len(ports) > 0 {
+		dw.printf("EXPOSE %s\n", strings.Join(ports, " "))
+	}
+
+	if len(l.Volumes) > 0 {
+		dw.printf("VOLUME %s\n", dockerfileList(l.Volumes))
+	}
+
+	if l.StopSignal != "" {
+		dw.printf("STOPSIGNAL %s\n", l.StopSignal)
+	}
+
+	if l.Healthcheck != nil {
+		if err := dw.healthcheck(l.Healthcheck); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	if l.FullCommand != nil {
+		full, err := l.ParseFullCommand()
+		if err != nil {
+			return err
+		}
+		dw.printf("ENTRYPOINT %s\n", dockerfileList(full))
+	} else {
+		entrypoint, err := l.ParseEntrypoint()
+		if err != nil {
+			return err
+		}
+		if l.Entrypoint != nil {
+			dw.printf("ENTRYPOINT %s\n", dockerfileList(entrypoint))
+		}
+
+		cmd, err := l.ParseCmd()
+		if err != nil {
+			return err
+		}
+		if l.Cmd != nil {
+			dw.printf("CMD %s\n", dockerfileList(cmd))
+		}
+	}
+
+	// the layer's commands run as root in its base's working directory,
+	// which these change for the image
+	if l.WorkingDir != "" {
+		dw.printf("WORKDIR %s\n", l.WorkingDir)
+	}
+	if l.User != "" {
+		dw.printf("USER %s\n", l.User)
+	}
+
+	dw.printf("\n")
+	return dw.err
+}
+
+func (dw *dockerfileWriter) healthcheck(h *Healthcheck) error {
+	options := ""
+	for _, o := range []struct{ name, value string }{
+		{"interval", h.Interval},
+		{"timeout", h.Timeout},
+		{"start-period", h.StartPeriod},
+	} {
+		if o.value != "" {
+			options += fmt.Sprintf("--%s=%s ", o.name, o.value)
+		}
+	}
+	if h.Retries != 0 {
+		options += fmt.Sprintf("--retries=%d ", h.Retries)
+	}
+
+	switch test := h.Test.(type) {
+	case string:
+		if test == "NONE" {
+			dw.printf("HEALTHCHECK NONE\n")
+		} else {
+			dw.printf("HEALTHCHECK %sCMD %s\n", options, test)
+		}
+	case []interface{}:
+		args := []string{}
+		for _, arg := range test {
+			s, ok := arg.(string)
+			if !ok {
+				return fmt.Errorf("unknown healthcheck test argument type: %T", arg)
+			}
+			args = append(args, s)
+		}
+		dw.printf("HEALTHCHECK %sCMD %s\n", options, dockerfileList(args))
+	default:
+		return fmt.Errorf("unknown healthcheck test type: %T", h.Test)
+	}
+
+	return nil
+}
+
+// WriteDockerfile writes a multi-stage Dockerfile to w that builds the
+// layers of sf (with their names, lower cased, as the stages' names) the
+// way stacker would, so that they can be built by BuildKit, e.g. with docker
+// buildx build --target <layer>, with the stackerfile's directory as the
+// context. The things stacker can do that Dockerfiles can't are left out,
+// with a warning and a comment in the Dockerfile.
+func WriteDockerfile(sf *Stackerfile, w io.Writer) error {
+	order, err := sf.DependencyOrder()
+	if err != nil {
+		return err
+	}
+
+	dw := &dockerfileWriter{sf: sf, w: w, stages: map[string]string{}}
+	syntax := dockerfileSyntax
+	for _, name := range order {
+		dw.stages[name] = dockerfileStage(name)
+		if l, _ := sf.Get(name); l.Privileged {
+			syntax = dockerfileLabsSyntax
+		}
+	}
+
+	dw.printf("# syntax=%s\n", syntax)
+	dw.printf("# generated by stacker from %s\n\n", sf.path)
+	for _, name := range order {
+		l, _ := sf.Get(name)
+		if err := dw.layer(name, l); err != nil {
+			return err
+		}
+	}
+
+	return dw.err
+}
@@ -0,0 +1,126 @@
+package stacker
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteDockerfile(t *testing.T) {
+	content := `Builder:
+    from:
+        type: docker
+        url: docker://golang:latest
+    import:
+        - src/main.go
+        - https://example.com/vendor.tar.gz
+    build_env:
+        GOFLAGS: -mod=vendor
+    secrets:
+        - token
+    run: |
+        tar -C /go/src -xf /stacker/vendor.tar.gz
+        go build -o /out/app /stacker/main.go
+    build_only: true
+app:
+    from:
+        type: built
+        tag: Builder
+    copy_from: {layer: Builder, path: /out/app, dest: /usr/bin/app}
+    environment:
+        FOO: bar baz
+    labels:
+        org.example.team: core
+    ports:
+        - 8080
+    binds:
+        - /etc/resolv.conf
+    entrypoint: /usr/bin/app
+    user: nobody
+`
+	sf, err := NewStackerfileFromReader(strings.NewReader(content), "/src", nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := WriteDockerfile(sf, out); err != nil {
+		t.Fatalf("WriteDockerfile failed: %v", err)
+	}
+	dockerfile := out.String()
+
+	expected := []string{
+		"# syntax=" + dockerfileSyntax + "\n",
+		"FROM scratch AS stacker-imports-builder\n" +
+			`COPY "src/main.go" "/main.go"` + "\n" +
+			`ADD "https://example.com/vendor.tar.gz" "/vendor.tar.gz"` + "\n",
+		"FROM golang:latest AS builder\n",
+		`ARG GOFLAGS="-mod=vendor"` + "\n",
+		"RUN --mount=type=bind,from=stacker-imports-builder,target=/stacker,rw --mount=type=secret,id=token <<'STACKER_EOF'\n" +
+			"#!/bin/sh -xe\ntar -C /go/src -xf /stacker/vendor.tar.gz\ngo build -o /out/app /stacker/main.go\nSTACKER_EOF\n",
+		"FROM builder AS app\n",
+		`ENV FOO="bar baz"` + "\n",
+		`COPY --from=builder "/out/app" "/usr/bin/app"` + "\n",
+		"# stacker: binds is left out\n",
+		`LABEL "org.example.team"="core"` + "\n",
+		"EXPOSE 8080/tcp\n",
+		`ENTRYPOINT ["/usr/bin/app"]` + "\n",
+		"USER nobody\n",
+	}
+
+	last := 0
+	for _, e := range expected {
+		i := strings.Index(dockerfile, e)
+		if i < 0 {
+			t.Errorf("%q isn't in the Dockerfile:\n%s", e, dockerfile)
+			continue
+		}
+		if i < last {
+			t.Errorf("%q is out of order in the Dockerfile:\n%s", e, dockerfile)
+		}
+		last = i
+	}
+}
+
+func TestWriteDockerfileOutsideContext(t *testing.T) {
+	content := `app:
+    from:
+        type: docker
+        url: docker://centos:latest
+    import: /etc/passwd
+    run: cat /stacker/passwd
+`
+	sf, err := NewStackerfileFromReader(strings.NewReader(content), "/src", nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := WriteDockerfile(sf, &bytes.Buffer{}); err == nil {
+		t.Errorf("an import outside the context was converted")
+	}
+}
+
+func TestWriteDockerfilePrivileged(t *testing.T) {
+	content := `app:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: mount -t tmpfs tmpfs /mnt
+    privileged: true
+`
+	sf, err := NewStackerfileFromReader(strings.NewReader(content), "/src", nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := WriteDockerfile(sf, out); err != nil {
+		t.Fatalf("WriteDockerfile failed: %v", err)
+	}
+
+	// RUN --security=insecure is only in the labs frontend
+	dockerfile := out.String()
+	if !strings.HasPrefix(dockerfile, "# syntax="+dockerfileLabsSyntax+"\n") || !strings.Contains(dockerfile, "RUN --security=insecure") {
+		t.Errorf("bad privileged Dockerfile:\n%s", dockerfile)
+	}
+}
@@ -0,0 +1,158 @@
+package stacker
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/containers/image/docker"
+	"github.com/docker/distribution/registry/api/errcode"
+	pkgerrors "github.com/pkg/errors"
+)
+
+// These are the errors stacker's library API can fail with, so that callers
+// can react to particular failures without parsing error strings. Errors
+// returned by stacker carry context (which layer, which url, the underlying
+// error) in their message; use errors.Cause() from github.com/pkg/errors to
+// get at the error to compare against one of these, e.g.:
+//
+//	if errors.Cause(err) == stacker.ErrNoShell {
+//		...
+//	}
+var (
+	// ErrNoShell means a layer has run or test commands, but its rootfs
+	// has no /bin/sh to run them with.
+	ErrNoShell = errors.New("rootfs does not have a /bin/sh")
+
+	// ErrRunFailed means a layer's run commands exited non-zero.
+	ErrRunFailed = errors.New("run commands failed")
+
+	// ErrTestsFailed means a layer's test commands exited non-zero.
+	ErrTestsFailed = errors.New("tests failed")
+
+	// ErrHookFailed means a pre_run or post_build hook exited non-zero.
+	ErrHookFailed = errors.New("hook failed")
+
+	// ErrCacheMiss means a layer isn't in the build cache, or its cache
+	// entry is no longer valid.
+	ErrCacheMiss = errors.New("cache miss")
+
+	// ErrMissingBaseLayer means a layer is built on a layer that isn't
+	// defined in any of the stackerfiles being built.
+	ErrMissingBaseLayer = errors.New("missing base layer")
+
+	// ErrImportHashMismatch means an import's content doesn't match the
+	// hash it is expected to have.
+	ErrImportHashMismatch = errors.New("import hash mismatch")
+
+	// ErrDownloadFailed means an http(s) import couldn't be downloaded.
+	ErrDownloadFailed = errors.New("download failed")
+
+	// ErrPullUnauthorized means the registry refused to let us pull a
+	// base image with the credentials we have (if any).
+	ErrPullUnauthorized = errors.New("unauthorized to pull image")
+
+	// ErrPushUnauthorized means the registry refused to let us push a
+	// layer with the credentials we have (if any).
+	ErrPushUnauthorized = errors.New("unauthorized to push image")
+
+	// ErrLayerTooBig means a layer has files that are bigger than the
+	// maximum layer size on their own, so it can't be split to fit.
+	ErrLayerTooBig = errors.New("file bigger than maximum layer size")
+
+	// ErrBuildInProgress means another stacker is using something that
+	// only one stacker can use at a time, e.g. the same OCI layout or
+	// working container.
+	ErrBuildInProgress = errors.New("another build is in progress")
+
+	// ErrLayerMismatch means a generated layer doesn't unpack to the
+	// rootfs it was generated from.
+	ErrLayerMismatch = errors.New("layer doesn't match rootfs")
+
+	// ErrPolicyViolation means a built image violates one of the
+	// policies it's checked against before it's saved.
+	ErrPolicyViolation = errors.New("policy violation")
+
+	// ErrOverBudget means the layers generated for a layer are bigger
+	// than its max_size.
+	ErrOverBudget = errors.New("layer bigger than its max_size")
+
+	// ErrVulnerable means scanning a built layer found vulnerabilities
+	// that are at least as severe as the build fails on.
+	ErrVulnerable = errors.New("vulnerabilities found")
+
+	// ErrInterrupted means the build was stopped because its context was
+	// cancelled, e.g. when stacker got SIGINT or SIGTERM.
+	ErrInterrupted = errors.New("build interrupted")
+
+	// ErrMissingTool means an external tool the build needs (e.g.
+	// mksquashfs) isn't there, or is too old.
+	ErrMissingTool = errors.New("missing tool")
+
+	// ErrNoSpace means there isn't enough free space where squashfs
+	// images are generated, see StackerConfig.ScratchMinFree.
+	ErrNoSpace = errors.New("not enough free space")
+
+	// ErrQuotaExceeded means a layer's build wrote more than its
+	// StackerConfig.LayerQuota.
+	ErrQuotaExceeded = errors.New("layer quota exceeded")
+
+	// ErrUntrusted means an untrusted stackerfile (see
+	// BuildArgs.Untrusted) uses the host, e.g. with hooks or binds.
+	ErrUntrusted = errors.New("untrusted stackerfile uses the host")
+)
+
+// stackerError is one of the errors above, along with the human readable
+// context of where it happened and the underlying error (if any) that caused
+// it.
+type stackerError struct {
+	kind error
+	msg  string
+	err  error
+}
+
+func (e *stackerError) Error() string {
+	if e.err == nil {
+		return e.msg
+	}
+	return fmt.Sprintf("%s: %v", e.msg, e.err)
+}
+
+// Cause makes errors.Cause() return the sentinel error.
+func (e *stackerError) Cause() error {
+	return e.kind
+}
+
+func newError(kind error, err error, format string, args ...interface{}) error {
+	return &stackerError{kind: kind, msg: fmt.Sprintf(format, args...), err: err}
+}
+
+// isUnauthorized returns true if err is a registry telling us our credentials
+// aren't good enough.
+func isUnauthorized(err error) bool {
+	cause := pkgerrors.Cause(err)
+	if cause == docker.ErrUnauthorizedForCredentials {
+		return true
+	}
+
+	var errs errcode.Errors
+	switch e := cause.(type) {
+	case errcode.Errors:
+		errs = e
+	default:
+		errs = errcode.Errors{e}
+	}
+
+	for _, e := range errs {
+		coder, ok := e.(errcode.ErrorCoder)
+		if !ok {
+			continue
+		}
+
+		switch coder.ErrorCode() {
+		case errcode.ErrorCodeUnauthorized, errcode.ErrorCodeDenied:
+			return true
+		}
+	}
+
+	return false
+}
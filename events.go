@@ -0,0 +1,185 @@
+package stacker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// EventLayerStarted is sent when a layer starts being built (or
+	// looked up in the cache).
+	EventLayerStarted = "layer_started"
+
+	// EventPhaseStarted is sent when a layer starts one of the phases
+	// of building it, e.g. RunPhase.
+	EventPhaseStarted = "phase_started"
+
+	// EventImportFetched is sent for each of a layer's imports, once
+	// they've all been fetched.
+	EventImportFetched = "import_fetched"
+
+	// EventCacheHit is sent when a layer is taken from the cache instead
+	// of being built.
+	EventCacheHit = "cache_hit"
+
+	// EventRunOutput is sent with each chunk of output of a layer's run
+	// commands.
+	EventRunOutput = "run_output"
+
+	// EventLayerCommitted is sent when a layer has been built and added
+	// to the OCI output and the cache.
+	EventLayerCommitted = "layer_committed"
+
+	// EventPushProgress is sent with each chunk of progress output while
+	// a layer is pushed to its save_url.
+	EventPushProgress = "push_progress"
+
+	// EventLayerPushed is sent when a layer has been pushed to one of the
+	// urls it's saved to.
+	EventLayerPushed = "layer_pushed"
+)
+
+// Event is something that happened during a build.
+type Event struct {
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	Stackerfile string    `json:"stackerfile"`
+	Layer       string    `json:"layer"`
+
+	// Phase is the phase that started, for EventPhaseStarted.
+	Phase string `json:"phase,omitempty"`
+
+	// Digest is the digest of the layer's manifest, for
+	// EventCacheHit and EventLayerCommitted.
+	Digest string `json:"digest,omitempty"`
+
+	// URL is the import that was fetched for EventImportFetched, or where
+	// the layer is being pushed for EventPushProgress and
+	// EventLayerPushed.
+	URL string `json:"url,omitempty"`
+
+	// Output is what was printed, for EventRunOutput and
+	// EventPushProgress.
+	Output []byte `json:"output,omitempty"`
+}
+
+// EventHandler is called with each event of a build, in order, from the
+// goroutine doing the build, so it holds the build up until it returns.
+type EventHandler func(Event)
+
+// OnEvent makes the builder call h with each event of the builds it does.
+func (b *Builder) OnEvent(h EventHandler) {
+	b.opts.eventHandlers = append(b.opts.eventHandlers, h)
+}
+
+// Subscribe makes the builder send each event of the builds it does to ch.
+// The build waits for ch to be received from; ch is not closed when the
+// build is done.
+func (b *Builder) Subscribe(ch chan<- Event) {
+	b.OnEvent(func(e Event) {
+		ch <- e
+	})
+}
+
+// eventLinePrefix starts the json of each event StreamEvents writes.
+const eventLinePrefix = "stacker-event: "
+
+// StreamEvents makes the builder write each event of the builds it does to
+// w, as a line of json after "stacker-event: ", so that it can be mixed into
+// the build's output and read back out of it by the Runner that ran it.
+func (b *Builder) StreamEvents(w io.Writer) {
+	b.OnEvent(func(e Event) {
+		content, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "%s%s\n", eventLinePrefix, content)
+	})
+}
+
+// replayEvents reads the output of a build that streamed its events into it
+// (see StreamEvents) from r, sending the events to opts' event handlers and
+// the rest of the output to out.
+func (opts *BuildArgs) replayEvents(r io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// output without a trailing newline ends up in front of the
+		// event that comes after it
+		i := strings.Index(line, eventLinePrefix)
+		if i < 0 {
+			fmt.Fprintln(out, line)
+			continue
+		}
+
+		if i > 0 {
+			fmt.Fprintln(out, line[:i])
+		}
+
+		e := Event{}
+		if err := json.Unmarshal([]byte(line[i+len(eventLinePrefix):]), &e); err != nil {
+			fmt.Fprintln(out, line[i:])
+			continue
+		}
+		opts.emit(e)
+	}
+
+	return scanner.Err()
+}
+
+// emit sends e to the build's event handlers.
+func (opts *BuildArgs) emit(e Event) {
+	if len(opts.eventHandlers) == 0 {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	for _, h := range opts.eventHandlers {
+		h(e)
+	}
+}
+
+// startPhase sends EventPhaseStarted for phase of the layer name, and
+// returns when it started.
+func (opts *BuildArgs) startPhase(file string, name string, phase string) time.Time {
+	start := time.Now()
+	opts.emit(Event{Type: EventPhaseStarted, Time: start, Stackerfile: file, Layer: name, Phase: phase})
+	return start
+}
+
+// eventWriter sends what's written to it as events like e, with the
+// output set to what was written, and then writes it to w (if there is one).
+type eventWriter struct {
+	opts *BuildArgs
+	e    Event
+	w    io.Writer
+}
+
+func (ew *eventWriter) Write(p []byte) (int, error) {
+	e := ew.e
+	e.Output = append([]byte{}, p...)
+	ew.opts.emit(e)
+
+	if ew.w == nil {
+		return len(p), nil
+	}
+	return ew.w.Write(p)
+}
+
+// eventOutput returns w, or if the build has any event handlers, a writer
+// that also sends what's written to it as events like e.
+func (opts *BuildArgs) eventOutput(e Event, w io.Writer) io.Writer {
+	if len(opts.eventHandlers) == 0 {
+		return w
+	}
+	return &eventWriter{opts: opts, e: e, w: w}
+}
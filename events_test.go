@@ -0,0 +1,91 @@
+package stacker
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	b := NewBuilder(&BuildArgs{})
+
+	// nothing is wrapped if there's nobody to tell
+	out := &bytes.Buffer{}
+	if b.opts.eventOutput(Event{Type: EventRunOutput}, out) != out {
+		t.Errorf("output wrapped without any event handlers")
+	}
+
+	events := []Event{}
+	b.OnEvent(func(e Event) {
+		events = append(events, e)
+	})
+
+	ch := make(chan Event, 10)
+	b.Subscribe(ch)
+
+	b.opts.emit(Event{Type: EventLayerStarted, Layer: "foo"})
+
+	w := b.opts.eventOutput(Event{Type: EventRunOutput, Layer: "foo"}, out)
+	buf := []byte("hello\n")
+	if _, err := w.Write(buf); err != nil {
+		t.Fatalf("couldn't write output %v", err)
+	}
+	buf[0] = 'j'
+
+	if out.String() != "hello\n" {
+		t.Errorf("output not passed on: %q", out.String())
+	}
+
+	if len(events) != 2 || len(ch) != 2 {
+		t.Fatalf("bad events %v, %d sent to channel", events, len(ch))
+	}
+
+	if events[0].Type != EventLayerStarted || events[0].Layer != "foo" || events[0].Time.IsZero() {
+		t.Errorf("bad first event %v", events[0])
+	}
+
+	if events[1].Type != EventRunOutput || string(events[1].Output) != "hello\n" {
+		t.Errorf("bad output event %v", events[1])
+	}
+
+	if e := <-ch; e.Type != EventLayerStarted {
+		t.Errorf("bad event from channel %v", e)
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	remote := NewBuilder(&BuildArgs{})
+	stream := &bytes.Buffer{}
+	remote.StreamEvents(stream)
+
+	stream.WriteString("building foo\n")
+	remote.opts.emit(Event{Type: EventLayerStarted, Layer: "foo"})
+	stream.WriteString("no newline")
+	remote.opts.emit(Event{Type: EventRunOutput, Layer: "foo", Output: []byte("hello\n")})
+
+	events := []Event{}
+	local := NewBuilder(&BuildArgs{})
+	local.OnEvent(func(e Event) {
+		events = append(events, e)
+	})
+
+	out := &bytes.Buffer{}
+	if err := local.opts.replayEvents(stream, out); err != nil {
+		t.Fatalf("replayEvents failed: %v", err)
+	}
+
+	if out.String() != "building foo\nno newline\n" {
+		t.Errorf("bad output %q", out.String())
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("bad events %v", events)
+	}
+
+	if events[0].Type != EventLayerStarted || events[0].Layer != "foo" || events[0].Time.IsZero() {
+		t.Errorf("bad first event %v", events[0])
+	}
+
+	if events[1].Type != EventRunOutput || string(events[1].Output) != "hello\n" {
+		t.Errorf("bad output event %v", events[1])
+	}
+}
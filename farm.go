@@ -0,0 +1,258 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FarmRunner runs builds on a farm of remote hosts (with RemoteBuild): each
+// stackerfile, once its prerequisites are built, goes to an idle worker,
+// preferring the one whose build cache has the most of it already, and the
+// images they build are all pulled into the local output.
+//
+// A worker builds a stackerfile's prerequisites too, if it hasn't already,
+// so what's in the workers' caches is what they've built, which the farm
+// keeps track of in StackerDir.
+type FarmRunner struct {
+	// Workers are the hosts to build on, and how. Their Args are the
+	// arguments of every build, which the stackerfile is added to.
+	Workers []RemoteBuildOpts
+}
+
+// farmIndex is which stackerfiles (relative to the directory the farm was
+// run from) each worker has built, by host.
+type farmIndex map[string]map[string]bool
+
+func farmIndexPath(config StackerConfig) string {
+	return path.Join(config.StackerDir, "farm.json")
+}
+
+func loadFarmIndex(config StackerConfig) (farmIndex, error) {
+	index := farmIndex{}
+	content, err := ioutil.ReadFile(farmIndexPath(config))
+	if os.IsNotExist(err) {
+		return index, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, &index); err != nil {
+		return nil, fmt.Errorf("bad farm index %s: %v", farmIndexPath(config), err)
+	}
+	return index, nil
+}
+
+func (index farmIndex) save(config StackerConfig) error {
+	content, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(farmIndexPath(config), content, 0644)
+}
+
+func (index farmIndex) record(host string, file string) {
+	if index[host] == nil {
+		index[host] = map[string]bool{}
+	}
+	index[host][file] = true
+}
+
+// pickWorker returns the one of the idle workers whose host has built the
+// most of file and its prerequisites (file itself counting the most, since
+// its layers are all in the cache then), or the first one if none have.
+func (index farmIndex) pickWorker(workers []RemoteBuildOpts, idle []int, file string, prerequisites []string) int {
+	best, bestScore := idle[0], -1
+	for _, w := range idle {
+		built := index[workers[w].Host]
+
+		score := 0
+		if built[file] {
+			score += len(prerequisites) + 1
+		}
+		for _, p := range prerequisites {
+			if built[p] {
+				score++
+			}
+		}
+
+		if score > bestScore {
+			best, bestScore = w, score
+		}
+	}
+
+	return best
+}
+
+// allPrerequisites returns the prerequisites of each stackerfile in dag, and
+// theirs, and so on.
+func allPrerequisites(order []string, dag *StackerFilesDAG) (map[string][]string, error) {
+	all := map[string][]string{}
+
+	// order has each stackerfile's prerequisites before it
+	for _, p := range order {
+		direct, err := dag.GetStackerFile(p).Prerequisites()
+		if err != nil {
+			return nil, err
+		}
+
+		seen := map[string]bool{}
+		for _, d := range direct {
+			seen[d] = true
+			for _, dd := range all[d] {
+				seen[dd] = true
+			}
+		}
+
+		prerequisites := []string{}
+		for d := range seen {
+			prerequisites = append(prerequisites, d)
+		}
+		sort.Strings(prerequisites)
+		all[p] = prerequisites
+	}
+
+	return all, nil
+}
+
+type farmResult struct {
+	file   string
+	worker int
+	err    error
+}
+
+// Run builds the stackerfiles at paths, and their prerequisites, on the
+// farm. They, and the local files they import, have to be under the current
+// directory, as for RemoteBuild.
+func (f *FarmRunner) Run(opts *BuildArgs, paths []string) error {
+	if len(f.Workers) == 0 {
+		return fmt.Errorf("no workers to build on")
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	sfOpts, err := opts.stackerfileOpts()
+	if err != nil {
+		return err
+	}
+
+	sfs, err := NewStackerFilesWithOpts(paths, sfOpts)
+	if err != nil {
+		return err
+	}
+
+	dag, err := NewStackerFilesDAG(sfs)
+	if err != nil {
+		return err
+	}
+
+	order := dag.Sort()
+	prerequisites, err := allPrerequisites(order, dag)
+	if err != nil {
+		return err
+	}
+
+	// the index is by path relative to the working directory, which is
+	// also how the workers get them
+	rel := map[string]string{}
+	for _, p := range order {
+		rel[p] = p
+		if !strings.Contains(p, "://") {
+			if rel[p], err = filepath.Rel(wd, p); err != nil {
+				return err
+			}
+		}
+	}
+	relAll := func(ps []string) []string {
+		rs := []string{}
+		for _, p := range ps {
+			rs = append(rs, rel[p])
+		}
+		return rs
+	}
+
+	index, err := loadFarmIndex(opts.Config)
+	if err != nil {
+		return err
+	}
+
+	idle := []int{}
+	for i := range f.Workers {
+		idle = append(idle, i)
+	}
+
+	done := map[string]bool{}
+	running := map[string]bool{}
+	results := make(chan farmResult)
+	var buildErr error
+	for {
+		// nothing new is started once a build has failed, but the
+		// ones that are running are waited for
+		for _, p := range order {
+			if buildErr != nil || len(idle) == 0 {
+				break
+			}
+
+			if done[p] || running[p] {
+				continue
+			}
+
+			ready := true
+			for _, d := range prerequisites[p] {
+				ready = ready && done[d]
+			}
+			if !ready {
+				continue
+			}
+
+			w := index.pickWorker(f.Workers, idle, rel[p], relAll(prerequisites[p]))
+			for i := range idle {
+				if idle[i] == w {
+					idle = append(idle[:i], idle[i+1:]...)
+					break
+				}
+			}
+			running[p] = true
+
+			worker := f.Workers[w]
+			worker.Args = append(append([]string{}, worker.Args...), "--stacker-file", rel[p])
+			infof(opts.Config, "building %s on %s\n", rel[p], worker.Host)
+			go func(p string, w int, worker RemoteBuildOpts) {
+				results <- farmResult{file: p, worker: w, err: RemoteBuild(opts, []string{p}, worker)}
+			}(p, w, worker)
+		}
+
+		if len(running) == 0 {
+			break
+		}
+
+		r := <-results
+		delete(running, r.file)
+		idle = append(idle, r.worker)
+		if r.err != nil {
+			if buildErr == nil {
+				buildErr = fmt.Errorf("building %s on %s failed: %v", rel[r.file], f.Workers[r.worker].Host, r.err)
+			}
+			continue
+		}
+
+		done[r.file] = true
+		index.record(f.Workers[r.worker].Host, rel[r.file])
+		for _, d := range prerequisites[r.file] {
+			index.record(f.Workers[r.worker].Host, rel[d])
+		}
+		if err := index.save(opts.Config); err != nil {
+			warnf(opts.Config, "couldn't save farm index: %v\n", err)
+		}
+	}
+
+	return buildErr
+}
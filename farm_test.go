@@ -0,0 +1,60 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFarmPickWorker(t *testing.T) {
+	workers := []RemoteBuildOpts{{Host: "a"}, {Host: "b"}, {Host: "c"}}
+	index := farmIndex{}
+	index.record("b", "base.yaml")
+	index.record("c", "base.yaml")
+	index.record("c", "tools.yaml")
+	index.record("a", "app.yaml")
+
+	for _, c := range []struct {
+		idle          []int
+		file          string
+		prerequisites []string
+		expected      string
+	}{
+		// nobody has anything, so the first idle one
+		{[]int{1, 2}, "other.yaml", nil, "b"},
+		// c has both prerequisites, b only one
+		{[]int{0, 1, 2}, "app2.yaml", []string{"base.yaml", "tools.yaml"}, "c"},
+		{[]int{0, 1}, "app2.yaml", []string{"base.yaml", "tools.yaml"}, "b"},
+		// a built app.yaml itself, which beats having its prerequisites
+		{[]int{0, 1, 2}, "app.yaml", []string{"base.yaml", "tools.yaml"}, "a"},
+	} {
+		w := index.pickWorker(workers, c.idle, c.file, c.prerequisites)
+		if workers[w].Host != c.expected {
+			t.Errorf("%s went to %s from %v, expected %s", c.file, workers[w].Host, c.idle, c.expected)
+		}
+	}
+}
+
+func TestFarmIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-farm-test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := StackerConfig{StackerDir: dir}
+	index, err := loadFarmIndex(config)
+	if err != nil || len(index) != 0 {
+		t.Fatalf("bad empty index %v %v", index, err)
+	}
+
+	index.record("a", "stacker.yaml")
+	if err := index.save(config); err != nil {
+		t.Fatalf("couldn't save index: %v", err)
+	}
+
+	index, err = loadFarmIndex(config)
+	if err != nil || !index["a"]["stacker.yaml"] {
+		t.Errorf("bad saved index %v %v", index, err)
+	}
+}
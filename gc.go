@@ -0,0 +1,373 @@
+package stacker
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// GCAtEnd removes unused blobs from the output at the end of every
+	// build.
+	GCAtEnd = "at-end"
+
+	// GCScheduled removes them at the end of a build if the policy's
+	// interval has passed since they last were.
+	GCScheduled = "scheduled"
+
+	// GCOff never removes them at the end of a build; only stacker gc
+	// does.
+	GCOff = "off"
+)
+
+// GCPolicy is when builds remove the blobs in OCIDir that no tag uses, and
+// which of them are old enough to be removed (by builds or GC).
+type GCPolicy struct {
+	// Mode is GCAtEnd (the default), GCScheduled or GCOff.
+	Mode string `yaml:"mode"`
+
+	// Interval is how long (e.g. "24h") GCScheduled waits between
+	// removing them.
+	Interval string `yaml:"interval"`
+
+	// GracePeriod is how long (e.g. "1h") blobs are kept after they're
+	// written (or linked into a layout), even though no tag uses them,
+	// since another process may be about to tag them.
+	GracePeriod string `yaml:"grace_period"`
+}
+
+func (c StackerConfig) gcPolicy() GCPolicy {
+	if c.GC == nil {
+		return GCPolicy{Mode: GCAtEnd}
+	}
+
+	p := *c.GC
+	if p.Mode == "" {
+		p.Mode = GCAtEnd
+	}
+	return p
+}
+
+func (p GCPolicy) gracePeriod() (time.Duration, error) {
+	if p.GracePeriod == "" {
+		return 0, nil
+	}
+
+	grace, err := time.ParseDuration(p.GracePeriod)
+	if err != nil {
+		return 0, fmt.Errorf("bad gc grace_period %s: %v", p.GracePeriod, err)
+	}
+
+	return grace, nil
+}
+
+// changedWithin returns whether the file at p was written, or had a link
+// made to it, in the last d.
+func changedWithin(p string, d time.Duration) bool {
+	if d == 0 {
+		return false
+	}
+
+	var st unix.Stat_t
+	if err := unix.Lstat(p, &st); err != nil {
+		return false
+	}
+
+	return time.Since(time.Unix(st.Ctim.Unix())) < d
+}
+
+// gcLayout removes the blobs in oci, the layout at layout, that none of its
+// tags (or the images keep) use, like oci.GC, except the ones that changed in
+// the last grace. Tags of image indexes are kept along with all of their
+// manifests.
+func gcLayout(oci casext.Engine, layout string, grace time.Duration, keep []ispec.Descriptor) error {
+	ctx := context.Background()
+
+	names, err := oci.ListReferences(ctx)
+	if err != nil {
+		return err
+	}
+
+	used := map[digest.Digest]bool{}
+	mark := func(root ispec.Descriptor) error {
+		if used[root.Digest] {
+			return nil
+		}
+
+		reachable, err := oci.Reachable(ctx, root)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range reachable {
+			used[r] = true
+		}
+		return nil
+	}
+
+	for _, name := range names {
+		descs, err := oci.ResolveReference(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		for _, d := range descs {
+			if err := mark(d.Root()); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, d := range keep {
+		// images that are gone already are pruned from the cache
+		// the next time it's opened
+		if _, err := os.Stat(blobPath(layout, d.Digest)); err != nil {
+			continue
+		}
+
+		if err := mark(d); err != nil {
+			return err
+		}
+	}
+
+	blobs, err := oci.ListBlobs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range blobs {
+		if used[b] || changedWithin(blobPath(layout, b), grace) {
+			continue
+		}
+
+		if err := oci.DeleteBlob(ctx, b); err != nil {
+			return err
+		}
+	}
+
+	return oci.Clean(ctx)
+}
+
+func lastGCPath(config StackerConfig) string {
+	return path.Join(config.StackerDir, "last-gc")
+}
+
+// recordGC remembers that the output was just GCed, for GCScheduled.
+func recordGC(config StackerConfig) error {
+	return ioutil.WriteFile(lastGCPath(config), []byte(time.Now().Format(time.RFC3339)), 0644)
+}
+
+// gcDue returns whether the policy p says the output should be GCed at the
+// end of a build.
+func gcDue(config StackerConfig, p GCPolicy) (bool, error) {
+	switch p.Mode {
+	case GCAtEnd:
+		return true, nil
+	case GCOff:
+		return false, nil
+	case GCScheduled:
+	default:
+		return false, fmt.Errorf("unknown gc mode %s", p.Mode)
+	}
+
+	if p.Interval == "" {
+		return false, fmt.Errorf("gc mode %s needs an interval", GCScheduled)
+	}
+
+	interval, err := time.ParseDuration(p.Interval)
+	if err != nil {
+		return false, fmt.Errorf("bad gc interval %s: %v", p.Interval, err)
+	}
+
+	fi, err := os.Stat(lastGCPath(config))
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return time.Since(fi.ModTime()) >= interval, nil
+}
+
+// cachedImages are the images of the entries in cache, in every cache
+// namespace, which GC keeps even when the layers' tags have moved on to
+// other builds of them.
+func cachedImages(cache *BuildCache) []ispec.Descriptor {
+	images := []ispec.Descriptor{}
+	if cache == nil {
+		return images
+	}
+
+	for _, ent := range cache.Cache {
+		if ent.Blob.Digest != "" {
+			images = append(images, ent.Blob)
+		}
+	}
+	return images
+}
+
+// gcAfterBuild removes the blobs in the output (opened as oci) that neither
+// a tag nor the build cache uses, if the GC policy says to. The caller holds
+// the lock on OCIDir, so no other stacker is using it.
+func gcAfterBuild(config StackerConfig, oci casext.Engine, cache *BuildCache) error {
+	p := config.gcPolicy()
+	due, err := gcDue(config, p)
+	if err != nil || !due {
+		return err
+	}
+
+	grace, err := p.gracePeriod()
+	if err != nil {
+		return err
+	}
+
+	if err := gcLayout(oci, config.OCIDir, grace, cachedImages(cache)); err != nil {
+		return err
+	}
+
+	return recordGC(config)
+}
+
+func gcForOCILayout(layout string, grace time.Duration, keep []ispec.Descriptor, thingsToKeep map[string]bool) error {
+	oci, err := umoci.OpenLayout(layout)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	err = gcLayout(oci, layout, grace, keep)
+	if err != nil {
+		return err
+	}
+
+	tags, err := oci.ListReferences(context.Background())
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tags {
+		manifest, err := stackeroci.LookupManifest(oci, t)
+		if err != nil {
+			return err
+		}
+
+		// keep both tags and hashes
+		thingsToKeep[t] = true
+
+		// and the unpacked base image, if this is one
+		descs, err := oci.ResolveReference(context.Background(), t)
+		if err != nil {
+			return err
+		}
+
+		for _, desc := range descs {
+			thingsToKeep[baseSnapshotName(desc.Descriptor().Digest)] = true
+		}
+
+		for _, layer := range manifest.Layers {
+			hash, err := ComputeAggregateHash(manifest, layer)
+			if err != nil {
+				return err
+			}
+
+			thingsToKeep[hash] = true
+		}
+	}
+
+	return nil
+}
+
+// GC removes unused OCI blobs from the output and import layouts, and deletes
+// any snapshots that are no longer referenced by a tag in either of them. It
+// also removes the blobs in the shared blob store that no layout uses. Blobs
+// that changed within the GC policy's grace period, and the images of the
+// build cache's entries, are kept.
+func GC(config StackerConfig) error {
+	ociLock, err := LockOCIDir(config)
+	if err != nil {
+		return err
+	}
+	defer ociLock.Unlock()
+
+	basesLock, err := lockOrWait(config, "layer-bases", "the base image import layout")
+	if err != nil {
+		return err
+	}
+	defer basesLock.Unlock()
+
+	s, err := NewStorage(config)
+	if err != nil {
+		return err
+	}
+	defer s.Detach()
+
+	grace, err := config.gcPolicy().gracePeriod()
+	if err != nil {
+		return err
+	}
+
+	cache, err := readBuildCache(config)
+	if err != nil {
+		return err
+	}
+
+	// and the snapshots the cache's entries in namespaces keep
+	thingsToKeep := map[string]bool{}
+	for _, ent := range cache.Cache {
+		if ent.Snapshot != "" {
+			thingsToKeep[ent.Snapshot] = true
+		}
+	}
+
+	err = gcForOCILayout(config.OCIDir, grace, cachedImages(cache), thingsToKeep)
+	if err != nil {
+		return err
+	}
+
+	if err := recordGC(config); err != nil {
+		return err
+	}
+
+	err = gcForOCILayout(path.Join(config.StackerDir, "layer-bases", "oci"), grace, nil, thingsToKeep)
+	if err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(config.RootFSDir)
+	if err != nil {
+		return err
+	}
+
+	for _, ent := range entries {
+		_, used := thingsToKeep[ent.Name()]
+		if used {
+			continue
+		}
+
+		// another stacker is building in it right now
+		if isLocked(config, workingLockName(ent.Name())) {
+			continue
+		}
+
+		err = s.Delete(ent.Name())
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.SharedBlobDir != "" {
+		err = gcSharedBlobs(config.SharedBlobDir, grace)
+	}
+
+	return err
+}
@@ -0,0 +1,108 @@
+package stacker
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestGCLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_gc_test")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	layout := path.Join(dir, "oci")
+	oci, err := umoci.CreateLayout(layout)
+	if err != nil {
+		t.Fatalf("couldn't create layout: %v", err)
+	}
+	defer oci.Close()
+
+	ctx := context.Background()
+	desc := putImage(t, oci, ispec.MediaTypeImageLayer, "tagged")
+	if err := oci.UpdateReference(ctx, "app", desc); err != nil {
+		t.Fatalf("couldn't tag image: %v", err)
+	}
+
+	// an image in the build cache, whose tag has moved on
+	cached := putImage(t, oci, ispec.MediaTypeImageLayer, "cached")
+
+	unused, _, err := oci.PutBlob(ctx, bytes.NewBufferString("unused"))
+	if err != nil {
+		t.Fatalf("couldn't put blob: %v", err)
+	}
+
+	// the unused blob was just written, so the grace period keeps it
+	if err := gcLayout(oci, layout, time.Hour, nil); err != nil {
+		t.Fatalf("couldn't gc: %v", err)
+	}
+
+	if _, err := os.Stat(blobPath(layout, unused)); err != nil {
+		t.Errorf("blob in its grace period was removed: %v", err)
+	}
+
+	if err := gcLayout(oci, layout, 0, []ispec.Descriptor{cached}); err != nil {
+		t.Fatalf("couldn't gc: %v", err)
+	}
+
+	if _, err := os.Stat(blobPath(layout, unused)); !os.IsNotExist(err) {
+		t.Errorf("unused blob was kept: %v", err)
+	}
+
+	if _, err := os.Stat(blobPath(layout, desc.Digest)); err != nil {
+		t.Errorf("tagged manifest was removed: %v", err)
+	}
+
+	if _, err := os.Stat(blobPath(layout, cached.Digest)); err != nil {
+		t.Errorf("cached manifest was removed: %v", err)
+	}
+}
+
+func TestGCDue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_gc_test")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := StackerConfig{StackerDir: dir}
+	scheduled := GCPolicy{Mode: GCScheduled, Interval: "1h"}
+
+	for _, c := range []struct {
+		policy GCPolicy
+		due    bool
+	}{
+		{config.gcPolicy(), true},
+		{GCPolicy{Mode: GCOff}, false},
+		{scheduled, true},
+	} {
+		due, err := gcDue(config, c.policy)
+		if err != nil {
+			t.Fatalf("gcDue(%v) failed: %v", c.policy, err)
+		}
+		if due != c.due {
+			t.Errorf("gcDue(%v) is %v", c.policy, due)
+		}
+	}
+
+	if err := recordGC(config); err != nil {
+		t.Fatalf("couldn't record gc: %v", err)
+	}
+
+	if due, err := gcDue(config, scheduled); err != nil || due {
+		t.Errorf("scheduled gc is due right after one: %v %v", due, err)
+	}
+
+	if _, err := gcDue(config, GCPolicy{Mode: GCScheduled}); err == nil {
+		t.Errorf("scheduled gc without an interval was accepted")
+	}
+}
@@ -1,8 +1,12 @@
 package stacker
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"net/url"
+	"os"
 	"os/exec"
+	"path"
 	"strings"
 )
 
@@ -71,3 +75,78 @@ func NewGitLayerTag(path string) (string, error) {
 	// Add commit id in tag
 	return "commit-" + hash, nil
 }
+
+// gitStackerfileURL is a stackerfile in a git repo, written as
+// <repo url>//<path in repo>?ref=<ref>, e.g.
+// https://github.com/org/repo.git//images/stacker.yaml?ref=v1.2
+type gitStackerfileURL struct {
+	repo string
+	path string
+	ref  string
+}
+
+func parseGitStackerfileURL(raw string) (*gitStackerfileURL, bool) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" {
+		return nil, false
+	}
+
+	idx := strings.Index(u.Path, "//")
+	if idx < 0 {
+		return nil, false
+	}
+
+	g := &gitStackerfileURL{
+		path: u.Path[idx+2:],
+		ref:  u.Query().Get("ref"),
+	}
+
+	repo := *u
+	repo.Path = u.Path[:idx]
+	repo.RawQuery = ""
+	g.repo = repo.String()
+
+	return g, true
+}
+
+func runGit(args ...string) error {
+	output, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git %s failed: %s: %s", strings.Join(args, " "), err, output)
+	}
+
+	return nil
+}
+
+// checkout fetches g's ref (or the remote's HEAD, if there is no ref) into a
+// clone of the repo in cloneDir, re-using the clone from earlier builds if
+// there is one, and returns the path to the clone.
+func (g *gitStackerfileURL) checkout(config StackerConfig, cloneDir string) (string, error) {
+	dir := path.Join(cloneDir, fmt.Sprintf("%x", sha256.Sum256([]byte(g.repo))))
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := runGit("init", "-q", dir); err != nil {
+			return "", err
+		}
+
+		if err := runGit("-C", dir, "remote", "add", "origin", g.repo); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+
+	ref := g.ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	verbosef(config, "fetching %s from %s\n", ref, g.repo)
+	if err := runGit("-C", dir, "fetch", "-q", "--depth", "1", "origin", ref); err != nil {
+		return "", err
+	}
+
+	if err := runGit("-C", dir, "checkout", "-q", "--force", "FETCH_HEAD"); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
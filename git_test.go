@@ -0,0 +1,80 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+func TestParseGitStackerfileURL(t *testing.T) {
+	g, ok := parseGitStackerfileURL("https://github.com/org/repo.git//images/stacker.yaml?ref=v1.2")
+	if !ok {
+		t.Fatalf("git url not recognized")
+	}
+
+	if g.repo != "https://github.com/org/repo.git" || g.path != "images/stacker.yaml" || g.ref != "v1.2" {
+		t.Fatalf("bad git url: %+v", g)
+	}
+
+	for _, notGit := range []string{"stacker.yaml", "/src/stacker.yaml", "https://example.com/stacker.yaml"} {
+		if _, ok := parseGitStackerfileURL(notGit); ok {
+			t.Errorf("%s recognized as a git url", notGit)
+		}
+	}
+}
+
+func TestGitStackerfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_test_")
+	if err != nil {
+		t.Fatalf("couldn't create tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := path.Join(dir, "repo")
+	if err := os.MkdirAll(path.Join(repo, "images"), 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+	writeStackerfile(t, path.Join(repo, "images"), "stacker.yaml", `centos:
+    from:
+        type: docker
+        url: docker://centos:latest
+    import: config.json
+`)
+
+	for _, args := range [][]string{
+		{"init", "-q", repo},
+		{"-C", repo, "add", "."},
+		{"-C", repo, "-c", "user.name=stacker", "-c", "user.email=stacker@example.com", "commit", "-q", "-m", "initial"},
+		{"-C", repo, "tag", "v1.0"},
+	} {
+		if output, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %s: %s", args, err, output)
+		}
+	}
+
+	source := "file://" + repo + "//images/stacker.yaml?ref=v1.0"
+	sf, err := NewStackerfileWithOpts(source, StackerfileOpts{GitCloneDir: path.Join(dir, "clones")})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	l, ok := sf.Get("centos")
+	if !ok {
+		t.Fatalf("missing centos layer")
+	}
+
+	imports, err := l.ParseImport()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(imports) != 1 || imports[0] != path.Join(sf.referenceDirectory, "config.json") {
+		t.Fatalf("import not relative to the repo root: %v", imports)
+	}
+
+	if sf.source != source {
+		t.Fatalf("bad source: %s", sf.source)
+	}
+}
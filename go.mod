@@ -16,7 +16,8 @@ require (
 	github.com/containerd/continuity v0.0.0-20181203112020-004b46473808 // indirect
 	github.com/containers/image v0.0.0-20190306164208-8e82e04fe1bb
 	github.com/containers/storage v0.0.0-20190207215558-06b6c2e4cf25 // indirect
-	github.com/docker/distribution v0.0.0-20190205005809-0d3efadf0154 // indirect
+	github.com/cyphar/filepath-securejoin v0.2.2
+	github.com/docker/distribution v0.0.0-20190205005809-0d3efadf0154
 	github.com/docker/docker v0.0.0-20190207111444-e6fe7f8f2936 // indirect
 	github.com/docker/docker-credential-helpers v0.0.0-20180925085122-123ba1b7cd64 // indirect
 	github.com/docker/go-connections v0.0.0-20180821093606-97c2040d34df // indirect
@@ -27,7 +28,7 @@ require (
 	github.com/flynn/go-shlex v0.0.0-20150515145356-3f9db97f8568 // indirect
 	github.com/freddierice/go-losetup v0.0.0-20170407175016-fc9adea44124
 	github.com/ghodss/yaml v0.0.0-20190206175653-d4115522f0fe // indirect
-	github.com/golang/protobuf v1.3.1 // indirect
+	github.com/golang/protobuf v1.3.1
 	github.com/google/go-cmp v0.2.0 // indirect
 	github.com/gorilla/mux v1.7.0 // indirect
 	github.com/gorilla/websocket v0.0.0-20190205004414-7c8e298727d1 // indirect
@@ -71,6 +72,7 @@ require (
 	golang.org/x/crypto v0.0.0-20190325154230-a5d413f7728c // indirect
 	golang.org/x/net v0.0.0-20190327091125-710a502c58a2 // indirect
 	golang.org/x/sys v0.0.0-20190322080309-f49334f85ddc
+	google.golang.org/grpc v1.19.1
 	gopkg.in/cheggaaa/pb.v1 v1.0.27 // indirect
 	gopkg.in/lxc/go-lxc.v2 v2.0.0-20181227225324-7c910f8a5edc
 	gopkg.in/robfig/cron.v2 v2.0.0-20150107220207-be2e0b0deed5 // indirect
@@ -1,28 +1,320 @@
 package stacker
 
 import (
+	"archive/tar"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// whiteoutPrefix marks an OCI layer entry that removes the file
+	// it's named after from the layers below.
+	whiteoutPrefix = ".wh."
+
+	// whiteoutOpaque empties the directory it's in.
+	whiteoutOpaque = ".wh..wh..opq"
 )
 
-func Grab(sc StackerConfig, name string, source string) error {
-	c, err := newContainer(sc, WorkingContainerName)
+// grabPaths are the paths in an image, relative to its root, that
+// grabFromLayers looks for in its layers, and the ones that the symlinks on
+// the way to them lead to.
+type grabPaths map[string]bool
+
+// imagePath returns p, which is absolute or relative to the root of an
+// image, relative to the root, as the entries of tar layers are.
+func imagePath(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+func newGrabPaths(paths []string) grabPaths {
+	g := grabPaths{}
+	for _, p := range paths {
+		g[imagePath(p)] = true
+	}
+	return g
+}
+
+// isUnder returns whether p is dir or something in it.
+func isUnder(p string, dir string) bool {
+	return p == dir || dir == "." || strings.HasPrefix(p, dir+"/")
+}
+
+// related returns whether the layer entry at p (relative to the root) is one
+// of the paths, in one of them, or a directory (or symlink) on the way to
+// one of them.
+func (g grabPaths) related(p string) bool {
+	for want := range g {
+		if isUnder(p, want) || isUnder(want, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// followLink adds what the paths that go through the symlink at p, to
+// target, are once it's followed.
+func (g grabPaths) followLink(p string, target string) {
+	if !path.IsAbs(target) {
+		target = path.Join("/", path.Dir(p), target)
+	}
+
+	for want := range g {
+		if want != p && isUnder(want, p) {
+			g[imagePath(path.Join(target, strings.TrimPrefix(want, p+"/")))] = true
+		}
+	}
+}
+
+// entryTarget is what the layer entry name changes: the file itself, the file
+// a whiteout removes, or the directory an opaque whiteout empties.
+func entryTarget(name string) string {
+	dir, file := path.Split(name)
+	switch {
+	case file == whiteoutOpaque:
+		return imagePath(dir)
+	case strings.HasPrefix(file, whiteoutPrefix):
+		return imagePath(path.Join(dir, strings.TrimPrefix(file, whiteoutPrefix)))
+	default:
+		return imagePath(name)
+	}
+}
+
+// grabTarLayer extracts the entries of the tar layer in r that have to do
+// with the paths into root.
+func grabTarLayer(r io.Reader, root string, paths grabPaths) error {
+	tr := tar.NewReader(r)
+	te := layer.NewTarExtractor(layer.MapOptions{KeepDirlinks: true, Rootless: os.Geteuid() != 0})
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name := imagePath(hdr.Name)
+		if name == "." || !paths.related(entryTarget(name)) {
+			continue
+		}
+
+		if hdr.Typeflag == tar.TypeSymlink {
+			paths.followLink(name, hdr.Linkname)
+		}
+
+		if err := te.UnpackEntry(root, hdr, tr); err != nil {
+			return errors.Wrapf(err, "couldn't extract %s", hdr.Name)
+		}
+	}
+}
+
+// maxSymlinks is how many times grabLayers goes through the layers again
+// for paths it finds symlinks on the way to, like the kernel's limit on the
+// symlinks in a path.
+const maxSymlinks = 40
+
+// grabLayers runs the layers' extract functions, bottom layer first, to
+// extract what has to do with the paths in want into root, so that the ones
+// on top win. A file can come before a symlink to its directory (in the same
+// layer or a lower one), so the layers are gone through again, from scratch,
+// when symlinks lead to paths that weren't looked for.
+func grabLayers(root string, want grabPaths, layers []func(root string, want grabPaths) error) error {
+	for i := 0; i < maxSymlinks; i++ {
+		before := len(want)
+		for _, extract := range layers {
+			if err := extract(root, want); err != nil {
+				return err
+			}
+		}
+
+		if len(want) == before {
+			return nil
+		}
+
+		if err := os.RemoveAll(root); err != nil {
+			return err
+		}
+		if err := os.Mkdir(root, 0700); err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("too many levels of symlinks")
+}
+
+// grabFromLayers extracts the paths from the layers of the image manifest in
+// oci (whose layout is at layout) into root. Only symlinks in tar layers are
+// followed: the paths in squashfs layers have to be where the files are.
+func grabFromLayers(config StackerConfig, oci casext.Engine, layout string, manifest ispec.Manifest, paths []string, root string) error {
+	layers := []func(string, grabPaths) error{}
+	for _, l := range manifest.Layers {
+		l := l
+		if l.MediaType == stackeroci.MediaTypeLayerSquashfs {
+			layers = append(layers, func(root string, want grabPaths) error {
+				args := []string{config.ToolPath(ToolUnsquashfs), "-f", "-d", root, blobPath(layout, l.Digest)}
+				for p := range want {
+					args = append(args, p)
+				}
+
+				return MaybeRunInUserns(args, "couldn't unsquashfs layer")
+			})
+			continue
+		}
+
+		layers = append(layers, func(root string, want grabPaths) error {
+			blob, err := oci.FromDescriptor(context.Background(), l)
+			if err != nil {
+				return err
+			}
+			defer blob.Close()
+
+			reader, needsClose, err := getReader(blob)
+			if err != nil {
+				return err
+			}
+			if needsClose {
+				defer reader.Close()
+			}
+
+			return errors.Wrapf(grabTarLayer(reader, root, want), "couldn't read layer %s", l.Digest)
+		})
+	}
+
+	return grabLayers(root, newGrabPaths(paths), layers)
+}
+
+// isWhiteout returns whether fi is an overlay whiteout, which is what
+// squashfs layers have for the files they remove.
+func isWhiteout(fi os.FileInfo) bool {
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	st, ok := fi.Sys().(*unix.Stat_t)
+	return ok && st.Rdev == 0
+}
+
+// GrabFiles copies the paths (absolute, in the image) out of the image tag,
+// built or pulled, into the directory dest, each as dest/<its base name>,
+// the way cp -a would. Nothing is unpacked: they're copied from the
+// snapshot of tag when it was built here, or else extracted from just the
+// entries of its layers that have to do with them.
+func GrabFiles(config StackerConfig, tag string, paths []string, dest string) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("nothing to grab from %s", tag)
+	}
+
+	dest, err := filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		if _, err := os.Lstat(path.Join(dest, path.Base(p))); err == nil {
+			return fmt.Errorf("%s is already in %s", path.Base(p), dest)
+		}
+	}
+
+	ociLock, err := LockOCIDir(config)
+	if err != nil {
+		return err
+	}
+	defer ociLock.Unlock()
+
+	basesLock, err := lockOrWait(config, "layer-bases", "the base image import layout")
+	if err != nil {
+		return err
+	}
+	defer basesLock.Unlock()
+
+	s, err := NewStorage(config)
 	if err != nil {
 		return err
 	}
-	defer c.Close()
+	defer s.Detach()
+
+	if s.Exists(tag) {
+		rootfs := path.Join(config.RootFSDir, tag, "rootfs")
+		for _, p := range paths {
+			source, err := securejoin.SecureJoin(rootfs, p)
+			if err != nil {
+				return err
+			}
+
+			if _, err := os.Lstat(source); err != nil {
+				return errors.Wrapf(err, "couldn't find %s in %s", p, tag)
+			}
+
+			// the copies keep their owners, so do them in the
+			// user namespace when unprivileged
+			msg := fmt.Sprintf("couldn't grab %s from %s", p, tag)
+			if err := MaybeRunInUserns([]string{"cp", "-a", source, path.Join(dest, path.Base(p))}, msg); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
 
-	cwd, err := os.Getwd()
+	layout, err := findImage(config, tag)
 	if err != nil {
 		return err
 	}
 
-	err = c.bindMount(cwd, "/stacker", "")
+	oci, err := umoci.OpenLayout(layout)
 	if err != nil {
 		return err
 	}
-	defer os.Remove(path.Join(sc.RootFSDir, WorkingContainerName, "rootfs", "stacker"))
+	defer oci.Close()
+
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return err
+	}
+
+	root, err := ioutil.TempDir(dest, ".stacker-grab-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(root)
+
+	if err := grabFromLayers(config, oci, layout, manifest, paths, root); err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		source, err := securejoin.SecureJoin(root, p)
+		if err != nil {
+			return err
+		}
+
+		fi, err := os.Lstat(source)
+		if err != nil || isWhiteout(fi) {
+			return fmt.Errorf("couldn't find %s in %s", p, tag)
+		}
+
+		if err := os.Rename(source, path.Join(dest, path.Base(p))); err != nil {
+			return err
+		}
+	}
 
-	return c.execute(fmt.Sprintf("cp -a %s /stacker", source), nil)
+	return nil
 }
@@ -0,0 +1,103 @@
+package stacker
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	link     string
+}
+
+func makeTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0755, Linkname: e.link, Size: int64(len(e.content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("%s", err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("%s", err)
+	}
+	return buf
+}
+
+func TestGrabTarLayers(t *testing.T) {
+	root, err := ioutil.TempDir("", "stacker_grab_test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(root)
+
+	bottom := makeTar(t, []tarEntry{
+		{name: "usr/", typeflag: tar.TypeDir},
+		{name: "usr/bin/", typeflag: tar.TypeDir},
+		{name: "usr/bin/app", typeflag: tar.TypeReg, content: "app"},
+		{name: "usr/bin/other", typeflag: tar.TypeReg, content: "other"},
+		{name: "bin", typeflag: tar.TypeSymlink, link: "usr/bin"},
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/version", typeflag: tar.TypeReg, content: "1"},
+		{name: "etc/gone", typeflag: tar.TypeReg, content: "gone"},
+		{name: "etc/passwd", typeflag: tar.TypeReg, content: "root"},
+	})
+
+	top := makeTar(t, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/version", typeflag: tar.TypeReg, content: "2"},
+		{name: "etc/.wh.gone", typeflag: tar.TypeReg},
+	})
+
+	layers := []func(string, grabPaths) error{}
+	for _, l := range []*bytes.Buffer{bottom, top} {
+		content := l.Bytes()
+		layers = append(layers, func(root string, want grabPaths) error {
+			return grabTarLayer(bytes.NewReader(content), root, want)
+		})
+	}
+
+	// the symlink comes after what it leads to
+	want := newGrabPaths([]string{"/bin/app", "/etc/version", "/etc/gone"})
+	if err := grabLayers(root, want, layers); err != nil {
+		t.Fatalf("couldn't grab from layers: %v", err)
+	}
+
+	for p, content := range map[string]string{"usr/bin/app": "app", "etc/version": "2"} {
+		got, err := ioutil.ReadFile(path.Join(root, p))
+		if err != nil {
+			t.Errorf("%s wasn't grabbed: %v", p, err)
+		} else if string(got) != content {
+			t.Errorf("bad %s: %q", p, got)
+		}
+	}
+
+	for _, p := range []string{"usr/bin/other", "etc/passwd", "etc/gone"} {
+		if _, err := os.Lstat(path.Join(root, p)); err == nil {
+			t.Errorf("%s was grabbed", p)
+		}
+	}
+}
+
+func TestEntryTarget(t *testing.T) {
+	for name, target := range map[string]string{
+		"./etc/passwd":       "etc/passwd",
+		"etc/.wh.shadow":     "etc/shadow",
+		"etc/.wh..wh..opq":   "etc",
+		"/usr/bin/../lib/x/": "usr/lib/x",
+	} {
+		if got := entryTarget(imagePath(name)); got != target {
+			t.Errorf("%s: got %s, expected %s", name, got, target)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package stacker
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+// maxCreatedByLine is how much of the first run command is kept in a
+// layer's history; long enough to recognize it, short enough that docker
+// history is still readable.
+const maxCreatedByLine = 80
+
+// layerCreatedBy summarizes how the layer l was built for its history entry:
+// the first line of its run commands, plus a hash of all of them if that's
+// not the whole script, so that history entries can be told apart.
+func layerCreatedBy(name string, l *Layer) (string, error) {
+	run, err := l.ParseRun()
+	if err != nil {
+		return "", err
+	}
+
+	if len(run) == 0 {
+		return fmt.Sprintf("stacker build %s", name), nil
+	}
+
+	script := strings.TrimSpace(strings.Join(run, "\n"))
+	lines := strings.Split(script, "\n")
+	first := lines[0]
+	if len(first) > maxCreatedByLine {
+		first = first[:maxCreatedByLine] + "..."
+	}
+
+	createdBy := fmt.Sprintf("/bin/sh -c %s", first)
+	if len(lines) == 1 && first == lines[0] {
+		return createdBy, nil
+	}
+
+	return fmt.Sprintf("%s # run script sha256:%x", createdBy, sha256.Sum256([]byte(script))), nil
+}
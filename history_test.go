@@ -0,0 +1,35 @@
+package stacker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLayerCreatedBy(t *testing.T) {
+	createdBy, err := layerCreatedBy("empty", &Layer{})
+	if err != nil || createdBy != "stacker build empty" {
+		t.Fatalf("bad created_by for a layer without run: %s %v", createdBy, err)
+	}
+
+	createdBy, err = layerCreatedBy("one", &Layer{Run: "apt-get install -y curl"})
+	if err != nil || createdBy != "/bin/sh -c apt-get install -y curl" {
+		t.Fatalf("bad created_by for one command: %s %v", createdBy, err)
+	}
+
+	createdBy, err = layerCreatedBy("many", &Layer{Run: []interface{}{"apt-get update", "apt-get install -y curl"}})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !strings.HasPrefix(createdBy, "/bin/sh -c apt-get update # run script sha256:") {
+		t.Fatalf("bad created_by for several commands: %s", createdBy)
+	}
+
+	long := strings.Repeat("x", 2*maxCreatedByLine)
+	createdBy, err = layerCreatedBy("long", &Layer{Run: long})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if strings.Contains(createdBy, long) || !strings.Contains(createdBy, "sha256:") {
+		t.Fatalf("bad created_by for a long command: %s", createdBy)
+	}
+}
@@ -0,0 +1,86 @@
+package stacker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+)
+
+const (
+	PreRunHook    = "pre_run"
+	PostBuildHook = "post_build"
+)
+
+// Hooks are commands run on the host (not in the container) around the
+// phases of a layer build. They are run with sh -c, and get information about
+// the layer being built via STACKER_* environment variables.
+type Hooks struct {
+	PreRun    []string `yaml:"pre_run"`
+	PostBuild []string `yaml:"post_build"`
+}
+
+func (h *Hooks) forPhase(phase string) []string {
+	if h == nil {
+		return nil
+	}
+
+	switch phase {
+	case PreRunHook:
+		return h.PreRun
+	case PostBuildHook:
+		return h.PostBuild
+	default:
+		return nil
+	}
+}
+
+// hookEnv is the information passed to the hooks.
+type hookEnv struct {
+	config      StackerConfig
+	stackerfile string
+	name        string
+	digest      string
+	rootfs      string
+}
+
+func (he hookEnv) environ(phase string) []string {
+	return append(os.Environ(),
+		fmt.Sprintf("STACKER_HOOK=%s", phase),
+		fmt.Sprintf("STACKER_LAYER_NAME=%s", he.name),
+		fmt.Sprintf("STACKER_LAYER_DIGEST=%s", he.digest),
+		fmt.Sprintf("STACKER_STACKERFILE=%s", he.stackerfile),
+		fmt.Sprintf("STACKER_ROOTFS=%s", he.rootfs),
+		fmt.Sprintf("STACKER_IMPORTS_DIR=%s", path.Join(he.config.StackerDir, "imports", he.name)),
+		fmt.Sprintf("STACKER_OCI_DIR=%s", he.config.OCIDir),
+		fmt.Sprintf("STACKER_ROOTFS_DIR=%s", he.config.RootFSDir),
+	)
+}
+
+// runHooks runs the global hooks and then the layer's hooks for the given
+// phase. Any hook failing fails the build. The global hooks run in the
+// current directory, and the layer's in the directory of the stackerfile it's
+// in, as its relative paths are.
+func runHooks(phase string, global *Hooks, l *Layer, he hookEnv) error {
+	if err := runHookCommands(phase, global.forPhase(phase), "", he); err != nil {
+		return err
+	}
+
+	return runHookCommands(phase, l.Hooks.forPhase(phase), l.referenceDirectory, he)
+}
+
+func runHookCommands(phase string, hooks []string, dir string, he hookEnv) error {
+	for _, hook := range hooks {
+		infof(he.config, "running %s hook for %s: %s\n", phase, he.name, hook)
+		cmd := exec.Command("sh", "-c", hook)
+		cmd.Dir = dir
+		cmd.Env = he.environ(phase)
+		cmd.Stdout = he.config.stdout()
+		cmd.Stderr = he.config.stderr()
+		if err := cmd.Run(); err != nil {
+			return newError(ErrHookFailed, err, "%s hook %q for %s failed", phase, hook, he.name)
+		}
+	}
+
+	return nil
+}
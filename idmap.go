@@ -0,0 +1,131 @@
+package stacker
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+
+	"github.com/lxc/lxd/shared/idmap"
+	"github.com/pkg/errors"
+)
+
+// parseIdmap parses the "nsid:hostid:range" entries of a uid (or gid) map.
+func parseIdmap(entries []string, isuid bool) ([]idmap.IdmapEntry, error) {
+	which := "g"
+	if isuid {
+		which = "u"
+	}
+
+	set := idmap.IdmapSet{}
+	for _, entry := range entries {
+		var err error
+		set, err = set.Append(fmt.Sprintf("%s:%s", which, entry))
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad %sid map entry %q", which, entry)
+		}
+	}
+
+	return set.Idmap, nil
+}
+
+// NewIdmapSet returns the id map that unprivileged builds use for the user
+// namespace their containers and image (un)packing run in: config's UIDMap
+// and GIDMap, or the current user's /etc/subuid and /etc/subgid delegations
+// for the ones that aren't set, with the current user mapped to root. It
+// returns nil when running as root, which doesn't need one.
+func NewIdmapSet(config StackerConfig) (*idmap.IdmapSet, error) {
+	if os.Geteuid() == 0 {
+		return nil, nil
+	}
+
+	uids, err := parseIdmap(config.UIDMap, true)
+	if err != nil {
+		return nil, err
+	}
+
+	gids, err := parseIdmap(config.GIDMap, false)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &idmap.IdmapSet{}
+	if len(uids) == 0 || len(gids) == 0 {
+		currentUser, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+
+		set, err = idmap.DefaultIdmapSet("", currentUser.Username)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't find subuids for %s", currentUser.Username)
+		}
+	}
+
+	set.Idmap = replaceIdmap(set.Idmap, uids, true)
+	set.Idmap = replaceIdmap(set.Idmap, gids, false)
+
+	/* Let's make our current user the root user in the ns, so that when
+	 * stacker emits files, it does them as the right user.
+	 */
+	hostMap := []idmap.IdmapEntry{
+		idmap.IdmapEntry{
+			Isuid:    true,
+			Hostid:   int64(os.Getuid()),
+			Nsid:     0,
+			Maprange: 1,
+		},
+		idmap.IdmapEntry{
+			Isgid:    true,
+			Hostid:   int64(os.Getgid()),
+			Nsid:     0,
+			Maprange: 1,
+		},
+	}
+
+	for _, hm := range hostMap {
+		if err := set.AddSafe(hm); err != nil {
+			return nil, errors.Wrapf(err, "couldn't map %s to root", hm.ToLxcString()[0])
+		}
+	}
+
+	return set, nil
+}
+
+// replaceIdmap replaces the uid (or gid) entries of current with entries,
+// if there are any.
+func replaceIdmap(current []idmap.IdmapEntry, entries []idmap.IdmapEntry, isuid bool) []idmap.IdmapEntry {
+	if len(entries) == 0 {
+		return current
+	}
+
+	result := []idmap.IdmapEntry{}
+	for _, e := range current {
+		// keep the other half of entries that map both
+		if isuid {
+			e.Isuid = false
+		} else {
+			e.Isgid = false
+		}
+
+		if e.Isuid || e.Isgid {
+			result = append(result, e)
+		}
+	}
+
+	return append(result, entries...)
+}
+
+// SetupIdmap sets IdmapSet from config's UIDMap and GIDMap, if it has any.
+func SetupIdmap(config StackerConfig) error {
+	if len(config.UIDMap) == 0 && len(config.GIDMap) == 0 {
+		return nil
+	}
+
+	set, err := NewIdmapSet(config)
+	if err != nil {
+		return err
+	}
+
+	IdmapSet = set
+	return nil
+}
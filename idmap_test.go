@@ -0,0 +1,46 @@
+package stacker
+
+import (
+	"testing"
+
+	"github.com/lxc/lxd/shared/idmap"
+)
+
+func TestParseIdmap(t *testing.T) {
+	entries, err := parseIdmap([]string{"0:100000:1000", "1000:200000:64536"}, true)
+	if err != nil {
+		t.Fatalf("couldn't parse idmap: %v", err)
+	}
+
+	if len(entries) != 2 || !entries[0].Isuid || entries[0].Isgid || entries[1].Hostid != 200000 || entries[1].Nsid != 1000 {
+		t.Fatalf("bad idmap: %v", entries)
+	}
+
+	for _, bad := range [][]string{{"0:100000"}, {"a:100000:65536"}, {"0:100000:65536", "100:300000:10"}} {
+		if _, err := parseIdmap(bad, false); err == nil {
+			t.Errorf("parsed bad idmap %v", bad)
+		}
+	}
+}
+
+func TestReplaceIdmap(t *testing.T) {
+	current := []idmap.IdmapEntry{{Isuid: true, Isgid: true, Hostid: 1000000, Maprange: 65536}}
+	uids := []idmap.IdmapEntry{{Isuid: true, Hostid: 200000, Maprange: 65536}}
+
+	replaced := replaceIdmap(current, uids, true)
+	if len(replaced) != 2 {
+		t.Fatalf("bad idmap: %v", replaced)
+	}
+
+	if replaced[0].Isuid || !replaced[0].Isgid || replaced[0].Hostid != 1000000 {
+		t.Errorf("gids weren't kept: %v", replaced[0])
+	}
+
+	if replaced[1] != uids[0] {
+		t.Errorf("uids weren't replaced: %v", replaced[1])
+	}
+
+	if unchanged := replaceIdmap(current, nil, false); len(unchanged) != 1 || unchanged[0] != current[0] {
+		t.Errorf("idmap changed without entries: %v", unchanged)
+	}
+}
@@ -0,0 +1,154 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// HealthcheckLabel is the label a layer's healthcheck is stored in. The OCI
+// image config has no healthcheck, so we use the JSON format of docker's
+// image config, which tools converting to docker images can copy over as is.
+const HealthcheckLabel = "ws.tycho.stacker.healthcheck"
+
+// Healthcheck is how the image's container runtime should check that a
+// container from it is working.
+type Healthcheck struct {
+	// Test is either a string to run with /bin/sh -c, a list with the
+	// command and its arguments, or NONE to disable the base's check.
+	Test        interface{} `yaml:"test"`
+	Interval    string      `yaml:"interval"`
+	Timeout     string      `yaml:"timeout"`
+	StartPeriod string      `yaml:"start_period"`
+	Retries     int         `yaml:"retries"`
+}
+
+// dockerHealthcheck is docker's HealthConfig.
+type dockerHealthcheck struct {
+	Test        []string      `json:",omitempty"`
+	Interval    time.Duration `json:",omitempty"`
+	Timeout     time.Duration `json:",omitempty"`
+	StartPeriod time.Duration `json:",omitempty"`
+	Retries     int           `json:",omitempty"`
+}
+
+func (h *Healthcheck) label() (string, error) {
+	dh := dockerHealthcheck{Retries: h.Retries}
+
+	switch test := h.Test.(type) {
+	case string:
+		if test == "NONE" {
+			dh.Test = []string{"NONE"}
+		} else {
+			dh.Test = []string{"CMD-SHELL", test}
+		}
+	case []interface{}:
+		dh.Test = []string{"CMD"}
+		for _, arg := range test {
+			s, ok := arg.(string)
+			if !ok {
+				return "", fmt.Errorf("unknown healthcheck test argument type: %T", arg)
+			}
+			dh.Test = append(dh.Test, s)
+		}
+	default:
+		return "", fmt.Errorf("unknown healthcheck test type: %T", h.Test)
+	}
+
+	for _, d := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"interval", h.Interval, &dh.Interval},
+		{"timeout", h.Timeout, &dh.Timeout},
+		{"start_period", h.StartPeriod, &dh.StartPeriod},
+	} {
+		if d.value == "" {
+			continue
+		}
+
+		parsed, err := time.ParseDuration(d.value)
+		if err != nil {
+			return "", fmt.Errorf("bad healthcheck %s %s: %v", d.name, d.value, err)
+		}
+		*d.dest = parsed
+	}
+
+	content, err := json.Marshal(dh)
+	if err != nil {
+		return "", err
+	}
+
+	return string(content), nil
+}
+
+// ParsePorts returns the layer's exposed ports in the image config's
+// port/protocol format; ports without a protocol are tcp.
+func (l *Layer) ParsePorts() ([]string, error) {
+	ports := []string{}
+	for _, p := range l.Ports {
+		membs := strings.SplitN(p, "/", 2)
+		if len(membs) == 1 {
+			membs = append(membs, "tcp")
+		}
+
+		port, err := strconv.Atoi(membs[0])
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %s", p)
+		}
+
+		switch membs[1] {
+		case "tcp", "udp", "sctp":
+		default:
+			return nil, fmt.Errorf("invalid protocol for port %s", p)
+		}
+
+		ports = append(ports, fmt.Sprintf("%d/%s", port, membs[1]))
+	}
+
+	return ports, nil
+}
+
+// applyRuntimeConfig sets the user, exposed ports, stop signal and healthcheck
+// of imageConfig from l.
+func applyRuntimeConfig(imageConfig *ispec.ImageConfig, l *Layer) error {
+	if l.User != "" {
+		imageConfig.User = l.User
+	}
+
+	ports, err := l.ParsePorts()
+	if err != nil {
+		return err
+	}
+
+	if len(ports) > 0 && imageConfig.ExposedPorts == nil {
+		imageConfig.ExposedPorts = map[string]struct{}{}
+	}
+
+	for _, p := range ports {
+		imageConfig.ExposedPorts[p] = struct{}{}
+	}
+
+	if l.StopSignal != "" {
+		imageConfig.StopSignal = l.StopSignal
+	}
+
+	if l.Healthcheck != nil {
+		label, err := l.Healthcheck.label()
+		if err != nil {
+			return err
+		}
+
+		if imageConfig.Labels == nil {
+			imageConfig.Labels = map[string]string{}
+		}
+		imageConfig.Labels[HealthcheckLabel] = label
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package stacker
+
+import (
+	"testing"
+)
+
+func TestParsePorts(t *testing.T) {
+	l := &Layer{Ports: []string{"80", "53/udp", "8080/tcp"}}
+	ports, err := l.ParsePorts()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(ports) != 3 || ports[0] != "80/tcp" || ports[1] != "53/udp" || ports[2] != "8080/tcp" {
+		t.Fatalf("bad ports: %v", ports)
+	}
+
+	for _, bad := range []string{"http", "0", "70000", "80/icmp"} {
+		l := &Layer{Ports: []string{bad}}
+		if _, err := l.ParsePorts(); err == nil {
+			t.Errorf("bad port %s accepted", bad)
+		}
+	}
+}
+
+func TestHealthcheckLabel(t *testing.T) {
+	content := `healthy:
+    from:
+        type: docker
+        url: docker://centos:latest
+    ports:
+        - 80
+    healthcheck:
+        test: curl -f http://localhost/
+        interval: 30s
+        retries: 3
+`
+	sf := parse(t, content)
+	l, ok := sf.Get("healthy")
+	if !ok {
+		t.Fatalf("missing healthy layer")
+	}
+
+	label, err := l.Healthcheck.label()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	expected := `{"Test":["CMD-SHELL","curl -f http://localhost/"],"Interval":30000000000,"Retries":3}`
+	if label != expected {
+		t.Fatalf("bad healthcheck label: %s", label)
+	}
+
+	ports, err := l.ParsePorts()
+	if err != nil || len(ports) != 1 || ports[0] != "80/tcp" {
+		t.Fatalf("bad ports: %v %v", ports, err)
+	}
+}
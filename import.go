@@ -61,7 +61,7 @@ func filesDiffer(p1 string, info1 os.FileInfo, p2 string, info2 os.FileInfo) (bo
 	return !eq, nil
 }
 
-func importFile(imp string, cacheDir string) (string, error) {
+func importFile(config StackerConfig, imp string, cacheDir string) (string, error) {
 	e1, err := os.Lstat(imp)
 	if err != nil {
 		return "", errors.Wrapf(err, "couldn't stat import %s", imp)
@@ -83,12 +83,12 @@ func importFile(imp string, cacheDir string) (string, error) {
 		}
 
 		if needsCopy {
-			fmt.Printf("copying %s\n", imp)
+			verbosef(config, "copying %s\n", imp)
 			if err := lib.FileCopy(dest, imp); err != nil {
 				return "", errors.Wrapf(err, "couldn't copy import %s", imp)
 			}
 		} else {
-			fmt.Println("using cached copy of", imp)
+			verboseln(config, "using cached copy of", imp)
 		}
 
 		return dest, nil
@@ -165,16 +165,26 @@ func acquireUrl(c StackerConfig, i string, cache string) (string, error) {
 
 	// It's just a path, let's copy it to .stacker.
 	if url.Scheme == "" {
-		return importFile(i, cache)
-	} else if url.Scheme == "http" || url.Scheme == "https" {
-		// otherwise, we need to download it
-		return Download(cache, i)
-	} else if url.Scheme == "stacker" {
-		p := path.Join(c.RootFSDir, url.Host, "rootfs", url.Path)
-		return importFile(p, cache)
+		return importFile(c, i, cache)
 	}
 
-	return "", fmt.Errorf("unsupported url scheme %s", i)
+	scheme, ok := lookupScheme(url.Scheme)
+	if !ok {
+		return "", fmt.Errorf("unsupported url scheme %s", i)
+	}
+
+	p, err := scheme.Fetch(c, i, cache)
+	if err != nil {
+		return "", err
+	}
+
+	if url.Scheme == "http" || url.Scheme == "https" {
+		if err := checkImportPin(c, i, p); err != nil {
+			return "", err
+		}
+	}
+
+	return p, nil
 }
 
 func Import(c StackerConfig, name string, imports []string) error {
@@ -0,0 +1,333 @@
+package stacker
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// includePaths returns the paths of the stackerfiles included by sf, with
+// relative paths made relative to sf.
+func (sf *Stackerfile) includePaths() ([]string, error) {
+	paths := []string{}
+	for _, p := range sf.buildConfig.Include {
+		parsed, err := url.Parse(p)
+		if err != nil {
+			return nil, err
+		}
+
+		if parsed.Scheme != "" || filepath.IsAbs(p) {
+			paths = append(paths, p)
+			continue
+		}
+
+		abs, err := filepath.Abs(filepath.Join(sf.referenceDirectory, p))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, abs)
+	}
+
+	return paths, nil
+}
+
+// loadIncludes reads the stackerfiles sf includes, returning all the layers
+// they define (which have had their own extends resolved already). including
+// is the chain of stackerfiles that included sf, to detect include cycles.
+func (sf *Stackerfile) loadIncludes(opts StackerfileOpts, including []string) ([]map[string]*Layer, error) {
+	paths, err := sf.includePaths()
+	if err != nil {
+		return nil, err
+	}
+
+	chain := append(append([]string{}, including...), sf.path)
+
+	included := []map[string]*Layer{}
+	for _, p := range paths {
+		for _, seen := range chain {
+			if seen == p {
+				return nil, fmt.Errorf("stackerfile: include cycle: %s -> %s", strings.Join(chain, " -> "), p)
+			}
+		}
+
+		inc, err := newStackerfile(p, opts, chain)
+		if err != nil {
+			return nil, err
+		}
+
+		included = append(included, inc.internal)
+	}
+
+	return included, nil
+}
+
+// resolveExtends replaces each layer in sf that extends another layer with
+// the merge of the two. The layer being extended can be defined in sf or in
+// a stackerfile it includes; a layer that extends a layer with its own name
+// extends the included one.
+func (sf *Stackerfile) resolveExtends(opts StackerfileOpts, including []string) error {
+	included, err := sf.loadIncludes(opts, including)
+	if err != nil {
+		return err
+	}
+
+	lookupIncluded := func(name string) (*Layer, bool) {
+		for _, layers := range included {
+			if l, ok := layers[name]; ok {
+				return l, true
+			}
+		}
+		return nil, false
+	}
+
+	resolved := map[string]bool{}
+	var resolve func(name string, chain []string) (*Layer, error)
+	resolve = func(name string, chain []string) (*Layer, error) {
+		l := sf.internal[name]
+		if l.Extends == "" || resolved[name] {
+			return l, nil
+		}
+
+		for _, seen := range chain {
+			if seen == name {
+				return nil, fmt.Errorf("stackerfile: extends cycle: %s -> %s", strings.Join(chain, " -> "), name)
+			}
+		}
+
+		var parent *Layer
+		_, local := sf.internal[l.Extends]
+		if local && l.Extends != name {
+			var err error
+			parent, err = resolve(l.Extends, append(chain, name))
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			var ok bool
+			parent, ok = lookupIncluded(l.Extends)
+			if !ok {
+				return nil, fmt.Errorf("stackerfile: %s extends unknown layer %s", name, l.Extends)
+			}
+		}
+
+		merged, err := mergeLayers(parent, l)
+		if err != nil {
+			return nil, err
+		}
+
+		sf.internal[name] = merged
+		resolved[name] = true
+		return merged, nil
+	}
+
+	for _, name := range sf.fileOrder {
+		if _, err := resolve(name, []string{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func appendUnique(list []string, items ...string) []string {
+	for _, item := range items {
+		found := false
+		for _, existing := range list {
+			if existing == item {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// mergeLayers returns child merged onto parent: lists of commands (run,
+// test, hooks) and copy_from are the parent's followed by the child's;
+// imports, binds, volumes, ports, apply, capabilities, devices, tmpfs,
+// artifacts and secrets are the union of both; environment, build_env, labels and
+// annotations are merged with the child's values winning; the result is
+// privileged if either one is; and everything else is the child's if it set
+// it, and the parent's otherwise. build_only is never inherited. Paths in the
+// result are absolute, since the parent and child may be defined in different
+// directories.
+func mergeLayers(parent *Layer, child *Layer) (*Layer, error) {
+	merged := *child
+
+	if merged.From == nil {
+		merged.From = parent.From
+	}
+
+	parentRun, err := parent.ParseRun()
+	if err != nil {
+		return nil, err
+	}
+	childRun, err := child.ParseRun()
+	if err != nil {
+		return nil, err
+	}
+	if len(parentRun) != 0 || len(childRun) != 0 {
+		merged.Run = append(append([]string{}, parentRun...), childRun...)
+	}
+
+	parentTest, err := parent.ParseTest()
+	if err != nil {
+		return nil, err
+	}
+	childTest, err := child.ParseTest()
+	if err != nil {
+		return nil, err
+	}
+	if len(parentTest) != 0 || len(childTest) != 0 {
+		merged.Test = append(append([]string{}, parentTest...), childTest...)
+	}
+
+	parentCopies, err := parent.ParseCopyFrom()
+	if err != nil {
+		return nil, err
+	}
+	childCopies, err := child.ParseCopyFrom()
+	if err != nil {
+		return nil, err
+	}
+	if len(parentCopies) != 0 || len(childCopies) != 0 {
+		merged.CopyFrom = append(append([]CopyFrom{}, parentCopies...), childCopies...)
+	}
+
+	parentImports, err := parent.ParseImport()
+	if err != nil {
+		return nil, err
+	}
+	childImports, err := child.ParseImport()
+	if err != nil {
+		return nil, err
+	}
+	merged.Import = appendUnique(appendUnique([]string{}, parentImports...), childImports...)
+
+	parentBinds, err := parent.ParseBinds()
+	if err != nil {
+		return nil, err
+	}
+	childBinds, err := child.ParseBinds()
+	if err != nil {
+		return nil, err
+	}
+	binds := []string{}
+	for source, target := range parentBinds {
+		if _, ok := childBinds[source]; !ok {
+			binds = append(binds, fmt.Sprintf("%s -> %s", source, target))
+		}
+	}
+	for source, target := range childBinds {
+		binds = append(binds, fmt.Sprintf("%s -> %s", source, target))
+	}
+	// the layer is hashed for the cache, so don't let map order change it
+	sort.Strings(binds)
+	merged.Binds = binds
+
+	if merged.Cmd == nil {
+		merged.Cmd = parent.Cmd
+	}
+	if merged.Entrypoint == nil {
+		merged.Entrypoint = parent.Entrypoint
+	}
+	if merged.FullCommand == nil {
+		merged.FullCommand = parent.FullCommand
+	}
+	if merged.WorkingDir == "" {
+		merged.WorkingDir = parent.WorkingDir
+	}
+	if merged.User == "" {
+		merged.User = parent.User
+	}
+	if merged.StopSignal == "" {
+		merged.StopSignal = parent.StopSignal
+	}
+	if merged.Healthcheck == nil {
+		merged.Healthcheck = parent.Healthcheck
+	}
+	if merged.OS == "" {
+		merged.OS = parent.OS
+	}
+	if merged.Arch == "" {
+		merged.Arch = parent.Arch
+		if merged.Variant == "" {
+			merged.Variant = parent.Variant
+		}
+	}
+	if merged.MaxSize == "" {
+		merged.MaxSize = parent.MaxSize
+		merged.MaxSizeWarnOnly = parent.MaxSizeWarnOnly
+	}
+
+	parentSeccomp, err := parent.ParseSeccompProfile()
+	if err != nil {
+		return nil, err
+	}
+	childSeccomp, err := child.ParseSeccompProfile()
+	if err != nil {
+		return nil, err
+	}
+	merged.SeccompProfile = childSeccomp
+	if merged.SeccompProfile == "" {
+		merged.SeccompProfile = parentSeccomp
+	}
+	merged.Privileged = parent.Privileged || child.Privileged
+
+	merged.Environment = map[string]string{}
+	for k, v := range parent.Environment {
+		merged.Environment[k] = v
+	}
+	for k, v := range child.Environment {
+		merged.Environment[k] = v
+	}
+
+	merged.BuildEnv = map[string]string{}
+	for k, v := range parent.BuildEnv {
+		merged.BuildEnv[k] = v
+	}
+	for k, v := range child.BuildEnv {
+		merged.BuildEnv[k] = v
+	}
+
+	merged.Labels = map[string]string{}
+	for k, v := range parent.Labels {
+		merged.Labels[k] = v
+	}
+	for k, v := range child.Labels {
+		merged.Labels[k] = v
+	}
+
+	merged.Annotations = map[string]string{}
+	for k, v := range parent.Annotations {
+		merged.Annotations[k] = v
+	}
+	for k, v := range child.Annotations {
+		merged.Annotations[k] = v
+	}
+
+	merged.Ports = appendUnique(appendUnique([]string{}, parent.Ports...), child.Ports...)
+	merged.Volumes = appendUnique(appendUnique([]string{}, parent.Volumes...), child.Volumes...)
+	merged.Apply = appendUnique(appendUnique([]string{}, parent.Apply...), child.Apply...)
+	merged.Capabilities = appendUnique(appendUnique([]string{}, parent.Capabilities...), child.Capabilities...)
+	merged.Devices = appendUnique(appendUnique([]string{}, parent.Devices...), child.Devices...)
+	merged.Tmpfs = appendUnique(appendUnique([]string{}, parent.Tmpfs...), child.Tmpfs...)
+	merged.Artifacts = appendUnique(appendUnique([]string{}, parent.Artifacts...), child.Artifacts...)
+	merged.Secrets = appendUnique(appendUnique([]string{}, parent.Secrets...), child.Secrets...)
+
+	if parent.Hooks != nil || child.Hooks != nil {
+		merged.Hooks = &Hooks{
+			PreRun:    append(append([]string{}, parent.Hooks.forPhase(PreRunHook)...), child.Hooks.forPhase(PreRunHook)...),
+			PostBuild: append(append([]string{}, parent.Hooks.forPhase(PostBuildHook)...), child.Hooks.forPhase(PostBuildHook)...),
+		}
+	}
+
+	return &merged, nil
+}
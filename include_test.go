@@ -0,0 +1,146 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func writeStackerfile(t *testing.T, dir string, name string, content string) string {
+	p := path.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatalf("couldn't write %s: %s", name, err)
+	}
+	return p
+}
+
+func TestExtends(t *testing.T) {
+	content := `base:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: echo base
+    environment:
+        A: a
+        B: b
+    build_only: true
+child:
+    extends: base
+    run: echo child
+    environment:
+        B: c
+`
+	sf := parse(t, content)
+	l, ok := sf.Get("child")
+	if !ok {
+		t.Fatalf("missing child layer")
+	}
+
+	if l.From == nil || l.From.Url != "docker://centos:latest" {
+		t.Fatalf("from not inherited: %v", l.From)
+	}
+
+	run, err := l.ParseRun()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(run) != 2 || run[0] != "echo base" || run[1] != "echo child" {
+		t.Fatalf("bad run: %v", run)
+	}
+
+	if l.Environment["A"] != "a" || l.Environment["B"] != "c" {
+		t.Fatalf("bad environment: %v", l.Environment)
+	}
+
+	if l.BuildOnly {
+		t.Fatalf("build_only was inherited")
+	}
+
+	// neither of them has tests, so the child doesn't either
+	if l.Test != nil {
+		t.Fatalf("bad test: %v", l.Test)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_test_")
+	if err != nil {
+		t.Fatalf("couldn't create tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeStackerfile(t, dir, "common.yaml", `hardened:
+    from:
+        type: docker
+        url: docker://centos:latest
+    import: common.conf
+    run: echo hardening
+`)
+	p := writeStackerfile(t, dir, "stacker.yaml", `stacker_config:
+    include:
+        - common.yaml
+hardened:
+    extends: hardened
+    import: app.conf
+    run: echo app
+`)
+
+	sf, err := NewStackerfile(p, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	l, ok := sf.Get("hardened")
+	if !ok {
+		t.Fatalf("missing hardened layer")
+	}
+
+	imports, err := l.ParseImport()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(imports) != 2 || imports[0] != path.Join(dir, "common.conf") || imports[1] != path.Join(dir, "app.conf") {
+		t.Fatalf("bad imports: %v", imports)
+	}
+
+	run, err := l.ParseRun()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(run) != 2 || run[0] != "echo hardening" || run[1] != "echo app" {
+		t.Fatalf("bad run: %v", run)
+	}
+}
+
+func TestExtendsCycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_test_")
+	if err != nil {
+		t.Fatalf("couldn't create tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := writeStackerfile(t, dir, "stacker.yaml", `a:
+    extends: b
+b:
+    extends: a
+`)
+	_, err = NewStackerfile(p, nil)
+	if err == nil || !strings.Contains(err.Error(), "extends cycle") {
+		t.Fatalf("extends cycle not detected: %v", err)
+	}
+
+	writeStackerfile(t, dir, "one.yaml", `stacker_config:
+    include:
+        - two.yaml
+`)
+	writeStackerfile(t, dir, "two.yaml", `stacker_config:
+    include:
+        - one.yaml
+`)
+	_, err = NewStackerfile(path.Join(dir, "one.yaml"), nil)
+	if err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Fatalf("include cycle not detected: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package stacker
+
+import (
+	"context"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/openSUSE/umoci"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LayerInspection describes a single layer of a built image.
+type LayerInspection struct {
+	Digest    digest.Digest `json:"digest"`
+	Size      int64         `json:"size"`
+	MediaType string        `json:"media_type"`
+}
+
+// ImageInspection is the result of inspecting a tag in the OCI output
+// directory; it is intended to be rendered as JSON.
+type ImageInspection struct {
+	Tag         string            `json:"tag"`
+	Manifest    digest.Digest     `json:"manifest"`
+	Layers      []LayerInspection `json:"layers"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	GitVersion  string            `json:"git_version,omitempty"`
+	Stackerfile string            `json:"stackerfile,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	Provenance  *Provenance       `json:"provenance,omitempty"`
+	Config      ispec.Image       `json:"config"`
+	History     []ispec.History   `json:"history"`
+}
+
+// Inspect looks up tag in config.OCIDir and returns the interesting bits of
+// its manifest and image config.
+func Inspect(config StackerConfig, tag string) (*ImageInspection, error) {
+	oci, err := umoci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return nil, err
+	}
+	defer oci.Close()
+
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	imageConfig, err := stackeroci.LookupConfig(oci, manifest.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	descPaths, err := oci.ResolveReference(context.Background(), tag)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ImageInspection{
+		Tag:         tag,
+		Manifest:    descPaths[0].Descriptor().Digest,
+		Layers:      []LayerInspection{},
+		Annotations: manifest.Annotations,
+		GitVersion:  manifest.Annotations[GitVersionAnnotation],
+		Stackerfile: manifest.Annotations[StackerContentsAnnotation],
+		Source:      manifest.Annotations[StackerSourceAnnotation],
+		Provenance:  recordedProvenance(oci, tag, ProvenanceAnnotation),
+		Config:      imageConfig,
+		History:     imageConfig.History,
+	}
+
+	for _, l := range manifest.Layers {
+		result.Layers = append(result.Layers, LayerInspection{
+			Digest:    l.Digest,
+			Size:      l.Size,
+			MediaType: l.MediaType,
+		})
+	}
+
+	return result, nil
+}
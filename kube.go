@@ -0,0 +1,316 @@
+package stacker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The directories in the pods of KubeRunner's jobs that the build is shipped
+// to, and that the cache volume is mounted at.
+const (
+	kubeBuildDir = "/build"
+	kubeCacheDir = "/var/lib/stacker"
+)
+
+// kubeReadyFile is made in kubeBuildDir once the build has been shipped
+// there, which the job waits for before it starts the build.
+const kubeReadyFile = ".stacker-ready"
+
+// kubePodTimeout is how long a job's pod can take to start.
+const kubePodTimeout = 10 * time.Minute
+
+// KubeRunner runs builds as Kubernetes Jobs, with kubectl: the stackerfiles
+// and the local files they import are shipped to the job's pod, which builds
+// them with the stacker in its image, and its output and events are streamed
+// back.
+type KubeRunner struct {
+	// Image is the image the job runs stacker from.
+	Image string
+
+	// Context and Namespace are the kubectl context and namespace to run
+	// the job in, kubectl's current ones if they aren't set.
+	Context   string
+	Namespace string
+
+	// CacheClaim is the PersistentVolumeClaim the job keeps its stacker
+	// dir, output and rootfses on, so that builds share a build cache. The
+	// job's are thrown away with it if it isn't set.
+	CacheClaim string
+
+	// RegistrySecret is a kubernetes.io/dockerconfigjson secret with the
+	// credentials of the registries the build pulls from and saves to.
+	RegistrySecret string
+
+	// Args are the arguments of the stacker build the job runs.
+	Args []string
+}
+
+func (k *KubeRunner) kubectl(config StackerConfig, args ...string) *exec.Cmd {
+	global := []string{}
+	if k.Context != "" {
+		global = append(global, "--context", k.Context)
+	}
+	if k.Namespace != "" {
+		global = append(global, "--namespace", k.Namespace)
+	}
+	return exec.Command(config.ToolPath(ToolKubectl), append(global, args...)...)
+}
+
+// run runs kubectl with args, returning what it printed.
+func (k *KubeRunner) run(config StackerConfig, args ...string) (string, error) {
+	cmd := k.kubectl(config, args...)
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", errors.Errorf("kubectl %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// job returns the Job called name that builds with args.
+func (k *KubeRunner) job(name string, args []string) map[string]interface{} {
+	command := []string{"stacker",
+		"--stacker-dir", kubeCacheDir + "/stacker",
+		"--oci-dir", kubeCacheDir + "/oci",
+		"--roots-dir", kubeCacheDir + "/roots",
+		// jobs that share the cache each have their own working
+		// container, but there's one OCI dir (the build cache is only
+		// good for the OCI dir it's for), so they build one at a time
+		"--working-container", name,
+		"build", "--wait"}
+	command = append(command, args...)
+	for i := range command {
+		command[i] = shellQuote(command[i])
+	}
+
+	script := fmt.Sprintf("while [ ! -e %s/%s ]; do sleep 1; done; cd %s && exec %s",
+		kubeBuildDir, kubeReadyFile, kubeBuildDir, strings.Join(command, " "))
+
+	cache := map[string]interface{}{"name": "cache", "emptyDir": map[string]interface{}{}}
+	if k.CacheClaim != "" {
+		cache = map[string]interface{}{
+			"name":                  "cache",
+			"persistentVolumeClaim": map[string]interface{}{"claimName": k.CacheClaim},
+		}
+	}
+
+	volumes := []interface{}{
+		map[string]interface{}{"name": "build", "emptyDir": map[string]interface{}{}},
+		cache,
+	}
+	mounts := []interface{}{
+		map[string]interface{}{"name": "build", "mountPath": kubeBuildDir},
+		map[string]interface{}{"name": "cache", "mountPath": kubeCacheDir},
+	}
+
+	// containers/image reads the credentials from docker's config
+	if k.RegistrySecret != "" {
+		volumes = append(volumes, map[string]interface{}{
+			"name": "registry-auth",
+			"secret": map[string]interface{}{
+				"secretName": k.RegistrySecret,
+				"items": []interface{}{
+					map[string]interface{}{"key": ".dockerconfigjson", "path": "config.json"},
+				},
+			},
+		})
+		mounts = append(mounts, map[string]interface{}{"name": "registry-auth", "mountPath": "/root/.docker", "readOnly": true})
+	}
+
+	return map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata": map[string]interface{}{
+			"name":   name,
+			"labels": map[string]interface{}{"app.kubernetes.io/name": "stacker"},
+		},
+		"spec": map[string]interface{}{
+			"backoffLimit": 0,
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"restartPolicy": "Never",
+					"containers": []interface{}{
+						map[string]interface{}{
+							"name":            "stacker",
+							"image":           k.Image,
+							"command":         []string{"/bin/sh", "-c", script},
+							"securityContext": map[string]interface{}{"privileged": true},
+							"volumeMounts":    mounts,
+						},
+					},
+					"volumes": volumes,
+				},
+			},
+		},
+	}
+}
+
+// waitForPod returns the pod of the job name once it's running.
+func (k *KubeRunner) waitForPod(config StackerConfig, name string) (string, error) {
+	deadline := time.Now().Add(kubePodTimeout)
+	for {
+		pod, err := k.run(config, "get", "pods", "-l", "job-name="+name, "-o", "jsonpath={.items[0].metadata.name}")
+		if err == nil && pod != "" {
+			_, err = k.run(config, "wait", "--for=condition=Ready", "pod/"+pod, fmt.Sprintf("--timeout=%s", time.Until(deadline).Round(time.Second)))
+			if err != nil {
+				return "", errors.Wrapf(err, "pod %s didn't start", pod)
+			}
+			return pod, nil
+		}
+
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("job %s didn't start a pod in %s", name, kubePodTimeout)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// podSucceeded waits for pod to finish, and returns whether it succeeded.
+func (k *KubeRunner) podSucceeded(config StackerConfig, pod string) (bool, error) {
+	for {
+		phase, err := k.run(config, "get", "pod", pod, "-o", "jsonpath={.status.phase}")
+		if err != nil {
+			return false, err
+		}
+
+		switch phase {
+		case "Succeeded":
+			return true, nil
+		case "Failed":
+			return false, nil
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Run builds the stackerfile at paths in a job. It, and the files it
+// imports, have to be under the current directory, as for RemoteBuild.
+func (k *KubeRunner) Run(opts *BuildArgs, paths []string) error {
+	if k.Image == "" {
+		return fmt.Errorf("no image to run stacker from in kubernetes")
+	}
+
+	if len(paths) != 1 {
+		return fmt.Errorf("kubernetes jobs build one stackerfile, not %d", len(paths))
+	}
+
+	config := opts.Config
+	for _, tool := range []string{ToolKubectl, ToolTar} {
+		if err := checkTool(tool, config.ToolPath(tool)); err != nil {
+			return err
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	watched, err := watchedPaths(paths, opts)
+	if err != nil {
+		return err
+	}
+
+	files, err := remoteContext(wd, watched)
+	if err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("stacker-build-%x", suffix)
+
+	file := paths[0]
+	if !strings.Contains(file, "://") {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+
+		file, err = filepath.Rel(wd, abs)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the last of each flag wins, and the events are streamed into the
+	// output, which is all the job's log has
+	args := append(append([]string{}, k.Args...), "--stacker-file", file, "--progress", "plain", "--event-stream", "/dev/stdout")
+
+	content, err := json.Marshal(k.job(name, args))
+	if err != nil {
+		return err
+	}
+
+	create := k.kubectl(config, "create", "-f", "-")
+	create.Stdin = bytes.NewReader(content)
+	if output, err := create.CombinedOutput(); err != nil {
+		return errors.Errorf("couldn't create job %s: %v: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	defer func() {
+		if _, err := k.run(config, "delete", "job", name, "--wait=false"); err != nil {
+			warnf(config, "couldn't delete job %s: %v\n", name, err)
+		}
+	}()
+
+	infof(config, "waiting for job %s to start\n", name)
+	pod, err := k.waitForPod(config, name)
+	if err != nil {
+		return err
+	}
+
+	infof(config, "shipping %d files to pod %s\n", len(files), pod)
+	tarArgs := append([]string{"-C", wd, "-cf", "-", "--"}, files...)
+	err = pipe(config,
+		exec.Command(config.ToolPath(ToolTar), tarArgs...),
+		k.kubectl(config, "exec", "-i", pod, "--", "tar", "-C", kubeBuildDir, "-xf", "-"))
+	if err != nil {
+		return errors.Wrapf(err, "couldn't ship the build to pod %s", pod)
+	}
+
+	if _, err := k.run(config, "exec", pod, "--", "touch", kubeBuildDir+"/"+kubeReadyFile); err != nil {
+		return err
+	}
+
+	logs := k.kubectl(config, "logs", "-f", pod)
+	logs.Stderr = config.stderr()
+	r, err := logs.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := logs.Start(); err != nil {
+		return err
+	}
+
+	replayErr := opts.replayEvents(r, config.stdout())
+	if err := logs.Wait(); err != nil {
+		warnf(config, "following the log of pod %s failed: %v\n", pod, err)
+	}
+	if replayErr != nil {
+		return replayErr
+	}
+
+	succeeded, err := k.podSucceeded(config, pod)
+	if err != nil {
+		return err
+	}
+
+	if !succeeded {
+		return fmt.Errorf("build in job %s failed", name)
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package stacker
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestKubeJob(t *testing.T) {
+	k := &KubeRunner{Image: "stacker:latest", CacheClaim: "stacker-cache", RegistrySecret: "regcred"}
+	content, err := json.Marshal(k.job("stacker-build-1234", []string{"--substitute", "FOO=two words"}))
+	if err != nil {
+		t.Fatalf("couldn't marshal job: %v", err)
+	}
+
+	job := struct {
+		Spec struct {
+			Template struct {
+				Spec struct {
+					Containers []struct {
+						Image   string   `json:"image"`
+						Command []string `json:"command"`
+					} `json:"containers"`
+					Volumes []map[string]interface{} `json:"volumes"`
+				} `json:"spec"`
+			} `json:"template"`
+		} `json:"spec"`
+	}{}
+	if err := json.Unmarshal(content, &job); err != nil {
+		t.Fatalf("couldn't unmarshal job: %v", err)
+	}
+
+	pod := job.Spec.Template.Spec
+	if len(pod.Containers) != 1 || pod.Containers[0].Image != "stacker:latest" {
+		t.Fatalf("bad containers %v", pod.Containers)
+	}
+
+	script := pod.Containers[0].Command[2]
+	for _, expected := range []string{
+		"while [ ! -e /build/.stacker-ready ]",
+		"--working-container stacker-build-1234 build --wait --substitute 'FOO=two words'",
+	} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("%q isn't in the job's script %q", expected, script)
+		}
+	}
+
+	names := []string{}
+	for _, v := range pod.Volumes {
+		names = append(names, v["name"].(string))
+	}
+	if strings.Join(names, ",") != "build,cache,registry-auth" {
+		t.Errorf("bad volumes %v", pod.Volumes)
+	}
+
+	if claim, ok := pod.Volumes[1]["persistentVolumeClaim"].(map[string]interface{}); !ok || claim["claimName"] != "stacker-cache" {
+		t.Errorf("cache isn't the claim: %v", pod.Volumes[1])
+	}
+}
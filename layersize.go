@@ -0,0 +1,228 @@
+package stacker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/dustin/go-humanize"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vbatts/go-mtree"
+)
+
+// largestPathsShown is how many of the largest files and directories are
+// shown when a layer is bigger than its max_size.
+const largestPathsShown = 10
+
+// PathSize is the size of a file in a rootfs, or of the files in a directory
+// of it.
+type PathSize struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// ParseMaxSize returns the layer's max_size in bytes, or 0 if it doesn't have
+// one.
+func (l *Layer) ParseMaxSize() (int64, error) {
+	if l.MaxSize == "" {
+		return 0, nil
+	}
+
+	size, err := humanize.ParseBytes(l.MaxSize)
+	if err != nil {
+		return 0, fmt.Errorf("bad max_size %s: %v", l.MaxSize, err)
+	}
+
+	return int64(size), nil
+}
+
+// rootfsChanges returns the sizes of the files that were added or modified
+// in the working container's rootfs since its base was unpacked. It has to
+// be called before the layer with them is generated, which replaces the
+// base's mtree.
+func rootfsChanges(config StackerConfig) ([]PathSize, error) {
+	bundlePath := path.Join(config.RootFSDir, config.WorkingContainer())
+	meta, err := umoci.ReadBundleMeta(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+
+	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
+	mfh, err := os.Open(path.Join(bundlePath, mtreeName+".mtree"))
+	if err != nil {
+		return nil, err
+	}
+	defer mfh.Close()
+
+	spec, err := mtree.ParseSpec(mfh)
+	if err != nil {
+		return nil, err
+	}
+
+	rootfs := path.Join(bundlePath, "rootfs")
+	dh, err := walkRootfs(rootfs, umoci.MtreeKeywords, fseval.DefaultFsEval, path.Join(config.StackerDir, "mtree.cache"))
+	if err != nil {
+		return nil, err
+	}
+
+	diffs, err := mtree.CompareSame(spec, dh, umoci.MtreeKeywords)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []PathSize{}
+	for _, diff := range diffs {
+		if diff.Type() != mtree.Modified && diff.Type() != mtree.Extra {
+			continue
+		}
+
+		st, err := os.Lstat(path.Join(rootfs, diff.Path()))
+		if err != nil || st.IsDir() {
+			continue
+		}
+
+		changes = append(changes, PathSize{Path: "/" + strings.TrimPrefix(diff.Path(), "./"), Size: st.Size()})
+	}
+
+	return changes, nil
+}
+
+// largestFiles returns the n biggest of changes, biggest first.
+func largestFiles(changes []PathSize, n int) []PathSize {
+	files := append([]PathSize{}, changes...)
+	sortBySize(files)
+	if len(files) > n {
+		files = files[:n]
+	}
+	return files
+}
+
+// largestDirs returns the n directories whose changed files add up to the
+// most, biggest first.
+func largestDirs(changes []PathSize, n int) []PathSize {
+	sizes := map[string]int64{}
+	for _, c := range changes {
+		for dir := path.Dir(c.Path); ; dir = path.Dir(dir) {
+			sizes[dir] += c.Size
+			if dir == "/" {
+				break
+			}
+		}
+	}
+
+	dirs := []PathSize{}
+	for dir, size := range sizes {
+		dirs = append(dirs, PathSize{Path: dir, Size: size})
+	}
+	sortBySize(dirs)
+	if len(dirs) > n {
+		dirs = dirs[:n]
+	}
+	return dirs
+}
+
+func sortBySize(paths []PathSize) {
+	sort.Slice(paths, func(i, j int) bool {
+		if paths[i].Size != paths[j].Size {
+			return paths[i].Size > paths[j].Size
+		}
+		return paths[i].Path < paths[j].Path
+	})
+}
+
+// formatPathSizes is paths, one per line, for people.
+func formatPathSizes(paths []PathSize) string {
+	lines := []string{}
+	for _, p := range paths {
+		lines = append(lines, fmt.Sprintf("  %10s  %s", humanize.IBytes(uint64(p.Size)), p.Path))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// reportLayerSize prints the n biggest of the changes that went into the
+// layer name, and the directories they add up to the most in, and records
+// them in its report.
+func reportLayerSize(config StackerConfig, name string, changes []PathSize, n int, report *LayerReport) {
+	total := int64(0)
+	for _, c := range changes {
+		total += c.Size
+	}
+
+	report.LargestFiles = largestFiles(changes, n)
+	report.LargestDirs = largestDirs(changes, n)
+
+	infof(config, "%s added or changed %d files, %s:\n%s\nin:\n%s\n", name, len(changes), humanize.IBytes(uint64(total)),
+		formatPathSizes(report.LargestFiles), formatPathSizes(report.LargestDirs))
+}
+
+// generatedSize is the size of the layers in the image name that aren't in
+// its base, whose manifest is base.
+func generatedSize(oci casext.Engine, name string, base ispec.Descriptor) (int64, error) {
+	manifest, err := stackeroci.LookupManifest(oci, name)
+	if err != nil {
+		return 0, err
+	}
+
+	baseLayers := map[string]bool{}
+	blob, err := oci.FromDescriptor(context.Background(), base)
+	if err != nil {
+		return 0, err
+	}
+	defer blob.Close()
+
+	if baseManifest, ok := blob.Data.(ispec.Manifest); ok {
+		for _, l := range baseManifest.Layers {
+			baseLayers[l.Digest.String()] = true
+		}
+	}
+
+	size := int64(0)
+	for _, l := range manifest.Layers {
+		if !baseLayers[l.Digest.String()] {
+			size += l.Size
+		}
+	}
+
+	return size, nil
+}
+
+// checkLayerSize compares the size of the layers generated for name with
+// the layer's max_size, and fails with ErrOverBudget (or, if the layer says
+// so, only warns) if they're bigger, showing the biggest of changes.
+func checkLayerSize(config StackerConfig, oci casext.Engine, name string, l *Layer, base ispec.Descriptor, changes []PathSize) error {
+	max, err := l.ParseMaxSize()
+	if err != nil || max == 0 {
+		return err
+	}
+
+	size, err := generatedSize(oci, name, base)
+	if err != nil {
+		return err
+	}
+
+	if size <= max {
+		verbosef(config, "%s is %s, within its max_size of %s\n", name, humanize.IBytes(uint64(size)), humanize.IBytes(uint64(max)))
+		return nil
+	}
+
+	msg := fmt.Sprintf("%s is %s, more than its max_size of %s", name, humanize.IBytes(uint64(size)), humanize.IBytes(uint64(max)))
+	if len(changes) > 0 {
+		msg = fmt.Sprintf("%s; the biggest changes are:\n%s\nin:\n%s", msg,
+			formatPathSizes(largestFiles(changes, largestPathsShown)),
+			formatPathSizes(largestDirs(changes, largestPathsShown)))
+	}
+
+	if l.MaxSizeWarnOnly {
+		warnln(config, msg)
+		return nil
+	}
+
+	return newError(ErrOverBudget, nil, "%s", msg)
+}
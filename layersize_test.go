@@ -0,0 +1,61 @@
+package stacker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMaxSize(t *testing.T) {
+	l := &Layer{MaxSize: "200MiB"}
+	size, err := l.ParseMaxSize()
+	if err != nil {
+		t.Fatalf("couldn't parse max_size %v", err)
+	}
+	if size != 200*1024*1024 {
+		t.Errorf("bad max_size %d", size)
+	}
+
+	l = &Layer{MaxSize: "lots"}
+	if _, err := l.ParseMaxSize(); err == nil {
+		t.Errorf("bad max_size accepted")
+	}
+}
+
+func TestLargestPaths(t *testing.T) {
+	changes := []PathSize{
+		{Path: "/usr/lib/libbig.so", Size: 100},
+		{Path: "/usr/lib/libsmall.so", Size: 10},
+		{Path: "/usr/bin/tool", Size: 50},
+		{Path: "/etc/config", Size: 1},
+	}
+
+	files := largestFiles(changes, 2)
+	expected := []PathSize{{Path: "/usr/lib/libbig.so", Size: 100}, {Path: "/usr/bin/tool", Size: 50}}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected largest files %v, got %v", expected, files)
+	}
+
+	dirs := largestDirs(changes, 3)
+	expected = []PathSize{{Path: "/", Size: 161}, {Path: "/usr", Size: 160}, {Path: "/usr/lib", Size: 110}}
+	if !reflect.DeepEqual(dirs, expected) {
+		t.Errorf("expected largest dirs %v, got %v", expected, dirs)
+	}
+}
+
+func TestReportLayerSize(t *testing.T) {
+	changes := []PathSize{
+		{Path: "/usr/bin/tool", Size: 50},
+		{Path: "/etc/config", Size: 1},
+	}
+
+	report := &LayerReport{}
+	reportLayerSize(StackerConfig{}, "foo", changes, 1, report)
+
+	if !reflect.DeepEqual(report.LargestFiles, []PathSize{{Path: "/usr/bin/tool", Size: 50}}) {
+		t.Errorf("bad largest files %v", report.LargestFiles)
+	}
+
+	if !reflect.DeepEqual(report.LargestDirs, []PathSize{{Path: "/", Size: 51}}) {
+		t.Errorf("bad largest dirs %v", report.LargestDirs)
+	}
+}
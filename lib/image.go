@@ -7,9 +7,11 @@ import (
 
 	"github.com/containers/image/copy"
 	"github.com/containers/image/docker"
+	"github.com/containers/image/manifest"
 	"github.com/containers/image/oci/layout"
 	"github.com/containers/image/signature"
 	"github.com/containers/image/types"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
@@ -43,11 +45,46 @@ func localRefParser(ref string) (types.ImageReference, error) {
 	return f(parts[1])
 }
 
+// TLSOpts are how to connect to a docker registry over TLS.
+type TLSOpts struct {
+	// CertDir is a directory of CA certificates (*.crt) the registry's
+	// certificate is checked against, in addition to the host's, and a
+	// client certificate (*.cert) and its key (*.key) to authenticate
+	// with.
+	CertDir string
+
+	// Insecure skips checking the registry's certificate, and allows
+	// plain http if the registry doesn't speak https.
+	Insecure bool
+}
+
+func (t TLSOpts) apply(ctx *types.SystemContext) {
+	ctx.DockerCertPath = t.CertDir
+	if t.Insecure {
+		ctx.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	}
+}
+
 type ImageCopyOpts struct {
-	Src      string
-	Dest     string
-	SkipTLS  bool
+	Src  string
+	Dest string
+
+	// SkipTLS is the same as SrcTLS.Insecure.
+	SkipTLS bool
+
+	// SrcTLS and DestTLS are how to connect to Src's and Dest's
+	// registries, if they're docker:// urls.
+	SrcTLS  TLSOpts
+	DestTLS TLSOpts
+
 	Progress io.Writer
+	SrcAuth  *types.DockerAuthConfig
+	DestAuth *types.DockerAuthConfig
+
+	// SrcOS and SrcArch pick the image to copy from a multi-platform
+	// Src, instead of the host's.
+	SrcOS   string
+	SrcArch string
 }
 
 func ImageCopy(opts ImageCopyOpts) error {
@@ -76,16 +113,50 @@ func ImageCopy(opts ImageCopyOpts) error {
 		ReportWriter: opts.Progress,
 	}
 
-	if opts.SkipTLS {
-		args.SourceCtx = &types.SystemContext{
-			DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
-		}
+	args.SourceCtx = &types.SystemContext{
+		DockerAuthConfig:   opts.SrcAuth,
+		OSChoice:           opts.SrcOS,
+		ArchitectureChoice: opts.SrcArch,
 	}
 
+	srcTLS := opts.SrcTLS
+	srcTLS.Insecure = srcTLS.Insecure || opts.SkipTLS
+	srcTLS.apply(args.SourceCtx)
+
 	args.DestinationCtx = &types.SystemContext{
 		OCIAcceptUncompressedLayers: true,
+		DockerAuthConfig:            opts.DestAuth,
 	}
+	opts.DestTLS.apply(args.DestinationCtx)
 
 	_, err = copy.Image(context.Background(), policy, destRef, srcRef, args)
 	return err
 }
+
+// ManifestDigest returns the digest of the manifest (or manifest list) of the
+// image at src, without copying any of the image's blobs.
+func ManifestDigest(src string, tls TLSOpts, auth *types.DockerAuthConfig) (digest.Digest, error) {
+	srcRef, err := localRefParser(src)
+	if err != nil {
+		return "", err
+	}
+
+	ctx := &types.SystemContext{
+		DockerAuthConfig: auth,
+	}
+
+	tls.apply(ctx)
+
+	source, err := srcRef.NewImageSource(context.Background(), ctx)
+	if err != nil {
+		return "", err
+	}
+	defer source.Close()
+
+	content, _, err := source.GetManifest(context.Background(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	return manifest.Digest(content)
+}
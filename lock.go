@@ -0,0 +1,191 @@
+package stacker
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// locksDir is where the lock files for config's resources live. It is kept
+// when StackerDir is cleaned out, since removing a lock file while someone
+// holds it lets the next stacker take a lock on a new file instead.
+func locksDir(config StackerConfig) string {
+	return path.Join(config.StackerDir, "locks")
+}
+
+// cleanStackerDir removes everything in config.StackerDir except the lock
+// files, which other stackers may be holding.
+func cleanStackerDir(config StackerConfig) error {
+	entries, err := ioutil.ReadDir(config.StackerDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, ent := range entries {
+		p := path.Join(config.StackerDir, ent.Name())
+		if p == locksDir(config) {
+			continue
+		}
+
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Lock is an flock held on one of stacker's lock files.
+type Lock struct {
+	f *os.File
+}
+
+// lockFile takes an flock (unix.LOCK_SH or unix.LOCK_EX) on the lock file
+// name in config's locks dir. If wait is false and someone else holds a
+// conflicting lock, it fails with unix.EWOULDBLOCK instead of waiting.
+func lockFile(config StackerConfig, name string, how int, wait bool) (*Lock, error) {
+	if err := os.MkdirAll(locksDir(config), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path.Join(locksDir(config), name+".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if !wait {
+		how |= unix.LOCK_NB
+	}
+
+	if err := unix.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &Lock{f: f}, nil
+}
+
+// relock changes the lock to how (unix.LOCK_SH or unix.LOCK_EX), without
+// waiting. Note that if it fails, the lock may have been released.
+func (l *Lock) relock(how int) error {
+	return unix.Flock(int(l.f.Fd()), how|unix.LOCK_NB)
+}
+
+// Unlock releases the lock.
+func (l *Lock) Unlock() error {
+	return l.f.Close()
+}
+
+// isLocked returns whether someone holds the lock file name in config's
+// locks dir.
+func isLocked(config StackerConfig, name string) bool {
+	if _, err := os.Stat(path.Join(locksDir(config), name+".lock")); err != nil {
+		return false
+	}
+
+	l, err := lockFile(config, name, unix.LOCK_EX, false)
+	if err != nil {
+		return err == unix.EWOULDBLOCK
+	}
+
+	l.Unlock()
+	return false
+}
+
+func workingLockName(name string) string {
+	return "working-" + name
+}
+
+// LockWorkingContainer takes the lock on config's working container, so that
+// no other stacker uses the same one at the same time; it fails right away if
+// another one is.
+func LockWorkingContainer(config StackerConfig) (*Lock, error) {
+	name := config.WorkingContainer()
+	l, err := lockFile(config, workingLockName(name), unix.LOCK_EX, false)
+	if err == unix.EWOULDBLOCK {
+		return nil, newError(ErrBuildInProgress, nil, "working container %s is in use by another stacker (use --working-container to run several at once)", name)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "couldn't lock working container %s", name)
+	}
+
+	return l, nil
+}
+
+// lockOrWait takes an exclusive lock on name, telling the user if it has to
+// wait for another stacker to be done with what, first.
+func lockOrWait(config StackerConfig, name string, what string) (*Lock, error) {
+	l, err := lockFile(config, name, unix.LOCK_EX, false)
+	if err == unix.EWOULDBLOCK {
+		infof(config, "waiting for another stacker to be done with %s...\n", what)
+		l, err = lockFile(config, name, unix.LOCK_EX, true)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't lock %s", what)
+	}
+
+	return l, nil
+}
+
+// LockOCIDir takes the lock on config.OCIDir, which only one stacker at a
+// time can change; it fails with ErrBuildInProgress right away if another
+// one is. Stackers that share a StackerDir can build at the same time if
+// they have their own OCIDir (and working container).
+func LockOCIDir(config StackerConfig) (*Lock, error) {
+	l, err := lockFile(config, ociLockName(config), unix.LOCK_EX, false)
+	if err == unix.EWOULDBLOCK {
+		return nil, newError(ErrBuildInProgress, nil, "another build is in progress in %s", config.OCIDir)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "couldn't lock %s", config.OCIDir)
+	}
+
+	return l, nil
+}
+
+// WaitForOCIDir takes the lock on config.OCIDir like LockOCIDir, but waits
+// for the stacker that has it to be done instead of failing.
+func WaitForOCIDir(config StackerConfig) (*Lock, error) {
+	return lockOrWait(config, ociLockName(config), config.OCIDir)
+}
+
+// ociLockName is the name of the lock on config.OCIDir; several OCIDirs can
+// share a StackerDir.
+func ociLockName(config StackerConfig) string {
+	return fmt.Sprintf("oci-%x", sha256.Sum256([]byte(config.OCIDir)))
+}
+
+// lockImports takes the locks on the imports dirs of the layers names, which
+// are shared by all the stackers using the same StackerDir. They're taken in
+// order, so that two stackers that both need some of the same ones can't
+// each wait for the other.
+func lockImports(config StackerConfig, names []string) ([]*Lock, error) {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+
+	locks := []*Lock{}
+	for _, name := range sorted {
+		l, err := lockOrWait(config, fmt.Sprintf("imports-%x", sha256.Sum256([]byte(name))), fmt.Sprintf("the imports of %s", name))
+		if err != nil {
+			unlockAll(locks)
+			return nil, err
+		}
+
+		locks = append(locks, l)
+	}
+
+	return locks, nil
+}
+
+func unlockAll(locks []*Lock) {
+	for _, l := range locks {
+		l.Unlock()
+	}
+}
@@ -0,0 +1,64 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLockWorkingContainer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-lock-test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := StackerConfig{StackerDir: dir}
+	if isLocked(config, workingLockName(WorkingContainerName)) {
+		t.Fatalf("working container locked before anyone locked it")
+	}
+
+	l, err := LockWorkingContainer(config)
+	if err != nil {
+		t.Fatalf("couldn't lock working container: %v", err)
+	}
+
+	if !isLocked(config, workingLockName(WorkingContainerName)) {
+		t.Fatalf("working container not locked")
+	}
+
+	if _, err := LockWorkingContainer(config); err == nil {
+		t.Fatalf("locked the working container twice")
+	}
+
+	other := config
+	other.WorkingContainerName = "_working-other"
+	otherLock, err := LockWorkingContainer(other)
+	if err != nil {
+		t.Fatalf("couldn't lock another working container: %v", err)
+	}
+	otherLock.Unlock()
+
+	// cleaning out the stacker dir keeps the locks
+	if err := ioutil.WriteFile(path.Join(dir, "build.cache"), []byte("cache"), 0644); err != nil {
+		t.Fatalf("couldn't write file: %v", err)
+	}
+
+	if err := cleanStackerDir(config); err != nil {
+		t.Fatalf("couldn't clean stacker dir: %v", err)
+	}
+
+	if _, err := os.Stat(path.Join(dir, "build.cache")); !os.IsNotExist(err) {
+		t.Fatalf("build.cache wasn't removed: %v", err)
+	}
+
+	if !isLocked(config, workingLockName(WorkingContainerName)) {
+		t.Fatalf("working container not locked after cleaning")
+	}
+
+	l.Unlock()
+	if isLocked(config, workingLockName(WorkingContainerName)) {
+		t.Fatalf("working container still locked after unlocking")
+	}
+}
@@ -0,0 +1,105 @@
+package stacker
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logsDir is where the logs of layers' commands are kept.
+func logsDir(config StackerConfig) string {
+	return path.Join(config.StackerDir, "logs")
+}
+
+// layerLog is the log of what a layer's run and test commands printed, with
+// the time each line was printed. It's kept in StackerDir/logs/<name>.log
+// until the layer is built again.
+type layerLog struct {
+	path   string
+	f      *os.File
+	w      *timestampWriter
+	config StackerConfig
+}
+
+func openLayerLog(config StackerConfig, name string) (*layerLog, error) {
+	if err := os.MkdirAll(logsDir(config), 0755); err != nil {
+		return nil, err
+	}
+
+	// layer names can have slashes in them
+	p := path.Join(logsDir(config), strings.Replace(name, "/", "_", -1)+".log")
+	f, err := os.Create(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return &layerLog{path: p, f: f, w: &timestampWriter{w: f, now: time.Now}, config: config}, nil
+}
+
+// output is where commands' output goes: both the console (unless stacker
+// is quiet) and the log.
+func (l *layerLog) output() io.Writer {
+	return io.MultiWriter(consoleOutput(l.config), l.w)
+}
+
+func (l *layerLog) Close() error {
+	if err := l.w.flush(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+// timestampWriter prefixes each line written to w with the time it was
+// (started to be) written.
+type timestampWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+
+	// partial is whether the last line written hasn't ended yet
+	partial bool
+	now     func() time.Time
+}
+
+func (t *timestampWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	buf := bytes.Buffer{}
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+
+		if !t.partial {
+			buf.WriteString(t.now().UTC().Format(time.RFC3339Nano))
+			buf.WriteString(" ")
+		}
+		buf.Write(line)
+		t.partial = line[len(line)-1] != '\n'
+	}
+
+	if _, err := t.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// flush ends the last line, if it wasn't.
+func (t *timestampWriter) flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.partial {
+		return nil
+	}
+
+	t.partial = false
+	_, err := t.w.Write([]byte("\n"))
+	return err
+}
@@ -0,0 +1,29 @@
+package stacker
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestTimestampWriter(t *testing.T) {
+	buf := bytes.Buffer{}
+	now := time.Date(2019, 4, 1, 12, 0, 0, 0, time.UTC)
+	w := &timestampWriter{w: &buf, now: func() time.Time { return now }}
+
+	for _, s := range []string{"+ apt-get update\nHit:1 ", "http://archive", ".ubuntu.com\n\n", "done"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatalf("couldn't write: %v", err)
+		}
+	}
+
+	if err := w.flush(); err != nil {
+		t.Fatalf("couldn't flush: %v", err)
+	}
+
+	ts := "2019-04-01T12:00:00Z "
+	expected := ts + "+ apt-get update\n" + ts + "Hit:1 http://archive.ubuntu.com\n" + ts + "\n" + ts + "done\n"
+	if buf.String() != expected {
+		t.Errorf("bad log:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
@@ -0,0 +1,299 @@
+package stacker
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// lvmTag is the tag of the logical volumes stacker keeps containers
+	// in.
+	lvmTag = "stacker"
+
+	// lvmNameTag prefixes the tag with the (hex encoded) name of the
+	// container a logical volume has.
+	lvmNameTag = "stacker-name-"
+
+	defaultLVMVolumeSize = "100GB"
+)
+
+// lvm keeps each container in a thin logical volume of the config's
+// LVMThinPool, with an ext4 filesystem on it mounted at its path in RootFSDir.
+// Snapshots are thin snapshots, mounted read only, and restoring one is a
+// thin snapshot of it, mounted read write.
+type lvm struct {
+	c    StackerConfig
+	lock *Lock
+	size uint64
+}
+
+func newLVM(c StackerConfig, lock *Lock) (Storage, error) {
+	if c.LVMVolumeGroup == "" || c.LVMThinPool == "" {
+		return nil, fmt.Errorf("lvm storage needs lvm_volume_group and lvm_thin_pool set to the thin pool to keep the rootfses in")
+	}
+
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("lvm storage needs stacker to run as root")
+	}
+
+	volumeSize := c.LVMVolumeSize
+	if volumeSize == "" {
+		volumeSize = defaultLVMVolumeSize
+	}
+	size, err := humanize.ParseBytes(volumeSize)
+	if err != nil {
+		return nil, fmt.Errorf("bad lvm_volume_size %s: %v", volumeSize, err)
+	}
+
+	if err := os.MkdirAll(c.RootFSDir, 0755); err != nil {
+		return nil, err
+	}
+
+	l := &lvm{c: c, lock: lock, size: size}
+
+	// the volumes aren't mounted anymore after a reboot
+	names, err := l.volumes()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		if err := l.mount(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+func lvmCommand(c StackerConfig, name string, args ...string) (string, error) {
+	output, err := exec.Command(c.ToolPath(name), args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s: %s: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// lvName is the name of the logical volume the container name is kept in.
+func lvName(name string) string {
+	return fmt.Sprintf("stacker-%x", sha256.Sum256([]byte(name)))[:40]
+}
+
+func (l *lvm) lv(name string) string {
+	return path.Join(l.c.LVMVolumeGroup, lvName(name))
+}
+
+// volumes returns the names of the containers that have logical volumes in
+// the config's volume group.
+func (l *lvm) volumes() ([]string, error) {
+	output, err := lvmCommand(l.c, ToolLvs, "--noheadings", "--separator", " ", "-o", "lv_name,lv_tags", l.c.LVMVolumeGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseLVMVolumes(output), nil
+}
+
+// parseLVMVolumes returns the names of the containers in the output of
+// `lvs -o lv_name,lv_tags`, whose name tags match the volume they're on
+// (snapshots may have their origin's tags too).
+func parseLVMVolumes(output string) []string {
+	names := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+
+		for _, tag := range strings.Split(fields[1], ",") {
+			if !strings.HasPrefix(tag, lvmNameTag) {
+				continue
+			}
+
+			name, err := hex.DecodeString(strings.TrimPrefix(tag, lvmNameTag))
+			if err != nil || lvName(string(name)) != fields[0] {
+				continue
+			}
+			names = append(names, string(name))
+		}
+	}
+
+	return names
+}
+
+func (l *lvm) exists(name string) bool {
+	_, err := lvmCommand(l.c, ToolLvs, l.lv(name))
+	return err == nil
+}
+
+// mount activates the container name's volume and mounts it, read only if
+// it's a snapshot.
+func (l *lvm) mount(name string) error {
+	mountpoint := path.Join(l.c.RootFSDir, name)
+	mounted, err := isMountpoint(mountpoint)
+	if err != nil || mounted {
+		return err
+	}
+
+	// thin snapshots are skipped when activating by default
+	if _, err := lvmCommand(l.c, ToolLvchange, "-ay", "-K", l.lv(name)); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(mountpoint, 0755); err != nil {
+		return err
+	}
+
+	attr, err := lvmCommand(l.c, ToolLvs, "--noheadings", "-o", "lv_attr", l.lv(name))
+	if err != nil {
+		return err
+	}
+
+	// snapshots' volumes are read only, and their journals can't be
+	// replayed
+	var flags uintptr
+	data := ""
+	if attr = strings.TrimSpace(attr); len(attr) > 1 && attr[1] == 'r' {
+		flags = unix.MS_RDONLY
+		data = "noload"
+	}
+
+	if err := unix.Mount(path.Join("/dev", l.lv(name)), mountpoint, "ext4", flags, data); err != nil {
+		return fmt.Errorf("couldn't mount %s: %v", name, err)
+	}
+
+	return nil
+}
+
+func (l *lvm) tags(name string) []string {
+	return []string{"--addtag", lvmTag, "--addtag", lvmNameTag + hex.EncodeToString([]byte(name))}
+}
+
+func (l *lvm) Name() string {
+	return "lvm"
+}
+
+func (l *lvm) Create(source string) error {
+	args := append([]string{"-q", "-V", fmt.Sprintf("%db", l.size), "-T", path.Join(l.c.LVMVolumeGroup, l.c.LVMThinPool), "-n", lvName(source)}, l.tags(source)...)
+	if _, err := lvmCommand(l.c, ToolLvcreate, args...); err != nil {
+		return err
+	}
+
+	if _, err := lvmCommand(l.c, ToolMkfsExt4, "-q", path.Join("/dev", l.lv(source))); err != nil {
+		l.Delete(source)
+		return err
+	}
+
+	return l.mount(source)
+}
+
+// snapshot makes target a thin snapshot of source.
+func (l *lvm) snapshot(source string, target string, readonly bool) error {
+	permission := "rw"
+	if readonly {
+		permission = "r"
+	}
+
+	args := append([]string{"-q", "-s", "-p", permission, "-n", lvName(target)}, l.tags(target)...)
+	args = append(args, l.lv(source))
+
+	if _, err := lvmCommand(l.c, ToolLvcreate, args...); err != nil {
+		return err
+	}
+
+	return l.mount(target)
+}
+
+func (l *lvm) Snapshot(source string, target string) error {
+	return l.snapshot(source, target, true)
+}
+
+func (l *lvm) Restore(source string, target string) error {
+	return l.snapshot(source, target, false)
+}
+
+func (l *lvm) Delete(source string) error {
+	mountpoint := path.Join(l.c.RootFSDir, source)
+	if mounted, err := isMountpoint(mountpoint); err == nil && mounted {
+		if err := unix.Unmount(mountpoint, unix.MNT_DETACH); err != nil {
+			return fmt.Errorf("couldn't unmount %s: %v", source, err)
+		}
+	}
+
+	if l.exists(source) {
+		if _, err := lvmCommand(l.c, ToolLvremove, "-q", "-f", l.lv(source)); err != nil {
+			return err
+		}
+	}
+
+	return os.RemoveAll(mountpoint)
+}
+
+func (l *lvm) Detach() error {
+	// the volumes stay mounted, like a btrfs that isn't a loopback
+	return l.lock.Unlock()
+}
+
+func (l *lvm) Mountpoints() ([]string, error) {
+	names, err := l.volumes()
+	if err != nil {
+		return nil, err
+	}
+
+	mountpoints := []string{}
+	for _, name := range names {
+		mountpoints = append(mountpoints, path.Join(l.c.RootFSDir, name))
+	}
+
+	return mountpoints, nil
+}
+
+func (l *lvm) Exists(thing string) bool {
+	_, err := os.Stat(path.Join(l.c.RootFSDir, thing))
+	return err == nil
+}
+
+// isMountpoint returns whether something is mounted at p.
+func isMountpoint(p string) (bool, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 5 && unescapeMountpoint(fields[4]) == p {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+// cleanLVM removes all of the logical volumes stacker keeps containers in.
+func cleanLVM(config StackerConfig) error {
+	l := &lvm{c: config}
+	names, err := l.volumes()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := l.Delete(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
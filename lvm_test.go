@@ -0,0 +1,33 @@
+package stacker
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func TestParseLVMVolumes(t *testing.T) {
+	fooTag := lvmNameTag + hex.EncodeToString([]byte("foo"))
+	barTag := lvmNameTag + hex.EncodeToString([]byte("bar"))
+
+	output := fmt.Sprintf(`  %s stacker,%s
+  %s stacker,%s,%s
+  root
+  swap 
+`, lvName("foo"), fooTag, lvName("bar"), fooTag, barTag)
+
+	names := parseLVMVolumes(output)
+	if len(names) != 2 || names[0] != "foo" || names[1] != "bar" {
+		t.Fatalf("bad volumes %v", names)
+	}
+}
+
+func TestLVName(t *testing.T) {
+	if lvName("foo") == lvName("bar") {
+		t.Fatalf("different containers with the same volume")
+	}
+
+	if len(lvName("foo")) != 40 {
+		t.Fatalf("bad volume name %s", lvName("foo"))
+	}
+}
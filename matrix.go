@@ -0,0 +1,201 @@
+package stacker
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// matrixSubstitution matches ${{matrix.NAME}}, which is substituted per
+// instance of a layer with a matrix: section, instead of from the global
+// substitutions.
+var matrixSubstitution = regexp.MustCompile(`\$\{\{matrix\.([^\}]*)\}\}`)
+
+// matrixInstances returns every combination of the values in matrix, in a
+// stable order: the axes are sorted by name, and the values are in the order
+// they were given.
+func matrixInstances(matrix map[string][]string) []map[string]string {
+	axes := []string{}
+	for axis := range matrix {
+		axes = append(axes, axis)
+	}
+	sort.Strings(axes)
+
+	instances := []map[string]string{{}}
+	for _, axis := range axes {
+		next := []map[string]string{}
+		for _, instance := range instances {
+			for _, value := range matrix[axis] {
+				expanded := map[string]string{axis: value}
+				for k, v := range instance {
+					expanded[k] = v
+				}
+				next = append(next, expanded)
+			}
+		}
+		instances = next
+	}
+
+	return instances
+}
+
+// matrixInstanceName is the name of the layer that the instance of the matrix
+// layer name is built as, e.g. python-3.9-alpine for the instance
+// {version: 3.9, flavor: alpine} of python.
+func matrixInstanceName(name string, instance map[string]string) string {
+	axes := []string{}
+	for axis := range instance {
+		axes = append(axes, axis)
+	}
+	sort.Strings(axes)
+
+	pieces := []string{name}
+	for _, axis := range axes {
+		pieces = append(pieces, instance[axis])
+	}
+
+	return strings.Join(pieces, "-")
+}
+
+// rawMatrices reads the matrix: sections of the layers in content. The layers
+// have been through a yaml.MapSlice by the time they are parsed, which turns
+// e.g. 3.10 into the float 3.1; decoding straight into strings keeps the
+// values as they were written.
+func rawMatrices(content string) (map[string]map[string][]string, error) {
+	layers := map[string]struct {
+		Matrix map[string][]string `yaml:"matrix"`
+	}{}
+	if err := yaml.Unmarshal([]byte(content), &layers); err != nil {
+		return nil, err
+	}
+
+	matrices := map[string]map[string][]string{}
+	for name, l := range layers {
+		matrices[name] = l.Matrix
+	}
+
+	return matrices, nil
+}
+
+// substituteMatrixValues returns v, part of a layer parsed into a
+// yaml.MapSlice, with replace applied to its strings. Substituting in the
+// parsed layer rather than in its yaml keeps the values strings: a bare
+// ${{matrix.version}} of 1.10 would otherwise be parsed again as 1.1.
+func substituteMatrixValues(v interface{}, replace func(string) string) interface{} {
+	switch v := v.(type) {
+	case string:
+		return replace(v)
+	case []interface{}:
+		substituted := []interface{}{}
+		for _, e := range v {
+			substituted = append(substituted, substituteMatrixValues(e, replace))
+		}
+		return substituted
+	case yaml.MapSlice:
+		substituted := yaml.MapSlice{}
+		for _, item := range v {
+			substituted = append(substituted, yaml.MapItem{
+				Key:   substituteMatrixValues(item.Key, replace),
+				Value: substituteMatrixValues(item.Value, replace),
+			})
+		}
+		return substituted
+	case map[interface{}]interface{}:
+		substituted := map[interface{}]interface{}{}
+		for k, e := range v {
+			substituted[substituteMatrixValues(k, replace)] = substituteMatrixValues(e, replace)
+		}
+		return substituted
+	default:
+		return v
+	}
+}
+
+// expandMatrix replaces each layer in sf that has a matrix: section with one
+// layer per combination of the matrix's values, in the same place in the
+// file order.
+func (sf *Stackerfile) expandMatrix() error {
+	matrices, err := rawMatrices(sf.AfterSubstitutions)
+	if err != nil {
+		return err
+	}
+
+	fileOrder := []string{}
+	for _, name := range sf.fileOrder {
+		layer := sf.internal[name]
+		if len(layer.Matrix) == 0 {
+			content, err := yaml.Marshal(layer)
+			if err != nil {
+				return err
+			}
+
+			if match := matrixSubstitution.FindString(string(content)); match != "" {
+				return fmt.Errorf("stackerfile: %s uses %s but has no matrix", name, match)
+			}
+
+			fileOrder = append(fileOrder, name)
+			continue
+		}
+
+		matrix := matrices[name]
+		for axis, values := range matrix {
+			if len(values) == 0 {
+				return fmt.Errorf("stackerfile: matrix %s of %s has no values", axis, name)
+			}
+		}
+
+		layer.Matrix = nil
+		content, err := yaml.Marshal(layer)
+		if err != nil {
+			return err
+		}
+
+		parsed := yaml.MapSlice{}
+		if err := yaml.Unmarshal(content, &parsed); err != nil {
+			return err
+		}
+
+		delete(sf.internal, name)
+		for _, instance := range matrixInstances(matrix) {
+			var missing []string
+			expanded := substituteMatrixValues(parsed, func(s string) string {
+				return matrixSubstitution.ReplaceAllStringFunc(s, func(match string) string {
+					axis := matrixSubstitution.FindStringSubmatch(match)[1]
+					value, ok := instance[axis]
+					if !ok {
+						missing = append(missing, axis)
+					}
+					return value
+				})
+			})
+			if len(missing) > 0 {
+				return fmt.Errorf("stackerfile: %s has no matrix values for %s", name, strings.Join(missing, ", "))
+			}
+
+			expandedContent, err := yaml.Marshal(expanded)
+			if err != nil {
+				return err
+			}
+
+			instanceLayer := &Layer{}
+			if err := yaml.Unmarshal(expandedContent, instanceLayer); err != nil {
+				return err
+			}
+			instanceLayer.referenceDirectory = layer.referenceDirectory
+
+			instanceName := matrixInstanceName(name, instance)
+			if _, ok := sf.internal[instanceName]; ok {
+				return fmt.Errorf("stackerfile: matrix instance %s of %s conflicts with another layer", instanceName, name)
+			}
+
+			sf.internal[instanceName] = instanceLayer
+			fileOrder = append(fileOrder, instanceName)
+		}
+	}
+
+	sf.fileOrder = fileOrder
+	return nil
+}
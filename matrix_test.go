@@ -0,0 +1,107 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMatrix(t *testing.T) {
+	content := `base:
+    from:
+        type: docker
+        url: docker://centos:latest
+python:
+    from:
+        type: built
+        tag: base
+    matrix:
+        version: [3.9, 3.10]
+        flavor: [slim]
+    run: install-python ${{matrix.version}} --${{matrix.flavor}}
+app:
+    from:
+        type: built
+        tag: python-slim-3.10
+`
+	sf := parse(t, content)
+
+	do, err := sf.DependencyOrder()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	expected := []string{"base", "python-slim-3.9", "python-slim-3.10", "app"}
+	if strings.Join(do, " ") != strings.Join(expected, " ") {
+		t.Fatalf("bad dependency order: %v", do)
+	}
+
+	l, ok := sf.Get("python-slim-3.10")
+	if !ok {
+		t.Fatalf("missing python-slim-3.10 layer")
+	}
+
+	run, err := l.ParseRun()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(run) != 1 || run[0] != "install-python 3.10 --slim" {
+		t.Fatalf("bad run: %v", run)
+	}
+
+	if l.From.Tag != "base" {
+		t.Fatalf("bad base: %v", l.From)
+	}
+}
+
+func TestMatrixOutsideMatrixLayer(t *testing.T) {
+	content := `base:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: echo ${{matrix.version}}
+`
+	dir, err := ioutil.TempDir("", "stacker_test_")
+	if err != nil {
+		t.Fatalf("couldn't create tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = NewStackerfile(writeStackerfile(t, dir, "stacker.yaml", content), nil)
+	if err == nil || !strings.Contains(err.Error(), "has no matrix") {
+		t.Fatalf("matrix substitution outside matrix layer not detected: %v", err)
+	}
+}
+
+func TestMatrixBareSubstitution(t *testing.T) {
+	content := `python:
+    from:
+        type: docker
+        url: docker://python:latest
+    matrix:
+        version: [3.10]
+    run:
+        - ${{matrix.version}}
+    cmd: ${{matrix.version}}
+`
+	sf := parse(t, content)
+
+	l, ok := sf.Get("python-3.10")
+	if !ok {
+		t.Fatalf("missing python-3.10 layer")
+	}
+
+	// a bare substitution isn't parsed again, as the number 3.1
+	run, err := l.ParseRun()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(run) != 1 || run[0] != "3.10" {
+		t.Fatalf("bad run: %v", run)
+	}
+
+	if l.Cmd != "3.10" {
+		t.Fatalf("bad cmd: %#v", l.Cmd)
+	}
+}
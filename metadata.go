@@ -0,0 +1,52 @@
+package stacker
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Version is the version of stacker doing the build, as recorded by
+// ${{build.stacker_version}}. The stacker binary sets it to its own version.
+var Version = ""
+
+// buildPlaceholder matches ${{build.NAME}} in labels and annotations, which
+// is filled in with information about the build (see buildMetadata) when the
+// layer's image config is written, rather than from the substitutions.
+var buildPlaceholder = regexp.MustCompile(`\$\{\{build\.([^\}]*)\}\}`)
+
+// buildMetadata is what ${{build.NAME}} expands to for each NAME.
+type buildMetadata map[string]string
+
+// expand replaces the ${{build.NAME}} placeholders in value.
+func (md buildMetadata) expand(value string) (string, error) {
+	var unknown []string
+	expanded := buildPlaceholder.ReplaceAllStringFunc(value, func(match string) string {
+		name := buildPlaceholder.FindStringSubmatch(match)[1]
+		v, ok := md[name]
+		if !ok {
+			unknown = append(unknown, name)
+		}
+		return v
+	})
+
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("unknown build metadata: %s", strings.Join(unknown, ", "))
+	}
+
+	return expanded, nil
+}
+
+// expandMap returns m with the placeholders in its values expanded.
+func (md buildMetadata) expandMap(m map[string]string) (map[string]string, error) {
+	expanded := map[string]string{}
+	for k, v := range m {
+		e, err := md.expand(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", k, err)
+		}
+		expanded[k] = e
+	}
+
+	return expanded, nil
+}
@@ -0,0 +1,41 @@
+package stacker
+
+import (
+	"testing"
+)
+
+func TestBuildMetadataExpand(t *testing.T) {
+	md := buildMetadata{"git_commit": "abc123", "name": "app"}
+
+	expanded, err := md.expand("${{build.name}} at ${{build.git_commit}}")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if expanded != "app at abc123" {
+		t.Fatalf("bad expansion: %s", expanded)
+	}
+
+	if _, err := md.expand("${{build.nope}}"); err == nil {
+		t.Fatalf("unknown build metadata accepted")
+	}
+}
+
+func TestBuildPlaceholdersSurviveSubstitution(t *testing.T) {
+	content := `app:
+    from:
+        type: docker
+        url: docker://centos:latest
+    labels:
+        org.opencontainers.image.revision: ${{build.git_commit}}
+`
+	sf := parse(t, content)
+	l, ok := sf.Get("app")
+	if !ok {
+		t.Fatalf("missing app layer")
+	}
+
+	if l.Labels["org.opencontainers.image.revision"] != "${{build.git_commit}}" {
+		t.Fatalf("build placeholder was substituted: %v", l.Labels)
+	}
+}
@@ -0,0 +1,258 @@
+package stacker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// We don't pull in the prometheus client library for this; the text
+// exposition format is simple enough that rendering it by hand is less code
+// than the dependency would be.
+
+type counter struct {
+	name  string
+	help  string
+	value float64
+}
+
+func (c *counter) render(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+	fmt.Fprintf(w, "%s %g\n", c.name, c.value)
+}
+
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(name string, help string, buckets []float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) render(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, b, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", h.name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+var durationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 3600}
+
+// buildMetrics are the metrics for everything this process has done.
+var buildMetrics = struct {
+	sync.Mutex
+	layersBuilt     *counter
+	cacheHits       *counter
+	cacheMisses     *counter
+	importBytes     *counter
+	pushDuration    *histogram
+	layerGeneration *histogram
+}{
+	layersBuilt: &counter{name: "stacker_layers_built_total", help: "Number of layers built (not including cache hits)."},
+	cacheHits:   &counter{name: "stacker_cache_hits_total", help: "Number of layers found in the build cache."},
+	cacheMisses: &counter{name: "stacker_cache_misses_total", help: "Number of layers not found in the build cache."},
+	importBytes: &counter{name: "stacker_import_bytes_fetched_total", help: "Number of bytes downloaded for http(s) imports."},
+	pushDuration: newHistogram("stacker_push_duration_seconds",
+		"Time taken to save a layer to a remote location.", durationBuckets),
+	layerGeneration: newHistogram("stacker_layer_generation_duration_seconds",
+		"Time taken to generate an OCI layer from a rootfs.", durationBuckets),
+}
+
+func metricsCacheLookup(hit bool) {
+	buildMetrics.Lock()
+	defer buildMetrics.Unlock()
+	if hit {
+		buildMetrics.cacheHits.value++
+	} else {
+		buildMetrics.cacheMisses.value++
+	}
+}
+
+func metricsLayerBuilt(generationStart time.Time) {
+	buildMetrics.Lock()
+	defer buildMetrics.Unlock()
+	buildMetrics.layersBuilt.value++
+	buildMetrics.layerGeneration.observe(time.Since(generationStart).Seconds())
+}
+
+func metricsImportBytes(n int64) {
+	buildMetrics.Lock()
+	defer buildMetrics.Unlock()
+	buildMetrics.importBytes.value += float64(n)
+}
+
+func metricsPush(start time.Time) {
+	buildMetrics.Lock()
+	defer buildMetrics.Unlock()
+	buildMetrics.pushDuration.observe(time.Since(start).Seconds())
+}
+
+// WriteMetrics writes the current build metrics in the prometheus text
+// exposition format.
+func WriteMetrics(w io.Writer) error {
+	buildMetrics.Lock()
+	defer buildMetrics.Unlock()
+
+	buf := &bytes.Buffer{}
+	buildMetrics.layersBuilt.render(buf)
+	buildMetrics.cacheHits.render(buf)
+	buildMetrics.cacheMisses.render(buf)
+	buildMetrics.importBytes.render(buf)
+	buildMetrics.pushDuration.render(buf)
+	buildMetrics.layerGeneration.render(buf)
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// MetricsHandler serves the build metrics, so that a long running stacker
+// process can be scraped directly.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteMetrics(w)
+	})
+}
+
+// parseMetrics returns the values of the series in text, which is in the
+// exposition format, by their name and labels.
+func parseMetrics(text []byte) map[string]float64 {
+	values := map[string]float64{}
+	for _, line := range strings.Split(string(text), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.LastIndex(line, " ")
+		if i < 0 {
+			continue
+		}
+
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			continue
+		}
+		values[line[:i]] = v
+	}
+	return values
+}
+
+// textfileMetrics are the values of the metrics that this process has already
+// added to the textfile, see writeMetricsTextfile.
+var textfileMetrics = struct {
+	sync.Mutex
+	written map[string]float64
+}{written: map[string]float64{}}
+
+// writeMetricsTextfile adds the metrics to the ones in
+// StackerDir/metrics/stacker.prom, suitable for node_exporter's textfile
+// collector, so that they're for all the builds that have been run there
+// rather than the last one. Every series is a counter (or a histogram's
+// buckets, sum and count, which are counters too), so what this process did
+// since it last wrote the file is added to each. The file is written
+// atomically, since the collector may read it at any time, and under a lock,
+// since other builds may be writing it too.
+func writeMetricsTextfile(config StackerConfig) error {
+	dir := path.Join(config.StackerDir, "metrics")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	lock, err := lockFile(config, "metrics", unix.LOCK_EX, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	textfileMetrics.Lock()
+	defer textfileMetrics.Unlock()
+
+	current := &bytes.Buffer{}
+	if err := WriteMetrics(current); err != nil {
+		return err
+	}
+
+	textfile := path.Join(dir, "stacker.prom")
+	previous := map[string]float64{}
+	content, err := ioutil.ReadFile(textfile)
+	if err == nil {
+		previous = parseMetrics(content)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, ".stacker.prom")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	values := parseMetrics(current.Bytes())
+	out := &bytes.Buffer{}
+	for _, line := range strings.Split(strings.TrimSuffix(current.String(), "\n"), "\n") {
+		series := line
+		if i := strings.LastIndex(line, " "); i >= 0 {
+			series = line[:i]
+		}
+
+		v, ok := values[series]
+		if strings.HasPrefix(line, "#") || !ok {
+			fmt.Fprintln(out, line)
+			continue
+		}
+
+		fmt.Fprintf(out, "%s %g\n", series, previous[series]+v-textfileMetrics.written[series])
+	}
+
+	_, err = out.WriteTo(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), textfile); err != nil {
+		return err
+	}
+
+	textfileMetrics.written = values
+	return nil
+}
@@ -0,0 +1,71 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestWriteMetricsTextfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-metrics-test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := StackerConfig{StackerDir: dir}
+	textfile := path.Join(dir, "metrics", "stacker.prom")
+	hits := func() float64 {
+		content, err := ioutil.ReadFile(textfile)
+		if err != nil {
+			t.Fatalf("couldn't read textfile: %v", err)
+		}
+		return parseMetrics(content)["stacker_cache_hits_total"]
+	}
+
+	// what another build left behind
+	if err := os.MkdirAll(path.Dir(textfile), 0755); err != nil {
+		t.Fatalf("couldn't create metrics dir: %v", err)
+	}
+	err = ioutil.WriteFile(textfile, []byte("stacker_cache_hits_total 3\nstacker_layer_generation_duration_seconds_bucket{le=\"+Inf\"} 2\n"), 0644)
+	if err != nil {
+		t.Fatalf("couldn't write textfile: %v", err)
+	}
+
+	// this process' earlier metrics were never written to it
+	buildMetrics.Lock()
+	before := buildMetrics.cacheHits.value
+	buildMetrics.Unlock()
+
+	metricsCacheLookup(true)
+	if err := writeMetricsTextfile(config); err != nil {
+		t.Fatalf("couldn't write metrics: %v", err)
+	}
+	if actual := hits(); actual != before+4 {
+		t.Errorf("%g cache hits after the first write, expected %g", actual, before+4)
+	}
+
+	if err := writeMetricsTextfile(config); err != nil {
+		t.Fatalf("couldn't write metrics: %v", err)
+	}
+	if actual := hits(); actual != before+4 {
+		t.Errorf("%g cache hits after writing nothing new, expected %g", actual, before+4)
+	}
+
+	metricsCacheLookup(true)
+	if err := writeMetricsTextfile(config); err != nil {
+		t.Fatalf("couldn't write metrics: %v", err)
+	}
+	if actual := hits(); actual != before+5 {
+		t.Errorf("%g cache hits after another hit, expected %g", actual, before+5)
+	}
+
+	content, err := ioutil.ReadFile(textfile)
+	if err != nil {
+		t.Fatalf("couldn't read textfile: %v", err)
+	}
+	if parseMetrics(content)["stacker_layer_generation_duration_seconds_bucket{le=\"+Inf\"}"] < 2 {
+		t.Errorf("histogram buckets weren't added to: %s", string(content))
+	}
+}
@@ -0,0 +1,261 @@
+package stacker
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/freddierice/go-losetup"
+	"github.com/openSUSE/umoci"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// squashfsBlockSize is what mksquashfs pads squashfs images to, which is
+// where a verity hash tree appended to one starts.
+const squashfsBlockSize = 4096
+
+// squashfsSize returns how many bytes of the squashfs image in f are the
+// filesystem, according to its superblock.
+func squashfsSize(f io.ReaderAt) (int64, error) {
+	sb := make([]byte, 48)
+	if _, err := f.ReadAt(sb, 0); err != nil {
+		return 0, errors.Wrapf(err, "couldn't read squashfs superblock")
+	}
+
+	if string(sb[:4]) != "hsqs" {
+		return 0, fmt.Errorf("not a squashfs image")
+	}
+
+	return int64(binary.LittleEndian.Uint64(sb[40:48])), nil
+}
+
+// verityHashOffset returns where the hash tree appended to the squashfs image
+// of size bytes starts.
+func verityHashOffset(size int64) int64 {
+	return (size + squashfsBlockSize - 1) / squashfsBlockSize * squashfsBlockSize
+}
+
+// mountStateDir is where the layers of the image mounted at mountpoint are
+// mounted.
+func mountStateDir(config StackerConfig, mountpoint string) string {
+	return path.Join(config.StackerDir, "mounts", fmt.Sprintf("%x", sha256.Sum256([]byte(mountpoint)))[:16])
+}
+
+// verityName is the name of the dm-verity device of the layer i of the image
+// mounted with its layers in stateDir.
+func verityName(stateDir string, i int) string {
+	return fmt.Sprintf("stacker-%s-%d", path.Base(stateDir), i)
+}
+
+// mountSquashfsLayer mounts the squashfs layer blob read-only at dest,
+// through a dm-verity device called name if the layer has a root hash.
+func mountSquashfsLayer(config StackerConfig, blob string, desc ispec.Descriptor, name string, dest string) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	rootHash := desc.Annotations[VerityRootHashAnnotation]
+	if rootHash == "" {
+		dev, err := losetup.Attach(blob, 0, true)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't attach loop device for %s", blob)
+		}
+		// the loop device goes away when it's unmounted
+		defer dev.Detach()
+
+		err = unix.Mount(dev.Path(), dest, "squashfs", unix.MS_RDONLY, "")
+		if err != nil {
+			return errors.Wrapf(err, "couldn't mount %s", blob)
+		}
+
+		return nil
+	}
+
+	f, err := os.Open(blob)
+	if err != nil {
+		return err
+	}
+	size, err := squashfsSize(f)
+	f.Close()
+	if err != nil {
+		return errors.Wrapf(err, "bad layer %s", blob)
+	}
+
+	veritysetup := config.ToolPath(ToolVeritysetup)
+	if err := checkTool(ToolVeritysetup, veritysetup); err != nil {
+		return errors.Wrapf(err, "layer %s has a verity root hash", desc.Digest)
+	}
+
+	output, err := exec.Command(veritysetup, "open", "--readonly",
+		fmt.Sprintf("--hash-offset=%d", verityHashOffset(size)),
+		blob, name, blob, rootHash).CombinedOutput()
+	if err != nil {
+		return errors.Errorf("couldn't open verity device for %s: %v: %s", blob, err, strings.TrimSpace(string(output)))
+	}
+
+	err = unix.Mount(path.Join("/dev/mapper", name), dest, "squashfs", unix.MS_RDONLY, "")
+	if err != nil {
+		closeVerity(config, name)
+		return errors.Wrapf(err, "couldn't mount %s", blob)
+	}
+
+	return nil
+}
+
+func closeVerity(config StackerConfig, name string) error {
+	if _, err := os.Stat(path.Join("/dev/mapper", name)); err != nil {
+		return nil
+	}
+
+	output, err := exec.Command(config.ToolPath(ToolVeritysetup), "close", name).CombinedOutput()
+	if err != nil {
+		return errors.Errorf("couldn't close verity device %s: %v: %s", name, err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// overlayLowerDirs returns the overlay lowerdir option for layers, which are
+// bottom first, while overlay wants the top one first.
+func overlayLowerDirs(layers []string) string {
+	lower := make([]string, len(layers))
+	for i, l := range layers {
+		lower[len(layers)-1-i] = l
+	}
+	return strings.Join(lower, ":")
+}
+
+// Mount mounts the image tag, built with squashfs layers, read-only at
+// mountpoint the way a device that it's shipped to would: each layer is a
+// squashfs loop mount (through dm-verity, for the layers that have a verity
+// root hash), stacked with overlayfs. It's so that the exact artifact can be
+// looked at, or booted in a VM or container, before it's shipped. It needs
+// root; Unmount undoes it.
+func Mount(config StackerConfig, tag string, mountpoint string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("mounting images needs root")
+	}
+
+	mountpoint, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return err
+	}
+
+	ociLock, err := LockOCIDir(config)
+	if err != nil {
+		return err
+	}
+	defer ociLock.Unlock()
+
+	oci, err := umoci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return err
+	}
+
+	if len(manifest.Layers) == 0 {
+		return fmt.Errorf("%s has no layers", tag)
+	}
+
+	for _, l := range manifest.Layers {
+		if l.MediaType != stackeroci.MediaTypeLayerSquashfs {
+			return fmt.Errorf("%s has a %s layer; only images with squashfs layers can be mounted", tag, l.MediaType)
+		}
+	}
+
+	stateDir := mountStateDir(config, mountpoint)
+	if _, err := os.Stat(stateDir); err == nil {
+		return fmt.Errorf("something is already mounted at %s; unmount it first", mountpoint)
+	}
+
+	if err := os.MkdirAll(mountpoint, 0755); err != nil {
+		return err
+	}
+
+	layers := []string{}
+	for i, l := range manifest.Layers {
+		blob := path.Join(config.OCIDir, "blobs", l.Digest.Algorithm().String(), l.Digest.Encoded())
+		dest := path.Join(stateDir, fmt.Sprintf("%d", i))
+
+		err := mountSquashfsLayer(config, blob, l, verityName(stateDir, i), dest)
+		if err != nil {
+			Unmount(config, mountpoint)
+			return err
+		}
+
+		layers = append(layers, dest)
+	}
+
+	// overlay needs at least two lower dirs without an upper dir
+	if len(layers) == 1 {
+		err = unix.Mount(layers[0], mountpoint, "", unix.MS_BIND, "")
+		if err == nil {
+			err = unix.Mount("", mountpoint, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, "")
+		}
+	} else {
+		err = unix.Mount("overlay", mountpoint, "overlay", unix.MS_RDONLY, fmt.Sprintf("lowerdir=%s", overlayLowerDirs(layers)))
+	}
+	if err != nil {
+		Unmount(config, mountpoint)
+		return errors.Wrapf(err, "couldn't mount %s at %s", tag, mountpoint)
+	}
+
+	return nil
+}
+
+// Unmount unmounts the image Mount mounted at mountpoint, and its layers.
+func Unmount(config StackerConfig, mountpoint string) error {
+	mountpoint, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return err
+	}
+
+	stateDir := mountStateDir(config, mountpoint)
+	ents, err := ioutil.ReadDir(stateDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no image is mounted at %s", mountpoint)
+		}
+		return err
+	}
+
+	if mounted, err := isMountpoint(mountpoint); err != nil {
+		return err
+	} else if mounted {
+		if err := unix.Unmount(mountpoint, 0); err != nil {
+			return errors.Wrapf(err, "couldn't unmount %s", mountpoint)
+		}
+	}
+
+	for i := range ents {
+		dest := path.Join(stateDir, fmt.Sprintf("%d", i))
+		if mounted, err := isMountpoint(dest); err != nil {
+			return err
+		} else if mounted {
+			if err := unix.Unmount(dest, 0); err != nil {
+				return errors.Wrapf(err, "couldn't unmount layer %s", dest)
+			}
+		}
+
+		if err := closeVerity(config, verityName(stateDir, i)); err != nil {
+			return err
+		}
+	}
+
+	return os.RemoveAll(stateDir)
+}
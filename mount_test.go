@@ -0,0 +1,48 @@
+package stacker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestSquashfsSize(t *testing.T) {
+	sb := make([]byte, 96)
+	copy(sb, "hsqs")
+	binary.LittleEndian.PutUint64(sb[40:48], 12345)
+
+	size, err := squashfsSize(bytes.NewReader(sb))
+	if err != nil {
+		t.Fatalf("couldn't read size: %v", err)
+	}
+	if size != 12345 {
+		t.Fatalf("bad size %d", size)
+	}
+
+	if _, err := squashfsSize(bytes.NewReader(make([]byte, 96))); err == nil {
+		t.Fatalf("read the size of something that isn't squashfs")
+	}
+
+	if _, err := squashfsSize(bytes.NewReader([]byte("hsqs"))); err == nil {
+		t.Fatalf("read the size of a truncated superblock")
+	}
+}
+
+func TestVerityHashOffset(t *testing.T) {
+	for size, offset := range map[int64]int64{
+		1:    4096,
+		4096: 4096,
+		4097: 8192,
+	} {
+		if verityHashOffset(size) != offset {
+			t.Errorf("bad offset for %d: %d", size, verityHashOffset(size))
+		}
+	}
+}
+
+func TestOverlayLowerDirs(t *testing.T) {
+	lower := overlayLowerDirs([]string{"/s/0", "/s/1", "/s/2"})
+	if lower != "/s/2:/s/1:/s/0" {
+		t.Fatalf("bad lowerdir %s", lower)
+	}
+}
@@ -0,0 +1,298 @@
+package stacker
+
+import (
+	"encoding/gob"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"github.com/vbatts/go-mtree/pkg/govis"
+)
+
+// mtreeCacheEntry is the mtree keywords of a file, along with the parts of
+// its stat that change whenever any of those keywords do.
+type mtreeCacheEntry struct {
+	Ino      uint64
+	Size     int64
+	Mtime    int64
+	Ctime    int64
+	Keywords []string
+}
+
+// mtreeCache remembers the keywords of every file in the rootfs the last
+// time it was walked, so that files which haven't changed since (in
+// particular, their sha256digest) don't need to be read again.
+type mtreeCache struct {
+	Entries map[string]mtreeCacheEntry
+}
+
+func loadMtreeCache(p string) *mtreeCache {
+	cache := &mtreeCache{Entries: map[string]mtreeCacheEntry{}}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return cache
+	}
+	defer f.Close()
+
+	// an unreadable cache is just an empty one
+	if err := gob.NewDecoder(f).Decode(cache); err != nil {
+		return &mtreeCache{Entries: map[string]mtreeCacheEntry{}}
+	}
+
+	return cache
+}
+
+func (c *mtreeCache) save(p string) error {
+	tmp := p + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(f).Encode(c)
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, p)
+}
+
+// mtreeCacheMargin is how long before a walk starts files must have last
+// changed to be cached: files changed in the same clock tick as they are read
+// have the same ctime before and after the change.
+var mtreeCacheMargin = time.Second
+
+// walkedEntry is a file found by the walk; directories have their contents
+// in children, sorted by name.
+type walkedEntry struct {
+	name     string
+	keywords []mtree.KeyVal
+	isDir    bool
+	children []*walkedEntry
+}
+
+type mtreeWalker struct {
+	root     string
+	keywords []mtree.Keyword
+	fsEval   mtree.FsEval
+
+	// only files whose ctime is before this are cached
+	cacheBefore int64
+
+	// old is only read, new is written as the walk goes
+	old *mtreeCache
+	new *mtreeCache
+
+	// sem limits how many directories are walked at once
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	// lock protects new and err
+	lock sync.Mutex
+	err  error
+}
+
+// walkRootfs is mtree.Walk, except that directories are walked in parallel,
+// and files whose stat hasn't changed since the last walk that used the
+// cache at cachePath reuse their keywords from then instead of being read
+// again.
+func walkRootfs(root string, keywords []mtree.Keyword, fsEval mtree.FsEval, cachePath string) (*mtree.DirectoryHierarchy, error) {
+	w := &mtreeWalker{
+		root:     root,
+		keywords: keywords,
+		fsEval:   fsEval,
+		old:      loadMtreeCache(cachePath),
+		new:      &mtreeCache{Entries: map[string]mtreeCacheEntry{}},
+		sem:      make(chan struct{}, runtime.NumCPU()),
+
+		cacheBefore: time.Now().Add(-mtreeCacheMargin).UnixNano(),
+	}
+
+	info, err := fsEval.Lstat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	kvs, err := w.entryKeywords(".", info)
+	if err != nil {
+		return nil, err
+	}
+
+	top := &walkedEntry{name: ".", keywords: kvs, isDir: true}
+	w.wg.Add(1)
+	go w.walkDir(".", top)
+	w.wg.Wait()
+
+	if w.err != nil {
+		return nil, w.err
+	}
+
+	if err := w.new.save(cachePath); err != nil {
+		return nil, errors.Wrapf(err, "couldn't save mtree cache")
+	}
+
+	dh := &mtree.DirectoryHierarchy{}
+	addWalkedEntry(dh, top, nil)
+	return dh, nil
+}
+
+func (w *mtreeWalker) fail(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *mtreeWalker) walkDir(rel string, dir *walkedEntry) {
+	defer w.wg.Done()
+
+	w.sem <- struct{}{}
+	defer func() { <-w.sem }()
+
+	infos, err := w.fsEval.Readdir(path.Join(w.root, rel))
+	if err != nil {
+		w.fail(err)
+		return
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+	for _, info := range infos {
+		childRel := path.Join(rel, info.Name())
+		kvs, err := w.entryKeywords(childRel, info)
+		if err != nil {
+			w.fail(err)
+			return
+		}
+
+		name, err := govis.Vis(info.Name(), mtree.DefaultVisFlags)
+		if err != nil {
+			w.fail(err)
+			return
+		}
+
+		child := &walkedEntry{name: name, keywords: kvs, isDir: info.IsDir()}
+		dir.children = append(dir.children, child)
+
+		if child.isDir {
+			w.wg.Add(1)
+			go w.walkDir(childRel, child)
+		}
+	}
+}
+
+// entryKeywords computes the keywords of the file at rel, or gets them from
+// the cache if it hasn't changed.
+func (w *mtreeWalker) entryKeywords(rel string, info os.FileInfo) ([]mtree.KeyVal, error) {
+	var cacheEntry mtreeCacheEntry
+	stat, haveStat := info.Sys().(*syscall.Stat_t)
+	if haveStat {
+		cacheEntry = mtreeCacheEntry{
+			Ino:   stat.Ino,
+			Size:  stat.Size,
+			Mtime: stat.Mtim.Nano(),
+			Ctime: stat.Ctim.Nano(),
+		}
+
+		cached, ok := w.old.Entries[rel]
+		if ok && cached.Ino == cacheEntry.Ino && cached.Size == cacheEntry.Size &&
+			cached.Mtime == cacheEntry.Mtime && cached.Ctime == cacheEntry.Ctime {
+			w.lock.Lock()
+			w.new.Entries[rel] = cached
+			w.lock.Unlock()
+
+			kvs := []mtree.KeyVal{}
+			for _, kv := range cached.Keywords {
+				kvs = append(kvs, mtree.KeyVal(kv))
+			}
+			return kvs, nil
+		}
+	}
+
+	full := path.Join(w.root, rel)
+	kvs := []mtree.KeyVal{}
+	for _, keyword := range w.keywords {
+		err := func() error {
+			var r io.Reader
+			if info.Mode().IsRegular() {
+				fh, err := w.fsEval.Open(full)
+				if err != nil {
+					return err
+				}
+				defer fh.Close()
+				r = fh
+			}
+
+			keyFunc, ok := mtree.KeywordFuncs[keyword.Prefix()]
+			if !ok {
+				return errors.Errorf("unknown keyword %q for file %q", keyword.Prefix(), full)
+			}
+
+			result, err := w.fsEval.KeywordFunc(keyFunc)(full, info, r)
+			if err != nil {
+				return err
+			}
+
+			for _, kv := range result {
+				if kv != "" {
+					kvs = append(kvs, kv)
+				}
+			}
+			return nil
+		}()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if haveStat && cacheEntry.Ctime < w.cacheBefore {
+		for _, kv := range kvs {
+			cacheEntry.Keywords = append(cacheEntry.Keywords, string(kv))
+		}
+
+		w.lock.Lock()
+		w.new.Entries[rel] = cacheEntry
+		w.lock.Unlock()
+	}
+
+	return kvs, nil
+}
+
+// addWalkedEntry adds e and everything under it to dh, in the same relative
+// format that mtree.Walk uses, so that dh can be compared with (or written
+// out as) a spec.
+func addWalkedEntry(dh *mtree.DirectoryHierarchy, e *walkedEntry, parent *mtree.Entry) {
+	entry := &mtree.Entry{
+		Name:     e.name,
+		Pos:      len(dh.Entries),
+		Type:     mtree.RelativeType,
+		Keywords: e.keywords,
+		Parent:   parent,
+	}
+	dh.Entries = append(dh.Entries, *entry)
+
+	if !e.isDir {
+		return
+	}
+
+	for _, child := range e.children {
+		addWalkedEntry(dh, child, entry)
+	}
+
+	dh.Entries = append(dh.Entries, mtree.Entry{
+		Name: "..",
+		Pos:  len(dh.Entries),
+		Type: mtree.DotDotType,
+	})
+}
@@ -0,0 +1,82 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/vbatts/go-mtree"
+)
+
+var testMtreeKeywords = []mtree.Keyword{"size", "type", "uid", "gid", "mode", "link", "nlink", "sha256digest"}
+
+func checkWalkRootfs(t *testing.T, root string, cachePath string) {
+	expected, err := mtree.Walk(root, nil, testMtreeKeywords, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	walked, err := walkRootfs(root, testMtreeKeywords, mtree.DefaultFsEval{}, cachePath)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	diffs, err := mtree.Compare(expected, walked, testMtreeKeywords)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(diffs) != 0 {
+		t.Fatalf("walk differs from mtree.Walk: %v", diffs)
+	}
+}
+
+func TestWalkRootfs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_mtree_test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := path.Join(dir, "rootfs")
+	for _, d := range []string{"etc", "usr/bin", "usr/lib/x"} {
+		if err := os.MkdirAll(path.Join(root, d), 0755); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	for _, f := range []string{"etc/passwd", "usr/bin/sh", "usr/lib/x/y"} {
+		if err := ioutil.WriteFile(path.Join(root, f), []byte(f), 0644); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	if err := os.Symlink("sh", path.Join(root, "usr/bin/bash")); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// cache everything, no matter how recently it was written
+	mtreeCacheMargin = 0
+	defer func() { mtreeCacheMargin = time.Second }()
+
+	cachePath := path.Join(dir, "mtree.cache")
+	checkWalkRootfs(t, root, cachePath)
+
+	cache := loadMtreeCache(cachePath)
+	if _, ok := cache.Entries["usr/bin/sh"]; !ok {
+		t.Fatalf("usr/bin/sh not cached: %v", cache.Entries)
+	}
+
+	checkWalkRootfs(t, root, cachePath)
+
+	// changed files aren't taken from the cache
+	if err := ioutil.WriteFile(path.Join(root, "etc/passwd"), []byte("changed"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := os.Remove(path.Join(root, "usr/lib/x/y")); err != nil {
+		t.Fatalf("%s", err)
+	}
+	checkWalkRootfs(t, root, cachePath)
+}
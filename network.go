@@ -1,7 +1,6 @@
 package stacker
 
 import (
-	"fmt"
 	"io"
 	"net/http"
 	"os"
@@ -12,12 +11,16 @@ import (
 
 // download with caching support in the specified cache dir.
 func Download(cacheDir string, url string) (string, error) {
+	return download(StackerConfig{}, cacheDir, url)
+}
+
+func download(config StackerConfig, cacheDir string, url string) (string, error) {
 	name := path.Join(cacheDir, path.Base(url))
 	out, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
 	if err != nil {
 		// It already exists, let's just use that one.
 		if os.IsExist(err) {
-			fmt.Println("using cached copy of", url)
+			verboseln(config, "using cached copy of", url)
 			return name, nil
 		} else if os.IsNotExist(err) {
 			out, err = os.OpenFile(name, os.O_RDWR, 0644)
@@ -30,18 +33,18 @@ func Download(cacheDir string, url string) (string, error) {
 	}
 	defer out.Close()
 
-	fmt.Println("downloading", url)
+	infoln(config, "downloading", url)
 
 	resp, err := http.Get(url)
 	if err != nil {
 		os.RemoveAll(name)
-		return "", err
+		return "", newError(ErrDownloadFailed, err, "couldn't download %s", url)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		os.RemoveAll(name)
-		return "", fmt.Errorf("couldn't download %s: %s", url, resp.Status)
+		return "", newError(ErrDownloadFailed, nil, "couldn't download %s: %s", url, resp.Status)
 	}
 
 	source := resp.Body
@@ -54,6 +57,7 @@ func Download(cacheDir string, url string) (string, error) {
 		defer bar.Finish()
 	}
 
-	_, err = io.Copy(out, source)
+	n, err := io.Copy(out, source)
+	metricsImportBytes(n)
 	return name, err
 }
@@ -0,0 +1,77 @@
+package stacker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	WebhookFormatJSON  = "json"
+	WebhookFormatSlack = "slack"
+)
+
+// slackPayload is the minimal payload accepted by slack (and the various
+// slack compatible chat systems) incoming webhooks.
+type slackPayload struct {
+	Text string `json:"text"`
+}
+
+func webhookPayload(format string, report *StackerfileReport) ([]byte, error) {
+	switch format {
+	case "", WebhookFormatJSON:
+		return json.Marshal(report)
+	case WebhookFormatSlack:
+		status := "succeeded"
+		if !report.Success {
+			status = fmt.Sprintf("failed: %s", report.Error)
+		}
+
+		lines := []string{fmt.Sprintf("stacker build of %s %s (%.1fs)", report.Path, status, report.Duration)}
+		for _, l := range report.Layers {
+			line := fmt.Sprintf("• %s", l.Name)
+			if l.Digest != "" {
+				line = fmt.Sprintf("%s %s", line, l.Digest)
+			}
+			if l.Cached {
+				line = fmt.Sprintf("%s (cached)", line)
+			}
+			lines = append(lines, line)
+		}
+
+		return json.Marshal(slackPayload{Text: strings.Join(lines, "\n")})
+	default:
+		return nil, fmt.Errorf("unknown webhook format %s", format)
+	}
+}
+
+// notifyWebhooks POSTs a summary of the build to each of the urls. Failing to
+// notify doesn't fail the build, since the build itself is already done.
+func notifyWebhooks(config StackerConfig, urls []string, format string, report *StackerfileReport) {
+	if len(urls) == 0 {
+		return
+	}
+
+	payload, err := webhookPayload(format, report)
+	if err != nil {
+		warnf(config, "couldn't render webhook payload: %v\n", err)
+		return
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	for _, url := range urls {
+		resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			warnf(config, "couldn't notify webhook %s: %v\n", url, err)
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			warnf(config, "couldn't notify webhook %s: %s\n", url, resp.Status)
+		}
+	}
+}
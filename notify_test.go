@@ -0,0 +1,50 @@
+package stacker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNotifyWebhooks(t *testing.T) {
+	bodies := make(chan []byte, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("couldn't read body: %v", err)
+		}
+		bodies <- body
+	}))
+	defer server.Close()
+
+	report := &StackerfileReport{
+		Path:    "stacker.yaml",
+		Success: true,
+		Layers: []*LayerReport{
+			{Name: "foo", Digest: "sha256:1234", Cached: true},
+		},
+	}
+
+	notifyWebhooks(StackerConfig{}, []string{server.URL}, WebhookFormatJSON, report)
+	result := StackerfileReport{}
+	if err := json.Unmarshal(<-bodies, &result); err != nil {
+		t.Fatalf("bad json payload: %v", err)
+	}
+
+	if result.Path != "stacker.yaml" || len(result.Layers) != 1 || result.Layers[0].Digest != "sha256:1234" {
+		t.Fatalf("bad json payload: %v", result)
+	}
+
+	notifyWebhooks(StackerConfig{}, []string{server.URL}, WebhookFormatSlack, report)
+	slack := slackPayload{}
+	if err := json.Unmarshal(<-bodies, &slack); err != nil {
+		t.Fatalf("bad slack payload: %v", err)
+	}
+
+	if !strings.Contains(slack.Text, "succeeded") || !strings.Contains(slack.Text, "foo sha256:1234 (cached)") {
+		t.Fatalf("bad slack payload: %s", slack.Text)
+	}
+}
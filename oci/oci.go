@@ -6,6 +6,7 @@ import (
 	"io"
 
 	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 )
@@ -52,8 +53,9 @@ func LookupConfig(oci casext.Engine, desc ispec.Descriptor) (ispec.Image, error)
 }
 
 // AddBlobNoCompression adds a blob to an OCI tag without compressing it (i.e.
-// not through umoci.mutator).
-func AddBlobNoCompression(oci casext.Engine, name string, content io.Reader) (ispec.Descriptor, error) {
+// not through umoci.mutator). If history is not nil, it is added to the
+// image's history as the entry for the new layer.
+func AddBlobNoCompression(oci casext.Engine, name string, content io.Reader, history *ispec.History) (ispec.Descriptor, error) {
 	manifest, err := LookupManifest(oci, name)
 	if err != nil {
 		return ispec.Descriptor{}, err
@@ -77,6 +79,9 @@ func AddBlobNoCompression(oci casext.Engine, name string, content io.Reader) (is
 
 	manifest.Layers = append(manifest.Layers, desc)
 	config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, blobDigest)
+	if history != nil {
+		config.History = append(config.History, *history)
+	}
 
 	configDigest, configSize, err := oci.PutBlobJSON(context.Background(), config)
 	if err != nil {
@@ -107,3 +112,50 @@ func AddBlobNoCompression(oci casext.Engine, name string, content io.Reader) (is
 
 	return desc, nil
 }
+
+// ClearLayers stores a copy of the image whose manifest is desc without any of
+// its layers (or their history), and returns the descriptor of the copy's
+// manifest. Adding a layer of the whole rootfs to that squashes the image.
+func ClearLayers(oci casext.Engine, desc ispec.Descriptor) (ispec.Descriptor, error) {
+	blob, err := oci.FromDescriptor(context.Background(), desc)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	defer blob.Close()
+
+	manifest, ok := blob.Data.(ispec.Manifest)
+	if !ok {
+		return ispec.Descriptor{}, errors.Errorf("%s is not a manifest", desc.Digest)
+	}
+
+	config, err := LookupConfig(oci, manifest.Config)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	manifest.Layers = []ispec.Descriptor{}
+	config.RootFS.DiffIDs = []digest.Digest{}
+	config.History = []ispec.History{}
+
+	configDigest, configSize, err := oci.PutBlobJSON(context.Background(), config)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	manifest.Config = ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageConfig,
+		Digest:    configDigest,
+		Size:      configSize,
+	}
+
+	manifestDigest, manifestSize, err := oci.PutBlobJSON(context.Background(), manifest)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}, nil
+}
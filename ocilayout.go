@@ -0,0 +1,225 @@
+package stacker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// layerMediaTypes are the layer types stacker can unpack.
+var layerMediaTypes = map[string]bool{
+	ispec.MediaTypeImageLayer:                     true,
+	ispec.MediaTypeImageLayerGzip:                 true,
+	ispec.MediaTypeImageLayerNonDistributable:     true,
+	ispec.MediaTypeImageLayerNonDistributableGzip: true,
+	stackeroci.MediaTypeLayerSquashfs:             true,
+}
+
+// ociLayoutRef splits an oci base's url into the layout's path and the tag
+// in it, which is empty if the url doesn't have one.
+func ociLayoutRef(u string) (string, string) {
+	// tags can't have /s in them, so a : before the last / is part of
+	// the path
+	i := strings.LastIndex(u, ":")
+	if i < 0 || strings.Contains(u[i:], "/") {
+		return u, ""
+	}
+	return u[:i], u[i+1:]
+}
+
+// resolveOCILayout finds the image manifest for tag in oci, going through any
+// indexes (e.g. of multi-platform images) on the way, and picking the one for
+// platform (or the host) if there are several. An empty tag means the
+// layout's only image, for layouts whose images don't have names.
+func resolveOCILayout(oci casext.Engine, tag string, platform ispec.Platform) (ispec.Descriptor, error) {
+	ctx := context.Background()
+	index, err := oci.GetIndex(ctx)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	roots := []ispec.Descriptor{}
+	for _, desc := range index.Manifests {
+		if tag == "" || desc.Annotations[ispec.AnnotationRefName] == tag {
+			roots = append(roots, desc)
+		}
+	}
+
+	if len(roots) == 0 {
+		return ispec.Descriptor{}, fmt.Errorf("no image %s", tag)
+	}
+
+	if tag == "" && len(roots) != 1 {
+		return ispec.Descriptor{}, fmt.Errorf("there are %d images, so one needs to be picked with a tag", len(roots))
+	}
+
+	manifests := []ispec.Descriptor{}
+	for _, root := range roots {
+		err := oci.Walk(ctx, root, func(dp casext.DescriptorPath) error {
+			desc := dp.Descriptor()
+			switch desc.MediaType {
+			case ispec.MediaTypeImageIndex:
+				return nil
+			case ispec.MediaTypeImageManifest:
+				manifests = append(manifests, desc)
+				return casext.ErrSkipDescriptor
+			default:
+				return errors.Errorf("%s is a %s, not an OCI image or index", desc.Digest, desc.MediaType)
+			}
+		})
+		if err != nil {
+			return ispec.Descriptor{}, err
+		}
+	}
+
+	return pickPlatform(manifests, orHost(platform))
+}
+
+// pickPlatform picks the manifest for platform from manifests, unless there's
+// only one. The variant only matters if platform has one.
+func pickPlatform(manifests []ispec.Descriptor, platform ispec.Platform) (ispec.Descriptor, error) {
+	if len(manifests) == 1 {
+		return manifests[0], nil
+	}
+
+	matches := []ispec.Descriptor{}
+	for _, m := range manifests {
+		if m.Platform == nil || m.Platform.OS != platform.OS || m.Platform.Architecture != platform.Architecture {
+			continue
+		}
+
+		if platform.Variant != "" && m.Platform.Variant != platform.Variant {
+			continue
+		}
+
+		matches = append(matches, m)
+	}
+
+	name := platform.OS + "/" + platform.Architecture
+	if platform.Variant != "" {
+		name += "/" + platform.Variant
+	}
+
+	switch len(matches) {
+	case 0:
+		return ispec.Descriptor{}, fmt.Errorf("none of its %d images are for %s", len(manifests), name)
+	case 1:
+		return matches[0], nil
+	default:
+		return ispec.Descriptor{}, fmt.Errorf("%d of its images are for %s", len(matches), name)
+	}
+}
+
+// checkOCIImage checks that manifest is an image stacker can build on.
+func checkOCIImage(manifest ispec.Manifest) error {
+	if manifest.Config.MediaType != ispec.MediaTypeImageConfig {
+		return errors.Errorf("its config is a %s, not an OCI image config", manifest.Config.MediaType)
+	}
+
+	for _, l := range manifest.Layers {
+		if !layerMediaTypes[l.MediaType] {
+			return errors.Errorf("layer %s is a %s, which stacker can't unpack", l.Digest, l.MediaType)
+		}
+	}
+
+	return nil
+}
+
+// copyBlob copies the blob desc from src to dest, checking that it is what
+// desc says it is.
+func copyBlob(src casext.Engine, dest casext.Engine, desc ispec.Descriptor) error {
+	ctx := context.Background()
+	blob, err := src.GetBlob(ctx, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	d, size, err := dest.PutBlob(ctx, blob)
+	if err != nil {
+		return err
+	}
+
+	if d != desc.Digest || size != desc.Size {
+		return errors.Errorf("blob %s is really %s (%d bytes, not %d)", desc.Digest, d, size, desc.Size)
+	}
+
+	return nil
+}
+
+// importOCILayout imports the image url (path[:tag]) from an OCI layout, which
+// may have been made by another tool, as tag in the import layout at
+// cacheDir.
+func importOCILayout(config StackerConfig, url string, cacheDir string, tag string, platform ispec.Platform) error {
+	layoutPath, ref := ociLayoutRef(url)
+	if _, err := os.Stat(path.Join(layoutPath, "index.json")); err != nil {
+		return errors.Wrapf(err, "%s isn't an OCI layout", layoutPath)
+	}
+
+	src, err := umoci.OpenLayout(layoutPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	desc, err := resolveOCILayout(src, ref, platform)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't find an image in %s", url)
+	}
+
+	blob, err := src.GetBlob(context.Background(), desc.Digest)
+	if err != nil {
+		return err
+	}
+	manifest := ispec.Manifest{}
+	err = json.NewDecoder(io.LimitReader(blob, desc.Size)).Decode(&manifest)
+	blob.Close()
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read manifest of %s", url)
+	}
+
+	if err := checkOCIImage(manifest); err != nil {
+		return errors.Wrapf(err, "can't build on %s", url)
+	}
+
+	var dest casext.Engine
+	if _, err := os.Stat(path.Join(cacheDir, "index.json")); err != nil {
+		os.RemoveAll(cacheDir)
+		dest, err = umoci.CreateLayout(cacheDir)
+	} else {
+		dest, err = umoci.OpenLayout(cacheDir)
+	}
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	infof(config, "loading %s (%s)\n", url, desc.Digest)
+	for _, d := range append([]ispec.Descriptor{manifest.Config}, manifest.Layers...) {
+		if err := copyBlob(src, dest, d); err != nil {
+			return errors.Wrapf(err, "couldn't copy %s", url)
+		}
+	}
+
+	if err := copyBlob(src, dest, desc); err != nil {
+		return errors.Wrapf(err, "couldn't copy %s", url)
+	}
+
+	// the platform and annotations were about its place in the source
+	// layout
+	return dest.UpdateReference(context.Background(), tag, ispec.Descriptor{
+		MediaType: desc.MediaType,
+		Digest:    desc.Digest,
+		Size:      desc.Size,
+	})
+}
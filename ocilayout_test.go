@@ -0,0 +1,153 @@
+package stacker
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestOCILayoutRef(t *testing.T) {
+	for url, expected := range map[string][2]string{
+		"/path/to/layout:tag":   {"/path/to/layout", "tag"},
+		"/path/to/layout":       {"/path/to/layout", ""},
+		"/path/with:colon/oci":  {"/path/with:colon/oci", ""},
+		"relative/layout:1.2.3": {"relative/layout", "1.2.3"},
+	} {
+		layout, tag := ociLayoutRef(url)
+		if layout != expected[0] || tag != expected[1] {
+			t.Errorf("bad ref for %s: %s %s", url, layout, tag)
+		}
+	}
+}
+
+// putImage adds an image with one layer to oci, and returns its manifest's
+// descriptor.
+func putImage(t *testing.T, oci casext.Engine, layerType string, content string) ispec.Descriptor {
+	ctx := context.Background()
+
+	layerDigest, layerSize, err := oci.PutBlob(ctx, bytes.NewBufferString(content))
+	if err != nil {
+		t.Fatalf("couldn't put layer: %v", err)
+	}
+
+	configDigest, configSize, err := oci.PutBlobJSON(ctx, ispec.Image{OS: runtime.GOOS, Architecture: runtime.GOARCH})
+	if err != nil {
+		t.Fatalf("couldn't put config: %v", err)
+	}
+
+	manifest := ispec.Manifest{
+		Config: ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig, Digest: configDigest, Size: configSize},
+		Layers: []ispec.Descriptor{{MediaType: layerType, Digest: layerDigest, Size: layerSize}},
+	}
+	manifest.SchemaVersion = 2
+
+	manifestDigest, manifestSize, err := oci.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		t.Fatalf("couldn't put manifest: %v", err)
+	}
+
+	return ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: manifestDigest, Size: manifestSize}
+}
+
+func TestImportOCILayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_ocilayout_test")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	layout := path.Join(dir, "layout")
+	oci, err := umoci.CreateLayout(layout)
+	if err != nil {
+		t.Fatalf("couldn't create layout: %v", err)
+	}
+	defer oci.Close()
+
+	ctx := context.Background()
+
+	// a multi-platform image, whose index is itself in an index, like
+	// some tools make them
+	native := putImage(t, oci, ispec.MediaTypeImageLayer, "native")
+	native.Platform = &ispec.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	other := putImage(t, oci, ispec.MediaTypeImageLayer, "other")
+	other.Platform = &ispec.Platform{OS: "plan9", Architecture: "mips"}
+
+	inner := ispec.Index{Manifests: []ispec.Descriptor{other, native}}
+	inner.SchemaVersion = 2
+	innerDigest, innerSize, err := oci.PutBlobJSON(ctx, inner)
+	if err != nil {
+		t.Fatalf("couldn't put index: %v", err)
+	}
+
+	outer := ispec.Index{Manifests: []ispec.Descriptor{{MediaType: ispec.MediaTypeImageIndex, Digest: innerDigest, Size: innerSize}}}
+	outer.SchemaVersion = 2
+	outerDigest, outerSize, err := oci.PutBlobJSON(ctx, outer)
+	if err != nil {
+		t.Fatalf("couldn't put index: %v", err)
+	}
+
+	err = oci.UpdateReference(ctx, "multi", ispec.Descriptor{MediaType: ispec.MediaTypeImageIndex, Digest: outerDigest, Size: outerSize})
+	if err != nil {
+		t.Fatalf("couldn't tag index: %v", err)
+	}
+
+	desc, err := resolveOCILayout(oci, "multi", ispec.Platform{})
+	if err != nil {
+		t.Fatalf("couldn't resolve multi: %v", err)
+	}
+
+	if desc.Digest != native.Digest {
+		t.Fatalf("resolved the wrong image: %s", desc.Digest)
+	}
+
+	desc, err = resolveOCILayout(oci, "multi", ispec.Platform{OS: "plan9", Architecture: "mips"})
+	if err != nil || desc.Digest != other.Digest {
+		t.Fatalf("couldn't resolve the other platform: %s %v", desc.Digest, err)
+	}
+
+	if _, err := resolveOCILayout(oci, "missing", ispec.Platform{}); err == nil {
+		t.Errorf("resolved a missing tag")
+	}
+
+	cacheDir := path.Join(dir, "cache")
+	if err := importOCILayout(StackerConfig{}, layout+":multi", cacheDir, "imported", ispec.Platform{}); err != nil {
+		t.Fatalf("couldn't import multi: %v", err)
+	}
+
+	cache, err := umoci.OpenLayout(cacheDir)
+	if err != nil {
+		t.Fatalf("couldn't open cache: %v", err)
+	}
+	defer cache.Close()
+
+	descs, err := cache.ResolveReference(ctx, "imported")
+	if err != nil || len(descs) != 1 || descs[0].Descriptor().Digest != native.Digest {
+		t.Fatalf("bad import: %v %v", descs, err)
+	}
+
+	// only the one image is in the layout now, so it doesn't need a tag
+	if _, err := resolveOCILayout(oci, "", ispec.Platform{}); err != nil {
+		t.Errorf("couldn't resolve the only image: %v", err)
+	}
+
+	docker := putImage(t, oci, "application/vnd.docker.image.rootfs.diff.tar.gzip", "docker")
+	if err := oci.UpdateReference(ctx, "docker", docker); err != nil {
+		t.Fatalf("couldn't tag image: %v", err)
+	}
+
+	if _, err := resolveOCILayout(oci, "", ispec.Platform{}); err == nil {
+		t.Errorf("resolved an image without a tag when there are several")
+	}
+
+	if err := importOCILayout(StackerConfig{}, layout+":docker", cacheDir, "docker", ispec.Platform{}); err == nil {
+		t.Errorf("imported an image with docker layers")
+	}
+}
@@ -0,0 +1,157 @@
+package stacker
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// The levels of stacker's output, see SetOutputLevel.
+const (
+	// QuietOutput only prints warnings and errors.
+	QuietOutput = iota - 1
+
+	// NormalOutput also prints what stacker is doing, and what layers'
+	// commands print.
+	NormalOutput
+
+	// VerboseOutput also prints the details of how stacker is doing it.
+	VerboseOutput
+)
+
+var (
+	outputLevel = NormalOutput
+
+	// noColor turns off colored and animated output (i.e. the progress
+	// bars of image copies); it's turned off when stdout isn't a
+	// terminal, or when NO_COLOR is set.
+	noColor = os.Getenv("NO_COLOR") != "" || !isTerminal(os.Stdout)
+)
+
+// SetOutputLevel sets how much stacker prints, for the whole process.
+func SetOutputLevel(level int) {
+	outputLevel = level
+}
+
+// DisableColor turns off colored and animated output, even when stdout is a
+// terminal.
+func DisableColor() {
+	noColor = true
+}
+
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// stdout is where the output of stacker (and of what it runs) goes: the
+// writer of the Stacker the config is for, see WithOutput, or else this
+// process' stdout.
+func (c StackerConfig) stdout() io.Writer {
+	if c.output != nil {
+		return c.output
+	}
+	return os.Stdout
+}
+
+// stderr is where the errors of what stacker runs go: the same writer as
+// stdout, if the Stacker has one.
+func (c StackerConfig) stderr() io.Writer {
+	if c.output != nil {
+		return c.output
+	}
+	return os.Stderr
+}
+
+// lineWriter writes what's written to it to w one line per Write, from
+// however many goroutines (e.g. a command's stdout and stderr copiers).
+type lineWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	partial string
+}
+
+func (lw *lineWriter) Write(b []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	lines := strings.SplitAfter(lw.partial+string(b), "\n")
+	lw.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		if _, err := lw.w.Write([]byte(line)); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// flush writes out the last line, if it wasn't terminated.
+func (lw *lineWriter) flush() {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	if lw.partial != "" {
+		lw.w.Write([]byte(lw.partial))
+		lw.partial = ""
+	}
+}
+
+func infof(config StackerConfig, format string, args ...interface{}) {
+	if outputLevel >= NormalOutput {
+		fmt.Fprintf(config.stdout(), format, args...)
+	}
+}
+
+func infoln(config StackerConfig, args ...interface{}) {
+	if outputLevel >= NormalOutput {
+		fmt.Fprintln(config.stdout(), args...)
+	}
+}
+
+func verbosef(config StackerConfig, format string, args ...interface{}) {
+	if outputLevel >= VerboseOutput {
+		fmt.Fprintf(config.stdout(), format, args...)
+	}
+}
+
+func verboseln(config StackerConfig, args ...interface{}) {
+	if outputLevel >= VerboseOutput {
+		fmt.Fprintln(config.stdout(), args...)
+	}
+}
+
+// warnf prints a warning, which is printed at every output level.
+func warnf(config StackerConfig, format string, args ...interface{}) {
+	fmt.Fprintf(config.stdout(), format, args...)
+}
+
+// Warnf prints a warning the way stacker does, for the commands built on it.
+func Warnf(config StackerConfig, format string, args ...interface{}) {
+	warnf(config, format, args...)
+}
+
+func warnln(config StackerConfig, args ...interface{}) {
+	fmt.Fprintln(config.stdout(), args...)
+}
+
+// consoleOutput is where the output of layers' commands goes on the
+// console: nowhere, if stacker is quiet.
+func consoleOutput(config StackerConfig) io.Writer {
+	if outputLevel < NormalOutput {
+		return ioutil.Discard
+	}
+	return config.stdout()
+}
+
+// progressOutput is where the progress of image copies goes, if anywhere.
+func progressOutput(config StackerConfig) io.Writer {
+	if outputLevel < NormalOutput || noColor {
+		return nil
+	}
+	return config.stdout()
+}
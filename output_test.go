@@ -0,0 +1,60 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestOutputLevels(t *testing.T) {
+	defer SetOutputLevel(NormalOutput)
+
+	SetOutputLevel(QuietOutput)
+	if consoleOutput(StackerConfig{}) != ioutil.Discard || progressOutput(StackerConfig{}) != nil {
+		t.Errorf("quiet output went to the console")
+	}
+
+	SetOutputLevel(NormalOutput)
+	if consoleOutput(StackerConfig{}) != os.Stdout {
+		t.Errorf("commands' output didn't go to the console")
+	}
+
+	noColor = false
+	if progressOutput(StackerConfig{}) != os.Stdout {
+		t.Errorf("progress wasn't shown")
+	}
+
+	DisableColor()
+	if progressOutput(StackerConfig{}) != nil {
+		t.Errorf("progress was shown without color")
+	}
+}
+
+type writes [][]byte
+
+func (w *writes) Write(b []byte) (int, error) {
+	*w = append(*w, append([]byte{}, b...))
+	return len(b), nil
+}
+
+func TestLineWriter(t *testing.T) {
+	w := &writes{}
+	lw := &lineWriter{w: w}
+
+	for _, s := range []string{"building ", "foo\nrunning", " bar\n", "no newline"} {
+		if n, err := lw.Write([]byte(s)); err != nil || n != len(s) {
+			t.Fatalf("bad write of %q: %d %v", s, n, err)
+		}
+	}
+	lw.flush()
+
+	expected := []string{"building foo\n", "running bar\n", "no newline"}
+	if len(*w) != len(expected) {
+		t.Fatalf("bad writes %q", *w)
+	}
+	for i, line := range expected {
+		if string((*w)[i]) != line {
+			t.Errorf("bad write %d: %q", i, (*w)[i])
+		}
+	}
+}
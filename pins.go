@@ -0,0 +1,99 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// PinFail fails the build when an import doesn't match its pin.
+	PinFail = "fail"
+
+	// PinWarn only warns about it.
+	PinWarn = "warn"
+)
+
+func readImportPins(file string) (map[string]string, error) {
+	pins := map[string]string{}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return pins, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, &pins); err != nil {
+		return nil, fmt.Errorf("bad import pins file %s: %v", file, err)
+	}
+
+	return pins, nil
+}
+
+// checkImportPin checks that the http(s) import url, downloaded to p, has the
+// sha256 it had the first time it was downloaded, which is pinned in the
+// config's ImportPins file then (trust on first use). Pins are kept by url,
+// without its credentials, so that the file can be committed along with the
+// stackerfile.
+func checkImportPin(c StackerConfig, url string, p string) error {
+	if c.ImportPins == "" {
+		return nil
+	}
+
+	mode := c.ImportPinMode
+	if mode == "" {
+		mode = PinFail
+	}
+	if mode != PinFail && mode != PinWarn {
+		return fmt.Errorf("unknown import_pin_mode %s", mode)
+	}
+
+	lock, err := lockFile(c, "import-pins", unix.LOCK_EX, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	pins, err := readImportPins(c.ImportPins)
+	if err != nil {
+		return err
+	}
+
+	sum, err := hashFile(p)
+	if err != nil {
+		return err
+	}
+
+	key := redactURL(url)
+	pinned, ok := pins[key]
+	if !ok {
+		pins[key] = sum
+		content, err := json.MarshalIndent(pins, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		infof(c, "pinning %s to %s\n", key, sum)
+		return ioutil.WriteFile(c.ImportPins, append(content, '\n'), 0644)
+	}
+
+	if pinned == sum {
+		return nil
+	}
+
+	if mode == PinWarn {
+		warnf(c, "%s has %s, but was pinned to %s in %s\n", key, sum, pinned, c.ImportPins)
+		return nil
+	}
+
+	// so that the next build downloads it again, rather than using what
+	// doesn't match
+	os.Remove(p)
+	return newError(ErrImportHashMismatch, nil, "%s has %s, but was pinned to %s in %s; if it was meant to change, remove its pin",
+		key, sum, pinned, c.ImportPins)
+}
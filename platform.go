@@ -0,0 +1,63 @@
+package stacker
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ParsePlatform parses a platform in the usual os/arch[/variant] form, e.g.
+// linux/arm64 or linux/arm/v7.
+func ParsePlatform(platform string) (ispec.Platform, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return ispec.Platform{}, fmt.Errorf("invalid platform %s, it should be os/arch[/variant]", platform)
+	}
+
+	p := ispec.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+
+	return p, nil
+}
+
+// platform is the platform the layer says it's for. Fields it doesn't set
+// are empty.
+func (l *Layer) platform() ispec.Platform {
+	return ispec.Platform{OS: l.OS, Architecture: l.Arch, Variant: l.Variant}
+}
+
+// setDefaultPlatform makes the layer for platform, unless it says otherwise.
+func (l *Layer) setDefaultPlatform(platform ispec.Platform) {
+	if l.OS == "" {
+		l.OS = platform.OS
+	}
+
+	if l.Arch == "" {
+		l.Arch = platform.Architecture
+		if l.Variant == "" {
+			l.Variant = platform.Variant
+		}
+	}
+}
+
+// orHost fills in the parts of p that aren't set with the host's.
+func orHost(p ispec.Platform) ispec.Platform {
+	if p.OS == "" {
+		p.OS = runtime.GOOS
+	}
+
+	if p.Architecture == "" {
+		p.Architecture = runtime.GOARCH
+	}
+
+	return p
+}
+
+// isHost returns true if p is the host's platform, or doesn't say what it is.
+func isHost(p ispec.Platform) bool {
+	return (p.OS == "" || p.OS == runtime.GOOS) && (p.Architecture == "" || p.Architecture == runtime.GOARCH)
+}
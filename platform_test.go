@@ -0,0 +1,42 @@
+package stacker
+
+import (
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParsePlatform(t *testing.T) {
+	p, err := ParsePlatform("linux/arm/v7")
+	if err != nil || p.OS != "linux" || p.Architecture != "arm" || p.Variant != "v7" {
+		t.Fatalf("bad platform: %v %v", p, err)
+	}
+
+	p, err = ParsePlatform("linux/arm64")
+	if err != nil || p.OS != "linux" || p.Architecture != "arm64" || p.Variant != "" {
+		t.Fatalf("bad platform: %v %v", p, err)
+	}
+
+	for _, bad := range []string{"linux", "linux/", "/arm64", "linux/arm/v7/extra"} {
+		if _, err := ParsePlatform(bad); err == nil {
+			t.Errorf("parsed bad platform %s", bad)
+		}
+	}
+}
+
+func TestSetDefaultPlatform(t *testing.T) {
+	arm := ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+
+	l := &Layer{}
+	l.setDefaultPlatform(arm)
+	if p := l.platform(); p.OS != "linux" || p.Architecture != "arm" || p.Variant != "v7" {
+		t.Fatalf("default platform not used: %v", l.platform())
+	}
+
+	// a layer's own arch doesn't get the default's variant
+	l = &Layer{Arch: "arm64"}
+	l.setDefaultPlatform(arm)
+	if p := l.platform(); p.OS != "linux" || p.Architecture != "arm64" || p.Variant != "" {
+		t.Fatalf("bad platform: %v", l.platform())
+	}
+}
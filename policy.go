@@ -0,0 +1,135 @@
+package stacker
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PolicyQuery is the rule that policies define: the set of reasons an image
+// violates them, e.g.
+//
+//	package stacker
+//
+//	deny[msg] {
+//		not input.config.config.Labels["org.opencontainers.image.source"]
+//		msg := "images must set org.opencontainers.image.source"
+//	}
+const PolicyQuery = "data.stacker.deny"
+
+// policyInput is the document policies are evaluated against: what
+// stacker inspect says about the image, and its name.
+type policyInput struct {
+	Name string `json:"name"`
+	*ImageInspection
+}
+
+// policies are the rego files (or directories of them) images are checked
+// against: the config's, then the ones given to the build.
+func (opts *BuildArgs) policies() []string {
+	return append(append([]string{}, opts.Config.Policies...), opts.Policies...)
+}
+
+// opaResult is the part of `opa eval --format json`'s output we care about.
+type opaResult struct {
+	Result []struct {
+		Expressions []struct {
+			Value interface{} `json:"value"`
+		} `json:"expressions"`
+	} `json:"result"`
+}
+
+// violations returns the reasons in the value of the query, which is usually
+// a set of strings, but can be a set of anything.
+func (r opaResult) violations() []string {
+	violations := []string{}
+	for _, result := range r.Result {
+		for _, expr := range result.Expressions {
+			values, ok := expr.Value.([]interface{})
+			if !ok {
+				values = []interface{}{expr.Value}
+			}
+
+			for _, v := range values {
+				if s, ok := v.(string); ok {
+					violations = append(violations, s)
+					continue
+				}
+
+				content, _ := json.Marshal(v)
+				violations = append(violations, string(content))
+			}
+		}
+	}
+
+	return violations
+}
+
+// evalPolicies evaluates PolicyQuery with the opa binary at opa, and returns
+// the violations it finds.
+func evalPolicies(opa string, policies []string, input interface{}) ([]string, error) {
+	f, err := ioutil.TempFile("", "stacker-policy-input")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+
+	err = json.NewEncoder(f).Encode(input)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"eval", "--format", "json", "--input", f.Name()}
+	for _, p := range policies {
+		args = append(args, "--data", p)
+	}
+	args = append(args, PolicyQuery)
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(opa, args...)
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't evaluate policies: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	result := opaResult{}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, errors.Wrapf(err, "bad output from opa")
+	}
+
+	return result.violations(), nil
+}
+
+// checkPolicies checks the image name against the build's policies, before
+// it's saved anywhere, and fails with ErrPolicyViolation if it breaks any of
+// them.
+func checkPolicies(opts *BuildArgs, name string) error {
+	policies := opts.policies()
+	if len(policies) == 0 {
+		return nil
+	}
+
+	inspection, err := Inspect(opts.Config, name)
+	if err != nil {
+		return err
+	}
+
+	verbosef(opts.Config, "checking %s against policies %s\n", name, strings.Join(policies, ", "))
+	violations, err := evalPolicies(opts.Config.ToolPath(ToolOPA), policies, policyInput{Name: name, ImageInspection: inspection})
+	if err != nil {
+		return err
+	}
+
+	if len(violations) > 0 {
+		return newError(ErrPolicyViolation, nil, "%s violates policy: %s", name, strings.Join(violations, "; "))
+	}
+
+	return nil
+}
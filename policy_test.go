@@ -0,0 +1,84 @@
+package stacker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestPolicyViolations(t *testing.T) {
+	output := `{"result": [{"expressions": [{"value": ["no latest tags", {"label": "source"}], "text": "data.stacker.deny"}]}]}`
+
+	result := opaResult{}
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		t.Fatalf("couldn't parse output %v", err)
+	}
+
+	violations := result.violations()
+	expected := []string{"no latest tags", `{"label":"source"}`}
+	if !reflect.DeepEqual(violations, expected) {
+		t.Errorf("expected violations %v, got %v", expected, violations)
+	}
+
+	if violations := (opaResult{}).violations(); len(violations) != 0 {
+		t.Errorf("undefined deny has violations %v", violations)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	opts := &BuildArgs{
+		Config:   StackerConfig{Policies: []string{"/etc/stacker/policies"}},
+		Policies: []string{"extra.rego"},
+	}
+
+	expected := []string{"/etc/stacker/policies", "extra.rego"}
+	if policies := opts.policies(); !reflect.DeepEqual(policies, expected) {
+		t.Errorf("expected policies %v, got %v", expected, policies)
+	}
+}
+
+func TestEvalPolicies(t *testing.T) {
+	if _, err := exec.LookPath("opa"); err != nil {
+		t.Skip("opa isn't installed")
+	}
+
+	dir, err := ioutil.TempDir("", "stacker-policy-test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	policy := `package stacker
+
+deny[msg] {
+	not input.annotations["org.opencontainers.image.source"]
+	msg := sprintf("%s has no source", [input.name])
+}
+`
+	if err := ioutil.WriteFile(path.Join(dir, "source.rego"), []byte(policy), 0644); err != nil {
+		t.Fatalf("couldn't write policy %v", err)
+	}
+
+	violations, err := evalPolicies("opa", []string{dir}, policyInput{Name: "foo", ImageInspection: &ImageInspection{}})
+	if err != nil {
+		t.Fatalf("couldn't evaluate policies %v", err)
+	}
+
+	if len(violations) != 1 || violations[0] != "foo has no source" {
+		t.Errorf("bad violations %v", violations)
+	}
+
+	inspection := &ImageInspection{Annotations: map[string]string{"org.opencontainers.image.source": "https://example.com"}}
+	violations, err = evalPolicies("opa", []string{dir}, policyInput{Name: "foo", ImageInspection: inspection})
+	if err != nil {
+		t.Fatalf("couldn't evaluate policies %v", err)
+	}
+
+	if len(violations) != 0 {
+		t.Errorf("unexpected violations %v", violations)
+	}
+}
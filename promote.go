@@ -0,0 +1,130 @@
+package stacker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/openSUSE/umoci"
+	"github.com/opencontainers/go-digest"
+)
+
+// Retag points the tag dst in the output at exactly what src points at, so
+// that the image (or image index) keeps its digest and annotations. It
+// replaces whatever dst was before.
+func Retag(config StackerConfig, src string, dst string) error {
+	lock, err := LockOCIDir(config)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	oci, err := umoci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	descs, err := oci.ResolveReference(context.Background(), src)
+	if err != nil {
+		return err
+	}
+
+	if len(descs) == 0 {
+		return fmt.Errorf("no image tagged %s", src)
+	}
+
+	// an image index resolves to each of its manifests, which all have it
+	// as their root
+	root := descs[0].Root()
+	for _, d := range descs[1:] {
+		if d.Root().Digest != root.Digest {
+			return fmt.Errorf("%s is tagged more than once", src)
+		}
+	}
+
+	return oci.UpdateReference(context.Background(), dst, root)
+}
+
+// promoteSource is the image url of what to promote: tag itself if it's an
+// image url, or else the tag in the output.
+func promoteSource(config StackerConfig, tag string) string {
+	if strings.Contains(tag, "://") || strings.HasPrefix(tag, "oci:") {
+		return tag
+	}
+
+	return fmt.Sprintf("oci:%s:%s", config.OCIDir, tag)
+}
+
+func promoteDigest(opts *BuildArgs, url string) (digest.Digest, error) {
+	tls, err := opts.Config.registryTLS(url)
+	if err != nil {
+		return "", err
+	}
+
+	creds, err := opts.registryAuth().forURL(opts.Config, url)
+	if err != nil {
+		return "", err
+	}
+
+	return lib.ManifestDigest(url, tls, creds)
+}
+
+// Promote copies the image tag (a tag in the output, or an image url, e.g. a
+// staging registry's docker://registry.example.com/staging/app:1.2) to
+// destURL as it is, without rebuilding it, and returns its digest. Since the
+// manifest isn't changed, the image has the same digest and annotations at
+// destURL as it had when it was tested; if the destination changed the
+// manifest anyway, Promote returns an error.
+func Promote(opts *BuildArgs, tag string, destURL string) (digest.Digest, error) {
+	src := promoteSource(opts.Config, tag)
+	if src != tag {
+		lock, err := LockOCIDir(opts.Config)
+		if err != nil {
+			return "", err
+		}
+		defer lock.Unlock()
+	}
+
+	want, err := promoteDigest(opts, src)
+	if err != nil {
+		return "", err
+	}
+
+	srcTLS, err := opts.Config.registryTLS(src)
+	if err != nil {
+		return "", err
+	}
+
+	destTLS, err := opts.Config.registryTLS(destURL)
+	if err != nil {
+		return "", err
+	}
+
+	infof(opts.Config, "promoting %s (%s) to %s\n", redactURL(src), want, redactURL(destURL))
+	err = imageCopy(opts.Config, lib.ImageCopyOpts{
+		Src:      src,
+		Dest:     destURL,
+		Progress: progressOutput(opts.Config),
+		SrcTLS:   srcTLS,
+		DestTLS:  destTLS,
+	}, opts.registryAuth())
+	if err != nil {
+		if isUnauthorized(err) {
+			return "", newError(ErrPushUnauthorized, err, "couldn't promote to %s", destURL)
+		}
+		return "", err
+	}
+
+	got, err := promoteDigest(opts, destURL)
+	if err != nil {
+		return "", err
+	}
+
+	if got != want {
+		return "", fmt.Errorf("%s has digest %s instead of %s", redactURL(destURL), got, want)
+	}
+
+	return want, nil
+}
@@ -0,0 +1,82 @@
+package stacker
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/openSUSE/umoci"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestRetag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_promote_test")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := StackerConfig{
+		StackerDir: path.Join(dir, ".stacker"),
+		OCIDir:     path.Join(dir, "oci"),
+	}
+
+	if err := os.MkdirAll(config.StackerDir, 0755); err != nil {
+		t.Fatalf("couldn't make stacker dir: %v", err)
+	}
+
+	oci, err := umoci.CreateLayout(config.OCIDir)
+	if err != nil {
+		t.Fatalf("couldn't create layout: %v", err)
+	}
+
+	desc := putImage(t, oci, ispec.MediaTypeImageLayer, "layer")
+	desc.Annotations = map[string]string{"org.example.tested": "true"}
+	if err := oci.UpdateReference(context.Background(), "staging", desc); err != nil {
+		t.Fatalf("couldn't tag image: %v", err)
+	}
+	oci.Close()
+
+	if err := Retag(config, "staging", "production"); err != nil {
+		t.Fatalf("couldn't retag: %v", err)
+	}
+
+	if err := Retag(config, "missing", "production"); err == nil {
+		t.Errorf("retagged an image that isn't there")
+	}
+
+	oci, err = umoci.OpenLayout(config.OCIDir)
+	if err != nil {
+		t.Fatalf("couldn't open layout: %v", err)
+	}
+	defer oci.Close()
+
+	descs, err := oci.ResolveReference(context.Background(), "production")
+	if err != nil || len(descs) != 1 {
+		t.Fatalf("couldn't resolve production: %v (%d)", err, len(descs))
+	}
+
+	root := descs[0].Root()
+	if root.Digest != desc.Digest {
+		t.Errorf("production is %s instead of %s", root.Digest, desc.Digest)
+	}
+
+	if root.Annotations["org.example.tested"] != "true" {
+		t.Errorf("production lost its annotations: %v", root.Annotations)
+	}
+}
+
+func TestPromoteSource(t *testing.T) {
+	config := StackerConfig{OCIDir: "/oci"}
+	for tag, expected := range map[string]string{
+		"app":                                 "oci:/oci:app",
+		"docker://registry.example.com/app:1": "docker://registry.example.com/app:1",
+		"oci:/elsewhere:app":                  "oci:/elsewhere:app",
+	} {
+		if src := promoteSource(config, tag); src != expected {
+			t.Errorf("promoteSource(%s) is %s instead of %s", tag, src, expected)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package stacker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+)
+
+// Provenance is what went into a layer: the base it was built on and the
+// content of its imports. It's recorded in the image as the
+// ProvenanceAnnotation, and in the build report.
+type Provenance struct {
+	Base    BaseProvenance     `json:"base"`
+	Imports []ImportProvenance `json:"imports,omitempty"`
+}
+
+// BaseProvenance is the base image a layer was built on. Digest is the
+// digest of its manifest as stacker imported it, the sha256 of a tar base,
+// or empty if stacker doesn't know it (e.g. for scratch or build_only bases).
+type BaseProvenance struct {
+	Type   string `json:"type"`
+	URL    string `json:"url,omitempty"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// ImportProvenance is one of a layer's imports. Digest is the sha256 of a
+// file, or of the mtree manifest of a directory.
+type ImportProvenance struct {
+	URL    string `json:"url"`
+	Digest string `json:"digest"`
+}
+
+// layerProvenance returns the provenance of the layer name, once its
+// imports have been imported and its base set up.
+func layerProvenance(config StackerConfig, oci casext.Engine, name string, l *Layer) (*Provenance, error) {
+	base, err := baseProvenance(config, oci, l)
+	if err != nil {
+		return nil, err
+	}
+
+	prov := &Provenance{Base: base}
+
+	imports, err := l.ParseImport()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, imp := range imports {
+		p := path.Join(config.StackerDir, "imports", name, path.Base(imp))
+		d, err := importDigest(p)
+		if err != nil {
+			return nil, err
+		}
+
+		prov.Imports = append(prov.Imports, ImportProvenance{URL: redactURL(imp), Digest: d})
+	}
+
+	return prov, nil
+}
+
+func importDigest(p string) (string, error) {
+	st, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+
+	if !st.IsDir() {
+		return hashFile(p)
+	}
+
+	encoded, err := getEncodedMtree(p)
+	if err != nil {
+		return "", err
+	}
+
+	spec, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+
+	return digest.FromBytes(spec).String(), nil
+}
+
+func baseProvenance(config StackerConfig, oci casext.Engine, l *Layer) (BaseProvenance, error) {
+	base := BaseProvenance{Type: l.From.Type}
+
+	switch l.From.baseType() {
+	case BuiltType:
+		base.URL = l.From.Tag
+		descs, err := oci.ResolveReference(context.Background(), l.From.Tag)
+		if err == nil && len(descs) > 0 {
+			base.Digest = descs[0].Descriptor().Digest.String()
+		}
+	case DockerType, OCIType:
+		base.URL = redactURL(l.From.Url)
+		tag, err := l.From.ParseTag()
+		if err != nil {
+			return base, err
+		}
+
+		cacheOCI, err := umoci.OpenLayout(path.Join(config.StackerDir, "layer-bases", "oci"))
+		if err != nil {
+			return base, err
+		}
+		defer cacheOCI.Close()
+
+		descs, err := cacheOCI.ResolveReference(context.Background(), tag)
+		if err != nil {
+			return base, err
+		}
+		if len(descs) > 0 {
+			base.Digest = descs[0].Descriptor().Digest.String()
+		}
+	case TarType:
+		base.URL = redactURL(l.From.Url)
+		sum, err := l.From.tarChecksum()
+		if err != nil {
+			return base, err
+		}
+
+		if sum != "" {
+			base.Digest = "sha256:" + sum
+		} else if u, err := url.Parse(l.From.Url); err == nil && u.Scheme == "" {
+			base.Digest, err = hashFile(l.From.Url)
+			if err != nil {
+				return base, err
+			}
+		}
+	}
+
+	return base, nil
+}
+
+// provenanceAnnotation is the value of the ProvenanceAnnotation for prov.
+func provenanceAnnotation(prov *Provenance) (string, error) {
+	content, err := json.Marshal(prov)
+	if err != nil {
+		return "", err
+	}
+
+	return string(content), nil
+}
+
+// recordedProvenance returns the provenance recorded in the image tag as the
+// annotation key, if there is any.
+func recordedProvenance(oci casext.Engine, tag string, key string) *Provenance {
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return nil
+	}
+
+	v, ok := manifest.Annotations[key]
+	if !ok {
+		return nil
+	}
+
+	prov := &Provenance{}
+	if err := json.Unmarshal([]byte(v), prov); err != nil {
+		return nil
+	}
+
+	return prov
+}
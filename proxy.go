@@ -0,0 +1,186 @@
+package stacker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// proxyVars are the environment variables with the host's proxy settings.
+var proxyVars = []string{"http_proxy", "https_proxy", "no_proxy"}
+
+// caBundlePaths are where distros keep the bundle of CA certificates that
+// TLS clients trust.
+var caBundlePaths = []string{
+	"/etc/ssl/certs/ca-certificates.crt", // debian, ubuntu, alpine, arch
+	"/etc/pki/tls/certs/ca-bundle.crt",   // fedora, centos, rhel
+	"/etc/ssl/ca-bundle.pem",             // opensuse
+	"/etc/ssl/cert.pem",                  // alpine, void
+}
+
+// passProxy returns whether layers' commands get the host's proxy settings,
+// which they do unless the config turns it off.
+func (c StackerConfig) passProxy() bool {
+	return c.PassProxy == nil || *c.PassProxy
+}
+
+// hostEnv is the environment from the host that layers' commands run with.
+func hostEnv(sc StackerConfig) []string {
+	vars := []string{"TERM"}
+	if sc.passProxy() {
+		vars = append(vars, proxyVars...)
+	}
+
+	env := []string{}
+	for _, k := range vars {
+		// The proxy vars are special, because some things e.g. curl
+		// and python like lower case, while golang likes upper case.
+		for _, k := range []string{k, strings.ToUpper(k)} {
+			if v := os.Getenv(k); v != "" {
+				env = append(env, fmt.Sprintf("%s=%s", k, v))
+			}
+		}
+	}
+
+	return env
+}
+
+// readCACerts reads the PEM certificates in the files (or directories of
+// .pem and .crt files) paths.
+func readCACerts(paths []string) ([]byte, error) {
+	certs := []byte{}
+	for _, p := range paths {
+		files := []string{p}
+
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read CA certificates")
+		}
+
+		if fi.IsDir() {
+			files = []string{}
+			for _, ext := range []string{"*.pem", "*.crt"} {
+				matches, err := filepath.Glob(path.Join(p, ext))
+				if err != nil {
+					return nil, err
+				}
+				files = append(files, matches...)
+			}
+		}
+
+		for _, f := range files {
+			content, err := ioutil.ReadFile(f)
+			if err != nil {
+				return nil, errors.Wrapf(err, "couldn't read CA certificates")
+			}
+
+			if !strings.Contains(string(content), "-----BEGIN CERTIFICATE-----") {
+				return nil, errors.Errorf("%s doesn't have any PEM certificates", f)
+			}
+
+			certs = append(certs, content...)
+			if len(content) > 0 && content[len(content)-1] != '\n' {
+				certs = append(certs, '\n')
+			}
+		}
+	}
+
+	return certs, nil
+}
+
+// resolveInRootfs resolves the symlinks in the last component of p, without
+// leaving rootfs.
+func resolveInRootfs(rootfs string, p string) (string, error) {
+	for i := 0; i < 10; i++ {
+		target, err := os.Readlink(path.Join(rootfs, p))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return "", err
+			}
+			// not a symlink
+			return p, nil
+		}
+
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(p), target)
+		}
+		p = path.Clean(target)
+	}
+
+	return "", errors.Errorf("too many levels of symlinks in %s", p)
+}
+
+// caBundleMount is where the CA bundle with the configured CA certificates
+// is mounted in the container.
+const caBundleMount = "/.stacker-ca-bundle.pem"
+
+// caBundle returns the rootfs' CA bundle (the first of caBundlePaths it has,
+// if any) with certs added.
+func caBundle(rootfs string, certs []byte) []byte {
+	for _, bundle := range caBundlePaths {
+		resolved, err := resolveInRootfs(rootfs, bundle)
+		if err != nil {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(path.Join(rootfs, resolved))
+		if err != nil {
+			continue
+		}
+
+		if len(content) > 0 && content[len(content)-1] != '\n' {
+			content = append(content, '\n')
+		}
+		return append(content, certs...)
+	}
+
+	return certs
+}
+
+// injectCACerts bind mounts a copy of the rootfs' CA bundle with sc.CACerts
+// added at caBundleMount, and points SSL_CERT_FILE at it, so that commands
+// trust them without them ending up in the layer. The rootfs' own bundles
+// are left as they are, so that commands can still update them. The
+// returned function removes the mount point from the rootfs.
+func injectCACerts(c runner, sc StackerConfig) (func(), error) {
+	if len(sc.CACerts) == 0 {
+		return func() {}, nil
+	}
+
+	certs, err := readCACerts(sc.CACerts)
+	if err != nil {
+		return nil, err
+	}
+
+	rootfs := path.Join(sc.RootFSDir, sc.WorkingContainer(), "rootfs")
+	dir := path.Join(sc.StackerDir, "ca-certs")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	bundle := path.Join(dir, sc.WorkingContainer()+".pem")
+	if err := ioutil.WriteFile(bundle, caBundle(rootfs, certs), 0644); err != nil {
+		return nil, err
+	}
+
+	if err := c.bindMount(bundle, caBundleMount, "ro"); err != nil {
+		return nil, err
+	}
+
+	cleanup := func() {
+		os.Remove(path.Join(rootfs, caBundleMount))
+	}
+
+	// the layer's build_env is set later, so it can still override this
+	if err := c.setEnv([]string{"SSL_CERT_FILE=" + caBundleMount}); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	return cleanup, nil
+}
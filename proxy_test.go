@@ -0,0 +1,111 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestHostEnv(t *testing.T) {
+	os.Setenv("http_proxy", "http://proxy:3128")
+	defer os.Unsetenv("http_proxy")
+
+	found := false
+	for _, env := range hostEnv(StackerConfig{}) {
+		if env == "http_proxy=http://proxy:3128" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("proxy wasn't passed by default")
+	}
+
+	pass := false
+	for _, env := range hostEnv(StackerConfig{PassProxy: &pass}) {
+		if env == "http_proxy=http://proxy:3128" {
+			t.Errorf("proxy was passed with pass_proxy: false")
+		}
+	}
+}
+
+func TestApplyConfigEnvBool(t *testing.T) {
+	config := StackerConfig{}
+	lookup := func(name string) (string, bool) {
+		return "false", name == "STACKER_PASS_PROXY"
+	}
+
+	if err := applyConfigEnv(&config, lookup); err != nil {
+		t.Fatalf("couldn't apply env: %v", err)
+	}
+
+	if config.passProxy() {
+		t.Errorf("STACKER_PASS_PROXY=false didn't turn off the proxy")
+	}
+}
+
+func TestCACerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_ca_test")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert := "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----"
+	if err := ioutil.WriteFile(path.Join(dir, "corp.crt"), []byte(cert), 0644); err != nil {
+		t.Fatalf("couldn't write cert: %v", err)
+	}
+
+	certs, err := readCACerts([]string{dir})
+	if err != nil {
+		t.Fatalf("couldn't read certs: %v", err)
+	}
+
+	if string(certs) != cert+"\n" {
+		t.Errorf("bad certs: %s", certs)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "junk.pem"), []byte("junk"), 0644); err != nil {
+		t.Fatalf("couldn't write junk: %v", err)
+	}
+
+	if _, err := readCACerts([]string{path.Join(dir, "junk.pem")}); err == nil {
+		t.Errorf("read certs from a file without any")
+	}
+
+	// an absolute symlink in the rootfs stays in the rootfs
+	rootfs := path.Join(dir, "rootfs")
+	if err := os.MkdirAll(path.Join(rootfs, "etc/ssl/certs"), 0755); err != nil {
+		t.Fatalf("couldn't make rootfs: %v", err)
+	}
+
+	if err := os.Symlink("/etc/ssl/certs/ca-certificates.crt", path.Join(rootfs, "etc/ssl/cert.pem")); err != nil {
+		t.Fatalf("couldn't make symlink: %v", err)
+	}
+
+	if _, err := resolveInRootfs(rootfs, "/etc/ssl/cert.pem"); err == nil {
+		t.Errorf("resolved a dangling symlink")
+	}
+
+	if err := ioutil.WriteFile(path.Join(rootfs, "etc/ssl/certs/ca-certificates.crt"), []byte(cert), 0644); err != nil {
+		t.Fatalf("couldn't write bundle: %v", err)
+	}
+
+	resolved, err := resolveInRootfs(rootfs, "/etc/ssl/cert.pem")
+	if err != nil {
+		t.Fatalf("couldn't resolve symlink: %v", err)
+	}
+
+	if resolved != "/etc/ssl/certs/ca-certificates.crt" {
+		t.Errorf("bad resolved path: %s", resolved)
+	}
+
+	corp := "-----BEGIN CERTIFICATE-----\nMIIC\n-----END CERTIFICATE-----\n"
+	if bundle := caBundle(rootfs, []byte(corp)); string(bundle) != cert+"\n"+corp {
+		t.Errorf("bad bundle: %s", bundle)
+	}
+
+	if bundle := caBundle(path.Join(dir, "empty"), []byte(corp)); string(bundle) != corp {
+		t.Errorf("bad bundle without the rootfs': %s", bundle)
+	}
+}
@@ -0,0 +1,238 @@
+package stacker
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strings"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/pkg/errors"
+)
+
+const binfmtDir = "/proc/sys/fs/binfmt_misc"
+
+// qemuArches are qemu's names for the GOARCHes it can emulate.
+var qemuArches = map[string]string{
+	"amd64":    "x86_64",
+	"386":      "i386",
+	"arm64":    "aarch64",
+	"arm":      "arm",
+	"ppc64le":  "ppc64le",
+	"ppc64":    "ppc64",
+	"s390x":    "s390x",
+	"riscv64":  "riscv64",
+	"mips64le": "mips64el",
+	"mips64":   "mips64",
+	"mipsle":   "mipsel",
+	"mips":     "mips",
+}
+
+// binfmtMagic are the magic and mask binfmt_misc recognizes each qemu
+// arch's ELF binaries by, as in qemu's qemu-binfmt-conf.sh.
+var binfmtMagic = map[string][2]string{
+	"x86_64":  {`\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x3e\x00`, `\xff\xff\xff\xff\xff\xfe\xfe\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`},
+	"i386":    {`\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x03\x00`, `\xff\xff\xff\xff\xff\xfe\xfe\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`},
+	"aarch64": {`\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00`, `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`},
+	"arm":     {`\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x28\x00`, `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`},
+	"ppc64le": {`\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x15\x00`, `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\x00`},
+	"s390x":   {`\x7fELF\x02\x02\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x16`, `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff`},
+	"riscv64": {`\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xf3\x00`, `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`},
+}
+
+// elfArch returns the GOARCH of the ELF binary f, or "" if it's for something
+// go doesn't know about.
+func elfArch(f *elf.File) string {
+	little := f.ByteOrder.String() == "LittleEndian"
+	is64 := f.Class == elf.ELFCLASS64
+
+	switch f.Machine {
+	case elf.EM_X86_64:
+		return "amd64"
+	case elf.EM_386:
+		return "386"
+	case elf.EM_AARCH64:
+		return "arm64"
+	case elf.EM_ARM:
+		return "arm"
+	case elf.EM_PPC64:
+		if little {
+			return "ppc64le"
+		}
+		return "ppc64"
+	case elf.EM_S390:
+		return "s390x"
+	case elf.EM_RISCV:
+		return "riscv64"
+	case elf.EM_MIPS:
+		switch {
+		case is64 && little:
+			return "mips64le"
+		case is64:
+			return "mips64"
+		case little:
+			return "mipsle"
+		default:
+			return "mips"
+		}
+	default:
+		return ""
+	}
+}
+
+// rootfsArch returns the GOARCH of the binaries in rootfs, going by its
+// /bin/sh, or "" if it doesn't have one.
+func rootfsArch(rootfs string) (string, error) {
+	sh, err := securejoin.SecureJoin(rootfs, "/bin/sh")
+	if err != nil {
+		return "", err
+	}
+
+	f, err := elf.Open(sh)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrapf(err, "couldn't read /bin/sh")
+	}
+	defer f.Close()
+
+	return elfArch(f), nil
+}
+
+// canRunNatively returns true if the host can run arch's binaries without
+// emulation.
+func canRunNatively(arch string) bool {
+	return arch == runtime.GOARCH || (runtime.GOARCH == "amd64" && arch == "386")
+}
+
+// binfmtEntry is a binfmt_misc registration.
+type binfmtEntry struct {
+	enabled     bool
+	interpreter string
+	flags       string
+}
+
+// parseBinfmtEntry parses a file in /proc/sys/fs/binfmt_misc.
+func parseBinfmtEntry(content string) binfmtEntry {
+	entry := binfmtEntry{}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "enabled":
+			entry.enabled = true
+		case strings.HasPrefix(line, "interpreter "):
+			entry.interpreter = strings.TrimPrefix(line, "interpreter ")
+		case strings.HasPrefix(line, "flags:"):
+			entry.flags = strings.TrimSpace(strings.TrimPrefix(line, "flags:"))
+		}
+	}
+
+	return entry
+}
+
+// qemuBinary finds the host's static qemu for qarch.
+func qemuBinary(qarch string) (string, error) {
+	for _, name := range []string{"qemu-" + qarch + "-static", "qemu-" + qarch} {
+		if p, err := exec.LookPath(name); err == nil {
+			return p, nil
+		}
+	}
+
+	return "", fmt.Errorf("couldn't find qemu-%s-static; install qemu-user-static", qarch)
+}
+
+// registerBinfmt registers the host's qemu for qarch with binfmt_misc. It is
+// registered with the F flag, so the kernel opens the interpreter right
+// away, and containers don't need it in their rootfs.
+func registerBinfmt(sc StackerConfig, qarch string) (binfmtEntry, error) {
+	magic, ok := binfmtMagic[qarch]
+	if !ok || os.Geteuid() != 0 {
+		return binfmtEntry{}, fmt.Errorf("qemu-%s isn't registered with binfmt_misc; install qemu-user-static (and binfmt-support), or build as root so stacker can register it", qarch)
+	}
+
+	qemu, err := qemuBinary(qarch)
+	if err != nil {
+		return binfmtEntry{}, err
+	}
+
+	infof(sc, "registering %s for %s binaries\n", qemu, qarch)
+	registration := fmt.Sprintf(":qemu-%s:M::%s:%s:%s:F", qarch, magic[0], magic[1], qemu)
+	if err := ioutil.WriteFile(path.Join(binfmtDir, "register"), []byte(registration), 0200); err != nil {
+		return binfmtEntry{}, errors.Wrapf(err, "couldn't register qemu-%s with binfmt_misc", qarch)
+	}
+
+	return binfmtEntry{enabled: true, interpreter: qemu, flags: "F"}, nil
+}
+
+// removeMountpoint removes the mountpoint p that was made in rootfs, and its
+// parents up to created, the outermost directory that was made for it, as
+// long as they're still empty.
+func removeMountpoint(rootfs string, p string, created string) {
+	for ; p != "/"; p = path.Dir(p) {
+		if err := os.Remove(path.Join(rootfs, p)); err != nil || p == created {
+			return
+		}
+	}
+}
+
+// setupForeignArch makes sure commands can run in the working container
+// when its rootfs is for another architecture, by having binfmt_misc run
+// its binaries with qemu. If the interpreter qemu is registered with has
+// to be in the container, it's bind mounted in, and the returned func
+// removes the mountpoint made for it, so it doesn't end up in the layer.
+func setupForeignArch(c runner, sc StackerConfig) (func(), error) {
+	nothing := func() {}
+
+	rootfs := path.Join(sc.RootFSDir, sc.WorkingContainer(), "rootfs")
+	arch, err := rootfsArch(rootfs)
+	if err != nil || arch == "" || canRunNatively(arch) {
+		return nothing, err
+	}
+
+	qarch, ok := qemuArches[arch]
+	if !ok {
+		return nothing, fmt.Errorf("can't run %s binaries on %s", arch, runtime.GOARCH)
+	}
+
+	verbosef(sc, "rootfs is for %s, running its commands with qemu-%s\n", arch, qarch)
+
+	var entry binfmtEntry
+	content, err := ioutil.ReadFile(path.Join(binfmtDir, "qemu-"+qarch))
+	if err == nil {
+		entry = parseBinfmtEntry(string(content))
+	} else {
+		entry, err = registerBinfmt(sc, qarch)
+		if err != nil {
+			return nothing, err
+		}
+	}
+
+	if !entry.enabled {
+		return nothing, fmt.Errorf("qemu-%s's binfmt_misc registration is disabled", qarch)
+	}
+
+	if strings.Contains(entry.flags, "F") {
+		return nothing, nil
+	}
+
+	if _, err := os.Stat(entry.interpreter); err != nil {
+		return nothing, errors.Wrapf(err, "qemu-%s's interpreter isn't there", qarch)
+	}
+
+	if err := c.bindMount(entry.interpreter, entry.interpreter, "ro"); err != nil {
+		return nothing, err
+	}
+
+	created := firstMissing(rootfs, entry.interpreter)
+	if created == "" {
+		return nothing, nil
+	}
+
+	return func() { removeMountpoint(rootfs, entry.interpreter, created) }, nil
+}
@@ -0,0 +1,90 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+)
+
+func TestRootfsArch(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "stacker_qemu_test")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir: %v", err)
+	}
+	defer os.RemoveAll(rootfs)
+
+	arch, err := rootfsArch(rootfs)
+	if err != nil || arch != "" {
+		t.Fatalf("bad arch of a rootfs without a shell: %s %v", arch, err)
+	}
+
+	// the test binary is as good an ELF binary for the host as any
+	self, err := ioutil.ReadFile("/proc/self/exe")
+	if err != nil {
+		t.Fatalf("couldn't read test binary: %v", err)
+	}
+
+	if err := os.MkdirAll(path.Join(rootfs, "bin"), 0755); err != nil {
+		t.Fatalf("couldn't make bin: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(rootfs, "bin/busybox"), self, 0755); err != nil {
+		t.Fatalf("couldn't write busybox: %v", err)
+	}
+
+	// absolute links are in the rootfs, not on the host
+	if err := os.Symlink("/bin/busybox", path.Join(rootfs, "bin/sh")); err != nil {
+		t.Fatalf("couldn't link sh: %v", err)
+	}
+
+	arch, err = rootfsArch(rootfs)
+	if err != nil || arch != runtime.GOARCH {
+		t.Fatalf("bad arch: %s %v", arch, err)
+	}
+}
+
+func TestParseBinfmtEntry(t *testing.T) {
+	entry := parseBinfmtEntry(`enabled
+interpreter /usr/bin/qemu-aarch64-static
+flags: OCF
+offset 0
+magic 7f454c460201010000000000000000000200b700
+mask ffffffffffffff00fffffffffffffffffeffffff
+`)
+
+	if !entry.enabled || entry.interpreter != "/usr/bin/qemu-aarch64-static" || entry.flags != "OCF" {
+		t.Fatalf("bad entry: %v", entry)
+	}
+
+	entry = parseBinfmtEntry("disabled\ninterpreter /usr/bin/qemu-arm\nflags: \n")
+	if entry.enabled || entry.interpreter != "/usr/bin/qemu-arm" || entry.flags != "" {
+		t.Fatalf("bad entry: %v", entry)
+	}
+}
+
+func TestRemoveMountpoint(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "stacker_qemu_test")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir: %v", err)
+	}
+	defer os.RemoveAll(rootfs)
+
+	if err := os.MkdirAll(path.Join(rootfs, "usr/bin"), 0755); err != nil {
+		t.Fatalf("couldn't make dirs: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(rootfs, "usr/bin/qemu-arm"), nil, 0644); err != nil {
+		t.Fatalf("couldn't make mountpoint: %v", err)
+	}
+
+	removeMountpoint(rootfs, "/usr/bin/qemu-arm", "/usr/bin")
+	if _, err := os.Stat(path.Join(rootfs, "usr/bin")); !os.IsNotExist(err) {
+		t.Fatalf("created dir wasn't removed: %v", err)
+	}
+
+	if _, err := os.Stat(path.Join(rootfs, "usr")); err != nil {
+		t.Fatalf("dir that was there was removed: %v", err)
+	}
+}
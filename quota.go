@@ -0,0 +1,171 @@
+package stacker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// QuotaStorage is a Storage that can limit how much space a container's
+// changes take up, see StackerConfig.LayerQuota.
+type QuotaStorage interface {
+	Storage
+
+	// SetQuota limits how much the container name can write on top of
+	// what it was restored from (or created with) to bytes.
+	SetQuota(name string, bytes uint64) error
+
+	// QuotaExceeded is whether the container name has (nearly) used up
+	// its quota.
+	QuotaExceeded(name string) bool
+}
+
+// layerQuota returns the config's LayerQuota in bytes, or 0 if it isn't set.
+func (c StackerConfig) layerQuota() (uint64, error) {
+	if c.LayerQuota == "" {
+		return 0, nil
+	}
+
+	quota, err := humanize.ParseBytes(c.LayerQuota)
+	if err != nil {
+		return 0, fmt.Errorf("bad layer_quota %s: %v", c.LayerQuota, err)
+	}
+
+	return quota, nil
+}
+
+// limitWorkingContainer applies the config's LayerQuota to the working
+// container, whose base has just been set up, so that only what the layer's
+// build writes on top of it counts.
+func limitWorkingContainer(config StackerConfig, s Storage) error {
+	quota, err := config.layerQuota()
+	if err != nil || quota == 0 {
+		return err
+	}
+
+	qs, ok := s.(QuotaStorage)
+	if !ok {
+		return fmt.Errorf("layer_quota isn't supported by %s storage", s.Name())
+	}
+
+	return qs.SetQuota(config.WorkingContainer(), quota)
+}
+
+// quotaError returns err, or if building the layer name failed because the
+// working container used up its quota, an ErrQuotaExceeded saying so.
+func quotaError(config StackerConfig, s Storage, name string, err error) error {
+	qs, ok := s.(QuotaStorage)
+	if !ok || config.LayerQuota == "" || !qs.QuotaExceeded(config.WorkingContainer()) {
+		return err
+	}
+
+	return newError(ErrQuotaExceeded, err, "%s wrote more than its layer_quota of %s", name, config.LayerQuota)
+}
+
+// parseQgroupShow returns the exclusive usage and limit of the first qgroup in
+// the output of `btrfs qgroup show -e --raw`; the limit is 0 if there isn't
+// one.
+func parseQgroupShow(output string) (uint64, uint64, error) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) < 3 {
+		return 0, 0, fmt.Errorf("no qgroups in: %s", output)
+	}
+
+	header := strings.Fields(lines[0])
+	excl, maxExcl := -1, -1
+	for i, h := range header {
+		switch h {
+		case "excl":
+			excl = i
+		case "max_excl":
+			maxExcl = i
+		}
+	}
+
+	fields := strings.Fields(lines[2])
+	if excl < 0 || maxExcl < 0 || len(fields) != len(header) {
+		return 0, 0, fmt.Errorf("couldn't parse qgroups: %s", output)
+	}
+
+	used, err := strconv.ParseUint(fields[excl], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if fields[maxExcl] == "none" {
+		return used, 0, nil
+	}
+
+	limit, err := strconv.ParseUint(fields[maxExcl], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return used, limit, nil
+}
+
+func (b *btrfs) enableQuota() error {
+	if b.quotaEnabled {
+		return nil
+	}
+
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("layer_quota needs stacker to run as root, for btrfs quotas")
+	}
+
+	output, err := exec.Command(b.c.ToolPath(ToolBtrfs), "quota", "enable", b.c.RootFSDir).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("btrfs quota enable: %s: %s", err, output)
+	}
+
+	b.quotaEnabled = true
+	return nil
+}
+
+func (b *btrfs) SetQuota(name string, bytes uint64) error {
+	if err := b.enableQuota(); err != nil {
+		return err
+	}
+
+	subvol := path.Join(b.c.RootFSDir, name)
+
+	// the base was just unpacked (or snapshotted) into it, and that has
+	// to be committed for it to count as shared with the base's snapshot
+	// rather than as the container's own
+	output, err := exec.Command(b.c.ToolPath(ToolBtrfs), "filesystem", "sync", subvol).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("btrfs filesystem sync: %s: %s", err, output)
+	}
+
+	output, err = exec.Command(b.c.ToolPath(ToolBtrfs), "qgroup", "limit", "-e", fmt.Sprintf("%d", bytes), subvol).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("btrfs qgroup limit: %s: %s", err, output)
+	}
+
+	return nil
+}
+
+func (b *btrfs) QuotaExceeded(name string) bool {
+	if !b.quotaEnabled {
+		return false
+	}
+
+	subvol := path.Join(b.c.RootFSDir, name)
+	output, err := exec.Command(b.c.ToolPath(ToolBtrfs), "qgroup", "show", "-e", "--raw", "-f", subvol).CombinedOutput()
+	if err != nil {
+		return false
+	}
+
+	used, limit, err := parseQgroupShow(string(output))
+	if err != nil || limit == 0 {
+		return false
+	}
+
+	// writes start failing a bit before the limit
+	return used >= limit/100*95
+}
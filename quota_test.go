@@ -0,0 +1,76 @@
+package stacker
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseQgroupShow(t *testing.T) {
+	output := `qgroupid         rfer         excl     max_excl 
+--------         ----         ----     -------- 
+0/257        1073758208   1048576000   1073741824 
+`
+	used, limit, err := parseQgroupShow(output)
+	if err != nil || used != 1048576000 || limit != 1073741824 {
+		t.Fatalf("bad qgroup %d/%d: %v", used, limit, err)
+	}
+
+	output = `qgroupid         rfer         excl     max_excl 
+--------         ----         ----     -------- 
+0/257           16384        16384         none 
+`
+	used, limit, err = parseQgroupShow(output)
+	if err != nil || used != 16384 || limit != 0 {
+		t.Fatalf("bad unlimited qgroup %d/%d: %v", used, limit, err)
+	}
+
+	if _, _, err := parseQgroupShow("ERROR: can't list qgroups: quotas not enabled"); err == nil {
+		t.Fatalf("parsed an error")
+	}
+}
+
+func TestLayerQuota(t *testing.T) {
+	quota, err := StackerConfig{LayerQuota: "1GiB"}.layerQuota()
+	if err != nil || quota != 1024*1024*1024 {
+		t.Fatalf("bad quota %d: %v", quota, err)
+	}
+
+	quota, err = StackerConfig{}.layerQuota()
+	if err != nil || quota != 0 {
+		t.Fatalf("quota without one set %d: %v", quota, err)
+	}
+
+	if _, err := (StackerConfig{LayerQuota: "lots"}).layerQuota(); err == nil {
+		t.Fatalf("bad quota accepted")
+	}
+}
+
+type quotaTestStorage struct {
+	Storage
+	exceeded bool
+}
+
+func (s quotaTestStorage) SetQuota(name string, bytes uint64) error {
+	return nil
+}
+
+func (s quotaTestStorage) QuotaExceeded(name string) bool {
+	return s.exceeded
+}
+
+func TestQuotaError(t *testing.T) {
+	config := StackerConfig{LayerQuota: "1GB"}
+	runErr := fmt.Errorf("run failed")
+
+	err := quotaError(config, quotaTestStorage{exceeded: true}, "foo", runErr)
+	if errors.Cause(err) != ErrQuotaExceeded {
+		t.Fatalf("expected a quota error, got %v", err)
+	}
+
+	err = quotaError(config, quotaTestStorage{}, "foo", runErr)
+	if err != runErr {
+		t.Fatalf("quota not exceeded, but got %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package stacker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// unescapeMountpoint undoes the octal escaping of spaces, tabs, newlines and
+// backslashes in /proc/self/mountinfo.
+func unescapeMountpoint(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// staleMounts returns the mountpoints in mountinfo (the format of
+// /proc/self/mountinfo) under config.RootFSDir, but not the storage mounted at
+// it or the storage's own mounts in it (storageMounts), that aren't in a
+// working container another stacker is using. They are deepest first, the
+// order they can be unmounted in.
+func staleMounts(config StackerConfig, mountinfo io.Reader, storageMounts []string) ([]string, error) {
+	own := map[string]bool{}
+	for _, m := range storageMounts {
+		own[path.Clean(m)] = true
+	}
+
+	mounts := []string{}
+	scanner := bufio.NewScanner(mountinfo)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+
+		mountpoint := unescapeMountpoint(fields[4])
+		rel, err := filepath.Rel(config.RootFSDir, mountpoint)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") || own[mountpoint] {
+			continue
+		}
+
+		// our own working container's lock is held by us, which
+		// isLocked() can't tell from another stacker holding it
+		name := strings.SplitN(rel, "/", 2)[0]
+		if name != config.WorkingContainer() && isLocked(config, workingLockName(name)) {
+			continue
+		}
+
+		mounts = append(mounts, mountpoint)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(mounts, func(i, j int) bool {
+		return strings.Count(mounts[i], "/") > strings.Count(mounts[j], "/")
+	})
+
+	return mounts, nil
+}
+
+// staleWorkingContainers returns the working containers (other than
+// config's own) that a stacker has used, but none is using now.
+func staleWorkingContainers(config StackerConfig) ([]string, error) {
+	ents, err := ioutil.ReadDir(locksDir(config))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	stale := []string{}
+	for _, ent := range ents {
+		lock := strings.TrimSuffix(ent.Name(), ".lock")
+		if !strings.HasPrefix(lock, workingLockName("")) || lock == ent.Name() {
+			continue
+		}
+
+		name := strings.TrimPrefix(lock, workingLockName(""))
+		if name == config.WorkingContainer() || isLocked(config, lock) {
+			continue
+		}
+
+		stale = append(stale, name)
+	}
+
+	return stale, nil
+}
+
+// staleTempFiles returns the temporary files that builds in config's working
+// container and OCI layout make and remove when they're done, which are
+// only around if one crashed. The caller must hold the locks on both.
+func staleTempFiles(config StackerConfig) ([]string, error) {
+	patterns := []string{
+		path.Join(config.OCIDir, "stacker-squashfs-*"),
+		path.Join(config.RootFSDir, config.WorkingContainer(), squashfsStageDir),
+		path.Join(config.StackerDir, "secrets", config.WorkingContainer()),
+	}
+	if dir := config.scratchDir(); dir != "" {
+		patterns = append(patterns, path.Join(dir, "stacker-*"))
+	}
+
+	stale := []string{}
+	for _, p := range patterns {
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, err
+		}
+		stale = append(stale, matches...)
+	}
+
+	return stale, nil
+}
+
+// recoverStaleState cleans up what builds that crashed left behind, which
+// would otherwise make this one fail (or use their layers): mounts under
+// config.RootFSDir, working containers nothing is using, snapshots read only
+// builds replaced, and temporary files. The caller must hold the locks on
+// config's working container and OCI layout.
+func recoverStaleState(config StackerConfig, s Storage) error {
+	mountinfo, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	defer mountinfo.Close()
+
+	var storageMounts []string
+	if ms, ok := s.(MountingStorage); ok {
+		storageMounts, err = ms.Mountpoints()
+		if err != nil {
+			return err
+		}
+	}
+
+	mounts, err := staleMounts(config, mountinfo, storageMounts)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range mounts {
+		infof(config, "unmounting %s left by a previous build\n", m)
+		if err := unix.Unmount(m, unix.MNT_DETACH); err != nil {
+			return fmt.Errorf("couldn't unmount %s: %v", m, err)
+		}
+	}
+
+	containers, err := staleWorkingContainers(config)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range containers {
+		if !s.Exists(name) {
+			continue
+		}
+
+		infof(config, "removing working container %s left by a previous build\n", name)
+		if err := s.Delete(name); err != nil {
+			return err
+		}
+	}
+
+	// a read only build that crashed left its own builds of the layers
+	// whose snapshots it put aside in their place
+	cache, err := readBuildCache(config)
+	if err != nil {
+		return err
+	}
+
+	for _, ent := range cache.Cache {
+		if !s.Exists(readOnlyStash(ent.Name)) {
+			continue
+		}
+
+		infof(config, "restoring the snapshot of %s a read only build replaced\n", ent.Name)
+		if err := restoreSnapshot(s, ent.Name, true); err != nil {
+			return err
+		}
+	}
+
+	files, err := staleTempFiles(config)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		verbosef(config, "removing %s left by a previous build\n", f)
+		if err := os.RemoveAll(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
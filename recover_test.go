@@ -0,0 +1,87 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStaleMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-recover-test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := StackerConfig{StackerDir: dir, RootFSDir: "/roots"}
+
+	busy := config
+	busy.WorkingContainerName = "busy"
+	l, err := LockWorkingContainer(busy)
+	if err != nil {
+		t.Fatalf("couldn't lock working container: %v", err)
+	}
+	defer l.Unlock()
+
+	mountinfo := `22 1 0:20 / / rw - ext4 /dev/sda1 rw
+40 22 0:40 / /roots rw - btrfs /dev/loop0 rw
+41 40 0:41 / /roots/_working/rootfs/proc rw - proc proc rw
+42 41 0:42 / /roots/_working/rootfs/proc/sys rw - proc proc rw
+43 40 0:43 / /roots/busy/rootfs/proc rw - proc proc rw
+44 40 0:44 / /roots/old\040one/rootfs/dev rw - tmpfs tmpfs rw
+45 22 0:45 / /rootsfoo rw - tmpfs tmpfs rw
+46 40 0:46 / /roots/foo rw - zfs tank/stacker/foo rw
+47 46 0:47 / /roots/foo/rootfs/dev rw - tmpfs tmpfs rw
+`
+
+	// foo is mounted by the storage itself, but what's mounted in it isn't
+	mounts, err := staleMounts(config, strings.NewReader(mountinfo), []string{"/roots/foo", "/roots/bar"})
+	if err != nil {
+		t.Fatalf("couldn't find stale mounts: %v", err)
+	}
+
+	expected := []string{
+		"/roots/_working/rootfs/proc/sys",
+		"/roots/_working/rootfs/proc",
+		"/roots/old one/rootfs/dev",
+		"/roots/foo/rootfs/dev",
+	}
+	if !reflect.DeepEqual(mounts, expected) {
+		t.Errorf("bad stale mounts %v", mounts)
+	}
+}
+
+func TestStaleWorkingContainers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-recover-test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := StackerConfig{StackerDir: dir}
+	for _, name := range []string{"crashed", "busy", WorkingContainerName} {
+		other := config
+		other.WorkingContainerName = name
+		l, err := LockWorkingContainer(other)
+		if err != nil {
+			t.Fatalf("couldn't lock working container: %v", err)
+		}
+
+		if name == "busy" {
+			defer l.Unlock()
+		} else {
+			l.Unlock()
+		}
+	}
+
+	stale, err := staleWorkingContainers(config)
+	if err != nil {
+		t.Fatalf("couldn't find stale working containers: %v", err)
+	}
+
+	if !reflect.DeepEqual(stale, []string{"crashed"}) {
+		t.Errorf("bad stale working containers %v", stale)
+	}
+}
@@ -0,0 +1,109 @@
+package stacker
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/pkg/errors"
+)
+
+// RegistryTLS is how to connect to a docker registry whose certificate isn't
+// signed by a CA the host trusts, that wants a client certificate, or that
+// doesn't speak https at all.
+type RegistryTLS struct {
+	// CACert is a PEM bundle of CA certificates the registry's
+	// certificate is checked against, in addition to the host's.
+	CACert string `yaml:"ca_cert"`
+
+	// ClientCert and ClientKey are the PEM certificate and key stacker
+	// authenticates to the registry with.
+	ClientCert string `yaml:"client_cert"`
+	ClientKey  string `yaml:"client_key"`
+
+	// Insecure skips checking the registry's certificate, and allows
+	// plain http if it doesn't speak https.
+	Insecure bool `yaml:"insecure"`
+}
+
+// registryCertDir is the directory of the certificates of the registry host
+// in the layout containers/image wants.
+func registryCertDir(config StackerConfig, host string) string {
+	return path.Join(config.StackerDir, "certs.d", host)
+}
+
+// linkCert makes p a symlink to target, or removes it if target is "". It's
+// replaced atomically, since other stackers may be reading it.
+func linkCert(p string, target string) error {
+	if target == "" {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	target, err := filepath.Abs(target)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(target); err != nil {
+		return err
+	}
+
+	tmp := fmt.Sprintf("%s.%d", p, os.Getpid())
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// registryTLS returns how to connect to imageURL's registry.
+func (c StackerConfig) registryTLS(imageURL string) (lib.TLSOpts, error) {
+	host, ok := registryHost(imageURL)
+	if !ok {
+		return lib.TLSOpts{}, nil
+	}
+
+	t, ok := c.RegistryTLS[host]
+	if !ok {
+		return lib.TLSOpts{}, nil
+	}
+
+	opts := lib.TLSOpts{Insecure: t.Insecure}
+	if t.CACert == "" && t.ClientCert == "" && t.ClientKey == "" {
+		return opts, nil
+	}
+
+	if (t.ClientCert == "") != (t.ClientKey == "") {
+		return lib.TLSOpts{}, fmt.Errorf("registry_tls for %s needs both a client_cert and a client_key", host)
+	}
+
+	dir := registryCertDir(c, host)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return lib.TLSOpts{}, err
+	}
+
+	// containers/image pairs each foo.cert with foo.key
+	for name, target := range map[string]string{
+		"ca.crt":      t.CACert,
+		"client.cert": t.ClientCert,
+		"client.key":  t.ClientKey,
+	} {
+		if err := linkCert(path.Join(dir, name), target); err != nil {
+			return lib.TLSOpts{}, errors.Wrapf(err, "bad registry_tls for %s", host)
+		}
+	}
+
+	opts.CertDir = dir
+	return opts, nil
+}
@@ -0,0 +1,88 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRegistryTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-registrytls-test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, f := range []string{"ca.pem", "client.pem", "client-key.pem"} {
+		if err := ioutil.WriteFile(path.Join(dir, f), []byte(f), 0600); err != nil {
+			t.Fatalf("couldn't write %s: %v", f, err)
+		}
+	}
+
+	config := StackerConfig{
+		StackerDir: path.Join(dir, ".stacker"),
+		RegistryTLS: map[string]RegistryTLS{
+			"localhost:5000": {Insecure: true},
+			"registry.example.com": {
+				CACert:     path.Join(dir, "ca.pem"),
+				ClientCert: path.Join(dir, "client.pem"),
+				ClientKey:  path.Join(dir, "client-key.pem"),
+			},
+			"half.example.com": {ClientCert: path.Join(dir, "client.pem")},
+		},
+	}
+
+	tls, err := config.registryTLS("docker://localhost:5000/foo:latest")
+	if err != nil {
+		t.Fatalf("registryTLS failed: %v", err)
+	}
+	if !tls.Insecure || tls.CertDir != "" {
+		t.Errorf("bad tls for localhost:5000: %v", tls)
+	}
+
+	tls, err = config.registryTLS("docker://centos:latest")
+	if err != nil || tls.Insecure || tls.CertDir != "" {
+		t.Errorf("got tls for an unconfigured registry: %v %v", tls, err)
+	}
+
+	tls, err = config.registryTLS("docker://registry.example.com/foo:latest")
+	if err != nil {
+		t.Fatalf("registryTLS failed: %v", err)
+	}
+	if tls.Insecure || tls.CertDir != registryCertDir(config, "registry.example.com") {
+		t.Errorf("bad tls for registry.example.com: %v", tls)
+	}
+
+	for name, expected := range map[string]string{
+		"ca.crt":      "ca.pem",
+		"client.cert": "client.pem",
+		"client.key":  "client-key.pem",
+	} {
+		content, err := ioutil.ReadFile(path.Join(tls.CertDir, name))
+		if err != nil {
+			t.Errorf("couldn't read %s: %v", name, err)
+			continue
+		}
+		if string(content) != expected {
+			t.Errorf("%s is %s, expected %s", name, content, expected)
+		}
+	}
+
+	// dropping the client certificate from the config drops it from the
+	// cert dir
+	rt := config.RegistryTLS["registry.example.com"]
+	rt.ClientCert = ""
+	rt.ClientKey = ""
+	config.RegistryTLS["registry.example.com"] = rt
+	if _, err := config.registryTLS("docker://registry.example.com/foo:latest"); err != nil {
+		t.Fatalf("registryTLS failed: %v", err)
+	}
+	if _, err := os.Lstat(path.Join(tls.CertDir, "client.cert")); !os.IsNotExist(err) {
+		t.Errorf("client.cert is still there: %v", err)
+	}
+
+	if _, err := config.registryTLS("docker://half.example.com/foo:latest"); err == nil {
+		t.Errorf("a client cert without a key was accepted")
+	}
+}
@@ -0,0 +1,228 @@
+package stacker
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/openSUSE/umoci"
+	"github.com/pkg/errors"
+)
+
+// RemoteBuildOpts are where and how a build runs on another host, see
+// RemoteBuild.
+type RemoteBuildOpts struct {
+	// Host is the ssh destination to build on, e.g. "me@buildbox" or a
+	// host in ~/.ssh/config.
+	Host string
+
+	// Dir is the directory on Host the build runs in; relative to the
+	// remote user's home directory, and stacker-remote/<the name of the
+	// current directory> if it isn't set. Builds that run in the same one
+	// share its build cache.
+	Dir string
+
+	// Stacker is the command that runs stacker on Host, "stacker" by
+	// default; e.g. "sudo stacker" for builds that need root.
+	Stacker string
+
+	// Args are the arguments of the remote stacker build.
+	Args []string
+
+	// NoPull is true to leave the built images on Host, e.g. for builds
+	// that save them to a registry from there.
+	NoPull bool
+}
+
+// remoteContext returns the paths, relative to dir, that are shipped to the
+// remote host for the build: all of them have to be under dir, since the
+// build runs in the copy of it there.
+func remoteContext(dir string, paths []string) ([]string, error) {
+	seen := map[string]bool{}
+	for _, p := range paths {
+		// stackerfiles in git repos are cloned by the remote stacker
+		if strings.Contains(p, "://") {
+			continue
+		}
+
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+
+		rel, err := filepath.Rel(dir, abs)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return nil, fmt.Errorf("%s is outside %s, so it can't be shipped to the remote host", p, dir)
+		}
+
+		seen[rel] = true
+	}
+
+	rels := []string{}
+	for rel := range seen {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	return rels, nil
+}
+
+// remoteCommand runs the shell command command on opts.Host.
+func remoteCommand(config StackerConfig, opts RemoteBuildOpts, command string) *exec.Cmd {
+	return exec.Command(config.ToolPath(ToolSSH), opts.Host, command)
+}
+
+// pipe runs from with its output going to to, returning the first error of
+// either.
+func pipe(config StackerConfig, from *exec.Cmd, to *exec.Cmd) error {
+	r, err := from.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	to.Stdin = r
+	from.Stderr = config.stderr()
+	to.Stderr = config.stderr()
+
+	if err := from.Start(); err != nil {
+		return err
+	}
+
+	toErr := to.Run()
+	fromErr := from.Wait()
+	if fromErr != nil {
+		return errors.Wrapf(fromErr, "%s failed", strings.Join(from.Args, " "))
+	}
+	if toErr != nil {
+		return errors.Wrapf(toErr, "%s failed", strings.Join(to.Args, " "))
+	}
+
+	return nil
+}
+
+// pullRemoteImages copies the images in the OCI layout remoteOCI on
+// opts.Host into config's.
+func pullRemoteImages(config StackerConfig, opts RemoteBuildOpts, remoteOCI string) error {
+	tmp, err := ioutil.TempDir(config.StackerDir, "remote-oci-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	tarCmd := config.ToolPath(ToolTar)
+	err = pipe(config,
+		remoteCommand(config, opts, fmt.Sprintf("tar -C %s -cf - .", shellQuote(remoteOCI))),
+		exec.Command(tarCmd, "-C", tmp, "-xf", "-"))
+	if err != nil {
+		return errors.Wrapf(err, "couldn't pull the images built on %s", opts.Host)
+	}
+
+	layout, err := umoci.OpenLayout(tmp)
+	if err != nil {
+		return err
+	}
+	tags, err := layout.ListReferences(context.Background())
+	layout.Close()
+	if err != nil {
+		return err
+	}
+
+	// farm builds pull what each of their workers built as they finish,
+	// so they wait for each other here
+	lock, err := WaitForOCIDir(config)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	for _, tag := range tags {
+		verbosef(config, "pulling %s from %s\n", tag, opts.Host)
+		err = lib.ImageCopy(lib.ImageCopyOpts{
+			Src:  fmt.Sprintf("oci:%s:%s", tmp, tag),
+			Dest: fmt.Sprintf("oci:%s:%s", config.OCIDir, tag),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoteBuild builds the stackerfiles at paths on another host over ssh:
+// they, and the local files they import, are shipped to opts.Dir there,
+// the build runs there with its output streamed back, and then the images
+// it built are pulled into the local output. Paths (including the ones in
+// opts.Args) are relative to the current directory, which everything that
+// is shipped has to be under.
+func RemoteBuild(opts *BuildArgs, paths []string, remote RemoteBuildOpts) error {
+	if remote.Host == "" {
+		return fmt.Errorf("no remote host to build on")
+	}
+
+	config := opts.Config
+	for _, tool := range []string{ToolSSH, ToolTar} {
+		if err := checkTool(tool, config.ToolPath(tool)); err != nil {
+			return err
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	if remote.Dir == "" {
+		remote.Dir = path.Join("stacker-remote", path.Base(wd))
+	}
+	if remote.Stacker == "" {
+		remote.Stacker = "stacker"
+	}
+
+	watched, err := watchedPaths(paths, opts)
+	if err != nil {
+		return err
+	}
+
+	files, err := remoteContext(wd, watched)
+	if err != nil {
+		return err
+	}
+
+	infof(config, "shipping %d files to %s:%s\n", len(files), remote.Host, remote.Dir)
+	tarArgs := append([]string{"-C", wd, "-cf", "-", "--"}, files...)
+	dir := shellQuote(remote.Dir)
+	err = pipe(config,
+		exec.Command(config.ToolPath(ToolTar), tarArgs...),
+		remoteCommand(config, remote, fmt.Sprintf("mkdir -p %s && tar -C %s -xf -", dir, dir)))
+	if err != nil {
+		return errors.Wrapf(err, "couldn't ship the build to %s", remote.Host)
+	}
+
+	// the remote stacker's oci_dir is relative to the directory it runs
+	// in, so the images can be found to pull them
+	remoteOCI := path.Join(remote.Dir, "oci")
+	build := []string{"--oci-dir", "oci", "build"}
+	build = append(build, remote.Args...)
+	for i := range build {
+		build[i] = shellQuote(build[i])
+	}
+
+	cmd := remoteCommand(config, remote, fmt.Sprintf("cd %s && %s %s", dir, remote.Stacker, strings.Join(build, " ")))
+	cmd.Stdout = config.stdout()
+	cmd.Stderr = config.stderr()
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "build on %s failed", remote.Host)
+	}
+
+	if remote.NoPull {
+		return nil
+	}
+
+	return pullRemoteImages(config, remote, remoteOCI)
+}
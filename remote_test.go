@@ -0,0 +1,29 @@
+package stacker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRemoteContext(t *testing.T) {
+	files, err := remoteContext("/home/me/project", []string{
+		"/home/me/project/stacker.yaml",
+		"/home/me/project/files/config",
+		"/home/me/project/stacker.yaml",
+		"https://github.com/org/repo.git//stacker.yaml",
+	})
+	if err != nil {
+		t.Fatalf("remoteContext failed: %v", err)
+	}
+
+	expected := []string{"files/config", "stacker.yaml"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("shipped %v, expected %v", files, expected)
+	}
+
+	for _, p := range []string{"/home/me/other/foo", "/home/me/project/../secret"} {
+		if _, err := remoteContext("/home/me/project", []string{p}); err == nil {
+			t.Errorf("%s outside the project was shipped", p)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package stacker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+)
+
+// splitBySize groups the files with the given sizes, in order, into groups
+// whose total size is at most max. It fails if any one file is bigger than
+// max, listing all such files. If max is 0, all the files are in one group.
+func splitBySize(paths []string, sizes []int64, max int64) ([][]int, error) {
+	if max == 0 {
+		if len(paths) == 0 {
+			return [][]int{}, nil
+		}
+
+		group := []int{}
+		for i := range paths {
+			group = append(group, i)
+		}
+		return [][]int{group}, nil
+	}
+
+	tooBig := []string{}
+	for i, size := range sizes {
+		if size > max {
+			tooBig = append(tooBig, fmt.Sprintf("%s (%d bytes)", paths[i], size))
+		}
+	}
+
+	if len(tooBig) > 0 {
+		return nil, newError(ErrLayerTooBig, nil, "files bigger than the maximum layer size of %d bytes: %s", max, strings.Join(tooBig, ", "))
+	}
+
+	groups := [][]int{}
+	current := []int{}
+	var total int64
+	for i, size := range sizes {
+		if total+size > max && len(current) > 0 {
+			groups = append(groups, current)
+			current = []int{}
+			total = 0
+		}
+
+		current = append(current, i)
+		total += size
+	}
+
+	if len(current) > 0 {
+		groups = append(groups, current)
+	}
+
+	return groups, nil
+}
+
+// RepackOpts are the options for Repack.
+type RepackOpts struct {
+	// Tag is the tag to update with the new layer(s).
+	Tag string
+
+	// BundlePath is the umoci bundle with the rootfs to repack.
+	BundlePath string
+
+	// History is the history entry of each new layer.
+	History *ispec.History
+
+	// Squash replaces all of the image's layers with one of the whole
+	// rootfs, instead of adding a layer with the changes.
+	Squash bool
+
+	// MaxLayerSize, if it isn't 0, splits the changes into several layers
+	// of at most that many bytes (before compression).
+	MaxLayerSize int64
+
+	// Xattrs are the xattr namespaces (e.g. "security", "user.*") to keep
+	// in the new layers; if it's empty, all xattrs are kept.
+	Xattrs []string
+
+	// Progress, if set, is called before each new layer is generated.
+	Progress func(layer int, layers int)
+
+	// Timing, if set, is called with how long finding the changes to the
+	// rootfs (MtreePhase) took.
+	Timing func(phase string, d time.Duration)
+
+	// config is the config of the build, for its output.
+	config StackerConfig
+}
+
+// Repack adds the changes to the rootfs of opts.BundlePath as a new layer of
+// the image it was unpacked from, and points opts.Tag at the result.
+func Repack(oci casext.Engine, opts RepackOpts) error {
+	meta, err := umoci.ReadBundleMeta(opts.BundlePath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := parseXattrNamespaces(opts.Xattrs); err != nil {
+		return err
+	}
+
+	if opts.Squash {
+		if opts.MaxLayerSize != 0 {
+			return errors.Errorf("squashed layers can't be split to fit a maximum layer size")
+		}
+		return repackSquash(oci, opts, meta)
+	}
+
+	return repackChanges(oci, opts, meta)
+}
+
+// repackSquash is umoci.Repack, except that instead of adding a layer with
+// the changes to the bundle, it replaces all of the image's layers with a
+// single layer containing the whole rootfs (with only the xattrs in
+// opts.Xattrs).
+func repackSquash(oci casext.Engine, opts RepackOpts, meta umoci.Meta) error {
+	cleared, err := stackeroci.ClearLayers(oci, meta.From.Descriptor())
+	if err != nil {
+		return err
+	}
+
+	mutator, err := mutate.New(oci, casext.DescriptorPath{Walk: []ispec.Descriptor{cleared}})
+	if err != nil {
+		return err
+	}
+
+	if opts.Progress != nil {
+		opts.Progress(1, 1)
+	}
+
+	rootfs := path.Join(opts.BundlePath, layer.RootfsName)
+	xattrs, _ := parseXattrNamespaces(opts.Xattrs)
+	generated := layer.GenerateInsertLayer(rootfs, "/", false, &meta.MapOptions)
+	reader := sparseTar(filterTarXattrs(generated, xattrs), rootfs)
+	defer reader.Close()
+
+	if err := mutator.Add(context.Background(), reader, opts.History); err != nil {
+		return errors.Wrapf(err, "couldn't add squashed layer")
+	}
+
+	newPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if err := oci.UpdateReference(context.Background(), opts.Tag, newPath.Root()); err != nil {
+		return err
+	}
+
+	// refresh the bundle the same way umoci.Repack does, so that it
+	// looks like it was unpacked from the squashed image
+	oldMtree := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1) + ".mtree"
+	newMtree := strings.Replace(newPath.Descriptor().Digest.String(), ":", "_", 1)
+	if err := umoci.GenerateBundleManifest(newMtree, opts.BundlePath, fseval.DefaultFsEval); err != nil {
+		return err
+	}
+	os.Remove(path.Join(opts.BundlePath, oldMtree))
+
+	meta.From = newPath
+	return umoci.WriteBundleMeta(opts.BundlePath, meta)
+}
+
+// repackChanges is umoci.Repack, except that files with holes are written as
+// sparse files, only the xattrs in opts.Xattrs are kept, and that if the changes to the bundle add up to more than
+// opts.MaxLayerSize bytes (before compression), they are split into several
+// layers that each are at most that size. Each layer gets a copy of
+// opts.History.
+func repackChanges(oci casext.Engine, opts RepackOpts, meta umoci.Meta) error {
+	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
+	mtreePath := path.Join(opts.BundlePath, mtreeName+".mtree")
+	rootfs := path.Join(opts.BundlePath, layer.RootfsName)
+
+	mfh, err := os.Open(mtreePath)
+	if err != nil {
+		return err
+	}
+	defer mfh.Close()
+
+	spec, err := mtree.ParseSpec(mfh)
+	if err != nil {
+		return err
+	}
+
+	fsEval := fseval.DefaultFsEval
+	if meta.MapOptions.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+
+	mtreeStart := time.Now()
+	diffs, err := mtree.Check(rootfs, spec, umoci.MtreeKeywords, fsEval)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't check mtree")
+	}
+
+	if opts.Timing != nil {
+		opts.Timing(MtreePhase, time.Since(mtreeStart))
+	}
+
+	diffs = mtreefilter.FilterDeltas(diffs, mtreefilter.SimplifyFilter(diffs))
+
+	// parents before children, so that each layer's directories exist by
+	// the time they are needed
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Path() < diffs[j].Path() })
+
+	paths := []string{}
+	sizes := []int64{}
+	for _, diff := range diffs {
+		var size int64
+		if diff.Type() != mtree.Missing {
+			fi, err := os.Lstat(path.Join(rootfs, diff.Path()))
+			if err != nil {
+				return err
+			}
+			if fi.Mode().IsRegular() {
+				size = fi.Size()
+			}
+		}
+
+		paths = append(paths, diff.Path())
+		sizes = append(sizes, size)
+	}
+
+	xattrs, _ := parseXattrNamespaces(opts.Xattrs)
+	groups, err := splitBySize(paths, sizes, opts.MaxLayerSize)
+	if err != nil {
+		return err
+	}
+
+	mutator, err := mutate.New(oci, meta.From)
+	if err != nil {
+		return err
+	}
+
+	if len(groups) == 0 {
+		// nothing changed, so just record the history, like
+		// umoci.Repack does
+		config, err := mutator.Config(context.Background())
+		if err != nil {
+			return err
+		}
+
+		imageMeta, err := mutator.Meta(context.Background())
+		if err != nil {
+			return err
+		}
+
+		annotations, err := mutator.Annotations(context.Background())
+		if err != nil {
+			return err
+		}
+
+		if err := mutator.Set(context.Background(), config, imageMeta, annotations, opts.History); err != nil {
+			return err
+		}
+	}
+
+	if len(groups) > 1 {
+		infof(opts.config, "splitting %s into %d layers of at most %d bytes\n", opts.Tag, len(groups), opts.MaxLayerSize)
+	}
+
+	for i, group := range groups {
+		if opts.Progress != nil {
+			opts.Progress(i+1, len(groups))
+		}
+
+		deltas := []mtree.InodeDelta{}
+		for _, i := range group {
+			deltas = append(deltas, diffs[i])
+		}
+
+		generated, err := layer.GenerateLayer(rootfs, deltas, &meta.MapOptions)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't generate layer")
+		}
+		reader := sparseTar(filterTarXattrs(generated, xattrs), rootfs)
+
+		err = mutator.Add(context.Background(), reader, opts.History)
+		reader.Close()
+		if err != nil {
+			return errors.Wrapf(err, "couldn't add layer")
+		}
+	}
+
+	newPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if err := oci.UpdateReference(context.Background(), opts.Tag, newPath.Root()); err != nil {
+		return err
+	}
+
+	newMtreeName := strings.Replace(newPath.Descriptor().Digest.String(), ":", "_", 1)
+	if err := umoci.GenerateBundleManifest(newMtreeName, opts.BundlePath, fsEval); err != nil {
+		return err
+	}
+
+	if err := os.Remove(mtreePath); err != nil {
+		return err
+	}
+
+	meta.From = newPath
+	return umoci.WriteBundleMeta(opts.BundlePath, meta)
+}
@@ -0,0 +1,42 @@
+package stacker
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestSplitBySize(t *testing.T) {
+	paths := []string{"a", "b", "c", "d"}
+	sizes := []int64{40, 50, 20, 100}
+
+	groups, err := splitBySize(paths, sizes, 100)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	expected := [][]int{{0, 1}, {2}, {3}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("bad groups: %v", groups)
+	}
+
+	groups, err = splitBySize(paths, sizes, 0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if !reflect.DeepEqual(groups, [][]int{{0, 1, 2, 3}}) {
+		t.Fatalf("no maximum should be one group: %v", groups)
+	}
+
+	_, err = splitBySize(paths, sizes, 60)
+	if err == nil || !strings.Contains(err.Error(), "d (100 bytes)") {
+		t.Fatalf("file bigger than the maximum not reported: %v", err)
+	}
+
+	if errors.Cause(err) != ErrLayerTooBig {
+		t.Fatalf("wrong error kind: %v", err)
+	}
+}
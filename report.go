@@ -0,0 +1,162 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	TestsPassed = "passed"
+	TestsFailed = "failed"
+
+	// TestsCached means the layer was cached, so its tests weren't run
+	// again; they passed when it was built, since it wouldn't have been
+	// cached otherwise.
+	TestsCached = "cached"
+)
+
+// LayerReport records what happened to a single layer during a build.
+type LayerReport struct {
+	Name   string `json:"name"`
+	Cached bool   `json:"cached"`
+	Digest string `json:"digest,omitempty"`
+	Tests  string `json:"tests,omitempty"`
+
+	// Log is the log of the layer's run and test commands, if it was
+	// built.
+	Log string `json:"log,omitempty"`
+
+	// LargestFiles and LargestDirs are the biggest files the layer added
+	// or changed, and the directories they add up to the most in, if a
+	// layer size report was asked for.
+	LargestFiles []PathSize `json:"largest_files,omitempty"`
+	LargestDirs  []PathSize `json:"largest_dirs,omitempty"`
+
+	// Vulnerabilities are what scanning the layer found, most severe
+	// first, if it was built and scanned.
+	Vulnerabilities []Vulnerability `json:"vulnerabilities,omitempty"`
+
+	// Provenance is what the layer was built from.
+	Provenance *Provenance `json:"provenance,omitempty"`
+
+	// Phases are how many seconds each phase of building the layer
+	// (ImportPhase, BasePhase, ...) took.
+	Phases map[string]float64 `json:"phases,omitempty"`
+}
+
+// The phases of building a layer.
+const (
+	// ImportPhase copies or downloads the layer's imports.
+	ImportPhase = "import"
+
+	// BasePhase sets up the working container's rootfs from the layer's
+	// base image, pulling and unpacking it if needed.
+	BasePhase = "base"
+
+	// ApplyPhase applies the layer's apply images.
+	ApplyPhase = "apply"
+
+	// RunPhase runs the layer's run commands.
+	RunPhase = "run"
+
+	// TestPhase runs the layer's tests.
+	TestPhase = "test"
+
+	// MtreePhase finds what changed in the rootfs; it's part of
+	// GeneratePhase, and is only timed when stacker generates tar layers
+	// in-process (i.e. as root).
+	MtreePhase = "mtree"
+
+	// GeneratePhase generates the layer's OCI layer.
+	GeneratePhase = "generate"
+
+	// VerifyPhase checks the generated layer against the rootfs.
+	VerifyPhase = "verify"
+
+	// ScanPhase scans the built layer for vulnerabilities.
+	ScanPhase = "scan"
+
+	// PushPhase pushes the layer to its save urls.
+	PushPhase = "push"
+)
+
+// phaseOrder is the order phases happen in.
+var phaseOrder = []string{ImportPhase, BasePhase, ApplyPhase, RunPhase, TestPhase, MtreePhase, GeneratePhase, VerifyPhase, ScanPhase, PushPhase}
+
+// timed records that phase took from start until now.
+func (lr *LayerReport) timed(phase string, start time.Time) {
+	lr.timedDuration(phase, time.Since(start))
+}
+
+func (lr *LayerReport) timedDuration(phase string, d time.Duration) {
+	if lr.Phases == nil {
+		lr.Phases = map[string]float64{}
+	}
+	lr.Phases[phase] += d.Seconds()
+}
+
+// phaseSummary is how long each phase of the layer took, for people.
+func (lr *LayerReport) phaseSummary() string {
+	phases := []string{}
+	for _, phase := range phaseOrder {
+		if seconds, ok := lr.Phases[phase]; ok {
+			phases = append(phases, fmt.Sprintf("%s %.1fs", phase, seconds))
+		}
+	}
+
+	return strings.Join(phases, ", ")
+}
+
+// StackerfileReport records the layers built from a single stackerfile.
+type StackerfileReport struct {
+	Path     string         `json:"path"`
+	Layers   []*LayerReport `json:"layers"`
+	Success  bool           `json:"success"`
+	Error    string         `json:"error,omitempty"`
+	Duration float64        `json:"duration_seconds"`
+}
+
+// BuildReport is a machine readable summary of a (possibly multi-stackerfile)
+// build. It is written to StackerDir/build-report.json after every
+// stackerfile, whether or not the build succeeded.
+type BuildReport struct {
+	Stackerfiles []*StackerfileReport `json:"stackerfiles"`
+}
+
+func (br *BuildReport) newStackerfile(path string) *StackerfileReport {
+	sfr := &StackerfileReport{Path: path, Layers: []*LayerReport{}}
+	br.Stackerfiles = append(br.Stackerfiles, sfr)
+	return sfr
+}
+
+func (sfr *StackerfileReport) newLayer(name string) *LayerReport {
+	lr := &LayerReport{Name: name}
+	sfr.Layers = append(sfr.Layers, lr)
+	return lr
+}
+
+func (sfr *StackerfileReport) finish(start time.Time, err error) {
+	sfr.Duration = time.Since(start).Seconds()
+	sfr.Success = err == nil
+	if err != nil {
+		sfr.Error = err.Error()
+	}
+}
+
+func (br *BuildReport) persist(config StackerConfig) error {
+	if err := os.MkdirAll(config.StackerDir, 0755); err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(br, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(config.StackerDir, "build-report.json"), content, 0644)
+}
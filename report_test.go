@@ -0,0 +1,21 @@
+package stacker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLayerPhases(t *testing.T) {
+	lr := &LayerReport{Name: "foo"}
+	lr.timedDuration(RunPhase, 2*time.Second)
+	lr.timedDuration(ImportPhase, 500*time.Millisecond)
+	lr.timedDuration(RunPhase, time.Second)
+
+	if lr.Phases[RunPhase] != 3 || lr.Phases[ImportPhase] != 0.5 {
+		t.Errorf("bad phases: %v", lr.Phases)
+	}
+
+	if summary := lr.phaseSummary(); summary != "import 0.5s, run 3.0s" {
+		t.Errorf("bad summary: %s", summary)
+	}
+}
@@ -0,0 +1,264 @@
+package stacker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/anuvu/stacker/lib"
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// LayerReproduction is how a layer that was rebuilt compares with the
+// original build of it.
+type LayerReproduction struct {
+	Name string `json:"name"`
+
+	// Missing is set if the original build doesn't have this layer.
+	Missing bool `json:"missing,omitempty"`
+
+	// The diff ids (digests of the uncompressed layers) and config
+	// digests of the original image and the rebuilt one.
+	ExpectedLayers []digest.Digest `json:"expected_layers,omitempty"`
+	Layers         []digest.Digest `json:"layers"`
+	ExpectedConfig digest.Digest   `json:"expected_config,omitempty"`
+	Config         digest.Digest   `json:"config"`
+
+	// LayersMatch is whether the layers are the same, and ConfigMatches
+	// whether the configs are, apart from when they were made.
+	LayersMatch   bool `json:"layers_match"`
+	ConfigMatches bool `json:"config_matches"`
+}
+
+// Reproducible is whether the layer was rebuilt exactly.
+func (lr LayerReproduction) Reproducible() bool {
+	return lr.LayersMatch && lr.ConfigMatches
+}
+
+// ReproductionReport is what rebuilding a stackerfile to check that its
+// images are reproducible found.
+type ReproductionReport struct {
+	Layers []LayerReproduction `json:"layers"`
+}
+
+// Diverged returns the names of the layers that weren't reproduced exactly.
+func (r *ReproductionReport) Diverged() []string {
+	diverged := []string{}
+	for _, l := range r.Layers {
+		if !l.Reproducible() {
+			diverged = append(diverged, l.Name)
+		}
+	}
+	return diverged
+}
+
+// imageDigests are the parts of an image that are compared.
+type imageDigests struct {
+	layers []digest.Digest
+	config digest.Digest
+
+	// timeless is the digest of the config without the times in it.
+	timeless digest.Digest
+}
+
+func lookupImageDigests(oci casext.Engine, tag string) (imageDigests, error) {
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return imageDigests{}, err
+	}
+
+	config, err := stackeroci.LookupConfig(oci, manifest.Config)
+	if err != nil {
+		return imageDigests{}, err
+	}
+
+	config.Created = nil
+	for i := range config.History {
+		config.History[i].Created = nil
+	}
+
+	content, err := json.Marshal(config)
+	if err != nil {
+		return imageDigests{}, err
+	}
+
+	return imageDigests{
+		layers:   config.RootFS.DiffIDs,
+		config:   manifest.Config.Digest,
+		timeless: digest.FromBytes(content),
+	}, nil
+}
+
+func sameDigests(a []digest.Digest, b []digest.Digest) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// originalRef is the reference to the original build of the layer name in
+// against, which is the same kind of url as a save_url: the layer is
+// against/name:tag in a registry, or against:name_tag in an OCI layout.
+func originalRef(against string, name string, tag string) (string, error) {
+	is, err := NewImageSource(against)
+	if err != nil {
+		return "", err
+	}
+
+	switch is.Type {
+	case DockerType:
+		if tag == "" {
+			tag = "latest"
+		}
+		return fmt.Sprintf("%s/%s:%s", strings.TrimRight(against, "/"), name, tag), nil
+	case OCIType:
+		if tag == "" {
+			return fmt.Sprintf("%s:%s", against, name), nil
+		}
+		return fmt.Sprintf("%s:%s_%s", against, name, tag), nil
+	default:
+		return "", fmt.Errorf("can't compare with images in %s", against)
+	}
+}
+
+// Reproduce rebuilds the stackerfile file (and its prerequisites) from
+// scratch, without the cache, in a workspace of its own, and compares the
+// images with the original build of them. That's opts.Config.OCIDir if
+// against is "", or else the registry or OCI layout against that they were
+// saved to as tag. Nothing that's rebuilt is saved or pushed anywhere.
+func Reproduce(opts BuildArgs, file string, against string, tag string) (*ReproductionReport, error) {
+	return reproduce(context.Background(), opts, file, against, tag)
+}
+
+func reproduce(ctx context.Context, opts BuildArgs, file string, against string, tag string) (*ReproductionReport, error) {
+	if err := os.MkdirAll(opts.Config.StackerDir, 0755); err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir(opts.Config.StackerDir, "reproduce-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	scratch := opts
+	scratch.Config.StackerDir = path.Join(dir, "stacker")
+	scratch.Config.OCIDir = path.Join(dir, "oci")
+	scratch.Config.RootFSDir = path.Join(dir, "roots")
+	scratch.Config.SharedBlobDir = ""
+	scratch.Config.WorkingContainerName = ""
+	scratch.NoCache = true
+	scratch.LeaveUnladen = false
+	scratch.ArtifactsDir = path.Join(dir, "artifacts")
+	scratch.PushArtifacts = false
+	scratch.Hooks = Hooks{}
+	scratch.Webhooks = nil
+	scratch.MetricsTextfile = false
+	scratch.noSave = true
+	defer CleanRoots(scratch.Config)
+
+	infof(opts.Config, "rebuilding %s from scratch\n", file)
+	b := NewBuilder(&scratch)
+	b.ctx = ctx
+	if err := b.BuildMultiple([]string{file}); err != nil {
+		return nil, errors.Wrapf(err, "couldn't rebuild %s", file)
+	}
+
+	rebuilt, err := umoci.OpenLayout(scratch.Config.OCIDir)
+	if err != nil {
+		return nil, err
+	}
+	defer rebuilt.Close()
+
+	names, err := rebuilt.ListReferences(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	// the original images are fetched into a layout of their own, unless
+	// they're already in one here
+	originalDir := opts.Config.OCIDir
+	if against != "" {
+		originalDir = path.Join(dir, "original")
+		if err := os.MkdirAll(originalDir, 0755); err != nil {
+			return nil, err
+		}
+
+		layout, err := umoci.CreateLayout(originalDir)
+		if err != nil {
+			return nil, err
+		}
+		layout.Close()
+
+		for _, name := range names {
+			ref, err := originalRef(against, name, tag)
+			if err != nil {
+				return nil, err
+			}
+
+			tls, err := opts.Config.registryTLS(ref)
+			if err != nil {
+				return nil, err
+			}
+
+			infof(opts.Config, "fetching %s\n", ref)
+			err = imageCopy(opts.Config, lib.ImageCopyOpts{
+				Src:      ref,
+				Dest:     fmt.Sprintf("oci:%s:%s", originalDir, name),
+				Progress: progressOutput(opts.Config),
+				SrcTLS:   tls,
+			}, opts.registryAuth())
+			if err != nil {
+				warnf(opts.Config, "couldn't fetch %s: %v\n", ref, err)
+			}
+		}
+	}
+
+	original, err := umoci.OpenLayout(originalDir)
+	if err != nil {
+		return nil, err
+	}
+	defer original.Close()
+
+	report := &ReproductionReport{Layers: []LayerReproduction{}}
+	for _, name := range names {
+		now, err := lookupImageDigests(rebuilt, name)
+		if err != nil {
+			return nil, err
+		}
+
+		lr := LayerReproduction{Name: name, Layers: now.layers, Config: now.config}
+
+		then, err := lookupImageDigests(original, name)
+		if err != nil {
+			lr.Missing = true
+			report.Layers = append(report.Layers, lr)
+			continue
+		}
+
+		lr.ExpectedLayers = then.layers
+		lr.ExpectedConfig = then.config
+		lr.LayersMatch = sameDigests(now.layers, then.layers)
+		lr.ConfigMatches = now.timeless == then.timeless
+		report.Layers = append(report.Layers, lr)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,62 @@
+package stacker
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestOriginalRef(t *testing.T) {
+	cases := []struct {
+		against string
+		tag     string
+		ref     string
+	}{
+		{"docker://example.com/images/", "", "docker://example.com/images/foo:latest"},
+		{"docker://example.com/images", "v1", "docker://example.com/images/foo:v1"},
+		{"oci:/tmp/layout", "", "oci:/tmp/layout:foo"},
+		{"oci:/tmp/layout", "v1", "oci:/tmp/layout:foo_v1"},
+	}
+
+	for _, c := range cases {
+		ref, err := originalRef(c.against, "foo", c.tag)
+		if err != nil {
+			t.Errorf("couldn't find original of foo in %s: %v", c.against, err)
+			continue
+		}
+		if ref != c.ref {
+			t.Errorf("bad original of foo in %s: %s, expected %s", c.against, ref, c.ref)
+		}
+	}
+
+	if _, err := originalRef("http://example.com/foo.tar", "foo", ""); err == nil {
+		t.Errorf("compared with a tarball")
+	}
+}
+
+func TestReproductionReport(t *testing.T) {
+	a := digest.FromString("a")
+	b := digest.FromString("b")
+
+	if !sameDigests([]digest.Digest{a, b}, []digest.Digest{a, b}) {
+		t.Errorf("same digests differ")
+	}
+	if sameDigests([]digest.Digest{a, b}, []digest.Digest{b, a}) {
+		t.Errorf("reordered digests are the same")
+	}
+	if sameDigests([]digest.Digest{a}, []digest.Digest{a, b}) {
+		t.Errorf("extra digest is the same")
+	}
+
+	report := &ReproductionReport{Layers: []LayerReproduction{
+		{Name: "same", LayersMatch: true, ConfigMatches: true},
+		{Name: "layers", ConfigMatches: true},
+		{Name: "config", LayersMatch: true},
+		{Name: "new", Missing: true},
+	}}
+
+	diverged := report.Diverged()
+	if len(diverged) != 3 || diverged[0] != "layers" || diverged[1] != "config" || diverged[2] != "new" {
+		t.Errorf("bad diverged layers %v", diverged)
+	}
+}
@@ -0,0 +1,255 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/sys/unix"
+)
+
+// SnapshotRetention is how many of the snapshots in RootFSDir (of built
+// layers, and of unpacked bases) are kept; the ones that builds still need
+// are kept regardless.
+type SnapshotRetention struct {
+	// KeepLast is how many snapshots of the same thing (a layer, or the
+	// image a base was unpacked from) are kept, the most recent ones.
+	KeepLast int `yaml:"keep_last"`
+
+	// MaxSize is how much space (e.g. "100GB") all of the snapshots can
+	// take up, going by the size of their files; the oldest ones are
+	// deleted until they fit.
+	MaxSize string `yaml:"max_size"`
+
+	// MaxAge is how long (e.g. "720h") snapshots are kept after they're
+	// made.
+	MaxAge string `yaml:"max_age"`
+}
+
+// snapshotRecord is what stacker remembers about a snapshot it made.
+type snapshotRecord struct {
+	// Of is what the snapshot is of: the layer's name, or the image a
+	// base was unpacked from.
+	Of      string    `json:"of"`
+	Created time.Time `json:"created"`
+}
+
+func snapshotIndexPath(config StackerConfig) string {
+	return path.Join(config.StackerDir, "snapshots.json")
+}
+
+func readSnapshotIndex(config StackerConfig) (map[string]snapshotRecord, error) {
+	index := map[string]snapshotRecord{}
+
+	content, err := ioutil.ReadFile(snapshotIndexPath(config))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return index, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, &index); err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+func writeSnapshotIndex(config StackerConfig, index map[string]snapshotRecord) error {
+	content, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(snapshotIndexPath(config), content, 0644)
+}
+
+// recordSnapshot remembers that the snapshot name of of was just made, for
+// the retention policy.
+func recordSnapshot(config StackerConfig, name string, of string) error {
+	lock, err := lockFile(config, "snapshots", unix.LOCK_EX, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	index, err := readSnapshotIndex(config)
+	if err != nil {
+		return err
+	}
+
+	index[name] = snapshotRecord{Of: of, Created: time.Now()}
+	return writeSnapshotIndex(config, index)
+}
+
+// retainedSnapshot is a snapshot the retention policy applies to.
+type retainedSnapshot struct {
+	name string
+	snapshotRecord
+	protected bool
+}
+
+// snapshotsToDelete returns which of the snapshots the retention policy r
+// deletes at now, oldest first. sizes are the sizes of the snapshots, which
+// are only needed if r has a MaxSize.
+func snapshotsToDelete(r SnapshotRetention, snapshots []retainedSnapshot, sizes map[string]uint64, now time.Time) ([]string, error) {
+	var maxAge time.Duration
+	if r.MaxAge != "" {
+		var err error
+		maxAge, err = time.ParseDuration(r.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("bad snapshot_retention max_age %s: %v", r.MaxAge, err)
+		}
+	}
+
+	var maxSize uint64
+	if r.MaxSize != "" {
+		var err error
+		maxSize, err = humanize.ParseBytes(r.MaxSize)
+		if err != nil {
+			return nil, fmt.Errorf("bad snapshot_retention max_size %s: %v", r.MaxSize, err)
+		}
+	}
+
+	// newest first
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Created.After(snapshots[j].Created)
+	})
+
+	deleted := map[string]bool{}
+	perThing := map[string]int{}
+	var total uint64
+	for _, snapshot := range snapshots {
+		perThing[snapshot.Of]++
+		total += sizes[snapshot.name]
+
+		if snapshot.protected {
+			continue
+		}
+
+		if maxAge != 0 && now.Sub(snapshot.Created) > maxAge {
+			deleted[snapshot.name] = true
+		}
+
+		if r.KeepLast > 0 && perThing[snapshot.Of] > r.KeepLast {
+			deleted[snapshot.name] = true
+		}
+	}
+
+	toDelete := []string{}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		snapshot := snapshots[i]
+		if snapshot.protected {
+			continue
+		}
+
+		if deleted[snapshot.name] || (maxSize != 0 && total > maxSize) {
+			toDelete = append(toDelete, snapshot.name)
+			total -= sizes[snapshot.name]
+		}
+	}
+
+	return toDelete, nil
+}
+
+// enforceRetention deletes the snapshots in config.RootFSDir that its
+// SnapshotRetention doesn't keep, except for working containers and the
+// snapshots that the cache's entries need (built layers, which later layers
+// are built on). The caller must hold the lock on the OCI layout.
+func enforceRetention(config StackerConfig, s Storage, cache *BuildCache) error {
+	r := config.SnapshotRetention
+	if r == nil {
+		return nil
+	}
+
+	// other stackers' builds restore unpacked bases while they hold this
+	basesLock, err := lockOrWait(config, "layer-bases", "the base image import layout")
+	if err != nil {
+		return err
+	}
+	defer basesLock.Unlock()
+
+	lock, err := lockFile(config, "snapshots", unix.LOCK_EX, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	index, err := readSnapshotIndex(config)
+	if err != nil {
+		return err
+	}
+
+	protected := map[string]bool{config.WorkingContainer(): true}
+	for _, ent := range cache.Cache {
+		protected[entrySnapshot(ent)] = true
+	}
+
+	locks, err := ioutil.ReadDir(locksDir(config))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, lock := range locks {
+		name := strings.TrimSuffix(lock.Name(), ".lock")
+		if strings.HasPrefix(name, workingLockName("")) {
+			protected[strings.TrimPrefix(name, workingLockName(""))] = true
+		}
+	}
+
+	entries, err := ioutil.ReadDir(config.RootFSDir)
+	if err != nil {
+		return err
+	}
+
+	snapshots := []retainedSnapshot{}
+	sizes := map[string]uint64{}
+	for _, ent := range entries {
+		// temporary directories, e.g. for verifying layers
+		if !ent.IsDir() || strings.HasPrefix(ent.Name(), ".") {
+			continue
+		}
+
+		record, ok := index[ent.Name()]
+		if !ok {
+			record = snapshotRecord{Of: ent.Name(), Created: ent.ModTime()}
+		}
+
+		snapshots = append(snapshots, retainedSnapshot{name: ent.Name(), snapshotRecord: record, protected: protected[ent.Name()]})
+
+		if r.MaxSize != "" {
+			sizes[ent.Name()], err = dirSize(path.Join(config.RootFSDir, ent.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	toDelete, err := snapshotsToDelete(*r, snapshots, sizes, time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, name := range toDelete {
+		verbosef(config, "deleting snapshot %s, by the retention policy\n", name)
+		if err := s.Delete(name); err != nil {
+			return err
+		}
+		delete(index, name)
+	}
+
+	// forget about the snapshots that were deleted some other way, too
+	for name := range index {
+		if !s.Exists(name) {
+			delete(index, name)
+		}
+	}
+
+	return writeSnapshotIndex(config, index)
+}
@@ -0,0 +1,48 @@
+package stacker
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshotsToDelete(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+
+	snapshots := func() []retainedSnapshot {
+		return []retainedSnapshot{
+			{name: "base-1", snapshotRecord: snapshotRecord{Of: "ubuntu:latest", Created: now.Add(-3 * day)}},
+			{name: "base-2", snapshotRecord: snapshotRecord{Of: "ubuntu:latest", Created: now.Add(-2 * day)}},
+			{name: "base-3", snapshotRecord: snapshotRecord{Of: "ubuntu:latest", Created: now.Add(-1 * day)}},
+			{name: "foo", snapshotRecord: snapshotRecord{Of: "foo", Created: now.Add(-10 * day)}, protected: true},
+			{name: "bar", snapshotRecord: snapshotRecord{Of: "bar", Created: now.Add(-5 * day)}},
+		}
+	}
+
+	cases := []struct {
+		r        SnapshotRetention
+		expected []string
+	}{
+		{SnapshotRetention{KeepLast: 2}, []string{"base-1"}},
+		{SnapshotRetention{MaxAge: "60h"}, []string{"bar", "base-1"}},
+		{SnapshotRetention{MaxSize: "240B"}, []string{"bar", "base-1"}},
+		{SnapshotRetention{}, []string{}},
+	}
+
+	sizes := map[string]uint64{"base-1": 50, "base-2": 50, "base-3": 50, "foo": 100, "bar": 50}
+	for _, c := range cases {
+		toDelete, err := snapshotsToDelete(c.r, snapshots(), sizes, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(toDelete, c.expected) {
+			t.Errorf("%+v deleted %v, not %v", c.r, toDelete, c.expected)
+		}
+	}
+
+	if _, err := snapshotsToDelete(SnapshotRetention{MaxAge: "a month"}, snapshots(), sizes, now); err == nil {
+		t.Errorf("bad max_age accepted")
+	}
+}
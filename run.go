@@ -8,7 +8,13 @@ import (
 )
 
 func Run(sc StackerConfig, name string, command string, l *Layer, onFailure string, stdin io.Reader) error {
-	c, err := newContainer(sc, WorkingContainerName)
+	return runWithOutput(sc, name, command, l, onFailure, stdin, sc.stdout())
+}
+
+// runWithOutput is Run, with command's output going to stdout; onFailure's
+// is always on the console, since it's usually interactive.
+func runWithOutput(sc StackerConfig, name string, command string, l *Layer, onFailure string, stdin io.Reader, stdout io.Writer) error {
+	c, err := newRunner(sc, sc.WorkingContainer())
 	if err != nil {
 		return err
 	}
@@ -20,14 +26,40 @@ func Run(sc StackerConfig, name string, command string, l *Layer, onFailure stri
 		if err != nil {
 			return err
 		}
-		defer os.Remove(path.Join(sc.RootFSDir, WorkingContainerName, "rootfs", "stacker"))
+		defer os.Remove(path.Join(sc.RootFSDir, sc.WorkingContainer(), "rootfs", "stacker"))
+	}
+
+	profile, err := newSecurityProfile(sc, l)
+	if err != nil {
+		return err
 	}
 
-	err = c.bindMount("/etc/resolv.conf", "/etc/resolv.conf", "")
+	if err := c.setSecurity(profile); err != nil {
+		return err
+	}
+
+	resolv, err := resolvConf(sc)
 	if err != nil {
 		return err
 	}
 
+	err = c.bindMount(resolv, "/etc/resolv.conf", "")
+	if err != nil {
+		return err
+	}
+
+	cleanupCACerts, err := injectCACerts(c, sc)
+	if err != nil {
+		return err
+	}
+	defer cleanupCACerts()
+
+	cleanupQemu, err := setupForeignArch(c, sc)
+	if err != nil {
+		return err
+	}
+	defer cleanupQemu()
+
 	binds, err := l.ParseBinds()
 	if err != nil {
 		return err
@@ -40,13 +72,52 @@ func Run(sc StackerConfig, name string, command string, l *Layer, onFailure stri
 		}
 	}
 
+	devices, err := l.ParseDevices()
+	if err != nil {
+		return err
+	}
+
+	for _, d := range devices {
+		if err := c.addDevice(d); err != nil {
+			return err
+		}
+	}
+
+	tmpfs, err := l.ParseTmpfs()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range tmpfs {
+		// the mount point (and its parents) have to be made if they
+		// aren't there, but shouldn't be left in the layer
+		rootfs := path.Join(sc.RootFSDir, sc.WorkingContainer(), "rootfs")
+		if created := firstMissing(rootfs, m.dest); created != "" {
+			defer removeCreated(rootfs, created, m.dest)
+		}
+
+		if err := c.addTmpfs(m); err != nil {
+			return err
+		}
+	}
+
+	cleanupSecrets, err := mountSecrets(c, sc, l)
+	if err != nil {
+		return err
+	}
+	defer cleanupSecrets()
+
+	if err := c.setEnv(l.buildEnv()); err != nil {
+		return err
+	}
+
 	// These should all be non-interactive; let's ensure that.
-	err = c.execute(command, stdin)
+	err = c.execute(command, stdin, stdout)
 	if err != nil {
 		if onFailure != "" {
-			err2 := c.execute(onFailure, os.Stdin)
+			err2 := c.execute(onFailure, os.Stdin, os.Stdout)
 			if err2 != nil {
-				fmt.Printf("failed executing %s: %s\n", onFailure, err2)
+				warnf(sc, "failed executing %s: %s\n", onFailure, err2)
 			}
 		}
 		err = fmt.Errorf("run commands failed: %s", err)
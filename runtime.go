@@ -0,0 +1,197 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// LXCRuntime is the runtime stacker runs layers' commands with by default.
+const LXCRuntime = "lxc"
+
+// runner runs commands in the working container; see newRunner.
+type runner interface {
+	bindMount(source string, dest string, extraOpts string) error
+	execute(args string, stdin io.Reader, stdout io.Writer) error
+	setSecurity(p securityProfile) error
+	addDevice(d hostDevice) error
+	addTmpfs(m tmpfsMount) error
+	setEnv(env []string) error
+	kill() error
+	Close()
+}
+
+// newRunner returns something that runs commands in the container name with
+// sc's Runtime: liblxc, or the OCI runtime (runc, crun, kata-runtime, ...)
+// binary it names.
+func newRunner(sc StackerConfig, name string) (runner, error) {
+	if sc.Runtime == "" || sc.Runtime == LXCRuntime {
+		return newContainer(sc, name)
+	}
+
+	return newOCIContainer(sc, name)
+}
+
+// ociContainer runs commands in a container with an OCI runtime's command
+// line interface, which runc, crun, runsc and kata-runtime all share.
+type ociContainer struct {
+	sc      StackerConfig
+	name    string
+	runtime string
+	spec    *rspec.Spec
+}
+
+func newOCIContainer(sc StackerConfig, name string) (*ociContainer, error) {
+	runtime, err := exec.LookPath(sc.Runtime)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't find runtime %s", sc.Runtime)
+	}
+
+	return &ociContainer{
+		sc:      sc,
+		name:    name,
+		runtime: runtime,
+		spec:    ociSpec(sc, name),
+	}, nil
+}
+
+// ociSpec is the runtime spec equivalent of the config newContainer gives
+// lxc containers.
+func ociSpec(sc StackerConfig, name string) *rspec.Spec {
+	env := append([]string{fmt.Sprintf("PATH=%s", ReasonableDefaultPath)}, hostEnv(sc)...)
+
+	spec := &rspec.Spec{
+		Version: rspec.Version,
+		Process: &rspec.Process{
+			Cwd: "/",
+			Env: env,
+		},
+		Root: &rspec.Root{
+			Path: path.Join(sc.RootFSDir, name, "rootfs"),
+		},
+		Hostname: name,
+		Mounts: []rspec.Mount{
+			{Destination: "/proc", Type: "proc", Source: "proc", Options: []string{"nosuid", "noexec", "nodev"}},
+			{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+			{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"}},
+			{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777"}},
+			{Destination: "/sys", Type: "none", Source: "/sys", Options: []string{"rbind", "nosuid", "noexec", "nodev"}},
+		},
+		Linux: &rspec.Linux{
+			// like the lxc containers, these share the host's
+			// network
+			Namespaces: []rspec.LinuxNamespace{
+				{Type: rspec.PIDNamespace},
+				{Type: rspec.IPCNamespace},
+				{Type: rspec.UTSNamespace},
+				{Type: rspec.MountNamespace},
+			},
+		},
+	}
+
+	if IdmapSet != nil {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, rspec.LinuxNamespace{Type: rspec.UserNamespace})
+		for _, idm := range IdmapSet.Idmap {
+			m := rspec.LinuxIDMapping{
+				ContainerID: uint32(idm.Nsid),
+				HostID:      uint32(idm.Hostid),
+				Size:        uint32(idm.Maprange),
+			}
+
+			if idm.Isuid {
+				spec.Linux.UIDMappings = append(spec.Linux.UIDMappings, m)
+			}
+			if idm.Isgid {
+				spec.Linux.GIDMappings = append(spec.Linux.GIDMappings, m)
+			}
+		}
+	}
+
+	return spec
+}
+
+func (c *ociContainer) bindMount(source string, dest string, extraOpts string) error {
+	options := []string{"rbind"}
+	if extraOpts != "" {
+		options = append(options, strings.Split(extraOpts, ",")...)
+	}
+
+	c.spec.Mounts = append(c.spec.Mounts, rspec.Mount{
+		Destination: dest,
+		Type:        "none",
+		Source:      source,
+		Options:     options,
+	})
+	return nil
+}
+
+// bundleDir is where the container's config.json is written; its rootfs
+// stays in RootFSDir.
+func (c *ociContainer) bundleDir() string {
+	return path.Join(c.sc.StackerDir, "runtime", c.name)
+}
+
+// id is the container's id in the runtime, which has to be unique on the
+// host.
+func (c *ociContainer) id() string {
+	return fmt.Sprintf("stacker-%s-%x", c.name, os.Getpid())
+}
+
+func (c *ociContainer) execute(args string, stdin io.Reader, stdout io.Writer) error {
+	c.spec.Process.Args = []string{"/bin/sh", "-c", args}
+
+	content, err := json.MarshalIndent(c.spec, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(c.bundleDir(), 0755); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path.Join(c.bundleDir(), "config.json"), content, 0644); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(c.runtime, "run", "--bundle", c.bundleDir(), c.id())
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = c.sc.stderr()
+	if stdin == nil {
+		// like lxc, non-interactive commands' output all goes to
+		// stdout
+		cmd.Stderr = stdout
+	}
+
+	// the runtime forwards the signals it gets to the container
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "execute failed with %s", c.sc.Runtime)
+	}
+
+	return nil
+}
+
+// kill kills what's running in the container, which may be being run by
+// another ociContainer for the same container in this process.
+func (c *ociContainer) kill() error {
+	output, err := exec.Command(c.runtime, "kill", c.id(), "KILL").CombinedOutput()
+	if err != nil {
+		return errors.Errorf("couldn't kill %s: %v: %s", c.id(), err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+func (c *ociContainer) Close() {
+	// in case the runtime didn't get to clean up after itself
+	exec.Command(c.runtime, "delete", "--force", c.id()).Run()
+	os.RemoveAll(c.bundleDir())
+}
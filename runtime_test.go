@@ -0,0 +1,37 @@
+package stacker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOCISpec(t *testing.T) {
+	sc := StackerConfig{RootFSDir: "/roots", Runtime: "runc"}
+	c := &ociContainer{sc: sc, name: "_working", spec: ociSpec(sc, "_working")}
+
+	if c.spec.Root.Path != "/roots/_working/rootfs" {
+		t.Errorf("bad rootfs %s", c.spec.Root.Path)
+	}
+
+	if err := c.bindMount("/imports", "/stacker", "ro"); err != nil {
+		t.Fatalf("couldn't bind mount: %v", err)
+	}
+
+	m := c.spec.Mounts[len(c.spec.Mounts)-1]
+	if m.Source != "/imports" || m.Destination != "/stacker" || !reflect.DeepEqual(m.Options, []string{"rbind", "ro"}) {
+		t.Errorf("bad bind mount: %v", m)
+	}
+
+	for _, ns := range c.spec.Linux.Namespaces {
+		if ns.Type == "network" {
+			t.Errorf("run steps shouldn't get their own network")
+		}
+	}
+}
+
+func TestNewRunnerMissingRuntime(t *testing.T) {
+	sc := StackerConfig{Runtime: "stacker-no-such-runtime"}
+	if _, err := newRunner(sc, "_working"); err == nil {
+		t.Fatalf("got a runner for a runtime that doesn't exist")
+	}
+}
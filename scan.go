@@ -0,0 +1,256 @@
+package stacker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Vulnerability is a vulnerability a scanner found in a layer.
+type Vulnerability struct {
+	ID           string `json:"id"`
+	Package      string `json:"package"`
+	Version      string `json:"version"`
+	FixedVersion string `json:"fixed_version,omitempty"`
+
+	// Severity is UNKNOWN, NEGLIGIBLE, LOW, MEDIUM, HIGH or CRITICAL.
+	Severity string `json:"severity"`
+}
+
+// Scanner finds vulnerabilities in the rootfs of a built layer.
+type Scanner interface {
+	Scan(config StackerConfig, name string, rootfs string) ([]Vulnerability, error)
+}
+
+var scanners map[string]Scanner
+
+// RegisterScanner makes s available as the scanner called name. It is meant
+// to be called from an init() function, and is not safe to call concurrently
+// with a build.
+func RegisterScanner(name string, s Scanner) {
+	scanners[name] = s
+}
+
+func lookupScanner(name string) (Scanner, bool) {
+	s, ok := scanners[name]
+	return s, ok
+}
+
+func init() {
+	scanners = map[string]Scanner{}
+	RegisterScanner("trivy", trivyScanner{})
+	RegisterScanner("grype", grypeScanner{})
+}
+
+// severities are the severities vulnerabilities can have, least severe first.
+var severities = []string{"UNKNOWN", "NEGLIGIBLE", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+func severityRank(severity string) int {
+	for i, s := range severities {
+		if strings.EqualFold(s, severity) {
+			return i
+		}
+	}
+	return 0
+}
+
+func checkSeverity(severity string) error {
+	for _, s := range severities {
+		if strings.EqualFold(s, severity) {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown severity %s, must be one of %s", severity, strings.Join(severities, ", "))
+}
+
+// checkScanner makes sure the build's scanner and the severity it fails on
+// exist before anything is built.
+func (opts *BuildArgs) checkScanner() error {
+	if opts.Scanner == "" {
+		if opts.ScanFailOn != "" {
+			return fmt.Errorf("a severity to fail on was given, but no scanner")
+		}
+		return nil
+	}
+
+	if _, ok := lookupScanner(opts.Scanner); !ok {
+		return fmt.Errorf("unknown scanner %s", opts.Scanner)
+	}
+
+	if opts.ScanFailOn != "" {
+		return checkSeverity(opts.ScanFailOn)
+	}
+
+	return nil
+}
+
+// runScanner runs a scanner's command and returns what it printed.
+func runScanner(name string, args ...string) ([]byte, error) {
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s failed: %s", name, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+type trivyScanner struct{}
+
+type trivyReport struct {
+	Results []struct {
+		Vulnerabilities []struct {
+			VulnerabilityID  string
+			PkgName          string
+			InstalledVersion string
+			FixedVersion     string
+			Severity         string
+		}
+	}
+}
+
+func (trivyScanner) Scan(config StackerConfig, name string, rootfs string) ([]Vulnerability, error) {
+	output, err := runScanner(config.ToolPath(ToolTrivy), "rootfs", "--quiet", "--format", "json", rootfs)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseTrivy(output)
+}
+
+func parseTrivy(output []byte) ([]Vulnerability, error) {
+	report := trivyReport{}
+	if err := json.Unmarshal(output, &report); err != nil {
+		return nil, errors.Wrapf(err, "bad output from trivy")
+	}
+
+	vulns := []Vulnerability{}
+	for _, result := range report.Results {
+		for _, v := range result.Vulnerabilities {
+			vulns = append(vulns, Vulnerability{
+				ID:           v.VulnerabilityID,
+				Package:      v.PkgName,
+				Version:      v.InstalledVersion,
+				FixedVersion: v.FixedVersion,
+				Severity:     strings.ToUpper(v.Severity),
+			})
+		}
+	}
+
+	return vulns, nil
+}
+
+type grypeScanner struct{}
+
+type grypeReport struct {
+	Matches []struct {
+		Vulnerability struct {
+			ID       string `json:"id"`
+			Severity string `json:"severity"`
+			Fix      struct {
+				Versions []string `json:"versions"`
+			} `json:"fix"`
+		} `json:"vulnerability"`
+		Artifact struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"artifact"`
+	} `json:"matches"`
+}
+
+func (grypeScanner) Scan(config StackerConfig, name string, rootfs string) ([]Vulnerability, error) {
+	output, err := runScanner(config.ToolPath(ToolGrype), "--quiet", "--output", "json", "dir:"+rootfs)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseGrype(output)
+}
+
+func parseGrype(output []byte) ([]Vulnerability, error) {
+	report := grypeReport{}
+	if err := json.Unmarshal(output, &report); err != nil {
+		return nil, errors.Wrapf(err, "bad output from grype")
+	}
+
+	vulns := []Vulnerability{}
+	for _, m := range report.Matches {
+		vulns = append(vulns, Vulnerability{
+			ID:           m.Vulnerability.ID,
+			Package:      m.Artifact.Name,
+			Version:      m.Artifact.Version,
+			FixedVersion: strings.Join(m.Vulnerability.Fix.Versions, ", "),
+			Severity:     strings.ToUpper(m.Vulnerability.Severity),
+		})
+	}
+
+	return vulns, nil
+}
+
+// severitySummary is how many of vulns there are of each severity, most
+// severe first, for people.
+func severitySummary(vulns []Vulnerability) string {
+	counts := map[string]int{}
+	for _, v := range vulns {
+		counts[strings.ToUpper(v.Severity)]++
+	}
+
+	parts := []string{}
+	for i := len(severities) - 1; i >= 0; i-- {
+		if n := counts[severities[i]]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, strings.ToLower(severities[i])))
+		}
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// scanLayer scans the rootfs of the layer name with the build's scanner,
+// and fails with ErrVulnerable if it finds vulnerabilities at least as
+// severe as opts.ScanFailOn.
+func scanLayer(opts *BuildArgs, name string, rootfs string) ([]Vulnerability, error) {
+	scanner, ok := lookupScanner(opts.Scanner)
+	if !ok {
+		return nil, fmt.Errorf("unknown scanner %s", opts.Scanner)
+	}
+
+	infof(opts.Config, "scanning %s with %s\n", name, opts.Scanner)
+	vulns, err := scanner.Scan(opts.Config, name, rootfs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't scan %s", name)
+	}
+
+	sort.SliceStable(vulns, func(i, j int) bool {
+		return severityRank(vulns[i].Severity) > severityRank(vulns[j].Severity)
+	})
+
+	if len(vulns) == 0 {
+		infof(opts.Config, "%s has no known vulnerabilities\n", name)
+		return vulns, nil
+	}
+	infof(opts.Config, "%s has %d vulnerabilities: %s\n", name, len(vulns), severitySummary(vulns))
+
+	if opts.ScanFailOn == "" {
+		return vulns, nil
+	}
+
+	threshold := severityRank(opts.ScanFailOn)
+	failed := []string{}
+	for _, v := range vulns {
+		if severityRank(v.Severity) >= threshold {
+			failed = append(failed, fmt.Sprintf("%s (%s %s)", v.ID, v.Package, strings.ToLower(v.Severity)))
+		}
+	}
+
+	if len(failed) > 0 {
+		return vulns, newError(ErrVulnerable, nil, "%s has vulnerabilities of severity %s or higher: %s", name, strings.ToLower(opts.ScanFailOn), strings.Join(failed, ", "))
+	}
+
+	return vulns, nil
+}
@@ -0,0 +1,73 @@
+package stacker
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseScannerOutput(t *testing.T) {
+	trivy := `{"Results": [{"Target": "rootfs", "Vulnerabilities": [
+		{"VulnerabilityID": "CVE-2019-1", "PkgName": "openssl", "InstalledVersion": "1.1.1a", "FixedVersion": "1.1.1b", "Severity": "HIGH"}
+	]}]}`
+
+	vulns, err := parseTrivy([]byte(trivy))
+	if err != nil {
+		t.Fatalf("couldn't parse trivy output %v", err)
+	}
+
+	expected := Vulnerability{ID: "CVE-2019-1", Package: "openssl", Version: "1.1.1a", FixedVersion: "1.1.1b", Severity: "HIGH"}
+	if len(vulns) != 1 || vulns[0] != expected {
+		t.Errorf("bad vulnerabilities from trivy %v", vulns)
+	}
+
+	grype := `{"matches": [{
+		"vulnerability": {"id": "CVE-2019-1", "severity": "High", "fix": {"versions": ["1.1.1b"]}},
+		"artifact": {"name": "openssl", "version": "1.1.1a"}
+	}]}`
+
+	vulns, err = parseGrype([]byte(grype))
+	if err != nil {
+		t.Fatalf("couldn't parse grype output %v", err)
+	}
+
+	if len(vulns) != 1 || vulns[0] != expected {
+		t.Errorf("bad vulnerabilities from grype %v", vulns)
+	}
+}
+
+type fakeScanner []Vulnerability
+
+func (s fakeScanner) Scan(config StackerConfig, name string, rootfs string) ([]Vulnerability, error) {
+	return s, nil
+}
+
+func TestScanLayer(t *testing.T) {
+	RegisterScanner("fake", fakeScanner{
+		{ID: "CVE-2019-1", Severity: "LOW"},
+		{ID: "CVE-2019-2", Severity: "HIGH"},
+	})
+	defer delete(scanners, "fake")
+
+	vulns, err := scanLayer(&BuildArgs{Scanner: "fake"}, "foo", "/")
+	if err != nil {
+		t.Fatalf("scan without a threshold failed %v", err)
+	}
+
+	if len(vulns) != 2 || vulns[0].ID != "CVE-2019-2" {
+		t.Errorf("vulnerabilities aren't most severe first: %v", vulns)
+	}
+
+	if _, err := scanLayer(&BuildArgs{Scanner: "fake", ScanFailOn: "critical"}, "foo", "/"); err != nil {
+		t.Errorf("scan failed below its threshold: %v", err)
+	}
+
+	_, err = scanLayer(&BuildArgs{Scanner: "fake", ScanFailOn: "medium"}, "foo", "/")
+	if errors.Cause(err) != ErrVulnerable {
+		t.Errorf("expected ErrVulnerable, got %v", err)
+	}
+
+	if err := (&BuildArgs{Scanner: "fake", ScanFailOn: "bad"}).checkScanner(); err == nil {
+		t.Errorf("bad severity accepted")
+	}
+}
@@ -0,0 +1,72 @@
+package stacker
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+)
+
+// Scheme is an implementation of a url scheme (the foo in foo://...) that
+// stacker can fetch files from and push images to. Fetch is used for
+// import: and for from: with type: tar; Push is used for save_url.
+//
+// docker:// and oci: urls are handled by containers/image; to add a
+// containers/image transport instead, see lib.RegisterURLScheme.
+type Scheme interface {
+	// Fetch copies the file at url into cacheDir, returning the path to
+	// the copy. Implementations should avoid re-fetching the file if the
+	// copy in cacheDir is up to date.
+	Fetch(config StackerConfig, url string, cacheDir string) (string, error)
+
+	// Push saves the image tag in the OCI layout at ociDir to url.
+	Push(config StackerConfig, ociDir string, tag string, url string) error
+}
+
+var schemes map[string]Scheme
+
+// RegisterScheme makes stacker use s for urls with the given scheme. It is
+// meant to be called from an init() function, and is not safe to call
+// concurrently with a build.
+func RegisterScheme(scheme string, s Scheme) {
+	schemes[scheme] = s
+}
+
+func lookupScheme(scheme string) (Scheme, bool) {
+	s, ok := schemes[scheme]
+	return s, ok
+}
+
+func init() {
+	schemes = map[string]Scheme{}
+	RegisterScheme("http", httpScheme{})
+	RegisterScheme("https", httpScheme{})
+	RegisterScheme("stacker", stackerScheme{})
+}
+
+type httpScheme struct{}
+
+func (httpScheme) Fetch(config StackerConfig, url string, cacheDir string) (string, error) {
+	return stageDownload(config, cacheDir, url)
+}
+
+func (httpScheme) Push(config StackerConfig, ociDir string, tag string, url string) error {
+	return fmt.Errorf("can't push to http urls: %s", url)
+}
+
+// stackerScheme is stacker://<layer>/<path>, which imports path from the
+// rootfs of a layer that has already been built.
+type stackerScheme struct{}
+
+func (stackerScheme) Fetch(config StackerConfig, rawURL string, cacheDir string) (string, error) {
+	url, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	p := path.Join(config.RootFSDir, url.Host, "rootfs", url.Path)
+	return importFile(config, p, cacheDir)
+}
+
+func (stackerScheme) Push(config StackerConfig, ociDir string, tag string, url string) error {
+	return fmt.Errorf("can't push to stacker urls: %s", url)
+}
@@ -0,0 +1,94 @@
+package stacker
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type fakeScheme struct {
+	fetched []string
+}
+
+func (fs *fakeScheme) Fetch(config StackerConfig, url string, cacheDir string) (string, error) {
+	fs.fetched = append(fs.fetched, url)
+	return path.Join(cacheDir, path.Base(url)), nil
+}
+
+func (fs *fakeScheme) Push(config StackerConfig, ociDir string, tag string, url string) error {
+	return fmt.Errorf("not implemented")
+}
+
+func TestRegisterScheme(t *testing.T) {
+	fs := &fakeScheme{}
+	RegisterScheme("fake", fs)
+	defer delete(schemes, "fake")
+
+	p, err := acquireUrl(StackerConfig{}, "fake://example.com/foo.tar", "/cache")
+	if err != nil {
+		t.Fatalf("couldn't acquire fake url: %v", err)
+	}
+
+	if p != "/cache/foo.tar" || len(fs.fetched) != 1 {
+		t.Errorf("fake scheme not used: %s %v", p, fs.fetched)
+	}
+
+	is, err := NewImageSource("fake://example.com/images")
+	if err != nil {
+		t.Fatalf("couldn't create image source for fake scheme: %v", err)
+	}
+
+	if is.Type != "fake" {
+		t.Errorf("bad image source type %s", is.Type)
+	}
+
+	_, err = acquireUrl(StackerConfig{}, "unknown://example.com/foo.tar", "/cache")
+	if err == nil {
+		t.Errorf("acquired url with unknown scheme")
+	}
+}
+
+func TestSchemeBase(t *testing.T) {
+	fs := &fakeScheme{}
+	RegisterScheme("fake", fs)
+	defer delete(schemes, "fake")
+
+	dir, err := ioutil.TempDir("", "stacker_scheme_test")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the fake scheme "fetches" files that are already in the cache dir
+	f, err := os.Create(path.Join(dir, "rootfs.tar"))
+	if err != nil {
+		t.Fatalf("couldn't create tar: %v", err)
+	}
+	tw := tar.NewWriter(f)
+	tw.WriteHeader(&tar.Header{Name: "etc/os-release", Mode: 0644, Size: 4, Typeflag: tar.TypeReg})
+	tw.Write([]byte("ID=x"))
+	tw.Close()
+	f.Close()
+
+	rootfs := path.Join(dir, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatalf("couldn't make rootfs: %v", err)
+	}
+
+	is := &ImageSource{Type: "fake", Url: "fake://example.com/rootfs.tar"}
+	if is.baseType() != TarType {
+		t.Fatalf("fake scheme base isn't a tar base: %s", is.baseType())
+	}
+
+	if err := extractTarBase(StackerConfig{}, is, dir, rootfs); err != nil {
+		t.Fatalf("couldn't extract fake scheme base: %v", err)
+	}
+
+	content, err := ioutil.ReadFile(path.Join(rootfs, "etc/os-release"))
+	if err != nil || string(content) != "ID=x" || len(fs.fetched) != 1 {
+		t.Fatalf("bad extracted file: %s %v %v", string(content), err, fs.fetched)
+	}
+}
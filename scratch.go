@@ -0,0 +1,117 @@
+package stacker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/dustin/go-humanize"
+	"golang.org/x/sys/unix"
+)
+
+// scratchDir is where this build's large temporary files go: its own
+// directory in the config's ScratchDir (which stackers with different
+// working containers can share), or "" if there isn't one.
+func (c StackerConfig) scratchDir() string {
+	if c.ScratchDir == "" {
+		return ""
+	}
+	return path.Join(c.ScratchDir, c.WorkingContainer())
+}
+
+// squashfsScratchDir is where squashfs images are generated before they're
+// added to the output: the scratch directory, or OCIDir if there isn't one.
+func (c StackerConfig) squashfsScratchDir() string {
+	if dir := c.scratchDir(); dir != "" {
+		return dir
+	}
+	return c.OCIDir
+}
+
+// freeSpace returns how many bytes unprivileged users can still write to the
+// filesystem dir is on.
+func freeSpace(dir string) (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// checkScratchSpace makes the directory squashfs images are generated in,
+// and checks that it has at least the config's ScratchMinFree free, so that
+// a build fails before it starts (or before the layer) rather than when
+// mksquashfs runs out of space.
+func checkScratchSpace(config StackerConfig) error {
+	dir := config.squashfsScratchDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if config.ScratchMinFree == "" {
+		return nil
+	}
+
+	min, err := humanize.ParseBytes(config.ScratchMinFree)
+	if err != nil {
+		return fmt.Errorf("bad scratch_min_free %s: %v", config.ScratchMinFree, err)
+	}
+
+	free, err := freeSpace(dir)
+	if err != nil {
+		return err
+	}
+
+	if free < min {
+		return newError(ErrNoSpace, nil, "%s only has %s free, but scratch_min_free is %s; free some space, or set scratch_dir to somewhere with more",
+			dir, humanize.Bytes(free), humanize.Bytes(min))
+	}
+
+	return nil
+}
+
+// stageDownload downloads url into cacheDir by way of the config's scratch
+// directory, so that a half downloaded file never ends up in cacheDir (where
+// it would be taken to be the whole thing). Without a scratch directory, the
+// file is downloaded straight into cacheDir.
+func stageDownload(config StackerConfig, cacheDir string, url string) (string, error) {
+	scratch := config.scratchDir()
+	if scratch == "" {
+		return download(config, cacheDir, url)
+	}
+
+	dest := path.Join(cacheDir, path.Base(url))
+	if _, err := os.Stat(dest); err == nil {
+		verboseln(config, "using cached copy of", url)
+		return dest, nil
+	}
+
+	if err := os.MkdirAll(scratch, 0755); err != nil {
+		return "", err
+	}
+
+	staging, err := ioutil.TempDir(scratch, "stacker-download-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(staging)
+
+	downloaded, err := download(config, staging, url)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(downloaded, dest); err == nil {
+		return dest, nil
+	}
+
+	// the scratch directory is on another filesystem
+	if err := lib.FileCopy(dest, downloaded); err != nil {
+		os.Remove(dest)
+		return "", err
+	}
+
+	return dest, nil
+}
@@ -0,0 +1,82 @@
+package stacker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestScratchDir(t *testing.T) {
+	config := StackerConfig{OCIDir: "/oci", WorkingContainerName: "wc"}
+	if config.scratchDir() != "" || config.squashfsScratchDir() != "/oci" {
+		t.Errorf("squashfs not generated in the OCI dir without a scratch dir")
+	}
+
+	config.ScratchDir = "/scratch"
+	if config.scratchDir() != "/scratch/wc" || config.squashfsScratchDir() != "/scratch/wc" {
+		t.Errorf("bad scratch dir %s", config.scratchDir())
+	}
+}
+
+func TestCheckScratchSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-scratch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := StackerConfig{ScratchDir: dir, ScratchMinFree: "1KB"}
+	if err := checkScratchSpace(config); err != nil {
+		t.Fatalf("not enough space for 1KB? %v", err)
+	}
+
+	config.ScratchMinFree = "1000PB"
+	if err := checkScratchSpace(config); errors.Cause(err) != ErrNoSpace {
+		t.Fatalf("expected a no space error, got %v", err)
+	}
+
+	config.ScratchMinFree = "lots"
+	if err := checkScratchSpace(config); err == nil {
+		t.Fatalf("bad size accepted")
+	}
+}
+
+func TestStageDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-scratch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello")
+	}))
+	defer server.Close()
+
+	config := StackerConfig{ScratchDir: path.Join(dir, "scratch")}
+	cacheDir := path.Join(dir, "cache")
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	downloaded, err := stageDownload(config, cacheDir, server.URL+"/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(downloaded)
+	if err != nil || string(content) != "hello" || downloaded != path.Join(cacheDir, "foo") {
+		t.Fatalf("bad download %s: %s %v", downloaded, string(content), err)
+	}
+
+	leftover, err := ioutil.ReadDir(config.scratchDir())
+	if err != nil || len(leftover) != 0 {
+		t.Fatalf("download left files in scratch: %v %v", leftover, err)
+	}
+}
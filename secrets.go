@@ -0,0 +1,178 @@
+package stacker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// secretsMountpoint is where the secrets a layer uses are in its container.
+const secretsMountpoint = "/run/secrets"
+
+var secretNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// secrets reads the secrets given to the build. Each one is NAME, whose value
+// is the NAME environment variable, or NAME=FILE, whose value is FILE's
+// contents.
+func (opts *BuildArgs) secrets() (map[string]string, error) {
+	secrets := map[string]string{}
+	for _, s := range opts.Secrets {
+		parts := strings.SplitN(s, "=", 2)
+		name := parts[0]
+		if !secretNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("invalid secret name %q", name)
+		}
+
+		if len(parts) == 1 {
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				return nil, fmt.Errorf("secret %s isn't in the environment", name)
+			}
+			secrets[name] = value
+			continue
+		}
+
+		content, err := ioutil.ReadFile(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read secret %s", name)
+		}
+		secrets[name] = string(content)
+	}
+
+	return secrets, nil
+}
+
+// hashSecret is the salted hash of a secret's value that stands in for it in
+// the build cache.
+func hashSecret(salt []byte, value string) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(value))
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// secretSalt is the salt that secrets are hashed with: config.SecretSalt, or
+// a random one made the first time it's needed and kept in StackerDir.
+func secretSalt(config StackerConfig) ([]byte, error) {
+	if config.SecretSalt != "" {
+		return []byte(config.SecretSalt), nil
+	}
+
+	p := path.Join(config.StackerDir, "secret.salt")
+	salt, err := ioutil.ReadFile(p)
+	if err == nil {
+		return salt, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	salt = []byte(hex.EncodeToString(buf))
+
+	if err := os.MkdirAll(config.StackerDir, 0755); err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(p, salt, 0600); err != nil {
+		return nil, err
+	}
+
+	return salt, nil
+}
+
+// writeSecrets writes the secrets the layer uses to files in dir, named after
+// them, that only their owner can read.
+func writeSecrets(sc StackerConfig, l *Layer, dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	for _, name := range l.Secrets {
+		value, ok := sc.Secrets[name]
+		if !ok {
+			return fmt.Errorf("secret %s wasn't given to the build", name)
+		}
+
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(value), 0400); err != nil {
+			return errors.Wrapf(err, "couldn't write secret %s", name)
+		}
+	}
+
+	return nil
+}
+
+// mountSecrets makes the secrets the layer uses available to its commands as
+// files in secretsMountpoint. They're never in the rootfs; the returned func
+// removes them, and the mountpoint if it was made for them.
+func mountSecrets(c runner, sc StackerConfig, l *Layer) (func(), error) {
+	if len(l.Secrets) == 0 {
+		return func() {}, nil
+	}
+
+	dir := path.Join(sc.StackerDir, "secrets", sc.WorkingContainer())
+	cleanup := func() { os.RemoveAll(dir) }
+
+	if err := writeSecrets(sc, l, dir); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	rootfs := path.Join(sc.RootFSDir, sc.WorkingContainer(), "rootfs")
+	created := firstMissing(rootfs, secretsMountpoint)
+	if err := c.bindMount(dir, secretsMountpoint, "ro"); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	return func() {
+		cleanup()
+		if created != "" {
+			removeMountpoint(rootfs, secretsMountpoint, created)
+		}
+	}, nil
+}
+
+// cacheKey is the layer as it's hashed and stored in the build cache: its
+// build_env values, which may be credentials, are replaced by their salted
+// hashes so that they still invalidate the cache when they change, but
+// aren't written to it.
+func (l *Layer) cacheKey(salt []byte) *Layer {
+	if len(l.BuildEnv) == 0 {
+		return l
+	}
+
+	key := *l
+	key.BuildEnv = map[string]string{}
+	for k, v := range l.BuildEnv {
+		key.BuildEnv[k] = hashSecret(salt, v)
+	}
+
+	return &key
+}
+
+// secretHashes are the salted hashes of the values of the secrets the layer
+// uses.
+func secretHashes(config StackerConfig, salt []byte, l *Layer) (map[string]string, error) {
+	hashes := map[string]string{}
+	for _, name := range l.Secrets {
+		value, ok := config.Secrets[name]
+		if !ok {
+			return nil, fmt.Errorf("secret %s wasn't given to the build", name)
+		}
+		hashes[name] = hashSecret(salt, value)
+	}
+
+	return hashes, nil
+}
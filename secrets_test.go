@@ -0,0 +1,169 @@
+package stacker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+func TestBuildSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-secrets-test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(path.Join(dir, "token"), []byte("from a file"), 0600); err != nil {
+		t.Fatalf("couldn't write secret %v", err)
+	}
+
+	os.Setenv("STACKER_TEST_SECRET", "from the env")
+	defer os.Unsetenv("STACKER_TEST_SECRET")
+
+	opts := &BuildArgs{Secrets: []string{"STACKER_TEST_SECRET", "token=" + path.Join(dir, "token")}}
+	secrets, err := opts.secrets()
+	if err != nil {
+		t.Fatalf("couldn't read secrets %v", err)
+	}
+
+	if secrets["STACKER_TEST_SECRET"] != "from the env" || secrets["token"] != "from a file" {
+		t.Errorf("bad secrets %v", secrets)
+	}
+
+	for _, bad := range []string{"STACKER_TEST_MISSING", "../token=" + path.Join(dir, "token"), "token=" + path.Join(dir, "missing")} {
+		opts := &BuildArgs{Secrets: []string{bad}}
+		if _, err := opts.secrets(); err == nil {
+			t.Errorf("secret %s should have been rejected", bad)
+		}
+	}
+}
+
+func TestSecretSalt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-secrets-test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := StackerConfig{StackerDir: dir}
+	salt, err := secretSalt(config)
+	if err != nil {
+		t.Fatalf("couldn't make salt %v", err)
+	}
+
+	again, err := secretSalt(config)
+	if err != nil {
+		t.Fatalf("couldn't read salt %v", err)
+	}
+
+	if !bytes.Equal(salt, again) {
+		t.Errorf("salt changed from %s to %s", salt, again)
+	}
+
+	if hashSecret(salt, "hunter2") != hashSecret(again, "hunter2") {
+		t.Errorf("hashes with the same salt differ")
+	}
+
+	config.SecretSalt = "configured"
+	configured, err := secretSalt(config)
+	if err != nil {
+		t.Fatalf("couldn't get configured salt %v", err)
+	}
+
+	if hashSecret(salt, "hunter2") == hashSecret(configured, "hunter2") {
+		t.Errorf("hashes with different salts are the same")
+	}
+}
+
+func TestCacheSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-secrets-test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := StackerConfig{
+		StackerDir: dir,
+		RootFSDir:  dir,
+		Secrets:    map[string]string{"token": "hunter2"},
+	}
+
+	layer := &Layer{
+		From:      &ImageSource{Type: "scratch"},
+		BuildEnv:  map[string]string{"PROXY_PASSWORD": "swordfish"},
+		Secrets:   []string{"token"},
+		BuildOnly: true,
+	}
+
+	sf := &Stackerfile{
+		internal: map[string]*Layer{
+			"foo": layer,
+		},
+	}
+
+	cache, err := OpenCache(config, casext.Engine{}, StackerFiles{"dummy": sf})
+	if err != nil {
+		t.Fatalf("couldn't open cache %v", err)
+	}
+
+	if err := os.MkdirAll(path.Join(dir, "foo"), 0755); err != nil {
+		t.Fatalf("couldn't fake successful build %v", err)
+	}
+
+	if err := cache.Put("foo", ispec.Descriptor{}); err != nil {
+		t.Fatalf("couldn't put to cache %v", err)
+	}
+
+	content, err := ioutil.ReadFile(path.Join(dir, "build.cache"))
+	if err != nil {
+		t.Fatalf("couldn't read cache %v", err)
+	}
+
+	for _, value := range []string{"hunter2", "swordfish"} {
+		if bytes.Contains(content, []byte(value)) {
+			t.Errorf("%s is in the cache", value)
+		}
+	}
+
+	if layer.BuildEnv["PROXY_PASSWORD"] != "swordfish" {
+		t.Errorf("caching changed the layer's build_env")
+	}
+
+	cache, err = OpenCache(config, casext.Engine{}, StackerFiles{"dummy": sf})
+	if err != nil {
+		t.Fatalf("couldn't re-load cache %v", err)
+	}
+
+	if _, err := cache.Get("foo"); err != nil {
+		t.Fatalf("layer should have been cached: %v", err)
+	}
+
+	// a changed secret is a cache miss, even though the layer isn't
+	config.Secrets["token"] = "hunter3"
+	cache, err = OpenCache(config, casext.Engine{}, StackerFiles{"dummy": sf})
+	if err != nil {
+		t.Fatalf("couldn't re-load cache %v", err)
+	}
+
+	if _, err := cache.Get("foo"); errors.Cause(err) != ErrCacheMiss {
+		t.Errorf("expected a cache miss, got %v", err)
+	}
+
+	// and so is a changed build_env value
+	config.Secrets["token"] = "hunter2"
+	layer.BuildEnv["PROXY_PASSWORD"] = "password"
+	cache, err = OpenCache(config, casext.Engine{}, StackerFiles{"dummy": sf})
+	if err != nil {
+		t.Fatalf("couldn't re-load cache %v", err)
+	}
+
+	if _, err := cache.Get("foo"); errors.Cause(err) != ErrCacheMiss {
+		t.Errorf("expected a cache miss, got %v", err)
+	}
+}
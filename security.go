@@ -0,0 +1,233 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// SeccompUnconfined is the seccomp profile that doesn't filter anything.
+const SeccompUnconfined = "unconfined"
+
+// DefaultCapabilities are the capabilities layers' commands get unless
+// they're privileged or configured otherwise: enough to install packages and
+// change the ownership and permissions of files, but not to administer the
+// host.
+var DefaultCapabilities = []string{
+	"audit_write",
+	"chown",
+	"dac_override",
+	"fowner",
+	"fsetid",
+	"kill",
+	"mknod",
+	"net_bind_service",
+	"net_raw",
+	"setfcap",
+	"setgid",
+	"setpcap",
+	"setuid",
+	"sys_chroot",
+}
+
+// allCapabilities are the capabilities the kernel knows about.
+var allCapabilities = []string{
+	"audit_control", "audit_read", "audit_write", "block_suspend", "chown",
+	"dac_override", "dac_read_search", "fowner", "fsetid", "ipc_lock",
+	"ipc_owner", "kill", "lease", "linux_immutable", "mac_admin",
+	"mac_override", "mknod", "net_admin", "net_bind_service",
+	"net_broadcast", "net_raw", "setfcap", "setgid", "setpcap", "setuid",
+	"sys_admin", "sys_boot", "sys_chroot", "sys_module", "sys_nice",
+	"sys_pacct", "sys_ptrace", "sys_rawio", "sys_resource", "sys_time",
+	"sys_tty_config", "syslog", "wake_alarm",
+}
+
+// deniedSyscalls are what stacker's default seccomp profile refuses (with
+// EPERM): loading kernels and modules, and other things that can affect the
+// whole host even from a container.
+var deniedSyscalls = []string{
+	"acct",
+	"add_key",
+	"bpf",
+	"delete_module",
+	"finit_module",
+	"init_module",
+	"kexec_file_load",
+	"kexec_load",
+	"keyctl",
+	"lookup_dcookie",
+	"open_by_handle_at",
+	"perf_event_open",
+	"quotactl",
+	"reboot",
+	"request_key",
+	"swapoff",
+	"swapon",
+	"userfaultfd",
+}
+
+// securityProfile is what layers' commands are allowed to do.
+type securityProfile struct {
+	// privileged commands get all capabilities, and no seccomp profile
+	privileged bool
+
+	// capabilities are in lower case, without the CAP_ prefix
+	capabilities []string
+
+	// seccomp is the path of the profile, SeccompUnconfined, or "" for
+	// stacker's default one
+	seccomp string
+}
+
+// parseCapability turns "CAP_SYS_ADMIN" or "sys_admin" into "sys_admin".
+func parseCapability(c string) (string, error) {
+	name := strings.TrimPrefix(strings.ToLower(c), "cap_")
+	for _, known := range allCapabilities {
+		if name == known {
+			return name, nil
+		}
+	}
+
+	return "", errors.Errorf("unknown capability %s", c)
+}
+
+// newSecurityProfile is the profile l's commands run with: the layer's
+// capabilities on top of sc's (or DefaultCapabilities), and its seccomp
+// profile or else sc's.
+func newSecurityProfile(sc StackerConfig, l *Layer) (securityProfile, error) {
+	if l.Privileged {
+		return securityProfile{privileged: true}, nil
+	}
+
+	base := DefaultCapabilities
+	if sc.Capabilities != nil {
+		base = sc.Capabilities
+	}
+
+	p := securityProfile{capabilities: []string{}}
+	for _, c := range append(append([]string{}, base...), l.Capabilities...) {
+		name, err := parseCapability(c)
+		if err != nil {
+			return securityProfile{}, err
+		}
+		p.capabilities = appendUnique(p.capabilities, name)
+	}
+
+	seccomp, err := l.ParseSeccompProfile()
+	if err != nil {
+		return securityProfile{}, err
+	}
+
+	p.seccomp = seccomp
+	if p.seccomp == "" {
+		p.seccomp = sc.SeccompProfile
+	}
+
+	return p, nil
+}
+
+// defaultLXCSeccomp writes stacker's default seccomp profile in lxc's format
+// to StackerDir, and returns its path.
+func defaultLXCSeccomp(sc StackerConfig) (string, error) {
+	profile := "2\nblacklist\n[all]\n"
+	for _, syscall := range deniedSyscalls {
+		profile += fmt.Sprintf("%s errno 1\n", syscall)
+	}
+
+	dir := path.Join(sc.StackerDir, "seccomp")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	p := path.Join(dir, "default.lxc")
+	if err := ioutil.WriteFile(p, []byte(profile), 0644); err != nil {
+		return "", err
+	}
+
+	return p, nil
+}
+
+func (c *container) setSecurity(p securityProfile) error {
+	if p.privileged {
+		return nil
+	}
+
+	caps := strings.Join(p.capabilities, " ")
+	if caps == "" {
+		caps = "none"
+	}
+
+	if err := c.setConfig("lxc.cap.keep", caps); err != nil {
+		return err
+	}
+
+	seccomp := p.seccomp
+	switch seccomp {
+	case SeccompUnconfined:
+		return nil
+	case "":
+		var err error
+		seccomp, err = defaultLXCSeccomp(c.sc)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.setConfig("lxc.seccomp.profile", seccomp)
+}
+
+// ociSeccomp is stacker's default seccomp profile in the runtime spec's
+// format.
+func ociSeccomp() *rspec.LinuxSeccomp {
+	return &rspec.LinuxSeccomp{
+		DefaultAction: rspec.ActAllow,
+		Syscalls: []rspec.LinuxSyscall{
+			{Names: deniedSyscalls, Action: rspec.ActErrno},
+		},
+	}
+}
+
+func (c *ociContainer) setSecurity(p securityProfile) error {
+	capabilities := p.capabilities
+	if p.privileged {
+		capabilities = allCapabilities
+	}
+
+	caps := []string{}
+	for _, c := range capabilities {
+		caps = append(caps, "CAP_"+strings.ToUpper(c))
+	}
+
+	c.spec.Process.Capabilities = &rspec.LinuxCapabilities{
+		Bounding:    caps,
+		Effective:   caps,
+		Inheritable: caps,
+		Permitted:   caps,
+	}
+
+	switch {
+	case p.privileged || p.seccomp == SeccompUnconfined:
+		c.spec.Linux.Seccomp = nil
+	case p.seccomp == "":
+		c.spec.Linux.Seccomp = ociSeccomp()
+	default:
+		content, err := ioutil.ReadFile(p.seccomp)
+		if err != nil {
+			return err
+		}
+
+		seccomp := &rspec.LinuxSeccomp{}
+		if err := json.Unmarshal(content, seccomp); err != nil {
+			return errors.Wrapf(err, "couldn't read seccomp profile %s", p.seccomp)
+		}
+		c.spec.Linux.Seccomp = seccomp
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package stacker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewSecurityProfile(t *testing.T) {
+	l := &Layer{Capabilities: []string{"CAP_SYS_ADMIN", "chown"}, SeccompProfile: "/build.seccomp"}
+	p, err := newSecurityProfile(StackerConfig{}, l)
+	if err != nil {
+		t.Fatalf("couldn't make profile: %v", err)
+	}
+
+	if !reflect.DeepEqual(p.capabilities, append(append([]string{}, DefaultCapabilities...), "sys_admin")) {
+		t.Errorf("bad capabilities: %v", p.capabilities)
+	}
+
+	if p.seccomp != "/build.seccomp" || p.privileged {
+		t.Errorf("bad profile: %v", p)
+	}
+
+	sc := StackerConfig{Capabilities: []string{}, SeccompProfile: SeccompUnconfined}
+	p, err = newSecurityProfile(sc, &Layer{})
+	if err != nil {
+		t.Fatalf("couldn't make profile: %v", err)
+	}
+
+	if len(p.capabilities) != 0 || p.seccomp != SeccompUnconfined {
+		t.Errorf("config didn't override the defaults: %v", p)
+	}
+
+	if _, err := newSecurityProfile(sc, &Layer{Capabilities: []string{"sys_everything"}}); err == nil {
+		t.Errorf("accepted an unknown capability")
+	}
+}
+
+func TestOCISecurity(t *testing.T) {
+	sc := StackerConfig{RootFSDir: "/roots"}
+	c := &ociContainer{sc: sc, name: "_working", spec: ociSpec(sc, "_working")}
+
+	if err := c.setSecurity(securityProfile{capabilities: []string{"chown"}}); err != nil {
+		t.Fatalf("couldn't set security: %v", err)
+	}
+
+	if !reflect.DeepEqual(c.spec.Process.Capabilities.Bounding, []string{"CAP_CHOWN"}) {
+		t.Errorf("bad capabilities: %v", c.spec.Process.Capabilities)
+	}
+
+	if c.spec.Linux.Seccomp == nil || len(c.spec.Linux.Seccomp.Syscalls[0].Names) != len(deniedSyscalls) {
+		t.Errorf("didn't get the default seccomp profile: %v", c.spec.Linux.Seccomp)
+	}
+
+	if err := c.setSecurity(securityProfile{privileged: true}); err != nil {
+		t.Fatalf("couldn't set security: %v", err)
+	}
+
+	if len(c.spec.Process.Capabilities.Effective) != len(allCapabilities) || c.spec.Linux.Seccomp != nil {
+		t.Errorf("privileged profile wasn't privileged: %v %v", c.spec.Process.Capabilities, c.spec.Linux.Seccomp)
+	}
+}
@@ -0,0 +1,174 @@
+package stacker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SendStorage is a Storage whose snapshots can be serialized as a stream, and
+// received from one, e.g. on another host.
+type SendStorage interface {
+	Storage
+
+	// Send writes the snapshot name to w, as just what changed since
+	// the snapshot parent if that isn't "", in which case whatever
+	// receives it needs to have received parent already.
+	Send(name string, parent string, w io.Writer) error
+
+	// Receive makes the snapshot name out of what was sent to r.
+	Receive(name string, r io.Reader) error
+}
+
+func (b *btrfs) Send(name string, parent string, w io.Writer) error {
+	args := []string{"send", "-q"}
+	if parent != "" {
+		args = append(args, "-p", path.Join(b.c.RootFSDir, parent))
+	}
+	args = append(args, path.Join(b.c.RootFSDir, name))
+
+	stderr := bytes.NewBuffer(nil)
+	cmd := exec.Command(b.c.ToolPath(ToolBtrfs), args...)
+	cmd.Stdout = w
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("btrfs send %s: %s: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+func (b *btrfs) Receive(name string, r io.Reader) error {
+	// btrfs receive names the snapshot what it was called where it was
+	// sent from, so it's received somewhere else and then renamed
+	dir, err := ioutil.TempDir(b.c.RootFSDir, ".receive-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command(b.c.ToolPath(ToolBtrfs), "receive", "-e", dir)
+	cmd.Stdin = r
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("btrfs receive %s: %s: %s", name, err, strings.TrimSpace(string(output)))
+	}
+
+	received, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	if len(received) != 1 {
+		for _, ent := range received {
+			btrfsSubVolumeDelete(path.Join(dir, ent.Name()))
+		}
+		return fmt.Errorf("expected one snapshot in the stream for %s, got %d", name, len(received))
+	}
+
+	return os.Rename(path.Join(dir, received[0].Name()), path.Join(b.c.RootFSDir, name))
+}
+
+// checkSnapshotName fails if the snapshot name would be outside the config's
+// RootFSDir, as layer names that leave it would be.
+func checkSnapshotName(config StackerConfig, name string) error {
+	base, err := filepath.Abs(config.RootFSDir)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(filepath.Join(base, name), base+"/") {
+		return fmt.Errorf("bad snapshot name %s, it leaves the rootfs directory", name)
+	}
+
+	return nil
+}
+
+// openSendStorage opens the storage, and checks that it can send and
+// receive snapshots, and that the btrfs tool it does that with is there.
+func openSendStorage(config StackerConfig) (SendStorage, error) {
+	if err := checkTool(ToolBtrfs, config.ToolPath(ToolBtrfs)); err != nil {
+		return nil, err
+	}
+
+	s, err := NewStorage(config)
+	if err != nil {
+		return nil, err
+	}
+
+	ss, ok := s.(SendStorage)
+	if !ok {
+		s.Detach()
+		return nil, fmt.Errorf("%s storage can't export or import snapshots", s.Name())
+	}
+
+	return ss, nil
+}
+
+// ExportSnapshot writes the snapshot name (e.g. a layer's rootfs, or an
+// unpacked base) from the config's storage to w, so that it can be imported
+// with ImportSnapshot on another host instead of being rebuilt or unpacked
+// again there. If parent isn't "", only what changed since that snapshot is
+// written, and it has to have been imported wherever this one is.
+func ExportSnapshot(config StackerConfig, name string, parent string, w io.Writer) error {
+	for _, snapshot := range []string{name, parent} {
+		if snapshot == "" {
+			continue
+		}
+		if err := checkSnapshotName(config, snapshot); err != nil {
+			return err
+		}
+	}
+
+	ociLock, err := LockOCIDir(config)
+	if err != nil {
+		return err
+	}
+	defer ociLock.Unlock()
+
+	s, err := openSendStorage(config)
+	if err != nil {
+		return err
+	}
+	defer s.Detach()
+
+	for _, snapshot := range []string{name, parent} {
+		if snapshot != "" && !s.Exists(snapshot) {
+			return fmt.Errorf("no snapshot %s", snapshot)
+		}
+	}
+
+	return s.Send(name, parent, w)
+}
+
+// ImportSnapshot makes the snapshot name in the config's storage out of what
+// ExportSnapshot wrote to r.
+func ImportSnapshot(config StackerConfig, name string, r io.Reader) error {
+	if err := checkSnapshotName(config, name); err != nil {
+		return err
+	}
+
+	ociLock, err := LockOCIDir(config)
+	if err != nil {
+		return err
+	}
+	defer ociLock.Unlock()
+
+	s, err := openSendStorage(config)
+	if err != nil {
+		return err
+	}
+	defer s.Detach()
+
+	if s.Exists(name) {
+		return fmt.Errorf("snapshot %s already exists", name)
+	}
+
+	return s.Receive(name, r)
+}
@@ -0,0 +1,21 @@
+package stacker
+
+import (
+	"testing"
+)
+
+func TestCheckSnapshotName(t *testing.T) {
+	config := StackerConfig{RootFSDir: "/var/lib/stacker/roots"}
+
+	for _, good := range []string{"app", "team/app", "_working"} {
+		if err := checkSnapshotName(config, good); err != nil {
+			t.Errorf("snapshot %s was refused: %v", good, err)
+		}
+	}
+
+	for _, bad := range []string{"", ".", "..", "../app", "app/../..", "/../../etc"} {
+		if err := checkSnapshotName(config, bad); err == nil {
+			t.Errorf("snapshot %s outside the rootfs directory was accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+//go:generate protoc --go_out=plugins=grpc,paths=source_relative:. stacker.proto
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/anuvu/stacker"
+)
+
+// Server implements the Stacker service on top of a single stacker config,
+// so that all clients share the same cache.
+type Server struct {
+	config stacker.StackerConfig
+	debug  bool
+
+	// stacker builds everything in a single working container, so only
+	// one request can be served at a time.
+	mu sync.Mutex
+}
+
+func NewServer(config stacker.StackerConfig, debug bool) *Server {
+	return &Server{config: config, debug: debug}
+}
+
+// eventWriter sends each line of build output to the client, until it goes
+// away (which also cancels the build).
+type eventWriter struct {
+	stream buildStream
+	err    error
+}
+
+func (ew *eventWriter) Write(p []byte) (int, error) {
+	if ew.err == nil {
+		ew.err = ew.stream.Send(&BuildEvent{Log: string(p)})
+	}
+	return len(p), nil
+}
+
+// buildStream is the stream of a Build or BuildMultiple request.
+type buildStream interface {
+	Send(*BuildEvent) error
+	Context() context.Context
+}
+
+func (s *Server) build(paths []string, opts *BuildOptions, stream buildStream) error {
+	for _, p := range paths {
+		if !filepath.IsAbs(p) {
+			return fmt.Errorf("stackerfile paths must be absolute: %s", p)
+		}
+	}
+
+	// the cache is shared by all the clients, so none of them can wipe
+	// it
+	if opts.GetNoCache() {
+		return fmt.Errorf("the daemon's build cache is shared, so builds can't be without it")
+	}
+
+	// the daemon's own stdout gets a copy of everything too
+	output := io.MultiWriter(os.Stdout, &eventWriter{stream: stream})
+
+	stackerOpts := []stacker.Option{
+		stacker.WithConfig(s.config),
+		stacker.WithSubstitutions(opts.GetSubstitute()...),
+		stacker.WithRemoteSaveTags(opts.GetRemoteSaveTags()...),
+		stacker.WithOutput(output),
+		// the daemon is root, and its clients needn't be
+		stacker.WithUntrustedStackerfiles(),
+	}
+
+	if opts.GetLayerType() != "" {
+		stackerOpts = append(stackerOpts, stacker.WithLayerType(opts.GetLayerType()))
+	}
+
+	if s.debug {
+		stackerOpts = append(stackerOpts, stacker.WithDebug())
+	}
+
+	st, err := stacker.New(stackerOpts...)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report, buildErr := st.Build(stream.Context(), paths...)
+
+	content, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	final := &BuildEvent{Report: string(content)}
+	if buildErr != nil {
+		final.Error = buildErr.Error()
+	}
+
+	if err := stream.Send(final); err != nil {
+		return err
+	}
+
+	return buildErr
+}
+
+func (s *Server) Build(req *BuildRequest, stream Stacker_BuildServer) error {
+	return s.build([]string{req.Stackerfile}, req.Options, stream)
+}
+
+func (s *Server) BuildMultiple(req *BuildMultipleRequest, stream Stacker_BuildMultipleServer) error {
+	return s.build(req.Stackerfiles, req.Options, stream)
+}
+
+func (s *Server) Inspect(ctx context.Context, req *InspectRequest) (*InspectResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inspection, err := stacker.Inspect(s.config, req.Tag)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := json.Marshal(inspection)
+	if err != nil {
+		return nil, err
+	}
+
+	return &InspectResponse{Json: string(content)}, nil
+}
+
+func (s *Server) GC(ctx context.Context, req *GCRequest) (*GCResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := stacker.GC(s.config); err != nil {
+		return nil, err
+	}
+
+	return &GCResponse{}, nil
+}
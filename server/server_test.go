@@ -0,0 +1,55 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/anuvu/stacker"
+	"google.golang.org/grpc"
+)
+
+type testBuildServer struct {
+	grpc.ServerStream
+	events []*BuildEvent
+}
+
+func (s *testBuildServer) Send(e *BuildEvent) error {
+	s.events = append(s.events, e)
+	return nil
+}
+
+func TestBuildRefusesBadRequests(t *testing.T) {
+	s := NewServer(stacker.StackerConfig{}, false)
+
+	for _, c := range []struct {
+		paths []string
+		opts  *BuildOptions
+	}{
+		{[]string{"stacker.yaml"}, &BuildOptions{}},
+		// the cache is every client's, so none of them can wipe it
+		{[]string{"/stacker.yaml"}, &BuildOptions{NoCache: true}},
+	} {
+		stream := &testBuildServer{}
+		if err := s.build(c.paths, c.opts, stream); err == nil {
+			t.Errorf("build of %v with %v was accepted", c.paths, c.opts)
+		}
+
+		if len(stream.events) != 0 {
+			t.Errorf("refused build of %v sent events %v", c.paths, stream.events)
+		}
+	}
+}
+
+func TestEventWriter(t *testing.T) {
+	stream := &testBuildServer{}
+	ew := &eventWriter{stream: stream}
+
+	for _, line := range []string{"building foo\n", "done\n"} {
+		if n, err := ew.Write([]byte(line)); err != nil || n != len(line) {
+			t.Fatalf("bad write of %q: %d %v", line, n, err)
+		}
+	}
+
+	if len(stream.events) != 2 || stream.events[1].Log != "done\n" {
+		t.Errorf("bad events %v", stream.events)
+	}
+}
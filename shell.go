@@ -0,0 +1,24 @@
+package stacker
+
+import (
+	"strings"
+)
+
+// shellQuote quotes s as a single word for sh, e.g. the remote shell ssh runs
+// commands with.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=+/.,:@%") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// ShellJoin quotes args (see shellQuote) into a shell command that runs them
+// as they are.
+func ShellJoin(args []string) string {
+	quoted := []string{}
+	for _, a := range args {
+		quoted = append(quoted, shellQuote(a))
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,24 @@
+package stacker
+
+import (
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	for s, expected := range map[string]string{
+		"stacker.yaml":       "stacker.yaml",
+		"--substitute=FOO=1": "--substitute=FOO=1",
+		"":                   "''",
+		"two words":          "'two words'",
+		"it's":               `'it'\''s'`,
+		"$(reboot)":          "'$(reboot)'",
+	} {
+		if actual := shellQuote(s); actual != expected {
+			t.Errorf("quoted %q as %s, expected %s", s, actual, expected)
+		}
+	}
+
+	if actual := ShellJoin([]string{"sh", "-c", "echo 'a  b'"}); actual != `sh -c 'echo '\''a  b'\'''` {
+		t.Errorf("bad joined command %s", actual)
+	}
+}
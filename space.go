@@ -0,0 +1,215 @@
+package stacker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/dustin/go-humanize"
+	"github.com/openSUSE/umoci"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// unpackFactor is how many times bigger a compressed layer is
+	// estimated to be once it's unpacked.
+	unpackFactor = 3
+
+	// layerDiffFloor is the room left for what a layer's commands add on
+	// top of its imports, which can't be known before they run.
+	layerDiffFloor = 64 * 1024 * 1024
+)
+
+// spaceNeed is how much space building a layer is estimated to need in one
+// of the directories it writes to, and what for.
+type spaceNeed struct {
+	dir   string
+	bytes uint64
+	what  string
+}
+
+// dirSize returns the size of the files under dir.
+func dirSize(dir string) (uint64, error) {
+	var size uint64
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return size, err
+}
+
+// imageSize returns the size of the layers of the image tag in the layout
+// at layout, or 0 if it isn't there.
+func imageSize(layout string, tag string) uint64 {
+	oci, err := umoci.OpenLayout(layout)
+	if err != nil {
+		return 0
+	}
+	defer oci.Close()
+
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return 0
+	}
+
+	var size uint64
+	for _, l := range manifest.Layers {
+		size += uint64(l.Size)
+	}
+	return size
+}
+
+// baseSpace returns the (compressed) size of l's base, and how much space
+// unpacking it will need, as far as they're known before it's imported: an
+// image that hasn't been downloaded yet doesn't count, and one that's
+// already unpacked (or a layer that was built here, which is snapshotted)
+// needs nothing more.
+func (opts *BuildArgs) baseSpace(s Storage, l *Layer) (uint64, uint64) {
+	switch l.From.baseType() {
+	case BuiltType:
+		return imageSize(opts.Config.OCIDir, l.From.Tag), 0
+	case TarType:
+		if strings.Contains(l.From.Url, "://") {
+			return 0, 0
+		}
+		st, err := os.Stat(l.From.Url)
+		if err != nil {
+			return 0, 0
+		}
+		return uint64(st.Size()), uint64(st.Size()) * unpackFactor
+	case DockerType, OCIType:
+		tag, err := l.From.ParseTag()
+		if err != nil {
+			return 0, 0
+		}
+
+		layout := path.Join(opts.Config.StackerDir, "layer-bases", "oci")
+		size := imageSize(layout, tag)
+		if size == 0 {
+			return 0, 0
+		}
+
+		cache, err := umoci.OpenLayout(layout)
+		if err != nil {
+			return size, 0
+		}
+		defer cache.Close()
+
+		dps, err := cache.ResolveReference(context.Background(), tag)
+		if err == nil && len(dps) == 1 && s.Exists(baseSnapshotName(dps[0].Descriptor().Digest)) {
+			return size, 0
+		}
+
+		return size, size * unpackFactor
+	}
+
+	return 0, 0
+}
+
+// estimateSpace estimates how much space building the layer name will need
+// in each of the directories it writes to: the base unpacked in RootFSDir,
+// the layer's changes in it, the layer itself in OCIDir, and for squashfs
+// layers, the image generated in the scratch directory. The layer's imports
+// have already been fetched into StackerDir by then, and its changes are
+// taken to be about the size of its imports, plus layerDiffFloor.
+func (opts *BuildArgs) estimateSpace(s Storage, name string, l *Layer) ([]spaceNeed, error) {
+	imports, err := dirSize(path.Join(opts.Config.StackerDir, "imports", name))
+	if err != nil {
+		return nil, err
+	}
+
+	baseSize, unpack := opts.baseSpace(s, l)
+	diff := imports + layerDiffFloor
+
+	// squashed layers are the whole rootfs
+	layer := diff
+	if l.Squash {
+		layer += baseSize * unpackFactor
+	}
+
+	needs := []spaceNeed{
+		{opts.Config.RootFSDir, unpack, "unpacking the base"},
+		{opts.Config.RootFSDir, diff, "the layer's changes"},
+		{opts.Config.OCIDir, layer, "the layer"},
+	}
+
+	if opts.LayerType == "squashfs" {
+		needs = append(needs, spaceNeed{opts.Config.squashfsScratchDir(), layer, "generating the squashfs"})
+	}
+
+	return needs, nil
+}
+
+// existingParent returns dir, or the closest of its parents that exists.
+func existingParent(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil || dir == "/" || dir == "." {
+			return dir
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// checkSpace checks that each filesystem the needs are on has enough space
+// free for all of the ones on it.
+func checkSpace(name string, needs []spaceNeed) error {
+	type filesystem struct {
+		dir   string
+		free  uint64
+		total uint64
+		whats []string
+	}
+
+	filesystems := map[[2]int32]*filesystem{}
+	for _, n := range needs {
+		if n.bytes == 0 {
+			continue
+		}
+
+		dir := existingParent(n.dir)
+
+		var st unix.Statfs_t
+		if err := unix.Statfs(dir, &st); err != nil {
+			return err
+		}
+
+		fs, ok := filesystems[st.Fsid.Val]
+		if !ok {
+			fs = &filesystem{dir: n.dir, free: st.Bavail * uint64(st.Bsize)}
+			filesystems[st.Fsid.Val] = fs
+		}
+
+		fs.total += n.bytes
+		fs.whats = append(fs.whats, fmt.Sprintf("%s for %s", humanize.Bytes(n.bytes), n.what))
+	}
+
+	problems := []string{}
+	for _, fs := range filesystems {
+		if fs.total > fs.free {
+			problems = append(problems, fmt.Sprintf("%s has %s free, but about %s is needed (%s)",
+				fs.dir, humanize.Bytes(fs.free), humanize.Bytes(fs.total), strings.Join(fs.whats, ", ")))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return newError(ErrNoSpace, nil, "not enough space to build %s: %s; free some space, or build with --no-space-check if the estimate is wrong",
+			name, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
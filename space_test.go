@@ -0,0 +1,79 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestDirSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-space-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(path.Join(dir, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "a", "b"), make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "c"), make([]byte, 24), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := dirSize(dir)
+	if err != nil || size != 1024 {
+		t.Fatalf("bad size %d: %v", size, err)
+	}
+
+	size, err = dirSize(path.Join(dir, "missing"))
+	if err != nil || size != 0 {
+		t.Fatalf("bad size of a missing dir %d: %v", size, err)
+	}
+}
+
+func TestExistingParent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-space-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if p := existingParent(path.Join(dir, "a", "b")); p != dir {
+		t.Errorf("bad existing parent %s", p)
+	}
+}
+
+func TestCheckSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-space-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	needs := []spaceNeed{
+		{dir, 1024, "a little"},
+		{path.Join(dir, "not-yet"), 0, "nothing"},
+	}
+	if err := checkSpace("foo", needs); err != nil {
+		t.Fatalf("not enough space for 1KB? %v", err)
+	}
+
+	// each is fine alone, but they're on the same filesystem
+	free, err := freeSpace(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	needs = []spaceNeed{
+		{dir, free/2 + 1, "half"},
+		{path.Join(dir, "not-yet"), free/2 + 1, "the other half"},
+	}
+	if err := checkSpace("foo", needs); errors.Cause(err) != ErrNoSpace {
+		t.Fatalf("expected a no space error, got %v", err)
+	}
+}
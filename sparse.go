@@ -0,0 +1,312 @@
+package stacker
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// sparseMinSize is the smallest file that is checked for holes; smaller
+// files can't save enough to be worth the sparse map.
+const sparseMinSize = 1024 * 1024
+
+// lseek's whences for finding holes; the version of x/sys/unix we use
+// doesn't have them.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// sparseRegion is a part of a sparse file that has data in it.
+type sparseRegion struct {
+	offset int64
+	length int64
+}
+
+// dataRegions returns the parts of f (which is size bytes long) that aren't
+// holes, as reported by SEEK_DATA and SEEK_HOLE.
+func dataRegions(f *os.File, size int64) ([]sparseRegion, error) {
+	regions := []sparseRegion{}
+	fd := int(f.Fd())
+
+	var offset int64
+	for offset < size {
+		start, err := unix.Seek(fd, offset, seekData)
+		if err == unix.ENXIO {
+			// only a hole from here to the end
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		end, err := unix.Seek(fd, start, seekHole)
+		if err != nil {
+			return nil, err
+		}
+
+		if end > size {
+			end = size
+		}
+
+		regions = append(regions, sparseRegion{start, end - start})
+		offset = end
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return regions, nil
+}
+
+// sparseTar rewrites the regular files in the tar stream r that have holes
+// in rootfs as GNU sparse (PAX format 1.0) entries, so that the holes don't
+// take up space in the layer. Go's archive/tar can read these, but not write
+// them, so the entries are written by hand. r is closed once it has been
+// rewritten.
+func sparseTar(r io.ReadCloser, rootfs string) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		defer r.Close()
+		writer.CloseWithError(writeSparseTar(r, rootfs, writer))
+	}()
+	return reader
+}
+
+func writeSparseTar(r io.Reader, rootfs string, w io.Writer) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		sparse, err := maybeWriteSparse(tw, w, hdr, rootfs)
+		if err != nil {
+			return err
+		}
+
+		if sparse {
+			// we wrote it from rootfs, so skip the expanded copy
+			if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// maybeWriteSparse writes hdr as a sparse entry (with its content from
+// rootfs) if it is a regular file with holes.
+func maybeWriteSparse(tw *tar.Writer, w io.Writer, hdr *tar.Header, rootfs string) (bool, error) {
+	if (hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA) || hdr.Size < sparseMinSize {
+		return false, nil
+	}
+
+	f, err := os.Open(path.Join(rootfs, hdr.Name))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	// the rootfs isn't what the layer was generated from
+	if fi.Size() != hdr.Size {
+		return false, errors.Errorf("%s changed while generating layer", hdr.Name)
+	}
+
+	regions, err := dataRegions(f, hdr.Size)
+	if err != nil {
+		return false, errors.Wrapf(err, "couldn't find holes in %s", hdr.Name)
+	}
+
+	var dataSize int64
+	for _, region := range regions {
+		dataSize += region.length
+	}
+
+	if dataSize == hdr.Size {
+		return false, nil
+	}
+
+	// pad the previous entry, so we can write our own blocks
+	if err := tw.Flush(); err != nil {
+		return false, err
+	}
+
+	return true, writeSparseEntry(w, hdr, f, regions)
+}
+
+// paxRecord formats a PAX extended header record, whose length includes the
+// length of the length itself.
+func paxRecord(k string, v string) string {
+	record := fmt.Sprintf(" %s=%s\n", k, v)
+	size := len(record)
+	for {
+		full := strconv.Itoa(size) + record
+		if len(full) == size {
+			return full
+		}
+		size = len(full)
+	}
+}
+
+// ustarBlock formats a ustar header block. Values that don't fit in it must
+// also be in the PAX records before it, which readers prefer.
+func ustarBlock(name string, typeflag byte, size int64, hdr *tar.Header) []byte {
+	block := make([]byte, 512)
+
+	putString := func(b []byte, s string) {
+		copy(b, s)
+	}
+
+	putOctal := func(b []byte, n int64) {
+		s := strconv.FormatInt(n, 8)
+		if len(s) > len(b)-1 || n < 0 {
+			// too big; it's in the PAX records
+			s = "0"
+		}
+		for i := range b[:len(b)-1] {
+			b[i] = '0'
+		}
+		copy(b[len(b)-1-len(s):], s)
+	}
+
+	if len(name) > 100 {
+		name = name[len(name)-100:]
+	}
+
+	putString(block[0:100], name)
+	putOctal(block[100:108], hdr.Mode&07777)
+	putOctal(block[108:116], int64(hdr.Uid))
+	putOctal(block[116:124], int64(hdr.Gid))
+	putOctal(block[124:136], size)
+	putOctal(block[136:148], hdr.ModTime.Unix())
+	block[156] = typeflag
+	putString(block[257:263], "ustar\x00")
+	putString(block[263:265], "00")
+
+	// the checksum is computed with its own field as spaces
+	for i := 148; i < 156; i++ {
+		block[i] = ' '
+	}
+
+	var sum int64
+	for _, b := range block {
+		sum += int64(b)
+	}
+
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return block
+}
+
+func padding(n int64) []byte {
+	return make([]byte, (512-n%512)%512)
+}
+
+// writeSparseEntry writes hdr to w as a GNU sparse 1.0 entry, with the
+// regions of f as its data.
+func writeSparseEntry(w io.Writer, hdr *tar.Header, f *os.File, regions []sparseRegion) error {
+	// the sparse map, which comes before the data
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(regions))
+	for _, region := range regions {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", region.offset, region.length)
+	}
+	sparseMap.Write(padding(int64(sparseMap.Len())))
+
+	size := int64(sparseMap.Len())
+	for _, region := range regions {
+		size += region.length
+	}
+
+	dir, file := path.Split(hdr.Name)
+	sparseName := path.Join(dir, "GNUSparseFile.0", file)
+
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     hdr.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(hdr.Size, 10),
+		"path":                sparseName,
+		"size":                strconv.FormatInt(size, 10),
+		"uid":                 strconv.Itoa(hdr.Uid),
+		"gid":                 strconv.Itoa(hdr.Gid),
+		"mtime":               strconv.FormatInt(hdr.ModTime.Unix(), 10),
+	}
+
+	for k, v := range hdr.Xattrs {
+		records["SCHILY.xattr."+k] = v
+	}
+
+	// sorted, so the layer is reproducible
+	keys := []string{}
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pax bytes.Buffer
+	for _, k := range keys {
+		pax.WriteString(paxRecord(k, records[k]))
+	}
+
+	paxName := path.Join(dir, "PaxHeaders.0", file)
+	if _, err := w.Write(ustarBlock(paxName, tar.TypeXHeader, int64(pax.Len()), hdr)); err != nil {
+		return err
+	}
+
+	pax.Write(padding(int64(pax.Len())))
+	if _, err := w.Write(pax.Bytes()); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(ustarBlock(sparseName, tar.TypeReg, size, hdr)); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(sparseMap.Bytes()); err != nil {
+		return err
+	}
+
+	for _, region := range regions {
+		if _, err := f.Seek(region.offset, io.SeekStart); err != nil {
+			return err
+		}
+
+		n, err := io.CopyN(w, f, region.length)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't copy %s (copied %d bytes)", hdr.Name, n)
+		}
+	}
+
+	_, err := w.Write(padding(size))
+	return err
+}
@@ -0,0 +1,103 @@
+package stacker
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSparseTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_sparse_test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(path.Join(dir, "var/lib"), 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	const size = 64 * 1024 * 1024
+	p := path.Join(dir, "var/lib/disk.img")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if _, err := f.WriteAt([]byte("hello"), size/2); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := f.Truncate(size); err != nil {
+		t.Fatalf("%s", err)
+	}
+	f.Close()
+
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	hdr := &tar.Header{
+		Name:     "var/lib/disk.img",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Now(),
+		Xattrs:   map[string]string{"user.foo": "bar"},
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	tw.Close()
+
+	sparse, err := ioutil.ReadAll(sparseTar(ioutil.NopCloser(&layer), dir))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(sparse) > size/4 {
+		t.Fatalf("holes were written out: layer is %d bytes", len(sparse))
+	}
+
+	tr := tar.NewReader(bytes.NewReader(sparse))
+	hdr, err = tr.Next()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if hdr.Name != "var/lib/disk.img" || hdr.Size != size || hdr.Xattrs["user.foo"] != "bar" {
+		t.Fatalf("bad sparse header: %v", hdr)
+	}
+
+	var read bytes.Buffer
+	if _, err := io.Copy(&read, tr); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if !bytes.Equal(read.Bytes(), content) {
+		t.Fatalf("sparse file content doesn't match")
+	}
+
+	hdr, err = tr.Next()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if hdr.Name != "etc/" {
+		t.Fatalf("entry after sparse file is wrong: %v", hdr)
+	}
+}
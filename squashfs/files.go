@@ -0,0 +1,270 @@
+package squashfs
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// FileList is the files of a rootfs that go in an incremental squashfs
+// layer: the ones that changed since the layer below, and overlayfs
+// whiteouts for the ones that were removed. Unlike ExcludePaths, a
+// directory that's in the list only brings itself, not what's in it, so a
+// change to one file in a large directory doesn't rewrite the directory.
+type FileList struct {
+	rootfs    string
+	paths     map[string]bool
+	whiteouts map[string]bool
+}
+
+func NewFileList(rootfs string) *FileList {
+	return &FileList{
+		rootfs:    rootfs,
+		paths:     map[string]bool{},
+		whiteouts: map[string]bool{},
+	}
+}
+
+// Add adds the file (or directory) p, relative to the rootfs, to the list.
+func (fl *FileList) Add(p string) {
+	fl.paths[path.Clean("/"+p)] = true
+}
+
+// AddWhiteout adds a whiteout for p, relative to the rootfs, which was
+// removed from it.
+func (fl *FileList) AddWhiteout(p string) {
+	fl.whiteouts[path.Clean("/"+p)] = true
+}
+
+// Len is how many files and whiteouts are in the list.
+func (fl *FileList) Len() int {
+	return len(fl.paths) + len(fl.whiteouts)
+}
+
+// stager builds a tree with just the files in a list, hardlinked to (or,
+// across filesystems, copied from) the rootfs.
+type stager struct {
+	rootfs string
+	stage  string
+
+	// dirs are the directories made so far, whose metadata is copied
+	// from the rootfs once what's in them is there.
+	dirs map[string]bool
+
+	// inodes are where the first file staged of each inode of the rootfs
+	// was staged, to keep hardlinks when files are copied.
+	inodes map[uint64]string
+}
+
+func (s *stager) dir(p string) error {
+	if p == "/" || s.dirs[p] {
+		return nil
+	}
+
+	if err := s.dir(path.Dir(p)); err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(path.Join(s.stage, p), 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	s.dirs[p] = true
+	return nil
+}
+
+func (s *stager) file(p string, fi os.FileInfo) error {
+	src := path.Join(s.rootfs, p)
+	dest := path.Join(s.stage, p)
+	ino := fi.Sys().(*syscall.Stat_t).Ino
+
+	if first, ok := s.inodes[ino]; ok {
+		return os.Link(first, dest)
+	}
+	s.inodes[ino] = dest
+
+	err := os.Link(src, dest)
+	if err == nil {
+		return nil
+	}
+
+	linkErr, ok := err.(*os.LinkError)
+	if !ok || linkErr.Err != unix.EXDEV {
+		return err
+	}
+
+	output, err := exec.Command("cp", "-a", "--reflink=auto", src, dest).CombinedOutput()
+	if err != nil {
+		return errors.Errorf("couldn't copy %s: %v: %s", p, err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+func (s *stager) whiteout(p string) error {
+	// when a whole directory was removed, its whiteout hides everything
+	// that was in it
+	parent, err := os.Lstat(path.Join(s.rootfs, path.Dir(p)))
+	if err != nil || !parent.IsDir() {
+		return nil
+	}
+
+	if err := s.dir(path.Dir(p)); err != nil {
+		return err
+	}
+
+	return unix.Mknod(path.Join(s.stage, p), unix.S_IFCHR, int(unix.Mkdev(0, 0)))
+}
+
+// copyDirMetadata makes the staged directory p like the one in the rootfs.
+func (s *stager) copyDirMetadata(p string) error {
+	src := path.Join(s.rootfs, p)
+	dest := path.Join(s.stage, p)
+
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	stat := fi.Sys().(*syscall.Stat_t)
+
+	if err := os.Lchown(dest, int(stat.Uid), int(stat.Gid)); err != nil {
+		return err
+	}
+
+	if err := unix.Chmod(dest, stat.Mode&07777); err != nil {
+		return errors.Wrapf(err, "couldn't chmod %s", dest)
+	}
+
+	if err := copyXattrs(src, dest); err != nil {
+		return err
+	}
+
+	atime := time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
+	return os.Chtimes(dest, atime, fi.ModTime())
+}
+
+func copyXattrs(src string, dest string) error {
+	sz, err := unix.Llistxattr(src, nil)
+	if err != nil || sz == 0 {
+		return nil
+	}
+
+	buf := make([]byte, sz)
+	sz, err = unix.Llistxattr(src, buf)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't list xattrs of %s", src)
+	}
+
+	for _, name := range strings.Split(string(buf[:sz]), "\x00") {
+		if name == "" {
+			continue
+		}
+
+		vsz, err := unix.Lgetxattr(src, name, nil)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't get xattr %s of %s", name, src)
+		}
+
+		value := make([]byte, vsz)
+		vsz, err = unix.Lgetxattr(src, name, value)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't get xattr %s of %s", name, src)
+		}
+
+		if err := unix.Lsetxattr(dest, name, value[:vsz], 0); err != nil {
+			return errors.Wrapf(err, "couldn't set xattr %s of %s", name, dest)
+		}
+	}
+
+	return nil
+}
+
+// Stage makes the directory stage (which mustn't exist, and has to be on the
+// same filesystem as the rootfs for the files to be hardlinked rather than
+// copied) a tree of just the files in the list, their parent directories and
+// the whiteouts.
+func (fl *FileList) Stage(stage string) error {
+	if err := os.Mkdir(stage, 0700); err != nil {
+		return err
+	}
+
+	s := &stager{rootfs: fl.rootfs, stage: stage, dirs: map[string]bool{"/": true}, inodes: map[uint64]string{}}
+
+	paths := []string{}
+	for p := range fl.paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		if p == "/" {
+			continue
+		}
+
+		fi, err := os.Lstat(path.Join(fl.rootfs, p))
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			err = s.dir(p)
+		} else if err = s.dir(path.Dir(p)); err == nil {
+			err = s.file(p, fi)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "couldn't stage %s", p)
+		}
+	}
+
+	whiteouts := []string{}
+	for p := range fl.whiteouts {
+		whiteouts = append(whiteouts, p)
+	}
+	sort.Strings(whiteouts)
+
+	for _, p := range whiteouts {
+		if err := s.whiteout(p); err != nil {
+			return errors.Wrapf(err, "couldn't stage whiteout for %s", p)
+		}
+	}
+
+	// making what's in them changed the directories' mtimes, so their
+	// metadata is copied last, deepest first
+	dirs := []string{}
+	for p := range s.dirs {
+		dirs = append(dirs, p)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i], "/") > strings.Count(dirs[j], "/")
+	})
+
+	for _, p := range dirs {
+		if err := s.copyDirMetadata(p); err != nil {
+			return errors.Wrapf(err, "couldn't stage %s", p)
+		}
+	}
+
+	return nil
+}
+
+// MakeSquashfsFiles generates a squashfs image of just the files in fl,
+// staged at stage (see Stage) first, with xattrs only if xattrs is true.
+// The tail ends of all the files are packed into shared fragments, since
+// the few files of an incremental layer would otherwise each take up a
+// whole block for theirs.
+func MakeSquashfsFiles(mksquashfs string, tempdir string, stage string, fl *FileList, xattrs bool) (io.ReadCloser, error) {
+	defer os.RemoveAll(stage)
+	if err := fl.Stage(stage); err != nil {
+		return nil, err
+	}
+
+	return makeSquashfs(mksquashfs, tempdir, stage, "", xattrs, "-always-use-fragments")
+}
@@ -0,0 +1,82 @@
+package squashfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func TestStage(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("making whiteouts needs root")
+	}
+
+	dir, err := ioutil.TempDir("", "stacker-stage-test")
+	if err != nil {
+		t.Fatalf("couldn't make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := path.Join(dir, "rootfs")
+	if err := os.MkdirAll(path.Join(rootfs, "a", "b"), 0755); err != nil {
+		t.Fatalf("couldn't make rootfs: %v", err)
+	}
+	if err := os.Chmod(path.Join(rootfs, "a"), 0710); err != nil {
+		t.Fatalf("couldn't chmod: %v", err)
+	}
+	for _, f := range []string{"a/changed", "a/same", "a/b/same"} {
+		if err := ioutil.WriteFile(path.Join(rootfs, f), []byte(f), 0644); err != nil {
+			t.Fatalf("couldn't write %s: %v", f, err)
+		}
+	}
+	if err := os.Link(path.Join(rootfs, "a/changed"), path.Join(rootfs, "a/b/link")); err != nil {
+		t.Fatalf("couldn't link: %v", err)
+	}
+
+	fl := NewFileList(rootfs)
+	fl.Add("a/changed")
+	fl.Add("/a/b/link")
+	fl.AddWhiteout("a/removed")
+	fl.AddWhiteout("gone/removed")
+
+	stage := path.Join(dir, "stage")
+	if err := fl.Stage(stage); err != nil {
+		t.Fatalf("couldn't stage: %v", err)
+	}
+
+	changed, err := os.Stat(path.Join(stage, "a/changed"))
+	if err != nil {
+		t.Fatalf("changed file wasn't staged: %v", err)
+	}
+	link, err := os.Stat(path.Join(stage, "a/b/link"))
+	if err != nil {
+		t.Fatalf("hardlink wasn't staged: %v", err)
+	}
+	if !os.SameFile(changed, link) {
+		t.Errorf("hardlinks aren't the same file in the stage")
+	}
+
+	for _, f := range []string{"a/same", "a/b/same", "gone"} {
+		if _, err := os.Lstat(path.Join(stage, f)); !os.IsNotExist(err) {
+			t.Errorf("%s was staged: %v", f, err)
+		}
+	}
+
+	removed, err := os.Lstat(path.Join(stage, "a/removed"))
+	if err != nil {
+		t.Fatalf("whiteout wasn't staged: %v", err)
+	}
+	if removed.Mode()&os.ModeCharDevice == 0 || removed.Sys().(*syscall.Stat_t).Rdev != 0 {
+		t.Errorf("whiteout isn't a 0/0 character device: %v", removed.Mode())
+	}
+
+	a, err := os.Stat(path.Join(stage, "a"))
+	if err != nil {
+		t.Fatalf("parent dir wasn't staged: %v", err)
+	}
+	if a.Mode().Perm() != 0710 {
+		t.Errorf("parent dir has mode %v", a.Mode().Perm())
+	}
+}
@@ -90,7 +90,9 @@ func (eps *ExcludePaths) String() (string, error) {
 	return buf.String(), nil
 }
 
-func MakeSquashfs(tempdir string, rootfs string, eps *ExcludePaths) (io.ReadCloser, error) {
+// MakeSquashfs generates a squashfs image of rootfs, without the paths in
+// eps, and with xattrs only if xattrs is true.
+func MakeSquashfs(mksquashfs string, tempdir string, rootfs string, eps *ExcludePaths, xattrs bool) (io.ReadCloser, error) {
 	var excludesFile string
 	var err error
 	var toExclude string
@@ -117,6 +119,13 @@ func MakeSquashfs(tempdir string, rootfs string, eps *ExcludePaths) (io.ReadClos
 		}
 	}
 
+	return makeSquashfs(mksquashfs, tempdir, rootfs, excludesFile, xattrs)
+}
+
+// makeSquashfs generates a squashfs image of dir in tempdir, without the
+// paths in excludesFile if there is one, and opens it; it's deleted once it's
+// closed.
+func makeSquashfs(mksquashfs string, tempdir string, dir string, excludesFile string, xattrs bool, extraArgs ...string) (io.ReadCloser, error) {
 	tmpSquashfs, err := ioutil.TempFile(tempdir, "stacker-squashfs-img-")
 	if err != nil {
 		return nil, err
@@ -124,11 +133,17 @@ func MakeSquashfs(tempdir string, rootfs string, eps *ExcludePaths) (io.ReadClos
 	tmpSquashfs.Close()
 	os.Remove(tmpSquashfs.Name())
 	defer os.Remove(tmpSquashfs.Name())
-	args := []string{rootfs, tmpSquashfs.Name()}
-	if len(toExclude) != 0 {
+	// mksquashfs stores all-zero blocks as holes by default (unless it is
+	// given -no-sparse), so sparse files stay sparse in squashfs layers.
+	args := []string{dir, tmpSquashfs.Name()}
+	if excludesFile != "" {
 		args = append(args, "-ef", excludesFile)
 	}
-	cmd := exec.Command("mksquashfs", args...)
+	if !xattrs {
+		args = append(args, "-no-xattrs")
+	}
+	args = append(args, extraArgs...)
+	cmd := exec.Command(mksquashfs, args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err = cmd.Run(); err != nil {
@@ -0,0 +1,676 @@
+package stacker
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Stacker is the entry point for using stacker as a library. Build it with
+// New() and the With* options; the zero value of every option is the same as
+// the default of the corresponding stacker command line flag.
+type Stacker struct {
+	args   BuildArgs
+	output io.Writer
+
+	// configOpts are the options that change the config, applied after
+	// all the others so they can come before WithConfig.
+	configOpts []func(*StackerConfig)
+}
+
+// Option configures a Stacker.
+type Option func(*Stacker) error
+
+// New returns a Stacker configured with opts. WithConfig is required, since
+// there's no sensible default for where stacker keeps its state.
+func New(opts ...Option) (*Stacker, error) {
+	s := &Stacker{
+		args: BuildArgs{
+			LayerType:     "tar",
+			WebhookFormat: WebhookFormatJSON,
+		},
+	}
+
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, opt := range s.configOpts {
+		opt(&s.args.Config)
+	}
+
+	config := s.args.Config
+	if config.StackerDir == "" || config.OCIDir == "" || config.RootFSDir == "" {
+		return nil, fmt.Errorf("stacker dir, oci dir and rootfs dir are all required")
+	}
+
+	return s, nil
+}
+
+// WithConfig sets where stacker keeps its cache, its output, and the
+// filesystems it builds in.
+func WithConfig(config StackerConfig) Option {
+	return func(s *Stacker) error {
+		s.args.Config = config
+		if config.LayerType != "" {
+			s.args.LayerType = config.LayerType
+		}
+		return nil
+	}
+}
+
+// WithLayerType sets the type of layers that are generated, either "tar" or
+// "squashfs".
+func WithLayerType(layerType string) Option {
+	return func(s *Stacker) error {
+		switch layerType {
+		case "tar", "squashfs":
+			s.args.LayerType = layerType
+			return nil
+		default:
+			return fmt.Errorf("unknown layer type: %s", layerType)
+		}
+	}
+}
+
+// WithStorageType sets the kind of storage the rootfses of layers are kept
+// in: "btrfs" (the default), "zfs", "lvm" or "dir", see
+// StackerConfig.StorageType.
+func WithStorageType(storageType string) Option {
+	return func(s *Stacker) error {
+		switch storageType {
+		case "btrfs", "zfs", "lvm", "dir":
+		default:
+			return fmt.Errorf("unknown storage type: %s", storageType)
+		}
+
+		s.configOpts = append(s.configOpts, func(c *StackerConfig) {
+			c.StorageType = storageType
+		})
+		return nil
+	}
+}
+
+// WithZFSDataset keeps the rootfses of layers in datasets under dataset,
+// e.g. "tank/stacker".
+func WithZFSDataset(dataset string) Option {
+	return func(s *Stacker) error {
+		s.configOpts = append(s.configOpts, func(c *StackerConfig) {
+			c.StorageType = "zfs"
+			c.ZFSDataset = dataset
+		})
+		return nil
+	}
+}
+
+// WithLVMThinPool keeps the rootfses of layers in thin volumes of pool in
+// volumeGroup, each size big (or the default of 100GB, if it's empty).
+func WithLVMThinPool(volumeGroup string, pool string, size string) Option {
+	return func(s *Stacker) error {
+		s.configOpts = append(s.configOpts, func(c *StackerConfig) {
+			c.StorageType = "lvm"
+			c.LVMVolumeGroup = volumeGroup
+			c.LVMThinPool = pool
+			c.LVMVolumeSize = size
+		})
+		return nil
+	}
+}
+
+// WithBaseImageCache caches the images imported from registries in the OCI
+// layout dir, see StackerConfig.BaseImageCacheDir.
+func WithBaseImageCache(dir string) Option {
+	return func(s *Stacker) error {
+		s.configOpts = append(s.configOpts, func(c *StackerConfig) {
+			c.BaseImageCacheDir = dir
+		})
+		return nil
+	}
+}
+
+// WithSharedBlobDir stores the blobs of the output in the content addressed
+// store dir too, see StackerConfig.SharedBlobDir.
+func WithSharedBlobDir(dir string) Option {
+	return func(s *Stacker) error {
+		s.configOpts = append(s.configOpts, func(c *StackerConfig) {
+			c.SharedBlobDir = dir
+		})
+		return nil
+	}
+}
+
+// WithNoCache throws away the build cache before each build.
+func WithNoCache() Option {
+	return func(s *Stacker) error {
+		s.args.NoCache = true
+		return nil
+	}
+}
+
+// WithSubstitutions adds FOO=bar style substitutions for stackerfiles.
+func WithSubstitutions(substitutions ...string) Option {
+	return func(s *Stacker) error {
+		s.args.Substitute = append(s.args.Substitute, substitutions...)
+		return nil
+	}
+}
+
+// WithSubstitutionFiles adds the substitutions in yaml files, see
+// SubstitutionsFromFile. These are re-read for every build.
+func WithSubstitutionFiles(paths ...string) Option {
+	return func(s *Stacker) error {
+		s.args.SubstituteFiles = append(s.args.SubstituteFiles, paths...)
+		return nil
+	}
+}
+
+// WithSubstitutionsFromEnv uses environment variables named prefix + NAME as
+// substitutions for NAME.
+func WithSubstitutionsFromEnv(prefix string) Option {
+	return func(s *Stacker) error {
+		s.args.SubstituteEnvPrefix = prefix
+		return nil
+	}
+}
+
+// WithTemplate renders stackerfiles as go templates, with the environment
+// variables in env visible to the template.
+func WithTemplate(env ...string) Option {
+	return func(s *Stacker) error {
+		s.args.Template = true
+		s.args.TemplateEnv = append(s.args.TemplateEnv, env...)
+		return nil
+	}
+}
+
+// WithRegistryCredentials sets the credentials to use when pulling from or
+// pushing to the docker registry at host.
+func WithRegistryCredentials(host string, creds RegistryCredentials) Option {
+	return func(s *Stacker) error {
+		if s.args.RegistryAuth == nil {
+			s.args.RegistryAuth = RegistryAuth{}
+		}
+		s.args.RegistryAuth[host] = creds
+		return nil
+	}
+}
+
+// WithRemoteSaveTags sets the tags used when saving layers to a stackerfile's
+// save_url.
+func WithRemoteSaveTags(tags ...string) Option {
+	return func(s *Stacker) error {
+		s.args.RemoteSaveTags = append(s.args.RemoteSaveTags, tags...)
+		return nil
+	}
+}
+
+// WithHooks sets hooks that are run for every layer, in addition to the
+// layer's own hooks.
+func WithHooks(hooks Hooks) Option {
+	return func(s *Stacker) error {
+		s.args.Hooks = hooks
+		return nil
+	}
+}
+
+// WithWebhooks POSTs a summary of each stackerfile's build to urls in the
+// given format (WebhookFormatJSON or WebhookFormatSlack).
+func WithWebhooks(format string, urls ...string) Option {
+	return func(s *Stacker) error {
+		switch format {
+		case WebhookFormatJSON, WebhookFormatSlack:
+			s.args.WebhookFormat = format
+			s.args.Webhooks = append(s.args.Webhooks, urls...)
+			return nil
+		default:
+			return fmt.Errorf("unknown webhook format: %s", format)
+		}
+	}
+}
+
+// WithSquash squashes every image that is built into a single layer.
+func WithSquash() Option {
+	return func(s *Stacker) error {
+		s.args.Squash = true
+		return nil
+	}
+}
+
+// WithMaxLayerSize splits the tar layers that are generated into several
+// layers of at most bytes each (before compression).
+func WithMaxLayerSize(bytes int64) Option {
+	return func(s *Stacker) error {
+		s.args.MaxLayerSize = bytes
+		return nil
+	}
+}
+
+// WithXattrNamespaces keeps only the xattrs in the given namespaces (e.g.
+// "security", "user.*" or "system.posix_acl") in the layers that are
+// generated and in unpacked base images. "none" keeps no xattrs at all.
+func WithXattrNamespaces(namespaces ...string) Option {
+	return func(s *Stacker) error {
+		if _, err := parseXattrNamespaces(namespaces); err != nil {
+			return err
+		}
+		s.args.Xattrs = namespaces
+		return nil
+	}
+}
+
+// WithLayerVerification unpacks each layer after it is generated and checks
+// that it has exactly what the rootfs it was generated from has; builds whose
+// layers don't fail with ErrLayerMismatch.
+func WithLayerVerification() Option {
+	return func(s *Stacker) error {
+		s.args.VerifyLayers = true
+		return nil
+	}
+}
+
+// WithPlatform builds layers for platform (os/arch[/variant]), unless they
+// say otherwise, instead of for the host.
+func WithPlatform(platform string) Option {
+	return func(s *Stacker) error {
+		if _, err := ParsePlatform(platform); err != nil {
+			return err
+		}
+		s.args.Platform = platform
+		return nil
+	}
+}
+
+// WithWait waits for other builds in the same OCI dir to be done, instead of
+// failing with ErrBuildInProgress.
+func WithWait() Option {
+	return func(s *Stacker) error {
+		s.args.WaitForOCIDir = true
+		return nil
+	}
+}
+
+// WithUntrustedStackerfiles refuses stackerfiles that use the host, see
+// BuildArgs.Untrusted.
+func WithUntrustedStackerfiles() Option {
+	return func(s *Stacker) error {
+		s.args.Untrusted = true
+		return nil
+	}
+}
+
+// WithoutAutoClean doesn't clean up the mounts, working containers and
+// temporary files that builds which crashed left behind before building.
+func WithoutAutoClean() Option {
+	return func(s *Stacker) error {
+		s.args.NoAutoClean = true
+		return nil
+	}
+}
+
+// WithoutSpaceCheck doesn't check that there's enough free space for each
+// layer before building it.
+func WithoutSpaceCheck() Option {
+	return func(s *Stacker) error {
+		s.args.NoSpaceCheck = true
+		return nil
+	}
+}
+
+// WithSquashfsChunks also makes each squashfs layer that's built into an image
+// of content-defined chunks of it, named after the layer with -chunked
+// added, which is saved to the layer's save_url too; see ChunkImage.
+func WithSquashfsChunks() Option {
+	return func(s *Stacker) error {
+		s.args.ChunkSquashfs = true
+		return nil
+	}
+}
+
+// WithLayerSizeReport shows the n biggest files each layer adds or changes,
+// and the directories they add up to the most in, and records them in the
+// build report.
+func WithLayerSizeReport(n int) Option {
+	return func(s *Stacker) error {
+		s.args.LayerSizeReport = n
+		return nil
+	}
+}
+
+// WithScanner scans built layers for vulnerabilities with the scanner name
+// (see RegisterScanner), failing the build if it finds any of severity
+// failOn or worse, unless failOn is "".
+func WithScanner(name string, failOn string) Option {
+	return func(s *Stacker) error {
+		if _, ok := lookupScanner(name); !ok {
+			return fmt.Errorf("unknown scanner %s", name)
+		}
+		if failOn != "" {
+			if err := checkSeverity(failOn); err != nil {
+				return err
+			}
+		}
+		s.args.Scanner = name
+		s.args.ScanFailOn = failOn
+		return nil
+	}
+}
+
+// WithPolicies checks every built image against the rego policies in paths,
+// as well as the config's, see PolicyQuery.
+func WithPolicies(paths ...string) Option {
+	return func(s *Stacker) error {
+		s.args.Policies = append(s.args.Policies, paths...)
+		return nil
+	}
+}
+
+// WithCacheSalt makes salt part of every layer's cache key, instead of the
+// config's cache_salt, so that changing it invalidates all cached layers.
+func WithCacheSalt(salt string) Option {
+	return func(s *Stacker) error {
+		s.args.CacheSalt = salt
+		return nil
+	}
+}
+
+// WithSecrets gives the build secrets for layers to use, as NAME, whose value
+// is the NAME environment variable, or NAME=FILE.
+func WithSecrets(secrets ...string) Option {
+	return func(s *Stacker) error {
+		s.args.Secrets = append(s.args.Secrets, secrets...)
+		return nil
+	}
+}
+
+// WithArtifactsDir exports layers' artifacts to dir, instead of to artifacts
+// in the current directory.
+func WithArtifactsDir(dir string) Option {
+	return func(s *Stacker) error {
+		s.args.ArtifactsDir = dir
+		return nil
+	}
+}
+
+// WithReadOnlyCache uses the build cache without adding the layers that are
+// built to it, or removing anything from the stacker dir or OCI output other
+// than by retagging the layers.
+func WithReadOnlyCache() Option {
+	return func(s *Stacker) error {
+		s.args.ReadOnlyCache = true
+		return nil
+	}
+}
+
+// WithCacheNamespace uses (and adds to) the namespace ns in the build cache,
+// e.g. a branch's name, so that builds in other namespaces don't replace its
+// entries, falling back to the ones in the namespaces readFrom, in order.
+func WithCacheNamespace(ns string, readFrom ...string) Option {
+	return func(s *Stacker) error {
+		s.args.CacheNamespace = ns
+		s.args.CacheReadFrom = readFrom
+		return nil
+	}
+}
+
+// WithBundleDir also unpacks each image that is built into an OCI runtime
+// bundle in dir/<layer>, which runc and the like can run as it is, replacing
+// the one from its last build.
+func WithBundleDir(dir string) Option {
+	return func(s *Stacker) error {
+		s.args.BundleDir = dir
+		return nil
+	}
+}
+
+// WithArtifactPush also saves each layer's artifacts to its stackerfile's
+// save_url, as an OCI artifact named after the layer with -artifacts added.
+func WithArtifactPush() Option {
+	return func(s *Stacker) error {
+		s.args.PushArtifacts = true
+		return nil
+	}
+}
+
+// WithoutStackerAnnotations doesn't record the git version or the
+// stackerfile in the annotations of the images that are built.
+func WithoutStackerAnnotations() Option {
+	return func(s *Stacker) error {
+		s.args.NoStackerAnnotations = true
+		return nil
+	}
+}
+
+// WithRedactedSubstitutions records the stackerfile in image annotations as
+// it was written, rather than with the values of its substitutions.
+func WithRedactedSubstitutions() Option {
+	return func(s *Stacker) error {
+		s.args.RedactSubstitutions = true
+		return nil
+	}
+}
+
+// WithAnnotationPrefix uses prefix instead of DefaultAnnotationPrefix for the
+// keys of the annotations stacker records.
+func WithAnnotationPrefix(prefix string) Option {
+	return func(s *Stacker) error {
+		s.args.AnnotationPrefix = prefix
+		return nil
+	}
+}
+
+// WithOutput sends the human readable build output (including the output of
+// the commands run in the container) to w, one Write per line, instead of to
+// stdout.
+func WithOutput(w io.Writer) Option {
+	return func(s *Stacker) error {
+		s.output = w
+		return nil
+	}
+}
+
+// WithEventHandler calls h with each event of the builds, see
+// Builder.OnEvent.
+func WithEventHandler(h EventHandler) Option {
+	return func(s *Stacker) error {
+		s.args.eventHandlers = append(s.args.eventHandlers, h)
+		return nil
+	}
+}
+
+// WithOutputLevel sets how much stacker prints: QuietOutput, NormalOutput
+// or VerboseOutput. Note that this is for the whole process, not just this
+// Stacker.
+func WithOutputLevel(level int) Option {
+	return func(s *Stacker) error {
+		if level < QuietOutput || level > VerboseOutput {
+			return fmt.Errorf("invalid output level %d", level)
+		}
+		SetOutputLevel(level)
+		return nil
+	}
+}
+
+// WithDebug makes stacker more verbose about what it's doing.
+func WithDebug() Option {
+	return func(s *Stacker) error {
+		s.args.Debug = true
+		return nil
+	}
+}
+
+// buildArgs returns a copy of the Stacker's build args, with the output of
+// what it does going to the Stacker's writer, if it has one; the returned
+// function writes out the rest of that output.
+func (s *Stacker) buildArgs() (BuildArgs, func()) {
+	args := s.args
+	if s.output == nil {
+		return args, func() {}
+	}
+
+	lw := &lineWriter{w: s.output}
+	args.Config.output = lw
+	return args, lw.flush
+}
+
+// Build builds the stackerfiles at paths (and any of their prerequisites),
+// returning a report of what was built. If ctx is cancelled, the build stops
+// before the next layer (or phase of one) with ErrInterrupted.
+func (s *Stacker) Build(ctx context.Context, paths ...string) (*BuildReport, error) {
+	args, flush := s.buildArgs()
+	defer flush()
+
+	b := NewBuilder(&args)
+	b.ctx = ctx
+
+	err := b.BuildMultiple(paths)
+	return b.Report(), err
+}
+
+// BuildReader builds the stackerfile read from r, see
+// NewStackerfileFromReader; name is what it is called in the output and the
+// report. Any prerequisites it has must already have been built.
+func (s *Stacker) BuildReader(ctx context.Context, name string, r io.Reader, workingDir string) (*BuildReport, error) {
+	args, flush := s.buildArgs()
+	defer flush()
+
+	b := NewBuilder(&args)
+	b.ctx = ctx
+
+	err := b.BuildReader(name, r, workingDir)
+	return b.Report(), err
+}
+
+// Inspect returns the details of the image tag in the OCI output.
+func (s *Stacker) Inspect(tag string) (*ImageInspection, error) {
+	return Inspect(s.args.Config, tag)
+}
+
+// Diff returns the differences between the images tagA and tagB.
+func (s *Stacker) Diff(tagA string, tagB string) (*ImageDiff, error) {
+	storage, err := NewStorage(s.args.Config)
+	if err != nil {
+		return nil, err
+	}
+	defer storage.Detach()
+
+	return Diff(s.args.Config, tagA, tagB)
+}
+
+// Reproduce rebuilds the stackerfile at path from scratch, and compares its
+// images with the ones that were built before, see Reproduce. If ctx is
+// cancelled, the rebuild stops before the next layer.
+func (s *Stacker) Reproduce(ctx context.Context, path string, against string, tag string) (*ReproductionReport, error) {
+	args, flush := s.buildArgs()
+	defer flush()
+
+	return reproduce(ctx, args, path, against, tag)
+}
+
+// Check validates stacker's local state, removing what's broken if fix is
+// set, see Check.
+func (s *Stacker) Check(fix bool) (*CheckReport, error) {
+	return Check(s.args.Config, fix)
+}
+
+// ExportSnapshot writes the snapshot name to w, see ExportSnapshot.
+func (s *Stacker) ExportSnapshot(name string, parent string, w io.Writer) error {
+	return ExportSnapshot(s.args.Config, name, parent, w)
+}
+
+// ImportSnapshot makes the snapshot name out of r, see ImportSnapshot.
+func (s *Stacker) ImportSnapshot(name string, r io.Reader) error {
+	return ImportSnapshot(s.args.Config, name, r)
+}
+
+// GrabFiles copies paths out of the image tag into dest, see GrabFiles.
+func (s *Stacker) GrabFiles(tag string, paths []string, dest string) error {
+	return GrabFiles(s.args.Config, tag, paths, dest)
+}
+
+// Unpack checks out the image tag into dest, see Unpack.
+func (s *Stacker) Unpack(tag string, dest string, opts UnpackOpts) error {
+	return Unpack(s.args.Config, tag, dest, opts)
+}
+
+// Mount mounts the image tag at mountpoint, see Mount.
+func (s *Stacker) Mount(tag string, mountpoint string) error {
+	return Mount(s.args.Config, tag, mountpoint)
+}
+
+// Unmount unmounts the image mounted at mountpoint, see Unmount.
+func (s *Stacker) Unmount(mountpoint string) error {
+	return Unmount(s.args.Config, mountpoint)
+}
+
+// MakeDelta makes a delta artifact from one image to another, see MakeDelta.
+func (s *Stacker) MakeDelta(from string, to string, deltaTag string) error {
+	return MakeDelta(s.args.Config, from, to, deltaTag)
+}
+
+// ApplyDelta makes the image a delta artifact is to, see ApplyDelta.
+func (s *Stacker) ApplyDelta(deltaTag string, tag string) error {
+	return ApplyDelta(s.args.Config, deltaTag, tag)
+}
+
+// ChunkImage makes an image into one of content-defined chunks of its
+// layers, see ChunkImage.
+func (s *Stacker) ChunkImage(tag string, chunkedTag string) error {
+	return ChunkImage(s.args.Config, tag, chunkedTag)
+}
+
+// UnchunkImage makes a chunked image into the image it was made from, see
+// UnchunkImage.
+func (s *Stacker) UnchunkImage(chunkedTag string, tag string) error {
+	return UnchunkImage(s.args.Config, chunkedTag, tag)
+}
+
+// LastBuild returns how the layer tag was last built, see GetLastBuild.
+func (s *Stacker) LastBuild(tag string) (*LastBuild, error) {
+	return GetLastBuild(s.args.Config, tag)
+}
+
+// BuildRemote builds the stackerfiles at paths on another host, see
+// RemoteBuild.
+func (s *Stacker) BuildRemote(remote RemoteBuildOpts, paths ...string) error {
+	args, flush := s.buildArgs()
+	defer flush()
+
+	return RemoteBuild(&args, paths, remote)
+}
+
+// Compose builds the layers of the compose file file and runs them together,
+// see Compose.
+func (s *Stacker) Compose(ctx context.Context, file string) error {
+	args, flush := s.buildArgs()
+	defer flush()
+
+	return Compose(ctx, &args, file)
+}
+
+// CacheStats returns what's in the build cache and how it has been doing,
+// see CacheStats.
+func (s *Stacker) CacheStats() (*BuildCacheStats, error) {
+	return CacheStats(s.args.Config)
+}
+
+// Retag tags the image src in the output as dst too, see Retag.
+func (s *Stacker) Retag(src string, dst string) error {
+	return Retag(s.args.Config, src, dst)
+}
+
+// Promote copies the image tag to destURL as it is, see Promote.
+func (s *Stacker) Promote(tag string, destURL string) (digest.Digest, error) {
+	args, flush := s.buildArgs()
+	defer flush()
+
+	return Promote(&args, tag, destURL)
+}
+
+// GC removes anything stacker has stored that is no longer used.
+func (s *Stacker) GC() error {
+	return GC(s.args.Config)
+}
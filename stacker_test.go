@@ -0,0 +1,29 @@
+package stacker
+
+import (
+	"testing"
+)
+
+func TestStorageOptions(t *testing.T) {
+	// the storage options can come before the config they change
+	s, err := New(
+		WithZFSDataset("tank/stacker"),
+		WithConfig(StackerConfig{
+			StackerDir: "/stacker",
+			OCIDir:     "/oci",
+			RootFSDir:  "/roots",
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := s.args.Config
+	if config.StorageType != "zfs" || config.ZFSDataset != "tank/stacker" || config.RootFSDir != "/roots" {
+		t.Errorf("bad config %#v", config)
+	}
+
+	if _, err := New(WithStorageType("overlay")); err == nil {
+		t.Errorf("unknown storage type was accepted")
+	}
+}
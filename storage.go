@@ -15,6 +15,7 @@ import (
 
 	"github.com/freddierice/go-losetup"
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 )
 
 type Storage interface {
@@ -27,7 +28,59 @@ type Storage interface {
 	Exists(thing string) bool
 }
 
+// MountingStorage is a Storage that mounts each of its containers at its path
+// in RootFSDir itself, rather than them being directories of one filesystem
+// mounted at RootFSDir.
+type MountingStorage interface {
+	Storage
+
+	// Mountpoints are where the storage has mounted its containers.
+	Mountpoints() ([]string, error)
+}
+
 func NewStorage(c StackerConfig) (Storage, error) {
+	switch c.StorageType {
+	case "", "btrfs", "zfs", "dir", "lvm":
+		break
+	default:
+		return nil, errors.Errorf("unknown storage type: %s", c.StorageType)
+	}
+
+	// other stackers (including our own internal subcommands) may be
+	// using the same storage: setting it up is serialized, and everyone
+	// using it holds a shared lock, so that only the last one tears it
+	// down.
+	setup, err := lockFile(c, "storage-setup", unix.LOCK_EX, true)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't lock storage")
+	}
+	defer setup.Unlock()
+
+	lock, err := lockFile(c, "storage", unix.LOCK_SH, true)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't lock storage")
+	}
+
+	var s Storage
+	switch c.StorageType {
+	case "zfs":
+		s, err = newZFS(c, lock)
+	case "dir":
+		s, err = newDirStorage(c, lock)
+	case "lvm":
+		s, err = newLVM(c, lock)
+	default:
+		s, err = newBtrfs(c, lock)
+	}
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func newBtrfs(c StackerConfig, lock *Lock) (Storage, error) {
 	fs := syscall.Statfs_t{}
 
 	if err := os.MkdirAll(c.RootFSDir, 0755); err != nil {
@@ -66,12 +119,17 @@ func NewStorage(c StackerConfig) (Storage, error) {
 
 	}
 
-	return &btrfs{c: c, needsUmount: !isBtrfs}, nil
+	return &btrfs{c: c, needsUmount: !isBtrfs, lock: lock}, nil
 }
 
 type btrfs struct {
 	c           StackerConfig
 	needsUmount bool
+	lock        *Lock
+
+	// quotaEnabled is whether quotas have been turned on for the
+	// filesystem, see SetQuota.
+	quotaEnabled bool
 }
 
 func (b *btrfs) Name() string {
@@ -248,7 +306,11 @@ func (b *btrfs) Delete(source string) error {
 }
 
 func (b *btrfs) Detach() error {
-	if b.needsUmount {
+	defer b.lock.Unlock()
+
+	// if other stackers are still using the filesystem, they need it to
+	// stay mounted
+	if b.needsUmount && b.lock.relock(unix.LOCK_EX) == nil {
 		err := syscall.Unmount(b.c.RootFSDir, syscall.MNT_DETACH)
 		err2 := os.RemoveAll(b.c.RootFSDir)
 		if err != nil {
@@ -369,6 +431,18 @@ func haveRsync() error {
 }
 
 func CleanRoots(config StackerConfig) {
+	switch config.StorageType {
+	case "zfs":
+		cleanZFS(config)
+		return
+	case "lvm":
+		cleanLVM(config)
+		return
+	case "dir":
+		// the directories are removed with the rest of RootFSDir
+		return
+	}
+
 	btrfsSubVolumesDelete(config.RootFSDir)
 	syscall.Unmount(config.RootFSDir, syscall.MNT_DETACH)
 }
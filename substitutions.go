@@ -0,0 +1,70 @@
+package stacker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// SubstitutionsFromFile reads KEY=VALUE substitutions from a yaml file that
+// is a map of substitution names to their values, e.g.:
+//
+//	VERSION: 1.0
+//	PRODUCT: foo
+//
+// The substitutions are returned in the order they appear in the file.
+func SubstitutionsFromFile(path string) ([]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read substitute file")
+	}
+
+	// The MapSlice is for the order, and the map of strings is for the
+	// values as they were written, so that e.g. 1.0 isn't turned into 1.
+	ms := yaml.MapSlice{}
+	if err := yaml.Unmarshal(content, &ms); err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse substitute file %s", path)
+	}
+
+	values := map[string]string{}
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return nil, errors.Wrapf(err, "substitute file %s must only have single values", path)
+	}
+
+	substitutions := []string{}
+	for _, item := range ms {
+		key, ok := item.Key.(string)
+		if !ok {
+			return nil, fmt.Errorf("substitute file %s: bad key %v", path, item.Key)
+		}
+
+		substitutions = append(substitutions, fmt.Sprintf("%s=%s", key, values[key]))
+	}
+
+	return substitutions, nil
+}
+
+// SubstitutionsFromEnv returns a KEY=VALUE substitution for every environment
+// variable named prefix + KEY, e.g. with a prefix of STACKER_SUB_,
+// STACKER_SUB_FOO=bar becomes FOO=bar.
+func SubstitutionsFromEnv(prefix string) []string {
+	substitutions := []string{}
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, prefix) {
+			continue
+		}
+
+		sub := strings.TrimPrefix(env, prefix)
+		if strings.HasPrefix(sub, "=") {
+			continue
+		}
+
+		substitutions = append(substitutions, sub)
+	}
+
+	return substitutions
+}
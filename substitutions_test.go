@@ -0,0 +1,53 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSubstitutionsFromFile(t *testing.T) {
+	tf, err := ioutil.TempFile("", "stacker_subs_")
+	if err != nil {
+		t.Fatalf("couldn't create tempfile: %s", err)
+	}
+	defer tf.Close()
+	defer os.Remove(tf.Name())
+
+	_, err = tf.WriteString("VERSION: 1.0\nPRODUCT: foo\nEMPTY:\n")
+	if err != nil {
+		t.Fatalf("couldn't write content: %s", err)
+	}
+
+	subs, err := SubstitutionsFromFile(tf.Name())
+	if err != nil {
+		t.Fatalf("couldn't read substitutions: %s", err)
+	}
+
+	expected := []string{"VERSION=1.0", "PRODUCT=foo", "EMPTY="}
+	if !reflect.DeepEqual(subs, expected) {
+		t.Errorf("bad substitutions %v, expected %v", subs, expected)
+	}
+
+	_, err = tf.WriteString("LIST: [1, 2]\n")
+	if err != nil {
+		t.Fatalf("couldn't write content: %s", err)
+	}
+
+	_, err = SubstitutionsFromFile(tf.Name())
+	if err == nil {
+		t.Errorf("read list as a substitution")
+	}
+}
+
+func TestSubstitutionsFromEnv(t *testing.T) {
+	os.Setenv("STACKER_TEST_SUB_FOO", "bar=baz")
+	defer os.Unsetenv("STACKER_TEST_SUB_FOO")
+
+	subs := SubstitutionsFromEnv("STACKER_TEST_SUB_")
+	expected := []string{"FOO=bar=baz"}
+	if !reflect.DeepEqual(subs, expected) {
+		t.Errorf("bad substitutions %v, expected %v", subs, expected)
+	}
+}
@@ -0,0 +1,273 @@
+package stacker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/cheggaaa/pb"
+	"github.com/containers/image/pkg/compression"
+	"github.com/pkg/errors"
+)
+
+var sha256Regex = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// zstdMagic starts zstd frames; containers/image's compression detection
+// doesn't know about zstd (yet), so tar's --zstd decompresses it.
+var zstdMagic = []byte{0x28, 0xB5, 0x2F, 0xFD}
+
+// baseType is the type of base is: a registered scheme's urls (see
+// RegisterScheme) are fetched and used as tar bases.
+func (is *ImageSource) baseType() string {
+	if _, ok := lookupScheme(is.Type); ok {
+		return TarType
+	}
+	return is.Type
+}
+
+// tarChecksum returns the sha256 the tar base should have, if it says,
+// as hex. Tars from http(s) urls must say.
+func (is *ImageSource) tarChecksum() (string, error) {
+	sum := strings.ToLower(strings.TrimPrefix(is.Sha256, "sha256:"))
+	if sum != "" && !sha256Regex.MatchString(sum) {
+		return "", fmt.Errorf("invalid sha256 for %s: %s", is.Url, is.Sha256)
+	}
+
+	if sum == "" && (strings.HasPrefix(is.Url, "http://") || strings.HasPrefix(is.Url, "https://")) {
+		return "", fmt.Errorf("tar base %s needs a sha256, since it's downloaded", is.Url)
+	}
+
+	return sum, nil
+}
+
+// openTarBase opens the tar base at u: http(s) urls are streamed rather than
+// downloaded to cacheDir first, with a copy kept in cacheDir as they are (see
+// cachingReader) that's used instead if it still has the sha256 checksum;
+// local files are read in place, and other schemes are fetched to cacheDir as
+// usual.
+func openTarBase(config StackerConfig, u string, cacheDir string, checksum string) (io.ReadCloser, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+
+	switch parsed.Scheme {
+	case "":
+		return os.Open(u)
+	case "http", "https":
+		cached := path.Join(cacheDir, path.Base(u))
+		if sum, err := hashFile(cached); err == nil {
+			if sum == "sha256:"+checksum {
+				verboseln(config, "using cached copy of", u)
+				return os.Open(cached)
+			}
+			os.Remove(cached)
+		}
+
+		infoln(config, "downloading", u)
+		resp, err := http.Get(u)
+		if err != nil {
+			return nil, newError(ErrDownloadFailed, err, "couldn't download %s", u)
+		}
+
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return nil, newError(ErrDownloadFailed, nil, "couldn't download %s: %s", u, resp.Status)
+		}
+
+		var body io.ReadCloser = resp.Body
+		out := progressOutput(config)
+		if out != nil && resp.ContentLength >= 0 {
+			bar := pb.New(int(resp.ContentLength)).SetUnits(pb.U_BYTES)
+			bar.Output = out
+			bar.ShowTimeLeft = true
+			bar.ShowSpeed = true
+			bar.Start()
+			body = progressReader{bar.NewProxyReader(resp.Body), bar, resp.Body}
+		}
+
+		tmp, err := ioutil.TempFile(cacheDir, path.Base(u)+".partial-")
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+
+		hash := sha256.New()
+		return &cachingReader{
+			Reader:   io.TeeReader(body, io.MultiWriter(tmp, hash)),
+			body:     body,
+			tmp:      tmp,
+			hash:     hash,
+			checksum: checksum,
+			cached:   cached,
+		}, nil
+	default:
+		fetched, err := acquireUrl(config, u, cacheDir)
+		if err != nil {
+			return nil, err
+		}
+		return os.Open(fetched)
+	}
+}
+
+// cachingReader reads a download, writing it to a temporary file in the
+// cache dir as it goes. The file becomes the cached copy when the reader is
+// closed, if all of the download was read and it has the sha256 it should;
+// otherwise it's removed.
+type cachingReader struct {
+	io.Reader
+	body     io.Closer
+	tmp      *os.File
+	hash     hash.Hash
+	checksum string
+	cached   string
+	eof      bool
+}
+
+func (c *cachingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	if err == io.EOF {
+		c.eof = true
+	}
+	return n, err
+}
+
+func (c *cachingReader) Close() error {
+	err := c.body.Close()
+	c.tmp.Close()
+
+	if c.eof && hex.EncodeToString(c.hash.Sum(nil)) == c.checksum {
+		if os.Rename(c.tmp.Name(), c.cached) == nil {
+			return err
+		}
+	}
+
+	os.Remove(c.tmp.Name())
+	return err
+}
+
+type progressReader struct {
+	io.Reader
+	bar  *pb.ProgressBar
+	body io.Closer
+}
+
+func (p progressReader) Close() error {
+	p.bar.Finish()
+	return p.body.Close()
+}
+
+// decompressTar returns the tar in r, decompressing it if it's gzip, bzip2 or
+// xz compressed, and the flags tar needs to decompress the rest itself.
+func decompressTar(r io.Reader) (io.ReadCloser, []string, error) {
+	decompressor, r, err := compression.DetectCompression(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if decompressor != nil {
+		uncompressed, err := decompressor(r)
+		return uncompressed, nil, err
+	}
+
+	magic := make([]byte, len(zstdMagic))
+	n, err := io.ReadFull(r, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, nil, err
+	}
+	r = io.MultiReader(bytes.NewReader(magic[:n]), r)
+
+	if bytes.Equal(magic[:n], zstdMagic) {
+		return ioutil.NopCloser(r), []string{"--zstd"}, nil
+	}
+
+	return ioutil.NopCloser(r), nil, nil
+}
+
+// extractTarBase extracts the (maybe compressed) tar at u into dest as it
+// reads it, and checks its sha256 if it's supposed to have one. Since that's
+// only known once all of it is read, dest is emptied again if it doesn't
+// match, or the extraction fails.
+func extractTarBase(config StackerConfig, is *ImageSource, cacheDir string, dest string) error {
+	err := extractTar(config, is, cacheDir, dest)
+	if err != nil {
+		if cleanErr := emptyDir(dest); cleanErr != nil {
+			warnf(config, "couldn't clean up %s: %v\n", dest, cleanErr)
+		}
+	}
+	return err
+}
+
+func extractTar(config StackerConfig, is *ImageSource, cacheDir string, dest string) error {
+	checksum, err := is.tarChecksum()
+	if err != nil {
+		return err
+	}
+
+	source, err := openTarBase(config, is.Url, cacheDir, checksum)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	hash := sha256.New()
+	tee := io.TeeReader(source, hash)
+
+	uncompressed, flags, err := decompressTar(tee)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read %s", is.Url)
+	}
+
+	// TODO: make this respect ID maps
+	args := append([]string{"-x", "-C", dest}, flags...)
+	cmd := exec.Command(config.ToolPath(ToolTar), append(args, "-f", "-")...)
+	cmd.Stdin = uncompressed
+	output, tarErr := cmd.CombinedOutput()
+	uncompressed.Close()
+
+	// tar stops at the end of the archive (or when it fails), so the hash
+	// may not have seen all of the file yet; a file that isn't what it
+	// should be is reported as that, rather than as whatever tar made of
+	// it
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return errors.Wrapf(err, "couldn't read %s", is.Url)
+	}
+
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if checksum != "" && actual != checksum {
+		return newError(ErrImportHashMismatch, nil, "%s has sha256 %s, not %s", path.Base(is.Url), actual, checksum)
+	}
+
+	if tarErr != nil {
+		return fmt.Errorf("error: %s: %s", tarErr, string(output))
+	}
+
+	return nil
+}
+
+// emptyDir removes everything in dir, but not dir itself.
+func emptyDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if err := os.RemoveAll(path.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package stacker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestTarChecksum(t *testing.T) {
+	sum := "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+
+	is := &ImageSource{Type: TarType, Url: "https://example.com/rootfs.tar.zst", Sha256: "sha256:" + sum}
+	checksum, err := is.tarChecksum()
+	if err != nil || checksum != sum {
+		t.Fatalf("bad checksum %s: %v", checksum, err)
+	}
+
+	is.Sha256 = ""
+	if _, err := is.tarChecksum(); err == nil {
+		t.Errorf("downloaded tar without a sha256 was accepted")
+	}
+
+	is.Sha256 = "abc"
+	if _, err := is.tarChecksum(); err == nil {
+		t.Errorf("bad sha256 was accepted")
+	}
+
+	is = &ImageSource{Type: TarType, Url: "/tmp/rootfs.tar"}
+	if checksum, err := is.tarChecksum(); err != nil || checksum != "" {
+		t.Errorf("local tar without a sha256 wasn't accepted: %s %v", checksum, err)
+	}
+}
+
+func TestDecompressTar(t *testing.T) {
+	content := []byte("not really a tar")
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write(content)
+	gz.Close()
+
+	r, flags, err := decompressTar(buf)
+	if err != nil {
+		t.Fatalf("couldn't decompress: %v", err)
+	}
+
+	uncompressed, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(uncompressed, content) || len(flags) != 0 {
+		t.Fatalf("bad gzip decompression: %s %v %v", string(uncompressed), flags, err)
+	}
+
+	zstd := append(append([]byte{}, zstdMagic...), content...)
+	r, flags, err = decompressTar(bytes.NewReader(zstd))
+	if err != nil {
+		t.Fatalf("couldn't decompress: %v", err)
+	}
+
+	passed, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(passed, zstd) || len(flags) != 1 || flags[0] != "--zstd" {
+		t.Fatalf("bad zstd handling: %v %v", flags, err)
+	}
+}
+
+func TestExtractTarBase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_tarbase_test")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "etc/os-release", Mode: 0644, Size: 4, Typeflag: tar.TypeReg})
+	tw.Write([]byte("ID=x"))
+	tw.Close()
+	gz.Close()
+
+	tarPath := path.Join(dir, "rootfs.tar.gz")
+	if err := ioutil.WriteFile(tarPath, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("couldn't write tar: %v", err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+
+	rootfs := path.Join(dir, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatalf("couldn't make rootfs: %v", err)
+	}
+
+	is := &ImageSource{Type: TarType, Url: tarPath, Sha256: hex.EncodeToString(sum[:])}
+	if err := extractTarBase(StackerConfig{}, is, dir, rootfs); err != nil {
+		t.Fatalf("couldn't extract: %v", err)
+	}
+
+	content, err := ioutil.ReadFile(path.Join(rootfs, "etc/os-release"))
+	if err != nil || string(content) != "ID=x" {
+		t.Fatalf("bad extracted file: %s %v", string(content), err)
+	}
+
+	is.Sha256 = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	err = extractTarBase(StackerConfig{}, is, dir, rootfs)
+	if errors.Cause(err) != ErrImportHashMismatch {
+		t.Fatalf("bad sha256 wasn't noticed: %v", err)
+	}
+
+	if entries, err := ioutil.ReadDir(rootfs); err != nil || len(entries) != 0 {
+		t.Fatalf("rootfs wasn't emptied after the mismatch: %v %v", entries, err)
+	}
+}
+
+func TestExtractTarBaseCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_tarbase_test")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "etc/os-release", Mode: 0644, Size: 4, Typeflag: tar.TypeReg})
+	tw.Write([]byte("ID=x"))
+	tw.Close()
+	sum := sha256.Sum256(buf.Bytes())
+
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	rootfs := path.Join(dir, "rootfs")
+	is := &ImageSource{Type: TarType, Url: server.URL + "/rootfs.tar", Sha256: hex.EncodeToString(sum[:])}
+	for i := 0; i < 2; i++ {
+		os.RemoveAll(rootfs)
+		if err := os.Mkdir(rootfs, 0755); err != nil {
+			t.Fatalf("couldn't make rootfs: %v", err)
+		}
+
+		if err := extractTarBase(StackerConfig{}, is, dir, rootfs); err != nil {
+			t.Fatalf("couldn't extract: %v", err)
+		}
+
+		content, err := ioutil.ReadFile(path.Join(rootfs, "etc/os-release"))
+		if err != nil || string(content) != "ID=x" {
+			t.Fatalf("bad extracted file: %s %v", string(content), err)
+		}
+	}
+
+	if downloads != 1 {
+		t.Fatalf("downloaded %d times, expected the cached copy to be used", downloads)
+	}
+
+	cached, err := ioutil.ReadFile(path.Join(dir, "rootfs.tar"))
+	if err != nil || !bytes.Equal(cached, buf.Bytes()) {
+		t.Fatalf("bad cached copy: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package stacker
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"text/template"
+)
+
+// StackerfileOpts controls how stackerfiles are read.
+type StackerfileOpts struct {
+	// Substitute is a list of KEY=VALUE substitutions, see
+	// NewStackerfile.
+	Substitute []string
+
+	// Template renders the stackerfile as a go text/template (after
+	// substitutions) before parsing it.
+	Template bool
+
+	// TemplateEnv is the list of environment variables that templates
+	// can see in .Env; the rest of the environment is hidden, so that
+	// builds don't accidentally depend on (or leak) it.
+	TemplateEnv []string
+
+	// GitCloneDir is where git repos that stackerfiles are read from
+	// (see parseGitStackerfileURL) are cloned to.
+	GitCloneDir string
+
+	// config is the config of the build reading them, for its output.
+	config StackerConfig
+}
+
+// templateData is what stackerfile templates are rendered with.
+type templateData struct {
+	// Sub is the substitutions, as a map
+	Sub map[string]string
+	// Env is the allow-listed environment variables
+	Env map[string]string
+	// OS and Arch are the host's GOOS and GOARCH
+	OS   string
+	Arch string
+	// GitCommit is the commit of the git repo containing the stackerfile,
+	// or empty if it's not in one.
+	GitCommit string
+}
+
+var templateFuncs = template.FuncMap{
+	"split":   strings.Split,
+	"join":    strings.Join,
+	"replace": strings.Replace,
+	"trim":    strings.TrimSpace,
+	"upper":   strings.ToUpper,
+	"lower":   strings.ToLower,
+	"default": func(def string, value string) string {
+		if value == "" {
+			return def
+		}
+		return value
+	},
+}
+
+func renderTemplate(name string, content string, opts StackerfileOpts, referenceDirectory string) (string, error) {
+	data := templateData{
+		Sub:  map[string]string{},
+		Env:  map[string]string{},
+		OS:   runtime.GOOS,
+		Arch: runtime.GOARCH,
+	}
+
+	for _, subst := range opts.Substitute {
+		membs := strings.SplitN(subst, "=", 2)
+		if len(membs) != 2 {
+			return "", fmt.Errorf("invalid substition %s", subst)
+		}
+		data.Sub[membs[0]] = membs[1]
+	}
+
+	for _, name := range opts.TemplateEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			data.Env[name] = value
+		}
+	}
+
+	// not being in a git repo is fine, it just means there is no commit
+	data.GitCommit, _ = gitHash(referenceDirectory, false)
+
+	// missingkey=error so that typos in substitution or env names fail
+	// the build instead of silently rendering as "<no value>"
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(content)
+	if err != nil {
+		return "", fmt.Errorf("stackerfile: bad template: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, data); err != nil {
+		return "", fmt.Errorf("stackerfile: couldn't render template: %v", err)
+	}
+
+	return buf.String(), nil
+}
@@ -0,0 +1,44 @@
+package stacker
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	os.Setenv("STACKER_TEST_ALLOWED", "allowed")
+	os.Setenv("STACKER_TEST_HIDDEN", "hidden")
+	defer os.Unsetenv("STACKER_TEST_ALLOWED")
+	defer os.Unsetenv("STACKER_TEST_HIDDEN")
+
+	content := `{{ range split .Sub.FLAVORS "," }}
+{{ . }}:
+    from:
+        type: docker
+        url: docker://{{ . }}:latest
+    run: echo {{ $.Env.STACKER_TEST_ALLOWED }} {{ index $.Env "STACKER_TEST_HIDDEN" | default "none" }}
+{{ end }}`
+
+	opts := StackerfileOpts{
+		Substitute:  []string{"FLAVORS=centos,ubuntu"},
+		Template:    true,
+		TemplateEnv: []string{"STACKER_TEST_ALLOWED"},
+	}
+
+	rendered, err := renderTemplate("test", content, opts, "/")
+	if err != nil {
+		t.Fatalf("couldn't render template: %v", err)
+	}
+
+	for _, expected := range []string{"docker://centos:latest", "docker://ubuntu:latest", "echo allowed none"} {
+		if !strings.Contains(rendered, expected) {
+			t.Errorf("%q not in rendered template:\n%s", expected, rendered)
+		}
+	}
+
+	_, err = renderTemplate("test", "{{ .Sub.MISSING }}", opts, "/")
+	if err == nil {
+		t.Errorf("rendered template with missing substitution")
+	}
+}
@@ -61,3 +61,15 @@ EOF
     stacker build
     [ "$status" -eq 0 ]
 }
+
+@test "cache metrics" {
+    cat > stacker.yaml <<EOF
+a:
+    from:
+        type: scratch
+EOF
+    stacker build --metrics-textfile
+    grep "^stacker_cache_misses_total 1$" .stacker/metrics/stacker.prom
+    stacker build --metrics-textfile
+    grep "^stacker_cache_hits_total 1$" .stacker/metrics/stacker.prom
+}
@@ -0,0 +1,30 @@
+load helpers
+
+function teardown() {
+    cleanup
+}
+
+@test "diff two built tags" {
+    cat > stacker.yaml <<EOF
+one:
+    from:
+        type: docker
+        url: docker://centos:latest
+    environment:
+        FOO: bar
+two:
+    from:
+        type: built
+        tag: one
+    run: |
+        rm /etc/centos-release
+        echo hello > /hello
+    environment:
+        FOO: baz
+EOF
+    stacker build
+    stacker diff --json one two
+    [ "$(echo "$output" | jq -r '.files[] | select(.path == "hello") | .type')" = "added" ]
+    [ "$(echo "$output" | jq -r '.files[] | select(.path == "etc/centos-release") | .type')" = "removed" ]
+    [ "$(echo "$output" | jq -r '.env.modified.FOO')" = "bar -> baz" ]
+}
@@ -29,3 +29,13 @@ function teardown() {
     umoci unpack --image oci:layer1 dest
     [ ! -f dest/rootfs/favicon.ico ]
 }
+
+@test "docker bases are only downloaded and unpacked once" {
+    stacker build
+    # --no-cache would throw away the base image cache too
+    rm .stacker/build.cache
+    stacker build | tee build.log
+    grep "in base image cache" build.log
+    grep "using unpacked" build.log
+    rm build.log
+}
@@ -0,0 +1,37 @@
+load helpers
+
+function teardown() {
+    cleanup
+    rm -f hook-output >& /dev/null || true
+}
+
+@test "hooks get layer info" {
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest
+    hooks:
+        pre_run:
+            - echo "\$STACKER_HOOK \$STACKER_LAYER_NAME" >> hook-output
+        post_build:
+            - echo "\$STACKER_HOOK \$STACKER_LAYER_DIGEST" >> hook-output
+EOF
+    stacker build --post-build-hook 'test -f $STACKER_ROOTFS/etc/centos-release'
+    grep "pre_run centos" hook-output
+    manifest=$(cat oci/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "centos") | .digest')
+    grep "post_build $manifest" hook-output
+}
+
+@test "failing hooks fail the build" {
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest
+    hooks:
+        pre_run:
+            - false
+EOF
+    bad_stacker build
+}
@@ -0,0 +1,20 @@
+load helpers
+
+function teardown() {
+    cleanup
+}
+
+@test "inspect json output" {
+    cat > stacker.yaml <<EOF
+empty:
+    from:
+        type: scratch
+    labels:
+        foo: bar
+EOF
+    stacker build
+    stacker inspect --json empty
+    echo "$output" | jq -r .tag | grep "^empty$"
+    [ "$(echo "$output" | jq -r '.config.config.Labels.foo')" = "bar" ]
+    [ "$(echo "$output" | jq -r '.layers | length')" -ge 1 ]
+}
@@ -0,0 +1,33 @@
+load helpers
+
+function teardown() {
+    cleanup
+}
+
+@test "layer tests pass" {
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: touch /built
+    test:
+        - test -f /built
+EOF
+    stacker build
+    [ "$(jq -r '.stackerfiles[0].layers[0].tests' .stacker/build-report.json)" = "passed" ]
+}
+
+@test "layer tests fail the build" {
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest
+    test:
+        - test -f /not-there
+EOF
+    bad_stacker build
+    echo "$output" | grep "tests for centos failed"
+    [ "$(jq -r '.stackerfiles[0].layers[0].tests' .stacker/build-report.json)" = "failed" ]
+}
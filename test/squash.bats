@@ -0,0 +1,41 @@
+load helpers
+
+function setup() {
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: |
+        touch /first
+squashed:
+    from:
+        type: built
+        tag: centos
+    run: |
+        touch /second
+        rm /first
+    squash: true
+EOF
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "squash makes a single layer image" {
+    stacker build
+    manifest=$(cat oci/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "squashed") | .digest' | cut -f2 -d:)
+    [ "$(cat oci/blobs/sha256/$manifest | jq -r '.layers | length')" == "1" ]
+
+    umoci unpack --image oci:squashed dest
+    [ -f dest/rootfs/second ]
+    [ ! -f dest/rootfs/first ]
+    [ -f dest/rootfs/bin/sh ]
+}
+
+@test "--squash squashes every layer" {
+    stacker build --squash
+    manifest=$(cat oci/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "centos") | .digest' | cut -f2 -d:)
+    [ "$(cat oci/blobs/sha256/$manifest | jq -r '.layers | length')" == "1" ]
+}
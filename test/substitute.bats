@@ -0,0 +1,43 @@
+load helpers
+
+function teardown() {
+    cleanup
+    rm -f vars.yaml >& /dev/null || true
+    unset STACKER_SUB_FROM_ENV
+}
+
+@test "substitutions from files and the environment" {
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: |
+        echo \${{FROM_FILE}} > /from-file
+        echo \${{FROM_ENV}} > /from-env
+        echo \${{OVERRIDDEN}} > /overridden
+EOF
+    cat > vars.yaml <<EOF
+FROM_FILE: file
+OVERRIDDEN: file
+EOF
+    export STACKER_SUB_FROM_ENV=env
+    stacker build --substitute-file vars.yaml --substitute-env-prefix STACKER_SUB_ --substitute OVERRIDDEN=cli
+    umoci unpack --image oci:centos dest
+    [ "$(cat dest/rootfs/from-file)" == "file" ]
+    [ "$(cat dest/rootfs/from-env)" == "env" ]
+    [ "$(cat dest/rootfs/overridden)" == "cli" ]
+}
+
+@test "missing required substitutions are all reported" {
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: |
+        echo \${{ONE:?the first one}} \${{TWO}}
+EOF
+    bad_stacker build
+    echo "$output" | grep "ONE (the first one), TWO"
+}
@@ -0,0 +1,93 @@
+package stacker
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// tmpfsMount is a tmpfs mounted over part of the rootfs while the layer's
+// commands run, so nothing written there ends up in the layer.
+type tmpfsMount struct {
+	dest string
+
+	// options are tmpfs' mount options, e.g. "size=4g,mode=1777"
+	options string
+}
+
+// ParseTmpfs parses the layer's tmpfs mounts, which look like
+// "/tmp:size=4g" or just "/var/tmp".
+func (l *Layer) ParseTmpfs() ([]tmpfsMount, error) {
+	mounts := []tmpfsMount{}
+	for _, entry := range l.Tmpfs {
+		parts := strings.SplitN(entry, ":", 2)
+		m := tmpfsMount{dest: parts[0]}
+		if len(parts) == 2 {
+			m.options = parts[1]
+		}
+
+		if !path.IsAbs(m.dest) || path.Clean(m.dest) == "/" {
+			return nil, errors.Errorf("invalid tmpfs mount %s: it must be an absolute path other than /", entry)
+		}
+		m.dest = path.Clean(m.dest)
+
+		mounts = append(mounts, m)
+	}
+
+	return mounts, nil
+}
+
+// firstMissing returns the outermost directory of p (which is in rootfs)
+// that doesn't exist yet, or "" if p exists.
+func firstMissing(rootfs string, p string) string {
+	missing := ""
+	for ; p != "/"; p = path.Dir(p) {
+		if _, err := os.Lstat(path.Join(rootfs, p)); err == nil {
+			break
+		}
+		missing = p
+	}
+
+	return missing
+}
+
+// removeCreated removes the directories of p down to created (see
+// firstMissing), innermost first. Any that aren't empty, because commands
+// put things in them, are left.
+func removeCreated(rootfs string, created string, p string) {
+	for p = path.Clean(p); ; p = path.Dir(p) {
+		os.Remove(path.Join(rootfs, p))
+		if p == created || p == "/" {
+			return
+		}
+	}
+}
+
+func (c *container) addTmpfs(m tmpfsMount) error {
+	options := "create=dir"
+	if m.options != "" {
+		options = m.options + "," + options
+	}
+
+	val := fmt.Sprintf("tmpfs %s tmpfs %s 0 0", strings.TrimPrefix(m.dest, "/"), options)
+	return c.setConfig("lxc.mount.entry", val)
+}
+
+func (c *ociContainer) addTmpfs(m tmpfsMount) error {
+	options := []string{"nosuid", "nodev"}
+	if m.options != "" {
+		options = append(options, strings.Split(m.options, ",")...)
+	}
+
+	c.spec.Mounts = append(c.spec.Mounts, rspec.Mount{
+		Destination: m.dest,
+		Type:        "tmpfs",
+		Source:      "tmpfs",
+		Options:     options,
+	})
+	return nil
+}
@@ -0,0 +1,67 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParseTmpfs(t *testing.T) {
+	l := &Layer{Tmpfs: []string{"/tmp:size=4g,mode=1777", "/var/tmp/"}}
+	mounts, err := l.ParseTmpfs()
+	if err != nil {
+		t.Fatalf("couldn't parse tmpfs: %v", err)
+	}
+
+	if len(mounts) != 2 || mounts[0].dest != "/tmp" || mounts[0].options != "size=4g,mode=1777" || mounts[1].dest != "/var/tmp" || mounts[1].options != "" {
+		t.Fatalf("bad tmpfs mounts: %v", mounts)
+	}
+
+	for _, bad := range []string{"tmp", "/", "/tmp/..:size=1g"} {
+		l := &Layer{Tmpfs: []string{bad}}
+		if _, err := l.ParseTmpfs(); err == nil {
+			t.Errorf("parsed bad tmpfs %s", bad)
+		}
+	}
+}
+
+func TestFirstMissing(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "stacker_tmpfs_test")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir: %v", err)
+	}
+	defer os.RemoveAll(rootfs)
+
+	if err := os.MkdirAll(path.Join(rootfs, "var/tmp"), 0755); err != nil {
+		t.Fatalf("couldn't make rootfs: %v", err)
+	}
+
+	if missing := firstMissing(rootfs, "/var/tmp"); missing != "" {
+		t.Errorf("existing dir missing: %s", missing)
+	}
+
+	if missing := firstMissing(rootfs, "/var/cache/build"); missing != "/var/cache" {
+		t.Errorf("bad missing dir: %s", missing)
+	}
+
+	// what the mount made is removed, but not what commands put there
+	for _, dir := range []string{"var/a/b/c", "var/d/e/f", "var/d/g"} {
+		if err := os.MkdirAll(path.Join(rootfs, dir), 0755); err != nil {
+			t.Fatalf("couldn't make %s: %v", dir, err)
+		}
+	}
+
+	removeCreated(rootfs, "/var/a", "/var/a/b/c")
+	if _, err := os.Stat(path.Join(rootfs, "var/a")); !os.IsNotExist(err) {
+		t.Errorf("created dirs weren't removed: %v", err)
+	}
+
+	removeCreated(rootfs, "/var/d", "/var/d/e/f")
+	if _, err := os.Stat(path.Join(rootfs, "var/d/e")); !os.IsNotExist(err) {
+		t.Errorf("created dirs weren't removed: %v", err)
+	}
+	if _, err := os.Stat(path.Join(rootfs, "var/d/g")); err != nil {
+		t.Errorf("commands' dir was removed: %v", err)
+	}
+}
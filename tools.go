@@ -0,0 +1,254 @@
+package stacker
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The external tools stacker runs, whose paths can be set in the config's
+// tools (they're looked up in $PATH otherwise).
+const (
+	ToolMksquashfs  = "mksquashfs"
+	ToolUnsquashfs  = "unsquashfs"
+	ToolTar         = "tar"
+	ToolOPA         = "opa"
+	ToolTrivy       = "trivy"
+	ToolGrype       = "grype"
+	ToolVeritysetup = "veritysetup"
+	ToolSSH         = "ssh"
+	ToolKubectl     = "kubectl"
+	ToolZFS         = "zfs"
+	ToolBtrfs       = "btrfs"
+	ToolLvs         = "lvs"
+	ToolLvcreate    = "lvcreate"
+	ToolLvchange    = "lvchange"
+	ToolLvremove    = "lvremove"
+	ToolMkfsExt4    = "mkfs.ext4"
+)
+
+// credentialHelperPrefix starts the names of docker credential helpers, see
+// RegistryCredentials.Helper.
+const credentialHelperPrefix = "docker-credential-"
+
+// credentialHelperTool is the tool name of the docker credential helper
+// helper, e.g. docker-credential-ecr-login for ecr-login.
+func credentialHelperTool(helper string) string {
+	return credentialHelperPrefix + helper
+}
+
+// ToolPath is the path of the tool name: the one set in the config's tools,
+// or just name, to look it up in $PATH.
+func (c StackerConfig) ToolPath(name string) string {
+	if p, ok := c.Tools[name]; ok && p != "" {
+		return p
+	}
+	return name
+}
+
+// toolCheck is how to check that a tool works, and is new enough.
+type toolCheck struct {
+	// versionArgs makes the tool print its version; if there aren't any,
+	// the tool is only looked for.
+	versionArgs []string
+
+	// minVersion is the oldest major.minor version that works, and why,
+	// if there is one.
+	minVersion []int
+	why        string
+
+	// install is what to install to get the tool.
+	install string
+}
+
+var toolChecks = map[string]toolCheck{
+	ToolMksquashfs:  {versionArgs: []string{"-version"}, minVersion: []int{4, 1}, why: "for -no-xattrs", install: "squashfs-tools"},
+	ToolUnsquashfs:  {versionArgs: []string{"-version"}, minVersion: []int{4, 0}, install: "squashfs-tools"},
+	ToolTar:         {versionArgs: []string{"--version"}, install: "tar"},
+	ToolOPA:         {versionArgs: []string{"version"}, install: "opa (https://www.openpolicyagent.org)"},
+	ToolTrivy:       {versionArgs: []string{"--version"}, install: "trivy"},
+	ToolGrype:       {versionArgs: []string{"version"}, install: "grype"},
+	ToolVeritysetup: {versionArgs: []string{"--version"}, install: "cryptsetup"},
+	ToolSSH:         {versionArgs: []string{"-V"}, install: "an ssh client (e.g. openssh-client)"},
+	ToolKubectl:     {versionArgs: []string{"version", "--client"}, install: "kubectl"},
+	ToolZFS:         {versionArgs: []string{"version"}, install: "zfs (e.g. zfsutils-linux)"},
+	ToolBtrfs:       {versionArgs: []string{"--version"}, install: "btrfs-progs"},
+	ToolLvs:         {versionArgs: []string{"--version"}, install: "lvm2"},
+	ToolLvcreate:    {versionArgs: []string{"--version"}, install: "lvm2"},
+	ToolLvchange:    {versionArgs: []string{"--version"}, install: "lvm2"},
+	ToolLvremove:    {versionArgs: []string{"--version"}, install: "lvm2"},
+	ToolMkfsExt4:    {versionArgs: []string{"-V"}, install: "e2fsprogs"},
+}
+
+// toolCheckFor returns how to check the tool name; docker credential helpers
+// don't all have a way to print their version, so they're only looked for.
+func toolCheckFor(name string) toolCheck {
+	if strings.HasPrefix(name, credentialHelperPrefix) {
+		return toolCheck{install: name + " (the credential helper of the registry_auth that uses it)"}
+	}
+	return toolChecks[name]
+}
+
+var versionRegex = regexp.MustCompile(`(\d+)\.(\d+)`)
+
+// parseToolVersion returns the first major.minor version in what a tool
+// printed about its version.
+func parseToolVersion(output string) ([]int, bool) {
+	m := versionRegex.FindStringSubmatch(output)
+	if m == nil {
+		return nil, false
+	}
+
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return []int{major, minor}, true
+}
+
+func olderThan(version []int, min []int) bool {
+	for i := range min {
+		if version[i] != min[i] {
+			return version[i] < min[i]
+		}
+	}
+	return false
+}
+
+var (
+	checkedToolsLock sync.Mutex
+
+	// checkedTools are the paths of the tools that have been checked
+	// already, and what was wrong with them.
+	checkedTools = map[string]error{}
+)
+
+// checkTool checks that the tool name at path p can be run, and is new
+// enough.
+func checkTool(name string, p string) error {
+	checkedToolsLock.Lock()
+	defer checkedToolsLock.Unlock()
+
+	if err, ok := checkedTools[p]; ok {
+		return err
+	}
+
+	err := runToolCheck(name, p)
+	checkedTools[p] = err
+	return err
+}
+
+func runToolCheck(name string, p string) error {
+	check := toolCheckFor(name)
+
+	found, err := exec.LookPath(p)
+	if err != nil {
+		return fmt.Errorf("%s wasn't found; install %s, or set tools: {%s: /path/to/%s} in the stacker config", p, check.install, name, name)
+	}
+
+	if check.versionArgs == nil {
+		return nil
+	}
+
+	output, err := exec.Command(found, check.versionArgs...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %v: %s", found, strings.Join(check.versionArgs, " "), err, strings.TrimSpace(string(output)))
+	}
+
+	if check.minVersion == nil {
+		return nil
+	}
+
+	version, ok := parseToolVersion(string(output))
+	if !ok {
+		return fmt.Errorf("couldn't tell what version %s is from: %s", found, strings.TrimSpace(string(output)))
+	}
+
+	if olderThan(version, check.minVersion) {
+		return fmt.Errorf("%s is version %d.%d, but at least %d.%d is needed %s; install a newer %s, or set tools: {%s: /path/to/%s} in the stacker config",
+			found, version[0], version[1], check.minVersion[0], check.minVersion[1], check.why, check.install, name, name)
+	}
+
+	return nil
+}
+
+// requiredTools returns the tools building sf will need, and what for.
+func (opts *BuildArgs) requiredTools(sf *Stackerfile) map[string]string {
+	required := map[string]string{}
+
+	if opts.LayerType == "squashfs" {
+		required[ToolMksquashfs] = "squashfs layers"
+		required[ToolUnsquashfs] = "squashfs layers"
+	}
+
+	if len(opts.policies()) > 0 {
+		required[ToolOPA] = "policies"
+	}
+
+	if _, ok := toolChecks[opts.Scanner]; ok {
+		required[opts.Scanner] = "scanning layers"
+	}
+
+	switch opts.Config.StorageType {
+	case "zfs":
+		required[ToolZFS] = "zfs storage"
+	case "lvm":
+		for _, tool := range []string{ToolLvs, ToolLvcreate, ToolLvchange, ToolLvremove, ToolMkfsExt4} {
+			required[tool] = "lvm storage"
+		}
+	case "", "btrfs":
+		if opts.Config.LayerQuota != "" {
+			required[ToolBtrfs] = "layer_quota"
+		}
+	}
+
+	auth := opts.registryAuth()
+	helperFor := func(url string, what string) {
+		if host, ok := registryHost(url); ok && auth[host].Helper != "" {
+			required[credentialHelperTool(auth[host].Helper)] = what
+		}
+	}
+
+	for _, name := range sf.fileOrder {
+		l, ok := sf.Get(name)
+		if ok && l.From.baseType() == TarType {
+			required[ToolTar] = fmt.Sprintf("the tar base of %s", name)
+		}
+		if ok && l.From.Type == DockerType {
+			helperFor(l.From.Url, fmt.Sprintf("the credentials of the base of %s", name))
+		}
+	}
+
+	if sf.buildConfig != nil {
+		helperFor(sf.buildConfig.SaveUrl, "the credentials of the save_url")
+	}
+
+	return required
+}
+
+// checkTools checks that the tools building sf needs are there and new
+// enough before anything is built, rather than failing halfway through.
+func (opts *BuildArgs) checkTools(sf *Stackerfile) error {
+	required := opts.requiredTools(sf)
+
+	names := []string{}
+	for name := range required {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	problems := []string{}
+	for _, name := range names {
+		if err := checkTool(name, opts.Config.ToolPath(name)); err != nil {
+			problems = append(problems, fmt.Sprintf("%s is needed for %s, but %v", name, required[name], err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return newError(ErrMissingTool, nil, "%s", strings.Join(problems, "\n"))
+	}
+
+	return nil
+}
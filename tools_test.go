@@ -0,0 +1,99 @@
+package stacker
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseToolVersion(t *testing.T) {
+	cases := map[string][]int{
+		"mksquashfs version 4.3-git (2014/06/09)": {4, 3},
+		"tar (GNU tar) 1.30":                      {1, 30},
+		"Version: 0.34.0":                         {0, 34},
+	}
+
+	for output, expected := range cases {
+		version, ok := parseToolVersion(output)
+		if !ok || version[0] != expected[0] || version[1] != expected[1] {
+			t.Errorf("bad version for %q: %v", output, version)
+		}
+	}
+
+	if _, ok := parseToolVersion("no version here"); ok {
+		t.Errorf("found a version where there isn't one")
+	}
+}
+
+func TestOlderThan(t *testing.T) {
+	if !olderThan([]int{4, 0}, []int{4, 1}) {
+		t.Errorf("4.0 should be older than 4.1")
+	}
+	if olderThan([]int{4, 1}, []int{4, 1}) || olderThan([]int{5, 0}, []int{4, 1}) {
+		t.Errorf("4.1 and 5.0 shouldn't be older than 4.1")
+	}
+}
+
+func TestToolPath(t *testing.T) {
+	config := StackerConfig{Tools: map[string]string{ToolMksquashfs: "/opt/bin/mksquashfs"}}
+	if config.ToolPath(ToolMksquashfs) != "/opt/bin/mksquashfs" {
+		t.Errorf("configured path not used: %s", config.ToolPath(ToolMksquashfs))
+	}
+	if config.ToolPath(ToolTar) != "tar" {
+		t.Errorf("unconfigured tool not looked up in $PATH: %s", config.ToolPath(ToolTar))
+	}
+}
+
+func TestCheckToolsMissing(t *testing.T) {
+	opts := &BuildArgs{
+		Config:    StackerConfig{Tools: map[string]string{ToolMksquashfs: "/does/not/exist/mksquashfs", ToolUnsquashfs: "/does/not/exist/unsquashfs"}},
+		LayerType: "squashfs",
+	}
+
+	err := opts.checkTools(&Stackerfile{})
+	if errors.Cause(err) != ErrMissingTool {
+		t.Fatalf("expected a missing tool error, got %v", err)
+	}
+}
+
+func TestRequiredStorageTools(t *testing.T) {
+	opts := &BuildArgs{Config: StackerConfig{StorageType: "lvm"}}
+	required := opts.requiredTools(&Stackerfile{})
+	for _, tool := range []string{ToolLvs, ToolLvcreate, ToolLvchange, ToolLvremove, ToolMkfsExt4} {
+		if _, ok := required[tool]; !ok {
+			t.Errorf("%s isn't required for lvm storage", tool)
+		}
+	}
+
+	opts = &BuildArgs{Config: StackerConfig{StorageType: "zfs"}}
+	if _, ok := opts.requiredTools(&Stackerfile{})[ToolZFS]; !ok {
+		t.Errorf("zfs isn't required for zfs storage")
+	}
+
+	opts = &BuildArgs{Config: StackerConfig{LayerQuota: "1GB"}}
+	if _, ok := opts.requiredTools(&Stackerfile{})[ToolBtrfs]; !ok {
+		t.Errorf("btrfs isn't required for layer quotas")
+	}
+}
+
+func TestRequiredCredentialHelpers(t *testing.T) {
+	opts := &BuildArgs{Config: StackerConfig{RegistryAuth: RegistryAuth{
+		"1234.dkr.ecr.us-east-1.amazonaws.com": {Helper: "ecr-login"},
+	}}}
+
+	sf := &Stackerfile{
+		fileOrder: []string{"app"},
+		internal: map[string]*Layer{
+			"app": {From: &ImageSource{Type: DockerType, Url: "docker://1234.dkr.ecr.us-east-1.amazonaws.com/base:latest"}},
+		},
+	}
+
+	if _, ok := opts.requiredTools(sf)["docker-credential-ecr-login"]; !ok {
+		t.Errorf("the credential helper of the base's registry isn't required")
+	}
+
+	err := checkTool("docker-credential-ecr-login", "/does/not/exist/docker-credential-ecr-login")
+	if err == nil {
+		t.Errorf("missing credential helper wasn't noticed")
+	}
+}
@@ -0,0 +1,350 @@
+package stacker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ttyLogLines is how many of the last lines of its output are shown
+	// under a layer while it's being built, and when it fails.
+	ttyLogLines = 6
+
+	// ttyRefresh is how often the elapsed times are redrawn.
+	ttyRefresh = 100 * time.Millisecond
+)
+
+const (
+	ttyRunning = "running"
+	ttyCached  = "cached"
+	ttyDone    = "done"
+	ttyFailed  = "failed"
+)
+
+var ttySpinner = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// ttyLayer is what the tty view knows about a layer.
+type ttyLayer struct {
+	name  string
+	phase string
+	state string
+	start time.Time
+	end   time.Time
+	logs  []string
+}
+
+func (l *ttyLayer) log(line string) {
+	l.logs = append(l.logs, line)
+	if len(l.logs) > ttyLogLines {
+		l.logs = l.logs[len(l.logs)-ttyLogLines:]
+	}
+}
+
+func (l *ttyLayer) finish(failed bool, now time.Time) {
+	if !l.end.IsZero() {
+		return
+	}
+
+	l.end = now
+	if failed {
+		l.state = ttyFailed
+	} else if l.state == ttyRunning {
+		l.state = ttyDone
+	}
+}
+
+// ttyProgress renders a build as a view of each of its layers, the phase it's
+// in and how long it's taken, redrawn in place on a terminal: only the last
+// few lines of output of the layer being built are shown under it, and they
+// are collapsed once it's done, unless it failed.
+type ttyProgress struct {
+	out   io.Writer
+	width int
+
+	mu     sync.Mutex
+	start  time.Time
+	layers []*ttyLayer
+
+	// preamble is the output from before the first layer started.
+	preamble *ttyLayer
+
+	partial string
+	drawn   int
+	frame   int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newTTYProgress(out io.Writer, width int) *ttyProgress {
+	return &ttyProgress{
+		out:      out,
+		width:    width,
+		start:    time.Now(),
+		preamble: &ttyLayer{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (p *ttyProgress) current() *ttyLayer {
+	if len(p.layers) == 0 {
+		return nil
+	}
+	return p.layers[len(p.layers)-1]
+}
+
+// handle is the EventHandler that updates the view.
+func (p *ttyProgress) handle(e Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e.Type == EventLayerStarted {
+		if l := p.current(); l != nil {
+			l.finish(false, e.Time)
+		}
+		p.layers = append(p.layers, &ttyLayer{name: e.Layer, state: ttyRunning, start: e.Time})
+		return
+	}
+
+	l := p.current()
+	if l == nil {
+		return
+	}
+
+	switch e.Type {
+	case EventPhaseStarted:
+		l.phase = e.Phase
+	case EventCacheHit:
+		l.state = ttyCached
+	case EventImportFetched:
+		l.log(fmt.Sprintf("fetched %s", e.URL))
+	case EventPushProgress:
+		// the progress bars themselves don't fit in a line of the view
+		l.phase = PushPhase
+	case EventLayerPushed:
+		l.log(fmt.Sprintf("pushed %s", e.URL))
+	}
+
+	// EventRunOutput isn't shown, since everything that's printed
+	// (including it) is written to the view as the layer's output.
+}
+
+// Write takes the output of the build, which is shown under the layer that
+// is being built.
+func (p *ttyProgress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lines := strings.Split(p.partial+string(b), "\n")
+	p.partial = lines[len(lines)-1]
+
+	for _, line := range lines[:len(lines)-1] {
+		// only the last of the things drawn over each other with \r
+		if i := strings.LastIndex(strings.TrimRight(line, "\r"), "\r"); i >= 0 {
+			line = line[i+1:]
+		}
+		line = strings.TrimRight(line, "\r")
+
+		if l := p.current(); l != nil {
+			l.log(line)
+		} else {
+			p.preamble.log(line)
+		}
+	}
+
+	return len(b), nil
+}
+
+func (p *ttyProgress) truncate(line string) string {
+	if p.width <= 0 {
+		return line
+	}
+
+	runes := []rune(line)
+	if len(runes) < p.width {
+		return line
+	}
+	return string(runes[:p.width-1])
+}
+
+// nameWidth is how much of the width of the terminal layers' names get,
+// after the room for their state and how long they took.
+func (p *ttyProgress) nameWidth() int {
+	width := 30
+	if p.width > 0 && p.width-35 < width {
+		width = p.width - 35
+	}
+	if width < 10 {
+		width = 10
+	}
+	return width
+}
+
+// render returns the view at now.
+func (p *ttyProgress) render(now time.Time) []string {
+	done := 0
+	for _, l := range p.layers {
+		if l.state != ttyRunning {
+			done++
+		}
+	}
+
+	lines := []string{fmt.Sprintf("[+] Building %.1fs (%d/%d)", now.Sub(p.start).Seconds(), done, len(p.layers))}
+	if len(p.layers) == 0 {
+		for _, log := range p.preamble.logs {
+			lines = append(lines, p.truncate("   │ "+log))
+		}
+	}
+	for _, l := range p.layers {
+		end := l.end
+		if end.IsZero() {
+			end = now
+		}
+
+		mark, status := "✔", l.state
+		switch l.state {
+		case ttyRunning:
+			mark = ttySpinner[p.frame%len(ttySpinner)]
+			status = l.phase
+		case ttyFailed:
+			mark = "✘"
+			if l.phase != "" {
+				status = fmt.Sprintf("failed in %s", l.phase)
+			}
+		}
+
+		name := []rune(l.name)
+		if len(name) > p.nameWidth() {
+			name = append(name[:p.nameWidth()-1], '…')
+		}
+
+		line := fmt.Sprintf(" %s %-*s %-20s %7.1fs", mark, p.nameWidth(), string(name), status, end.Sub(l.start).Seconds())
+		lines = append(lines, p.truncate(line))
+
+		if l.state == ttyRunning || l.state == ttyFailed {
+			for _, log := range l.logs {
+				lines = append(lines, p.truncate("   │ "+log))
+			}
+		}
+	}
+
+	return lines
+}
+
+// draw redraws the view over the last one.
+func (p *ttyProgress) draw(now time.Time) {
+	lines := p.render(now)
+
+	var b strings.Builder
+	if p.drawn > 0 {
+		// back to the start of the last view, and clear it
+		fmt.Fprintf(&b, "\x1b[%dA\r\x1b[J", p.drawn)
+	}
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+
+	io.WriteString(p.out, b.String())
+	p.drawn = len(lines)
+	p.frame++
+}
+
+func (p *ttyProgress) run() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(ttyRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-ticker.C:
+			p.mu.Lock()
+			p.draw(now)
+			p.mu.Unlock()
+		}
+	}
+}
+
+// finish stops redrawing the view, and draws it one last time, with the
+// layer being built failed if err isn't nil.
+func (p *ttyProgress) finish(err error) {
+	close(p.stop)
+	<-p.done
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if p.partial != "" {
+		if l := p.current(); l != nil {
+			l.log(p.partial)
+		} else {
+			p.preamble.log(p.partial)
+		}
+		p.partial = ""
+	}
+
+	if l := p.current(); l != nil {
+		l.finish(err != nil, now)
+	}
+
+	p.draw(now)
+}
+
+// terminalWidth returns the width of the terminal f, or 0 if it isn't one.
+func terminalWidth(f *os.File) int {
+	ws, err := unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return 0
+	}
+	return int(ws.Col)
+}
+
+// TTYProgressAvailable is whether ShowTTYProgress can show the progress of a
+// build on stdout: it's a terminal, and output is neither quiet, verbose nor
+// without color.
+func TTYProgressAvailable() bool {
+	return !noColor && outputLevel == NormalOutput
+}
+
+// ShowTTYProgress makes the builder show its progress on the terminal out as
+// a view of each layer, the phase it's in and how long it's taken, redrawn in
+// place, instead of printing everything it does. Only the last few lines
+// of the output of the layer that's being built are shown, and those of the
+// layer that failed, if one did; what their commands printed is still in the
+// layers' logs. Everything the build prints is shown in the view until
+// the returned function is called with the error (if any) the build
+// returned.
+func (b *Builder) ShowTTYProgress(out *os.File) (func(error), error) {
+	if !isTerminal(out) {
+		return nil, fmt.Errorf("%s isn't a terminal", out.Name())
+	}
+
+	p := newTTYProgress(out, terminalWidth(out))
+	b.OnEvent(p.handle)
+
+	// the progress bars of image copies would be drawn over the view
+	oldNoColor := noColor
+	noColor = true
+
+	oldOutput := b.opts.Config.output
+	b.opts.Config.output = p
+
+	go p.run()
+
+	return func(err error) {
+		b.opts.Config.output = oldOutput
+		noColor = oldNoColor
+		p.finish(err)
+	}, nil
+}
@@ -0,0 +1,70 @@
+package stacker
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTTYProgress(t *testing.T) {
+	out := &bytes.Buffer{}
+	p := newTTYProgress(out, 60)
+	start := p.start
+
+	fmt.Fprintf(p, "preparing\n")
+	p.handle(Event{Type: EventLayerStarted, Layer: "base", Time: start})
+	p.handle(Event{Type: EventCacheHit, Layer: "base", Time: start})
+	p.handle(Event{Type: EventLayerStarted, Layer: "app", Time: start.Add(time.Second)})
+	p.handle(Event{Type: EventPhaseStarted, Layer: "app", Phase: RunPhase, Time: start.Add(time.Second)})
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(p, "line %d\n", i)
+	}
+	fmt.Fprintf(p, "10%%\r50%%\r100%%\n")
+
+	lines := p.render(start.Add(3 * time.Second))
+	view := strings.Join(lines, "\n")
+
+	if !strings.Contains(lines[0], "3.0s (1/2)") {
+		t.Errorf("bad header %q", lines[0])
+	}
+
+	if !strings.Contains(lines[1], "base") || !strings.Contains(lines[1], "cached") {
+		t.Errorf("bad cached layer %q", lines[1])
+	}
+
+	if !strings.Contains(lines[2], "app") || !strings.Contains(lines[2], "run") || !strings.Contains(lines[2], "2.0s") {
+		t.Errorf("bad running layer %q", lines[2])
+	}
+
+	if len(lines) != 3+ttyLogLines {
+		t.Errorf("bad number of lines in view:\n%s", view)
+	}
+
+	if strings.Contains(view, "line 4") || !strings.Contains(view, "line 9") {
+		t.Errorf("bad log lines in view:\n%s", view)
+	}
+
+	if !strings.HasSuffix(lines[len(lines)-1], "│ 100%") {
+		t.Errorf("overwritten output not collapsed: %q", lines[len(lines)-1])
+	}
+
+	for _, l := range lines {
+		if len([]rune(l)) >= 60 {
+			t.Errorf("line not truncated: %q", l)
+		}
+	}
+
+	// finished layers' output is collapsed, unless they failed
+	p.layers[1].finish(false, start.Add(4*time.Second))
+	if lines := p.render(start.Add(5 * time.Second)); len(lines) != 3 || !strings.Contains(lines[2], "3.0s") {
+		t.Errorf("bad view once done:\n%s", strings.Join(lines, "\n"))
+	}
+
+	p.layers[1].end = time.Time{}
+	p.layers[1].finish(true, start.Add(4*time.Second))
+	if lines := p.render(start.Add(5 * time.Second)); len(lines) != 3+ttyLogLines || !strings.Contains(lines[2], "failed in run") {
+		t.Errorf("bad view once failed:\n%s", strings.Join(lines, "\n"))
+	}
+}
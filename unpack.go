@@ -0,0 +1,251 @@
+package stacker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// UnpackOpts are the options for Unpack.
+type UnpackOpts struct {
+	// Snapshot makes the destination the name of a new snapshot in the
+	// config's storage (like the ones of built layers), instead of a
+	// directory.
+	Snapshot bool
+
+	// UIDMap and GIDMap shift the ids of the files in the image, as
+	// "nsid:hostid:range" entries: a file that's owned by nsid in the
+	// image is owned by hostid once it's unpacked, e.g. to use it as the
+	// rootfs of a container in a user namespace with that mapping. All
+	// of the ids in the image have to be mapped. Only root can shift ids.
+	UIDMap []string
+	GIDMap []string
+}
+
+// mapOptions returns the umoci map options that shift ids the way opts says.
+func (opts UnpackOpts) mapOptions() (layer.MapOptions, error) {
+	mapOptions := layer.MapOptions{KeepDirlinks: true}
+	if len(opts.UIDMap) == 0 && len(opts.GIDMap) == 0 {
+		return mapOptions, nil
+	}
+
+	if os.Geteuid() != 0 {
+		return mapOptions, fmt.Errorf("only root can shift the ids of unpacked images")
+	}
+
+	uids, err := parseIdmap(opts.UIDMap, true)
+	if err != nil {
+		return mapOptions, err
+	}
+
+	gids, err := parseIdmap(opts.GIDMap, false)
+	if err != nil {
+		return mapOptions, err
+	}
+
+	mapOptions.UIDMappings = []rspec.LinuxIDMapping{}
+	for _, e := range uids {
+		mapOptions.UIDMappings = append(mapOptions.UIDMappings, rspec.LinuxIDMapping{ContainerID: uint32(e.Nsid), HostID: uint32(e.Hostid), Size: uint32(e.Maprange)})
+	}
+
+	mapOptions.GIDMappings = []rspec.LinuxIDMapping{}
+	for _, e := range gids {
+		mapOptions.GIDMappings = append(mapOptions.GIDMappings, rspec.LinuxIDMapping{ContainerID: uint32(e.Nsid), HostID: uint32(e.Hostid), Size: uint32(e.Maprange)})
+	}
+
+	return mapOptions, nil
+}
+
+// findImage returns the layout the image tag is in: the output (for built
+// images), or the import layout (for bases that were pulled).
+func findImage(config StackerConfig, tag string) (string, error) {
+	for _, layout := range []string{config.OCIDir, path.Join(config.StackerDir, "layer-bases", "oci")} {
+		oci, err := umoci.OpenLayout(layout)
+		if err != nil {
+			continue
+		}
+
+		_, err = stackeroci.LookupManifest(oci, tag)
+		oci.Close()
+		if err == nil {
+			return layout, nil
+		}
+	}
+
+	return "", fmt.Errorf("no image %s in %s or the import layout", tag, config.OCIDir)
+}
+
+// writeRuntimeConfig writes the config.json of the bundle at bundlePath,
+// made from the config of the image manifest in oci, the way umoci does for
+// the images it unpacks.
+func writeRuntimeConfig(oci casext.Engine, manifest ispec.Manifest, bundlePath string, mapOptions layer.MapOptions) error {
+	f, err := os.Create(path.Join(bundlePath, "config.json"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rootfs := path.Join(bundlePath, layer.RootfsName)
+	return layer.UnpackRuntimeJSON(context.Background(), oci, f, rootfs, manifest, &mapOptions)
+}
+
+// unpackImage unpacks the image tag in layout as a runtime bundle at
+// bundlePath, with its filesystem in bundlePath/rootfs.
+func unpackImage(config StackerConfig, layout string, tag string, bundlePath string, mapOptions layer.MapOptions) error {
+	oci, err := umoci.OpenLayout(layout)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return err
+	}
+
+	if len(manifest.Layers) > 0 && manifest.Layers[0].MediaType == stackeroci.MediaTypeLayerSquashfs {
+		if mapOptions.UIDMappings != nil {
+			return fmt.Errorf("can't shift the ids of squashfs images")
+		}
+
+		rootfs := path.Join(bundlePath, layer.RootfsName)
+		if err := os.MkdirAll(rootfs, 0755); err != nil {
+			return err
+		}
+
+		for _, l := range manifest.Layers {
+			squashfsFile := path.Join(layout, "blobs", "sha256", l.Digest.Encoded())
+			err := MaybeRunInUserns([]string{config.ToolPath(ToolUnsquashfs), "-f", "-d", rootfs, squashfsFile}, "couldn't unsquashfs layer")
+			if err != nil {
+				return err
+			}
+		}
+
+		return writeRuntimeConfig(oci, manifest, bundlePath, mapOptions)
+	}
+
+	// unprivileged, the ids in the image can only be kept by unpacking
+	// it in the user namespace, which can only write under the roots
+	if IdmapSet != nil && !mapOptions.Rootless {
+		modifiedConfig := config
+		modifiedConfig.OCIDir = layout
+		return RunUmociSubcommand(modifiedConfig, false, []string{
+			"--bundle-path", bundlePath,
+			"--tag", tag,
+			"unpack",
+		})
+	}
+
+	return umoci.Unpack(oci, tag, bundlePath, mapOptions, nil, ispec.Descriptor{})
+}
+
+// Unpack checks out the image tag, built or pulled, into the directory dest
+// (which mustn't exist yet) as an OCI runtime bundle whose rootfs is
+// dest/rootfs, and whose config.json runs the image's entrypoint and cmd
+// (with runc, crun, ...) the way its config says to, or as a new snapshot
+// named dest, e.g. to inspect it, chroot into it or hand it to other tools.
+func Unpack(config StackerConfig, tag string, dest string, opts UnpackOpts) error {
+	mapOptions, err := opts.mapOptions()
+	if err != nil {
+		return err
+	}
+
+	ociLock, err := LockOCIDir(config)
+	if err != nil {
+		return err
+	}
+	defer ociLock.Unlock()
+
+	basesLock, err := lockOrWait(config, "layer-bases", "the base image import layout")
+	if err != nil {
+		return err
+	}
+	defer basesLock.Unlock()
+
+	layout, err := findImage(config, tag)
+	if err != nil {
+		return err
+	}
+
+	if !opts.Snapshot {
+		if _, err := os.Stat(dest); err == nil {
+			return fmt.Errorf("%s already exists", dest)
+		}
+
+		// a directory outside the roots can't be unpacked into from
+		// the user namespace, so unprivileged, everything is owned by
+		// the user instead
+		mapOptions.Rootless = IdmapSet != nil
+		return unpackImage(config, layout, tag, dest, mapOptions)
+	}
+
+	wcLock, err := LockWorkingContainer(config)
+	if err != nil {
+		return err
+	}
+	defer wcLock.Unlock()
+
+	s, err := NewStorage(config)
+	if err != nil {
+		return err
+	}
+	defer s.Detach()
+
+	if s.Exists(dest) {
+		return fmt.Errorf("snapshot %s already exists", dest)
+	}
+
+	wc := config.WorkingContainer()
+	s.Delete(wc)
+	if err := s.Create(wc); err != nil {
+		return err
+	}
+	defer s.Delete(wc)
+
+	if err := unpackImage(config, layout, tag, path.Join(config.RootFSDir, wc), mapOptions); err != nil {
+		return err
+	}
+
+	if err := s.Snapshot(wc, dest); err != nil {
+		return err
+	}
+
+	return recordSnapshot(config, dest, tag)
+}
+
+// exportBundle makes the image name that was just built into a runtime
+// bundle in opts.BundleDir/name, replacing the one from its last build, if
+// the build was asked to. The caller holds the lock on the output.
+func exportBundle(opts *BuildArgs, name string) error {
+	if opts.BundleDir == "" {
+		return nil
+	}
+
+	dest := path.Join(opts.BundleDir, name)
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(opts.BundleDir, 0755); err != nil {
+		return err
+	}
+
+	// like Unpack, outside the roots everything is owned by the user
+	// when building unprivileged
+	mapOptions := layer.MapOptions{KeepDirlinks: true, Rootless: IdmapSet != nil}
+	if err := unpackImage(opts.Config, opts.Config.OCIDir, name, dest, mapOptions); err != nil {
+		return errors.Wrapf(err, "couldn't export runtime bundle for %s", name)
+	}
+
+	infof(opts.Config, "exported runtime bundle for %s to %s\n", name, dest)
+	return nil
+}
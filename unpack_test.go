@@ -0,0 +1,121 @@
+package stacker
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestUnpackMapOptions(t *testing.T) {
+	mapOptions, err := UnpackOpts{}.mapOptions()
+	if err != nil {
+		t.Fatalf("no maps: %v", err)
+	}
+	if mapOptions.UIDMappings != nil || mapOptions.GIDMappings != nil || !mapOptions.KeepDirlinks {
+		t.Fatalf("bad options without maps: %+v", mapOptions)
+	}
+
+	opts := UnpackOpts{
+		UIDMap: []string{"0:100000:65536"},
+		GIDMap: []string{"0:200000:1000", "1000:300000:1"},
+	}
+
+	if os.Geteuid() != 0 {
+		if _, err := opts.mapOptions(); err == nil {
+			t.Fatalf("shifting ids unprivileged worked")
+		}
+		return
+	}
+
+	mapOptions, err = opts.mapOptions()
+	if err != nil {
+		t.Fatalf("maps: %v", err)
+	}
+
+	uids := []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}}
+	gids := []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 200000, Size: 1000}, {ContainerID: 1000, HostID: 300000, Size: 1}}
+	if len(mapOptions.UIDMappings) != 1 || mapOptions.UIDMappings[0] != uids[0] {
+		t.Fatalf("bad uid mappings: %+v", mapOptions.UIDMappings)
+	}
+	if len(mapOptions.GIDMappings) != 2 || mapOptions.GIDMappings[0] != gids[0] || mapOptions.GIDMappings[1] != gids[1] {
+		t.Fatalf("bad gid mappings: %+v", mapOptions.GIDMappings)
+	}
+
+	_, err = UnpackOpts{UIDMap: []string{"nope"}}.mapOptions()
+	if err == nil {
+		t.Fatalf("bad map parsed")
+	}
+}
+
+func TestWriteRuntimeConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_unpack_test")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oci, err := umoci.CreateLayout(path.Join(dir, "oci"))
+	if err != nil {
+		t.Fatalf("couldn't create layout: %v", err)
+	}
+	defer oci.Close()
+
+	image := ispec.Image{OS: "linux", Architecture: "amd64"}
+	image.Config.Entrypoint = []string{"/usr/bin/app"}
+	image.Config.Cmd = []string{"--serve"}
+	image.Config.Env = []string{"PATH=/usr/bin", "FOO=bar"}
+	image.Config.WorkingDir = "/srv"
+	image.RootFS.Type = "layers"
+
+	d, size, err := oci.PutBlobJSON(context.Background(), image)
+	if err != nil {
+		t.Fatalf("couldn't put config: %v", err)
+	}
+
+	manifest := ispec.Manifest{Config: ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig, Digest: d, Size: size}}
+	manifest.SchemaVersion = 2
+
+	bundle := path.Join(dir, "bundle")
+	if err := os.MkdirAll(path.Join(bundle, layer.RootfsName), 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if err := writeRuntimeConfig(oci, manifest, bundle, layer.MapOptions{}); err != nil {
+		t.Fatalf("couldn't write runtime config: %v", err)
+	}
+
+	content, err := ioutil.ReadFile(path.Join(bundle, "config.json"))
+	if err != nil {
+		t.Fatalf("no config.json: %v", err)
+	}
+
+	spec := rspec.Spec{}
+	if err := json.Unmarshal(content, &spec); err != nil {
+		t.Fatalf("bad config.json: %v", err)
+	}
+
+	if !reflect.DeepEqual(spec.Process.Args, []string{"/usr/bin/app", "--serve"}) {
+		t.Errorf("bad args %v", spec.Process.Args)
+	}
+
+	if spec.Process.Cwd != "/srv" {
+		t.Errorf("bad cwd %s", spec.Process.Cwd)
+	}
+
+	found := false
+	for _, e := range spec.Process.Env {
+		found = found || e == "FOO=bar"
+	}
+	if !found {
+		t.Errorf("FOO isn't in the environment: %v", spec.Process.Env)
+	}
+}
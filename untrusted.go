@@ -0,0 +1,120 @@
+package stacker
+
+import (
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// within returns whether p is dir or under it, once any symlinks that are
+// already there are resolved.
+func within(dir string, p string) bool {
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(p); err == nil {
+		p = resolved
+	}
+
+	dir = filepath.Clean(dir)
+	p = filepath.Clean(p)
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// localPath returns the host path u is, or "" if it's a url.
+func localPath(u string) string {
+	parsed, err := url.Parse(u)
+	if err == nil && parsed.Scheme != "" {
+		return ""
+	}
+	return u
+}
+
+// hostAccess returns what the layer does on the host rather than in its
+// container: running hooks, binding or reading host files outside dir (the
+// stackerfile's directory), or being let out of its container's confinement.
+func (l *Layer) hostAccess(dir string) ([]string, error) {
+	uses := []string{}
+	for _, u := range []struct {
+		used bool
+		what string
+	}{
+		{l.Hooks != nil, "hooks"},
+		{l.Binds != nil, "binds"},
+		{len(l.Devices) > 0, "devices"},
+		{l.Privileged, "privileged"},
+		{len(l.Capabilities) > 0, "capabilities"},
+		{l.SeccompProfile != "", "seccomp_profile"},
+	} {
+		if u.used {
+			uses = append(uses, u.what)
+		}
+	}
+
+	imports, err := l.ParseImport()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, imp := range imports {
+		if p := localPath(imp); p != "" && !within(dir, p) {
+			uses = append(uses, "import "+imp)
+		}
+	}
+
+	if l.From != nil && l.From.Url != "" {
+		base := ""
+		switch l.From.Type {
+		case TarType:
+			base = localPath(l.From.Url)
+		case OCIType:
+			base = strings.SplitN(l.From.Url, ":", 2)[0]
+		}
+
+		if base != "" {
+			abs, err := l.getAbsPath(base)
+			if err != nil {
+				return nil, err
+			}
+			if !within(dir, abs) {
+				uses = append(uses, "base "+l.From.Url)
+			}
+		}
+	}
+
+	return uses, nil
+}
+
+// checkUntrusted refuses sf if any of its layers use the host, see
+// hostAccess, or it's saved to an OCI layout outside its directory.
+func checkUntrusted(sf *Stackerfile) error {
+	dir, err := filepath.Abs(sf.referenceDirectory)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range sf.fileOrder {
+		l := sf.internal[name]
+		uses, err := l.hostAccess(dir)
+		if err != nil {
+			return err
+		}
+
+		if len(uses) > 0 {
+			return newError(ErrUntrusted, nil, "%s uses %s, which untrusted stackerfiles can't", name, strings.Join(uses, ", "))
+		}
+	}
+
+	saveURL := sf.buildConfig.SaveUrl
+	if strings.HasPrefix(saveURL, "oci:") {
+		layout := strings.TrimPrefix(saveURL, "oci:")
+		if !filepath.IsAbs(layout) {
+			layout = filepath.Join(dir, layout)
+		}
+		if !within(dir, layout) {
+			return newError(ErrUntrusted, nil, "%s is saved to %s, which untrusted stackerfiles can't be", sf.path, saveURL)
+		}
+	}
+
+	return nil
+}
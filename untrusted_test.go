@@ -0,0 +1,50 @@
+package stacker
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestCheckUntrusted(t *testing.T) {
+	base := `app:
+    from:
+        type: docker
+        url: docker://centos:latest
+    import:
+        - files/config
+        - https://example.com/app.tar.gz
+`
+	for _, c := range []struct {
+		extra string
+		ok    bool
+	}{
+		{"", true},
+		{"    hooks:\n        post_build: [sign]\n", false},
+		{"    binds: /etc/shadow\n", false},
+		{"    devices: [/dev/kvm]\n", false},
+		{"    privileged: true\n", false},
+		{"    import: /etc/shadow\n", false},
+		{"    import: ../../etc/shadow\n", false},
+	} {
+		content := base
+		if strings.Contains(c.extra, "import:") {
+			content = strings.Split(base, "    import:")[0]
+		}
+		content += c.extra
+
+		sf, err := NewStackerfileFromReader(strings.NewReader(content), "/src", nil)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		err = checkUntrusted(sf)
+		if c.ok && err != nil {
+			t.Errorf("refused %q: %v", c.extra, err)
+		}
+		if !c.ok && errors.Cause(err) != ErrUntrusted {
+			t.Errorf("allowed %q: %v", c.extra, err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package stacker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vbatts/go-mtree"
+)
+
+// verifyKeywords are what has to be the same in the unpacked image and the
+// rootfs it was generated from. Times aren't compared, since tar only has
+// them to the second; nlink is, so that broken hardlinks are caught.
+var verifyKeywords = []mtree.Keyword{"type", "link", "nlink", "uid", "gid", "mode", "size", "sha256digest", "xattr"}
+
+// LayerDiscrepancy is a file that is different in a generated image than in
+// the rootfs it was generated from.
+type LayerDiscrepancy struct {
+	Path string `json:"path"`
+
+	// Type is "missing" if the file isn't in the image, "extra" if only
+	// the image has it, or "modified".
+	Type string `json:"type"`
+
+	// Keywords are the mtree keywords that are different, if it was
+	// modified.
+	Keywords []string `json:"keywords,omitempty"`
+}
+
+func (d LayerDiscrepancy) String() string {
+	if len(d.Keywords) == 0 {
+		return fmt.Sprintf("%s: %s", d.Path, d.Type)
+	}
+	return fmt.Sprintf("%s: %s (%s)", d.Path, d.Type, strings.Join(d.Keywords, ", "))
+}
+
+// layerDiscrepancies turns the mtree deltas of the unpacked image against
+// the rootfs into LayerDiscrepancies, leaving out the xattrs that xattrs
+// doesn't keep, since those are meant to be missing.
+func layerDiscrepancies(deltas []mtree.InodeDelta, xattrs *xattrFilter) []LayerDiscrepancy {
+	discrepancies := []LayerDiscrepancy{}
+	for _, delta := range deltas {
+		switch delta.Type() {
+		case mtree.Missing:
+			discrepancies = append(discrepancies, LayerDiscrepancy{Path: delta.Path(), Type: "missing"})
+		case mtree.Extra:
+			discrepancies = append(discrepancies, LayerDiscrepancy{Path: delta.Path(), Type: "extra"})
+		case mtree.Modified:
+			keywords := []string{}
+			for _, kd := range delta.Diff() {
+				name := string(kd.Name())
+				if strings.HasPrefix(name, "xattr.") && !xattrs.keep(strings.TrimPrefix(name, "xattr.")) {
+					continue
+				}
+				keywords = append(keywords, name)
+			}
+
+			if len(keywords) == 0 {
+				continue
+			}
+
+			sort.Strings(keywords)
+			discrepancies = append(discrepancies, LayerDiscrepancy{Path: delta.Path(), Type: "modified", Keywords: keywords})
+		}
+	}
+
+	sort.Slice(discrepancies, func(i, j int) bool { return discrepancies[i].Path < discrepancies[j].Path })
+	return discrepancies
+}
+
+// VerifyImage unpacks the image tag into a temporary directory in
+// config.RootFSDir and compares it with rootfs, returning the files that
+// are different. Only the xattrs in xattrs (see WithXattrNamespaces) are
+// expected to be in the image.
+func VerifyImage(oci casext.Engine, config StackerConfig, tag string, rootfs string, xattrs []string) ([]LayerDiscrepancy, error) {
+	filter, err := parseXattrNamespaces(xattrs)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir(config.RootFSDir, ".verify-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	bundlePath := path.Join(dir, "bundle")
+	err = umoci.Unpack(oci, tag, bundlePath, layer.MapOptions{KeepDirlinks: true}, nil, ispec.Descriptor{})
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err := mtree.Walk(rootfs, nil, verifyKeywords, fseval.DefaultFsEval)
+	if err != nil {
+		return nil, err
+	}
+
+	deltas, err := mtree.Check(path.Join(bundlePath, layer.RootfsName), spec, verifyKeywords, fseval.DefaultFsEval)
+	if err != nil {
+		return nil, err
+	}
+
+	return layerDiscrepancies(deltas, filter), nil
+}
+
+// verifyLayer checks that the image name has exactly what's in the working
+// container's rootfs, and fails with a list of what's different otherwise.
+func verifyLayer(oci casext.Engine, name string, opts *BuildArgs) error {
+	if opts.LayerType != "tar" {
+		warnf(opts.Config, "warning: can't verify %s layers, skipping verification of %s\n", opts.LayerType, name)
+		return nil
+	}
+
+	if IdmapSet != nil || os.Geteuid() != 0 {
+		warnf(opts.Config, "warning: verifying layers needs root, skipping verification of %s\n", name)
+		return nil
+	}
+
+	infoln(opts.Config, "verifying layer for", name)
+	rootfs := path.Join(opts.Config.RootFSDir, opts.Config.WorkingContainer(), "rootfs")
+	discrepancies, err := VerifyImage(oci, opts.Config, name, rootfs, opts.Xattrs)
+	if err != nil {
+		return err
+	}
+
+	if len(discrepancies) == 0 {
+		return nil
+	}
+
+	for _, d := range discrepancies {
+		warnln(opts.Config, d)
+	}
+
+	return newError(ErrLayerMismatch, nil, "%s has %d files that are different than in its rootfs", name, len(discrepancies))
+}
@@ -0,0 +1,61 @@
+package stacker
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vbatts/go-mtree"
+)
+
+func TestLayerDiscrepancies(t *testing.T) {
+	rootfs := `
+.               type=dir mode=0755
+    bar         type=file size=3 nlink=2 xattr.user.foo=YmFy
+    baz         type=file size=3 xattr.security.capability=Y2Fw
+    foo         type=file size=3
+..
+`
+	unpacked := `
+.               type=dir mode=0755
+    bar         type=file size=3 nlink=1
+    baz         type=file size=3 xattr.security.capability=Y2Fw
+    qux         type=file size=3
+..
+`
+	parse := func(s string) *mtree.DirectoryHierarchy {
+		dh, err := mtree.ParseSpec(strings.NewReader(s))
+		if err != nil {
+			t.Fatalf("couldn't parse spec: %v", err)
+		}
+		return dh
+	}
+
+	deltas, err := mtree.Compare(parse(rootfs), parse(unpacked), verifyKeywords)
+	if err != nil {
+		t.Fatalf("couldn't compare: %v", err)
+	}
+
+	expected := []LayerDiscrepancy{
+		{Path: "bar", Type: "modified", Keywords: []string{"nlink", "xattr.user.foo"}},
+		{Path: "foo", Type: "missing"},
+		{Path: "qux", Type: "extra"},
+	}
+
+	discrepancies := layerDiscrepancies(deltas, nil)
+	if !reflect.DeepEqual(discrepancies, expected) {
+		t.Fatalf("bad discrepancies %v, expected %v", discrepancies, expected)
+	}
+
+	// user.foo isn't supposed to be in the layer, so it isn't missing
+	xattrs, err := parseXattrNamespaces([]string{"security"})
+	if err != nil {
+		t.Fatalf("couldn't parse namespaces: %v", err)
+	}
+
+	expected[0].Keywords = []string{"nlink"}
+	discrepancies = layerDiscrepancies(deltas, xattrs)
+	if !reflect.DeepEqual(discrepancies, expected) {
+		t.Fatalf("bad discrepancies %v, expected %v", discrepancies, expected)
+	}
+}
@@ -0,0 +1,177 @@
+package stacker
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fileStamp is what we look at to decide whether a file has changed. We poll
+// rather than use inotify, since imports can be arbitrarily large trees and
+// inotify needs a watch per directory.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+	mode    os.FileMode
+}
+
+type watchSnapshot map[string]fileStamp
+
+func (ws watchSnapshot) equals(other watchSnapshot) bool {
+	if len(ws) != len(other) {
+		return false
+	}
+
+	for p, stamp := range ws {
+		otherStamp, ok := other[p]
+		if !ok || !stamp.modTime.Equal(otherStamp.modTime) || stamp.size != otherStamp.size || stamp.mode != otherStamp.mode {
+			return false
+		}
+	}
+
+	return true
+}
+
+func takeWatchSnapshot(paths []string) watchSnapshot {
+	ws := watchSnapshot{}
+	for _, p := range paths {
+		// Files that don't exist (yet) or that we can't read are simply
+		// missing from the snapshot, so that they show up as a change
+		// when they appear.
+		filepath.Walk(p, func(walked string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+
+			ws[walked] = fileStamp{modTime: info.ModTime(), size: info.Size(), mode: info.Mode()}
+			return nil
+		})
+	}
+	return ws
+}
+
+// watchedPaths returns the local files that the build of the stackerfiles at
+// paths depends on: the stackerfiles themselves (and their prerequisites),
+// any substitution files, and any local imports.
+func watchedPaths(paths []string, opts *BuildArgs) ([]string, error) {
+	sfOpts, err := opts.stackerfileOpts()
+	if err != nil {
+		return nil, err
+	}
+
+	sfs, err := NewStackerFilesWithOpts(paths, sfOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	watched := append([]string{}, opts.SubstituteFiles...)
+	for p, sf := range sfs {
+		watched = append(watched, p)
+
+		includes, err := sf.includePaths()
+		if err != nil {
+			return nil, err
+		}
+		for _, inc := range includes {
+			if filepath.IsAbs(inc) {
+				watched = append(watched, inc)
+			}
+		}
+
+		for _, l := range sf.internal {
+			imports, err := l.ParseImport()
+			if err != nil {
+				return nil, err
+			}
+
+			for _, imp := range imports {
+				parsed, err := url.Parse(imp)
+				if err != nil {
+					return nil, err
+				}
+
+				if parsed.Scheme != "" {
+					continue
+				}
+
+				watched = append(watched, imp)
+			}
+		}
+	}
+
+	return watched, nil
+}
+
+// Watch builds the stackerfiles at paths, and then rebuilds them whenever one
+// of them, a substitution file, or one of their local imports changes, until
+// ctx is cancelled. Changes are polled for every interval, and a rebuild only
+// starts once nothing has changed for the debounce period, so that e.g. an
+// editor saving several files results in one rebuild. Build failures are
+// reported, but don't stop the watch; the error of a build that ctx
+// interrupted is returned.
+func Watch(ctx context.Context, opts *BuildArgs, paths []string, interval time.Duration, debounce time.Duration) error {
+	// Only honor --no-cache for the first build; the point of watching is
+	// to have the cache make the rebuilds fast.
+	buildOpts := *opts
+
+	watched := append(append([]string{}, paths...), opts.SubstituteFiles...)
+	for {
+		builder := NewBuilder(&buildOpts)
+		builder.SetContext(ctx)
+		err := builder.BuildMultiple(paths)
+		buildOpts.NoCache = false
+
+		if ctx.Err() != nil {
+			return err
+		}
+
+		rebuilt := []string{}
+		for _, sfr := range builder.Report().Stackerfiles {
+			for _, lr := range sfr.Layers {
+				if !lr.Cached {
+					rebuilt = append(rebuilt, lr.Name)
+				}
+			}
+		}
+
+		if err != nil {
+			warnf(opts.Config, "build failed: %v\n", err)
+		}
+		infof(opts.Config, "rebuilt layers: %v\n", rebuilt)
+
+		// If the stackerfile is broken, keep watching what we were
+		// watching before (which includes it), so that fixing it
+		// triggers a rebuild.
+		newWatched, err := watchedPaths(paths, opts)
+		if err == nil {
+			watched = newWatched
+		}
+
+		infof(opts.Config, "watching %d paths for changes...\n", len(watched))
+
+		last := takeWatchSnapshot(watched)
+		changedAt := time.Time{}
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(interval):
+			}
+
+			current := takeWatchSnapshot(watched)
+			if !current.equals(last) {
+				changedAt = time.Now()
+				last = current
+				continue
+			}
+
+			if !changedAt.IsZero() && time.Since(changedAt) >= debounce {
+				break
+			}
+		}
+
+		infof(opts.Config, "change detected, rebuilding\n")
+	}
+}
@@ -0,0 +1,293 @@
+package stacker
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// paxSchilyXattr is the prefix of the PAX records tar uses for xattrs.
+const paxSchilyXattr = "SCHILY.xattr."
+
+// xattrNamespaceRoots are the xattr namespaces the kernel knows about; every
+// namespace that can be preserved is one of these or is inside one.
+var xattrNamespaceRoots = []string{"security.", "system.", "trusted.", "user."}
+
+// squashfsXattrNamespaces are the xattr namespaces squashfs can store; it
+// has no way to represent anything else (in particular, POSIX ACLs).
+var squashfsXattrNamespaces = []string{"security.", "trusted.", "user."}
+
+// xattrFilter decides which xattrs are preserved. A nil *xattrFilter keeps
+// all of them.
+type xattrFilter struct {
+	prefixes []string
+}
+
+// parseXattrNamespaces parses namespaces like "security", "user.*" or
+// "system.posix_acl_*" into an xattrFilter. An empty list keeps all xattrs,
+// and "none" keeps none of them.
+func parseXattrNamespaces(namespaces []string) (*xattrFilter, error) {
+	if len(namespaces) == 0 {
+		return nil, nil
+	}
+
+	f := &xattrFilter{prefixes: []string{}}
+	for _, ns := range namespaces {
+		if ns == "none" {
+			if len(namespaces) != 1 {
+				return nil, errors.Errorf("xattr namespace none can't be combined with other namespaces")
+			}
+			return f, nil
+		}
+
+		prefix := strings.TrimSuffix(ns, "*")
+		switch {
+		case prefix == "system.posix_acl":
+			// both system.posix_acl_access and
+			// system.posix_acl_default
+			prefix += "_"
+		case !strings.Contains(prefix, "."):
+			prefix += "."
+		}
+
+		known := false
+		for _, root := range xattrNamespaceRoots {
+			if strings.HasPrefix(prefix, root) {
+				known = true
+				break
+			}
+		}
+
+		if !known {
+			return nil, errors.Errorf("unknown xattr namespace %s (it must be in one of %s)", ns, strings.Join(xattrNamespaceRoots, ", "))
+		}
+
+		f.prefixes = append(f.prefixes, prefix)
+	}
+
+	return f, nil
+}
+
+// keep returns whether the xattr name is preserved.
+func (f *xattrFilter) keep(name string) bool {
+	if f == nil {
+		return true
+	}
+
+	for _, prefix := range f.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keepsAll returns whether every xattr in the namespace ns is preserved.
+func (f *xattrFilter) keepsAll(ns string) bool {
+	if f == nil {
+		return true
+	}
+
+	for _, prefix := range f.prefixes {
+		if strings.HasPrefix(ns, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keepsAny returns whether any xattr in the namespace ns is preserved.
+func (f *xattrFilter) keepsAny(ns string) bool {
+	if f == nil {
+		return true
+	}
+
+	for _, prefix := range f.prefixes {
+		if strings.HasPrefix(ns, prefix) || strings.HasPrefix(prefix, ns) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// xattrFilter returns the filter for opts.Xattrs; it has been checked by
+// checkXattrs when the build started.
+func (opts *BuildArgs) xattrFilter() *xattrFilter {
+	f, _ := parseXattrNamespaces(opts.Xattrs)
+	return f
+}
+
+// checkXattrs checks opts.Xattrs, and warns about the xattrs it asks for that
+// the layer type can't represent.
+func (opts *BuildArgs) checkXattrs() error {
+	f, err := parseXattrNamespaces(opts.Xattrs)
+	if err != nil {
+		return err
+	}
+
+	if f == nil || opts.LayerType != "squashfs" {
+		return nil
+	}
+
+	for _, prefix := range f.prefixes {
+		supported := false
+		for _, ns := range squashfsXattrNamespaces {
+			if strings.HasPrefix(prefix, ns) {
+				supported = true
+				break
+			}
+		}
+
+		if !supported {
+			warnf(opts.Config, "warning: squashfs layers can't store %s* xattrs, they will be left out\n", prefix)
+		}
+	}
+
+	for _, ns := range squashfsXattrNamespaces {
+		if f.keepsAny(ns) && !f.keepsAll(ns) {
+			warnf(opts.Config, "warning: mksquashfs can't leave out only some %s* xattrs, squashfs layers will have all of them\n", ns)
+		}
+	}
+
+	return nil
+}
+
+// squashfsXattrs returns whether squashfs layers should have xattrs at all;
+// mksquashfs can only keep or leave out all of them.
+func (f *xattrFilter) squashfsXattrs() bool {
+	for _, ns := range squashfsXattrNamespaces {
+		if f.keepsAny(ns) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterTarXattrs removes the xattrs that f doesn't keep from the entries of
+// the tar stream r. r is closed once it has been rewritten.
+func filterTarXattrs(r io.ReadCloser, f *xattrFilter) io.ReadCloser {
+	if f == nil {
+		return r
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		defer r.Close()
+		writer.CloseWithError(writeFilteredTar(r, f, writer))
+	}()
+	return reader
+}
+
+func writeFilteredTar(r io.Reader, f *xattrFilter, w io.Writer) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		// the reader fills in both, and the writer writes both
+		for k := range hdr.Xattrs {
+			if !f.keep(k) {
+				delete(hdr.Xattrs, k)
+			}
+		}
+
+		for k := range hdr.PAXRecords {
+			if strings.HasPrefix(k, paxSchilyXattr) && !f.keep(strings.TrimPrefix(k, paxSchilyXattr)) {
+				delete(hdr.PAXRecords, k)
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// stripXattrs removes the xattrs that f doesn't keep from everything in
+// rootfs.
+func stripXattrs(rootfs string, f *xattrFilter) error {
+	if f == nil {
+		return nil
+	}
+
+	return filepath.Walk(rootfs, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		xattrs, err := lgetxattrs(p)
+		if err != nil {
+			return err
+		}
+
+		for name := range xattrs {
+			if f.keep(name) {
+				continue
+			}
+
+			if err := unix.Lremovexattr(p, name); err != nil {
+				return errors.Wrapf(err, "couldn't remove xattr %s from %s", name, p)
+			}
+		}
+
+		return nil
+	})
+}
+
+// lgetxattrs returns the xattrs of p (without following symlinks).
+func lgetxattrs(p string) (map[string]string, error) {
+	sz, err := unix.Llistxattr(p, nil)
+	if err != nil || sz == 0 {
+		// no xattr support in this filesystem means no xattrs
+		return map[string]string{}, nil
+	}
+
+	buf := make([]byte, sz)
+	sz, err = unix.Llistxattr(p, buf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't list xattrs of %s", p)
+	}
+
+	xattrs := map[string]string{}
+	for _, name := range strings.Split(string(buf[:sz]), "\x00") {
+		if name == "" {
+			continue
+		}
+
+		vsz, err := unix.Lgetxattr(p, name, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't get xattr %s of %s", name, p)
+		}
+
+		value := make([]byte, vsz)
+		vsz, err = unix.Lgetxattr(p, name, value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't get xattr %s of %s", name, p)
+		}
+
+		xattrs[name] = string(value[:vsz])
+	}
+
+	return xattrs, nil
+}
@@ -0,0 +1,105 @@
+package stacker
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestParseXattrNamespaces(t *testing.T) {
+	f, err := parseXattrNamespaces(nil)
+	if err != nil || f != nil {
+		t.Fatalf("no namespaces should keep everything: %v %v", f, err)
+	}
+
+	f, err = parseXattrNamespaces([]string{"security", "user.*", "system.posix_acl_*"})
+	if err != nil {
+		t.Fatalf("couldn't parse namespaces: %v", err)
+	}
+
+	expected := []string{"security.", "user.", "system.posix_acl_"}
+	if !reflect.DeepEqual(f.prefixes, expected) {
+		t.Fatalf("bad prefixes %v, expected %v", f.prefixes, expected)
+	}
+
+	for name, keep := range map[string]bool{
+		"security.capability":      true,
+		"user.foo":                 true,
+		"system.posix_acl_access":  true,
+		"system.posix_acl_default": true,
+		"system.nfs4_acl":          false,
+		"trusted.overlay.opaque":   false,
+		"userfoo":                  false,
+	} {
+		if f.keep(name) != keep {
+			t.Errorf("keep(%s) should be %v", name, keep)
+		}
+	}
+
+	if !f.squashfsXattrs() {
+		t.Errorf("squashfs layers should have xattrs")
+	}
+
+	f, err = parseXattrNamespaces([]string{"none"})
+	if err != nil {
+		t.Fatalf("couldn't parse none: %v", err)
+	}
+
+	if f.keep("security.capability") || f.squashfsXattrs() {
+		t.Errorf("none shouldn't keep anything")
+	}
+
+	if _, err := parseXattrNamespaces([]string{"none", "user"}); err == nil {
+		t.Errorf("none with other namespaces should fail")
+	}
+
+	if _, err := parseXattrNamespaces([]string{"foo"}); err == nil {
+		t.Errorf("unknown namespace should fail")
+	}
+}
+
+func TestFilterTarXattrs(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := tw.WriteHeader(&tar.Header{
+		Name:     "foo",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     3,
+		Xattrs: map[string]string{
+			"security.capability": "cap",
+			"user.foo":            "bar",
+		},
+	})
+	if err != nil {
+		t.Fatalf("couldn't write header: %v", err)
+	}
+	tw.Write([]byte("foo"))
+	tw.Close()
+
+	f, err := parseXattrNamespaces([]string{"security"})
+	if err != nil {
+		t.Fatalf("couldn't parse namespaces: %v", err)
+	}
+
+	r := filterTarXattrs(ioutil.NopCloser(&buf), f)
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("couldn't read filtered tar: %v", err)
+	}
+
+	expected := map[string]string{"security.capability": "cap"}
+	if !reflect.DeepEqual(hdr.Xattrs, expected) {
+		t.Fatalf("bad xattrs %v, expected %v", hdr.Xattrs, expected)
+	}
+
+	content, err := ioutil.ReadAll(tr)
+	if err != nil || string(content) != "foo" {
+		t.Fatalf("bad content %q: %v", content, err)
+	}
+}
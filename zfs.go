@@ -0,0 +1,197 @@
+package stacker
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// zfsSafeName is what layer names can be as zfs dataset names as they are.
+var zfsSafeName = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+// zfs keeps each container in a dataset under the config's ZFSDataset,
+// mounted at its path in RootFSDir. Snapshots are read only clones of a zfs
+// snapshot of their source, and restoring one is a writable clone of it.
+type zfs struct {
+	c    StackerConfig
+	lock *Lock
+}
+
+func newZFS(c StackerConfig, lock *Lock) (Storage, error) {
+	if c.ZFSDataset == "" {
+		return nil, fmt.Errorf("zfs storage needs zfs_dataset set to the dataset to keep the rootfses under")
+	}
+
+	if err := os.MkdirAll(c.RootFSDir, 0755); err != nil {
+		return nil, err
+	}
+
+	if _, err := zfsCommand(c, "list", "-H", "-o", "name", c.ZFSDataset); err != nil {
+		return nil, err
+	}
+
+	return &zfs{c: c, lock: lock}, nil
+}
+
+func zfsCommand(c StackerConfig, args ...string) (string, error) {
+	output, err := exec.Command(c.ToolPath(ToolZFS), args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("zfs %s: %s: %s", args[0], err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// dataset is the dataset the container name is kept in.
+func (z *zfs) dataset(name string) string {
+	if !zfsSafeName.MatchString(name) {
+		name = fmt.Sprintf("stacker-%x", sha256.Sum256([]byte(name)))[:40]
+	}
+	return path.Join(z.c.ZFSDataset, name)
+}
+
+func (z *zfs) Name() string {
+	return "zfs"
+}
+
+func (z *zfs) Create(source string) error {
+	_, err := zfsCommand(z.c, "create", "-o", "mountpoint="+path.Join(z.c.RootFSDir, source), z.dataset(source))
+	return err
+}
+
+// clone makes target a clone of a new snapshot of source.
+func (z *zfs) clone(source string, target string, readonly bool) error {
+	snapshot := fmt.Sprintf("%s@%s", z.dataset(source), path.Base(z.dataset(target)))
+	if _, err := zfsCommand(z.c, "snapshot", snapshot); err != nil {
+		return err
+	}
+
+	ro := "readonly=off"
+	if readonly {
+		ro = "readonly=on"
+	}
+
+	_, err := zfsCommand(z.c, "clone", "-o", ro, "-o", "mountpoint="+path.Join(z.c.RootFSDir, target), snapshot, z.dataset(target))
+	if err != nil {
+		zfsCommand(z.c, "destroy", snapshot)
+		return err
+	}
+
+	return nil
+}
+
+func (z *zfs) Snapshot(source string, target string) error {
+	if err := z.clone(source, target, true); err != nil {
+		return err
+	}
+
+	// the source is usually the working container, which is deleted
+	// right after; the snapshot it was cloned from becomes the target's,
+	// so that it doesn't depend on the source
+	_, err := zfsCommand(z.c, "promote", z.dataset(target))
+	return err
+}
+
+func (z *zfs) Restore(source string, target string) error {
+	return z.clone(source, target, false)
+}
+
+// Delete destroys the container name's dataset, after handing each of its
+// snapshots that other containers were cloned from over to one of them.
+func (z *zfs) Delete(name string) error {
+	dataset := z.dataset(name)
+	if _, err := zfsCommand(z.c, "list", "-H", "-o", "name", dataset); err != nil {
+		// nothing to delete
+		return os.RemoveAll(path.Join(z.c.RootFSDir, name))
+	}
+
+	for {
+		output, err := zfsCommand(z.c, "list", "-H", "-t", "snapshot", "-d", "1", "-o", "clones", dataset)
+		if err != nil {
+			return err
+		}
+
+		clone := ""
+		for _, line := range strings.Split(output, "\n") {
+			clones := strings.TrimSpace(line)
+			if clones != "" && clones != "-" {
+				clone = strings.Split(clones, ",")[0]
+				break
+			}
+		}
+
+		if clone == "" {
+			break
+		}
+
+		if _, err := zfsCommand(z.c, "promote", clone); err != nil {
+			return err
+		}
+	}
+
+	origin, err := zfsCommand(z.c, "get", "-H", "-o", "value", "origin", dataset)
+	if err != nil {
+		return err
+	}
+
+	if _, err := zfsCommand(z.c, "destroy", "-r", dataset); err != nil {
+		return err
+	}
+
+	// the snapshot it was cloned from isn't needed anymore either, unless
+	// something else was cloned from it too
+	if origin = strings.TrimSpace(origin); origin != "-" {
+		zfsCommand(z.c, "destroy", origin)
+	}
+
+	return os.RemoveAll(path.Join(z.c.RootFSDir, name))
+}
+
+func (z *zfs) Detach() error {
+	// the datasets stay mounted, like a btrfs that isn't a loopback
+	return z.lock.Unlock()
+}
+
+func (z *zfs) Mountpoints() ([]string, error) {
+	output, err := zfsCommand(z.c, "list", "-H", "-o", "mountpoint", "-d", "1", z.c.ZFSDataset)
+	if err != nil {
+		return nil, err
+	}
+
+	mountpoints := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		if line != "" {
+			mountpoints = append(mountpoints, line)
+		}
+	}
+
+	return mountpoints, nil
+}
+
+func (z *zfs) Exists(thing string) bool {
+	_, err := os.Stat(path.Join(z.c.RootFSDir, thing))
+	return err == nil
+}
+
+// cleanZFS destroys all of the datasets under the config's ZFSDataset.
+func cleanZFS(config StackerConfig) error {
+	output, err := zfsCommand(config, "list", "-H", "-o", "name", "-d", "1", config.ZFSDataset)
+	if err != nil {
+		return err
+	}
+
+	for _, ds := range strings.Split(strings.TrimSpace(output), "\n") {
+		if ds == "" || ds == config.ZFSDataset {
+			continue
+		}
+
+		if _, err := zfsCommand(config, "destroy", "-R", ds); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
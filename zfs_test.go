@@ -0,0 +1,23 @@
+package stacker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestZFSDataset(t *testing.T) {
+	z := &zfs{c: StackerConfig{ZFSDataset: "tank/stacker"}}
+
+	if ds := z.dataset("foo-1.0"); ds != "tank/stacker/foo-1.0" {
+		t.Errorf("bad dataset %s", ds)
+	}
+
+	ds := z.dataset("foo/bar baz")
+	if !strings.HasPrefix(ds, "tank/stacker/stacker-") || strings.Count(ds, "/") != 2 {
+		t.Errorf("bad dataset for an unsafe name %s", ds)
+	}
+
+	if ds == z.dataset("foo/bar qux") {
+		t.Errorf("different names with the same dataset %s", ds)
+	}
+}